@@ -5,6 +5,7 @@
 package chihaya
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -78,12 +79,63 @@ type AnnounceRequest struct {
 	IPv4, IPv6 net.IP
 	Port       uint16
 
-	Compact bool
-	NumWant int32
+	// Key is the key parameter of the announce, which identifies the client
+	// across changes of its address or port. It is empty if the client sent
+	// none.
+	Key string
+
+	// IPv6Port is the port of the IPv6 endpoint if it differs from Port,
+	// e.g. because the client supplied it with its IPv6 address as
+	// described in BEP 7. It is zero otherwise.
+	IPv6Port uint16
+
+	Compact  bool
+	NoPeerID bool
+	NumWant  int32
+
+	// Crypto is the support of the client for encrypted connections, as it
+	// announced it with the supportcrypto and requirecrypto parameters.
+	Crypto Crypto
 
 	Left, Downloaded, Uploaded uint64
 
+	// ClientCertName identifies the verified TLS client certificate the
+	// request was made with. It is empty unless the frontend requires client
+	// certificates.
+	ClientCertName string
+
+	// Passkey is the passkey a frontend received as part of the announce
+	// URL, if any.
+	Passkey string
+
+	// UserID identifies the user the request was authenticated as by
+	// middleware. It is empty if the request has not been authenticated.
+	UserID string
+
 	Params Params
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. It is never nil; it defaults
+// to the background context.
+func (r *AnnounceRequest) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+//
+// It panics if ctx is nil.
+func (r *AnnounceRequest) WithContext(ctx context.Context) *AnnounceRequest {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 // Peer4 returns a Peer using the IPv4 endpoint of the Announce.
@@ -91,9 +143,11 @@ type AnnounceRequest struct {
 // the returned Peer can be nil.
 func (r *AnnounceRequest) Peer4() Peer {
 	return Peer{
-		IP:   r.IPv4,
-		Port: r.Port,
-		ID:   r.PeerID,
+		IP:     r.IPv4,
+		Port:   r.Port,
+		ID:     r.PeerID,
+		Key:    r.Key,
+		Crypto: r.Crypto,
 	}
 }
 
@@ -101,10 +155,16 @@ func (r *AnnounceRequest) Peer4() Peer {
 // Note that, if the Announce does not contain an IPv6 address, the IP field of
 // the returned Peer can be nil.
 func (r *AnnounceRequest) Peer6() Peer {
+	port := r.Port
+	if r.IPv6Port != 0 {
+		port = r.IPv6Port
+	}
 	return Peer{
-		IP:   r.IPv6,
-		Port: r.Port,
-		ID:   r.PeerID,
+		IP:     r.IPv6,
+		Port:   port,
+		ID:     r.PeerID,
+		Key:    r.Key,
+		Crypto: r.Crypto,
 	}
 }
 
@@ -118,12 +178,55 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   []Peer
 	IPv6Peers   []Peer
+
+	// Warnings are messages for the user of the client, e.g. that its
+	// ratio is low, which do not fail the announce. Middleware appends to
+	// them; frontends that support warnings send all of them, joined in the
+	// order they were added. They are dropped if the announce fails.
+	Warnings []string
 }
 
 // ScrapeRequest represents the parsed parameters from a scrape request.
 type ScrapeRequest struct {
 	InfoHashes []InfoHash
-	Params     Params
+
+	// Full is set for scrapes of all swarms, i.e. scrapes without any
+	// infohashes, which frontends only accept if they are configured to.
+	Full bool
+
+	IPv4 net.IP
+	IPv6 net.IP
+
+	// ClientCertName, Passkey and UserID are set like the fields of the
+	// same names of an AnnounceRequest.
+	ClientCertName string
+	Passkey        string
+	UserID         string
+
+	Params Params
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. It is never nil; it defaults
+// to the background context.
+func (r *ScrapeRequest) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+//
+// It panics if ctx is nil.
+func (r *ScrapeRequest) WithContext(ctx context.Context) *ScrapeRequest {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 // ScrapeResponse represents the parameters used to create a scrape response.
@@ -135,6 +238,7 @@ type ScrapeResponse struct {
 type Scrape struct {
 	Complete   int32
 	Incomplete int32
+	Downloaded int32
 }
 
 // Peer represents the connection details of a peer that is returned in an
@@ -143,6 +247,41 @@ type Peer struct {
 	ID   PeerID
 	IP   net.IP
 	Port uint16
+
+	// Key is the key the peer announced with, if any. Unlike the endpoint,
+	// it stays the same when the peer's address or port changes, so that
+	// PeerStores can replace the entry of the peer rather than adding
+	// another one. It is never handed out to other peers.
+	Key string
+
+	// Crypto is the support of the peer for encrypted connections. PeerStores
+	// keep it with the peer to prefer the peers that support encryption for
+	// announcers that require it. The peers returned for announces have it
+	// set to CryptoSupported if the PeerStore knows that they support it.
+	Crypto Crypto
+}
+
+// Crypto is the support of a client for encrypted connections, as described
+// in BEP 8.
+type Crypto uint8
+
+const (
+	// CryptoNone is the Crypto of clients that did not announce any
+	// support for encrypted connections.
+	CryptoNone Crypto = iota
+
+	// CryptoSupported is the Crypto of clients that announced supportcrypto
+	// and accept both plain and encrypted connections.
+	CryptoSupported
+
+	// CryptoRequired is the Crypto of clients that announced requirecrypto
+	// and only accept encrypted connections. They support them, too.
+	CryptoRequired
+)
+
+// Supported reports whether c supports encrypted connections.
+func (c Crypto) Supported() bool {
+	return c != CryptoNone
 }
 
 // Equal reports whether p and x are the same.
@@ -6,28 +6,47 @@ package main
 
 import (
 	"flag"
-	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server"
 	"github.com/chihaya/chihaya/tracker"
 
 	// Servers
+	_ "github.com/chihaya/chihaya/server/admin"
 	_ "github.com/chihaya/chihaya/server/http"
 	_ "github.com/chihaya/chihaya/server/prometheus"
 	_ "github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/bolt"
+	_ "github.com/chihaya/chihaya/server/store/cluster"
+	_ "github.com/chihaya/chihaya/server/store/memcached"
 	_ "github.com/chihaya/chihaya/server/store/memory"
+	_ "github.com/chihaya/chihaya/server/store/postgres"
+	_ "github.com/chihaya/chihaya/server/store/redis"
+	_ "github.com/chihaya/chihaya/server/udp"
+	_ "github.com/chihaya/chihaya/server/webtorrent"
 
 	// Middleware
+	_ "github.com/chihaya/chihaya/middleware/anonymize"
 	_ "github.com/chihaya/chihaya/middleware/deniability"
+	_ "github.com/chihaya/chihaya/middleware/ipoverride"
+	_ "github.com/chihaya/chihaya/middleware/jitter"
+	_ "github.com/chihaya/chihaya/middleware/mininterval"
+	_ "github.com/chihaya/chihaya/middleware/ratelimit"
+	_ "github.com/chihaya/chihaya/middleware/swarmgrace"
+	_ "github.com/chihaya/chihaya/middleware/torrentpolicy"
 	_ "github.com/chihaya/chihaya/middleware/varinterval"
 	_ "github.com/chihaya/chihaya/server/store/middleware/client"
 	_ "github.com/chihaya/chihaya/server/store/middleware/infohash"
+	_ "github.com/chihaya/chihaya/server/store/middleware/internalpeers"
 	_ "github.com/chihaya/chihaya/server/store/middleware/ip"
+	_ "github.com/chihaya/chihaya/server/store/middleware/passkey"
+	_ "github.com/chihaya/chihaya/server/store/middleware/ratio"
 	_ "github.com/chihaya/chihaya/server/store/middleware/response"
 	_ "github.com/chihaya/chihaya/server/store/middleware/swarm"
 )
@@ -46,10 +65,10 @@ func main() {
 	flag.Parse()
 
 	if cpuprofile != "" {
-		log.Println("profiling...")
+		log.Info("profiling", "path", cpuprofile)
 		f, err := os.Create(cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatal("failed to create cpu profile", "error", err)
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
@@ -57,21 +76,88 @@ func main() {
 
 	cfg, err := chihaya.OpenConfigFile(configPath)
 	if err != nil {
-		log.Fatal("failed to load config: " + err.Error())
+		log.Fatal("failed to load config", "error", err)
+	}
+
+	logger, err := log.New(os.Stderr, cfg.Log)
+	if err != nil {
+		log.Fatal("failed to create logger", "error", err)
+	}
+	log.SetDefault(logger)
+
+	mask, err := ipmask.New(cfg.AnonymizeIPs)
+	if err != nil {
+		log.Fatal("failed to configure the anonymization of IPs", "error", err)
+	}
+	ipmask.SetDefault(mask)
+
+	err = cfg.Tracker.Validate()
+	if err != nil {
+		log.Fatal("invalid tracker config", "error", err)
 	}
 
 	tkr, err := tracker.NewTracker(&cfg.Tracker)
 	if err != nil {
-		log.Fatal("failed to create tracker: " + err.Error())
+		log.Fatal("failed to create tracker", "error", err)
 	}
 
 	pool, err := server.StartPool(cfg.Servers, tkr)
 	if err != nil {
-		log.Fatal("failed to create server pool: " + err.Error())
+		log.Fatal("failed to create server pool", "error", err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-reload:
+			reloadTracker(tkr)
+		case <-interrupt:
+			pool.Stop()
+			return
+		case <-terminate:
+			// Another signal cuts the drain short.
+			abort := make(chan struct{})
+			go func() {
+				select {
+				case <-interrupt:
+				case <-terminate:
+				}
+				close(abort)
+			}()
+			pool.DrainAndStop(tkr, tkr.Config().DrainWindow, abort)
+			return
+		}
+	}
+}
+
+// reloadTracker replaces the middleware of tkr with the middleware of the
+// configuration file. The middleware is left unchanged if the file or any of
+// its middleware can not be loaded.
+//
+// Only the tracker section of the file is reloaded, changes to the servers
+// require a restart.
+func reloadTracker(tkr *tracker.Tracker) {
+	cfg, err := chihaya.OpenConfigFile(configPath)
+	if err != nil {
+		log.Error("failed to reload config, keeping the previous one", "error", err)
+		return
+	}
+	err = cfg.Tracker.Validate()
+	if err != nil {
+		log.Error("invalid tracker config, keeping the previous one", "error", err)
+		return
 	}
 
-	shutdown := make(chan os.Signal)
-	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
-	<-shutdown
-	pool.Stop()
+	err = tkr.Reload(&cfg.Tracker)
+	if err != nil {
+		log.Error("failed to reload tracker, keeping the previous middleware", "error", err)
+		return
+	}
+	log.Info("reloaded tracker middleware")
 }
@@ -5,12 +5,19 @@
 package chihaya
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/pkg/log"
 )
 
 // DefaultConfig is a sane configuration used as a fallback or for testing.
@@ -26,17 +33,65 @@ var DefaultConfig = Config{
 
 // Config represents the global configuration of a chihaya binary.
 type Config struct {
-	Tracker TrackerConfig  `yaml:"tracker"`
-	Servers []ServerConfig `yaml:"servers"`
+	Log          log.Config     `yaml:"log"`
+	AnonymizeIPs ipmask.Config  `yaml:"anonymize_ips"`
+	Tracker      TrackerConfig  `yaml:"tracker"`
+	Servers      []ServerConfig `yaml:"servers"`
 }
 
+// MinSafeInterval is the shortest announce interval that is not warned about.
+// Shorter intervals multiply the load of the tracker for little benefit.
+const MinSafeInterval = time.Minute
+
 // TrackerConfig represents the configuration of protocol-agnostic BitTorrent
 // Tracker used by Servers started by chihaya.
 type TrackerConfig struct {
-	AnnounceInterval    time.Duration      `yaml:"announce"`
-	MinAnnounceInterval time.Duration      `yaml:"min_announce"`
-	AnnounceMiddleware  []MiddlewareConfig `yaml:"announce_middleware"`
-	ScrapeMiddleware    []MiddlewareConfig `yaml:"scrape_middleware"`
+	// AnnounceInterval is the interval clients are told to announce at, and
+	// MinAnnounceInterval the interval they must not announce more often
+	// than. Both must be positive, and MinAnnounceInterval must not exceed
+	// AnnounceInterval.
+	AnnounceInterval    time.Duration `yaml:"announce"`
+	MinAnnounceInterval time.Duration `yaml:"min_announce"`
+
+	// DrainInterval caps the intervals handed out while the tracker is
+	// draining, so that clients re-announce elsewhere soon. It defaults to
+	// one minute.
+	DrainInterval time.Duration `yaml:"drain_interval"`
+	// DrainWindow is the time the tracker drains for after SIGTERM before
+	// the servers are stopped. If it is zero, they are stopped right away.
+	DrainWindow time.Duration `yaml:"drain_window"`
+
+	// TraceMiddleware records the time each middleware takes for a request,
+	// and whether it passed the request on or aborted it. The records are
+	// logged at the debug level. It is off by default, as it slows down
+	// every request.
+	TraceMiddleware bool `yaml:"trace_middleware"`
+
+	AnnounceMiddleware []MiddlewareConfig `yaml:"announce_middleware"`
+	ScrapeMiddleware   []MiddlewareConfig `yaml:"scrape_middleware"`
+}
+
+// Validate checks the intervals of cfg. It warns about intervals shorter than
+// MinSafeInterval, but accepts them.
+func (cfg *TrackerConfig) Validate() error {
+	if cfg.AnnounceInterval <= 0 {
+		return errors.New("tracker: announce must be positive")
+	}
+	if cfg.MinAnnounceInterval <= 0 {
+		return errors.New("tracker: min_announce must be positive")
+	}
+	if cfg.MinAnnounceInterval > cfg.AnnounceInterval {
+		return fmt.Errorf("tracker: min_announce (%s) must not exceed announce (%s)", cfg.MinAnnounceInterval, cfg.AnnounceInterval)
+	}
+	if cfg.DrainInterval < 0 {
+		return errors.New("tracker: drain_interval must not be negative")
+	}
+
+	if cfg.MinAnnounceInterval < MinSafeInterval {
+		log.Warn("tracker: min_announce is very short, clients may overload the tracker",
+			"min_announce", cfg.MinAnnounceInterval, "recommended_minimum", MinSafeInterval)
+	}
+	return nil
 }
 
 // MiddlewareConfig represents the configuration of a middleware used by
@@ -59,12 +114,20 @@ type ConfigFile struct {
 }
 
 // DecodeConfigFile unmarshals an io.Reader into a new Config.
+//
+// References to environment variables are expanded before the YAML is
+// decoded, see ExpandEnv.
 func DecodeConfigFile(r io.Reader) (*Config, error) {
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
+	contents, err = ExpandEnv(contents)
+	if err != nil {
+		return nil, err
+	}
+
 	cfgFile := &ConfigFile{}
 	err = yaml.Unmarshal(contents, cfgFile)
 	if err != nil {
@@ -74,6 +137,95 @@ func DecodeConfigFile(r io.Reader) (*Config, error) {
 	return &cfgFile.Chihaya, nil
 }
 
+// ExpandEnv replaces the references to environment variables in the contents
+// of a configuration file with their values.
+//
+// ${VAR} is replaced with the value of VAR, and an error naming VAR is
+// returned if it is not set. ${VAR:-default} is replaced with default if VAR
+// is unset or empty. $${ is replaced with a literal ${. Any other $ is kept,
+// so that literal values do not need to be escaped. Lines that only hold a
+// comment are kept as they are.
+//
+// Values are inserted as they are, so values that may contain YAML syntax
+// should be referenced in quotes.
+func ExpandEnv(contents []byte) ([]byte, error) {
+	var expanded bytes.Buffer
+	for i, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			expanded.Write(line)
+			continue
+		}
+
+		err := expandLine(&expanded, string(line))
+		if err != nil {
+			return nil, fmt.Errorf("config: line %d: %s", i+1, err)
+		}
+	}
+	return expanded.Bytes(), nil
+}
+
+// expandLine writes line to w with its references to environment variables
+// expanded.
+func expandLine(w *bytes.Buffer, line string) error {
+	for {
+		i := strings.Index(line, "${")
+		if i < 0 {
+			w.WriteString(line)
+			return nil
+		}
+
+		if i > 0 && line[i-1] == '$' {
+			w.WriteString(line[:i])
+			w.WriteString("{")
+			line = line[i+len("${"):]
+			continue
+		}
+		w.WriteString(line[:i])
+		line = line[i+len("${"):]
+
+		end := strings.Index(line, "}")
+		if end < 0 {
+			return errors.New("unterminated reference to an environment variable")
+		}
+		ref := line[:end]
+		line = line[end+len("}"):]
+
+		name, def, hasDefault := ref, "", false
+		if j := strings.Index(ref, ":-"); j >= 0 {
+			name, def, hasDefault = ref[:j], ref[j+len(":-"):], true
+		}
+		if !validEnvName(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+
+		value, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && value == "":
+			value = def
+		case !ok:
+			return fmt.Errorf("environment variable %s is not set", name)
+		}
+		w.WriteString(value)
+	}
+}
+
+// validEnvName reports whether name is a valid name of an environment
+// variable in a reference.
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // OpenConfigFile returns a new Config given the path to a YAML configuration
 // file.
 // It supports relative and absolute paths and environment variables.
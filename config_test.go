@@ -0,0 +1,127 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package chihaya
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CHIHAYA_TEST_SET", "value")
+	t.Setenv("CHIHAYA_TEST_EMPTY", "")
+
+	var table = []struct {
+		in, expected string
+		err          bool
+	}{
+		{"literal", "literal", false},
+		{"pa$$word $HOME $", "pa$$word $HOME $", false},
+		{"${CHIHAYA_TEST_SET}", "value", false},
+		{"a-${CHIHAYA_TEST_SET}-${CHIHAYA_TEST_SET}", "a-value-value", false},
+		{"${CHIHAYA_TEST_EMPTY}", "", false},
+		{"${CHIHAYA_TEST_SET:-default}", "value", false},
+		{"${CHIHAYA_TEST_EMPTY:-default}", "default", false},
+		{"${CHIHAYA_TEST_UNSET:-default}", "default", false},
+		{"${CHIHAYA_TEST_UNSET:-}", "", false},
+		{"${CHIHAYA_TEST_UNSET:-a:-b}", "a:-b", false},
+		{"$${CHIHAYA_TEST_SET}", "${CHIHAYA_TEST_SET}", false},
+		{"${CHIHAYA_TEST_UNSET}", "", true},
+		{"${}", "", true},
+		{"${1VAR}", "", true},
+		{"${CHIHAYA TEST}", "", true},
+		{"${CHIHAYA_TEST_SET", "", true},
+		{"${CHIHAYA_TEST_SET\n}", "", true},
+		{"# ${CHIHAYA_TEST_UNSET}\n  # ${CHIHAYA_TEST_SET}", "# ${CHIHAYA_TEST_UNSET}\n  # ${CHIHAYA_TEST_SET}", false},
+		{"a: ${CHIHAYA_TEST_SET} # ${CHIHAYA_TEST_SET}", "a: value # value", false},
+	}
+
+	for _, tt := range table {
+		got, err := ExpandEnv([]byte(tt.in))
+		if tt.err {
+			require.NotNil(t, err, tt.in)
+			continue
+		}
+		require.Nil(t, err, tt.in)
+		require.Equal(t, tt.expected, string(got), tt.in)
+	}
+}
+
+func TestExpandEnvMissing(t *testing.T) {
+	_, err := ExpandEnv([]byte("a: 1\nb: ${CHIHAYA_TEST_UNSET}\n"))
+	require.NotNil(t, err)
+	require.Equal(t, "config: line 2: environment variable CHIHAYA_TEST_UNSET is not set", err.Error())
+}
+
+func TestDecodeConfigFileEnv(t *testing.T) {
+	t.Setenv("CHIHAYA_TEST_ANNOUNCE", "15m")
+	t.Setenv("CHIHAYA_TEST_PASSWORD", "s3cr#t: $")
+
+	cfg, err := DecodeConfigFile(strings.NewReader(`
+chihaya:
+  tracker:
+    announce: ${CHIHAYA_TEST_ANNOUNCE}
+    min_announce: ${CHIHAYA_TEST_MIN_ANNOUNCE:-5m}
+  servers:
+    - name: http
+      config:
+        addr: 127.0.0.1:6881
+        password: "${CHIHAYA_TEST_PASSWORD}"
+`))
+	require.Nil(t, err)
+	require.Equal(t, 15*time.Minute, cfg.Tracker.AnnounceInterval)
+	require.Equal(t, 5*time.Minute, cfg.Tracker.MinAnnounceInterval)
+	require.Equal(t, 1, len(cfg.Servers))
+
+	serverCfg, ok := cfg.Servers[0].Config.(map[interface{}]interface{})
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:6881", serverCfg["addr"])
+	require.Equal(t, "s3cr#t: $", serverCfg["password"])
+
+	f, err := os.Open("config_example.yaml")
+	require.Nil(t, err)
+	defer f.Close()
+	_, err = DecodeConfigFile(f)
+	require.Nil(t, err, "the example config must decode without any environment")
+
+	_, err = DecodeConfigFile(strings.NewReader("chihaya:\n  tracker:\n    announce: ${CHIHAYA_TEST_UNSET}\n"))
+	require.NotNil(t, err)
+}
+
+func TestTrackerConfigValidate(t *testing.T) {
+	var table = []struct {
+		announce, minAnnounce, drain time.Duration
+		valid                        bool
+	}{
+		{30 * time.Minute, 20 * time.Minute, 0, true},
+		{10 * time.Minute, 10 * time.Minute, time.Minute, true},
+		// intervals below MinSafeInterval are warned about, not rejected
+		{30 * time.Second, 10 * time.Second, 0, true},
+		{0, 20 * time.Minute, 0, false},
+		{30 * time.Minute, 0, 0, false},
+		{-time.Minute, -2 * time.Minute, 0, false},
+		{10 * time.Minute, 20 * time.Minute, 0, false},
+		{30 * time.Minute, 20 * time.Minute, -time.Minute, false},
+	}
+
+	for _, tt := range table {
+		cfg := TrackerConfig{AnnounceInterval: tt.announce, MinAnnounceInterval: tt.minAnnounce, DrainInterval: tt.drain}
+		err := cfg.Validate()
+		require.Equal(t, tt.valid, err == nil, "announce %s, min_announce %s, drain_interval %s: %v", tt.announce, tt.minAnnounce, tt.drain, err)
+	}
+
+	require.Nil(t, DefaultConfig.Tracker.Validate())
+
+	f, err := os.Open("config_example.yaml")
+	require.Nil(t, err)
+	defer f.Close()
+	cfg, err := DecodeConfigFile(f)
+	require.Nil(t, err)
+	require.Nil(t, cfg.Tracker.Validate())
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package anonymize implements a middleware that replaces the peer IDs of
+// announces with salted hashes, so that the tracker neither stores nor hands
+// out the peer IDs of its clients.
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("anonymize_peer_id", constructor)
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// anonymize the peer IDs of announces.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	salt := []byte(cfg.Salt)
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			req.PeerID = hashPeerID(salt, req.PeerID)
+
+			// Peer IDs of other peers are hashes now, which are of no
+			// use to clients.
+			req.NoPeerID = true
+
+			log.DebugContext(req.Context(), "anonymize_peer_id: anonymized peer ID", "peer_id", hex.EncodeToString(req.PeerID[:4]))
+			return next(tcfg, req, resp)
+		}
+	}, nil
+}
+
+// hashPeerID returns the HMAC-SHA256 of peerID with salt, truncated to the
+// length of a peer ID. It is the same for every announce of a peer, so that
+// the PeerStore finds the peer it stored before.
+func hashPeerID(salt []byte, peerID chihaya.PeerID) chihaya.PeerID {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(peerID[:])
+	return chihaya.PeerIDFromBytes(mac.Sum(nil)[:len(peerID)])
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package anonymize
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+const salt = "0123456789abcdef"
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		config interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{"salt": salt}, true},
+		{map[string]interface{}{"salt": strings.Repeat("x", 64)}, true},
+		{map[string]interface{}{"salt": "short"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range table {
+		_, err := newConfig(chihaya.MiddlewareConfig{Config: tt.config})
+		require.Equal(t, tt.valid, err == nil, "%v", tt.config)
+	}
+}
+
+func TestHashPeerID(t *testing.T) {
+	id := chihaya.PeerIDFromString("-TEST01-000000000001")
+	other := chihaya.PeerIDFromString("-TEST01-000000000002")
+
+	hashed := hashPeerID([]byte(salt), id)
+	require.NotEqual(t, id, hashed)
+	require.Equal(t, hashed, hashPeerID([]byte(salt), id))
+	require.NotEqual(t, hashed, hashPeerID([]byte(salt), other))
+	require.NotEqual(t, hashed, hashPeerID([]byte("fedcba9876543210"), id))
+}
+
+// TestReannounce makes sure that the peers of anonymized announces are
+// matched across announces by the PeerStore, and that they are stored under
+// their hashes only.
+func TestReannounce(t *testing.T) {
+	ps, err := store.OpenPeerStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	defer func() {
+		require.Nil(t, <-ps.Stop())
+	}()
+
+	mw, err := constructor(chihaya.MiddlewareConfig{Config: map[string]interface{}{"salt": salt}})
+	require.Nil(t, err)
+	handler := mw(func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		if req.Left == 0 {
+			return ps.PutSeeder(req.InfoHash, req.Peer4())
+		}
+		return ps.PutLeecher(req.InfoHash, req.Peer4())
+	})
+
+	hash := chihaya.InfoHash{1}
+	id := chihaya.PeerIDFromString("-TEST01-000000000001")
+	announce := func(left uint64) *chihaya.AnnounceRequest {
+		req := &chihaya.AnnounceRequest{
+			InfoHash: hash,
+			PeerID:   id,
+			IPv4:     net.IPv4(10, 0, 0, 1).To4(),
+			Port:     6881,
+			Left:     left,
+		}
+		require.Nil(t, handler(&chihaya.TrackerConfig{}, req, &chihaya.AnnounceResponse{}))
+		require.True(t, req.NoPeerID)
+		return req
+	}
+
+	announce(10)
+	announce(10)
+	require.Equal(t, 1, ps.NumLeechers(hash))
+
+	// The leecher that finishes is moved to the seeders rather than joining
+	// them as another peer.
+	req := announce(0)
+	require.Equal(t, 0, ps.NumLeechers(hash))
+	require.Equal(t, 1, ps.NumSeeders(hash))
+
+	seeders, _, err := ps.GetSeeders(hash)
+	require.Nil(t, err)
+	require.Len(t, seeders, 1)
+	require.Equal(t, hashPeerID([]byte(salt), id), seeders[0].ID)
+	require.Equal(t, req.PeerID, seeders[0].ID)
+}
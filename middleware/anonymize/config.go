@@ -0,0 +1,45 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package anonymize
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// minSaltLength is the length of the shortest salt accepted. Shorter salts
+// could be guessed, which would allow telling the hashes of known peer IDs.
+const minSaltLength = 16
+
+// Config represents the configuration for the anonymize middleware.
+type Config struct {
+	// Salt is the secret the peer IDs are hashed with. Changing it changes
+	// the hashes of all peers, so that they are in their swarms twice until
+	// their old entries expire.
+	Salt string `yaml:"salt"`
+}
+
+// newConfig parses the given MiddlewareConfig as an anonymize.Config.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Salt) < minSaltLength {
+		return nil, fmt.Errorf("anonymize_peer_id: salt must be at least %d bytes long", minSaltLength)
+	}
+
+	return &cfg, nil
+}
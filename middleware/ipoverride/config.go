@@ -0,0 +1,71 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ipoverride
+
+import (
+	"errors"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// ErrUnknownMode is returned by the MiddlewareConstructor if the Mode
+// specified in the configuration is unknown.
+var ErrUnknownMode = errors.New("unknown mode")
+
+// Mode represents the policy for client-supplied IPs.
+type Mode string
+
+const (
+	// ModeIgnore makes the middleware ignore client-supplied IPs, i.e. only
+	// the address the request was sent from is used.
+	ModeIgnore = Mode("ignore")
+
+	// ModePrivate makes the middleware use client-supplied IPs only if they
+	// are private addresses, i.e. in one of the RFC 1918 networks or, for
+	// IPv6, fc00::/7.
+	ModePrivate = Mode("private")
+
+	// ModeTrust makes the middleware use all client-supplied IPs.
+	ModeTrust = Mode("trust")
+)
+
+// Config represents the configuration for the ipoverride middleware.
+type Config struct {
+	Mode Mode `yaml:"mode"`
+
+	// DualStack makes the middleware add the address clients supply in the
+	// ipv6 parameter of BEP 7 to announces that were not sent over IPv6,
+	// regardless of the Mode. The address the announce was sent from is
+	// kept, so that the client is in the swarm with both addresses.
+	DualStack bool `yaml:"dual_stack"`
+}
+
+// newConfig parses the given MiddlewareConfig as an ipoverride.Config.
+// The mode defaults to ModeIgnore, ErrUnknownMode is returned if it is
+// unknown.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeIgnore
+	case ModeIgnore, ModePrivate, ModeTrust:
+	default:
+		return nil, ErrUnknownMode
+	}
+
+	return &cfg, nil
+}
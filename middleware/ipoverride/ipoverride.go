@@ -0,0 +1,142 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ipoverride
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("ip_override", constructor)
+}
+
+// privateNetworks are the networks client-supplied IPs must be in with
+// ModePrivate.
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// apply client-supplied IPs to announces according to the configured Mode.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			if cfg.Mode != ModeIgnore || cfg.DualStack {
+				err := override(cfg, req)
+				if err != nil {
+					return err
+				}
+			}
+
+			return next(tcfg, req, resp)
+		}
+	}, nil
+}
+
+// override replaces the IPs of req with the ones supplied in its ip, ipv4
+// and ipv6 parameters, if the mode of cfg allows them. Later parameters take
+// precedence over earlier ones for the same address family.
+// With DualStack, the ipv6 parameter is used for announces that were not sent
+// over IPv6 even if the mode does not allow it.
+//
+// Malformed parameters, addresses of the wrong family and IPv6 addresses
+// other peers can not connect to fail the announce.
+func override(cfg *Config, req *chihaya.AnnounceRequest) error {
+	if req.Params == nil {
+		return nil
+	}
+	sentOverIPv6 := req.IPv6 != nil
+
+	for _, param := range []string{"ip", "ipv4", "ipv6"} {
+		dualStack := param == "ipv6" && cfg.DualStack && !sentOverIPv6
+		if cfg.Mode == ModeIgnore && !dualStack {
+			continue
+		}
+
+		str, err := req.Params.String(param)
+		if err != nil || str == "" {
+			continue
+		}
+
+		ip, port := parseIP(str)
+		if ip == nil {
+			return tracker.ClientError("failed to parse parameter: " + param)
+		}
+
+		v4 := ip.To4()
+		if (param == "ipv4" && v4 == nil) || (param == "ipv6" && (v4 != nil || !isReachable(ip))) {
+			return tracker.ClientError("failed to provide valid " + param)
+		}
+
+		if !dualStack && (cfg.Mode == ModeIgnore || cfg.Mode == ModePrivate && !isPrivate(ip)) {
+			continue
+		}
+
+		if v4 != nil {
+			req.IPv4 = v4
+		} else {
+			req.IPv6 = ip
+			if param == "ipv6" {
+				req.IPv6Port = port
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseIP parses an IP that is optionally followed by a port, as clients are
+// allowed to supply for ipv4 and ipv6. The port is zero if there is none.
+func parseIP(str string) (net.IP, uint16) {
+	host, portStr, err := net.SplitHostPort(str)
+	if err != nil {
+		return net.ParseIP(str), 0
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), uint16(port)
+}
+
+// isReachable reports whether other peers can connect to the IPv6 address ip,
+// i.e. whether it is neither unspecified, nor link-local, nor multicast.
+func isReachable(ip net.IP) bool {
+	return !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast()
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
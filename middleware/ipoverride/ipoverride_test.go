@@ -0,0 +1,152 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ipoverride
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+type params map[string]string
+
+func (p params) String(key string) (string, error) {
+	if v, ok := p[key]; ok {
+		return v, nil
+	}
+	return "", errors.New("not found")
+}
+
+var (
+	remote4 = net.ParseIP("203.0.113.1").To4()
+	remote6 = net.ParseIP("2001:db8::1")
+)
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		config   interface{}
+		expected Mode
+		err      error
+	}{
+		{nil, ModeIgnore, nil},
+		{map[string]interface{}{"mode": "ignore"}, ModeIgnore, nil},
+		{map[string]interface{}{"mode": "private"}, ModePrivate, nil},
+		{map[string]interface{}{"mode": "trust"}, ModeTrust, nil},
+		{map[string]interface{}{"mode": "always"}, "", ErrUnknownMode},
+	}
+
+	for _, tt := range table {
+		cfg, err := newConfig(chihaya.MiddlewareConfig{Config: tt.config})
+		require.Equal(t, tt.err, err)
+		if err == nil {
+			require.Equal(t, tt.expected, cfg.Mode)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	var table = []struct {
+		mode   Mode
+		params params
+		v4, v6 net.IP
+		err    error
+	}{
+		// ignore uses the remote address only
+		{ModeIgnore, params{"ip": "10.0.0.1"}, remote4, remote6, nil},
+		{ModeIgnore, params{"ip": "invalid"}, remote4, remote6, nil},
+
+		// private only accepts private addresses
+		{ModePrivate, params{"ip": "10.0.0.1"}, net.ParseIP("10.0.0.1").To4(), remote6, nil},
+		{ModePrivate, params{"ipv4": "192.168.1.1:6881", "ipv6": "[fd00::1]:6881"}, net.ParseIP("192.168.1.1").To4(), net.ParseIP("fd00::1"), nil},
+		{ModePrivate, params{"ip": "198.51.100.1"}, remote4, remote6, nil},
+		{ModePrivate, params{"ipv6": "2001:db8::2"}, remote4, remote6, nil},
+		{ModePrivate, params{"ip": "invalid"}, nil, nil, tracker.ClientError("failed to parse parameter: ip")},
+
+		// trust accepts all addresses
+		{ModeTrust, params{"ip": "198.51.100.1"}, net.ParseIP("198.51.100.1").To4(), remote6, nil},
+		{ModeTrust, params{"ip": "198.51.100.1", "ipv4": "198.51.100.2"}, net.ParseIP("198.51.100.2").To4(), remote6, nil},
+		{ModeTrust, params{"ipv6": "2001:db8::2"}, remote4, net.ParseIP("2001:db8::2"), nil},
+		{ModeTrust, params{"ipv4": "2001:db8::2"}, nil, nil, tracker.ClientError("failed to provide valid ipv4")},
+		{ModeTrust, params{"ipv6": "198.51.100.1"}, nil, nil, tracker.ClientError("failed to provide valid ipv6")},
+		{ModeTrust, params{"ipv6": "[::1"}, nil, nil, tracker.ClientError("failed to parse parameter: ipv6")},
+		{ModeTrust, params{"ipv6": "[2001:db8::2]:port"}, nil, nil, tracker.ClientError("failed to parse parameter: ipv6")},
+
+		// IPv6 addresses other peers can not connect to are rejected
+		{ModeTrust, params{"ipv6": "fe80::1"}, nil, nil, tracker.ClientError("failed to provide valid ipv6")},
+		{ModeTrust, params{"ipv6": "[::]:6881"}, nil, nil, tracker.ClientError("failed to provide valid ipv6")},
+		{ModePrivate, params{"ipv6": "ff02::1"}, nil, nil, tracker.ClientError("failed to provide valid ipv6")},
+	}
+
+	for _, tt := range table {
+		mw, err := constructor(chihaya.MiddlewareConfig{Config: Config{Mode: tt.mode}})
+		require.Nil(t, err)
+
+		var achain tracker.AnnounceChain
+		achain.Append(mw)
+		req := &chihaya.AnnounceRequest{IPv4: remote4, IPv6: remote6, Params: tt.params}
+
+		err = achain.Handler()(nil, req, &chihaya.AnnounceResponse{})
+		require.Equal(t, tt.err, err, "%s %v", tt.mode, tt.params)
+		if err != nil {
+			continue
+		}
+		require.Equal(t, tt.v4, req.IPv4, "%s %v", tt.mode, tt.params)
+		require.Equal(t, tt.v6, req.IPv6, "%s %v", tt.mode, tt.params)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	var table = []struct {
+		mode   Mode
+		sent6  net.IP
+		params params
+		v4, v6 net.IP
+		port6  uint16
+		err    error
+	}{
+		// announces sent over IPv4 get the supplied IPv6 address added
+		{ModeIgnore, nil, params{"ipv6": "2001:db8::2"}, remote4, net.ParseIP("2001:db8::2"), 0, nil},
+		{ModeIgnore, nil, params{"ipv6": "[2001:db8::2]:6882"}, remote4, net.ParseIP("2001:db8::2"), 6882, nil},
+		{ModePrivate, nil, params{"ipv6": "2001:db8::2"}, remote4, net.ParseIP("2001:db8::2"), 0, nil},
+
+		// the other parameters still follow the mode
+		{ModeIgnore, nil, params{"ip": "198.51.100.1", "ipv4": "invalid", "ipv6": "2001:db8::2"}, remote4, net.ParseIP("2001:db8::2"), 0, nil},
+		{ModeTrust, nil, params{"ipv4": "198.51.100.1", "ipv6": "2001:db8::2"}, net.ParseIP("198.51.100.1").To4(), net.ParseIP("2001:db8::2"), 0, nil},
+
+		// announces sent over IPv6 keep their address unless the mode
+		// allows replacing it
+		{ModeIgnore, remote6, params{"ipv6": "2001:db8::2"}, remote4, remote6, 0, nil},
+		{ModeTrust, remote6, params{"ipv6": "[2001:db8::2]:6882"}, remote4, net.ParseIP("2001:db8::2"), 6882, nil},
+
+		// unreachable addresses fail the announce
+		{ModeIgnore, nil, params{"ipv6": "fe80::1%eth0"}, nil, nil, 0, tracker.ClientError("failed to parse parameter: ipv6")},
+		{ModeIgnore, nil, params{"ipv6": "fe80::1"}, nil, nil, 0, tracker.ClientError("failed to provide valid ipv6")},
+		{ModeIgnore, nil, params{"ipv6": "::"}, nil, nil, 0, tracker.ClientError("failed to provide valid ipv6")},
+		{ModeIgnore, nil, params{"ipv6": "198.51.100.1"}, nil, nil, 0, tracker.ClientError("failed to provide valid ipv6")},
+	}
+
+	for _, tt := range table {
+		mw, err := constructor(chihaya.MiddlewareConfig{Config: Config{Mode: tt.mode, DualStack: true}})
+		require.Nil(t, err)
+
+		var achain tracker.AnnounceChain
+		achain.Append(mw)
+		req := &chihaya.AnnounceRequest{IPv4: remote4, IPv6: tt.sent6, Port: 6881, Params: tt.params}
+
+		err = achain.Handler()(nil, req, &chihaya.AnnounceResponse{})
+		require.Equal(t, tt.err, err, "%s %v", tt.mode, tt.params)
+		if err != nil {
+			continue
+		}
+		require.Equal(t, tt.v4, req.IPv4, "%s %v", tt.mode, tt.params)
+		require.Equal(t, tt.v6, req.IPv6, "%s %v", tt.mode, tt.params)
+		require.Equal(t, tt.port6, req.IPv6Port, "%s %v", tt.mode, tt.params)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package jitter
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// Config represents the configuration for the jitter middleware.
+type Config struct {
+	// Percentage is the maximum deviation of the returned interval from the
+	// base interval, in percent of the base interval.
+	Percentage float64 `yaml:"percentage"`
+}
+
+// newConfig parses the given MiddlewareConfig as a jitter.Config.
+//
+// The contents of the config are not checked.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package jitter
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("interval_jitter", constructor)
+}
+
+type jitterMiddleware struct {
+	cfg *Config
+
+	// r is not safe for concurrent use, so it is guarded by mu.
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// randomize announce intervals around their base value.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Percentage <= 0 || cfg.Percentage > 100 {
+		return nil, errors.New("percentage must be in (0,100]")
+	}
+
+	mw := newJitterMiddleware(cfg, rand.NewSource(time.Now().UnixNano()))
+	return mw.modifyResponse, nil
+}
+
+func newJitterMiddleware(cfg *Config, src rand.Source) *jitterMiddleware {
+	return &jitterMiddleware{
+		cfg: cfg,
+		r:   rand.New(src),
+	}
+}
+
+func (mw *jitterMiddleware) modifyResponse(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		err := next(cfg, req, resp)
+		if err != nil {
+			return err
+		}
+
+		resp.Interval = mw.jitter(resp.Interval)
+		if resp.Interval < resp.MinInterval {
+			resp.Interval = resp.MinInterval
+		}
+
+		return nil
+	}
+}
+
+// jitter returns a random interval of whole seconds within the configured
+// percentage of base.
+func (mw *jitterMiddleware) jitter(base time.Duration) time.Duration {
+	maxDelta := int64(float64(base/time.Second) * mw.cfg.Percentage / 100)
+	if maxDelta <= 0 {
+		return base
+	}
+
+	mw.mu.Lock()
+	delta := mw.r.Int63n(2*maxDelta+1) - maxDelta
+	mw.mu.Unlock()
+
+	return base + time.Duration(delta)*time.Second
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package jitter
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestConstructor(t *testing.T) {
+	var table = []struct {
+		cfg   Config
+		error bool
+	}{
+		{Config{10}, false},
+		{Config{100}, false},
+		{Config{0}, true},
+		{Config{-5}, true},
+		{Config{100.5}, true},
+	}
+
+	for _, tt := range table {
+		_, err := constructor(chihaya.MiddlewareConfig{
+			Config: tt.cfg,
+		})
+
+		if tt.error {
+			assert.NotNil(t, err, fmt.Sprintf("error expected for %+v", tt.cfg))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("no error expected for %+v", tt.cfg))
+		}
+	}
+}
+
+func TestModifyResponse(t *testing.T) {
+	var table = []struct {
+		percentage      float64
+		interval, min   time.Duration
+		lowest, highest time.Duration
+	}{
+		{10, 30 * time.Minute, 0, 27 * time.Minute, 33 * time.Minute},
+		{50, 30 * time.Minute, 20 * time.Minute, 20 * time.Minute, 45 * time.Minute},
+		{100, 30 * time.Minute, 5 * time.Minute, 5 * time.Minute, 60 * time.Minute},
+	}
+
+	for _, tt := range table {
+		mw := newJitterMiddleware(&Config{tt.percentage}, rand.NewSource(0))
+		var achain tracker.AnnounceChain
+		achain.Append(func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+			return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+				resp.Interval = tt.interval
+				resp.MinInterval = tt.min
+				return next(cfg, req, resp)
+			}
+		}, mw.modifyResponse)
+		handler := achain.Handler()
+
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			var resp chihaya.AnnounceResponse
+			err := handler(nil, &chihaya.AnnounceRequest{}, &resp)
+			require.Nil(t, err)
+			require.True(t, resp.Interval >= tt.lowest, "interval %s below %s", resp.Interval, tt.lowest)
+			require.True(t, resp.Interval <= tt.highest, "interval %s above %s", resp.Interval, tt.highest)
+			require.True(t, resp.Interval >= tt.min, "interval %s below min_interval %s", resp.Interval, tt.min)
+			require.Equal(t, time.Duration(0), resp.Interval%time.Second)
+			seen[resp.Interval] = true
+		}
+		require.True(t, len(seen) > 100, "intervals are not spread out")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	a := newJitterMiddleware(&Config{20}, rand.NewSource(42))
+	b := newJitterMiddleware(&Config{20}, rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		require.Equal(t, a.jitter(30*time.Minute), b.jitter(30*time.Minute))
+	}
+
+	// intervals too short to vary by a second are kept
+	require.Equal(t, 3*time.Second, a.jitter(3*time.Second))
+}
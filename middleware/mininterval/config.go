@@ -0,0 +1,55 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package mininterval
+
+import (
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// Config represents the configuration for the min_interval middleware.
+type Config struct {
+	// Interval is the time a peer must wait between two announces of the
+	// same torrent. It is capped at the min announce interval of the
+	// tracker, so that clients that honor it are never rejected.
+	Interval time.Duration `yaml:"interval"`
+
+	// Shards is the number of shards the last announce times of the peers
+	// are spread across.
+	Shards int `yaml:"shards"`
+
+	// GCInterval is the interval at which each shard is checked for peers
+	// whose last announce is longer ago than Interval.
+	GCInterval time.Duration `yaml:"gc_interval"`
+}
+
+// newConfig parses the given MiddlewareConfig as a mininterval.Config and
+// applies the defaults of the optional fields.
+//
+// The contents of the config are not checked.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Shards == 0 {
+		cfg.Shards = 16
+	}
+	if cfg.GCInterval == 0 {
+		cfg.GCInterval = time.Minute
+	}
+
+	return &cfg, nil
+}
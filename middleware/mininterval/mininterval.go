@@ -0,0 +1,180 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package mininterval implements a middleware that rejects the announces of
+// peers that re-announce a torrent sooner than allowed.
+package mininterval
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("min_interval", constructor)
+}
+
+// ErrAnnouncedTooSoon is the reason given to peers that re-announce before
+// the minimum interval has passed.
+var ErrAnnouncedTooSoon = tracker.ClientError("announced too soon")
+
+type minIntervalMiddleware struct {
+	cfg    *Config
+	shards []*peerShard
+
+	// clock tells the time. It is only replaced by tests.
+	clock clock.Clock
+}
+
+// peerKey identifies a peer in the swarm of a torrent.
+type peerKey struct {
+	infoHash chihaya.InfoHash
+	peerID   chihaya.PeerID
+}
+
+type peerShard struct {
+	// announced is the time of the last accepted announce of each peer.
+	announced map[peerKey]time.Time
+	swept     time.Time
+	sync.Mutex
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// reject the announces of peers that re-announce a torrent sooner than the
+// configured interval after their last announce.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Interval <= 0 {
+		return nil, errors.New("interval must be > 0")
+	}
+
+	if cfg.Shards < 0 {
+		return nil, errors.New("shards must be > 0")
+	}
+
+	if cfg.GCInterval < 0 {
+		return nil, errors.New("gc_interval must be > 0")
+	}
+
+	mw := newMinIntervalMiddleware(cfg)
+	return mw.enforce, nil
+}
+
+func newMinIntervalMiddleware(cfg *Config) *minIntervalMiddleware {
+	mw := &minIntervalMiddleware{
+		cfg:    cfg,
+		shards: make([]*peerShard, cfg.Shards),
+		clock:  clock.Real,
+	}
+	for i := range mw.shards {
+		mw.shards[i] = &peerShard{announced: make(map[peerKey]time.Time)}
+	}
+	return mw
+}
+
+func (mw *minIntervalMiddleware) enforce(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		k := peerKey{infoHash: req.InfoHash, peerID: req.PeerID}
+
+		// Peers that stop or complete report a change of their state and
+		// must never be rejected, or they would linger in the swarm with
+		// stale state.
+		switch req.Event {
+		case event.Stopped:
+			mw.forget(k, time.Time{})
+			return next(cfg, req, resp)
+		case event.Completed:
+			return next(cfg, req, resp)
+		}
+
+		interval := mw.cfg.Interval
+		if cfg != nil && cfg.MinAnnounceInterval > 0 && cfg.MinAnnounceInterval < interval {
+			interval = cfg.MinAnnounceInterval
+		}
+
+		announced, retryIn, ok := mw.record(k, interval)
+		if !ok {
+			log.DebugContext(req.Context(), "min_interval: rejected early announce", "retry_in", retryIn)
+			return tracker.RetryError{Reason: ErrAnnouncedTooSoon, RetryIn: retryIn}
+		}
+
+		err := next(cfg, req, resp)
+		if err != nil {
+			// Announces that later middleware rejected were not handled,
+			// so they must not delay the next one.
+			mw.forget(k, announced)
+		}
+		return err
+	}
+}
+
+func (mw *minIntervalMiddleware) shard(k peerKey) *peerShard {
+	h := fnv.New32a()
+	h.Write(k.infoHash[:])
+	h.Write(k.peerID[:])
+	return mw.shards[h.Sum32()%uint32(len(mw.shards))]
+}
+
+// record records an announce of the peer k now, unless its last announce was
+// less than interval ago. In that case, it returns false and the time until
+// the peer may announce again.
+func (mw *minIntervalMiddleware) record(k peerKey, interval time.Duration) (now time.Time, retryIn time.Duration, ok bool) {
+	now = mw.clock.Now()
+	shard := mw.shard(k)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if now.Sub(shard.swept) >= mw.cfg.GCInterval {
+		mw.sweep(shard, now)
+	}
+
+	if last, ok := shard.announced[k]; ok {
+		if elapsed := now.Sub(last); elapsed < interval {
+			return now, interval - elapsed, false
+		}
+	}
+
+	shard.announced[k] = now
+	return now, 0, true
+}
+
+// forget deletes the last announce of the peer k if it was recorded at the
+// given time, or regardless of its time if it is zero.
+func (mw *minIntervalMiddleware) forget(k peerKey, announced time.Time) {
+	shard := mw.shard(k)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if last, ok := shard.announced[k]; ok && (announced.IsZero() || last.Equal(announced)) {
+		delete(shard.announced, k)
+	}
+}
+
+// sweep deletes the announces of shard that are longer ago than the interval,
+// as they can not cause any rejections.
+//
+// The caller must hold the lock of shard.
+func (mw *minIntervalMiddleware) sweep(shard *peerShard, now time.Time) {
+	for k, last := range shard.announced {
+		if now.Sub(last) >= mw.cfg.Interval {
+			delete(shard.announced, k)
+		}
+	}
+	shard.swept = now
+}
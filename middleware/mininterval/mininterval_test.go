@@ -0,0 +1,153 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package mininterval
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestConstructor(t *testing.T) {
+	var table = []struct {
+		cfg   Config
+		error bool
+	}{
+		{Config{Interval: time.Minute}, false},
+		{Config{Interval: time.Minute, Shards: 4, GCInterval: time.Second}, false},
+		{Config{}, true},
+		{Config{Interval: -time.Minute}, true},
+		{Config{Interval: time.Minute, Shards: -1}, true},
+		{Config{Interval: time.Minute, GCInterval: -time.Second}, true},
+	}
+
+	for _, tt := range table {
+		_, err := constructor(chihaya.MiddlewareConfig{
+			Config: tt.cfg,
+		})
+
+		if tt.error {
+			assert.NotNil(t, err, fmt.Sprintf("error expected for %+v", tt.cfg))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("no error expected for %+v", tt.cfg))
+		}
+	}
+}
+
+var (
+	ih1   = chihaya.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	ih2   = chihaya.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	peer1 = chihaya.PeerIDFromString("-TEST01-000000000001")
+	peer2 = chihaya.PeerIDFromString("-TEST01-000000000002")
+)
+
+// newTestHandler returns a handler that runs announces through mw and then
+// fails them if *fail is set.
+func newTestHandler(cfg *Config) (*minIntervalMiddleware, *clock.Fake, *bool, tracker.AnnounceHandler) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	mw := newMinIntervalMiddleware(cfg)
+	mw.clock = fake
+
+	var fail bool
+	var achain tracker.AnnounceChain
+	achain.Append(mw.enforce, func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			if fail {
+				return errors.New("failing announce")
+			}
+			return next(cfg, req, resp)
+		}
+	})
+	return mw, fake, &fail, achain.Handler()
+}
+
+func announce(handler tracker.AnnounceHandler, cfg *chihaya.TrackerConfig, ih chihaya.InfoHash, id chihaya.PeerID, e event.Event) error {
+	return handler(cfg, &chihaya.AnnounceRequest{InfoHash: ih, PeerID: id, Event: e}, &chihaya.AnnounceResponse{})
+}
+
+func requireTooSoon(t *testing.T, err error, retryIn time.Duration) {
+	retryErr, ok := err.(tracker.RetryError)
+	require.True(t, ok, "unexpected error %v", err)
+	require.Equal(t, ErrAnnouncedTooSoon, retryErr.Reason)
+	require.Equal(t, retryIn, retryErr.RetryIn)
+}
+
+func TestEnforce(t *testing.T) {
+	_, fake, _, handler := newTestHandler(&Config{Interval: time.Minute, Shards: 4, GCInterval: time.Minute})
+
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Started))
+
+	// Re-announcing too fast is rejected, with the time left until the peer
+	// may announce again.
+	fake.Advance(10 * time.Second)
+	requireTooSoon(t, announce(handler, nil, ih1, peer1, event.None), 50*time.Second)
+
+	// Other peers and other torrents of the same peer are not affected.
+	require.Nil(t, announce(handler, nil, ih1, peer2, event.Started))
+	require.Nil(t, announce(handler, nil, ih2, peer1, event.Started))
+
+	// Rejected announces do not delay the next announce.
+	fake.Advance(50 * time.Second)
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.None))
+	fake.Advance(59 * time.Second)
+	requireTooSoon(t, announce(handler, nil, ih1, peer1, event.None), time.Second)
+	fake.Advance(time.Second)
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.None))
+
+	// Completing and stopping are never rejected, and a stopped peer may
+	// start again right away.
+	fake.Advance(time.Second)
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Completed))
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Stopped))
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Started))
+	requireTooSoon(t, announce(handler, nil, ih1, peer1, event.None), time.Minute)
+}
+
+func TestEnforceTrackerMinInterval(t *testing.T) {
+	_, fake, _, handler := newTestHandler(&Config{Interval: time.Hour, Shards: 1, GCInterval: time.Hour})
+	cfg := &chihaya.TrackerConfig{MinAnnounceInterval: 20 * time.Minute}
+
+	// Peers that honor the min announce interval of the tracker are never
+	// rejected, even if the configured interval is longer.
+	require.Nil(t, announce(handler, cfg, ih1, peer1, event.Started))
+	fake.Advance(19 * time.Minute)
+	requireTooSoon(t, announce(handler, cfg, ih1, peer1, event.None), time.Minute)
+	fake.Advance(time.Minute)
+	require.Nil(t, announce(handler, cfg, ih1, peer1, event.None))
+}
+
+func TestEnforceFailedAnnounce(t *testing.T) {
+	_, fake, fail, handler := newTestHandler(&Config{Interval: time.Minute, Shards: 1, GCInterval: time.Hour})
+
+	// Announces that later middleware fails are not recorded.
+	*fail = true
+	require.NotNil(t, announce(handler, nil, ih1, peer1, event.Started))
+	*fail = false
+	fake.Advance(time.Second)
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Started))
+	requireTooSoon(t, announce(handler, nil, ih1, peer1, event.None), time.Minute)
+}
+
+func TestSweep(t *testing.T) {
+	mw, fake, _, handler := newTestHandler(&Config{Interval: time.Minute, Shards: 1, GCInterval: 2 * time.Minute})
+
+	require.Nil(t, announce(handler, nil, ih1, peer1, event.Started))
+	fake.Advance(2 * time.Minute)
+	require.Nil(t, announce(handler, nil, ih1, peer2, event.Started))
+	require.Len(t, mw.shards[0].announced, 1)
+
+	fake.Advance(30 * time.Second)
+	require.Nil(t, announce(handler, nil, ih2, peer1, event.Started))
+	require.Len(t, mw.shards[0].announced, 2)
+}
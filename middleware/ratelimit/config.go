@@ -0,0 +1,58 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// Config represents the configuration for the ratelimit middleware.
+type Config struct {
+	// Rate is the number of announces per second a client is allowed on
+	// average.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of announces a client is allowed in quick
+	// succession.
+	Burst int `yaml:"burst"`
+
+	// Shards is the number of shards the buckets of the clients are spread
+	// across.
+	Shards int `yaml:"shards"`
+
+	// GCInterval is the interval at which each shard is checked for the
+	// buckets of idle clients.
+	GCInterval time.Duration `yaml:"gc_interval"`
+}
+
+// newConfig parses the given MiddlewareConfig as a ratelimit.Config and
+// applies the defaults of the optional fields.
+//
+// The contents of the config are not checked.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Shards == 0 {
+		cfg.Shards = 16
+	}
+	if cfg.GCInterval == 0 {
+		cfg.GCInterval = time.Minute
+	}
+
+	return &cfg, nil
+}
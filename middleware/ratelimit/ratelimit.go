@@ -0,0 +1,181 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("ratelimit", constructor)
+}
+
+// ErrRateLimited is the reason given to clients that announce too often.
+var ErrRateLimited = tracker.ClientError("rate limit exceeded")
+
+type ratelimitMiddleware struct {
+	cfg    *Config
+	shards []*bucketShard
+
+	// clock tells the time. It is only replaced by tests.
+	clock clock.Clock
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketShard struct {
+	buckets map[string]*bucket
+	swept   time.Time
+	sync.Mutex
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// reject the announces of clients that announce more often than allowed.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Rate <= 0 {
+		return nil, errors.New("rate must be > 0")
+	}
+
+	if cfg.Burst <= 0 {
+		return nil, errors.New("burst must be > 0")
+	}
+
+	if cfg.Shards < 0 {
+		return nil, errors.New("shards must be > 0")
+	}
+
+	if cfg.GCInterval < 0 {
+		return nil, errors.New("gc_interval must be > 0")
+	}
+
+	mw := newRatelimitMiddleware(cfg)
+	return mw.limit, nil
+}
+
+func newRatelimitMiddleware(cfg *Config) *ratelimitMiddleware {
+	mw := &ratelimitMiddleware{
+		cfg:    cfg,
+		shards: make([]*bucketShard, cfg.Shards),
+		clock:  clock.Real,
+	}
+	for i := range mw.shards {
+		mw.shards[i] = &bucketShard{buckets: make(map[string]*bucket)}
+	}
+	return mw
+}
+
+func (mw *ratelimitMiddleware) limit(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		if retryIn, ok := mw.take(key(req)); !ok {
+			log.DebugContext(req.Context(), "ratelimit: rate-limited announce", append(client(req), "retry_in", retryIn)...)
+			return tracker.RetryError{Reason: ErrRateLimited, RetryIn: retryIn}
+		}
+
+		return next(cfg, req, resp)
+	}
+}
+
+// key returns the key of the bucket of the client that sent req.
+//
+// Clients authenticated by middleware that ran before, e.g. passkey, are keyed
+// by their user, so that all of a user's clients share a bucket. Otherwise,
+// the key is the IPv4 address of the client if it has one and its IPv6
+// address if not. Unchecked parameters such as the passkey are never used, as
+// clients could get a new bucket for every announce by changing them.
+func key(req *chihaya.AnnounceRequest) string {
+	if req.UserID != "" {
+		return "user:" + req.UserID
+	}
+	return "ip:" + clientIP(req).String()
+}
+
+// client returns the attributes that identify the client of req in logs, as
+// it is keyed. IPs are logged as net.IP values, so that they are anonymized.
+func client(req *chihaya.AnnounceRequest) []interface{} {
+	if req.UserID != "" {
+		return []interface{}{"key", "user", "user_id", req.UserID}
+	}
+	return []interface{}{"key", "ip", "ip", clientIP(req)}
+}
+
+// clientIP returns the IP a client without a user is keyed by.
+func clientIP(req *chihaya.AnnounceRequest) net.IP {
+	if req.IPv4 != nil {
+		return req.IPv4
+	}
+	return req.IPv6
+}
+
+func (mw *ratelimitMiddleware) shard(key string) *bucketShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return mw.shards[h.Sum32()%uint32(len(mw.shards))]
+}
+
+// take takes a token from the bucket of key. If the bucket is empty, it
+// returns false and the time until the next token is available.
+func (mw *ratelimitMiddleware) take(key string) (retryIn time.Duration, ok bool) {
+	now := mw.clock.Now()
+	shard := mw.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if now.Sub(shard.swept) >= mw.cfg.GCInterval {
+		mw.sweep(shard, now)
+	}
+
+	b, ok := shard.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(mw.cfg.Burst), last: now}
+		shard.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * mw.cfg.Rate
+	if b.tokens > float64(mw.cfg.Burst) {
+		b.tokens = float64(mw.cfg.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / mw.cfg.Rate * float64(time.Second)), false
+	}
+
+	b.tokens--
+	return 0, true
+}
+
+// sweep deletes the buckets of shard that have been refilled completely, as
+// they are indistinguishable from new ones.
+//
+// The caller must hold the lock of shard.
+func (mw *ratelimitMiddleware) sweep(shard *bucketShard, now time.Time) {
+	for key, b := range shard.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*mw.cfg.Rate >= float64(mw.cfg.Burst) {
+			delete(shard.buckets, key)
+		}
+	}
+	shard.swept = now
+}
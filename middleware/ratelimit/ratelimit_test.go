@@ -0,0 +1,176 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestConstructor(t *testing.T) {
+	var table = []struct {
+		cfg   Config
+		error bool
+	}{
+		{Config{Rate: 1, Burst: 10}, false},
+		{Config{Rate: 0.1, Burst: 1, Shards: 4, GCInterval: time.Second}, false},
+		{Config{Rate: 0, Burst: 10}, true},
+		{Config{Rate: 1, Burst: 0}, true},
+		{Config{Rate: 1, Burst: 10, Shards: -1}, true},
+		{Config{Rate: 1, Burst: 10, GCInterval: -time.Second}, true},
+	}
+
+	for _, tt := range table {
+		_, err := constructor(chihaya.MiddlewareConfig{
+			Config: tt.cfg,
+		})
+
+		if tt.error {
+			assert.NotNil(t, err, fmt.Sprintf("error expected for %+v", tt.cfg))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("no error expected for %+v", tt.cfg))
+		}
+	}
+}
+
+type params map[string]string
+
+func (p params) String(key string) (string, error) {
+	if v, ok := p[key]; ok {
+		return v, nil
+	}
+	return "", errors.New("not found")
+}
+
+func newTestHandler(cfg *Config) (*ratelimitMiddleware, *clock.Fake, tracker.AnnounceHandler) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	mw := newRatelimitMiddleware(cfg)
+	mw.clock = fake
+
+	var achain tracker.AnnounceChain
+	achain.Append(mw.limit)
+	return mw, fake, achain.Handler()
+}
+
+func TestLimit(t *testing.T) {
+	const n, burst = 25, 10
+	_, fake, handler := newTestHandler(&Config{Rate: 0.5, Burst: burst, Shards: 4, GCInterval: time.Minute})
+
+	req := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.1").To4()}
+	var rejected int
+	for i := 0; i < n; i++ {
+		err := handler(nil, req, &chihaya.AnnounceResponse{})
+		if err != nil {
+			retryErr, ok := err.(tracker.RetryError)
+			require.True(t, ok, "unexpected error %s", err)
+			require.Equal(t, ErrRateLimited, retryErr.Reason)
+			require.Equal(t, 2*time.Second, retryErr.RetryIn)
+			rejected++
+		}
+	}
+	require.Equal(t, n-burst, rejected)
+
+	// other clients are not affected
+	err := handler(nil, &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.2").To4()}, &chihaya.AnnounceResponse{})
+	require.Nil(t, err)
+
+	// the bucket refills at the configured rate
+	fake.Advance(time.Second)
+	err = handler(nil, req, &chihaya.AnnounceResponse{})
+	retryErr, ok := err.(tracker.RetryError)
+	require.True(t, ok)
+	require.Equal(t, time.Second, retryErr.RetryIn)
+
+	fake.Advance(time.Second)
+	require.Nil(t, handler(nil, req, &chihaya.AnnounceResponse{}))
+	require.NotNil(t, handler(nil, req, &chihaya.AnnounceResponse{}))
+}
+
+func TestLimitPasskey(t *testing.T) {
+	_, _, handler := newTestHandler(&Config{Rate: 0.1, Burst: 2, Shards: 4, GCInterval: time.Minute})
+
+	// unchecked passkeys do not get a client a new bucket
+	for i := 0; i < 10; i++ {
+		passkey := fmt.Sprintf("%032d", i)
+		req := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.1").To4(), Passkey: passkey, Params: params{"passkey": passkey}}
+		err := handler(nil, req, &chihaya.AnnounceResponse{})
+		if i < 2 {
+			require.Nil(t, err)
+		} else {
+			require.NotNil(t, err)
+		}
+	}
+}
+
+func TestLimitUser(t *testing.T) {
+	_, _, handler := newTestHandler(&Config{Rate: 0.1, Burst: 2, Shards: 4, GCInterval: time.Minute})
+
+	a := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.1").To4(), Passkey: "abc", UserID: "alice"}
+	b := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.2").To4(), Passkey: "def", UserID: "alice"}
+
+	// all clients of a user share a bucket
+	require.Nil(t, handler(nil, a, &chihaya.AnnounceResponse{}))
+	require.Nil(t, handler(nil, b, &chihaya.AnnounceResponse{}))
+	require.NotNil(t, handler(nil, a, &chihaya.AnnounceResponse{}))
+
+	// unauthenticated clients are keyed by their IP
+	b.UserID = ""
+	require.Nil(t, handler(nil, b, &chihaya.AnnounceResponse{}))
+}
+
+func TestSweep(t *testing.T) {
+	mw, fake, handler := newTestHandler(&Config{Rate: 1, Burst: 5, Shards: 1, GCInterval: time.Minute})
+
+	idle := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.1").To4()}
+	active := &chihaya.AnnounceRequest{IPv4: net.ParseIP("10.0.0.2").To4()}
+	require.Nil(t, handler(nil, idle, &chihaya.AnnounceResponse{}))
+	require.Len(t, mw.shards[0].buckets, 1)
+
+	// the idle bucket is refilled completely and deleted by the next sweep,
+	// the active bucket is kept
+	fake.Advance(time.Minute)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, handler(nil, active, &chihaya.AnnounceResponse{}))
+	}
+	require.Len(t, mw.shards[0].buckets, 1)
+	_, ok := mw.shards[0].buckets[key(active)]
+	require.True(t, ok)
+}
+
+func TestLimitLogsAnonymizedIPs(t *testing.T) {
+	_, _, handler := newTestHandler(&Config{Rate: 0.1, Burst: 1, Shards: 4, GCInterval: time.Minute})
+
+	mask, err := ipmask.New(ipmask.Config{Enabled: true})
+	require.Nil(t, err)
+	ipmask.SetDefault(mask)
+	defer ipmask.SetDefault(nil)
+
+	var buf bytes.Buffer
+	logger, err := log.New(&buf, log.Config{Level: "debug"})
+	require.Nil(t, err)
+	defer log.SetDefault(log.Default())
+	log.SetDefault(logger)
+
+	req := &chihaya.AnnounceRequest{IPv4: net.ParseIP("192.0.2.55").To4(), Passkey: "0123456789abcdef"}
+	require.Nil(t, handler(nil, req, &chihaya.AnnounceResponse{}))
+	require.NotNil(t, handler(nil, req, &chihaya.AnnounceResponse{}))
+	require.Contains(t, buf.String(), "rate-limited announce")
+	require.Contains(t, buf.String(), "192.0.2.0")
+	require.NotContains(t, buf.String(), "192.0.2.55")
+	require.NotContains(t, buf.String(), req.Passkey)
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package swarmgrace
+
+import (
+	"errors"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// Config represents the configuration for the swarm_grace middleware.
+type Config struct {
+	// MinPeers is the number of seeders and leechers a swarm must reach
+	// before announces are answered with its peers.
+	MinPeers int32 `yaml:"min_peers"`
+
+	// MaxPeers is the number of peers handed out to announces of swarms
+	// below MinPeers. It defaults to 0, which withholds all of them.
+	MaxPeers int32 `yaml:"max_peers"`
+}
+
+// newConfig parses the given MiddlewareConfig as a swarmgrace.Config.
+//
+// An error is returned if MinPeers is not above 1, or MaxPeers is negative
+// or not below MinPeers.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MinPeers < 2 {
+		return nil, errors.New("min_peers must be at least 2")
+	}
+	if cfg.MaxPeers < 0 || cfg.MaxPeers >= cfg.MinPeers {
+		return nil, errors.New("max_peers must be between 0 and min_peers")
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package swarmgrace implements a middleware that withholds the peers of
+// swarms until they have grown to a configured size.
+package swarmgrace
+
+import (
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("swarm_grace", constructor)
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// reduce the peer lists of thin swarms.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return reducePeers(cfg), nil
+}
+
+// reducePeers provides a middleware that cuts the peer lists of responses
+// down to cfg.MaxPeers peers as long as their swarm has fewer than
+// cfg.MinPeers seeders and leechers.
+//
+// The counts of seeders and leechers are left as they are, so that clients
+// see the swarm is alive and announce again.
+func reducePeers(cfg *Config) tracker.AnnounceMiddleware {
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			err := next(tcfg, req, resp)
+			if err != nil {
+				return err
+			}
+
+			if resp.Complete+resp.Incomplete >= cfg.MinPeers {
+				return nil
+			}
+
+			// IPv4 peers are kept before IPv6 peers.
+			limit := int(cfg.MaxPeers)
+			if len(resp.IPv4Peers) > limit {
+				resp.IPv4Peers = resp.IPv4Peers[:limit]
+			}
+			limit -= len(resp.IPv4Peers)
+			if len(resp.IPv6Peers) > limit {
+				resp.IPv6Peers = resp.IPv6Peers[:limit]
+			}
+			return nil
+		}
+	}
+}
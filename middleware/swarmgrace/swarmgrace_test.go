@@ -0,0 +1,105 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package swarmgrace
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		config interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{"min_peers": 5}, true},
+		{map[string]interface{}{"min_peers": 5, "max_peers": 4}, true},
+		{map[string]interface{}{"min_peers": 5, "max_peers": 5}, false},
+		{map[string]interface{}{"min_peers": 5, "max_peers": -1}, false},
+		{map[string]interface{}{"min_peers": 1}, false},
+		{nil, false},
+	}
+
+	for _, tt := range table {
+		_, err := newConfig(chihaya.MiddlewareConfig{Name: "swarm_grace", Config: tt.config})
+		require.Equal(t, tt.valid, err == nil, "config %v", tt.config)
+	}
+}
+
+func peer(id byte) chihaya.Peer {
+	return chihaya.Peer{ID: chihaya.PeerID{id}, IP: net.IPv4(10, 0, 0, id).To4(), Port: 6881}
+}
+
+func peer6(id byte) chihaya.Peer {
+	return chihaya.Peer{ID: chihaya.PeerID{id}, IP: net.ParseIP("fd00::").To16(), Port: 6881}
+}
+
+// swarm is a stand-in for store_response that answers with every peer that
+// announced before, as a leecher.
+type swarm struct {
+	peers, peers6 []chihaya.Peer
+}
+
+func (s *swarm) respond(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		resp.IPv4Peers = append([]chihaya.Peer(nil), s.peers...)
+		resp.IPv6Peers = append([]chihaya.Peer(nil), s.peers6...)
+		if req.IPv4 != nil {
+			s.peers = append(s.peers, req.Peer4())
+		} else {
+			s.peers6 = append(s.peers6, req.Peer6())
+		}
+		resp.Incomplete = int32(len(s.peers) + len(s.peers6))
+		return next(cfg, req, resp)
+	}
+}
+
+func newHandler(t *testing.T, config map[string]interface{}) (tracker.AnnounceHandler, *swarm) {
+	mw, err := constructor(chihaya.MiddlewareConfig{Name: "swarm_grace", Config: config})
+	require.Nil(t, err)
+
+	s := &swarm{}
+	var achain tracker.AnnounceChain
+	achain.Append(mw, s.respond)
+	return achain.Handler(), s
+}
+
+func TestThreshold(t *testing.T) {
+	handler, _ := newHandler(t, map[string]interface{}{"min_peers": 3})
+
+	for id := byte(1); id <= 4; id++ {
+		p := peer(id)
+		resp := &chihaya.AnnounceResponse{}
+		err := handler(nil, &chihaya.AnnounceRequest{PeerID: p.ID, IPv4: p.IP, Port: p.Port}, resp)
+		require.Nil(t, err)
+
+		// the count stays truthful
+		require.Equal(t, int32(id), resp.Incomplete)
+		if id < 3 {
+			require.Equal(t, 0, len(resp.IPv4Peers), "announce %d", id)
+		} else {
+			require.Equal(t, int(id)-1, len(resp.IPv4Peers), "announce %d", id)
+		}
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	handler, s := newHandler(t, map[string]interface{}{"min_peers": 10, "max_peers": 2})
+	s.peers = []chihaya.Peer{peer(1)}
+	s.peers6 = []chihaya.Peer{peer6(2), peer6(3)}
+
+	p := peer(4)
+	resp := &chihaya.AnnounceResponse{}
+	err := handler(nil, &chihaya.AnnounceRequest{PeerID: p.ID, IPv4: p.IP, Port: p.Port}, resp)
+	require.Nil(t, err)
+	require.Equal(t, int32(4), resp.Incomplete)
+	require.Equal(t, []chihaya.Peer{peer(1)}, resp.IPv4Peers)
+	require.Equal(t, []chihaya.Peer{peer6(2)}, resp.IPv6Peers)
+}
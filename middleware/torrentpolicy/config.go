@@ -0,0 +1,70 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package torrentpolicy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// Config represents the configuration for the torrent_policy middleware.
+type Config struct {
+	// Torrents maps hex-encoded infohashes to the policies announces of
+	// their torrents are answered with.
+	Torrents map[string]Policy `yaml:"torrents"`
+}
+
+// Policy overrides the announce policy of the tracker for a torrent. Fields
+// that are not set keep the value of the tracker.
+type Policy struct {
+	// Interval replaces the announce interval of the tracker.
+	Interval time.Duration `yaml:"interval"`
+
+	// MinInterval replaces the min announce interval of the tracker.
+	MinInterval time.Duration `yaml:"min_interval"`
+
+	// MaxNumWant caps the number of peers announces ask for. It can only
+	// lower the maximum of the frontend.
+	MaxNumWant int32 `yaml:"max_numwant"`
+}
+
+// newConfig parses the given MiddlewareConfig as a torrentpolicy.Config and
+// returns the policies by infohash.
+//
+// An error is returned for malformed infohashes and invalid policies.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (map[chihaya.InfoHash]Policy, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[chihaya.InfoHash]Policy, len(cfg.Torrents))
+	for hexInfoHash, p := range cfg.Torrents {
+		b, err := hex.DecodeString(hexInfoHash)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("malformed infohash: %q", hexInfoHash)
+		}
+		if p.Interval < 0 || p.MinInterval < 0 || p.MaxNumWant < 0 {
+			return nil, fmt.Errorf("policy of %s must not be negative", hexInfoHash)
+		}
+		if p.Interval > 0 && p.MinInterval > p.Interval {
+			return nil, fmt.Errorf("min_interval of %s must not exceed its interval", hexInfoHash)
+		}
+		policies[chihaya.InfoHashFromBytes(b)] = p
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package torrentpolicy implements a middleware that overrides the announce
+// intervals and the maximum numwant of the tracker for individual torrents.
+package torrentpolicy
+
+import (
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("torrent_policy", constructor)
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// apply the configured policies to the announces of their torrents.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policies, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyPolicies(policies), nil
+}
+
+// applyPolicies provides a middleware that hands the rest of the chain a
+// TrackerConfig with the intervals of the policy of the torrent announced,
+// and caps its numwant, so that the response is built from them. Announces of
+// torrents without a policy are passed on unchanged.
+func applyPolicies(policies map[chihaya.InfoHash]Policy) tracker.AnnounceMiddleware {
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			p, ok := policies[req.InfoHash]
+			if !ok {
+				return next(cfg, req, resp)
+			}
+
+			overridden := *cfg
+			if p.Interval > 0 {
+				overridden.AnnounceInterval = p.Interval
+			}
+			if p.MinInterval > 0 {
+				overridden.MinAnnounceInterval = p.MinInterval
+			}
+			// Shorter intervals than the min interval of the tracker
+			// lower it, too.
+			if overridden.MinAnnounceInterval > overridden.AnnounceInterval {
+				overridden.MinAnnounceInterval = overridden.AnnounceInterval
+			}
+			if p.MaxNumWant > 0 && req.NumWant > p.MaxNumWant {
+				req.NumWant = p.MaxNumWant
+			}
+
+			return next(&overridden, req, resp)
+		}
+	}
+}
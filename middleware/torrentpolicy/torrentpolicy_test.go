@@ -0,0 +1,125 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package torrentpolicy
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+const (
+	eventHash = "0102030405060708090a0b0c0d0e0f1011121314"
+	otherHash = "1111111111111111111111111111111111111111"
+)
+
+// numWant is the numwant of the last announce that reached the end of the
+// chain.
+var numWant int32
+
+func init() {
+	// The middleware stands in for store_response, which builds the
+	// response from the TrackerConfig it is handed.
+	tracker.RegisterAnnounceMiddleware("torrentpolicy_test_response", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			resp.Interval = cfg.AnnounceInterval
+			resp.MinInterval = cfg.MinAnnounceInterval
+			numWant = req.NumWant
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+func trackerConfig(torrents map[string]interface{}) *chihaya.TrackerConfig {
+	return &chihaya.TrackerConfig{
+		AnnounceInterval:    30 * time.Minute,
+		MinAnnounceInterval: 20 * time.Minute,
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{
+			{Name: "torrent_policy", Config: map[string]interface{}{"torrents": torrents}},
+			{Name: "torrentpolicy_test_response"},
+		},
+	}
+}
+
+func announce(t *testing.T, tkr *tracker.Tracker, hexInfoHash string, numWant int32) *chihaya.AnnounceResponse {
+	b, err := hex.DecodeString(hexInfoHash)
+	require.Nil(t, err)
+	resp, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{
+		InfoHash: chihaya.InfoHashFromBytes(b),
+		NumWant:  numWant,
+	})
+	require.Nil(t, err)
+	return resp
+}
+
+func TestTorrentPolicy(t *testing.T) {
+	tkr, err := tracker.NewTracker(trackerConfig(map[string]interface{}{
+		eventHash: map[string]interface{}{"interval": "5m", "min_interval": "2m", "max_numwant": 20},
+	}))
+	require.Nil(t, err)
+
+	resp := announce(t, tkr, eventHash, 50)
+	require.Equal(t, 5*time.Minute, resp.Interval)
+	require.Equal(t, 2*time.Minute, resp.MinInterval)
+	require.Equal(t, int32(20), numWant)
+
+	resp = announce(t, tkr, eventHash, 10)
+	require.Equal(t, int32(10), numWant)
+
+	// Other torrents get the policy of the tracker.
+	resp = announce(t, tkr, otherHash, 50)
+	require.Equal(t, 30*time.Minute, resp.Interval)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+	require.Equal(t, int32(50), numWant)
+
+	// Policies are replaced when the tracker is reloaded. An interval
+	// below the min interval of the tracker lowers it.
+	require.Nil(t, tkr.Reload(trackerConfig(map[string]interface{}{
+		otherHash: map[string]interface{}{"interval": "10m"},
+	})))
+	resp = announce(t, tkr, eventHash, 50)
+	require.Equal(t, 30*time.Minute, resp.Interval)
+	require.Equal(t, int32(50), numWant)
+	resp = announce(t, tkr, otherHash, 50)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+}
+
+func TestConfig(t *testing.T) {
+	var table = []struct {
+		policy interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{}, true},
+		{map[string]interface{}{"interval": "5m", "min_interval": "5m"}, true},
+		{map[string]interface{}{"min_interval": "1h"}, true},
+		{map[string]interface{}{"interval": "5m", "min_interval": "6m"}, false},
+		{map[string]interface{}{"interval": "-5m"}, false},
+		{map[string]interface{}{"max_numwant": -1}, false},
+	}
+
+	for _, tt := range table {
+		_, err := newConfig(chihaya.MiddlewareConfig{Config: map[string]interface{}{
+			"torrents": map[string]interface{}{eventHash: tt.policy},
+		}})
+		if tt.valid {
+			require.Nil(t, err, "%v", tt.policy)
+		} else {
+			require.NotNil(t, err, "%v", tt.policy)
+		}
+	}
+
+	for _, infoHash := range []string{"", "0102", eventHash + "15", "zz02030405060708090a0b0c0d0e0f1011121314"} {
+		_, err := newConfig(chihaya.MiddlewareConfig{Config: map[string]interface{}{
+			"torrents": map[string]interface{}{infoHash: map[string]interface{}{}},
+		}})
+		require.NotNil(t, err, infoHash)
+	}
+}
@@ -12,67 +12,154 @@ import (
 	"strconv"
 )
 
+var (
+	// ErrMaxDepth is returned when decoding a value that nests dictionaries
+	// and lists deeper than Limits.MaxDepth.
+	ErrMaxDepth = errors.New("bencode: maximum nesting depth exceeded")
+
+	// ErrMaxSize is returned when decoding a value whose bencoding is longer
+	// than Limits.MaxSize.
+	ErrMaxSize = errors.New("bencode: maximum size exceeded")
+
+	// ErrMaxStringLength is returned when decoding a string longer than
+	// Limits.MaxStringLength.
+	ErrMaxStringLength = errors.New("bencode: maximum string length exceeded")
+)
+
+// Limits bounds the values a Decoder decodes, so that hostile input cannot
+// exhaust the memory or the stack of the process. A limit of zero means
+// that the respective dimension is unlimited.
+type Limits struct {
+	// MaxDepth is the number of dictionaries and lists a value may be
+	// nested in.
+	MaxDepth int
+
+	// MaxSize is the number of bytes the bencoding of a value may have.
+	MaxSize int64
+
+	// MaxStringLength is the number of bytes a string may have.
+	MaxStringLength int64
+}
+
+// DefaultLimits are the Limits of NewDecoder and Unmarshal. They are
+// generous enough for the metainfo of any real torrent.
+var DefaultLimits = Limits{
+	MaxDepth:        64,
+	MaxSize:         64 << 20,
+	MaxStringLength: 16 << 20,
+}
+
+// stringChunkSize is the length up to which strings are read into a buffer
+// allocated at once. Longer strings are read into a buffer that grows with
+// the input, so that a length prefix does not allocate more memory than the
+// input actually holds.
+const stringChunkSize = 64 << 10
+
 // A Decoder reads bencoded objects from an input stream.
 type Decoder struct {
-	r *bufio.Reader
+	d decodeState
 }
 
-// NewDecoder returns a new decoder that reads from r.
+// NewDecoder returns a new decoder that reads from r with the DefaultLimits.
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{r: bufio.NewReader(r)}
+	return NewLimitedDecoder(r, DefaultLimits)
 }
 
-// Decode unmarshals the next bencoded value in the stream.
+// NewLimitedDecoder returns a new decoder that reads from r, and rejects
+// every value that exceeds limits.
+func NewLimitedDecoder(r io.Reader, limits Limits) *Decoder {
+	return &Decoder{d: decodeState{r: bufio.NewReader(r), limits: limits}}
+}
+
+// Decode unmarshals the next bencoded value in the stream. The limits apply
+// to each value separately.
 func (dec *Decoder) Decode() (interface{}, error) {
-	return unmarshal(dec.r)
+	dec.d.size, dec.d.depth = 0, 0
+	return dec.d.unmarshal()
 }
 
-// Unmarshal deserializes and returns the bencoded value in buf.
+// Unmarshal deserializes and returns the bencoded value in buf with the
+// DefaultLimits.
 func Unmarshal(buf []byte) (interface{}, error) {
-	r := bufio.NewReader(bytes.NewBuffer(buf))
-	return unmarshal(r)
+	return UnmarshalLimited(buf, DefaultLimits)
 }
 
-// unmarshal reads bencoded values from a bufio.Reader
-func unmarshal(r *bufio.Reader) (interface{}, error) {
-	tok, err := r.ReadByte()
+// UnmarshalLimited deserializes and returns the bencoded value in buf, and
+// rejects it if it exceeds limits.
+func UnmarshalLimited(buf []byte, limits Limits) (interface{}, error) {
+	d := decodeState{r: bufio.NewReader(bytes.NewBuffer(buf)), limits: limits}
+	return d.unmarshal()
+}
+
+// decodeState tracks the size and depth of the value being decoded.
+type decodeState struct {
+	r      *bufio.Reader
+	limits Limits
+	size   int64
+	depth  int
+}
+
+// consume accounts for n more bytes of the value being decoded.
+func (d *decodeState) consume(n int64) error {
+	d.size += n
+	if d.limits.MaxSize > 0 && d.size > d.limits.MaxSize {
+		return ErrMaxSize
+	}
+	return nil
+}
+
+// unmarshal reads the next bencoded value.
+func (d *decodeState) unmarshal() (interface{}, error) {
+	tok, err := d.r.Peek(1)
 	if err != nil {
 		return nil, err
 	}
 
-	switch tok {
+	switch tok[0] {
 	case 'i':
-		return readTerminatedInt(r, 'e')
+		if err := d.skip(); err != nil {
+			return nil, err
+		}
+		return d.readTerminatedInt('e')
 
 	case 'l':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+
 		list := NewList()
 		for {
-			ok, err := readTerminator(r, 'e')
+			ok, err := d.readTerminator('e')
 			if err != nil {
 				return nil, err
 			} else if ok {
 				break
 			}
 
-			v, err := unmarshal(r)
+			v, err := d.unmarshal()
 			if err != nil {
 				return nil, err
 			}
 			list = append(list, v)
 		}
+		d.depth--
 		return list, nil
 
 	case 'd':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+
 		dict := NewDict()
 		for {
-			ok, err := readTerminator(r, 'e')
+			ok, err := d.readTerminator('e')
 			if err != nil {
 				return nil, err
 			} else if ok {
 				break
 			}
 
-			v, err := unmarshal(r)
+			v, err := d.unmarshal()
 			if err != nil {
 				return nil, err
 			}
@@ -82,54 +169,99 @@ func unmarshal(r *bufio.Reader) (interface{}, error) {
 				return nil, errors.New("bencode: non-string map key")
 			}
 
-			dict[key], err = unmarshal(r)
+			dict[key], err = d.unmarshal()
 			if err != nil {
 				return nil, err
 			}
 		}
+		d.depth--
 		return dict, nil
 
 	default:
-		err = r.UnreadByte()
-		if err != nil {
+		length, err := d.readTerminatedInt(':')
+		if err == ErrMaxSize {
 			return nil, err
-		}
-
-		length, err := readTerminatedInt(r, ':')
-		if err != nil {
+		} else if err != nil {
 			return nil, errors.New("bencode: unknown input sequence")
 		}
+		return d.readString(length)
+	}
+}
 
-		buf := make([]byte, length)
-		n, err := r.Read(buf)
-
-		if err != nil {
-			return nil, err
-		} else if int64(n) != length {
-			return nil, errors.New("bencode: short read")
-		}
+// skip consumes the token that has been peeked.
+func (d *decodeState) skip() error {
+	if _, err := d.r.Discard(1); err != nil {
+		return err
+	}
+	return d.consume(1)
+}
 
-		return string(buf), nil
+// enter consumes the beginning of a dictionary or list.
+func (d *decodeState) enter() error {
+	d.depth++
+	if d.limits.MaxDepth > 0 && d.depth > d.limits.MaxDepth {
+		return ErrMaxDepth
 	}
+	return d.skip()
 }
 
-func readTerminator(r io.ByteScanner, term byte) (bool, error) {
-	tok, err := r.ReadByte()
+func (d *decodeState) readTerminator(term byte) (bool, error) {
+	tok, err := d.r.Peek(1)
 	if err != nil {
 		return false, err
-	} else if tok == term {
-		return true, nil
+	} else if tok[0] != term {
+		return false, nil
 	}
-	return false, r.UnreadByte()
+	return true, d.skip()
 }
 
-func readTerminatedInt(r *bufio.Reader, term byte) (int64, error) {
-	buf, err := r.ReadSlice(term)
+func (d *decodeState) readTerminatedInt(term byte) (int64, error) {
+	buf, err := d.r.ReadSlice(term)
 	if err != nil {
 		return 0, err
+	} else if err := d.consume(int64(len(buf))); err != nil {
+		return 0, err
 	} else if len(buf) <= 1 {
 		return 0, errors.New("bencode: empty integer field")
 	}
 
 	return strconv.ParseInt(string(buf[:len(buf)-1]), 10, 64)
 }
+
+// readString reads a string of length bytes, checking the limits before
+// anything is allocated for it.
+func (d *decodeState) readString(length int64) (string, error) {
+	if length < 0 {
+		return "", errors.New("bencode: negative string length")
+	} else if d.limits.MaxStringLength > 0 && length > d.limits.MaxStringLength {
+		return "", ErrMaxStringLength
+	} else if err := d.consume(length); err != nil {
+		return "", err
+	}
+
+	if length <= stringChunkSize {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(d.r, buf); err != nil {
+			return "", shortRead(err)
+		}
+		return string(buf), nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(stringChunkSize)
+	n, err := buf.ReadFrom(io.LimitReader(d.r, length))
+	if err != nil {
+		return "", err
+	} else if n != length {
+		return "", shortRead(io.ErrUnexpectedEOF)
+	}
+	return buf.String(), nil
+}
+
+// shortRead translates the error of a string that ended early.
+func shortRead(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("bencode: short read")
+	}
+	return err
+}
@@ -5,9 +5,13 @@
 package bencode
 
 import (
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var unmarshalTests = []struct {
@@ -84,3 +88,83 @@ func BenchmarkUnmarshalLarge(b *testing.B) {
 		dec.Decode()
 	}
 }
+
+func TestUnmarshalLongString(t *testing.T) {
+	for _, length := range []int{4097, stringChunkSize, stringChunkSize + 1, 3 * stringChunkSize} {
+		s := strings.Repeat("x", length)
+		got, err := Unmarshal([]byte(strconv.Itoa(length) + ":" + s))
+		require.Nil(t, err)
+		require.Equal(t, s, got)
+	}
+}
+
+var limitTests = []struct {
+	input    string
+	limits   Limits
+	expected error
+}{
+	{"l" + strings.Repeat("le", 10) + "e", Limits{MaxDepth: 2}, nil},
+	{strings.Repeat("l", 3) + strings.Repeat("e", 3), Limits{MaxDepth: 2}, ErrMaxDepth},
+	{"d1:a" + strings.Repeat("d1:a", 2) + "dee" + strings.Repeat("e", 2), Limits{MaxDepth: 3}, ErrMaxDepth},
+
+	{"4:spam", Limits{MaxStringLength: 4}, nil},
+	{"5:spams", Limits{MaxStringLength: 4}, ErrMaxStringLength},
+	{"d5:spamsi1ee", Limits{MaxStringLength: 4}, ErrMaxStringLength},
+
+	{"l4:spami42ee", Limits{MaxSize: 12}, nil},
+	{"l4:spami42ee", Limits{MaxSize: 11}, ErrMaxSize},
+	{"l4:spami42ee", Limits{MaxSize: 5}, ErrMaxSize},
+	{"l" + strings.Repeat("i1e", 100) + "e", Limits{MaxSize: 100}, ErrMaxSize},
+}
+
+func TestUnmarshalLimited(t *testing.T) {
+	for _, tt := range limitTests {
+		_, err := UnmarshalLimited([]byte(tt.input), tt.limits)
+		require.Equal(t, tt.expected, err, tt.input)
+	}
+}
+
+func TestDecoderLimitsPerValue(t *testing.T) {
+	dec := NewLimitedDecoder(strings.NewReader("l4:spame"+"l4:spame"+"l4:spam4:eggse"), Limits{MaxSize: 8})
+
+	for i := 0; i < 2; i++ {
+		v, err := dec.Decode()
+		require.Nil(t, err)
+		require.Equal(t, List{"spam"}, v)
+	}
+	_, err := dec.Decode()
+	require.Equal(t, ErrMaxSize, err)
+}
+
+// allocated returns the number of bytes allocated while running f.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestUnmarshalBombs(t *testing.T) {
+	// A length prefix of 8 EiB, followed by a few bytes.
+	lengthBomb := []byte("9223372036854775807:spam")
+	// A million nested lists, which would take a million stack frames.
+	depthBomb := []byte(strings.Repeat("l", 1000000) + strings.Repeat("e", 1000000))
+
+	var err error
+	n := allocated(func() { _, err = Unmarshal(lengthBomb) })
+	require.Equal(t, ErrMaxStringLength, err)
+	require.True(t, n < 1<<20, "rejecting the length bomb allocated %d bytes", n)
+
+	n = allocated(func() { _, err = UnmarshalLimited(lengthBomb, Limits{}) })
+	require.NotNil(t, err)
+	require.True(t, n < 1<<20, "rejecting the unlimited length bomb allocated %d bytes", n)
+
+	n = allocated(func() { _, err = Unmarshal(depthBomb) })
+	require.Equal(t, ErrMaxDepth, err)
+	require.True(t, n < 1<<20, "rejecting the depth bomb allocated %d bytes", n)
+
+	_, err = Unmarshal([]byte("-1:"))
+	require.NotNil(t, err)
+}
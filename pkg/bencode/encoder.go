@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -100,10 +101,17 @@ func marshal(w io.Writer, data interface{}) error {
 		w.Write([]byte{'e'})
 
 	case map[string]interface{}:
+		// Keys must be sorted as raw strings.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
 		w.Write([]byte{'d'})
-		for key, val := range v {
+		for _, key := range keys {
 			marshalString(w, key)
-			err := marshal(w, val)
+			err := marshal(w, v[key])
 			if err != nil {
 				return err
 			}
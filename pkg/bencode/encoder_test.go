@@ -32,7 +32,8 @@ var marshalTests = []struct {
 	{[]interface{}{"one", "two"}, []string{"l3:one3:twoe", "l3:two3:onee"}},
 	{[]string{}, []string{"le"}},
 
-	{map[string]interface{}{"one": "aa", "two": "bb"}, []string{"d3:one2:aa3:two2:bbe", "d3:two2:bb3:one2:aae"}},
+	{map[string]interface{}{"one": "aa", "two": "bb"}, []string{"d3:one2:aa3:two2:bbe"}},
+	{map[string]interface{}{"b": 1, "a": 2, "ab": 3}, []string{"d1:ai2e2:abi3e1:bi1ee"}},
 	{map[string]interface{}{}, []string{"de"}},
 }
 
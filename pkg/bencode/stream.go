@@ -0,0 +1,241 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+var (
+	// ErrUnsortedKeys is returned by a StreamEncoder if the keys of a
+	// dictionary are not written in strictly ascending order, as the
+	// bencoding requires.
+	ErrUnsortedKeys = errors.New("bencode: dictionary keys not in sorted order")
+
+	// ErrInvalidStream is returned by a StreamEncoder if values, keys and
+	// ends of containers are written in an order that does not form a valid
+	// bencoding.
+	ErrInvalidStream = errors.New("bencode: invalid sequence of stream elements")
+)
+
+// The delimiters are shared, so that writing them does not allocate.
+var (
+	dictStart    = []byte{'d'}
+	listStart    = []byte{'l'}
+	containerEnd = []byte{'e'}
+)
+
+// A StreamEncoder writes bencoded dictionaries and lists element by element,
+// so that large values never have to be held in memory as a whole. Its output
+// is identical to that of Marshal for the same value.
+//
+// Errors are sticky: once an error occurred, all further writes are ignored
+// and Err returns the error.
+type StreamEncoder struct {
+	w       io.Writer
+	err     error
+	stack   []streamContainer
+	scratch []byte
+}
+
+// streamContainer is a dictionary or list that has been begun but not yet
+// ended.
+type streamContainer struct {
+	dict     bool
+	hasKey   bool
+	lastKey  []byte
+	awaiting bool // a key has been written, its value has not
+}
+
+// NewStreamEncoder returns a new StreamEncoder that writes to w.
+func NewStreamEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w}
+}
+
+// Err returns the first error that occurred, or ErrInvalidStream if a
+// dictionary or list has not been ended.
+func (enc *StreamEncoder) Err() error {
+	if enc.err == nil && len(enc.stack) > 0 {
+		return ErrInvalidStream
+	}
+	return enc.err
+}
+
+// BeginDict begins a dictionary. Its keys and values must be written in
+// alternation, ordered by key, followed by End.
+func (enc *StreamEncoder) BeginDict() {
+	enc.beginValue()
+	enc.write(dictStart)
+	enc.push(true)
+}
+
+// BeginList begins a list. Its values must be followed by End.
+func (enc *StreamEncoder) BeginList() {
+	enc.beginValue()
+	enc.write(listStart)
+	enc.push(false)
+}
+
+// push begins a container, reusing the key buffer of a previously ended one
+// at the same depth.
+func (enc *StreamEncoder) push(dict bool) {
+	var lastKey []byte
+	if len(enc.stack) < cap(enc.stack) {
+		lastKey = enc.stack[:len(enc.stack)+1][len(enc.stack)].lastKey[:0]
+	}
+	enc.stack = append(enc.stack, streamContainer{dict: dict, lastKey: lastKey})
+}
+
+// End ends the innermost dictionary or list.
+func (enc *StreamEncoder) End() {
+	if enc.err != nil {
+		return
+	}
+	if len(enc.stack) == 0 || enc.stack[len(enc.stack)-1].awaiting {
+		enc.err = ErrInvalidStream
+		return
+	}
+
+	enc.stack = enc.stack[:len(enc.stack)-1]
+	enc.write(containerEnd)
+}
+
+// Key writes the next key of the innermost dictionary.
+func (enc *StreamEncoder) Key(key string) {
+	c := enc.nextKey()
+	if c == nil {
+		return
+	}
+	if c.hasKey && key <= string(c.lastKey) {
+		enc.err = ErrUnsortedKeys
+		return
+	}
+
+	c.lastKey = append(c.lastKey[:0], key...)
+	c.hasKey = true
+	enc.writeString(key)
+}
+
+// KeyBytes writes the next key of the innermost dictionary.
+func (enc *StreamEncoder) KeyBytes(key []byte) {
+	c := enc.nextKey()
+	if c == nil {
+		return
+	}
+	if c.hasKey && bytes.Compare(key, c.lastKey) <= 0 {
+		enc.err = ErrUnsortedKeys
+		return
+	}
+
+	c.lastKey = append(c.lastKey[:0], key...)
+	c.hasKey = true
+	enc.writeBytes(key)
+}
+
+// nextKey returns the innermost dictionary, expecting the value of the key
+// about to be written, or nil if no key may be written.
+func (enc *StreamEncoder) nextKey() *streamContainer {
+	if enc.err != nil {
+		return nil
+	}
+	if len(enc.stack) == 0 {
+		enc.err = ErrInvalidStream
+		return nil
+	}
+
+	c := &enc.stack[len(enc.stack)-1]
+	if !c.dict || c.awaiting {
+		enc.err = ErrInvalidStream
+		return nil
+	}
+
+	c.awaiting = true
+	return c
+}
+
+// Int writes an integer.
+func (enc *StreamEncoder) Int(v int64) {
+	enc.beginValue()
+	enc.scratch = append(enc.scratch[:0], 'i')
+	enc.scratch = strconv.AppendInt(enc.scratch, v, 10)
+	enc.scratch = append(enc.scratch, 'e')
+	enc.write(enc.scratch)
+}
+
+// Uint writes an unsigned integer.
+func (enc *StreamEncoder) Uint(v uint64) {
+	enc.beginValue()
+	enc.scratch = append(enc.scratch[:0], 'i')
+	enc.scratch = strconv.AppendUint(enc.scratch, v, 10)
+	enc.scratch = append(enc.scratch, 'e')
+	enc.write(enc.scratch)
+}
+
+// String writes a string.
+func (enc *StreamEncoder) String(v string) {
+	enc.beginValue()
+	enc.writeString(v)
+}
+
+// Bytes writes a byte string.
+func (enc *StreamEncoder) Bytes(v []byte) {
+	enc.beginValue()
+	enc.writeBytes(v)
+}
+
+// Value writes any value supported by Marshal.
+func (enc *StreamEncoder) Value(v interface{}) {
+	enc.beginValue()
+	if enc.err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := marshal(&buf, v); err != nil {
+		enc.err = err
+		return
+	}
+	enc.write(buf.Bytes())
+}
+
+// beginValue checks that a value may be written at the current position.
+func (enc *StreamEncoder) beginValue() {
+	if enc.err != nil || len(enc.stack) == 0 {
+		return
+	}
+
+	c := &enc.stack[len(enc.stack)-1]
+	if c.dict {
+		if !c.awaiting {
+			enc.err = ErrInvalidStream
+			return
+		}
+		c.awaiting = false
+	}
+}
+
+func (enc *StreamEncoder) writeString(v string) {
+	enc.scratch = strconv.AppendInt(enc.scratch[:0], int64(len(v)), 10)
+	enc.scratch = append(enc.scratch, ':')
+	enc.scratch = append(enc.scratch, v...)
+	enc.write(enc.scratch)
+}
+
+func (enc *StreamEncoder) writeBytes(v []byte) {
+	enc.scratch = strconv.AppendInt(enc.scratch[:0], int64(len(v)), 10)
+	enc.scratch = append(enc.scratch, ':')
+	enc.write(enc.scratch)
+	enc.write(v)
+}
+
+func (enc *StreamEncoder) write(p []byte) {
+	if enc.err != nil {
+		return
+	}
+	_, enc.err = enc.w.Write(p)
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewStreamEncoder(&buf)
+
+	enc.BeginDict()
+	enc.Key("a")
+	enc.Int(-42)
+	enc.KeyBytes([]byte("ab"))
+	enc.Uint(43)
+	enc.Key("b")
+	enc.BeginList()
+	enc.String("one")
+	enc.Bytes([]byte("two"))
+	enc.BeginDict()
+	enc.End()
+	enc.Value([]string{"three"})
+	enc.End()
+	enc.Key("c")
+	enc.Value(map[string]interface{}{"y": 1, "x": 2})
+	enc.End()
+	require.Nil(t, enc.Err())
+
+	expected, err := Marshal(map[string]interface{}{
+		"a":  -42,
+		"ab": uint64(43),
+		"b":  []interface{}{"one", []byte("two"), map[string]interface{}{}, []string{"three"}},
+		"c":  map[string]interface{}{"y": 1, "x": 2},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, string(expected), buf.String())
+}
+
+func TestStreamEncoderErrors(t *testing.T) {
+	var table = []struct {
+		expected error
+		write    func(enc *StreamEncoder)
+	}{
+		{ErrUnsortedKeys, func(enc *StreamEncoder) {
+			enc.BeginDict()
+			enc.Key("b")
+			enc.Int(1)
+			enc.Key("a")
+		}},
+		{ErrUnsortedKeys, func(enc *StreamEncoder) {
+			enc.BeginDict()
+			enc.KeyBytes([]byte("a"))
+			enc.Int(1)
+			enc.KeyBytes([]byte("a"))
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.BeginDict()
+			enc.Int(1)
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.BeginDict()
+			enc.Key("a")
+			enc.Key("b")
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.BeginDict()
+			enc.Key("a")
+			enc.End()
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.BeginList()
+			enc.Key("a")
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.End()
+		}},
+		{ErrInvalidStream, func(enc *StreamEncoder) {
+			enc.BeginList()
+		}},
+	}
+
+	for i, tt := range table {
+		enc := NewStreamEncoder(&bytes.Buffer{})
+		tt.write(enc)
+		assert.Equal(t, tt.expected, enc.Err(), "case %d", i)
+	}
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errWrite }
+
+func TestStreamEncoderWriteError(t *testing.T) {
+	enc := NewStreamEncoder(failingWriter{})
+	enc.BeginDict()
+	enc.Key("a")
+	enc.Int(1)
+	enc.End()
+	assert.Equal(t, errWrite, enc.Err())
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package clock abstracts the passing of time, so that expiry, reapers and
+// rotations can be tested with a clock that is advanced by hand.
+package clock
+
+import "time"
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once d has
+	// passed, like time.After.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a Ticker that ticks every d, like time.NewTicker.
+	// It panics if d is not positive.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals. Like a time.Ticker, it drops ticks
+// for slow receivers.
+type Ticker interface {
+	// C returns the channel the ticks are delivered on.
+	C() <-chan time.Time
+
+	// Stop turns off the Ticker. It does not close the channel.
+	Stop()
+}
+
+// Real is the Clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
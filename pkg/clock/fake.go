@@ -0,0 +1,145 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only passes when it is advanced. It is safe for
+// concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+var _ Clock = &Fake{}
+
+// waiter is a channel of After or a Ticker, which is sent the time once it
+// reaches at.
+type waiter struct {
+	at     time.Time
+	period time.Duration // zero for After
+	c      chan time.Time
+}
+
+// NewFake returns a Fake that starts at now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time the Fake was advanced to.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the time once the Fake is advanced
+// by d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{at: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- f.now
+		return w.c
+	}
+	f.add(w)
+	return w.c
+}
+
+// NewTicker returns a Ticker that ticks whenever the Fake is advanced past
+// another multiple of d since the Ticker was created.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{at: f.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	f.add(w)
+	return &fakeTicker{f: f, w: w}
+}
+
+func (f *Fake) add(w *waiter) {
+	f.waiters = append(f.waiters, w)
+	f.changed.Broadcast()
+}
+
+func (f *Fake) remove(w *waiter) {
+	for i, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// Advance moves the time of the Fake forward by d and delivers the time to
+// the channels of After and to the Tickers that are due. Like a time.Ticker,
+// a Ticker that is due several times ticks once.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	var pending []*waiter
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		select {
+		case w.c <- f.now:
+		default:
+		}
+
+		if w.period > 0 {
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	f.waiters = pending
+	f.changed.Broadcast()
+}
+
+// BlockUntil blocks until at least n channels of After and Tickers wait for
+// the Fake, so that tests can advance it once the goroutines they drive are
+// waiting.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.waiters) < n {
+		f.changed.Wait()
+	}
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+
+func (t *fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	t.f.remove(t.w)
+}
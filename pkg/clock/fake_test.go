@@ -0,0 +1,97 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Unix(1466000000, 0)
+
+// received returns the time c received, if any.
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(start)
+	require.Equal(t, start, f.Now())
+
+	c := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	_, ok := received(c)
+	require.False(t, ok)
+
+	f.Advance(time.Second)
+	now, ok := received(c)
+	require.True(t, ok)
+	require.Equal(t, start.Add(time.Minute), now)
+	require.Equal(t, start.Add(time.Minute), f.Now())
+
+	// Waits that already passed are over right away.
+	_, ok = received(f.After(0))
+	require.True(t, ok)
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Minute)
+
+	f.Advance(30 * time.Second)
+	_, ok := received(ticker.C())
+	require.False(t, ok)
+
+	f.Advance(30 * time.Second)
+	now, ok := received(ticker.C())
+	require.True(t, ok)
+	require.Equal(t, start.Add(time.Minute), now)
+
+	// Ticks are dropped for slow receivers.
+	f.Advance(time.Minute)
+	f.Advance(3 * time.Minute)
+	_, ok = received(ticker.C())
+	require.True(t, ok)
+	_, ok = received(ticker.C())
+	require.False(t, ok)
+
+	// The ticker keeps its phase.
+	f.Advance(59 * time.Second)
+	_, ok = received(ticker.C())
+	require.False(t, ok)
+	f.Advance(time.Second)
+	_, ok = received(ticker.C())
+	require.True(t, ok)
+
+	ticker.Stop()
+	f.Advance(time.Hour)
+	_, ok = received(ticker.C())
+	require.False(t, ok)
+
+	assert.Panics(t, func() { f.NewTicker(0) })
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(start)
+
+	ticked := make(chan time.Time)
+	go func() {
+		ticker := f.NewTicker(time.Minute)
+		defer ticker.Stop()
+		ticked <- <-ticker.C()
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	require.Equal(t, start.Add(time.Minute), <-ticked)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package ipmask implements the anonymization of the IPs chihaya reports.
+//
+// IPs are anonymized by zeroing their host bits, so that only the network
+// of a peer is logged, exported by metrics or listed by the admin API. The
+// full addresses are still used internally, e.g. for swarm membership and
+// the checks of the IP middleware.
+package ipmask
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Default prefix lengths of anonymized IPs.
+const (
+	DefaultIPv4Prefix = 24
+	DefaultIPv6Prefix = 48
+)
+
+// Config represents the configuration of the anonymization of IPs.
+type Config struct {
+	// Enabled makes chihaya report anonymized IPs. It defaults to false.
+	Enabled bool `yaml:"enabled"`
+
+	// IPv4Prefix and IPv6Prefix are the numbers of leading bits that are
+	// kept of IPv4 and IPv6 addresses. They default to 24 and 48.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+// Mask anonymizes IPs by zeroing their host bits. A nil Mask keeps IPs as
+// they are.
+type Mask struct {
+	v4, v6 net.IPMask
+}
+
+// New creates the Mask described by cfg. It returns nil if anonymization is
+// not enabled.
+func New(cfg Config) (*Mask, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = DefaultIPv4Prefix
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = DefaultIPv6Prefix
+	}
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 8*net.IPv4len {
+		return nil, fmt.Errorf("ipmask: ipv4_prefix must be between 0 and %d", 8*net.IPv4len)
+	}
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 8*net.IPv6len {
+		return nil, fmt.Errorf("ipmask: ipv6_prefix must be between 0 and %d", 8*net.IPv6len)
+	}
+
+	return &Mask{
+		v4: net.CIDRMask(cfg.IPv4Prefix, 8*net.IPv4len),
+		v6: net.CIDRMask(cfg.IPv6Prefix, 8*net.IPv6len),
+	}, nil
+}
+
+// IP returns ip with its host bits zeroed. IPv4-mapped IPv6 addresses are
+// masked as IPv4 addresses.
+func (m *Mask) IP(ip net.IP) net.IP {
+	if m == nil || ip == nil {
+		return ip
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(m.v4)
+	}
+	if masked := ip.Mask(m.v6); masked != nil {
+		return masked
+	}
+	return ip
+}
+
+// String returns the string form of ip with its host bits zeroed.
+func (m *Mask) String(ip net.IP) string {
+	return m.IP(ip).String()
+}
+
+var defaultMask atomic.Pointer[Mask]
+
+// Default returns the Mask used by the functions of this package. Unless it
+// is replaced by SetDefault, it is nil and keeps IPs as they are.
+func Default() *Mask {
+	return defaultMask.Load()
+}
+
+// SetDefault replaces the Mask used by the functions of this package.
+func SetDefault(m *Mask) {
+	defaultMask.Store(m)
+}
+
+// IP returns ip masked with the default Mask.
+func IP(ip net.IP) net.IP {
+	return Default().IP(ip)
+}
+
+// String returns the string form of ip masked with the default Mask.
+func String(ip net.IP) string {
+	return Default().String(ip)
+}
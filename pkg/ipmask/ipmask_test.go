@@ -0,0 +1,64 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ipmask
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var table = []struct {
+		cfg   Config
+		valid bool
+	}{
+		{Config{}, true},
+		{Config{Enabled: true}, true},
+		{Config{Enabled: true, IPv4Prefix: 32, IPv6Prefix: 128}, true},
+		{Config{Enabled: true, IPv4Prefix: 33}, false},
+		{Config{Enabled: true, IPv6Prefix: -1}, false},
+	}
+
+	for _, tt := range table {
+		_, err := New(tt.cfg)
+		require.Equal(t, tt.valid, err == nil, "%+v", tt.cfg)
+	}
+
+	m, err := New(Config{IPv4Prefix: 16})
+	require.Nil(t, err)
+	require.Nil(t, m)
+}
+
+func TestMask(t *testing.T) {
+	m, err := New(Config{Enabled: true})
+	require.Nil(t, err)
+	m16, err := New(Config{Enabled: true, IPv4Prefix: 16, IPv6Prefix: 32})
+	require.Nil(t, err)
+
+	var table = []struct {
+		mask     *Mask
+		ip       string
+		expected string
+	}{
+		{m, "192.0.2.123", "192.0.2.0"},
+		{m, "::ffff:192.0.2.123", "192.0.2.0"},
+		{m, "2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{m16, "192.0.2.123", "192.0.0.0"},
+		{m16, "2001:db8:1234:5678::1", "2001:db8::"},
+		{nil, "192.0.2.123", "192.0.2.123"},
+		{nil, "2001:db8:1234:5678::1", "2001:db8:1234:5678::1"},
+	}
+
+	for _, tt := range table {
+		ip := net.ParseIP(tt.ip)
+		require.Equal(t, tt.expected, tt.mask.String(ip), "%s", tt.ip)
+		// the IP itself is left as it is
+		require.Equal(t, net.ParseIP(tt.ip), ip)
+	}
+
+	require.Nil(t, m.IP(nil))
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package listen implements the options servers listen on their addresses
+// with: binding to the address of a network interface, and SO_REUSEPORT.
+//
+// With SO_REUSEPORT, multiple chihaya processes can listen on the same port,
+// and the kernel balances the connections and packets across them. It is
+// only supported on Linux and the BSDs; elsewhere, servers warn and listen
+// without it.
+package listen
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Config represents the options a server listens with. It is meant to be
+// inlined into the configuration of the server.
+type Config struct {
+	// Interface is the name of the network interface the server binds to.
+	// The address is then given without a host, and the first address of
+	// the interface of the family of the network is listened on.
+	Interface string `yaml:"interface"`
+
+	// ReusePort sets SO_REUSEPORT on the sockets of the server.
+	ReusePort bool `yaml:"reuse_port"`
+}
+
+// Validate checks that the interface of cfg exists.
+func (cfg Config) Validate() error {
+	if cfg.Interface == "" {
+		return nil
+	}
+	_, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("unknown interface %q: %s", cfg.Interface, err)
+	}
+	return nil
+}
+
+// Listen listens on addr of the stream network, like net.Listen.
+func (cfg Config) Listen(network, addr string) (net.Listener, error) {
+	addr, err := cfg.Address(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	lc := cfg.listenConfig()
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// ListenUDP listens on addr of the UDP network, like net.ListenUDP.
+func (cfg Config) ListenUDP(network, addr string) (*net.UDPConn, error) {
+	addr, err := cfg.Address(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	lc := cfg.listenConfig()
+	conn, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Address returns the address Listen and ListenUDP bind to for addr: addr
+// itself, unless an interface is configured, in which case its host is an
+// address of the interface. Networks ending in 4 or 6 get an address of
+// that family, the others an IPv4 address if the interface has one.
+func (cfg Config) Address(network, addr string) (string, error) {
+	if cfg.Interface == "" {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host != "" {
+		return "", fmt.Errorf("address %s must not have a host if interface %s is configured", addr, cfg.Interface)
+	}
+
+	ifi, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	var v4, v6 net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ipnet.IP
+		}
+	}
+
+	ip := v4
+	switch {
+	case strings.HasSuffix(network, "4"):
+	case strings.HasSuffix(network, "6"):
+		ip = v6
+	case ip == nil:
+		ip = v6
+	}
+	if ip == nil {
+		return "", fmt.Errorf("interface %s has no address for %s", cfg.Interface, network)
+	}
+
+	host = ip.String()
+	if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+		host += "%" + cfg.Interface
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// listenConfig returns the net.ListenConfig of cfg. It warns if SO_REUSEPORT
+// is configured but not supported, and leaves it out.
+func (cfg Config) listenConfig() net.ListenConfig {
+	if !cfg.ReusePort {
+		return net.ListenConfig{}
+	}
+	if !reusePortSupported {
+		log.Warn("listen: reuse_port is not supported on this platform, listening without it", "os", runtime.GOOS)
+		return net.ListenConfig{}
+	}
+
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				err = setReusePort(fd)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package listen
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// loopback returns the name of a loopback interface with an IPv4 address.
+func loopback(t *testing.T) string {
+	ifis, err := net.Interfaces()
+	require.Nil(t, err)
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		require.Nil(t, err)
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ifi.Name
+			}
+		}
+	}
+	t.Skip("no loopback interface with an IPv4 address")
+	return ""
+}
+
+func TestAddress(t *testing.T) {
+	addr, err := Config{}.Address("tcp", "localhost:6881")
+	require.Nil(t, err)
+	require.Equal(t, "localhost:6881", addr)
+
+	cfg := Config{Interface: loopback(t)}
+	require.Nil(t, cfg.Validate())
+	for _, network := range []string{"tcp", "tcp4", "udp", "udp4"} {
+		addr, err = cfg.Address(network, ":6881")
+		require.Nil(t, err, network)
+		host, port, err := net.SplitHostPort(addr)
+		require.Nil(t, err, network)
+		require.Equal(t, "6881", port, network)
+		require.True(t, net.ParseIP(host).IsLoopback(), "%s: %s", network, addr)
+	}
+
+	_, err = cfg.Address("tcp", "127.0.0.1:6881")
+	require.NotNil(t, err)
+	_, err = Config{Interface: "chihaya-none0"}.Address("tcp", ":6881")
+	require.NotNil(t, err)
+	require.NotNil(t, Config{Interface: "chihaya-none0"}.Validate())
+}
+
+func TestListen(t *testing.T) {
+	cfg := Config{Interface: loopback(t)}
+
+	ln, err := cfg.Listen("tcp", ":0")
+	require.Nil(t, err)
+	defer ln.Close()
+	require.True(t, ln.Addr().(*net.TCPAddr).IP.IsLoopback(), ln.Addr().String())
+
+	conn, err := cfg.ListenUDP("udp", ":0")
+	require.Nil(t, err)
+	defer conn.Close()
+	require.True(t, conn.LocalAddr().(*net.UDPAddr).IP.IsLoopback(), conn.LocalAddr().String())
+}
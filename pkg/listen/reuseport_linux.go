@@ -0,0 +1,17 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package listen
+
+import "runtime"
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define for
+// Linux. Its value differs on a few architectures.
+var soReusePort = func() int {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le", "sparc64":
+		return 0x200
+	}
+	return 0xf
+}()
@@ -0,0 +1,36 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package listen
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReusePort(t *testing.T) {
+	cfg := Config{ReusePort: true}
+
+	ln, err := cfg.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	ln2, err := cfg.Listen("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer ln2.Close()
+
+	conn, err := cfg.ListenUDP("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	conn2, err := cfg.ListenUDP("udp", conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer conn2.Close()
+
+	// without it, the port is taken
+	_, err = Config{}.Listen("tcp", ln.Addr().String())
+	require.NotNil(t, err)
+	_, err = net.ListenPacket("udp", conn.LocalAddr().String())
+	require.NotNil(t, err)
+}
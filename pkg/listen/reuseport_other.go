@@ -0,0 +1,16 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package listen
+
+import "errors"
+
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return errors.New("listen: SO_REUSEPORT is not supported on this platform")
+}
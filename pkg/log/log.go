@@ -0,0 +1,164 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package log implements the structured logging of chihaya on top of
+// log/slog.
+//
+// Records logged with a context that carries a request ID have it attached
+// as the request_id attribute, so that all lines logged for a request can be
+// correlated.
+//
+// IPs logged as net.IP or []net.IP values are anonymized with the default
+// Mask of package ipmask. IPs must not be formatted before they are logged,
+// e.g. as part of a string, as those are logged as they are.
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/pkg/ipmask"
+)
+
+// Config represents the configuration of the logger of chihaya.
+type Config struct {
+	// Level is one of debug, info, warn or error. It defaults to info.
+	Level string `yaml:"level"`
+
+	// Format is either text or json. It defaults to text.
+	Format string `yaml:"format"`
+}
+
+var defaultLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	l, _ := New(os.Stderr, Config{})
+	defaultLogger.Store(l)
+}
+
+// New creates a Logger that writes records in the format and from the level
+// of the Config to w.
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	switch strings.ToLower(cfg.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("log: unknown level %q", cfg.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: maskIPs}
+
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log: unknown format %q", cfg.Format)
+	}
+
+	return slog.New(requestIDHandler{h}), nil
+}
+
+// maskIPs replaces the IPs of a with their anonymized forms.
+func maskIPs(_ []string, a slog.Attr) slog.Attr {
+	m := ipmask.Default()
+	if m == nil || a.Value.Kind() != slog.KindAny {
+		return a
+	}
+	switch v := a.Value.Any().(type) {
+	case net.IP:
+		a.Value = slog.StringValue(m.String(v))
+	case []net.IP:
+		masked := make([]string, len(v))
+		for i, ip := range v {
+			masked[i] = m.String(ip)
+		}
+		a.Value = slog.AnyValue(masked)
+	}
+	return a
+}
+
+// Default returns the Logger used by the functions of this package.
+func Default() *slog.Logger {
+	return defaultLogger.Load()
+}
+
+// SetDefault replaces the Logger used by the functions of this package.
+//
+// Loggers not created by New do not attach request IDs to records unless
+// their handlers are wrapped by Handler.
+func SetDefault(l *slog.Logger) {
+	defaultLogger.Store(l)
+}
+
+// Handler wraps h so that it attaches the request IDs of the contexts records
+// are logged with.
+func Handler(h slog.Handler) slog.Handler {
+	if _, ok := h.(requestIDHandler); ok {
+		return h
+	}
+	return requestIDHandler{h}
+}
+
+// Debug logs at the debug level with the default Logger.
+func Debug(msg string, args ...interface{}) {
+	Default().Debug(msg, args...)
+}
+
+// DebugContext logs at the debug level with the default Logger.
+func DebugContext(ctx context.Context, msg string, args ...interface{}) {
+	Default().DebugContext(ctx, msg, args...)
+}
+
+// Info logs at the info level with the default Logger.
+func Info(msg string, args ...interface{}) {
+	Default().Info(msg, args...)
+}
+
+// InfoContext logs at the info level with the default Logger.
+func InfoContext(ctx context.Context, msg string, args ...interface{}) {
+	Default().InfoContext(ctx, msg, args...)
+}
+
+// Warn logs at the warn level with the default Logger.
+func Warn(msg string, args ...interface{}) {
+	Default().Warn(msg, args...)
+}
+
+// WarnContext logs at the warn level with the default Logger.
+func WarnContext(ctx context.Context, msg string, args ...interface{}) {
+	Default().WarnContext(ctx, msg, args...)
+}
+
+// Error logs at the error level with the default Logger.
+func Error(msg string, args ...interface{}) {
+	Default().Error(msg, args...)
+}
+
+// ErrorContext logs at the error level with the default Logger.
+func ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	Default().ErrorContext(ctx, msg, args...)
+}
+
+// Fatal logs at the error level with the default Logger and exits the
+// process with status 1.
+func Fatal(msg string, args ...interface{}) {
+	Default().Error(msg, args...)
+	os.Exit(1)
+}
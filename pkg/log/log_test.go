@@ -0,0 +1,67 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var tests = []struct {
+		cfg   Config
+		valid bool
+	}{
+		{Config{}, true},
+		{Config{Level: "debug", Format: "json"}, true},
+		{Config{Level: "WARN", Format: "Text"}, true},
+		{Config{Level: "error"}, true},
+		{Config{Level: "verbose"}, false},
+		{Config{Format: "xml"}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := New(&bytes.Buffer{}, tt.cfg)
+		require.Equal(t, tt.valid, err == nil, "%+v", tt.cfg)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, Config{Level: "warn"})
+	require.Nil(t, err)
+
+	l.Info("dropped")
+	l.Warn("kept")
+	require.False(t, strings.Contains(buf.String(), "dropped"))
+	require.True(t, strings.Contains(buf.String(), "kept"))
+}
+
+func TestRequestID(t *testing.T) {
+	require.Equal(t, "", RequestID(context.Background()))
+
+	id := NewRequestID()
+	require.Equal(t, 16, len(id))
+	require.NotEqual(t, id, NewRequestID())
+
+	ctx := WithRequestID(context.Background(), id)
+	require.Equal(t, id, RequestID(ctx))
+
+	var buf bytes.Buffer
+	l, err := New(&buf, Config{})
+	require.Nil(t, err)
+
+	l.With("component", "test").InfoContext(ctx, "with ID")
+	require.True(t, strings.Contains(buf.String(), "request_id="+id))
+	require.True(t, strings.Contains(buf.String(), "component=test"))
+
+	buf.Reset()
+	l.Info("without ID")
+	require.False(t, strings.Contains(buf.String(), "request_id"))
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/server/store/middleware/client"
+)
+
+// putClientPrefix stores a peer ID prefix for the client_prefix middleware.
+func (s *adminServer) putClientPrefix(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	prefix, ok := parseClientPrefix(w, p.ByName("prefix"))
+	if !ok {
+		return
+	}
+
+	err := s.store().PutString(client.PrefixKey(prefix))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteClientPrefix removes a peer ID prefix.
+func (s *adminServer) deleteClientPrefix(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	prefix, ok := parseClientPrefix(w, p.ByName("prefix"))
+	if !ok {
+		return
+	}
+
+	err := s.store().RemoveString(client.PrefixKey(prefix))
+	if err == store.ErrResourceDoesNotExist {
+		writeError(w, http.StatusNotFound, "client prefix not stored")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseClientPrefix returns the peer ID prefix of a catch-all route
+// parameter. If it is empty or longer than a peer ID, an error is written and
+// ok is false.
+func parseClientPrefix(w http.ResponseWriter, param string) (prefix string, ok bool) {
+	prefix = strings.TrimPrefix(param, "/")
+	if prefix == "" || len(prefix) > len(chihaya.PeerID{}) {
+		writeError(w, http.StatusBadRequest, "malformed client prefix: must be 1 to 20 bytes")
+		return "", false
+	}
+	return prefix, true
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store/middleware/client"
+)
+
+func TestClientPrefixes(t *testing.T) {
+	s, st := newTestServer(t)
+
+	// prefixes are percent-encoded in the path
+	w := do(s, "PUT", "/client_prefixes/-UT%2F", testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	stored, err := st.HasString(client.PrefixKey("-UT/"))
+	require.Nil(t, err)
+	require.True(t, stored)
+
+	w = do(s, "DELETE", "/client_prefixes/-UT%2F", testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	stored, err = st.HasString(client.PrefixKey("-UT/"))
+	require.Nil(t, err)
+	require.False(t, stored)
+
+	w = do(s, "DELETE", "/client_prefixes/-UT%2F", testToken, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, prefix := range []string{"", strings.Repeat("x", 21)} {
+		w = do(s, "PUT", "/client_prefixes/"+prefix, testToken, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, prefix)
+	}
+}
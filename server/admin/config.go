@@ -0,0 +1,44 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+type adminConfig struct {
+	Addr           string        `yaml:"addr"`
+	Token          string        `yaml:"token"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+}
+
+func newAdminConfig(srvcfg *chihaya.ServerConfig) (*adminConfig, error) {
+	bytes, err := yaml.Marshal(srvcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg adminConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Addr == "" {
+		return nil, errors.New("addr must be set")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("token must be set")
+	}
+
+	return &cfg, nil
+}
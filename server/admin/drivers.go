@@ -0,0 +1,30 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// driversResponse lists the store drivers compiled into the binary.
+type driversResponse struct {
+	PeerStore   []string `json:"peer_store"`
+	IPStore     []string `json:"ip_store"`
+	StringStore []string `json:"string_store"`
+}
+
+// listDrivers lists the registered store drivers, e.g. to find out why a
+// configured driver is unknown.
+func (s *adminServer) listDrivers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, driversResponse{
+		PeerStore:   store.RegisteredPeerStoreDrivers(),
+		IPStore:     store.RegisteredIPStoreDrivers(),
+		StringStore: store.RegisteredStringStoreDrivers(),
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+type healthResponse struct {
+	Status string `json:"status"`
+
+	// Unhealthy maps the names of the stores that can not be reached to
+	// their errors.
+	Unhealthy map[string]string `json:"unhealthy,omitempty"`
+}
+
+// healthz reports that the process is alive.
+func (s *adminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// readyz reports whether all stores can be reached, so that no traffic is
+// routed to an instance whose stores are down, or that is draining.
+func (s *adminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if s.tkr.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "draining"})
+		return
+	}
+
+	failed := s.store().Check()
+	if len(failed) == 0 {
+		writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+		return
+	}
+
+	resp := healthResponse{Status: "unavailable", Unhealthy: make(map[string]string, len(failed))}
+	for name, err := range failed {
+		log.Warn("admin: store not ready", "store", name, "error", err)
+		resp.Unhealthy[name] = err.Error()
+	}
+	writeJSON(w, http.StatusServiceUnavailable, resp)
+}
+
+// putDrain makes the tracker hand out short intervals, e.g. ahead of a
+// deploy.
+func (s *adminServer) putDrain(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.tkr.Drain()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteDrain makes the tracker hand out the usual intervals again.
+func (s *adminServer) deleteDrain(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.tkr.StopDraining()
+	w.WriteHeader(http.StatusNoContent)
+}
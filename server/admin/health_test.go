@@ -0,0 +1,75 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// failingStringStore is a StringStore whose backend can not be reached.
+type failingStringStore struct {
+	store.StringStore
+}
+
+func (failingStringStore) HasString(s string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestProbes(t *testing.T) {
+	s, st := newTestServer(t)
+
+	// The probes do not need the token.
+	w := do(s, "GET", "/healthz", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.Equal(t, "{\"status\":\"ok\"}\n", w.Body.String())
+
+	w = do(s, "GET", "/readyz", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "{\"status\":\"ok\"}\n", w.Body.String())
+
+	st.StringStore = failingStringStore{st.StringStore}
+	w = do(s, "GET", "/readyz", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.Equal(t, "{\"status\":\"unavailable\",\"unhealthy\":{\"string_store\":\"connection refused\"}}\n", w.Body.String())
+
+	// The process is still alive.
+	w = do(s, "GET", "/healthz", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Everything else is still authenticated.
+	w = do(s, "GET", "/ips", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDrain(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	w := do(s, "PUT", "/drain", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.False(t, s.tkr.Draining())
+
+	w = do(s, "PUT", "/drain", testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.True(t, s.tkr.Draining())
+
+	// Orchestrators stop routing traffic to draining instances.
+	w = do(s, "GET", "/readyz", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "{\"status\":\"draining\"}\n", w.Body.String())
+
+	w = do(s, "DELETE", "/drain", testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.False(t, s.tkr.Draining())
+	w = do(s, "GET", "/readyz", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+}
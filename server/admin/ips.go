@@ -0,0 +1,192 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+const (
+	// defaultPageSize and maxPageSize bound the number of entries listed
+	// per page by GET /ips.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	// maxBodySize is the maximum size of a request body.
+	maxBodySize = 4096
+)
+
+// ipRequest is the body of POST /ips.
+type ipRequest struct {
+	Address string `json:"address"`
+}
+
+// ipListResponse is a page of IPStore entries. Next is the value of the after
+// parameter that requests the next page, it is empty on the last page.
+type ipListResponse struct {
+	Entries []string `json:"entries"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// ipEntry is a parsed IP address or network in CIDR notation.
+type ipEntry struct {
+	ip      net.IP
+	network *net.IPNet
+}
+
+// parseIPEntry parses an IP address or network. If it is malformed, an error
+// is written and ok is false.
+func parseIPEntry(w http.ResponseWriter, s string) (e ipEntry, ok bool) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "malformed network: "+s)
+			return e, false
+		}
+		return ipEntry{network: network}, true
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "malformed IP address: "+s)
+		return e, false
+	}
+	return ipEntry{ip: ip}, true
+}
+
+// postIP adds an IP address or network to the IPStore.
+func (s *adminServer) postIP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req ipRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	e, ok := parseIPEntry(w, req.Address)
+	if !ok {
+		return
+	}
+
+	if e.network != nil {
+		err = s.store().AddNetwork(e.network.String())
+	} else {
+		err = s.store().AddIP(e.ip)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteIP removes an IP address or network from the IPStore.
+func (s *adminServer) deleteIP(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	e, ok := parseIPEntry(w, strings.TrimPrefix(p.ByName("address"), "/"))
+	if !ok {
+		return
+	}
+
+	var err error
+	if e.network != nil {
+		err = s.store().RemoveNetwork(e.network.String())
+	} else {
+		err = s.store().RemoveIP(e.ip)
+	}
+	if err == store.ErrResourceDoesNotExist {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listIPs lists the IP addresses and networks of the IPStore, sorted as
+// strings.
+//
+// Pages are requested with the limit parameter and the after parameter,
+// which is the last entry of the previous page. Every page ranges over the
+// whole IPStore, so that entries added or removed between pages neither
+// break nor shift the pagination.
+//
+// If IPs are anonymized, addresses are listed with their host bits zeroed,
+// and addresses that share their network are listed once.
+func (s *adminServer) listIPs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := defaultPageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+			return
+		}
+	}
+	after := r.URL.Query().Get("after")
+
+	ips := s.store().IPStore
+	var entries []string
+	err := ips.RangeIPs(func(ip net.IP) bool {
+		if e := ipmask.String(ip); e > after {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	if err == nil {
+		err = ips.RangeNetworks(func(network *net.IPNet) bool {
+			if e := network.String(); e > after {
+				entries = append(entries, e)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sort.Strings(entries)
+	entries = dedup(entries)
+	resp := ipListResponse{Entries: entries}
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		resp.Next = entries[limit-1]
+	}
+	if resp.Entries == nil {
+		resp.Entries = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dedup removes the repeated entries of the sorted entries in place.
+func dedup(entries []string) []string {
+	if len(entries) == 0 {
+		return entries
+	}
+	n := 1
+	for _, e := range entries[1:] {
+		if e != entries[n-1] {
+			entries[n] = e
+			n++
+		}
+	}
+	return entries[:n]
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/ipmask"
+)
+
+func listIPs(t *testing.T, s *adminServer, query string) ipListResponse {
+	w := do(s, "GET", "/ips"+query, testToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var resp ipListResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestPostIP(t *testing.T) {
+	s, st := newTestServer(t)
+
+	w := do(s, "POST", "/ips", testToken, `{"address":"10.0.0.1"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	w = do(s, "POST", "/ips", testToken, `{"address":"fc00::1"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	w = do(s, "POST", "/ips", testToken, `{"address":"192.168.22.255/24"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	match, err := st.HasAllIPs([]net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("fc00::1"),
+		net.ParseIP("192.168.22.1"),
+	})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	var table = []struct {
+		body, expected string
+	}{
+		{`{"address":"10.0.0.256"}`, `{"error":"malformed IP address: 10.0.0.256"}`},
+		{`{"address":"10.0.0.0/33"}`, `{"error":"malformed network: 10.0.0.0/33"}`},
+		{`{"address":""}`, `{"error":"malformed IP address: "}`},
+		{`{"address":`, `{"error":"malformed request body"}`},
+	}
+
+	for _, tt := range table {
+		w = do(s, "POST", "/ips", testToken, tt.body)
+		require.Equal(t, http.StatusBadRequest, w.Code, tt.body)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.Equal(t, tt.expected+"\n", w.Body.String())
+	}
+}
+
+func TestDeleteIP(t *testing.T) {
+	s, st := newTestServer(t)
+	require.Nil(t, st.AddIP(net.ParseIP("10.0.0.1")))
+	require.Nil(t, st.AddIP(net.ParseIP("fc00::1")))
+	require.Nil(t, st.AddNetwork("192.168.22.0/24"))
+
+	for _, address := range []string{"10.0.0.1", "fc00::1", "192.168.22.123/24"} {
+		w := do(s, "DELETE", "/ips/"+address, testToken, "")
+		require.Equal(t, http.StatusNoContent, w.Code, address)
+
+		w = do(s, "DELETE", "/ips/"+address, testToken, "")
+		require.Equal(t, http.StatusNotFound, w.Code, address)
+		require.Equal(t, "{\"error\":\"not found\"}\n", w.Body.String())
+	}
+
+	require.Equal(t, []string{}, listIPs(t, s, "").Entries)
+
+	w := do(s, "DELETE", "/ips/10.0.0.0/33", testToken, "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(s, "DELETE", "/ips/nonsense", testToken, "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListIPs(t *testing.T) {
+	s, st := newTestServer(t)
+	require.Equal(t, ipListResponse{Entries: []string{}}, listIPs(t, s, ""))
+
+	require.Nil(t, st.AddIP(net.ParseIP("10.0.0.2")))
+	require.Nil(t, st.AddIP(net.ParseIP("10.0.0.1")))
+	require.Nil(t, st.AddIP(net.ParseIP("fc00::1")))
+	require.Nil(t, st.AddNetwork("192.168.22.0/24"))
+	require.Nil(t, st.AddNetwork("10.0.0.0/8"))
+
+	require.Equal(t, ipListResponse{
+		Entries: []string{"10.0.0.0/8", "10.0.0.1", "10.0.0.2", "192.168.22.0/24", "fc00::1"},
+	}, listIPs(t, s, ""))
+
+	resp := listIPs(t, s, "?limit=2")
+	require.Equal(t, ipListResponse{Entries: []string{"10.0.0.0/8", "10.0.0.1"}, Next: "10.0.0.1"}, resp)
+	resp = listIPs(t, s, "?limit=2&after="+resp.Next)
+	require.Equal(t, ipListResponse{Entries: []string{"10.0.0.2", "192.168.22.0/24"}, Next: "192.168.22.0/24"}, resp)
+	resp = listIPs(t, s, "?limit=2&after="+resp.Next)
+	require.Equal(t, ipListResponse{Entries: []string{"fc00::1"}}, resp)
+
+	for _, limit := range []string{"0", "-1", "1001", "x"} {
+		w := do(s, "GET", "/ips?limit="+limit, testToken, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, limit)
+	}
+
+	w := do(s, "GET", "/ips", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestListIPsAnonymized(t *testing.T) {
+	mask, err := ipmask.New(ipmask.Config{Enabled: true})
+	require.Nil(t, err)
+	ipmask.SetDefault(mask)
+	defer ipmask.SetDefault(nil)
+
+	s, st := newTestServer(t)
+	require.Nil(t, st.AddIP(net.ParseIP("10.0.0.2")))
+	require.Nil(t, st.AddIP(net.ParseIP("10.0.0.1")))
+	require.Nil(t, st.AddIP(net.ParseIP("fc00::1")))
+	require.Nil(t, st.AddNetwork("192.168.22.0/24"))
+
+	require.Equal(t, ipListResponse{
+		Entries: []string{"10.0.0.0", "192.168.22.0/24", "fc00::"},
+	}, listIPs(t, s, ""))
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package admin implements an HTTP API for changing the contents of the store
+// at runtime.
+//
+// The API is meant to be served on a private address. Every request must
+// authenticate with the configured token as a bearer token. It provides
+//
+//	PUT    /torrents/<hex infohash>  registers a torrent
+//	DELETE /torrents/<hex infohash>  unregisters a torrent
+//	POST   /ips                      adds {"address": "<IP or CIDR>"} to the IPStore
+//	DELETE /ips/<IP or CIDR>         removes an IP or network from the IPStore
+//	GET    /ips?limit=&after=        lists a page of the IPStore
+//	PUT    /client_prefixes/<prefix> stores a peer ID prefix
+//	DELETE /client_prefixes/<prefix> removes a peer ID prefix
+//	PUT    /drain                    makes the tracker hand out short intervals
+//	DELETE /drain                    stops draining the tracker
+//	GET    /drivers                  lists the registered store drivers
+//	GET    /swarm/<hex infohash>     describes a swarm and lists its peers
+//
+// Errors are returned as {"error": "<message>"}.
+//
+// For orchestrators, it also provides the unauthenticated probes
+//
+//	GET /healthz  reports that the process is alive
+//	GET /readyz   reports whether all stores can be reached, with 503 and
+//	              {"status": "unavailable", "unhealthy": {"<store>": "<error>"}}
+//	              if any of them can not, or {"status": "draining"} while
+//	              the tracker drains
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tylerb/graceful"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/server/store/middleware/infohash"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	server.Register("admin", constructor)
+}
+
+func constructor(srvcfg *chihaya.ServerConfig, tkr *tracker.Tracker) (server.Server, error) {
+	cfg, err := newAdminConfig(srvcfg)
+	if err != nil {
+		return nil, errors.New("admin: invalid config: " + err.Error())
+	}
+
+	return &adminServer{
+		cfg:   cfg,
+		tkr:   tkr,
+		store: store.MustGetStore,
+		clock: clock.Real,
+	}, nil
+}
+
+type adminServer struct {
+	cfg   *adminConfig
+	tkr   *tracker.Tracker
+	grace *graceful.Server
+
+	// store returns the store, which is only available once the store
+	// server has been created.
+	store func() *store.Store
+
+	// clock tells the time the ages of announces are computed at.
+	clock clock.Clock
+}
+
+// Start runs the server and blocks until it has exited.
+//
+// It panics if the server exits unexpectedly.
+func (s *adminServer) Start() {
+	s.grace = &graceful.Server{
+		Server: &http.Server{
+			Addr:         s.cfg.Addr,
+			Handler:      s.routes(),
+			ReadTimeout:  s.cfg.ReadTimeout,
+			WriteTimeout: s.cfg.WriteTimeout,
+		},
+		Timeout:          s.cfg.RequestTimeout,
+		NoSignalHandling: true,
+	}
+
+	if err := s.grace.ListenAndServe(); err != nil {
+		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
+			log.Error("failed to gracefully run admin server", "error", err)
+			panic(err)
+		}
+	}
+
+	log.Info("admin server shut down cleanly")
+}
+
+// Stop stops the server and blocks until the server has exited.
+func (s *adminServer) Stop() {
+	s.grace.Stop(s.grace.Timeout)
+	<-s.grace.StopChan()
+}
+
+func (s *adminServer) routes() http.Handler {
+	r := httprouter.New()
+	r.PUT("/torrents/:infohash", s.putTorrent)
+	r.DELETE("/torrents/:infohash", s.deleteTorrent)
+	r.GET("/ips", s.listIPs)
+	r.POST("/ips", s.postIP)
+	r.DELETE("/ips/*address", s.deleteIP)
+	r.PUT("/client_prefixes/*prefix", s.putClientPrefix)
+	r.DELETE("/client_prefixes/*prefix", s.deleteClientPrefix)
+	r.PUT("/drain", s.putDrain)
+	r.DELETE("/drain", s.deleteDrain)
+	r.GET("/drivers", s.listDrivers)
+	r.GET("/swarm/:infohash", s.getSwarm)
+
+	// The probes are not authenticated, so that orchestrators can use them
+	// without the token.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/", s.authenticate(r))
+	return mux
+}
+
+// authenticate rejects requests that do not carry the configured token.
+func (s *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// putTorrent registers an infohash for the infohash_registered middleware.
+func (s *adminServer) putTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	infoHash, ok := parseInfoHash(w, p.ByName("infohash"))
+	if !ok {
+		return
+	}
+
+	err := s.store().PutString(infohash.RegisteredKey(infoHash))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTorrent unregisters an infohash.
+func (s *adminServer) deleteTorrent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	infoHash, ok := parseInfoHash(w, p.ByName("infohash"))
+	if !ok {
+		return
+	}
+
+	err := s.store().RemoveString(infohash.RegisteredKey(infoHash))
+	if err == store.ErrResourceDoesNotExist {
+		writeError(w, http.StatusNotFound, "torrent not registered")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseInfoHash parses a hex-encoded infohash. If it is malformed, an error
+// is written and ok is false.
+func parseInfoHash(w http.ResponseWriter, s string) (infoHash chihaya.InfoHash, ok bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(infoHash) {
+		writeError(w, http.StatusBadRequest, "malformed infohash: must be 40 hexadecimal characters")
+		return infoHash, false
+	}
+
+	return chihaya.InfoHashFromBytes(b), true
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+	"github.com/chihaya/chihaya/server/store/middleware/infohash"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+const (
+	testToken    = "s3cr3t"
+	testInfoHash = "0102030405060708090a0b0c0d0e0f1011121314"
+)
+
+func newTestServer(t *testing.T) (*adminServer, *store.Store) {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+	srv, err := constructor(&chihaya.ServerConfig{
+		Name:   "admin",
+		Config: map[string]interface{}{"addr": "localhost:6880", "token": testToken},
+	}, tkr)
+	require.Nil(t, err)
+
+	ss, err := store.OpenStringStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	is, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	st := &store.Store{StringStore: ss, IPStore: is}
+	s := srv.(*adminServer)
+	s.store = func() *store.Store { return st }
+	return s, st
+}
+
+func do(s *adminServer, method, path, token, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthentication(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, token := range []string{"", "wrong", testToken + "x"} {
+		w := do(s, "PUT", "/torrents/"+testInfoHash, token, "")
+		require.Equal(t, http.StatusUnauthorized, w.Code, token)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.Equal(t, "{\"error\":\"invalid token\"}\n", w.Body.String())
+	}
+}
+
+func TestTorrents(t *testing.T) {
+	s, st := newTestServer(t)
+	key := infohash.RegisteredKey(chihaya.InfoHash{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+
+	w := do(s, "PUT", "/torrents/"+testInfoHash, testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	registered, err := st.HasString(key)
+	require.Nil(t, err)
+	require.True(t, registered)
+
+	// registering is idempotent
+	w = do(s, "PUT", "/torrents/"+testInfoHash, testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do(s, "DELETE", "/torrents/"+testInfoHash, testToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	registered, err = st.HasString(key)
+	require.Nil(t, err)
+	require.False(t, registered)
+
+	w = do(s, "DELETE", "/torrents/"+testInfoHash, testToken, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "{\"error\":\"torrent not registered\"}\n", w.Body.String())
+
+	for _, malformed := range []string{"0102", testInfoHash + "15", "zz02030405060708090a0b0c0d0e0f1011121314"} {
+		w = do(s, "PUT", "/torrents/"+malformed, testToken, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, malformed)
+		w = do(s, "DELETE", "/torrents/"+malformed, testToken, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, malformed)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, config := range []map[string]interface{}{
+		{"token": testToken},
+		{"addr": "localhost:6880"},
+	} {
+		_, err := constructor(&chihaya.ServerConfig{Name: "admin", Config: config}, nil)
+		require.NotNil(t, err)
+	}
+}
+
+func TestListDrivers(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	w := do(s, "GET", "/drivers", testToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var resp driversResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, store.RegisteredIPStoreDrivers(), resp.IPStore)
+	require.Contains(t, resp.IPStore, "memory")
+	require.Contains(t, resp.StringStore, "memory")
+
+	w = do(s, "GET", "/drivers", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// swarmResponse describes the swarm of an infohash.
+type swarmResponse struct {
+	Seeders    uint64      `json:"seeders"`
+	Leechers   uint64      `json:"leechers"`
+	Downloaded uint64      `json:"downloaded"`
+	Peers      []swarmPeer `json:"peers"`
+}
+
+// swarmPeer is a peer of a swarm. LastAnnounceAge is the number of seconds
+// since the last announce of the peer, it is omitted if the PeerStore does
+// not keep the times of announces.
+type swarmPeer struct {
+	ID              string `json:"id"`
+	IP              string `json:"ip"`
+	Port            uint16 `json:"port"`
+	Family          string `json:"family"`
+	Seeder          bool   `json:"seeder"`
+	LastAnnounceAge *int64 `json:"last_announce_age,omitempty"`
+}
+
+// getSwarm describes the swarm of an infohash, e.g. to debug why its peers
+// can not find each other. The swarm of an unknown infohash is empty.
+//
+// Peer IDs are hex-encoded. If IPs are anonymized, peers are listed with
+// their host bits zeroed.
+func (s *adminServer) getSwarm(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	infoHash, ok := parseInfoHash(w, p.ByName("infohash"))
+	if !ok {
+		return
+	}
+
+	peerStore := s.store().PeerStore
+	if peerStore == nil {
+		writeError(w, http.StatusInternalServerError, "no peer store configured")
+		return
+	}
+
+	var resp swarmResponse
+	var err error
+	resp.Seeders, resp.Leechers, resp.Downloaded, err = peerStore.GetStats(infoHash)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	peers, peers6, err := listSwarmPeers(peerStore, infoHash)
+	if err == store.ErrResourceDoesNotExist {
+		peers, peers6, err = nil, nil, nil
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := s.clock.Now()
+	resp.Peers = make([]swarmPeer, 0, len(peers)+len(peers6))
+	for _, family := range []struct {
+		name  string
+		peers []store.SwarmPeer
+	}{
+		{"ipv4", peers},
+		{"ipv6", peers6},
+	} {
+		sortSwarmPeers(family.peers)
+		for _, sp := range family.peers {
+			peer := swarmPeer{
+				ID:     hex.EncodeToString(sp.ID[:]),
+				IP:     ipmask.String(sp.IP),
+				Port:   sp.Port,
+				Family: family.name,
+				Seeder: sp.Seeder,
+			}
+			if !sp.LastAnnounce.IsZero() {
+				age := int64(now.Sub(sp.LastAnnounce) / time.Second)
+				peer.LastAnnounceAge = &age
+			}
+			resp.Peers = append(resp.Peers, peer)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listSwarmPeers lists the peers of the swarm of infoHash. Unless peerStore
+// is a store.SwarmPeerLister, the times of their last announces are unknown.
+func listSwarmPeers(peerStore store.PeerStore, infoHash chihaya.InfoHash) (peers, peers6 []store.SwarmPeer, err error) {
+	if lister, ok := peerStore.(store.SwarmPeerLister); ok {
+		return lister.ListSwarmPeers(infoHash)
+	}
+
+	for _, seeder := range []bool{true, false} {
+		get := peerStore.GetLeechers
+		if seeder {
+			get = peerStore.GetSeeders
+		}
+
+		v4, v6, err := get(infoHash)
+		if err == store.ErrResourceDoesNotExist {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range v4 {
+			peers = append(peers, store.SwarmPeer{Peer: p, Seeder: seeder})
+		}
+		for _, p := range v6 {
+			peers6 = append(peers6, store.SwarmPeer{Peer: p, Seeder: seeder})
+		}
+	}
+	return peers, peers6, nil
+}
+
+// sortSwarmPeers sorts the seeders before the leechers, and both by their
+// addresses and ports.
+func sortSwarmPeers(peers []store.SwarmPeer) {
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if a.Seeder != b.Seeder {
+			return a.Seeder
+		}
+		if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+			return c < 0
+		}
+		return a.Port < b.Port
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// newSwarmTestServer returns a server whose store has a swarm of
+// testInfoHash with an IPv4 seeder, an IPv4 leecher that announced a minute
+// later and a dual-stacked leecher that announced another minute later.
+func newSwarmTestServer(t *testing.T) *adminServer {
+	s, st := newTestServer(t)
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	s.clock = fake
+
+	ps, err := store.OpenPeerStore(&store.DriverConfig{Name: "memory", Clock: fake})
+	require.Nil(t, err)
+	st.PeerStore = ps
+	t.Cleanup(func() { require.Nil(t, <-ps.Stop()) })
+
+	infoHash := chihaya.InfoHash{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	require.Nil(t, ps.PutSeeder(infoHash, chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.ParseIP("10.0.0.1").To4(), Port: 6881}))
+	fake.Advance(time.Minute)
+	require.Nil(t, ps.PutLeecher(infoHash, chihaya.Peer{ID: chihaya.PeerID{2}, IP: net.ParseIP("10.0.0.2").To4(), Port: 6882}))
+	fake.Advance(time.Minute)
+	require.Nil(t, ps.PutLeecher(infoHash, chihaya.Peer{ID: chihaya.PeerID{3}, IP: net.ParseIP("10.0.1.3").To4(), Port: 6883}))
+	require.Nil(t, ps.PutLeecher(infoHash, chihaya.Peer{ID: chihaya.PeerID{3}, IP: net.ParseIP("fc00::3"), Port: 6883}))
+	fake.Advance(30 * time.Second)
+	return s
+}
+
+func getSwarm(t *testing.T, s *adminServer, infoHash string) swarmResponse {
+	w := do(s, "GET", "/swarm/"+infoHash, testToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var resp swarmResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func age(seconds int64) *int64 {
+	return &seconds
+}
+
+func TestGetSwarm(t *testing.T) {
+	s := newSwarmTestServer(t)
+
+	require.Equal(t, swarmResponse{
+		Seeders:  1,
+		Leechers: 3,
+		Peers: []swarmPeer{
+			{ID: "0100000000000000000000000000000000000000", IP: "10.0.0.1", Port: 6881, Family: "ipv4", Seeder: true, LastAnnounceAge: age(150)},
+			{ID: "0200000000000000000000000000000000000000", IP: "10.0.0.2", Port: 6882, Family: "ipv4", LastAnnounceAge: age(90)},
+			{ID: "0300000000000000000000000000000000000000", IP: "10.0.1.3", Port: 6883, Family: "ipv4", LastAnnounceAge: age(30)},
+			{ID: "0300000000000000000000000000000000000000", IP: "fc00::3", Port: 6883, Family: "ipv6", LastAnnounceAge: age(30)},
+		},
+	}, getSwarm(t, s, testInfoHash))
+
+	// unknown swarms are empty
+	require.Equal(t, swarmResponse{Peers: []swarmPeer{}}, getSwarm(t, s, "ffffffffffffffffffffffffffffffffffffffff"))
+
+	w := do(s, "GET", "/swarm/nonsense", testToken, "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(s, "GET", "/swarm/"+testInfoHash, "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestGetSwarmAnonymized(t *testing.T) {
+	mask, err := ipmask.New(ipmask.Config{Enabled: true})
+	require.Nil(t, err)
+	ipmask.SetDefault(mask)
+	defer ipmask.SetDefault(nil)
+
+	s := newSwarmTestServer(t)
+	var ips []string
+	for _, p := range getSwarm(t, s, testInfoHash).Peers {
+		ips = append(ips, p.Family+" "+p.IP)
+	}
+	require.Equal(t, []string{"ipv4 10.0.0.0", "ipv4 10.0.0.0", "ipv4 10.0.1.0", "ipv6 fc00::"}, ips)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Encodings the HTTP frontend can compress responses with, in the order of
+// preference.
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+	// deflate is the zlib format of RFC 1950 in HTTP, not raw DEFLATE.
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// compressor is implemented by the pooled gzip and zlib writers.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressed wraps h so that its responses are compressed with an encoding
+// the client accepts, once they reach minSize bytes.
+func compressed(h httprouter.Handle, minSize int) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			h(w, r, p)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, status: http.StatusOK}
+		h(cw, r, p)
+		cw.Close()
+	}
+}
+
+// acceptedEncoding returns the preferred encoding of the ones accepted by an
+// Accept-Encoding header, or an empty string if it accepts none of them.
+func acceptedEncoding(header string) string {
+	var gzipOK, deflateOK bool
+	for _, part := range strings.Split(header, ",") {
+		coding, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+
+		accepted := true
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+			weight, err := strconv.ParseFloat(q[len("q="):], 64)
+			accepted = err == nil && weight > 0
+		}
+
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case encodingGzip:
+			gzipOK = accepted
+		case encodingDeflate:
+			deflateOK = accepted
+		}
+	}
+
+	switch {
+	case gzipOK:
+		return encodingGzip
+	case deflateOK:
+		return encodingDeflate
+	}
+	return ""
+}
+
+// compressWriter is an http.ResponseWriter that buffers the response until it
+// reaches minSize bytes. Larger responses are compressed as they are written,
+// smaller ones are written uncompressed when the writer is closed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+
+	buf bytes.Buffer
+	c   compressor
+}
+
+// WriteHeader records the status, which is written once it is known whether
+// the response is compressed.
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.c != nil {
+		return w.c.Write(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() < w.minSize {
+		return len(p), nil
+	}
+
+	if w.encoding == encodingGzip {
+		w.c = gzipWriters.Get().(compressor)
+	} else {
+		w.c = zlibWriters.Get().(compressor)
+	}
+	w.c.Reset(w.ResponseWriter)
+
+	h := w.ResponseWriter.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+
+	_, err := w.c.Write(w.buf.Bytes())
+	w.buf.Reset()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the buffered response uncompressed, or finishes the
+// compressed one and returns its compressor to its pool.
+func (w *compressWriter) Close() error {
+	if w.c == nil {
+		w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		return err
+	}
+
+	err := w.c.Close()
+	w.c.Reset(nil)
+	if w.encoding == encodingGzip {
+		gzipWriters.Put(w.c)
+	} else {
+		zlibWriters.Put(w.c)
+	}
+	w.c = nil
+	return err
+}
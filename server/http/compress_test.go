@@ -0,0 +1,124 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	var table = []struct {
+		header, expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"GZIP;q=0.5, br", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"gzip;q=invalid", ""},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, acceptedEncoding(tt.header), tt.header)
+	}
+}
+
+// scrapeHandler returns a handle that writes a scrape response of n
+// infohashes.
+func scrapeHandler(n int) httprouter.Handle {
+	resp := &chihaya.ScrapeResponse{Files: make(map[chihaya.InfoHash]chihaya.Scrape)}
+	for i := 0; i < n; i++ {
+		resp.Files[chihaya.InfoHash{byte(i), byte(i >> 8)}] = chihaya.Scrape{Complete: int32(i)}
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		writeScrapeResponse(w, resp)
+	}
+}
+
+// serveCompressed serves a request with the given Accept-Encoding to h
+// compressed above 1KiB and returns the response and its decoded body.
+func serveCompressed(t *testing.T, h httprouter.Handle, acceptEncoding string) (*httptest.ResponseRecorder, []byte) {
+	r, err := http.NewRequest("GET", "/scrape", nil)
+	require.Nil(t, err)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	compressed(h, 1024)(w, r, nil)
+
+	var body io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		body, err = gzip.NewReader(w.Body)
+		require.Nil(t, err)
+	case "deflate":
+		body, err = zlib.NewReader(w.Body)
+		require.Nil(t, err)
+	}
+	decoded, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	return w, decoded
+}
+
+func TestCompress(t *testing.T) {
+	large, small := scrapeHandler(1000), scrapeHandler(1)
+	plainLarge := httptest.NewRecorder()
+	large(plainLarge, nil, nil)
+	plainSmall := httptest.NewRecorder()
+	small(plainSmall, nil, nil)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		// Twice, so that the second response uses a pooled compressor.
+		for i := 0; i < 2; i++ {
+			w, body := serveCompressed(t, large, encoding)
+			require.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			require.Equal(t, "", w.Header().Get("Content-Length"))
+			require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			require.True(t, w.Body.Len() < plainLarge.Body.Len())
+			require.Equal(t, plainLarge.Body.Bytes(), body)
+		}
+
+		w, body := serveCompressed(t, small, encoding)
+		require.Equal(t, "", w.Header().Get("Content-Encoding"))
+		require.Equal(t, strconv.Itoa(plainSmall.Body.Len()), w.Header().Get("Content-Length"))
+		require.Equal(t, plainSmall.Body.Bytes(), body)
+	}
+
+	// Clients that do not ask for compression never get it.
+	w, body := serveCompressed(t, large, "")
+	require.Equal(t, "", w.Header().Get("Content-Encoding"))
+	require.Equal(t, plainLarge.Body.Bytes(), body)
+
+	// Status codes written before the body are kept.
+	w, _ = serveCompressed(t, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, "gzip")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "0", w.Header().Get("Content-Length"))
+}
+
+func TestCompressConfig(t *testing.T) {
+	_, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"compress_min_size": -1}})
+	require.NotNil(t, err)
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"compress_min_size": 4096}})
+	require.Nil(t, err)
+	require.Equal(t, 4096, cfg.CompressMinSize)
+}
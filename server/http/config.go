@@ -5,21 +5,124 @@
 package http
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/listen"
 )
 
+// defaultMaxScrapeInfoHashes is the maximum number of infohashes per scrape
+// if none is configured.
+const defaultMaxScrapeInfoHashes = 50
+
+// defaultNumWant is the number of peers returned to clients that do not ask
+// for a specific number if none is configured.
+const defaultNumWant = 50
+
+// defaultMaxNumWant is the largest number of peers returned to a client if
+// none is configured.
+const defaultMaxNumWant = 50
+
+// defaultReadHeaderTimeout is the time clients have to send the headers of a
+// request if none is configured. It is short, so that clients that send their
+// headers slowly can not hold on to connections.
+const defaultReadHeaderTimeout = 5 * time.Second
+
+// defaultIdleTimeout is the time a kept-alive connection waits for the next
+// request if none is configured.
+const defaultIdleTimeout = 30 * time.Second
+
 type httpConfig struct {
-	Addr             string        `yaml:"addr"`
-	RequestTimeout   time.Duration `yaml:"request_timeout"`
-	ReadTimeout      time.Duration `yaml:"read_timeout"`
-	WriteTimeout     time.Duration `yaml:"write_timeout"`
-	AllowIPSpoofing  bool          `yaml:"allow_ip_spoofing"`
-	DualStackedPeers bool          `yaml:"dual_stacked_peers"`
-	RealIPHeader     string        `yaml:"real_ip_header"`
+	Addr                string        `yaml:"addr"`
+	RequestTimeout      time.Duration `yaml:"request_timeout"`
+	ReadTimeout         time.Duration `yaml:"read_timeout"`
+	WriteTimeout        time.Duration `yaml:"write_timeout"`
+	ReadHeaderTimeout   time.Duration `yaml:"read_header_timeout"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes      int           `yaml:"max_header_bytes"`
+	MaxURLLength        int           `yaml:"max_url_length"`
+	MaxBodyBytes        int64         `yaml:"max_body_bytes"`
+	KeepAlive           bool          `yaml:"keep_alive"`
+	HTTP2               bool          `yaml:"http2"`
+	AllowIPSpoofing     bool          `yaml:"allow_ip_spoofing"`
+	DualStackedPeers    bool          `yaml:"dual_stacked_peers"`
+	RealIPHeader        string        `yaml:"real_ip_header"`
+	MetricsAddr         string        `yaml:"metrics_addr"`
+	MaxScrapeInfoHashes int           `yaml:"max_scrape_infohashes"`
+	AllowFullScrape     bool          `yaml:"allow_full_scrape"`
+	DefaultNumWant      int32         `yaml:"default_num_want"`
+	MaxNumWant          int32         `yaml:"max_num_want"`
+	CompressMinSize     int           `yaml:"compress_min_size"`
+	TrustedProxies      []string      `yaml:"trusted_proxies"`
+	TLSCertFile         string        `yaml:"tls_cert_file"`
+	TLSKeyFile          string        `yaml:"tls_key_file"`
+	TLSMinVersion       string        `yaml:"tls_min_version"`
+	TLSClientCAFile     string        `yaml:"tls_client_ca_file"`
+	ExternalIP          bool          `yaml:"external_ip"`
+	CryptoFlags         bool          `yaml:"crypto_flags"`
+	TrackerID           string        `yaml:"tracker_id"`
+	ValidateTrackerID   bool          `yaml:"validate_tracker_id"`
+	AnnouncePaths       []string      `yaml:"announce_paths"`
+	ScrapePaths         []string      `yaml:"scrape_paths"`
+
+	// TraceHeader makes responses carry the middleware trace of their
+	// request in a Server-Timing header. Unless the trace_middleware of the
+	// tracker is enabled, traces are empty and the header is left out.
+	TraceHeader bool `yaml:"trace_header"`
+
+	// CompactDefault makes announces without the compact parameter get
+	// compact responses, unless their peer ID starts with one of the
+	// NonCompactClients.
+	CompactDefault    bool     `yaml:"compact_default"`
+	NonCompactClients []string `yaml:"non_compact_clients"`
+
+	// Config holds the options Addr is listened on with.
+	listen.Config `yaml:",inline"`
+
+	// Listeners are the addresses the server listens on. If none are
+	// configured, it listens on Addr with the TLS and listen options of
+	// httpConfig.
+	Listeners []listenerConfig `yaml:"listeners"`
+
+	// trustedProxies are the parsed TrustedProxies.
+	trustedProxies []*net.IPNet
+}
+
+// listenerConfig is the configuration of an address the server listens on,
+// which uses TLS if a certificate is configured.
+type listenerConfig struct {
+	Addr            string `yaml:"addr"`
+	TLSCertFile     string `yaml:"tls_cert_file"`
+	TLSKeyFile      string `yaml:"tls_key_file"`
+	TLSMinVersion   string `yaml:"tls_min_version"`
+	TLSClientCAFile string `yaml:"tls_client_ca_file"`
+
+	listen.Config `yaml:",inline"`
+}
+
+// TLS reports whether the listener uses TLS.
+func (cfg *listenerConfig) TLS() bool {
+	return cfg.TLSCertFile != ""
+}
+
+// validate checks that the TLS options of the listener are consistent, and
+// that its interface exists.
+func (cfg *listenerConfig) validate() error {
+	if err := cfg.Config.Validate(); err != nil {
+		return err
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if !cfg.TLS() && (cfg.TLSMinVersion != "" || cfg.TLSClientCAFile != "") {
+		return errors.New("TLS options require tls_cert_file and tls_key_file")
+	}
+	return nil
 }
 
 func newHTTPConfig(srvcfg *chihaya.ServerConfig) (*httpConfig, error) {
@@ -34,5 +137,174 @@ func newHTTPConfig(srvcfg *chihaya.ServerConfig) (*httpConfig, error) {
 		return nil, err
 	}
 
+	if cfg.MaxScrapeInfoHashes <= 0 {
+		cfg.MaxScrapeInfoHashes = defaultMaxScrapeInfoHashes
+	}
+	if cfg.MaxNumWant <= 0 {
+		cfg.MaxNumWant = defaultMaxNumWant
+	}
+	if cfg.DefaultNumWant <= 0 {
+		cfg.DefaultNumWant = defaultNumWant
+		if cfg.DefaultNumWant > cfg.MaxNumWant {
+			cfg.DefaultNumWant = cfg.MaxNumWant
+		}
+	}
+	if cfg.DefaultNumWant > cfg.MaxNumWant {
+		return nil, errors.New("default_num_want must not exceed max_num_want")
+	}
+
+	err = cfg.validateTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("max_header_bytes must not be negative, got %d", cfg.MaxHeaderBytes)
+	}
+	if cfg.MaxURLLength < 0 {
+		return nil, fmt.Errorf("max_url_length must not be negative, got %d", cfg.MaxURLLength)
+	}
+	if cfg.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("max_body_bytes must not be negative, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.MaxURLLength == 0 {
+		cfg.MaxURLLength = defaultMaxURLLength
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if cfg.CompressMinSize < 0 {
+		return nil, fmt.Errorf("compress_min_size must not be negative, got %d", cfg.CompressMinSize)
+	}
+
+	for _, cidr := range cfg.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", cidr, err)
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, network)
+	}
+
+	err = cfg.validateListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ValidateTrackerID && cfg.TrackerID == "" {
+		return nil, errors.New("validate_tracker_id requires tracker_id")
+	}
+
+	for _, prefix := range cfg.NonCompactClients {
+		if prefix == "" || len(prefix) > len(chihaya.PeerID{}) {
+			return nil, fmt.Errorf("non_compact_clients must be peer ID prefixes of 1 to %d bytes, got %q", len(chihaya.PeerID{}), prefix)
+		}
+	}
+
+	if len(cfg.AnnouncePaths) == 0 {
+		cfg.AnnouncePaths = defaultAnnouncePaths
+	}
+	if len(cfg.ScrapePaths) == 0 {
+		cfg.ScrapePaths = defaultScrapePaths
+	}
+	err = validateRoutes(cfg.AnnouncePaths, cfg.ScrapePaths)
+	if err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
+
+// validateListeners checks the configured listeners. If none are
+// configured, the listener of Addr and the TLS options of cfg is added.
+func (cfg *httpConfig) validateListeners() error {
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []listenerConfig{{
+			Addr:            cfg.Addr,
+			TLSCertFile:     cfg.TLSCertFile,
+			TLSKeyFile:      cfg.TLSKeyFile,
+			TLSMinVersion:   cfg.TLSMinVersion,
+			TLSClientCAFile: cfg.TLSClientCAFile,
+			Config:          cfg.Config,
+		}}
+		err := cfg.Listeners[0].validate()
+		if err != nil {
+			return err
+		}
+	} else {
+		if cfg.Addr != "" || cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSMinVersion != "" || cfg.TLSClientCAFile != "" || cfg.Config != (listen.Config{}) {
+			return errors.New("addr and the TLS and listen options must be set per listener if listeners are configured")
+		}
+
+		addrs := make(map[string]bool)
+		for i := range cfg.Listeners {
+			l := &cfg.Listeners[i]
+			if l.Addr == "" {
+				return fmt.Errorf("listener %d has no addr", i)
+			}
+			if addrs[l.Addr] {
+				return fmt.Errorf("listener %s is configured twice", l.Addr)
+			}
+			addrs[l.Addr] = true
+
+			err := l.validate()
+			if err != nil {
+				return fmt.Errorf("listener %s: %s", l.Addr, err)
+			}
+		}
+	}
+
+	anyTLS := false
+	for _, l := range cfg.Listeners {
+		anyTLS = anyTLS || l.TLS()
+	}
+	if cfg.HTTP2 && (!anyTLS || !cfg.KeepAlive) {
+		return errors.New("http2 requires a listener with tls_cert_file and tls_key_file, and keep_alive")
+	}
+	return nil
+}
+
+// validateTimeouts checks the configured timeouts and fills in the defaults
+// of the ones that are not set.
+func (cfg *httpConfig) validateTimeouts() error {
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request_timeout", cfg.RequestTimeout},
+		{"read_timeout", cfg.ReadTimeout},
+		{"write_timeout", cfg.WriteTimeout},
+		{"read_header_timeout", cfg.ReadHeaderTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", timeout.name, timeout.value)
+		}
+	}
+
+	if cfg.ReadTimeout > 0 && cfg.ReadHeaderTimeout > cfg.ReadTimeout {
+		return fmt.Errorf("read_header_timeout (%s) must not exceed read_timeout (%s)", cfg.ReadHeaderTimeout, cfg.ReadTimeout)
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = defaultReadHeaderTimeout
+		if cfg.ReadTimeout > 0 && cfg.ReadTimeout < cfg.ReadHeaderTimeout {
+			cfg.ReadHeaderTimeout = cfg.ReadTimeout
+		}
+	}
+
+	if cfg.IdleTimeout > 0 && !cfg.KeepAlive {
+		return errors.New("idle_timeout requires keep_alive")
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether ip is in any of the trusted proxy networks.
+func (cfg *httpConfig) isTrustedProxy(ip net.IP) bool {
+	for _, network := range cfg.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/pkg/bencode"
+)
+
+// The limits of requests if none are configured. An announce URL is a few
+// hundred bytes long, and a scrape of max_scrape_infohashes infohashes needs
+// about 70 bytes per infohash.
+const (
+	defaultMaxURLLength = 16 << 10
+	defaultMaxBodyBytes = 64 << 10
+)
+
+// limited wraps h so that requests whose URL is longer than maxURLLength or
+// whose body is larger than maxBodyBytes are rejected with a 400 before they
+// are parsed, and so that h can not read more than maxBodyBytes of a body
+// whose length was not announced.
+func limited(h httprouter.Handle, maxURLLength int, maxBodyBytes int64) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if len(r.RequestURI) > maxURLLength {
+			rejectRequest(w, "request URL too long")
+			return
+		}
+		if r.ContentLength > maxBodyBytes {
+			rejectRequest(w, "request body too large")
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		h(w, r, p)
+	}
+}
+
+// rejectRequest answers a request that exceeds the limits with a 400 and a
+// failure reason, and closes the connection, as the rest of the request is
+// not read.
+func rejectRequest(w http.ResponseWriter, reason string) {
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusBadRequest)
+	bencode.NewEncoder(w).Encode(bencode.Dict{"failure reason": reason})
+}
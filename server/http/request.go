@@ -7,75 +7,77 @@ package http
 import (
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
 
 	"github.com/chihaya/chihaya"
 	"github.com/chihaya/chihaya/pkg/event"
-	"github.com/chihaya/chihaya/server/http/query"
 	"github.com/chihaya/chihaya/tracker"
 )
 
+// ErrInvalidTrackerID is returned for announces whose tracker id is not the
+// one of the server, if tracker ids are validated.
+var ErrInvalidTrackerID = tracker.ClientError("invalid tracker id")
+
+// ErrFullScrapeNotAllowed is returned for scrapes without infohashes, unless
+// full scrapes are allowed.
+var ErrFullScrapeNotAllowed = tracker.ClientError("full scrape not allowed")
+
+// maxKeyLength is the length of the longest key parameter accepted. Clients
+// usually send 8 hexadecimal digits.
+const maxKeyLength = 64
+
 func announceRequest(r *http.Request, cfg *httpConfig) (*chihaya.AnnounceRequest, error) {
-	q, err := query.New(r.URL.RawQuery)
+	q, err := parseQuery(r.URL.RawQuery)
 	if err != nil {
 		return nil, err
 	}
-
-	request := &chihaya.AnnounceRequest{Params: q}
-
-	eventStr, err := q.String("event")
-	if err == query.ErrKeyNotFound {
-		eventStr = ""
-	} else if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: event")
-	}
-	request.Event, err = event.New(eventStr)
-	if err != nil {
-		return nil, tracker.ClientError("failed to provide valid client event")
+	if err := validateAnnounce(q); err != nil {
+		return nil, err
 	}
 
-	compactStr, _ := q.String("compact")
-	request.Compact = compactStr != "" && compactStr != "0"
-
-	infoHashes := q.InfoHashes()
-	if len(infoHashes) < 1 {
-		return nil, tracker.ClientError("no info_hash parameter supplied")
+	// The parameters were validated, so the errors of required parameters
+	// are not checked again.
+	request := &chihaya.AnnounceRequest{
+		ClientCertName: clientCertName(r),
+		Params:         q,
+		InfoHash:       q.InfoHashes()[0],
 	}
-	if len(infoHashes) > 1 {
-		return nil, tracker.ClientError("multiple info_hash parameters supplied")
-	}
-	request.InfoHash = infoHashes[0]
 
-	peerID, err := q.String("peer_id")
-	if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: peer_id")
-	}
-	if len(peerID) != 20 {
-		return nil, tracker.ClientError("failed to provide valid peer_id")
-	}
-	request.PeerID = chihaya.PeerIDFromString(peerID)
+	eventStr, _ := q.String("event")
+	request.Event, _ = event.New(eventStr)
 
-	request.Left, err = q.Uint64("left")
-	if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: left")
-	}
+	noPeerIDStr, _ := q.String("no_peer_id")
+	request.NoPeerID = noPeerIDStr != "" && noPeerIDStr != "0"
 
-	request.Downloaded, err = q.Uint64("downloaded")
-	if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: downloaded")
-	}
+	peerID, _ := q.String("peer_id")
+	request.PeerID = chihaya.PeerIDFromString(peerID)
 
-	request.Uploaded, err = q.Uint64("uploaded")
-	if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: uploaded")
+	request.Compact = wantsCompact(q, peerID, cfg)
+
+	request.Left, _ = q.Uint64("left")
+	request.Downloaded, _ = q.Uint64("downloaded")
+	request.Uploaded, _ = q.Uint64("uploaded")
+
+	// Clients that leave out numwant get the default number of peers. Those
+	// that send 0 get none, and those that want more than the maximum get the
+	// maximum.
+	request.NumWant = cfg.DefaultNumWant
+	if numwantStr, _ := q.String("numwant"); numwantStr != "" {
+		// The only errors left are those of numbers too large to parse.
+		numwant, err := strconv.ParseUint(numwantStr, 10, 64)
+		if err != nil || numwant > uint64(cfg.MaxNumWant) {
+			numwant = uint64(cfg.MaxNumWant)
+		}
+		request.NumWant = int32(numwant)
 	}
 
-	numwant, _ := q.Uint64("numwant")
-	request.NumWant = int32(numwant)
+	request.Key, _ = q.String("key")
+	request.Crypto = announcedCrypto(q)
 
-	port, err := q.Uint64("port")
-	if err != nil {
-		return nil, tracker.ClientError("failed to parse parameter: port")
-	}
+	port, _ := q.Uint64("port")
 	request.Port = uint16(port)
 
 	v4, v6, err := requestedIP(q, r, cfg)
@@ -85,99 +87,220 @@ func announceRequest(r *http.Request, cfg *httpConfig) (*chihaya.AnnounceRequest
 	request.IPv4 = v4
 	request.IPv6 = v6
 
+	// Clients only echo the tracker id once they received it, so announces
+	// without one are valid.
+	if cfg.ValidateTrackerID {
+		trackerID, err := q.String("trackerid")
+		if err == nil && trackerID != cfg.TrackerID {
+			return nil, ErrInvalidTrackerID
+		}
+	}
+
 	return request, nil
 }
 
+// wantsCompact reports whether the announce of the client with peerID gets a
+// compact response. The compact parameter takes precedence over the
+// NonCompactClients, which take precedence over the CompactDefault. An empty
+// compact parameter counts as absent.
+func wantsCompact(q chihaya.Params, peerID string, cfg *httpConfig) bool {
+	if compactStr, _ := q.String("compact"); compactStr != "" {
+		return compactStr != "0"
+	}
+
+	for _, prefix := range cfg.NonCompactClients {
+		if strings.HasPrefix(peerID, prefix) {
+			return false
+		}
+	}
+	return cfg.CompactDefault
+}
+
+// announcedCrypto returns the support for encrypted connections announced
+// with the supportcrypto and requirecrypto parameters, which are set unless
+// they are empty or 0.
+func announcedCrypto(q chihaya.Params) chihaya.Crypto {
+	if requireStr, _ := q.String("requirecrypto"); requireStr != "" && requireStr != "0" {
+		return chihaya.CryptoRequired
+	}
+	if supportStr, _ := q.String("supportcrypto"); supportStr != "" && supportStr != "0" {
+		return chihaya.CryptoSupported
+	}
+	return chihaya.CryptoNone
+}
+
 func scrapeRequest(r *http.Request, cfg *httpConfig) (*chihaya.ScrapeRequest, error) {
-	q, err := query.New(r.URL.RawQuery)
+	q, err := parseQuery(r.URL.RawQuery)
 	if err != nil {
 		return nil, err
 	}
 
+	// Scrapes without infohashes are full scrapes, which list every swarm.
+	// They are expensive and reveal all torrents, so they are optional.
 	infoHashes := q.InfoHashes()
-	if len(infoHashes) < 1 {
-		return nil, tracker.ClientError("no info_hash parameter supplied")
+	if len(infoHashes) < 1 && !cfg.AllowFullScrape {
+		return nil, ErrFullScrapeNotAllowed
+	}
+	if len(infoHashes) > cfg.MaxScrapeInfoHashes {
+		return nil, tracker.ClientError("too many info_hash parameters supplied")
+	}
+
+	v4, v6, err := requestedIP(q, r, cfg)
+	if err != nil {
+		return nil, tracker.ClientError("failed to parse remote IP")
 	}
 
 	request := &chihaya.ScrapeRequest{
-		InfoHashes: infoHashes,
-		Params:     q,
+		InfoHashes:     infoHashes,
+		Full:           len(infoHashes) < 1,
+		IPv4:           v4,
+		IPv6:           v6,
+		ClientCertName: clientCertName(r),
+		Params:         q,
 	}
 
 	return request, nil
 }
 
-// requestedIP returns the IP address for a request. If there are multiple in
-// the request, one IPv4 and one IPv6 will be returned.
-func requestedIP(p chihaya.Params, r *http.Request, cfg *httpConfig) (v4, v6 net.IP, err error) {
-	var done bool
+// passkey returns the passkey of a request, which is the segment of its path
+// captured by passkeyParam, e.g. of /announce/<passkey>, or the passkey
+// parameter.
+func passkey(q chihaya.Params, p httprouter.Params) string {
+	if passkey := p.ByName("passkey"); passkey != "" {
+		return passkey
+	}
+
+	passkey, _ := q.String("passkey")
+	return passkey
+}
 
+// requestedIP returns the IP addresses for a request, one of each family at
+// most. Each family is taken from the first of these that has an address of
+// it:
+//
+//   - the ipv4 or ipv6 parameter of the family, if IP spoofing is allowed
+//   - the ip parameter, if IP spoofing is allowed
+//   - the address of the client, see socketAddr
+//
+// Loopback, multicast and unspecified addresses of parameters are ignored.
+// Unless peers are dual-stacked, only one address is returned: that of a
+// parameter if there is one, and the IPv4 address of parameters of both
+// families.
+func requestedIP(p chihaya.Params, r *http.Request, cfg *httpConfig) (v4, v6 net.IP, err error) {
 	if cfg.AllowIPSpoofing {
-		if str, e := p.String("ip"); e == nil {
-			if v4, v6, done = getIPs(str, v4, v6, cfg); done {
-				return
+		for _, key := range []string{"ipv4", "ipv6", "ip"} {
+			str, e := p.String(key)
+			if e != nil {
+				continue
 			}
-		}
 
-		if str, e := p.String("ipv4"); e == nil {
-			if v4, v6, done = getIPs(str, v4, v6, cfg); done {
-				return
+			ip := parseIP(str)
+			if ip == nil || ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() {
+				continue
 			}
-		}
-
-		if str, e := p.String("ipv6"); e == nil {
-			if v4, v6, done = getIPs(str, v4, v6, cfg); done {
-				return
+			if key == "ipv4" && ip.To4() == nil || key == "ipv6" && ip.To4() != nil {
+				continue
 			}
+			v4, v6 = fillIP(ip, v4, v6)
 		}
-	}
 
-	if cfg.RealIPHeader != "" {
-		if xRealIPs, ok := r.Header[cfg.RealIPHeader]; ok {
-			if v4, v6, done = getIPs(string(xRealIPs[0]), v4, v6, cfg); done {
-				return
-			}
+		if !cfg.DualStackedPeers && v4 != nil {
+			return v4, nil, nil
 		}
-	} else {
-		if r.RemoteAddr == "" && v4 == nil {
-			if v4, v6, done = getIPs("127.0.0.1", v4, v6, cfg); done {
-				return
-			}
+		if !cfg.DualStackedPeers && v6 != nil {
+			return nil, v6, nil
 		}
+	}
 
-		if v4, v6, done = getIPs(r.RemoteAddr, v4, v6, cfg); done {
-			return
+	if addr, ok := socketAddr(r, cfg); ok {
+		if ip := parseIP(addr); ip != nil {
+			v4, v6 = fillIP(ip, v4, v6)
 		}
 	}
 
 	if v4 == nil && v6 == nil {
 		err = tracker.ClientError("failed to parse IP address")
 	}
-
 	return
 }
 
-func getIPs(ipstr string, ipv4, ipv6 net.IP, cfg *httpConfig) (net.IP, net.IP, bool) {
-	host, _, err := net.SplitHostPort(ipstr)
+// socketAddr returns the address of the client that sent r: the address of
+// the socket, or the one forwarded by a trusted proxy, or the one of the real
+// IP header if it is configured without trusted proxies. It reports false
+// if the real IP header is missing.
+func socketAddr(r *http.Request, cfg *httpConfig) (string, bool) {
+	switch {
+	case len(cfg.trustedProxies) > 0:
+		return clientAddr(r, cfg), true
+	case cfg.RealIPHeader != "":
+		if xRealIPs, ok := r.Header[cfg.RealIPHeader]; ok {
+			return xRealIPs[0], true
+		}
+		return "", false
+	case r.RemoteAddr == "":
+		return "127.0.0.1", true
+	default:
+		return r.RemoteAddr, true
+	}
+}
+
+// clientAddr returns the address of the client that sent r.
+//
+// If r was sent by a trusted proxy, the address is the rightmost entry of the
+// X-Forwarded-For header that is not a trusted proxy itself or, if there is no
+// such header, the value of the real IP header. The headers of requests sent
+// by anyone else are ignored, so that clients cannot forge their address.
+func clientAddr(r *http.Request, cfg *httpConfig) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = ipstr
+		host = r.RemoteAddr
+	}
+	if !cfg.isTrustedProxy(net.ParseIP(host)) {
+		return r.RemoteAddr
+	}
+
+	if forwarded, ok := r.Header["X-Forwarded-For"]; ok {
+		entries := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := strings.TrimSpace(entries[i])
+			if ip := net.ParseIP(entry); ip == nil || !cfg.isTrustedProxy(ip) || i == 0 {
+				return entry
+			}
+		}
 	}
 
-	if ip := net.ParseIP(host); ip != nil {
-		ipTo4 := ip.To4()
-		if ipv4 == nil && ipTo4 != nil {
-			ipv4 = ipTo4
-		} else if ipv6 == nil && ipTo4 == nil {
-			ipv6 = ip
+	if cfg.RealIPHeader != "" {
+		if xRealIPs, ok := r.Header[cfg.RealIPHeader]; ok {
+			return xRealIPs[0]
 		}
 	}
 
-	var done bool
-	if cfg.DualStackedPeers {
-		done = ipv4 != nil && ipv6 != nil
-	} else {
-		done = ipv4 != nil || ipv6 != nil
+	return r.RemoteAddr
+}
+
+// parseIP parses the IP of ipstr, which may have a port. IPv4 addresses are
+// returned in their 4-byte form. It returns nil if ipstr is not an IP.
+func parseIP(ipstr string) net.IP {
+	host, _, err := net.SplitHostPort(ipstr)
+	if err != nil {
+		host = ipstr
 	}
 
-	return ipv4, ipv6, done
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// fillIP sets the address of the family of ip to ip, unless it is set.
+func fillIP(ip, v4, v6 net.IP) (net.IP, net.IP) {
+	if ip.To4() != nil {
+		if v4 == nil {
+			v4 = ip
+		}
+	} else if v6 == nil {
+		v6 = ip
+	}
+	return v4, v6
 }
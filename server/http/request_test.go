@@ -0,0 +1,438 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/http/query"
+	"github.com/chihaya/chihaya/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeRequest(t *testing.T) {
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{
+		"max_scrape_infohashes": 2,
+	}})
+	require.Nil(t, err)
+
+	var (
+		hash  = "aaaaaaaaaaaaaaaaaaaa"
+		hash2 = "bbbbbbbbbbbbbbbbbbbb"
+		hash3 = "cccccccccccccccccccc"
+	)
+
+	var table = []struct {
+		infoHashes []string
+		err        error
+	}{
+		{[]string{hash}, nil},
+		{[]string{hash, hash2}, nil},
+		{[]string{hash, hash2, hash3}, tracker.ClientError("too many info_hash parameters supplied")},
+		{nil, ErrFullScrapeNotAllowed},
+	}
+
+	for _, tt := range table {
+		var params []string
+		for _, infoHash := range tt.infoHashes {
+			params = append(params, "info_hash="+infoHash)
+		}
+		r, err := http.NewRequest("GET", "/scrape?"+strings.Join(params, "&"), nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := scrapeRequest(r, cfg)
+		require.Equal(t, tt.err, err, "%v", tt.infoHashes)
+		if err != nil {
+			continue
+		}
+
+		require.Len(t, req.InfoHashes, len(tt.infoHashes))
+		for i, infoHash := range tt.infoHashes {
+			require.Equal(t, chihaya.InfoHashFromString(infoHash), req.InfoHashes[i])
+		}
+		require.Equal(t, "10.0.0.1", req.IPv4.String())
+	}
+
+	// the limit has a default
+	cfg, err = newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	require.Equal(t, defaultMaxScrapeInfoHashes, cfg.MaxScrapeInfoHashes)
+}
+
+func TestRequestedIP(t *testing.T) {
+	var (
+		spoofing = map[string]interface{}{"allow_ip_spoofing": true}
+		dual     = map[string]interface{}{"allow_ip_spoofing": true, "dual_stacked_peers": true}
+		noSpoof  = map[string]interface{}{"dual_stacked_peers": true}
+	)
+
+	var table = []struct {
+		config     map[string]interface{}
+		remoteAddr string
+		query      string
+		v4, v6     string
+	}{
+		// the socket address is used without parameters
+		{spoofing, "203.0.113.1:6881", "", "203.0.113.1", "<nil>"},
+		{spoofing, "[2001:db8::1]:6881", "", "<nil>", "2001:db8::1"},
+		{dual, "203.0.113.1:6881", "", "203.0.113.1", "<nil>"},
+
+		// parameters are ignored unless IP spoofing is allowed
+		{noSpoof, "203.0.113.1:6881", "ipv4=198.51.100.1&ipv6=2001:db8::2", "203.0.113.1", "<nil>"},
+
+		// a parameter of the family takes precedence over the socket address
+		{spoofing, "203.0.113.1:6881", "ipv4=198.51.100.1", "198.51.100.1", "<nil>"},
+		{spoofing, "203.0.113.1:6881", "ip=198.51.100.1", "198.51.100.1", "<nil>"},
+		{spoofing, "[2001:db8::1]:6881", "ipv6=2001:db8::2", "<nil>", "2001:db8::2"},
+		{dual, "[2001:db8::1]:6881", "ipv6=[2001:db8::2]:6881", "<nil>", "2001:db8::2"},
+		{dual, "203.0.113.1:6881", "ipv4=198.51.100.1", "198.51.100.1", "<nil>"},
+
+		// ipv4 and ipv6 take precedence over ip
+		{spoofing, "203.0.113.1:6881", "ip=192.0.2.1&ipv4=198.51.100.1", "198.51.100.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ip=2001:db8::3&ipv6=2001:db8::2", "203.0.113.1", "2001:db8::2"},
+
+		// the families are filled independently for dual-stacked peers
+		{dual, "203.0.113.1:6881", "ipv6=2001:db8::2", "203.0.113.1", "2001:db8::2"},
+		{dual, "[2001:db8::1]:6881", "ipv4=198.51.100.1", "198.51.100.1", "2001:db8::1"},
+		{dual, "[2001:db8::1]:6881", "ip=198.51.100.1", "198.51.100.1", "2001:db8::1"},
+		{dual, "203.0.113.1:6881", "ipv4=198.51.100.1&ipv6=2001:db8::2", "198.51.100.1", "2001:db8::2"},
+
+		// and only the one of a parameter is kept otherwise, IPv4 first
+		{spoofing, "203.0.113.1:6881", "ipv6=2001:db8::2", "<nil>", "2001:db8::2"},
+		{spoofing, "[2001:db8::1]:6881", "ipv4=198.51.100.1", "198.51.100.1", "<nil>"},
+		{spoofing, "203.0.113.1:6881", "ipv4=198.51.100.1&ipv6=2001:db8::2", "198.51.100.1", "<nil>"},
+
+		// parameters of the wrong family are ignored
+		{dual, "203.0.113.1:6881", "ipv4=2001:db8::2", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ipv6=198.51.100.1", "203.0.113.1", "<nil>"},
+
+		// so are unroutable and malformed ones
+		{dual, "203.0.113.1:6881", "ipv4=127.0.0.1", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ip=0.0.0.0", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ipv4=224.0.0.1", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ipv6=::1", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ipv6=::", "203.0.113.1", "<nil>"},
+		{dual, "203.0.113.1:6881", "ipv6=ff02::1", "203.0.113.1", "<nil>"},
+		{spoofing, "203.0.113.1:6881", "ip=garbage", "203.0.113.1", "<nil>"},
+
+		// the socket address is used whatever it is
+		{spoofing, "127.0.0.1:6881", "ip=127.0.0.2", "127.0.0.1", "<nil>"},
+	}
+
+	for _, tt := range table {
+		cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: tt.config})
+		require.Nil(t, err)
+
+		r, err := http.NewRequest("GET", "/announce?"+tt.query, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = tt.remoteAddr
+		q, err := parseQuery(r.URL.RawQuery)
+		require.Nil(t, err)
+
+		v4, v6, err := requestedIP(q, r, cfg)
+		require.Nil(t, err, "%v from %s with %q", tt.config, tt.remoteAddr, tt.query)
+		require.Equal(t, tt.v4, v4.String(), "IPv4 of %v from %s with %q", tt.config, tt.remoteAddr, tt.query)
+		require.Equal(t, tt.v6, v6.String(), "IPv6 of %v from %s with %q", tt.config, tt.remoteAddr, tt.query)
+	}
+}
+
+func TestRequestedIPTrustedProxies(t *testing.T) {
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{
+		"trusted_proxies": []string{"127.0.0.0/8", "10.0.0.0/8"},
+		"real_ip_header":  "X-Real-Ip",
+	}})
+	require.Nil(t, err)
+
+	var table = []struct {
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		// direct connections use their own address
+		{"203.0.113.1:6881", nil, "203.0.113.1"},
+
+		// forged headers from untrusted sources are ignored
+		{"203.0.113.1:6881", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.1"},
+		{"203.0.113.1:6881", map[string][]string{"X-Real-Ip": {"198.51.100.1"}}, "203.0.113.1"},
+
+		// trusted proxies forward the address of the client
+		{"127.0.0.1:6881", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"127.0.0.1:6881", map[string][]string{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"127.0.0.1:6881", nil, "127.0.0.1"},
+
+		// the rightmost untrusted entry wins, entries prepended by the
+		// client are ignored
+		{"127.0.0.1:6881", map[string][]string{"X-Forwarded-For": {"192.0.2.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"127.0.0.1:6881", map[string][]string{"X-Forwarded-For": {"192.0.2.1", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+
+		// if all entries are trusted, the leftmost wins
+		{"127.0.0.1:6881", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+
+		// IPv6 clients
+		{"127.0.0.1:6881", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+	}
+
+	for _, tt := range table {
+		r, err := http.NewRequest("GET", "/announce", nil)
+		require.Nil(t, err)
+		r.RemoteAddr = tt.remoteAddr
+		for key, values := range tt.headers {
+			r.Header[key] = values
+		}
+
+		v4, v6, err := requestedIP(noParams{}, r, cfg)
+		require.Nil(t, err, "%s %v", tt.remoteAddr, tt.headers)
+		ip := v4
+		if ip == nil {
+			ip = v6
+		}
+		require.Equal(t, tt.expected, ip.String(), "%s %v", tt.remoteAddr, tt.headers)
+	}
+
+	// malformed forwarded addresses are rejected
+	r, err := http.NewRequest("GET", "/announce", nil)
+	require.Nil(t, err)
+	r.RemoteAddr = "127.0.0.1:6881"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, garbage")
+	_, _, err = requestedIP(noParams{}, r, cfg)
+	require.NotNil(t, err)
+
+	// invalid networks are rejected
+	_, err = newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{
+		"trusted_proxies": []string{"127.0.0.1"},
+	}})
+	require.NotNil(t, err)
+}
+
+// noParams are the parameters of a request without any.
+type noParams struct{}
+
+func (noParams) String(key string) (string, error) { return "", query.ErrKeyNotFound }
+
+func TestAnnounceRequestTrackerID(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000001&port=6881&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		config    map[string]interface{}
+		trackerID string
+		err       error
+	}{
+		{nil, "", nil},
+		{nil, "anything", nil},
+		{map[string]interface{}{"tracker_id": "chihaya-01"}, "anything", nil},
+		{map[string]interface{}{"tracker_id": "chihaya-01", "validate_tracker_id": true}, "", nil},
+		{map[string]interface{}{"tracker_id": "chihaya-01", "validate_tracker_id": true}, "chihaya-01", nil},
+		{map[string]interface{}{"tracker_id": "chihaya-01", "validate_tracker_id": true}, "chihaya-02", ErrInvalidTrackerID},
+	}
+
+	for _, tt := range table {
+		cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: tt.config})
+		require.Nil(t, err)
+
+		url := announce
+		if tt.trackerID != "" {
+			url += "&trackerid=" + tt.trackerID
+		}
+		r, err := http.NewRequest("GET", url, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		_, err = announceRequest(r, cfg)
+		require.Equal(t, tt.err, err, "%v with tracker id %q", tt.config, tt.trackerID)
+	}
+
+	_, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"validate_tracker_id": true}})
+	require.NotNil(t, err)
+}
+
+func TestAnnounceRequestKey(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000001&port=6881&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		key, expected string
+		err           error
+	}{
+		{"", "", nil},
+		{"&key=3F2A1B9C", "3F2A1B9C", nil},
+		{"&key=" + strings.Repeat("a", maxKeyLength), strings.Repeat("a", maxKeyLength), nil},
+		{"&key=" + strings.Repeat("a", maxKeyLength+1), "", tracker.ClientError("failed to provide valid key")},
+	}
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	for _, tt := range table {
+		r, err := http.NewRequest("GET", announce+tt.key, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		require.Equal(t, tt.err, err, tt.key)
+		if err == nil {
+			require.Equal(t, tt.expected, req.Key)
+			require.Equal(t, tt.expected, req.Peer4().Key)
+		}
+	}
+}
+
+func TestAnnounceRequestNumWant(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000001&port=6881&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		config   map[string]interface{}
+		numwant  string
+		expected int32
+	}{
+		{nil, "", defaultNumWant},
+		{nil, "&numwant=0", 0},
+		{nil, "&numwant=10", 10},
+		{nil, "&numwant=", defaultNumWant},
+		{nil, "&numwant=99999999999999999999999", defaultMaxNumWant},
+		{nil, "&numwant=10000", defaultMaxNumWant},
+		{nil, "&numwant=99999999999", defaultMaxNumWant},
+		{map[string]interface{}{"default_num_want": 30}, "", 30},
+		{map[string]interface{}{"default_num_want": 30}, "&numwant=0", 0},
+		{map[string]interface{}{"max_num_want": 200}, "&numwant=10000", 200},
+		{map[string]interface{}{"max_num_want": 200}, "", defaultNumWant},
+
+		// the default does not exceed a lower maximum
+		{map[string]interface{}{"max_num_want": 20}, "", 20},
+	}
+
+	for _, tt := range table {
+		cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: tt.config})
+		require.Nil(t, err)
+
+		r, err := http.NewRequest("GET", announce+tt.numwant, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.NumWant, "%v with %q", tt.config, tt.numwant)
+	}
+
+	_, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"default_num_want": 100, "max_num_want": 20}})
+	require.NotNil(t, err)
+}
+
+func TestFullScrape(t *testing.T) {
+	r, err := http.NewRequest("GET", "/scrape", nil)
+	require.Nil(t, err)
+	r.RemoteAddr = "10.0.0.1:6881"
+
+	// Full scrapes fail by default.
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	_, err = scrapeRequest(r, cfg)
+	require.Equal(t, ErrFullScrapeNotAllowed, err)
+
+	w := httptest.NewRecorder()
+	require.Nil(t, writeError(w, err))
+	require.Equal(t, "d14:failure reason23:full scrape not allowede", w.Body.String())
+
+	cfg, err = newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"allow_full_scrape": true}})
+	require.Nil(t, err)
+	req, err := scrapeRequest(r, cfg)
+	require.Nil(t, err)
+	require.True(t, req.Full)
+	require.Len(t, req.InfoHashes, 0)
+
+	// Scrapes of infohashes work either way.
+	r, err = http.NewRequest("GET", "/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa", nil)
+	require.Nil(t, err)
+	r.RemoteAddr = "10.0.0.1:6881"
+	req, err = scrapeRequest(r, cfg)
+	require.Nil(t, err)
+	require.False(t, req.Full)
+	require.Len(t, req.InfoHashes, 1)
+}
+
+func TestAnnounceRequestCompact(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&port=6881&left=0&downloaded=0&uploaded=0"
+	const (
+		modern  = "&peer_id=-TEST01-000000000001"
+		ancient = "&peer_id=-AN0100-000000000001"
+	)
+
+	var (
+		none    = map[string]interface{}{"non_compact_clients": []string{"-AN01"}}
+		compact = map[string]interface{}{"non_compact_clients": []string{"-AN01"}, "compact_default": true}
+	)
+
+	var table = []struct {
+		config   map[string]interface{}
+		query    string
+		expected bool
+	}{
+		// the default applies without the parameter
+		{nil, modern, false},
+		{compact, modern, true},
+		{compact, modern + "&compact=", true},
+
+		// clients with quirks override the default
+		{none, ancient, false},
+		{compact, ancient, false},
+
+		// the parameter overrides both
+		{none, modern + "&compact=1", true},
+		{compact, modern + "&compact=0", false},
+		{none, ancient + "&compact=1", true},
+		{compact, ancient + "&compact=1", true},
+		{compact, ancient + "&compact=0", false},
+	}
+
+	for _, tt := range table {
+		cfg, err := newHTTPConfig(&chihaya.ServerConfig{Config: tt.config})
+		require.Nil(t, err)
+
+		r, err := http.NewRequest("GET", announce+tt.query, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.Compact, "%v with %q", tt.config, tt.query)
+	}
+
+	for _, prefix := range []string{"", strings.Repeat("a", 21)} {
+		_, err := newHTTPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"non_compact_clients": []string{prefix}}})
+		require.NotNil(t, err, "%q", prefix)
+	}
+}
+
+func TestAnnounceRequestCrypto(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000001&port=6881&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		query    string
+		expected chihaya.Crypto
+	}{
+		{"", chihaya.CryptoNone},
+		{"&supportcrypto=0", chihaya.CryptoNone},
+		{"&supportcrypto=", chihaya.CryptoNone},
+		{"&supportcrypto=1", chihaya.CryptoSupported},
+		{"&requirecrypto=1", chihaya.CryptoRequired},
+		{"&supportcrypto=1&requirecrypto=1", chihaya.CryptoRequired},
+		{"&supportcrypto=1&requirecrypto=0", chihaya.CryptoSupported},
+	}
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	for _, tt := range table {
+		r, err := http.NewRequest("GET", announce+tt.query, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.Crypto, tt.query)
+		require.Equal(t, tt.expected, req.Peer4().Crypto, tt.query)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chihaya/chihaya/pkg/bencode"
+)
+
+// passkeyParam is the path segment that captures the passkey of a request.
+const passkeyParam = ":passkey"
+
+// The paths announces and scrapes are served at if none are configured.
+var (
+	defaultAnnouncePaths = []string{"/announce", "/announce/" + passkeyParam}
+	defaultScrapePaths   = []string{"/scrape", "/scrape/" + passkeyParam}
+)
+
+// validateRoutes checks the configured paths of announces and scrapes.
+//
+// A path consists of non-empty segments that are either literal or the
+// passkeyParam, which may appear once. No two paths may match the same
+// request, so that requests are told apart by their paths alone.
+func validateRoutes(announcePaths, scrapePaths []string) error {
+	var paths []string
+	for _, path := range append(append([]string(nil), announcePaths...), scrapePaths...) {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path %q must start with a slash", path)
+		}
+		if strings.ContainsAny(path, "?#*") {
+			return fmt.Errorf("path %q must not contain a query, fragment or catch-all", path)
+		}
+
+		params := 0
+		for _, segment := range strings.Split(path[1:], "/") {
+			switch {
+			case segment == "":
+				return fmt.Errorf("path %q must not contain empty segments", path)
+			case segment == passkeyParam:
+				params++
+			case strings.HasPrefix(segment, ":"):
+				return fmt.Errorf("path %q: only the %s parameter is supported, got %s", path, passkeyParam, segment)
+			}
+		}
+		if params > 1 {
+			return fmt.Errorf("path %q must capture the passkey at most once", path)
+		}
+
+		for _, other := range paths {
+			if overlap(path, other) {
+				return fmt.Errorf("paths %q and %q match the same requests", other, path)
+			}
+		}
+		paths = append(paths, path)
+	}
+	return nil
+}
+
+// overlap reports whether any request path matches both a and b.
+func overlap(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] && as[i] != passkeyParam && bs[i] != passkeyParam {
+			return false
+		}
+	}
+	return true
+}
+
+// notFound answers requests of unknown paths with a 404 and a failure reason,
+// which clients show to their users.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+	bencode.NewEncoder(w).Encode(bencode.Dict{"failure reason": "unknown path"})
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	var table = []struct {
+		announce, scrape []string
+		valid            bool
+	}{
+		{defaultAnnouncePaths, defaultScrapePaths, true},
+		{[]string{"/:passkey/announce"}, []string{"/:passkey/scrape"}, true},
+		{[]string{"/tracker/announce.php"}, []string{"/tracker/scrape.php"}, true},
+		{[]string{"/a/:passkey/b"}, []string{"/a/:passkey/c"}, true},
+		{[]string{"announce"}, nil, false},
+		{[]string{"/announce/"}, nil, false},
+		{[]string{"/announce//x"}, nil, false},
+		{[]string{"/announce?x=1"}, nil, false},
+		{[]string{"/announce/*rest"}, nil, false},
+		{[]string{"/announce/:key"}, nil, false},
+		{[]string{"/:passkey/:passkey"}, nil, false},
+
+		// Paths that match the same requests are ambiguous.
+		{[]string{"/announce"}, []string{"/announce"}, false},
+		{[]string{"/announce/:passkey"}, []string{"/announce/scrape"}, false},
+		{[]string{"/:passkey"}, []string{"/scrape"}, false},
+		{[]string{"/a/:passkey/b"}, []string{"/a/b/:passkey"}, false},
+	}
+
+	for _, tt := range table {
+		err := validateRoutes(tt.announce, tt.scrape)
+		require.Equal(t, tt.valid, err == nil, "%v %v: %v", tt.announce, tt.scrape, err)
+	}
+}
@@ -5,15 +5,23 @@
 package http
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tylerb/graceful"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server"
 	"github.com/chihaya/chihaya/tracker"
 )
@@ -28,72 +36,263 @@ func constructor(srvcfg *chihaya.ServerConfig, tkr *tracker.Tracker) (server.Ser
 		return nil, errors.New("http: invalid config: " + err.Error())
 	}
 
-	return &httpServer{
+	s := &httpServer{
 		cfg: cfg,
 		tkr: tkr,
-	}, nil
+	}
+
+	for i := range cfg.Listeners {
+		l := &listener{cfg: &cfg.Listeners[i]}
+		if l.cfg.TLS() {
+			l.certs, err = newCertReloader(l.cfg.TLSCertFile, l.cfg.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("http: failed to load TLS certificate of %s: %s", l.cfg.Addr, err)
+			}
+
+			l.tlsConfig, err = newTLSConfig(l.cfg, cfg.HTTP2, l.certs)
+			if err != nil {
+				return nil, fmt.Errorf("http: invalid TLS config of %s: %s", l.cfg.Addr, err)
+			}
+		}
+		s.listeners = append(s.listeners, l)
+	}
+
+	return s, nil
 }
 
 type httpServer struct {
-	cfg   *httpConfig
-	tkr   *tracker.Tracker
+	cfg       *httpConfig
+	tkr       *tracker.Tracker
+	listeners []*listener
+	metrics   *graceful.Server
+	hup       chan os.Signal
+}
+
+// listener serves the routes of an httpServer on one of its addresses.
+type listener struct {
+	cfg   *listenerConfig
 	grace *graceful.Server
+
+	// certs and tlsConfig are nil unless the listener uses TLS.
+	certs     *certReloader
+	tlsConfig *tls.Config
 }
 
 // Start runs the server and blocks until it has exited.
 //
+// Every listener serves the same routes, which dispatch into the same
+// tracker. If one of them can not listen on its address, Start fails before
+// any of them serves.
+//
+// If a metrics address is configured, metrics are served on it under
+// /metrics.
+//
+// If TLS is configured, the certificates are reloaded whenever the process
+// receives SIGHUP.
+//
 // It panics if the server exits unexpectedly.
 func (s *httpServer) Start() {
-	s.grace = &graceful.Server{
-		Server: &http.Server{
-			Addr:         s.cfg.Addr,
-			Handler:      s.routes(),
-			ReadTimeout:  s.cfg.ReadTimeout,
-			WriteTimeout: s.cfg.WriteTimeout,
-		},
-		Timeout:          s.cfg.RequestTimeout,
-		NoSignalHandling: true,
-		ConnState: func(conn net.Conn, state http.ConnState) {
-			switch state {
-			case http.StateNew:
-				//stats.RecordEvent(stats.AcceptedConnection)
-
-			case http.StateClosed:
-				//stats.RecordEvent(stats.ClosedConnection)
-
-			case http.StateHijacked:
-				panic("http: connection impossibly hijacked")
-
-			// Ignore the following cases.
-			case http.StateActive, http.StateIdle:
-
-			default:
-				panic("http: connection transitioned to unknown state")
+	lns := make([]net.Listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		ln, err := l.listen()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
 			}
-		},
+			log.Error("failed to run HTTP server", "addr", l.cfg.Addr, "error", err)
+			panic(fmt.Errorf("http: failed to listen on %s: %s", l.cfg.Addr, err))
+		}
+		lns = append(lns, ln)
+	}
+
+	if s.cfg.MetricsAddr != "" {
+		s.metrics = &graceful.Server{
+			Server:           s.newServer(s.cfg.MetricsAddr, metricsRoutes()),
+			Timeout:          s.cfg.RequestTimeout,
+			NoSignalHandling: true,
+		}
+		go s.serveMetrics()
 	}
-	s.grace.SetKeepAlivesEnabled(false)
 
-	if err := s.grace.ListenAndServe(); err != nil {
+	routes := s.routes()
+	for _, l := range s.listeners {
+		l.grace = &graceful.Server{
+			Server:           s.newServer(l.cfg.Addr, routes),
+			Timeout:          s.cfg.RequestTimeout,
+			NoSignalHandling: true,
+			ConnState: func(conn net.Conn, state http.ConnState) {
+				switch state {
+				case http.StateNew:
+					//stats.RecordEvent(stats.AcceptedConnection)
+
+				case http.StateClosed:
+					//stats.RecordEvent(stats.ClosedConnection)
+
+				case http.StateHijacked:
+					panic("http: connection impossibly hijacked")
+
+				// Ignore the following cases.
+				case http.StateActive, http.StateIdle:
+
+				default:
+					panic("http: connection transitioned to unknown state")
+				}
+			},
+		}
+		// Most clients only announce once per interval, so connections
+		// are closed after every request unless keep-alives are enabled.
+		l.grace.SetKeepAlivesEnabled(s.cfg.KeepAlive)
+	}
+
+	for _, l := range s.listeners {
+		if l.certs != nil {
+			s.hup = make(chan os.Signal, 1)
+			signal.Notify(s.hup, syscall.SIGHUP)
+			go s.reloadCerts()
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, l := range s.listeners {
+		wg.Add(1)
+		go func(l *listener, ln net.Listener) {
+			defer wg.Done()
+			l.serve(ln)
+		}(l, lns[i])
+	}
+	wg.Wait()
+
+	log.Info("HTTP server shut down cleanly")
+}
+
+// serve serves the connections of ln until the listener is stopped.
+//
+// It panics if the listener exits unexpectedly.
+func (l *listener) serve(ln net.Listener) {
+	if err := l.grace.Serve(ln); err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			log.Printf("Failed to gracefully run HTTP server: %s", err.Error())
+			log.Error("failed to gracefully run HTTP server", "addr", l.cfg.Addr, "error", err)
 			panic(err)
 		}
 	}
+}
 
-	log.Println("HTTP server shut down cleanly")
+// newServer creates an http.Server serving handler on addr with the
+// configured timeouts, header limit and protocols.
+//
+// HTTP/2 is only negotiated over TLS, if it is enabled.
+func (s *httpServer) newServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		MaxHeaderBytes:    s.cfg.MaxHeaderBytes,
+	}
+	if !s.cfg.HTTP2 {
+		// A non-nil map keeps net/http from configuring HTTP/2.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return srv
 }
 
-// Stop stops the server and blocks until the server has exited.
+// listen listens on the address of l with its listen options, using TLS if
+// it is configured.
+func (l *listener) listen() (net.Listener, error) {
+	ln, err := l.cfg.Listen("tcp", l.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.tlsConfig != nil {
+		ln = tls.NewListener(ln, l.tlsConfig)
+	}
+	return ln, nil
+}
+
+// reloadCerts reloads the TLS certificates of all listeners on every SIGHUP
+// until the server is stopped.
+func (s *httpServer) reloadCerts() {
+	for range s.hup {
+		for _, l := range s.listeners {
+			if l.certs == nil {
+				continue
+			}
+			if err := l.certs.reload(); err != nil {
+				log.Error("failed to reload TLS certificate, keeping the previous one", "addr", l.cfg.Addr, "error", err)
+				continue
+			}
+			log.Info("reloaded TLS certificate", "addr", l.cfg.Addr)
+		}
+	}
+}
+
+// serveMetrics runs the metrics server and blocks until it has exited.
+//
+// It panics if the server exits unexpectedly.
+func (s *httpServer) serveMetrics() {
+	if err := s.metrics.ListenAndServe(); err != nil {
+		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
+			log.Error("failed to gracefully run HTTP metrics server", "error", err)
+			panic(err)
+		}
+	}
+
+	log.Info("HTTP metrics server shut down cleanly")
+}
+
+// Stop gracefully stops all listeners and blocks until the server has
+// exited.
 func (s *httpServer) Stop() {
-	s.grace.Stop(s.grace.Timeout)
-	<-s.grace.StopChan()
+	if s.hup != nil {
+		signal.Stop(s.hup)
+		close(s.hup)
+	}
+	if s.metrics != nil {
+		s.metrics.Stop(s.metrics.Timeout)
+	}
+	for _, l := range s.listeners {
+		l.grace.Stop(l.grace.Timeout)
+	}
+
+	if s.metrics != nil {
+		<-s.metrics.StopChan()
+	}
+	for _, l := range s.listeners {
+		<-l.grace.StopChan()
+	}
 }
 
+// routes returns the routes of the announce server, which serves announces
+// and scrapes at their configured paths. Requests exceeding max_url_length
+// or max_body_bytes are rejected, and if compress_min_size is set, responses
+// are compressed once they reach it.
 func (s *httpServer) routes() *httprouter.Router {
+	announce, scrape := s.serveAnnounce, s.serveScrape
+	if s.cfg.CompressMinSize > 0 {
+		announce = compressed(announce, s.cfg.CompressMinSize)
+		scrape = compressed(scrape, s.cfg.CompressMinSize)
+	}
+	announce = limited(announce, s.cfg.MaxURLLength, s.cfg.MaxBodyBytes)
+	scrape = limited(scrape, s.cfg.MaxURLLength, s.cfg.MaxBodyBytes)
+
+	r := httprouter.New()
+	for _, path := range s.cfg.AnnouncePaths {
+		r.GET(path, announce)
+	}
+	for _, path := range s.cfg.ScrapePaths {
+		r.GET(path, scrape)
+	}
+	r.NotFound = http.HandlerFunc(notFound)
+	return r
+}
+
+func metricsRoutes() *httprouter.Router {
 	r := httprouter.New()
-	r.GET("/announce", s.serveAnnounce)
-	r.GET("/scrape", s.serveScrape)
+	r.Handler("GET", "/metrics", prometheus.Handler())
 	return r
 }
 
@@ -103,16 +302,20 @@ func (s *httpServer) serveAnnounce(w http.ResponseWriter, r *http.Request, p htt
 		writeError(w, err)
 		return
 	}
+	req.Passkey = passkey(req.Params, p)
+	ctx, trace := s.traced(log.WithRequestID(r.Context(), log.NewRequestID()))
+	req = req.WithContext(ctx)
 
 	resp, err := s.tkr.HandleAnnounce(req)
+	writeTrace(w, trace)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	err = writeAnnounceResponse(w, resp)
+	err = writeAnnounceResponse(w, s.cfg, req, resp)
 	if err != nil {
-		log.Println("error serializing response", err)
+		log.ErrorContext(req.Context(), "failed to serialize response", "error", err)
 	}
 }
 
@@ -122,12 +325,37 @@ func (s *httpServer) serveScrape(w http.ResponseWriter, r *http.Request, p httpr
 		writeError(w, err)
 		return
 	}
+	req.Passkey = passkey(req.Params, p)
+	ctx, trace := s.traced(log.WithRequestID(r.Context(), log.NewRequestID()))
+	req = req.WithContext(ctx)
 
 	resp, err := s.tkr.HandleScrape(req)
+	writeTrace(w, trace)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	writeScrapeResponse(w, resp)
+	err = writeScrapeResponse(w, resp)
+	if err != nil {
+		log.ErrorContext(req.Context(), "failed to serialize response", "error", err)
+	}
+}
+
+// traced returns ctx with a new tracker.Trace and the Trace, if trace_header
+// is enabled, or ctx and nil otherwise.
+func (s *httpServer) traced(ctx context.Context) (context.Context, *tracker.Trace) {
+	if !s.cfg.TraceHeader {
+		return ctx, nil
+	}
+	return tracker.WithTrace(ctx)
+}
+
+// writeTrace sets the Server-Timing header of a response to trace, unless
+// the trace is empty.
+func writeTrace(w http.ResponseWriter, trace *tracker.Trace) {
+	if len(trace.Steps()) == 0 {
+		return
+	}
+	w.Header().Set("Server-Timing", trace.ServerTiming())
 }
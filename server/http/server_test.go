@@ -0,0 +1,285 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestPasskeyRoutes(t *testing.T) {
+	var announcePasskey, scrapePasskey string
+	tracker.RegisterAnnounceMiddleware("http_passkey_test", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			announcePasskey = req.Passkey
+			return next(cfg, req, resp)
+		}
+	})
+	tracker.RegisterScrapeMiddleware("http_passkey_test", func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			scrapePasskey = req.Passkey
+			return next(cfg, req, resp)
+		}
+	})
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "http_passkey_test"}},
+		ScrapeMiddleware:   []chihaya.MiddlewareConfig{{Name: "http_passkey_test"}},
+	})
+	require.Nil(t, err)
+
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http"}, tkr)
+	require.Nil(t, err)
+	routes := srv.(*httpServer).routes()
+
+	query := strings.TrimPrefix(testAnnounceQuery, "/announce")
+	var table = []struct {
+		path, passkey string
+	}{
+		{"/announce/abc123" + query, "abc123"},
+		{"/announce" + query, ""},
+		{"/announce" + query + "&passkey=def456", "def456"},
+
+		// the path takes precedence over the parameter
+		{"/announce/abc123" + query + "&passkey=def456", "abc123"},
+	}
+
+	for _, tt := range table {
+		announcePasskey = "unset"
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", tt.path, nil)
+		require.Nil(t, err)
+		routes.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, tt.passkey, announcePasskey, tt.path)
+	}
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/scrape/abc123?info_hash=aaaaaaaaaaaaaaaaaaaa", nil)
+	require.Nil(t, err)
+	routes.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "abc123", scrapePasskey)
+}
+
+func TestCustomRoutes(t *testing.T) {
+	var announcePasskey, scrapePasskey string
+	tracker.RegisterAnnounceMiddleware("http_routes_test", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			announcePasskey = req.Passkey
+			return next(cfg, req, resp)
+		}
+	})
+	tracker.RegisterScrapeMiddleware("http_routes_test", func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			scrapePasskey = req.Passkey
+			return next(cfg, req, resp)
+		}
+	})
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "http_routes_test"}},
+		ScrapeMiddleware:   []chihaya.MiddlewareConfig{{Name: "http_routes_test"}},
+	})
+	require.Nil(t, err)
+
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"announce_paths": []string{"/:passkey/announce", "/tracker/announce.php"},
+		"scrape_paths":   []string{"/:passkey/scrape"},
+	}}, tkr)
+	require.Nil(t, err)
+	routes := srv.(*httpServer).routes()
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", path, nil)
+		require.Nil(t, err)
+		routes.ServeHTTP(w, r)
+		return w
+	}
+
+	query := strings.TrimPrefix(testAnnounceQuery, "/announce")
+	announcePasskey = "unset"
+	require.Equal(t, http.StatusOK, serve("/abc123/announce"+query).Code)
+	require.Equal(t, "abc123", announcePasskey)
+	announcePasskey = "unset"
+	require.Equal(t, http.StatusOK, serve("/tracker/announce.php"+query+"&passkey=def456").Code)
+	require.Equal(t, "def456", announcePasskey)
+
+	// Scrapes are told apart from announces by their paths.
+	scrapePasskey, announcePasskey = "unset", "unset"
+	require.Equal(t, http.StatusOK, serve("/abc123/scrape"+query).Code)
+	require.Equal(t, "abc123", scrapePasskey)
+	require.Equal(t, "unset", announcePasskey)
+
+	// The default paths are gone, and unknown paths fail.
+	for _, path := range []string{"/announce" + query, "/scrape/abc123" + query, "/abc123/announce/x"} {
+		w := serve(path)
+		require.Equal(t, http.StatusNotFound, w.Code, path)
+		require.Equal(t, "d14:failure reason12:unknown pathe", w.Body.String(), path)
+	}
+
+	_, err = constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"announce_paths": []string{"/:passkey"},
+		"scrape_paths":   []string{"/scrape"},
+	}}, tkr)
+	require.NotNil(t, err)
+}
+
+func TestTimeoutConfig(t *testing.T) {
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Name: "http"})
+	require.Nil(t, err)
+	require.Equal(t, defaultReadHeaderTimeout, cfg.ReadHeaderTimeout)
+
+	// the header timeout does not exceed a shorter read timeout
+	cfg, err = newHTTPConfig(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{"read_timeout": "2s"}})
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Second, cfg.ReadHeaderTimeout)
+
+	var table = []map[string]interface{}{
+		{"read_timeout": "-1s"},
+		{"write_timeout": "-1s"},
+		{"request_timeout": "-1s"},
+		{"read_header_timeout": "-1s"},
+		{"read_timeout": "1s", "read_header_timeout": "2s"},
+		{"idle_timeout": "1m"},
+		{"keep_alive": true, "idle_timeout": "-1m"},
+		{"max_header_bytes": -1},
+		{"max_url_length": -1},
+		{"max_body_bytes": -1},
+		{"http2": true, "keep_alive": true},
+	}
+
+	for _, config := range table {
+		_, err := newHTTPConfig(&chihaya.ServerConfig{Name: "http", Config: config})
+		require.NotNil(t, err, "%v", config)
+	}
+}
+
+func TestSlowHeaders(t *testing.T) {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"read_header_timeout": "100ms",
+	}}, tkr)
+	require.Nil(t, err)
+	s := srv.(*httpServer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	hs := s.newServer(ln.Addr().String(), s.routes())
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	// a client that does not finish its headers is disconnected
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET "+testAnnounceQuery+" HTTP/1.1\r\nHost: tracker\r\n")
+	require.Nil(t, err)
+
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	start := time.Now()
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout(), "slow client was not disconnected")
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	// clients that send their headers right away are served
+	resp, err := http.Get("http://" + ln.Addr().String() + testAnnounceQuery)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRequestLimits(t *testing.T) {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Name: "http"})
+	require.Nil(t, err)
+	require.Equal(t, defaultMaxURLLength, cfg.MaxURLLength)
+	require.Equal(t, int64(defaultMaxBodyBytes), cfg.MaxBodyBytes)
+
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"max_url_length": len(testAnnounceQuery) + 16,
+		"max_body_bytes": 8,
+	}}, tkr)
+	require.Nil(t, err)
+	routes := srv.(*httpServer).routes()
+
+	var table = []struct {
+		path   string
+		body   string
+		code   int
+		reason string
+	}{
+		{testAnnounceQuery, "", http.StatusOK, ""},
+		{testAnnounceQuery + "&key=" + strings.Repeat("a", 16), "", http.StatusBadRequest, "request URL too long"},
+		{"/scrape?info_hash=" + strings.Repeat("a", len(testAnnounceQuery)), "", http.StatusBadRequest, "request URL too long"},
+		{testAnnounceQuery, strings.Repeat("a", 9), http.StatusBadRequest, "request body too large"},
+	}
+
+	for _, tt := range table {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", tt.path, strings.NewReader(tt.body))
+		require.Nil(t, err)
+		r.RequestURI = tt.path
+		routes.ServeHTTP(w, r)
+		require.Equal(t, tt.code, w.Code, tt.path)
+		if tt.reason != "" {
+			require.Equal(t, fmt.Sprintf("d14:failure reason%d:%se", len(tt.reason), tt.reason), w.Body.String())
+		}
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	tracker.RegisterAnnounceMiddleware("http_trace_test", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			return tracker.ClientError("rejected")
+		}
+	})
+
+	for _, enabled := range []bool{false, true} {
+		tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+			TraceMiddleware:    true,
+			AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "http_trace_test"}},
+		})
+		require.Nil(t, err)
+
+		srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+			"trace_header": enabled,
+		}}, tkr)
+		require.Nil(t, err)
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", testAnnounceQuery, nil)
+		require.Nil(t, err)
+		srv.(*httpServer).routes().ServeHTTP(w, r)
+		require.Equal(t, "d14:failure reason8:rejectede", w.Body.String())
+
+		header := w.Header().Get("Server-Timing")
+		if !enabled {
+			require.Equal(t, "", header)
+			continue
+		}
+		require.True(t, strings.HasPrefix(header, "http_trace_test;dur="), header)
+		require.True(t, strings.HasSuffix(header, `;desc="abort"`), header)
+	}
+}
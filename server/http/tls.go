@@ -0,0 +1,116 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// tlsVersions maps the values of tls_min_version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// defaultTLSMinVersion is the minimum TLS version if none is configured.
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// certReloader serves a certificate that can be replaced by reloading its
+// files, without affecting established connections.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	return r, r.reload()
+}
+
+// reload loads the certificate files. If they cannot be loaded, the previous
+// certificate is kept.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// newTLSConfig creates the TLS configuration of a listener serving the
+// certificate of r.
+//
+// If a client CA file is configured, clients must present a certificate
+// signed by one of its CAs. HTTP/2 is offered to clients if http2 is set.
+func newTLSConfig(cfg *listenerConfig, http2 bool, r *certReloader) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:     defaultTLSMinVersion,
+		GetCertificate: r.getCertificate,
+	}
+
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", cfg.TLSMinVersion)
+		}
+		tlsCfg.MinVersion = version
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		if !tlsCfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.TLSClientCAFile)
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if http2 {
+		tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	return tlsCfg, nil
+}
+
+// clientCertName returns the common name or, lacking one, the first DNS name
+// of the verified client certificate of a request.
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
@@ -0,0 +1,408 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/listen"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+const testAnnounceQuery = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000000&port=6881&uploaded=0&downloaded=0&left=0"
+
+// lastClientCertName is the ClientCertName of the last announce seen by the
+// test middleware.
+var lastClientCertName string
+
+func init() {
+	tracker.RegisterAnnounceMiddleware("http_tls_test", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			lastClientCertName = req.ClientCertName
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+// testCert is a certificate together with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for 127.0.0.1 with the given common
+// name. It is self-signed if parent is nil.
+func newTestCert(t *testing.T, commonName string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// write writes the certificate and key in PEM format to dir and returns
+// their paths.
+func (c *testCert) write(t *testing.T, dir string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	require.Nil(t, ioutil.WriteFile(certFile, certPEM, 0644))
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.Nil(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// startTLSServer starts an HTTPS server and returns its address.
+func startTLSServer(t *testing.T, config map[string]interface{}) (*httpServer, string) {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "http_tls_test"}},
+	})
+	require.Nil(t, err)
+
+	config["addr"] = "127.0.0.1:0"
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: config}, tkr)
+	require.Nil(t, err)
+	s := srv.(*httpServer)
+
+	ln, err := s.listeners[0].listen()
+	require.Nil(t, err)
+	go s.newServer(ln.Addr().String(), s.routes()).Serve(ln)
+
+	return s, ln.Addr().String()
+}
+
+func newTLSClient(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-http-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	first := newTestCert(t, "tracker", 1, nil)
+	certFile, keyFile := first.write(t, dir)
+
+	s, addr := startTLSServer(t, map[string]interface{}{
+		"tls_cert_file": certFile,
+		"tls_key_file":  keyFile,
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first.cert)
+
+	resp, err := newTLSClient(roots).Get("https://" + addr + testAnnounceQuery)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "", lastClientCertName)
+
+	// reloading serves the new certificate to new connections
+	second := newTestCert(t, "tracker", 2, nil)
+	second.write(t, dir)
+	require.Nil(t, s.listeners[0].certs.reload())
+
+	roots.AddCert(second.cert)
+	resp, err = newTLSClient(roots).Get("https://" + addr + testAnnounceQuery)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// a failed reload keeps the previous certificate
+	require.Nil(t, ioutil.WriteFile(certFile, []byte("garbage"), 0644))
+	require.NotNil(t, s.listeners[0].certs.reload())
+
+	resp, err = newTLSClient(roots).Get("https://" + addr + testAnnounceQuery)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-http-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert := newTestCert(t, "tracker", 1, nil)
+	certFile, keyFile := serverCert.write(t, dir)
+
+	caDir := filepath.Join(dir, "ca")
+	require.Nil(t, os.Mkdir(caDir, 0755))
+	ca := newTestCert(t, "client CA", 2, nil)
+	caFile, _ := ca.write(t, caDir)
+
+	_, addr := startTLSServer(t, map[string]interface{}{
+		"tls_cert_file":      certFile,
+		"tls_key_file":       keyFile,
+		"tls_client_ca_file": caFile,
+		"tls_min_version":    "1.2",
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+
+	// clients without a certificate are rejected
+	_, err = newTLSClient(roots).Get("https://" + addr + testAnnounceQuery)
+	require.NotNil(t, err)
+
+	// so are clients with a certificate of another CA
+	stranger := newTestCert(t, "mallory", 3, nil)
+	_, err = newTLSClient(roots, stranger.tlsCertificate()).Get("https://" + addr + testAnnounceQuery)
+	require.NotNil(t, err)
+
+	alice := newTestCert(t, "alice", 4, ca)
+	resp, err := newTLSClient(roots, alice.tlsCertificate()).Get("https://" + addr + testAnnounceQuery)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "alice", lastClientCertName)
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-http-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := newTestCert(t, "tracker", 1, nil)
+	certFile, keyFile := cert.write(t, dir)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.cert)
+
+	for _, http2 := range []bool{false, true} {
+		_, addr := startTLSServer(t, map[string]interface{}{
+			"tls_cert_file": certFile,
+			"tls_key_file":  keyFile,
+			"keep_alive":    true,
+			"http2":         http2,
+		})
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr + testAnnounceQuery)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		if http2 {
+			require.Equal(t, 2, resp.ProtoMajor)
+		} else {
+			require.Equal(t, 1, resp.ProtoMajor)
+		}
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-http-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := newTestCert(t, "tracker", 1, nil).write(t, dir)
+
+	var table = []map[string]interface{}{
+		{"tls_cert_file": certFile},
+		{"tls_client_ca_file": certFile},
+		{"tls_cert_file": filepath.Join(dir, "missing.pem"), "tls_key_file": keyFile},
+		{"tls_cert_file": keyFile, "tls_key_file": certFile},
+		{"tls_cert_file": certFile, "tls_key_file": keyFile, "tls_min_version": "3.0"},
+		{"tls_cert_file": certFile, "tls_key_file": keyFile, "tls_client_ca_file": keyFile},
+	}
+
+	for _, config := range table {
+		_, err := constructor(&chihaya.ServerConfig{Name: "http", Config: config}, nil)
+		require.NotNil(t, err, "%v", config)
+	}
+}
+
+func TestListenerConfig(t *testing.T) {
+	// addr and the TLS options make up the listener if none are configured
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"addr":          "127.0.0.1:6880",
+		"tls_cert_file": "cert.pem",
+		"tls_key_file":  "key.pem",
+	}})
+	require.Nil(t, err)
+	require.Equal(t, []listenerConfig{{Addr: "127.0.0.1:6880", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}}, cfg.Listeners)
+
+	// and so do the listen options
+	cfg, err = newHTTPConfig(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"addr":       "127.0.0.1:6880",
+		"reuse_port": true,
+	}})
+	require.Nil(t, err)
+	require.Equal(t, []listenerConfig{{Addr: "127.0.0.1:6880", Config: listen.Config{ReusePort: true}}}, cfg.Listeners)
+
+	var table = []map[string]interface{}{
+		{"addr": "127.0.0.1:6880", "listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881"}}},
+		{"tls_cert_file": "cert.pem", "tls_key_file": "key.pem", "listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881"}}},
+		{"listeners": []map[string]interface{}{{"tls_cert_file": "cert.pem", "tls_key_file": "key.pem"}}},
+		{"listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881"}, {"addr": "127.0.0.1:6881"}}},
+		{"listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881", "tls_cert_file": "cert.pem"}}},
+		{"listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881", "tls_min_version": "1.2"}}},
+		{"listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881"}}, "http2": true, "keep_alive": true},
+		{"reuse_port": true, "listeners": []map[string]interface{}{{"addr": "127.0.0.1:6881"}}},
+		{"listeners": []map[string]interface{}{{"addr": ":6881", "interface": "chihaya-none0"}}},
+	}
+
+	for _, config := range table {
+		_, err := newHTTPConfig(&chihaya.ServerConfig{Name: "http", Config: config})
+		require.NotNil(t, err, "%v", config)
+	}
+}
+
+// freeAddr returns a local address that nothing listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-http-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := newTestCert(t, "tracker", 1, nil)
+	certFile, keyFile := cert.write(t, dir)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.cert)
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "http_tls_test"}},
+	})
+	require.Nil(t, err)
+
+	httpAddr, httpsAddr := freeAddr(t), freeAddr(t)
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"listeners": []map[string]interface{}{
+			{"addr": httpAddr},
+			{"addr": httpsAddr, "tls_cert_file": certFile, "tls_key_file": keyFile},
+		},
+	}}, tkr)
+	require.Nil(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		srv.Start()
+	}()
+
+	get := func(client *http.Client, url string) {
+		var resp *http.Response
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			resp, err = client.Get(url)
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	get(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}, "http://"+httpAddr+testAnnounceQuery)
+	get(newTLSClient(roots), "https://"+httpsAddr+testAnnounceQuery)
+
+	// the HTTP listener does not speak TLS, and vice versa
+	_, err = newTLSClient(roots).Get("https://" + httpAddr + testAnnounceQuery)
+	require.NotNil(t, err)
+	resp, err := http.Get("http://" + httpsAddr + testAnnounceQuery)
+	if err == nil {
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// stopping the server stops both listeners
+	srv.Stop()
+	<-stopped
+	for _, addr := range []string{httpAddr, httpsAddr} {
+		_, err := net.Dial("tcp", addr)
+		require.NotNil(t, err, addr)
+	}
+}
+
+func TestListenerBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer taken.Close()
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+
+	free := freeAddr(t)
+	srv, err := constructor(&chihaya.ServerConfig{Name: "http", Config: map[string]interface{}{
+		"listeners": []map[string]interface{}{
+			{"addr": free},
+			{"addr": taken.Addr().String()},
+		},
+	}}, tkr)
+	require.Nil(t, err)
+
+	// startup fails, naming the address, and releases the other listener
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		srv.Start()
+	}()
+	require.NotNil(t, recovered)
+	require.Contains(t, fmt.Sprint(recovered), "failed to listen on "+taken.Addr().String())
+
+	ln, err := net.Listen("tcp", free)
+	require.Nil(t, err)
+	ln.Close()
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/server/http/query"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// parseQuery parses the query of a request. Queries that can not be parsed
+// are the client's fault, so they are rejected with a ClientError.
+func parseQuery(rawQuery string) (*query.Query, error) {
+	q, err := query.New(rawQuery)
+	if err == query.ErrInvalidInfohash {
+		return nil, tracker.ClientError("failed to provide valid info_hash")
+	} else if err != nil {
+		return nil, tracker.ClientError("failed to parse query")
+	}
+	return q, nil
+}
+
+// validateAnnounce checks the parameters of an announce before it is parsed,
+// so that malformed announces are rejected with a failure reason naming the
+// offending parameter rather than entering a swarm with bogus values.
+func validateAnnounce(q *query.Query) error {
+	switch infoHashes := q.InfoHashes(); {
+	case len(infoHashes) < 1:
+		return tracker.ClientError("no info_hash parameter supplied")
+	case len(infoHashes) > 1:
+		return tracker.ClientError("multiple info_hash parameters supplied")
+	}
+
+	peerID, err := q.String("peer_id")
+	if err != nil {
+		return tracker.ClientError("failed to parse parameter: peer_id")
+	}
+	if len(peerID) != 20 {
+		return tracker.ClientError("failed to provide valid peer_id")
+	}
+
+	port, err := q.Uint64("port")
+	if err == query.ErrKeyNotFound {
+		return tracker.ClientError("failed to parse parameter: port")
+	} else if err != nil || port < 1 || port > math.MaxUint16 {
+		return tracker.ClientError("failed to provide valid port")
+	}
+
+	for _, key := range []string{"left", "downloaded", "uploaded"} {
+		if _, err := q.Uint64(key); err != nil {
+			return tracker.ClientError("failed to parse parameter: " + key)
+		}
+	}
+
+	// Numbers too large to parse are clamped to the maximum like any other
+	// large numwant, only negative numbers and garbage are rejected.
+	if numwant, _ := q.String("numwant"); numwant != "" {
+		_, err := strconv.ParseUint(numwant, 10, 64)
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err != strconv.ErrRange {
+			return tracker.ClientError("failed to provide valid numwant")
+		}
+	}
+
+	eventStr, _ := q.String("event")
+	if _, err := event.New(eventStr); err != nil {
+		return tracker.ClientError("failed to provide valid client event")
+	}
+
+	if key, err := q.String("key"); err == nil && len(key) > maxKeyLength {
+		return tracker.ClientError("failed to provide valid key")
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestValidateAnnounce(t *testing.T) {
+	const (
+		infoHash = "info_hash=aaaaaaaaaaaaaaaaaaaa"
+		peerID   = "peer_id=-TEST01-000000000001"
+		counts   = "left=0&downloaded=0&uploaded=0"
+		valid    = infoHash + "&" + peerID + "&port=6881&" + counts
+	)
+
+	var table = []struct {
+		query  string
+		reason string
+	}{
+		{valid, ""},
+		{valid + "&event=started&numwant=10&key=3F2A1B9C", ""},
+		{valid + "&event=", ""},
+
+		{peerID + "&port=6881&" + counts, "no info_hash parameter supplied"},
+		{"info_hash=aaaa&" + peerID + "&port=6881&" + counts, "failed to provide valid info_hash"},
+		{"info_hash=" + strings.Repeat("a", 21) + "&" + peerID + "&port=6881&" + counts, "failed to provide valid info_hash"},
+		{valid + "&info_hash=bbbbbbbbbbbbbbbbbbbb", "multiple info_hash parameters supplied"},
+		{valid + "&foo=%zz", "failed to parse query"},
+
+		{infoHash + "&port=6881&" + counts, "failed to parse parameter: peer_id"},
+		{infoHash + "&peer_id=-TEST01-&port=6881&" + counts, "failed to provide valid peer_id"},
+		{infoHash + "&peer_id=-TEST01-0000000000012&port=6881&" + counts, "failed to provide valid peer_id"},
+
+		{infoHash + "&" + peerID + "&" + counts, "failed to parse parameter: port"},
+		{infoHash + "&" + peerID + "&port=0&" + counts, "failed to provide valid port"},
+		{infoHash + "&" + peerID + "&port=65536&" + counts, "failed to provide valid port"},
+		{infoHash + "&" + peerID + "&port=-1&" + counts, "failed to provide valid port"},
+		{infoHash + "&" + peerID + "&port=http&" + counts, "failed to provide valid port"},
+
+		{infoHash + "&" + peerID + "&port=6881&downloaded=0&uploaded=0", "failed to parse parameter: left"},
+		{infoHash + "&" + peerID + "&port=6881&left=-1&downloaded=0&uploaded=0", "failed to parse parameter: left"},
+		{infoHash + "&" + peerID + "&port=6881&left=0&uploaded=0", "failed to parse parameter: downloaded"},
+		{infoHash + "&" + peerID + "&port=6881&left=0&downloaded=0", "failed to parse parameter: uploaded"},
+
+		{valid + "&numwant=-1", "failed to provide valid numwant"},
+		{valid + "&numwant=ten", "failed to provide valid numwant"},
+
+		{valid + "&event=paused", "failed to provide valid client event"},
+		{valid + "&key=" + strings.Repeat("a", maxKeyLength+1), "failed to provide valid key"},
+	}
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	for _, tt := range table {
+		r, err := http.NewRequest("GET", "/announce?"+tt.query, nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		if tt.reason == "" {
+			require.Nil(t, err, tt.query)
+			require.Equal(t, chihaya.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa"), req.InfoHash)
+			require.Equal(t, chihaya.PeerIDFromString("-TEST01-000000000001"), req.PeerID)
+			require.Equal(t, uint16(6881), req.Port)
+			continue
+		}
+		require.Equal(t, tracker.ClientError(tt.reason), err, tt.query)
+
+		// Clients get the reason as a bencoded failure.
+		w := httptest.NewRecorder()
+		require.Nil(t, writeError(w, err))
+		require.Equal(t, "d14:failure reason"+strconv.Itoa(len(tt.reason))+":"+tt.reason+"e", w.Body.String())
+	}
+}
+
+func TestValidateAnnounceEvent(t *testing.T) {
+	const announce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TEST01-000000000001&port=6881&left=0&downloaded=0&uploaded=0"
+
+	cfg, err := newHTTPConfig(&chihaya.ServerConfig{})
+	require.Nil(t, err)
+	for _, e := range []event.Event{event.None, event.Started, event.Stopped, event.Completed} {
+		r, err := http.NewRequest("GET", announce+"&event="+strings.ToUpper(e.String()), nil)
+		require.Nil(t, err)
+		r.RemoteAddr = "10.0.0.1:6881"
+
+		req, err := announceRequest(r, cfg)
+		require.Nil(t, err, e.String())
+		require.Equal(t, e, req.Event)
+	}
+}
@@ -5,26 +5,50 @@
 package http
 
 import (
+	"bytes"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/chihaya/chihaya"
 	"github.com/chihaya/chihaya/pkg/bencode"
 	"github.com/chihaya/chihaya/tracker"
 )
 
+// warningSeparator separates the warnings of an announce response, which
+// clients show as a single warning message.
+const warningSeparator = "; "
+
 func writeError(w http.ResponseWriter, err error) error {
-	message := "internal server error"
-	if _, clientErr := err.(tracker.ClientError); clientErr {
-		message = err.Error()
+	bdict := bencode.Dict{"failure reason": "internal server error"}
+	switch e := err.(type) {
+	case tracker.ClientError:
+		bdict["failure reason"] = e.Error()
+
+	case tracker.RetryError:
+		bdict["failure reason"] = e.Error()
+		// BEP 31 specifies the delay in whole minutes.
+		bdict["retry in"] = int64((e.RetryIn + time.Minute - 1) / time.Minute)
 	}
 
 	w.WriteHeader(http.StatusOK)
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
-		"failure reason": message,
-	})
+	return bencode.NewEncoder(w).Encode(bdict)
 }
 
-func writeAnnounceResponse(w http.ResponseWriter, resp *chihaya.AnnounceResponse) error {
+// writeAnnounceResponse writes resp in the compact format of BEP 23 and BEP 7
+// if it is compact, and as a list of peer dictionaries otherwise.
+//
+// The peer IDs are omitted from the dictionaries if req asked for no_peer_id.
+// The external ip of BEP 24 and the tracker id are only added if cfg enables
+// them, the warning message only if the response has warnings.
+//
+// If cfg enables crypto flags and the client of req supports encryption,
+// compact peers are followed by crypto_flags and crypto_flags6, which hold one
+// byte per peer in peers and peers6: 1 if the peer is known to support
+// encrypted connections and 0 otherwise.
+func writeAnnounceResponse(w http.ResponseWriter, cfg *httpConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
 	bdict := bencode.Dict{
 		"complete":     resp.Complete,
 		"incomplete":   resp.Incomplete,
@@ -32,67 +56,150 @@ func writeAnnounceResponse(w http.ResponseWriter, resp *chihaya.AnnounceResponse
 		"min interval": resp.MinInterval,
 	}
 
+	if cfg.ExternalIP {
+		if ip := externalIP(req); ip != nil {
+			bdict["external ip"] = []byte(ip)
+		}
+	}
+	if cfg.TrackerID != "" {
+		bdict["tracker id"] = cfg.TrackerID
+	}
+	if len(resp.Warnings) > 0 {
+		bdict["warning message"] = strings.Join(resp.Warnings, warningSeparator)
+	}
+
 	// Add the peers to the dictionary in the compact format.
 	if resp.Compact {
-		var IPv4CompactDict, IPv6CompactDict []byte
-
-		// Add the IPv4 peers to the dictionary.
+		// The flags are appended along with the peers, so that every flag
+		// belongs to the peer at the same position.
+		withFlags := cfg.CryptoFlags && req.Crypto.Supported()
+
+		// Add the IPv4 peers to the dictionary. Clients expect this key even
+		// if there are no peers.
+		IPv4CompactDict := []byte{}
+		IPv4CryptoFlags := []byte{}
 		for _, peer := range resp.IPv4Peers {
-			IPv4CompactDict = append(IPv4CompactDict, compact(peer)...)
+			if ip := peer.IP.To4(); ip != nil {
+				IPv4CompactDict = append(IPv4CompactDict, compact(ip, peer.Port)...)
+				if withFlags {
+					IPv4CryptoFlags = append(IPv4CryptoFlags, cryptoFlag(peer))
+				}
+			}
 		}
-		if len(IPv4CompactDict) > 0 {
-			bdict["peers"] = IPv4CompactDict
+		bdict["peers"] = IPv4CompactDict
+		if withFlags {
+			bdict["crypto_flags"] = IPv4CryptoFlags
 		}
 
 		// Add the IPv6 peers to the dictionary.
+		var IPv6CompactDict, IPv6CryptoFlags []byte
 		for _, peer := range resp.IPv6Peers {
-			IPv6CompactDict = append(IPv6CompactDict, compact(peer)...)
+			if peer.IP.To4() == nil && len(peer.IP) == net.IPv6len {
+				IPv6CompactDict = append(IPv6CompactDict, compact(peer.IP, peer.Port)...)
+				if withFlags {
+					IPv6CryptoFlags = append(IPv6CryptoFlags, cryptoFlag(peer))
+				}
+			}
 		}
 		if len(IPv6CompactDict) > 0 {
 			bdict["peers6"] = IPv6CompactDict
+			if withFlags {
+				bdict["crypto_flags6"] = IPv6CryptoFlags
+			}
 		}
 
 		return bencode.NewEncoder(w).Encode(bdict)
 	}
 
 	// Add the peers to the dictionary.
-	var peers []bencode.Dict
+	peers := []bencode.Dict{}
 	for _, peer := range resp.IPv4Peers {
-		peers = append(peers, dict(peer))
+		peers = append(peers, dict(peer, req.NoPeerID))
 	}
 	for _, peer := range resp.IPv6Peers {
-		peers = append(peers, dict(peer))
+		peers = append(peers, dict(peer, req.NoPeerID))
 	}
 	bdict["peers"] = peers
 
 	return bencode.NewEncoder(w).Encode(bdict)
 }
 
+// writeScrapeResponse streams the response, so that scrapes of many
+// infohashes need no more memory than the list of the infohashes.
 func writeScrapeResponse(w http.ResponseWriter, resp *chihaya.ScrapeResponse) error {
-	filesDict := bencode.NewDict()
-	for infohash, scrape := range resp.Files {
-		filesDict[string(infohash[:])] = bencode.Dict{
-			"complete":   scrape.Complete,
-			"incomplete": scrape.Incomplete,
-		}
+	infoHashes := make(sortedInfoHashes, 0, len(resp.Files))
+	for infoHash := range resp.Files {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Sort(infoHashes)
+
+	enc := bencode.NewStreamEncoder(w)
+	enc.BeginDict()
+	enc.Key("files")
+	enc.BeginDict()
+	for i := range infoHashes {
+		scrape := resp.Files[infoHashes[i]]
+
+		enc.KeyBytes(infoHashes[i][:])
+		enc.BeginDict()
+		enc.Key("complete")
+		enc.Int(int64(scrape.Complete))
+		enc.Key("downloaded")
+		enc.Int(int64(scrape.Downloaded))
+		enc.Key("incomplete")
+		enc.Int(int64(scrape.Incomplete))
+		enc.End()
 	}
+	enc.End()
+	enc.End()
 
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
-		"files": filesDict,
-	})
+	return enc.Err()
 }
 
-func compact(peer chihaya.Peer) (buf []byte) {
-	buf = []byte(peer.IP)
-	buf = append(buf, byte(peer.Port>>8))
-	buf = append(buf, byte(peer.Port&0xff))
+// sortedInfoHashes sorts infohashes in the order of bencoded dictionary keys.
+type sortedInfoHashes []chihaya.InfoHash
+
+func (s sortedInfoHashes) Len() int           { return len(s) }
+func (s sortedInfoHashes) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s sortedInfoHashes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// externalIP returns the address the tracker used for the peer of req in its
+// 4-byte form for IPv4 and 16-byte form for IPv6, preferring IPv4 for
+// dual-stacked peers, or nil if req has no IP.
+func externalIP(req *chihaya.AnnounceRequest) net.IP {
+	if ip := req.IPv4.To4(); ip != nil {
+		return ip
+	}
+	if len(req.IPv6) == net.IPv6len {
+		return req.IPv6
+	}
+	return nil
+}
+
+// compact returns the compact representation of an endpoint, which is 6 bytes
+// long for IPv4 and 18 bytes long for IPv6 addresses.
+func compact(ip net.IP, port uint16) (buf []byte) {
+	buf = append(buf, ip...)
+	buf = append(buf, byte(port>>8))
+	buf = append(buf, byte(port&0xff))
 	return
 }
 
-func dict(peer chihaya.Peer) bencode.Dict {
-	return bencode.Dict{
-		"peer id": string(peer.ID[:]),
-		"ip":      peer.IP.String(),
-		"port":    peer.Port,
+// cryptoFlag returns the crypto flag of peer.
+func cryptoFlag(peer chihaya.Peer) byte {
+	if peer.Crypto.Supported() {
+		return 1
+	}
+	return 0
+}
+
+func dict(peer chihaya.Peer, noPeerID bool) bencode.Dict {
+	d := bencode.Dict{
+		"ip":   peer.IP.String(),
+		"port": peer.Port,
+	}
+	if !noPeerID {
+		d["peer id"] = string(peer.ID[:])
 	}
+	return d
 }
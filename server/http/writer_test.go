@@ -5,13 +5,26 @@
 package http
 
 import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/bencode"
 	"github.com/chihaya/chihaya/tracker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+var update = flag.Bool("update", false, "update the golden files of the tests")
+
 func TestWriteError(t *testing.T) {
 	var table = []struct {
 		reason, expected string
@@ -28,9 +41,230 @@ func TestWriteError(t *testing.T) {
 	}
 }
 
+func TestWriteRetryError(t *testing.T) {
+	var table = []struct {
+		retryIn  time.Duration
+		expected string
+	}{
+		{30 * time.Second, "d14:failure reason12:slow down :)8:retry ini1ee"},
+		{time.Minute, "d14:failure reason12:slow down :)8:retry ini1ee"},
+		{90 * time.Second, "d14:failure reason12:slow down :)8:retry ini2ee"},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRecorder()
+		err := writeError(r, tracker.RetryError{Reason: "slow down :)", RetryIn: tt.retryIn})
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, r.Body.String())
+	}
+
+	// other errors are not exposed
+	r := httptest.NewRecorder()
+	err := writeError(r, errors.New("secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "d14:failure reason21:internal server errore", r.Body.String())
+}
+
 func TestWriteStatus(t *testing.T) {
 	r := httptest.NewRecorder()
 	err := writeError(r, tracker.ClientError("something is missing"))
 	assert.Nil(t, err)
 	assert.Equal(t, r.Body.String(), "d14:failure reason20:something is missinge")
 }
+
+// requireGolden compares body to the golden file name in testdata, after
+// replacing the file with body if -update is set.
+func requireGolden(t *testing.T, name string, body []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		require.Nil(t, ioutil.WriteFile(path, body, 0644))
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, string(expected), string(body), name)
+}
+
+func testAnnounceResponse(compact bool) *chihaya.AnnounceResponse {
+	return &chihaya.AnnounceResponse{
+		Compact:     compact,
+		Complete:    2,
+		Incomplete:  1,
+		Interval:    30 * time.Minute,
+		MinInterval: 20 * time.Minute,
+		IPv4Peers: []chihaya.Peer{
+			{ID: chihaya.PeerIDFromString("-TEST01-000000000001"), IP: net.ParseIP("10.0.0.1").To4(), Port: 6881},
+			// IPv4 addresses in their 16-byte form must be compacted, too.
+			{ID: chihaya.PeerIDFromString("-TEST01-000000000002"), IP: net.ParseIP("10.0.0.2"), Port: 6882},
+			// IPv6 addresses must not end up in the IPv4 peers.
+			{ID: chihaya.PeerIDFromString("-TEST01-000000000003"), IP: net.ParseIP("fc00::3"), Port: 6883},
+		},
+		IPv6Peers: []chihaya.Peer{
+			{ID: chihaya.PeerIDFromString("-TEST01-000000000004"), IP: net.ParseIP("fc00::4"), Port: 6884},
+		},
+	}
+}
+
+func withWarnings(resp *chihaya.AnnounceResponse, warnings ...string) *chihaya.AnnounceResponse {
+	resp.Warnings = warnings
+	return resp
+}
+
+// withCrypto marks the second IPv4 peer and the IPv6 peer of resp as
+// supporting encrypted connections.
+func withCrypto(resp *chihaya.AnnounceResponse) *chihaya.AnnounceResponse {
+	resp.IPv4Peers[1].Crypto = chihaya.CryptoSupported
+	resp.IPv6Peers[0].Crypto = chihaya.CryptoSupported
+	return resp
+}
+
+func TestWriteAnnounceResponse(t *testing.T) {
+	var (
+		defaults    = &httpConfig{}
+		extended    = &httpConfig{ExternalIP: true, TrackerID: "chihaya-01"}
+		cryptoFlags = &httpConfig{CryptoFlags: true}
+
+		v4 = net.ParseIP("192.168.1.2")
+		v6 = net.ParseIP("fd00::1:2")
+	)
+
+	var table = []struct {
+		golden string
+		cfg    *httpConfig
+		req    *chihaya.AnnounceRequest
+		resp   *chihaya.AnnounceResponse
+	}{
+		{"announce_compact.golden", defaults, &chihaya.AnnounceRequest{Compact: true}, testAnnounceResponse(true)},
+		{"announce_compact_empty.golden", defaults, &chihaya.AnnounceRequest{Compact: true}, &chihaya.AnnounceResponse{Compact: true}},
+		{"announce_dict.golden", defaults, &chihaya.AnnounceRequest{}, testAnnounceResponse(false)},
+		{"announce_dict_no_peer_id.golden", defaults, &chihaya.AnnounceRequest{NoPeerID: true}, testAnnounceResponse(false)},
+		{"announce_dict_empty.golden", defaults, &chihaya.AnnounceRequest{}, &chihaya.AnnounceResponse{}},
+
+		// The optional fields are off by default, even for requests with IPs.
+		{"announce_compact.golden", defaults, &chihaya.AnnounceRequest{Compact: true, IPv4: v4, IPv6: v6}, testAnnounceResponse(true)},
+		{"announce_compact_extended_v4.golden", extended, &chihaya.AnnounceRequest{Compact: true, IPv4: v4, IPv6: v6}, testAnnounceResponse(true)},
+		{"announce_compact_extended_v6.golden", extended, &chihaya.AnnounceRequest{Compact: true, IPv6: v6}, testAnnounceResponse(true)},
+		{"announce_dict_extended_v4.golden", extended, &chihaya.AnnounceRequest{IPv4: v4}, testAnnounceResponse(false)},
+		{"announce_dict_extended_no_ip.golden", extended, &chihaya.AnnounceRequest{}, &chihaya.AnnounceResponse{}},
+
+		// Warnings are joined into one message, and omitted if there are none.
+		{"announce_compact_warning.golden", defaults, &chihaya.AnnounceRequest{Compact: true}, withWarnings(testAnnounceResponse(true), "your ratio is low", "client outdated")},
+		{"announce_dict_warning.golden", defaults, &chihaya.AnnounceRequest{}, withWarnings(&chihaya.AnnounceResponse{}, "client outdated")},
+		{"announce_compact.golden", defaults, &chihaya.AnnounceRequest{Compact: true}, withWarnings(testAnnounceResponse(true))},
+
+		// Crypto flags are only added if they are enabled and the client
+		// supports encryption, and only to compact responses.
+		{"announce_compact_crypto_flags.golden", cryptoFlags, &chihaya.AnnounceRequest{Compact: true, Crypto: chihaya.CryptoSupported}, withCrypto(testAnnounceResponse(true))},
+		{"announce_compact_crypto_flags.golden", cryptoFlags, &chihaya.AnnounceRequest{Compact: true, Crypto: chihaya.CryptoRequired}, withCrypto(testAnnounceResponse(true))},
+		{"announce_compact_crypto_flags_empty.golden", cryptoFlags, &chihaya.AnnounceRequest{Compact: true, Crypto: chihaya.CryptoSupported}, &chihaya.AnnounceResponse{Compact: true}},
+		{"announce_compact.golden", cryptoFlags, &chihaya.AnnounceRequest{Compact: true}, withCrypto(testAnnounceResponse(true))},
+		{"announce_compact.golden", defaults, &chihaya.AnnounceRequest{Compact: true, Crypto: chihaya.CryptoSupported}, withCrypto(testAnnounceResponse(true))},
+		{"announce_dict.golden", cryptoFlags, &chihaya.AnnounceRequest{Crypto: chihaya.CryptoSupported}, withCrypto(testAnnounceResponse(false))},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRecorder()
+		err := writeAnnounceResponse(r, tt.cfg, tt.req, tt.resp)
+		require.Nil(t, err)
+
+		requireGolden(t, tt.golden, r.Body.Bytes())
+	}
+}
+
+// TestCryptoFlagsLayout checks that every compact peer has exactly one crypto
+// flag, so that clients do not misattribute the flags of the peers after a
+// skipped one.
+func TestCryptoFlagsLayout(t *testing.T) {
+	r := httptest.NewRecorder()
+	req := &chihaya.AnnounceRequest{Compact: true, Crypto: chihaya.CryptoSupported}
+	err := writeAnnounceResponse(r, &httpConfig{CryptoFlags: true}, req, withCrypto(testAnnounceResponse(true)))
+	require.Nil(t, err)
+
+	v, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	d := v.(bencode.Dict)
+	require.Equal(t, 2*6, len(d["peers"].(string)))
+	require.Equal(t, "\x00\x01", d["crypto_flags"])
+	require.Equal(t, 1*18, len(d["peers6"].(string)))
+	require.Equal(t, "\x01", d["crypto_flags6"])
+}
+
+func TestWriteScrapeResponse(t *testing.T) {
+	var (
+		hash  = chihaya.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+		hash2 = chihaya.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	)
+
+	var table = []struct {
+		golden string
+		resp   *chihaya.ScrapeResponse
+	}{
+		{"scrape_single.golden", &chihaya.ScrapeResponse{Files: map[chihaya.InfoHash]chihaya.Scrape{
+			hash: {Complete: 2, Incomplete: 1, Downloaded: 5},
+		}}},
+		{"scrape_multi.golden", &chihaya.ScrapeResponse{Files: map[chihaya.InfoHash]chihaya.Scrape{
+			hash:  {Complete: 2, Incomplete: 1, Downloaded: 5},
+			hash2: {},
+		}}},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRecorder()
+		err := writeScrapeResponse(r, tt.resp)
+		require.Nil(t, err)
+
+		requireGolden(t, tt.golden, r.Body.Bytes())
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter that discards the body.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// benchmarkScrapeResponse returns a scrape response of 50000 infohashes.
+func benchmarkScrapeResponse() *chihaya.ScrapeResponse {
+	resp := &chihaya.ScrapeResponse{Files: make(map[chihaya.InfoHash]chihaya.Scrape)}
+	for i := 0; i < 50000; i++ {
+		var infoHash chihaya.InfoHash
+		binary.BigEndian.PutUint32(infoHash[:], uint32(i)*2654435761)
+		resp.Files[infoHash] = chihaya.Scrape{Complete: int32(i), Incomplete: int32(i / 2), Downloaded: int32(i * 2)}
+	}
+	return resp
+}
+
+func BenchmarkWriteScrapeResponse(b *testing.B) {
+	resp := benchmarkScrapeResponse()
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		writeScrapeResponse(w, resp)
+	}
+}
+
+// BenchmarkMarshalScrapeResponse marshals the same response as
+// BenchmarkWriteScrapeResponse as a single Dict, for comparison.
+func BenchmarkMarshalScrapeResponse(b *testing.B) {
+	resp := benchmarkScrapeResponse()
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		filesDict := bencode.NewDict()
+		for infohash, scrape := range resp.Files {
+			filesDict[string(infohash[:])] = bencode.Dict{
+				"complete":   scrape.Complete,
+				"incomplete": scrape.Incomplete,
+				"downloaded": scrape.Downloaded,
+			}
+		}
+		bencode.NewEncoder(w).Encode(bencode.Dict{"files": filesDict})
+	}
+}
@@ -6,8 +6,10 @@ package server
 
 import (
 	"sync"
+	"time"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/tracker"
 )
 
@@ -47,3 +49,23 @@ func (p *Pool) Stop() {
 	}
 	p.wg.Wait()
 }
+
+// DrainAndStop drains tkr for window, so that its clients get a final
+// response with a short interval, and then stops the pool. It stops the pool
+// right away once abort is closed or receives a value.
+func (p *Pool) DrainAndStop(tkr *tracker.Tracker, window time.Duration, abort <-chan struct{}) {
+	if window > 0 {
+		tkr.Drain()
+		log.Info("draining before shutdown", "window", window)
+
+		t := time.NewTimer(window)
+		select {
+		case <-t.C:
+		case <-abort:
+			t.Stop()
+			log.Info("drain aborted")
+		}
+	}
+
+	p.Stop()
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// announcingServer is a Server that announces to its tracker until it is
+// stopped, and records the intervals of the responses.
+type announcingServer struct {
+	tkr       *tracker.Tracker
+	intervals chan time.Duration
+	stop      chan struct{}
+}
+
+func (s *announcingServer) Start() {
+	for {
+		select {
+		case <-s.stop:
+			close(s.intervals)
+			return
+		default:
+		}
+
+		resp, err := s.tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+		if err == nil {
+			select {
+			case s.intervals <- resp.Interval:
+			default:
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *announcingServer) Stop() { close(s.stop) }
+
+func init() {
+	Register("test_announcing", func(cfg *chihaya.ServerConfig, tkr *tracker.Tracker) (Server, error) {
+		return cfg.Config.(*announcingServer), nil
+	})
+	tracker.RegisterAnnounceMiddleware("test_interval", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			resp.Interval = cfg.AnnounceInterval
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+func startAnnouncing(t *testing.T) (*Pool, *tracker.Tracker, *announcingServer) {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceInterval:   30 * time.Minute,
+		DrainInterval:      time.Minute,
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "test_interval"}},
+	})
+	require.Nil(t, err)
+
+	srv := &announcingServer{tkr: tkr, intervals: make(chan time.Duration), stop: make(chan struct{})}
+	pool, err := StartPool([]chihaya.ServerConfig{{Name: "test_announcing", Config: srv}}, tkr)
+	require.Nil(t, err)
+	require.Equal(t, 30*time.Minute, <-srv.intervals)
+	return pool, tkr, srv
+}
+
+func TestDrainAndStop(t *testing.T) {
+	pool, tkr, srv := startAnnouncing(t)
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		pool.DrainAndStop(tkr, 50*time.Millisecond, nil)
+		close(done)
+	}()
+
+	// Clients are served with the drain interval until the window is
+	// over, then the servers are stopped.
+	for interval := range srv.intervals {
+		if interval == time.Minute {
+			break
+		}
+	}
+	require.True(t, tkr.Draining())
+	<-done
+	require.True(t, time.Since(start) >= 50*time.Millisecond, "stopped before the drain window passed")
+	_, open := <-srv.intervals
+	require.False(t, open, "server not stopped")
+}
+
+func TestDrainAndStopAbort(t *testing.T) {
+	pool, tkr, srv := startAnnouncing(t)
+
+	abort := make(chan struct{})
+	close(abort)
+	done := make(chan struct{})
+	go func() {
+		pool.DrainAndStop(tkr, time.Hour, abort)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drain not aborted")
+	}
+	for range srv.intervals {
+	}
+}
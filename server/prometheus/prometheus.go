@@ -8,7 +8,6 @@ package prometheus
 
 import (
 	"errors"
-	"log"
 	"net"
 	"net/http"
 	"time"
@@ -18,6 +17,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server"
 	"github.com/chihaya/chihaya/tracker"
 )
@@ -88,12 +88,12 @@ func (s *Server) Start() {
 
 	if err := s.grace.ListenAndServe(); err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			log.Printf("Failed to gracefully run Prometheus server: %s", err.Error())
+			log.Error("failed to gracefully run Prometheus server", "error", err)
 			panic(err)
 		}
 	}
 
-	log.Println("Prometheus server shut down cleanly")
+	log.Info("Prometheus server shut down cleanly")
 }
 
 // Stop stops the prometheus server and blocks until it exits.
@@ -0,0 +1,167 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// blocklistMu serializes reloads of blocklist files, so that concurrent
+// reloads are applied in the order they read their files.
+var blocklistMu sync.Mutex
+
+// WatchBlocklistFile keeps the contents of an IPStore in sync with a
+// blocklist file.
+//
+// The file contains one IP address, network in CIDR notation or range of
+// addresses per line. Ranges are given as start-end, optionally prefixed with
+// a description and a colon like in the P2P format, e.g.
+// "Example:1.2.3.0-1.2.7.255", and stored as the networks IPRangeNetworks
+// returns for them.
+// Blank lines and lines starting with '#' are ignored, malformed lines are
+// logged and skipped.
+//
+// The file is loaded once immediately and again every time a value is
+// received from reload. Every load replaces the contents of the IPStore with
+// the entries of the file at once, so that lookups never see a partially
+// loaded file. Entries added by other means are therefore removed, too.
+//
+// If the initial load fails, its error is returned. Errors of later loads are
+// logged and leave the IPStore unchanged. WatchBlocklistFile returns nil once
+// reload is closed.
+func WatchBlocklistFile(ips IPStore, path string, reload <-chan struct{}) error {
+	err := reloadBlocklistFile(ips, path)
+	if err != nil {
+		return err
+	}
+
+	for range reload {
+		err = reloadBlocklistFile(ips, path)
+		if err != nil {
+			log.Error("store: failed to reload blocklist", "path", path, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// blocklist is the set of IPs and networks contained in a blocklist file,
+// keyed by their normalized string representations.
+type blocklist struct {
+	ips      map[string]net.IP
+	networks map[string]bool
+}
+
+// readBlocklistFile parses the blocklist file at path.
+func readBlocklistFile(path string) (*blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bl := &blocklist{
+		ips:      make(map[string]net.IP),
+		networks: make(map[string]bool),
+	}
+
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.Contains(line, "-") {
+			networks, err := parseBlocklistRange(line)
+			if err != nil {
+				log.Warn("store: skipping malformed line of blocklist", "path", path, "line", lineNum, "content", line)
+				continue
+			}
+			for _, network := range networks {
+				bl.networks[network] = true
+			}
+			continue
+		}
+
+		if strings.Contains(line, "/") {
+			_, network, err := net.ParseCIDR(line)
+			if err != nil {
+				log.Warn("store: skipping malformed line of blocklist", "path", path, "line", lineNum, "content", line)
+				continue
+			}
+			bl.networks[normalizeNetwork(network).String()] = true
+			continue
+		}
+
+		ip := net.ParseIP(line)
+		if ip == nil {
+			log.Warn("store: skipping malformed line of blocklist", "path", path, "line", lineNum, "content", line)
+			continue
+		}
+		bl.ips[ip.String()] = ip
+	}
+
+	return bl, s.Err()
+}
+
+// parseBlocklistRange returns the networks of a range line of a blocklist.
+func parseBlocklistRange(line string) ([]string, error) {
+	// Descriptions may contain dashes, addresses do not.
+	i := strings.LastIndex(line, "-")
+	first, last := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+	start := net.ParseIP(first)
+	if start == nil {
+		if j := strings.LastIndex(first, ":"); j >= 0 {
+			start = net.ParseIP(strings.TrimSpace(first[j+1:]))
+		}
+	}
+	end := net.ParseIP(last)
+	if start == nil || end == nil {
+		return nil, ErrInvalidIPRange
+	}
+
+	return IPRangeNetworks(start, end)
+}
+
+// normalizeNetwork returns IPv4 networks given in IPv6 notation in their
+// 4-byte form, as they are passed by IPStore.RangeNetworks.
+func normalizeNetwork(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+	}
+	return network
+}
+
+// reloadBlocklistFile replaces the contents of the IPStore with the entries
+// of the blocklist file at path.
+func reloadBlocklistFile(ips IPStore, path string) error {
+	blocklistMu.Lock()
+	defer blocklistMu.Unlock()
+
+	bl, err := readBlocklistFile(path)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]net.IP, 0, len(bl.ips))
+	for _, ip := range bl.ips {
+		entries = append(entries, ip)
+	}
+	networks := make([]string, 0, len(bl.networks))
+	for network := range bl.networks {
+		networks = append(networks, network)
+	}
+
+	return ips.ReplaceAll(entries, networks)
+}
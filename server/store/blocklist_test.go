@@ -0,0 +1,179 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func writeBlocklist(t *testing.T, path, contents string) {
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+}
+
+// storeContents returns the sorted string representations of all IPs and
+// networks contained in ips.
+func storeContents(t *testing.T, ips store.IPStore) []string {
+	var contents []string
+	err := ips.RangeIPs(func(ip net.IP) bool {
+		contents = append(contents, ip.String())
+		return true
+	})
+	require.Nil(t, err)
+
+	err = ips.RangeNetworks(func(network *net.IPNet) bool {
+		contents = append(contents, network.String())
+		return true
+	})
+	require.Nil(t, err)
+
+	sort.Strings(contents)
+	return contents
+}
+
+func requireStoreContents(t *testing.T, ips store.IPStore, expected []string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		contents := storeContents(t, ips)
+		if reflect.DeepEqual(expected, contents) {
+			return
+		}
+
+		require.True(t, time.Now().Before(deadline), "expected %v, got %v", expected, contents)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchBlocklistFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-blocklist")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	// A missing file fails the initial load.
+	require.NotNil(t, store.WatchBlocklistFile(ips, path, nil))
+
+	writeBlocklist(t, path, `
+# banned peers
+192.168.22.22
+fd45:7856:3dae::48
+
+10.0.0.0/8
+::ffff:172.16.0.0/108
+`)
+
+	reload := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- store.WatchBlocklistFile(ips, path, reload)
+	}()
+	requireStoreContents(t, ips, []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.22.22", "fd45:7856:3dae::48"})
+
+	// Entries that are not in the file are removed on reload.
+	require.Nil(t, ips.AddIP(net.ParseIP("10.154.243.22")))
+
+	writeBlocklist(t, path, `
+192.168.22.22
+192.168.23.23
+not an IP
+10.0.0.0/33
+::ffff:172.16.0.0/108
+fd0a:29a8:8445::/48
+`)
+	reload <- struct{}{}
+	requireStoreContents(t, ips, []string{"172.16.0.0/12", "192.168.22.22", "192.168.23.23", "fd0a:29a8:8445::/48"})
+
+	// A failed reload leaves the store unchanged.
+	require.Nil(t, os.Remove(path))
+	reload <- struct{}{}
+	close(reload)
+	require.Nil(t, <-done)
+	requireStoreContents(t, ips, []string{"172.16.0.0/12", "192.168.22.22", "192.168.23.23", "fd0a:29a8:8445::/48"})
+
+	require.Nil(t, <-ips.Stop())
+}
+
+func TestWatchBlocklistFileRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-blocklist")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	writeBlocklist(t, path, `
+Some Org - Hosting:1.2.3.0-1.2.7.255
+10.0.0.0 - 10.0.0.255
+fd00::-fd00::1:ffff
+1.2.3.4-1.2.3.0
+1.2.3.0-fd00::1
+`)
+	reload := make(chan struct{})
+	close(reload)
+	require.Nil(t, store.WatchBlocklistFile(ips, path, reload))
+	requireStoreContents(t, ips, []string{"1.2.3.0/24", "1.2.4.0/22", "10.0.0.0/24", "fd00::/111"})
+
+	require.Nil(t, <-ips.Stop())
+}
+
+func TestWatchBlocklistFileConcurrentReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-blocklist")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	writeBlocklist(t, path, "192.168.22.22\n10.0.0.0/8\n")
+
+	const watchers = 4
+	var wg sync.WaitGroup
+	reloads := make([]chan struct{}, watchers)
+	for i := range reloads {
+		reloads[i] = make(chan struct{})
+		wg.Add(1)
+		go func(reload <-chan struct{}) {
+			defer wg.Done()
+			require.Nil(t, store.WatchBlocklistFile(ips, path, reload))
+		}(reloads[i])
+	}
+
+	writeBlocklist(t, path, "192.168.23.23\n10.0.0.0/8\nfd0a:29a8:8445::/48\n")
+	for i := 0; i < 10; i++ {
+		for _, reload := range reloads {
+			reload <- struct{}{}
+		}
+	}
+	for _, reload := range reloads {
+		close(reload)
+	}
+	wg.Wait()
+
+	requireStoreContents(t, ips, []string{"10.0.0.0/8", "192.168.23.23", "fd0a:29a8:8445::/48"})
+	numIPs, err := ips.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), numIPs)
+	numNetworks, err := ips.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numNetworks)
+
+	require.Nil(t, <-ips.Stop())
+}
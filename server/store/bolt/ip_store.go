@@ -0,0 +1,870 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package bolt implements store drivers backed by BoltDB, which persist
+// their state in a single file for deployments of a single chihaya instance.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	store.RegisterIPStoreDriver("bolt", &ipStoreDriver{})
+}
+
+type ipStoreDriver struct{}
+
+func (d *ipStoreDriver) New(storecfg *store.DriverConfig) (store.IPStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newIPStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: cfg.OpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: unable to open %s: %s", cfg.Path, err)
+	}
+
+	s := &ipStore{
+		db:       db,
+		ips:      []byte(cfg.IPsBucket),
+		networks: []byte(cfg.NetworksBucket),
+		expiry:   []byte(cfg.ExpiryBucket),
+		closed:   make(chan struct{}),
+		reaped:   make(chan struct{}),
+		clock:    storecfg.ClockOrReal(),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{s.ips, s.networks, s.expiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt: unable to create buckets: %s", err)
+	}
+
+	go s.reap(cfg.ReapInterval)
+
+	return s, nil
+}
+
+type ipStoreConfig struct {
+	// Path is the file of the database. It is created if it does not
+	// exist.
+	Path string `yaml:"path"`
+
+	IPsBucket      string        `yaml:"ips_bucket"`
+	NetworksBucket string        `yaml:"networks_bucket"`
+	ExpiryBucket   string        `yaml:"expiry_bucket"`
+	OpenTimeout    time.Duration `yaml:"open_timeout"`
+	ReapInterval   time.Duration `yaml:"reap_interval"`
+}
+
+func newIPStoreConfig(storecfg *store.DriverConfig) (*ipStoreConfig, error) {
+	b, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ipStoreConfig
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Path == "" {
+		return nil, errors.New("bolt: invalid IPStore config: path must be set")
+	}
+	if cfg.IPsBucket == "" {
+		cfg.IPsBucket = "ips"
+	}
+	if cfg.NetworksBucket == "" {
+		cfg.NetworksBucket = "networks"
+	}
+	if cfg.ExpiryBucket == "" {
+		cfg.ExpiryBucket = "expiry"
+	}
+	if cfg.IPsBucket == cfg.NetworksBucket || cfg.IPsBucket == cfg.ExpiryBucket || cfg.NetworksBucket == cfg.ExpiryBucket {
+		return nil, errors.New("bolt: invalid IPStore config: bucket names must be distinct")
+	}
+	if cfg.OpenTimeout <= 0 {
+		// Another process holding the database must not block the start
+		// forever.
+		cfg.OpenTimeout = time.Second
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	return &cfg, nil
+}
+
+// ipStore implements store.IPStore using three buckets:
+//
+// The ips bucket is keyed by individual IP addresses in their 16-byte form.
+// The networks bucket is keyed by the first address of a network in its
+// 16-byte form, followed by a byte holding its prefix length in IPv6
+// notation. Networks are therefore sorted by their first address, and
+// supernets come before their subnets.
+// The values of both are the time the entry expires at, in nanoseconds since
+// the epoch as a big-endian uint64, or zero if it does not expire.
+//
+// The expiry bucket is keyed by the expiry of every expiring entry, followed
+// by ipKind or networkKind and the key of the entry. Its values are empty.
+//
+// Expired entries are treated as absent until they are evicted by the reaper.
+type ipStore struct {
+	db       *bolt.DB
+	ips      []byte
+	networks []byte
+	expiry   []byte
+	closed   chan struct{}
+	reaped   chan struct{}
+
+	// clock tells the time entries expire at and ticks the reaper.
+	clock clock.Clock
+}
+
+var (
+	_ store.IPStore        = &ipStore{}
+	_ store.ContextIPStore = &ipStore{}
+)
+
+// The kinds of entries in the expiry bucket.
+const (
+	ipKind      byte = 'i'
+	networkKind byte = 'n'
+)
+
+// checkOpen panics if the store has been stopped.
+func (s *ipStore) checkOpen() {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+}
+
+// ipKey returns the key of ip in the ips bucket.
+func ipKey(ip net.IP) []byte {
+	return append([]byte(nil), ip.To16()...)
+}
+
+// networkKey returns the key of the network with the first address ip and the
+// prefix length ones in IPv6 notation in the networks bucket.
+func networkKey(ip net.IP, ones int) []byte {
+	key := make([]byte, net.IPv6len+1)
+	copy(key, ip.To16())
+	key[net.IPv6len] = byte(ones)
+	return key
+}
+
+// decodeNetworkKey returns the network of a key of the networks bucket.
+func decodeNetworkKey(key []byte) *net.IPNet {
+	ones := int(key[net.IPv6len])
+	return normalize(&net.IPNet{
+		IP:   append(net.IP(nil), key[:net.IPv6len]...),
+		Mask: net.CIDRMask(ones, 8*net.IPv6len),
+	})
+}
+
+// parseCIDR parses a network in CIDR notation like net.ParseCIDR does and
+// returns its first address and its prefix length in IPv6 notation.
+func parseCIDR(network string) (net.IP, int, error) {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96
+	}
+	return ipnet.IP.To16(), ones, nil
+}
+
+// normalize converts an IPv4 network in IPv6 notation to its 4-byte form.
+// Other networks are returned unmodified.
+func normalize(ipnet *net.IPNet) *net.IPNet {
+	ones, bits := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		ipnet.IP = ip4
+		ipnet.Mask = net.CIDRMask(ones-96, 8*net.IPv4len)
+	}
+
+	return ipnet
+}
+
+// encodeExpiry returns the value of an entry that expires at expires.
+func encodeExpiry(expires time.Time) []byte {
+	v := make([]byte, 8)
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(v, uint64(expires.UnixNano()))
+	}
+	return v
+}
+
+// decodeExpiry returns the time the entry with the value v expires at, or the
+// zero time if it does not expire.
+func decodeExpiry(v []byte) time.Time {
+	if expires := int64(binary.BigEndian.Uint64(v)); expires != 0 {
+		return time.Unix(0, expires)
+	}
+	return time.Time{}
+}
+
+// expired returns whether the entry with the value v has expired at now.
+func (s *ipStore) expired(v []byte, now int64) bool {
+	expires := int64(binary.BigEndian.Uint64(v))
+	return expires != 0 && expires <= now
+}
+
+// expiryKey returns the key of an entry of the given kind and key that
+// expires at the time encoded in v in the expiry bucket.
+func expiryKey(v []byte, kind byte, key []byte) []byte {
+	ek := make([]byte, 0, len(v)+1+len(key))
+	ek = append(ek, v...)
+	ek = append(ek, kind)
+	return append(ek, key...)
+}
+
+// put stores the entry key of the given kind in the bucket b, replacing its
+// expiry.
+func (s *ipStore) put(tx *bolt.Tx, b []byte, kind byte, key []byte, expires time.Time) error {
+	err := s.delete(tx, b, kind, key)
+	if err != nil && err != store.ErrResourceDoesNotExist {
+		return err
+	}
+
+	v := encodeExpiry(expires)
+	if !expires.IsZero() {
+		err = tx.Bucket(s.expiry).Put(expiryKey(v, kind, key), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(b).Put(key, v)
+}
+
+// delete deletes the entry key of the given kind from the bucket b, along with
+// its expiry.
+//
+// Returns ErrResourceDoesNotExist if the entry does not exist or has expired.
+func (s *ipStore) delete(tx *bolt.Tx, b []byte, kind byte, key []byte) error {
+	bucket := tx.Bucket(b)
+	v := bucket.Get(key)
+	if v == nil {
+		return store.ErrResourceDoesNotExist
+	}
+
+	expired := s.expired(v, s.clock.Now().UnixNano())
+	if binary.BigEndian.Uint64(v) != 0 {
+		err := tx.Bucket(s.expiry).Delete(expiryKey(v, kind, key))
+		if err != nil {
+			return err
+		}
+	}
+	err := bucket.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	if expired {
+		return store.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (s *ipStore) addIP(ip net.IP, expires time.Time) error {
+	s.checkOpen()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, s.ips, ipKind, ipKey(ip), expires)
+	})
+}
+
+func (s *ipStore) AddIP(ip net.IP) error {
+	return s.addIP(ip, time.Time{})
+}
+
+func (s *ipStore) AddIPWithExpiry(ip net.IP, expires time.Time) error {
+	return s.addIP(ip, expires)
+}
+
+func (s *ipStore) addNetworks(networks []string, expires time.Time) error {
+	s.checkOpen()
+
+	// Parse everything before opening a transaction, so that a malformed
+	// network leaves the store untouched.
+	keys := make([][]byte, 0, len(networks))
+	for i, network := range networks {
+		ip, ones, err := parseCIDR(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		keys = append(keys, networkKey(ip, ones))
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := s.put(tx, s.networks, networkKind, key, expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ipStore) AddNetwork(network string) error {
+	err := s.addNetworks([]string{network}, time.Time{})
+	if invalid, ok := err.(store.InvalidNetworkError); ok {
+		return invalid.Err
+	}
+	return err
+}
+
+func (s *ipStore) AddNetworkWithExpiry(network string, expires time.Time) error {
+	err := s.addNetworks([]string{network}, expires)
+	if invalid, ok := err.(store.InvalidNetworkError); ok {
+		return invalid.Err
+	}
+	return err
+}
+
+func (s *ipStore) AddNetworks(networks []string) error {
+	return s.addNetworks(networks, time.Time{})
+}
+
+func (s *ipStore) AddIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+	return s.AddNetworks(networks)
+}
+
+// contains returns whether ip is contained in tx, either as an individual IP
+// or in a network with a prefix length in IPv6 notation of at most maxOnes.
+func (s *ipStore) contains(tx *bolt.Tx, ip net.IP, maxOnes int) bool {
+	now := s.clock.Now().UnixNano()
+	ip = ip.To16()
+
+	if maxOnes == 8*net.IPv6len && s.containsIP(tx, ip, now) {
+		return true
+	}
+	return s.inNetwork(tx, ip, maxOnes, now)
+}
+
+// containsIP returns whether ip, in its 16-byte form, is contained in tx as
+// an individual IP.
+func (s *ipStore) containsIP(tx *bolt.Tx, ip net.IP, now int64) bool {
+	v := tx.Bucket(s.ips).Get(ip)
+	return v != nil && !s.expired(v, now)
+}
+
+// inNetwork returns whether ip, in its 16-byte form, is contained in a
+// network of tx with a prefix length in IPv6 notation of at most maxOnes.
+//
+// Networks are found by a backwards scan from the key of ip, which skips
+// every network that does not contain ip along with all of its neighbours
+// that cannot contain it either, so that it visits at most one network per
+// prefix length.
+func (s *ipStore) inNetwork(tx *bolt.Tx, ip net.IP, maxOnes int, now int64) bool {
+	c := tx.Bucket(s.networks).Cursor()
+
+	// seekBefore positions c at the last key that is smaller than key.
+	seekBefore := func(key []byte) ([]byte, []byte) {
+		if k, _ := c.Seek(key); k == nil {
+			return c.Last()
+		}
+		return c.Prev()
+	}
+
+	k, v := seekBefore(networkKey(ip, maxOnes+1))
+	for k != nil {
+		ones := int(k[net.IPv6len])
+		common := commonPrefixLength(k[:net.IPv6len], ip)
+
+		if ones <= common && ones <= maxOnes {
+			// The network contains ip. Only its supernets, which come
+			// right before it, can contain ip, too.
+			if !s.expired(v, now) {
+				return true
+			}
+			k, v = c.Prev()
+			continue
+		}
+
+		// Every network that contains ip, but comes before this one,
+		// shares at most the first common bits with it.
+		if common > maxOnes {
+			common = maxOnes
+		}
+		k, v = seekBefore(networkKey(ip.Mask(net.CIDRMask(common, 8*net.IPv6len)), common+1))
+	}
+
+	return false
+}
+
+// commonPrefixLength returns the number of leading bits a and b, which are of
+// the same length, have in common.
+func commonPrefixLength(a, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := 8 * i
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return 8 * len(a)
+}
+
+func (s *ipStore) HasIP(ip net.IP) (bool, error) {
+	return s.HasAnyIP([]net.IP{ip})
+}
+
+func (s *ipStore) HasAnyIP(ips []net.IP) (bool, error) {
+	return s.HasAnyIPContext(context.Background(), ips)
+}
+
+// HasAnyIPContext checks ctx between the lookups of the individual IPs
+// within its read transaction.
+func (s *ipStore) HasAnyIPContext(ctx context.Context, ips []net.IP) (bool, error) {
+	s.checkOpen()
+
+	var match bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.clock.Now().UnixNano()
+		for _, ip := range ips {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if s.containsIP(tx, ip.To16(), now) {
+				match = true
+				return nil
+			}
+		}
+		for _, ip := range ips {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if s.inNetwork(tx, ip.To16(), 8*net.IPv6len, now) {
+				match = true
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return match, err
+}
+
+func (s *ipStore) HasAllIPs(ips []net.IP) (bool, error) {
+	return s.HasAllIPsContext(context.Background(), ips)
+}
+
+// HasAllIPsContext checks ctx between the lookups of the individual IPs
+// within its read transaction.
+func (s *ipStore) HasAllIPsContext(ctx context.Context, ips []net.IP) (bool, error) {
+	s.checkOpen()
+
+	all := true
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, ip := range ips {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !s.contains(tx, ip, 8*net.IPv6len) {
+				all = false
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return all, err
+}
+
+// HasNetwork first checks whether the network is contained in any stored
+// network. Otherwise, the stored subnets and IPs of the network are scanned,
+// which are adjacent in their buckets.
+func (s *ipStore) HasNetwork(network string) (bool, error) {
+	ip, ones, err := parseCIDR(network)
+	if err != nil {
+		return false, err
+	}
+	s.checkOpen()
+
+	var covered bool
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if s.contains(tx, ip, ones) {
+			covered = true
+			return nil
+		}
+
+		now := s.clock.Now().UnixNano()
+		r := newAddrRange(ip, ones)
+		var ranges []addrRange
+
+		c := tx.Bucket(s.networks).Cursor()
+		for k, v := c.Seek(ip); k != nil && bytes.Compare(k[:net.IPv6len], r.last[:]) <= 0; k, v = c.Next() {
+			if !s.expired(v, now) {
+				ranges = append(ranges, newAddrRange(k[:net.IPv6len], int(k[net.IPv6len])))
+			}
+		}
+
+		c = tx.Bucket(s.ips).Cursor()
+		for k, v := c.Seek(ip); k != nil && bytes.Compare(k, r.last[:]) <= 0; k, v = c.Next() {
+			if !s.expired(v, now) {
+				ranges = append(ranges, newAddrRange(k, 8*net.IPv6len))
+			}
+		}
+
+		covered = r.coveredBy(ranges)
+		return nil
+	})
+
+	return covered, err
+}
+
+// addrRange is an inclusive range of IPv6 addresses.
+type addrRange struct {
+	first, last [16]byte
+}
+
+func newAddrRange(ip []byte, ones int) addrRange {
+	var r addrRange
+	copy(r.first[:], ip)
+	r.last = r.first
+	for i := ones; i < 8*net.IPv6len; i++ {
+		r.last[i/8] |= 0x80 >> uint(i%8)
+	}
+	return r
+}
+
+type byFirst []addrRange
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].first[:], r[j].first[:]) < 0 }
+
+// coveredBy returns whether the union of ranges contains every address of r.
+func (r addrRange) coveredBy(ranges []addrRange) bool {
+	sort.Sort(byFirst(ranges))
+
+	// next is the first address of r that is not known to be covered yet.
+	next := r.first
+	for _, c := range ranges {
+		if bytes.Compare(c.first[:], next[:]) > 0 {
+			return false
+		}
+		if bytes.Compare(c.last[:], next[:]) < 0 {
+			continue
+		}
+		if bytes.Compare(c.last[:], r.last[:]) >= 0 {
+			return true
+		}
+
+		// Advance next to the address following c.
+		next = c.last
+		for i := len(next) - 1; i >= 0; i-- {
+			next[i]++
+			if next[i] != 0 {
+				break
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *ipStore) RemoveIP(ip net.IP) error {
+	s.checkOpen()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.delete(tx, s.ips, ipKind, ipKey(ip))
+	})
+}
+
+func (s *ipStore) RemoveNetwork(network string) error {
+	ip, ones, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+	s.checkOpen()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.delete(tx, s.networks, networkKind, networkKey(ip, ones))
+	})
+}
+
+func (s *ipStore) RemoveIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+
+	b := s.Batch()
+	for _, network := range networks {
+		err = b.RemoveNetwork(network)
+		if err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// CarveNetwork looks up the supernets of the network by their keys and its
+// subnets by a scan over the adjacent keys that start within the network.
+func (s *ipStore) CarveNetwork(network string) error {
+	ip, ones, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+	hole := decodeNetworkKey(networkKey(ip, ones))
+	s.checkOpen()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		now := s.clock.Now().UnixNano()
+		bucket := tx.Bucket(s.networks)
+
+		// The keys and values of the overlapping networks are copied, as
+		// they are only valid until the bucket is modified.
+		var keys, values [][]byte
+		collect := func(k, v []byte) {
+			if v != nil && !s.expired(v, now) {
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+		}
+
+		for prefix := 0; prefix <= ones; prefix++ {
+			k := networkKey(ip.Mask(net.CIDRMask(prefix, 8*net.IPv6len)), prefix)
+			collect(k, bucket.Get(k))
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(networkKey(ip, ones+1)); k != nil && commonPrefixLength(k[:net.IPv6len], ip) >= ones; k, v = c.Next() {
+			collect(k, v)
+		}
+
+		if len(keys) == 0 {
+			return store.ErrResourceDoesNotExist
+		}
+
+		for i, k := range keys {
+			remaining, _ := store.ExcludeNetwork(decodeNetworkKey(k), hole)
+			if err := s.delete(tx, s.networks, networkKind, k); err != nil {
+				return err
+			}
+			for _, ipnet := range remaining {
+				rip, rones, err := parseCIDR(ipnet.String())
+				if err != nil {
+					return err
+				}
+				err = s.put(tx, s.networks, networkKind, networkKey(rip, rones), decodeExpiry(values[i]))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// count returns the number of keys of the bucket b.
+func (s *ipStore) ReplaceAll(ips []net.IP, networks []string) error {
+	s.checkOpen()
+
+	keys := make([][]byte, 0, len(networks))
+	for i, network := range networks {
+		ip, ones, err := parseCIDR(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		keys = append(keys, networkKey(ip, ones))
+	}
+
+	// The buckets are recreated in a single transaction, which readers see
+	// either not at all or completely.
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{s.ips, s.networks, s.expiry} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		v := encodeExpiry(time.Time{})
+		for _, ip := range ips {
+			if err := tx.Bucket(s.ips).Put(ipKey(ip), v); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			if err := tx.Bucket(s.networks).Put(key, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ipStore) count(b []byte) (uint64, error) {
+	s.checkOpen()
+
+	var n uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = uint64(tx.Bucket(b).Stats().KeyN)
+		return nil
+	})
+	return n, err
+}
+
+func (s *ipStore) NumIPs() (uint64, error) {
+	return s.count(s.ips)
+}
+
+func (s *ipStore) NumNetworks() (uint64, error) {
+	return s.count(s.networks)
+}
+
+// rangeValid calls fn for the keys of all entries of the bucket b that have
+// not expired, in the order of their keys, until fn returns false.
+func (s *ipStore) rangeValid(b []byte, fn func(key []byte) bool) error {
+	s.checkOpen()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		now := s.clock.Now().UnixNano()
+		c := tx.Bucket(b).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !s.expired(v, now) && !fn(k) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// RangeIPs iterates over the stored IPs in ascending order, with the IPv4
+// addresses first.
+func (s *ipStore) RangeIPs(fn func(ip net.IP) bool) error {
+	return s.rangeValid(s.ips, func(key []byte) bool {
+		ip := append(net.IP(nil), key...)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return fn(ip)
+	})
+}
+
+// RangeNetworks iterates over the stored networks in ascending order of their
+// first addresses, with supernets before their subnets.
+func (s *ipStore) RangeNetworks(fn func(network *net.IPNet) bool) error {
+	return s.rangeValid(s.networks, func(key []byte) bool {
+		return fn(decodeNetworkKey(key))
+	})
+}
+
+// evict deletes all expired entries.
+func (s *ipStore) evict() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		now := encodeExpiry(s.clock.Now())
+		expiry := tx.Bucket(s.expiry)
+
+		var expired [][]byte
+		c := expiry.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], now) <= 0; k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+
+		for _, k := range expired {
+			b := s.ips
+			if k[8] == networkKind {
+				b = s.networks
+			}
+			if err := tx.Bucket(b).Delete(k[9:]); err != nil {
+				return err
+			}
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reap periodically evicts expired entries until the store is stopped.
+func (s *ipStore) reap(interval time.Duration) {
+	defer close(s.reaped)
+
+	t := s.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C():
+			// Failing to evict is harmless, because expired entries
+			// are ignored anyway; the next run will try again.
+			s.evict()
+		}
+	}
+}
+
+// Stop stops the reaper and closes the database. Every modification has been
+// written to the file by the time it returned, so there is nothing to flush
+// but the file itself.
+func (s *ipStore) Stop() <-chan error {
+	toReturn := make(chan error)
+	go func() {
+		close(s.closed)
+		<-s.reaped
+
+		err := s.db.Sync()
+		if closeErr := s.db.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			toReturn <- err
+		}
+		close(toReturn)
+	}()
+	return toReturn
+}
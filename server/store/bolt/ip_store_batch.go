@@ -0,0 +1,171 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bolt
+
+import (
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// ipBatch implements store.IPBatch for an ipStore.
+//
+// Every modification is recorded as a function, which are all applied in a
+// single transaction on Commit.
+type ipBatch struct {
+	s   *ipStore
+	ops []func(tx *bolt.Tx) error
+
+	// ips and nets record whether the IPs and networks modified by the
+	// batch so far, by their keys, are contained in the store after the
+	// batch is committed.
+	ips  map[string]bool
+	nets map[string]bool
+
+	done bool
+}
+
+var _ store.IPBatch = &ipBatch{}
+
+func (s *ipStore) Batch() store.IPBatch {
+	s.checkOpen()
+
+	return &ipBatch{
+		s:    s,
+		ips:  make(map[string]bool),
+		nets: make(map[string]bool),
+	}
+}
+
+// valid returns whether the entry key of the bucket b exists and has not
+// expired.
+func (s *ipStore) valid(b, key []byte) (bool, error) {
+	s.checkOpen()
+
+	var valid bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(b).Get(key)
+		valid = v != nil && !s.expired(v, s.clock.Now().UnixNano())
+		return nil
+	})
+	return valid, err
+}
+
+func (b *ipBatch) AddIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	key := ipKey(ip)
+	b.ips[string(key)] = true
+	b.ops = append(b.ops, func(tx *bolt.Tx) error {
+		return b.s.put(tx, b.s.ips, ipKind, key, time.Time{})
+	})
+
+	return nil
+}
+
+func (b *ipBatch) AddNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	ip, ones, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	key := networkKey(ip, ones)
+	b.nets[string(key)] = true
+	b.ops = append(b.ops, func(tx *bolt.Tx) error {
+		return b.s.put(tx, b.s.networks, networkKind, key, time.Time{})
+	})
+
+	return nil
+}
+
+// remove records the removal of the entry key of the given kind from the
+// bucket, after checking that it is contained according to the batch or the
+// store.
+func (b *ipBatch) remove(contained map[string]bool, bucket []byte, kind byte, key []byte) error {
+	ok, recorded := contained[string(key)]
+	if !recorded {
+		var err error
+		ok, err = b.s.valid(bucket, key)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return store.ErrResourceDoesNotExist
+	}
+
+	contained[string(key)] = false
+	b.ops = append(b.ops, func(tx *bolt.Tx) error {
+		err := b.s.delete(tx, bucket, kind, key)
+		if err == store.ErrResourceDoesNotExist {
+			// The entry expired after it was checked.
+			return nil
+		}
+		return err
+	})
+
+	return nil
+}
+
+func (b *ipBatch) RemoveIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	return b.remove(b.ips, b.s.ips, ipKind, ipKey(ip))
+}
+
+func (b *ipBatch) RemoveNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	ip, ones, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	return b.remove(b.nets, b.s.networks, networkKind, networkKey(ip, ones))
+}
+
+func (b *ipBatch) Commit() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+	b.s.checkOpen()
+
+	return b.s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range b.ops {
+			if err := op(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *ipBatch) Rollback() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+	b.ops = nil
+
+	return nil
+}
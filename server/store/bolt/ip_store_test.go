@@ -0,0 +1,299 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package bolt
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+var ipStoreTester = store.PrepareIPStoreTester(&ipStoreDriver{})
+
+// tempConfig returns a DriverConfig for a store in a new database file and a
+// function that deletes it.
+func tempConfig(t *testing.T) (*store.DriverConfig, func()) {
+	dir, err := ioutil.TempDir("", "chihaya-bolt")
+	require.Nil(t, err)
+
+	return &store.DriverConfig{
+		Name: "bolt",
+		Config: map[string]interface{}{
+			"path": filepath.Join(dir, "ips.db"),
+		},
+	}, func() { os.RemoveAll(dir) }
+}
+
+func TestIPStore(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestIPStore(t, cfg)
+}
+
+func TestHasAllHasAny(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestHasAllHasAny(t, cfg)
+}
+
+func TestNetworks(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestNetworks(t, cfg)
+}
+
+func TestHasAllHasAnyNetworks(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestHasAllHasAnyNetworks(t, cfg)
+}
+
+func TestAddNetworks(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestAddNetworks(t, cfg)
+}
+
+func TestIPRange(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestIPRange(t, cfg)
+}
+
+func TestCarveNetwork(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestCarveNetwork(t, cfg)
+}
+
+func TestRange(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestRange(t, cfg)
+}
+
+func TestHasNetwork(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestHasNetwork(t, cfg)
+}
+
+func TestCount(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestCount(t, cfg)
+}
+
+func TestExpiry(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestExpiry(t, cfg)
+}
+
+func TestBatch(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestBatch(t, cfg)
+}
+
+func TestBatchConcurrentReads(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestBatchConcurrentReads(t, cfg)
+}
+
+func TestBatchMoveConcurrentReads(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestBatchMoveConcurrentReads(t, cfg)
+}
+
+func TestReplaceAll(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestReplaceAll(t, cfg)
+}
+
+func TestReplaceAllConcurrentReads(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+	ipStoreTester.TestReplaceAllConcurrentReads(t, cfg)
+}
+
+func TestIPStoreConfig(t *testing.T) {
+	var table = []struct {
+		config map[string]interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{"path": "ips.db"}, true},
+		{map[string]interface{}{"path": "ips.db", "ips_bucket": "a", "networks_bucket": "b", "expiry_bucket": "c"}, true},
+		{nil, false},
+		{map[string]interface{}{"path": "ips.db", "ips_bucket": "networks"}, false},
+	}
+
+	for _, tt := range table {
+		_, err := newIPStoreConfig(&store.DriverConfig{Name: "bolt", Config: tt.config})
+		if tt.valid {
+			require.Nil(t, err, "%v", tt.config)
+		} else {
+			require.NotNil(t, err, "%v", tt.config)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+
+	is, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, is.AddIP(net.ParseIP("10.0.0.1")))
+	require.Nil(t, is.AddNetwork("192.168.0.0/16"))
+	require.Nil(t, is.AddIPWithExpiry(net.ParseIP("10.0.0.2"), time.Now().Add(time.Hour)))
+	require.Nil(t, is.AddIPWithExpiry(net.ParseIP("10.0.0.3"), time.Now().Add(-time.Second)))
+	require.Nil(t, <-is.Stop())
+
+	// everything but the expired entry is restored from the file
+	is, err = (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	for ip, expected := range map[string]bool{
+		"10.0.0.1":    true,
+		"192.168.4.1": true,
+		"10.0.0.2":    true,
+		"10.0.0.3":    false,
+		"10.0.0.4":    false,
+	} {
+		contained, err := is.HasIP(net.ParseIP(ip))
+		require.Nil(t, err)
+		require.Equal(t, expected, contained, ip)
+	}
+	require.Nil(t, is.RemoveNetwork("192.168.0.0/16"))
+	require.Nil(t, <-is.Stop())
+
+	is, err = (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	contained, err := is.HasIP(net.ParseIP("192.168.4.1"))
+	require.Nil(t, err)
+	require.False(t, contained)
+	numNetworks, err := is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numNetworks)
+	require.Nil(t, <-is.Stop())
+}
+
+func TestLookupCanceled(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+
+	is, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	s := is.(*ipStore)
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+	require.Nil(t, s.AddIP(ips[0]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.HasAnyIPContext(ctx, ips)
+	require.Equal(t, context.Canceled, err)
+	_, err = s.HasAllIPsContext(ctx, ips)
+	require.Equal(t, context.Canceled, err)
+
+	match, err := s.HasAllIPsContext(context.Background(), ips)
+	require.Nil(t, err)
+	require.True(t, match)
+	require.Nil(t, <-s.Stop())
+}
+
+func TestEvict(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	cfg.Clock = fake
+	is, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	s := is.(*ipStore)
+	now := fake.Now()
+
+	require.Nil(t, s.AddIPWithExpiry(net.ParseIP("10.0.0.1"), now.Add(time.Minute)))
+	require.Nil(t, s.AddNetworkWithExpiry("10.1.0.0/16", now.Add(time.Minute)))
+	require.Nil(t, s.AddIPWithExpiry(net.ParseIP("10.0.0.2"), now.Add(time.Hour)))
+
+	// replacing an expiry replaces its entry in the expiry bucket
+	require.Nil(t, s.AddIPWithExpiry(net.ParseIP("10.0.0.2"), now.Add(time.Second)))
+	require.Nil(t, s.AddIP(net.ParseIP("10.0.0.1")))
+
+	fake.Advance(time.Minute)
+	require.Nil(t, s.evict())
+
+	numIPs, err := s.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), numIPs)
+	numNetworks, err := s.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numNetworks)
+	numExpiries, err := s.count(s.expiry)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numExpiries)
+
+	require.Nil(t, <-s.Stop())
+}
+
+// TestContainsScan compares the network scan of contains to checking every
+// network for many random nested networks.
+func TestContainsScan(t *testing.T) {
+	cfg, cleanup := tempConfig(t)
+	defer cleanup()
+
+	is, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	s := is.(*ipStore)
+
+	r := rand.New(rand.NewSource(0))
+	randomIP := func() net.IP {
+		// Few distinct prefixes, so that networks nest.
+		return net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)))
+	}
+
+	var networks []*net.IPNet
+	for i := 0; i < 100; i++ {
+		network := &net.IPNet{IP: randomIP(), Mask: net.CIDRMask(17+r.Intn(16), 32)}
+		network.IP = network.IP.Mask(network.Mask)
+		networks = append(networks, network)
+		require.Nil(t, s.AddNetwork(network.String()))
+	}
+
+	var hits int
+	for i := 0; i < 2000; i++ {
+		ip := randomIP()
+		var expected bool
+		for _, network := range networks {
+			if network.Contains(ip) {
+				expected = true
+				break
+			}
+		}
+
+		contained, err := s.HasIP(ip)
+		require.Nil(t, err)
+		require.Equal(t, expected, contained, ip.String())
+		if contained {
+			hits++
+		}
+	}
+	require.True(t, hits > 200 && hits < 1800, "%d of the IPs are contained", hits)
+
+	require.Nil(t, <-s.Stop())
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// nonceSize is the size of the nonces exchanged by the handshake.
+const nonceSize = 32
+
+// minSecretLength is the length of the shortest secret a cluster accepts.
+const minSecretLength = 16
+
+// errUnauthenticated is returned by a handshake if the other node does not
+// know the secret of the cluster.
+var errUnauthenticated = errors.New("cluster: node failed to authenticate")
+
+// The nodes of a cluster prove to each other that they know its secret before
+// any call is made. Each side sends a nonce, and the MAC of both nonces keyed
+// with the secret, with the name of the side mixed in so that a node can not
+// reflect the MAC of the other side back at it:
+//
+//	dialing node:   client nonce
+//	accepting node: server nonce, MAC("server", client nonce, server nonce)
+//	dialing node:   MAC("client", client nonce, server nonce)
+//
+// The handshake authenticates the nodes, but the calls that follow are neither
+// encrypted nor protected against tampering.
+
+// handshakeMAC returns the MAC side proves that it knows secret with.
+func handshakeMAC(secret []byte, side string, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(side))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// newNonce returns a random nonce.
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// dialHandshake authenticates the node that conn was dialed to, and this node
+// to it. It fails if the handshake does not complete within timeout.
+func dialHandshake(conn net.Conn, secret []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(clientNonce); err != nil {
+		return err
+	}
+
+	reply := make([]byte, nonceSize+sha256.Size)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	serverNonce, serverMAC := reply[:nonceSize], reply[nonceSize:]
+	if !hmac.Equal(serverMAC, handshakeMAC(secret, "server", clientNonce, serverNonce)) {
+		return errUnauthenticated
+	}
+
+	_, err = conn.Write(handshakeMAC(secret, "client", clientNonce, serverNonce))
+	return err
+}
+
+// acceptHandshake authenticates the node that dialed conn, and this node to
+// it. It fails if the handshake does not complete within timeout.
+func acceptHandshake(conn net.Conn, secret []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	clientNonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, clientNonce); err != nil {
+		return err
+	}
+
+	serverNonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	reply := append(serverNonce, handshakeMAC(secret, "server", clientNonce, serverNonce)...)
+	if _, err = conn.Write(reply); err != nil {
+		return err
+	}
+
+	clientMAC := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(conn, clientMAC); err != nil {
+		return err
+	}
+	if !hmac.Equal(clientMAC, handshakeMAC(secret, "client", clientNonce, serverNonce)) {
+		return errUnauthenticated
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package cluster implements a PeerStore driver that partitions the swarms
+// across the nodes of a cluster, so that chihaya can scale beyond one node
+// without sharing a database.
+//
+// Every infohash is owned by one node, which keeps its swarm in a local
+// PeerStore. The nodes forward the calls for the swarms they do not own to
+// their owners, and fail them if the owner can not be reached.
+//
+// The nodes authenticate each other with a shared secret before they serve
+// any call, but do not encrypt the calls, so they should only be reachable
+// through a private network.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	store.RegisterPeerStoreDriver("cluster", &peerStoreDriver{})
+}
+
+type peerStoreDriver struct{}
+
+func (d *peerStoreDriver) New(storecfg *store.DriverConfig) (store.PeerStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newPeerStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := newPeerStore(cfg, ln)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+type peerStoreConfig struct {
+	Node         string             `yaml:"node"`
+	Listen       string             `yaml:"listen"`
+	Secret       string             `yaml:"secret"`
+	Nodes        []string           `yaml:"nodes"`
+	VirtualNodes int                `yaml:"virtual_nodes"`
+	Timeout      time.Duration      `yaml:"timeout"`
+	PeerStore    store.DriverConfig `yaml:"peer_store"`
+}
+
+func newPeerStoreConfig(storecfg *store.DriverConfig) (*peerStoreConfig, error) {
+	b, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg peerStoreConfig
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, node := range cfg.Nodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return nil, fmt.Errorf("cluster: invalid PeerStore config: node %q: %s", node, err)
+		}
+		if seen[node] {
+			return nil, fmt.Errorf("cluster: invalid PeerStore config: node %q is listed twice", node)
+		}
+		seen[node] = true
+	}
+	if !seen[cfg.Node] {
+		return nil, fmt.Errorf("cluster: invalid PeerStore config: node %q is not one of the nodes", cfg.Node)
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = cfg.Node
+	}
+	if len(cfg.Secret) < minSecretLength {
+		return nil, fmt.Errorf("cluster: invalid PeerStore config: secret must be at least %d bytes long", minSecretLength)
+	}
+	if cfg.VirtualNodes < 0 {
+		return nil, fmt.Errorf("cluster: invalid PeerStore config: virtual_nodes must not be negative, got %d", cfg.VirtualNodes)
+	}
+	if cfg.VirtualNodes == 0 {
+		cfg.VirtualNodes = 128
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.PeerStore.Name == "" {
+		cfg.PeerStore.Name = "memory"
+	}
+	if cfg.PeerStore.Name == "cluster" {
+		return nil, fmt.Errorf("cluster: invalid PeerStore config: peer_store must not be a cluster")
+	}
+	return &cfg, nil
+}
+
+// peerStore implements store.PeerStore by routing every call for a swarm to
+// the node that owns it.
+//
+// Calls that are not about one swarm are made on all nodes: the totals are
+// those of the whole cluster, and garbage is collected everywhere. Only the
+// events of the local swarms are available through Subscribe.
+type peerStore struct {
+	self  string
+	ring  *ring
+	local store.PeerStore
+	nodes map[string]*node
+
+	ln      net.Listener
+	secret  []byte
+	timeout time.Duration
+	svc     *service
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	serving sync.WaitGroup
+	closed  chan struct{}
+}
+
+var (
+	_ store.PeerStore          = &peerStore{}
+	_ store.ContextPeerStore   = &peerStore{}
+	_ store.SwarmSizeWalker    = &peerStore{}
+	_ store.SwarmMemberChecker = &peerStore{}
+)
+
+// newPeerStore opens the local PeerStore of cfg and serves it to the other
+// nodes on ln.
+func newPeerStore(cfg *peerStoreConfig, ln net.Listener) (*peerStore, error) {
+	local, err := store.OpenPeerStore(&cfg.PeerStore)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &peerStore{
+		self:    cfg.Node,
+		ring:    newRing(cfg.Nodes, cfg.VirtualNodes),
+		local:   local,
+		nodes:   make(map[string]*node),
+		ln:      ln,
+		secret:  []byte(cfg.Secret),
+		timeout: cfg.Timeout,
+		svc:     &service{local: local},
+		conns:   make(map[net.Conn]struct{}),
+		closed:  make(chan struct{}),
+	}
+	for _, addr := range cfg.Nodes {
+		if addr != cfg.Node {
+			s.nodes[addr] = newNode(addr, s.secret, cfg.Timeout)
+		}
+	}
+
+	server := rpc.NewServer()
+	err = server.RegisterName(serviceName, s.svc)
+	if err != nil {
+		<-local.Stop()
+		return nil, err
+	}
+
+	s.serving.Add(1)
+	go s.serve(server)
+
+	return s, nil
+}
+
+// serve accepts the connections of the other nodes until the store is
+// stopped. Connections are served once the node that dialed them
+// authenticated itself.
+func (s *peerStore) serve(server *rpc.Server) {
+	defer s.serving.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Error("cluster: failed to accept connection", "error", err)
+			}
+			return
+		}
+
+		// Stop closes the connections it finds, so connections that were
+		// accepted while it ran are closed right away.
+		s.connsMu.Lock()
+		select {
+		case <-s.closed:
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+
+		s.serving.Add(1)
+		go func() {
+			defer s.serving.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+			}()
+
+			if err := acceptHandshake(conn, s.secret, s.timeout); err != nil {
+				select {
+				case <-s.closed:
+				default:
+					log.Warn("cluster: rejected connection", "remote", conn.RemoteAddr().String(), "error", err)
+				}
+				conn.Close()
+				return
+			}
+			server.ServeConn(conn)
+		}()
+	}
+}
+
+// owner returns the node that owns the swarm of infoHash, or nil if it is
+// owned by this node.
+func (s *peerStore) owner(infoHash chihaya.InfoHash) *node {
+	addr := s.ring.owner(infoHash)
+	if addr == s.self {
+		return nil
+	}
+	return s.nodes[addr]
+}
+
+func (s *peerStore) PutSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "PutSeeder", &PeerArgs{InfoHash: infoHash, Peer: p}, &struct{}{})
+	}
+	return s.local.PutSeeder(infoHash, p)
+}
+
+func (s *peerStore) DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "DeleteSeeder", &PeerArgs{InfoHash: infoHash, Peer: p}, &struct{}{})
+	}
+	return s.local.DeleteSeeder(infoHash, p)
+}
+
+func (s *peerStore) PutLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "PutLeecher", &PeerArgs{InfoHash: infoHash, Peer: p}, &struct{}{})
+	}
+	return s.local.PutLeecher(infoHash, p)
+}
+
+func (s *peerStore) DeleteLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "DeleteLeecher", &PeerArgs{InfoHash: infoHash, Peer: p}, &struct{}{})
+	}
+	return s.local.DeleteLeecher(infoHash, p)
+}
+
+func (s *peerStore) GraduateLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "GraduateLeecher", &PeerArgs{InfoHash: infoHash, Peer: p}, &struct{}{})
+	}
+	return s.local.GraduateLeecher(infoHash, p)
+}
+
+func (s *peerStore) AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	return s.AnnouncePeersContext(context.Background(), infoHash, seeder, numWant, peer4, peer6, policy)
+}
+
+// AnnouncePeersContext implements store.ContextPeerStore. Calls to other
+// nodes are abandoned once ctx is done.
+func (s *peerStore) AnnouncePeersContext(ctx context.Context, infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	n := s.owner(infoHash)
+	if n == nil {
+		return store.AnnouncePeers(ctx, s.local, infoHash, seeder, numWant, peer4, peer6, policy)
+	}
+
+	args := &AnnounceArgs{
+		InfoHash: infoHash,
+		Seeder:   seeder,
+		NumWant:  numWant,
+		Peer4:    peer4,
+		Peer6:    peer6,
+		Policy:   policy,
+	}
+	var reply PeersReply
+	err = n.call(ctx, "AnnouncePeers", args, &reply)
+	return reply.Peers, reply.Peers6, err
+}
+
+func (s *peerStore) CollectGarbage(cutoff time.Time) error {
+	err := s.local.CollectGarbage(cutoff)
+	for _, n := range s.nodes {
+		if nerr := n.call(context.Background(), "CollectGarbage", &cutoff, &struct{}{}); nerr != nil && err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
+
+func (s *peerStore) GetSeeders(infoHash chihaya.InfoHash) (peers, peers6 []chihaya.Peer, err error) {
+	if n := s.owner(infoHash); n != nil {
+		var reply PeersReply
+		err = n.call(context.Background(), "GetSeeders", &infoHash, &reply)
+		return reply.Peers, reply.Peers6, err
+	}
+	return s.local.GetSeeders(infoHash)
+}
+
+func (s *peerStore) GetLeechers(infoHash chihaya.InfoHash) (peers, peers6 []chihaya.Peer, err error) {
+	if n := s.owner(infoHash); n != nil {
+		var reply PeersReply
+		err = n.call(context.Background(), "GetLeechers", &infoHash, &reply)
+		return reply.Peers, reply.Peers6, err
+	}
+	return s.local.GetLeechers(infoHash)
+}
+
+// NumSeeders implements store.PeerStore. Its signature has no room for
+// errors, so 0 is returned if the owner of the swarm can not be reached.
+func (s *peerStore) NumSeeders(infoHash chihaya.InfoHash) int {
+	if n := s.owner(infoHash); n != nil {
+		var num int
+		if err := n.call(context.Background(), "NumSeeders", &infoHash, &num); err != nil {
+			log.Warn("cluster: failed to count seeders", "infohash", infoHash, "error", err)
+			return 0
+		}
+		return num
+	}
+	return s.local.NumSeeders(infoHash)
+}
+
+// NumLeechers implements store.PeerStore like NumSeeders.
+func (s *peerStore) NumLeechers(infoHash chihaya.InfoHash) int {
+	if n := s.owner(infoHash); n != nil {
+		var num int
+		if err := n.call(context.Background(), "NumLeechers", &infoHash, &num); err != nil {
+			log.Warn("cluster: failed to count leechers", "infohash", infoHash, "error", err)
+			return 0
+		}
+		return num
+	}
+	return s.local.NumLeechers(infoHash)
+}
+
+func (s *peerStore) IncrementDownloaded(infoHash chihaya.InfoHash) error {
+	if n := s.owner(infoHash); n != nil {
+		return n.call(context.Background(), "IncrementDownloaded", &infoHash, &struct{}{})
+	}
+	return s.local.IncrementDownloaded(infoHash)
+}
+
+func (s *peerStore) HasPeer(infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error) {
+	if n := s.owner(infoHash); n != nil {
+		var reply MemberReply
+		err = n.call(context.Background(), "HasPeer", &PeerArgs{InfoHash: infoHash, Peer: p}, &reply)
+		return reply.Seeder, reply.Leecher, err
+	}
+	return localHasPeer(s.local, infoHash, p)
+}
+
+func (s *peerStore) GetStats(infoHash chihaya.InfoHash) (seeders, leechers, downloaded uint64, err error) {
+	if n := s.owner(infoHash); n != nil {
+		var reply StatsReply
+		err = n.call(context.Background(), "GetStats", &infoHash, &reply)
+		return reply.Seeders, reply.Leechers, reply.Downloaded, err
+	}
+	return s.local.GetStats(infoHash)
+}
+
+// totals returns the totals of the swarms of all nodes.
+func (s *peerStore) totals() (TotalsReply, error) {
+	var totals TotalsReply
+	var err error
+	totals.Swarms, totals.Seeders, totals.Leechers, err = localTotals(s.local)
+	if err != nil {
+		return TotalsReply{}, err
+	}
+
+	for _, n := range s.nodes {
+		var reply TotalsReply
+		if err := n.call(context.Background(), "Totals", &struct{}{}, &reply); err != nil {
+			return TotalsReply{}, err
+		}
+		totals.Swarms += reply.Swarms
+		totals.Seeders += reply.Seeders
+		totals.Leechers += reply.Leechers
+	}
+	return totals, nil
+}
+
+func (s *peerStore) NumSwarms() (uint64, error) {
+	totals, err := s.totals()
+	return totals.Swarms, err
+}
+
+func (s *peerStore) NumTotalSeeders() (uint64, error) {
+	totals, err := s.totals()
+	return totals.Seeders, err
+}
+
+func (s *peerStore) NumTotalLeechers() (uint64, error) {
+	totals, err := s.totals()
+	return totals.Leechers, err
+}
+
+// Subscribe implements store.PeerStore. Only the events of the swarms this
+// node owns are sent.
+func (s *peerStore) Subscribe() (<-chan store.PeerEvent, func()) {
+	return s.local.Subscribe()
+}
+
+// WalkSwarmSizes implements store.SwarmSizeWalker for the swarms this node
+// owns, so that the exported distributions of the nodes add up to the one of
+// the cluster.
+func (s *peerStore) WalkSwarmSizes(fn func(infoHash chihaya.InfoHash, peers int)) {
+	if w, ok := s.local.(store.SwarmSizeWalker); ok {
+		w.WalkSwarmSizes(fn)
+	}
+}
+
+func (s *peerStore) Stop() <-chan error {
+	toReturn := make(chan error)
+	go func() {
+		close(s.closed)
+		s.ln.Close()
+
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		s.serving.Wait()
+
+		for _, n := range s.nodes {
+			n.close()
+		}
+
+		// Calls that were received before the connections were closed may
+		// still be running.
+		s.svc.stop()
+
+		if err := <-s.local.Stop(); err != nil {
+			toReturn <- err
+		}
+		close(toReturn)
+	}()
+	return toReturn
+}
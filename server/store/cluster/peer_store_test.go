@@ -0,0 +1,329 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+// testSecret is the secret of the clusters of the tests.
+const testSecret = "0123456789abcdef"
+
+// newCluster starts an in-process cluster of size nodes on local ports.
+func newCluster(size int) ([]*peerStore, error) {
+	listeners := make([]net.Listener, size)
+	addrs := make([]string, size)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners[i] = ln
+		addrs[i] = ln.Addr().String()
+	}
+
+	nodes := make([]*peerStore, size)
+	for i, ln := range listeners {
+		cfg, err := newPeerStoreConfig(&store.DriverConfig{Name: "cluster", Config: map[string]interface{}{
+			"node":    addrs[i],
+			"nodes":   addrs,
+			"secret":  testSecret,
+			"timeout": "200ms",
+		}})
+		if err != nil {
+			return nil, err
+		}
+		nodes[i], err = newPeerStore(cfg, ln)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// testCluster is the first node of a cluster that stops all of its nodes.
+type testCluster struct {
+	*peerStore
+	others []*peerStore
+}
+
+func (c *testCluster) Stop() <-chan error {
+	for _, other := range c.others {
+		if err := <-other.Stop(); err != nil {
+			toReturn := make(chan error, 1)
+			toReturn <- err
+			return toReturn
+		}
+	}
+	return c.peerStore.Stop()
+}
+
+// testClusterDriver opens two-node clusters, so that the tests of the store
+// package run on swarms of both nodes.
+type testClusterDriver struct{}
+
+func (d *testClusterDriver) New(*store.DriverConfig) (store.PeerStore, error) {
+	nodes, err := newCluster(2)
+	if err != nil {
+		return nil, err
+	}
+	return &testCluster{peerStore: nodes[0], others: nodes[1:]}, nil
+}
+
+var (
+	peerStoreTester     = store.PreparePeerStoreTester(&testClusterDriver{})
+	peerStoreTestConfig = &store.DriverConfig{}
+)
+
+func TestPeerStore(t *testing.T) {
+	peerStoreTester.TestPeerStore(t, peerStoreTestConfig)
+}
+
+func TestAnnouncePeersFamilies(t *testing.T) {
+	peerStoreTester.TestAnnouncePeersFamilies(t, peerStoreTestConfig)
+}
+
+func TestDownloaded(t *testing.T) {
+	peerStoreTester.TestDownloaded(t, peerStoreTestConfig)
+}
+
+func TestAnnounceFamilyPolicies(t *testing.T) {
+	peerStoreTester.TestAnnounceFamilyPolicies(t, peerStoreTestConfig)
+}
+
+func TestReannounce(t *testing.T) {
+	peerStoreTester.TestReannounce(t, peerStoreTestConfig)
+}
+
+func TestKeys(t *testing.T) {
+	peerStoreTester.TestKeys(t, peerStoreTestConfig)
+}
+
+func TestHasPeer(t *testing.T) {
+	peerStoreTester.TestHasPeer(t, peerStoreTestConfig)
+}
+
+func TestRequireCrypto(t *testing.T) {
+	peerStoreTester.TestRequireCrypto(t, peerStoreTestConfig)
+}
+
+func TestPeerStoreConfig(t *testing.T) {
+	nodes := []string{"10.0.0.1:6882", "10.0.0.2:6882"}
+	var table = []struct {
+		config map[string]interface{}
+		valid  bool
+	}{
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes, "secret": testSecret}, true},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes, "secret": testSecret, "peer_store": map[string]interface{}{"name": "memory", "config": map[string]interface{}{"shards": 4}}}, true},
+		{map[string]interface{}{"node": "10.0.0.3:6882", "nodes": nodes, "secret": testSecret}, false},
+		{map[string]interface{}{"nodes": nodes, "secret": testSecret}, false},
+		{map[string]interface{}{"node": "10.0.0.1", "nodes": []string{"10.0.0.1"}, "secret": testSecret}, false},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": append(nodes, nodes[0]), "secret": testSecret}, false},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes, "secret": testSecret, "virtual_nodes": -1}, false},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes, "secret": testSecret, "peer_store": map[string]interface{}{"name": "cluster"}}, false},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes}, false},
+		{map[string]interface{}{"node": "10.0.0.1:6882", "nodes": nodes, "secret": "short"}, false},
+	}
+
+	for _, tt := range table {
+		cfg, err := newPeerStoreConfig(&store.DriverConfig{Name: "cluster", Config: tt.config})
+		if !tt.valid {
+			require.NotNil(t, err, "%v", tt.config)
+			continue
+		}
+		require.Nil(t, err, "%v", tt.config)
+		require.Equal(t, "10.0.0.1:6882", cfg.Listen)
+		require.Equal(t, 128, cfg.VirtualNodes)
+		require.Equal(t, time.Second, cfg.Timeout)
+		require.Equal(t, "memory", cfg.PeerStore.Name)
+	}
+}
+
+func peer(id byte) chihaya.Peer {
+	return chihaya.Peer{ID: chihaya.PeerID{id}, IP: net.IPv4(10, 0, 0, id).To4(), Port: 6881}
+}
+
+func TestPartition(t *testing.T) {
+	nodes, err := newCluster(2)
+	require.Nil(t, err)
+	a, b := nodes[0], nodes[1]
+	defer func() {
+		require.Nil(t, <-b.Stop())
+		require.Nil(t, <-a.Stop())
+	}()
+
+	// Swarms announced to either node are kept by their owner only.
+	const numSwarms = 64
+	for i := 0; i < numSwarms; i++ {
+		hash := chihaya.InfoHash{byte(i)}
+		require.Nil(t, a.PutSeeder(hash, peer(1)))
+		require.Nil(t, b.PutLeecher(hash, peer(2)))
+
+		owner, other := a, b
+		if a.ring.owner(hash) == b.self {
+			owner, other = b, a
+		}
+		require.Equal(t, 1, owner.local.NumSeeders(hash))
+		require.Equal(t, 1, owner.local.NumLeechers(hash))
+		require.Equal(t, 0, other.local.NumSeeders(hash)+other.local.NumLeechers(hash))
+	}
+
+	localA, err := a.local.NumSwarms()
+	require.Nil(t, err)
+	localB, err := b.local.NumSwarms()
+	require.Nil(t, err)
+	require.True(t, localA > 0 && localB > 0, "swarms are not partitioned: %d and %d", localA, localB)
+	require.Equal(t, uint64(numSwarms), localA+localB)
+
+	// Both nodes see all swarms.
+	for _, node := range nodes {
+		total, err := node.NumSwarms()
+		require.Nil(t, err)
+		require.Equal(t, uint64(numSwarms), total)
+
+		for i := 0; i < numSwarms; i++ {
+			hash := chihaya.InfoHash{byte(i)}
+			peers, _, err := node.AnnouncePeers(hash, false, 50, peer(2), chihaya.Peer{}, store.SameFamily)
+			require.Nil(t, err)
+			require.Equal(t, []chihaya.Peer{peer(1)}, peers)
+		}
+	}
+
+	// Missing peers of remote swarms are reported like local ones.
+	for i := 0; i < numSwarms; i++ {
+		require.Equal(t, store.ErrResourceDoesNotExist, a.DeleteSeeder(chihaya.InfoHash{byte(i)}, peer(3)))
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	nodes, err := newCluster(2)
+	require.Nil(t, err)
+	a, b := nodes[0], nodes[1]
+	defer func() {
+		require.Nil(t, <-a.Stop())
+	}()
+
+	var local, remote chihaya.InfoHash
+	for i := 0; local == (chihaya.InfoHash{}) || remote == (chihaya.InfoHash{}); i++ {
+		hash := chihaya.InfoHash{byte(i), byte(i >> 8), 1}
+		if a.ring.owner(hash) == a.self {
+			local = hash
+		} else {
+			remote = hash
+		}
+	}
+	require.Nil(t, a.PutSeeder(remote, peer(1)))
+	require.Nil(t, <-b.Stop())
+
+	// Calls for the swarms of the stopped node fail, rather than pretending
+	// the swarms are empty.
+	err = a.PutSeeder(remote, peer(2))
+	require.NotNil(t, err)
+	require.NotEqual(t, store.ErrResourceDoesNotExist, err)
+	_, _, err = a.AnnouncePeers(remote, false, 50, peer(2), chihaya.Peer{}, store.SameFamily)
+	require.NotNil(t, err)
+	require.Equal(t, 0, a.NumSeeders(remote))
+	_, err = a.NumSwarms()
+	require.NotNil(t, err)
+
+	// The swarms of the remaining node are not affected.
+	require.Nil(t, a.PutSeeder(local, peer(1)))
+	require.Equal(t, 1, a.NumSeeders(local))
+
+	// Canceled announces return right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = a.AnnouncePeersContext(ctx, remote, false, 50, peer(2), chihaya.Peer{}, store.SameFamily)
+	require.Equal(t, context.Canceled, err)
+}
+
+// TestTimeout makes sure that calls to nodes that accept connections but do
+// not reply fail once the timeout passes.
+func TestTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	n := newNode(ln.Addr().String(), []byte(testSecret), 50*time.Millisecond)
+	defer n.close()
+
+	start := time.Now()
+	hash := chihaya.InfoHash{1}
+	err = n.call(context.Background(), "PutSeeder", &PeerArgs{InfoHash: hash, Peer: peer(1)}, &struct{}{})
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < time.Second)
+
+	// The connection is dialed again for the next call.
+	n.mu.Lock()
+	require.Nil(t, n.client)
+	n.mu.Unlock()
+}
+
+// TestAuthentication makes sure that nodes only serve and call nodes that know
+// the secret of the cluster.
+func TestAuthentication(t *testing.T) {
+	nodes, err := newCluster(2)
+	require.Nil(t, err)
+	a, b := nodes[0], nodes[1]
+	defer func() {
+		require.Nil(t, <-b.Stop())
+		require.Nil(t, <-a.Stop())
+	}()
+
+	hash := chihaya.InfoHash{1}
+	args := &PeerArgs{InfoHash: hash, Peer: peer(1)}
+
+	// a node with the wrong secret is rejected
+	n := newNode(a.self, []byte("fedcba9876543210"), 200*time.Millisecond)
+	defer n.close()
+	err = n.call(context.Background(), "PutSeeder", args, &struct{}{})
+	require.NotNil(t, err)
+	require.Equal(t, 0, a.local.NumSeeders(hash))
+
+	// connections that skip the handshake are never served
+	conn, err := net.Dial("tcp", a.self)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, nonceSize+sha256.Size))
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, make([]byte, nonceSize+sha256.Size))
+	require.Nil(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	// a node that does not know the secret is not called
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		acceptHandshake(conn, []byte("fedcba9876543210"), time.Second)
+	}()
+	n = newNode(ln.Addr().String(), []byte(testSecret), 200*time.Millisecond)
+	defer n.close()
+	err = n.call(context.Background(), "PutSeeder", args, &struct{}{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), errUnauthenticated.Error())
+
+	// the nodes of the cluster know the secret
+	require.Nil(t, b.nodes[a.self].call(context.Background(), "PutSeeder", args, &struct{}{}))
+	require.Equal(t, 1, a.local.NumSeeders(hash))
+}
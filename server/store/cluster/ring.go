@@ -0,0 +1,70 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+
+	"github.com/chihaya/chihaya"
+)
+
+// point is a position on the ring that belongs to a node.
+type point struct {
+	hash uint64
+	node string
+}
+
+// ring assigns infohashes to the nodes of a cluster by consistent hashing.
+//
+// Every node is placed on the ring at a number of virtual positions, and an
+// infohash is owned by the node of the first position at or after the hash of
+// the infohash. Adding or removing a node therefore only moves the swarms of
+// the positions next to its own, and every node computes the same owners
+// from the same list of nodes, regardless of its order.
+type ring struct {
+	points []point
+}
+
+func newRing(nodes []string, virtualNodes int) *ring {
+	r := &ring{points: make([]point, 0, len(nodes)*virtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hashKey([]byte(node + "#" + strconv.Itoa(i))), node: node})
+		}
+	}
+
+	// Positions of different nodes may collide; their node names keep the
+	// order the same on every node.
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+// owner returns the node that owns the swarm of infoHash.
+func (r *ring) owner(infoHash chihaya.InfoHash) string {
+	h := hashKey(infoHash[:])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// hashKey returns the position of key on the ring.
+//
+// Infohashes are hashed like the positions of the nodes, so that they are
+// spread evenly across the ring even if they are not uniformly distributed,
+// e.g. because they were made up by clients.
+func hashKey(key []byte) uint64 {
+	sum := sha1.Sum(key)
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"crypto/sha1"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+func infoHashes(n int) []chihaya.InfoHash {
+	hashes := make([]chihaya.InfoHash, n)
+	for i := range hashes {
+		hashes[i] = chihaya.InfoHash(sha1.Sum([]byte(strconv.Itoa(i))))
+	}
+	return hashes
+}
+
+func TestRing(t *testing.T) {
+	nodes := []string{"10.0.0.1:6882", "10.0.0.2:6882", "10.0.0.3:6882"}
+	r := newRing(nodes, 128)
+	reversed := newRing([]string{nodes[2], nodes[1], nodes[0]}, 128)
+
+	hashes := infoHashes(30000)
+	owned := make(map[string]int)
+	for _, hash := range hashes {
+		owner := r.owner(hash)
+		owned[owner]++
+
+		// All nodes agree on the owners, whatever their order.
+		require.Equal(t, owner, reversed.owner(hash))
+	}
+
+	// The swarms are spread roughly evenly.
+	for _, node := range nodes {
+		require.InDelta(t, len(hashes)/len(nodes), owned[node], float64(len(hashes)/len(nodes))/5, node)
+	}
+
+	// A new node only takes swarms over, the others keep theirs.
+	grown := newRing(append(nodes, "10.0.0.4:6882"), 128)
+	moved := 0
+	for _, hash := range hashes {
+		if owner := grown.owner(hash); owner != r.owner(hash) {
+			require.Equal(t, "10.0.0.4:6882", owner)
+			moved++
+		}
+	}
+	require.InDelta(t, len(hashes)/4, moved, float64(len(hashes)/4)/5)
+}
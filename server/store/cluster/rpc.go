@@ -0,0 +1,313 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// serviceName is the name the nodes of a cluster serve their swarms under.
+const serviceName = "PeerStore"
+
+// errStopped is returned by the calls a node receives after it was stopped.
+var errStopped = errors.New("cluster: node is stopped")
+
+// errNoMembership is returned by HasPeer if the local PeerStore of the owner
+// of a swarm can not tell whether a peer is stored in it.
+var errNoMembership = errors.New("cluster: local PeerStore does not implement store.SwarmMemberChecker")
+
+// PeerArgs are the arguments of the calls that add or remove a peer.
+type PeerArgs struct {
+	InfoHash chihaya.InfoHash
+	Peer     chihaya.Peer
+}
+
+// AnnounceArgs are the arguments of AnnouncePeers.
+type AnnounceArgs struct {
+	InfoHash chihaya.InfoHash
+	Seeder   bool
+	NumWant  int
+	Peer4    chihaya.Peer
+	Peer6    chihaya.Peer
+	Policy   store.FamilyPolicy
+}
+
+// PeersReply holds the peers of a swarm, by address family.
+type PeersReply struct {
+	Peers  []chihaya.Peer
+	Peers6 []chihaya.Peer
+}
+
+// StatsReply holds the reply of GetStats.
+type StatsReply struct {
+	Seeders    uint64
+	Leechers   uint64
+	Downloaded uint64
+}
+
+// MemberReply holds the reply of HasPeer.
+type MemberReply struct {
+	Seeder  bool
+	Leecher bool
+}
+
+// TotalsReply holds the totals of the swarms a node owns.
+type TotalsReply struct {
+	Swarms   uint64
+	Seeders  uint64
+	Leechers uint64
+}
+
+// service serves the swarms of the local PeerStore to the other nodes.
+//
+// Calls are held off while the node stops, so that none of them reaches the
+// local PeerStore after it was stopped.
+type service struct {
+	mu      sync.RWMutex
+	stopped bool
+	local   store.PeerStore
+}
+
+func (svc *service) do(f func() error) error {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	if svc.stopped {
+		return errStopped
+	}
+	return f()
+}
+
+// stop makes the service refuse all further calls, once the pending ones
+// returned.
+func (svc *service) stop() {
+	svc.mu.Lock()
+	svc.stopped = true
+	svc.mu.Unlock()
+}
+
+func (svc *service) PutSeeder(args *PeerArgs, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.PutSeeder(args.InfoHash, args.Peer) })
+}
+
+func (svc *service) DeleteSeeder(args *PeerArgs, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.DeleteSeeder(args.InfoHash, args.Peer) })
+}
+
+func (svc *service) PutLeecher(args *PeerArgs, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.PutLeecher(args.InfoHash, args.Peer) })
+}
+
+func (svc *service) DeleteLeecher(args *PeerArgs, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.DeleteLeecher(args.InfoHash, args.Peer) })
+}
+
+func (svc *service) GraduateLeecher(args *PeerArgs, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.GraduateLeecher(args.InfoHash, args.Peer) })
+}
+
+func (svc *service) AnnouncePeers(args *AnnounceArgs, reply *PeersReply) error {
+	return svc.do(func() (err error) {
+		reply.Peers, reply.Peers6, err = svc.local.AnnouncePeers(args.InfoHash, args.Seeder, args.NumWant, args.Peer4, args.Peer6, args.Policy)
+		return err
+	})
+}
+
+func (svc *service) GetSeeders(infoHash *chihaya.InfoHash, reply *PeersReply) error {
+	return svc.do(func() (err error) {
+		reply.Peers, reply.Peers6, err = svc.local.GetSeeders(*infoHash)
+		return err
+	})
+}
+
+func (svc *service) GetLeechers(infoHash *chihaya.InfoHash, reply *PeersReply) error {
+	return svc.do(func() (err error) {
+		reply.Peers, reply.Peers6, err = svc.local.GetLeechers(*infoHash)
+		return err
+	})
+}
+
+func (svc *service) NumSeeders(infoHash *chihaya.InfoHash, reply *int) error {
+	return svc.do(func() error {
+		*reply = svc.local.NumSeeders(*infoHash)
+		return nil
+	})
+}
+
+func (svc *service) NumLeechers(infoHash *chihaya.InfoHash, reply *int) error {
+	return svc.do(func() error {
+		*reply = svc.local.NumLeechers(*infoHash)
+		return nil
+	})
+}
+
+func (svc *service) IncrementDownloaded(infoHash *chihaya.InfoHash, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.IncrementDownloaded(*infoHash) })
+}
+
+func (svc *service) GetStats(infoHash *chihaya.InfoHash, reply *StatsReply) error {
+	return svc.do(func() (err error) {
+		reply.Seeders, reply.Leechers, reply.Downloaded, err = svc.local.GetStats(*infoHash)
+		return err
+	})
+}
+
+func (svc *service) HasPeer(args *PeerArgs, reply *MemberReply) error {
+	return svc.do(func() (err error) {
+		reply.Seeder, reply.Leecher, err = localHasPeer(svc.local, args.InfoHash, args.Peer)
+		return err
+	})
+}
+
+func (svc *service) CollectGarbage(cutoff *time.Time, _ *struct{}) error {
+	return svc.do(func() error { return svc.local.CollectGarbage(*cutoff) })
+}
+
+func (svc *service) Totals(_ *struct{}, reply *TotalsReply) error {
+	return svc.do(func() (err error) {
+		reply.Swarms, reply.Seeders, reply.Leechers, err = localTotals(svc.local)
+		return err
+	})
+}
+
+// localTotals returns the totals of the swarms of a local PeerStore.
+func localTotals(ps store.PeerStore) (swarms, seeders, leechers uint64, err error) {
+	if swarms, err = ps.NumSwarms(); err != nil {
+		return
+	}
+	if seeders, err = ps.NumTotalSeeders(); err != nil {
+		return
+	}
+	leechers, err = ps.NumTotalLeechers()
+	return
+}
+
+// localHasPeer asks a local PeerStore whether p is stored in the swarm of
+// infoHash.
+func localHasPeer(ps store.PeerStore, infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error) {
+	c, ok := ps.(store.SwarmMemberChecker)
+	if !ok {
+		return false, false, errNoMembership
+	}
+	return c.HasPeer(infoHash, p)
+}
+
+// node is a client of another node of the cluster.
+//
+// It keeps one connection to the node, which is shared by all calls and
+// dialed again once it broke.
+type node struct {
+	addr    string
+	secret  []byte
+	timeout time.Duration
+
+	mu     sync.Mutex
+	client *rpc.Client
+	closed bool
+}
+
+func newNode(addr string, secret []byte, timeout time.Duration) *node {
+	return &node{addr: addr, secret: secret, timeout: timeout}
+}
+
+// connect returns the client of the node, dialing it and running the
+// handshake if necessary.
+func (n *node) connect() (*rpc.Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil, errStopped
+	}
+	if n.client == nil {
+		conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err = dialHandshake(conn, n.secret, n.timeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		n.client = rpc.NewClient(conn)
+	}
+	return n.client, nil
+}
+
+// reset closes client, so that the next call dials the node again.
+func (n *node) reset(client *rpc.Client) {
+	n.mu.Lock()
+	if n.client == client {
+		n.client = nil
+	}
+	n.mu.Unlock()
+	client.Close()
+}
+
+// close closes the connection to the node and makes all further calls fail.
+func (n *node) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+	if n.client != nil {
+		n.client.Close()
+		n.client = nil
+	}
+}
+
+// call calls method of the node and waits for its reply until the timeout
+// of the node passes or ctx is done.
+//
+// Errors of the remote PeerStore are returned as they are, so that
+// store.ErrResourceDoesNotExist can be told apart from a node that can not be
+// reached.
+func (n *node) call(ctx context.Context, method string, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	client, err := n.connect()
+	if err == errStopped {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("cluster: node %s is unreachable: %s", n.addr, err)
+	}
+
+	timer := time.NewTimer(n.timeout)
+	defer timer.Stop()
+
+	call := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-timer.C:
+		// The node may be gone without the connection noticing, so the
+		// next call dials it again.
+		n.reset(client)
+		return fmt.Errorf("cluster: node %s did not reply within %s", n.addr, n.timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if serverErr, ok := call.Error.(rpc.ServerError); ok {
+		if string(serverErr) == store.ErrResourceDoesNotExist.Error() {
+			return store.ErrResourceDoesNotExist
+		}
+		return fmt.Errorf("cluster: node %s: %s", n.addr, serverErr)
+	}
+	if call.Error != nil {
+		n.reset(client)
+		return fmt.Errorf("cluster: node %s is unreachable: %s", n.addr, call.Error)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"context"
+	"net"
+
+	"github.com/chihaya/chihaya"
+)
+
+// ContextIPStore is implemented by IPStores whose lookups can be canceled
+// through the context of the request they are made for, e.g. because its
+// client went away.
+type ContextIPStore interface {
+	// HasAnyIPContext is like HasAnyIP, but returns the error of ctx if ctx
+	// is done before the lookup completes.
+	HasAnyIPContext(ctx context.Context, ips []net.IP) (bool, error)
+
+	// HasAllIPsContext is like HasAllIPs, but returns the error of ctx if
+	// ctx is done before the lookup completes.
+	HasAllIPsContext(ctx context.Context, ips []net.IP) (bool, error)
+}
+
+// ContextPeerStore is implemented by PeerStores whose peer selection can be
+// canceled through the context of the request it is made for.
+type ContextPeerStore interface {
+	// AnnouncePeersContext is like AnnouncePeers, but returns the error of
+	// ctx if ctx is done before the peers are selected.
+	AnnouncePeersContext(ctx context.Context, infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy FamilyPolicy) (peers, peers6 []chihaya.Peer, err error)
+}
+
+// HasAnyIP calls HasAnyIPContext if s is a ContextIPStore. Otherwise, the
+// error of ctx is returned if ctx is already done, and HasAnyIP is called if
+// it is not.
+func HasAnyIP(ctx context.Context, s IPStore, ips []net.IP) (bool, error) {
+	if cs, ok := s.(ContextIPStore); ok {
+		return cs.HasAnyIPContext(ctx, ips)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.HasAnyIP(ips)
+}
+
+// HasAllIPs calls HasAllIPsContext if s is a ContextIPStore. Otherwise, the
+// error of ctx is returned if ctx is already done, and HasAllIPs is called if
+// it is not.
+func HasAllIPs(ctx context.Context, s IPStore, ips []net.IP) (bool, error) {
+	if cs, ok := s.(ContextIPStore); ok {
+		return cs.HasAllIPsContext(ctx, ips)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.HasAllIPs(ips)
+}
+
+// AnnouncePeers calls AnnouncePeersContext if s is a ContextPeerStore.
+// Otherwise, the error of ctx is returned if ctx is already done, and
+// AnnouncePeers is called if it is not.
+//
+// Peers with the peer ID of the announcer are left out, so that it does not
+// get itself at an address it announced from before, e.g. in the other
+// address family or before its port changed.
+func AnnouncePeers(ctx context.Context, s PeerStore, infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	if cs, ok := s.(ContextPeerStore); ok {
+		peers, peers6, err = cs.AnnouncePeersContext(ctx, infoHash, seeder, numWant, peer4, peer6, policy)
+	} else if err = ctx.Err(); err == nil {
+		peers, peers6, err = s.AnnouncePeers(infoHash, seeder, numWant, peer4, peer6, policy)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return withoutAnnouncer(peers, peer4, peer6), withoutAnnouncer(peers6, peer4, peer6), nil
+}
+
+// withoutAnnouncer removes the peers with the peer IDs of peer4 and peer6 from
+// peers, in place.
+func withoutAnnouncer(peers []chihaya.Peer, peer4, peer6 chihaya.Peer) []chihaya.Peer {
+	kept := peers[:0]
+	for _, p := range peers {
+		if p.ID != peer4.ID && p.ID != peer6.ID {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// canceled reports whether err is the error of ctx, i.e. whether a store call
+// failed because ctx is done rather than because the store did.
+func canceled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && err == ctx.Err()
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	prometheus.MustRegister(storeErrorsTotal)
+}
+
+// FailurePolicy decides how a middleware handles requests it can not check
+// because its store returned an error, e.g. because the servers of a
+// networked driver are unreachable.
+type FailurePolicy string
+
+const (
+	// FailOpen makes a middleware handle requests as if they passed its
+	// check, i.e. allow them.
+	FailOpen = FailurePolicy("open")
+
+	// FailClosed makes a middleware reject requests with
+	// ErrStoreUnavailable.
+	FailClosed = FailurePolicy("closed")
+)
+
+var (
+	// ErrStoreUnavailable is returned by middleware with the FailClosed
+	// policy if its store failed.
+	ErrStoreUnavailable = tracker.ClientError("tracker storage unavailable")
+
+	// ErrUnknownFailurePolicy is returned by ParseFailurePolicy if the
+	// policy specified in the configuration is unknown.
+	ErrUnknownFailurePolicy = errors.New("unknown store failure policy")
+)
+
+var storeErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "chihaya",
+	Subsystem: "store",
+	Name:      "errors_total",
+	Help:      "The number of store errors middleware encountered, by middleware and failure policy.",
+}, []string{"middleware", "policy"})
+
+// ParseFailurePolicy returns the policy configured by the on_store_error
+// option of a MiddlewareConfig, or def if the option is not set.
+//
+// ErrUnknownFailurePolicy is returned if the option is neither open nor
+// closed.
+func ParseFailurePolicy(mwcfg chihaya.MiddlewareConfig, def FailurePolicy) (FailurePolicy, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return "", err
+	}
+
+	var cfg struct {
+		OnStoreError FailurePolicy `yaml:"on_store_error"`
+	}
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return "", err
+	}
+
+	switch cfg.OnStoreError {
+	case "":
+		return def, nil
+	case FailOpen, FailClosed:
+		return cfg.OnStoreError, nil
+	}
+	return "", ErrUnknownFailurePolicy
+}
+
+// HandleError applies the policy to err, an error returned by the store of
+// the named middleware while it handled the request of ctx.
+//
+// The error is logged and counted. HandleError returns nil if the middleware
+// should continue as if its check passed, and ErrStoreUnavailable if it
+// should reject the request.
+//
+// If err is the error of ctx, the request was canceled rather than the store
+// failing, so err is returned as is, regardless of the policy.
+func (p FailurePolicy) HandleError(ctx context.Context, middleware string, err error) error {
+	if canceled(ctx, err) {
+		log.DebugContext(ctx, "request canceled during store call", "middleware", middleware, "error", err)
+		return err
+	}
+
+	storeErrorsTotal.WithLabelValues(middleware, string(p)).Inc()
+
+	if p == FailOpen {
+		log.WarnContext(ctx, "store failed, allowing request", "middleware", middleware, "error", err)
+		return nil
+	}
+	log.ErrorContext(ctx, "store failed, rejecting request", "middleware", middleware, "error", err)
+	return ErrStoreUnavailable
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+func TestParseFailurePolicy(t *testing.T) {
+	var table = []struct {
+		config   interface{}
+		def      FailurePolicy
+		expected FailurePolicy
+		err      error
+	}{
+		{nil, FailOpen, FailOpen, nil},
+		{nil, FailClosed, FailClosed, nil},
+		{map[string]interface{}{"mode": "allow"}, FailClosed, FailClosed, nil},
+		{map[string]interface{}{"on_store_error": "open"}, FailClosed, FailOpen, nil},
+		{map[string]interface{}{"on_store_error": "closed"}, FailOpen, FailClosed, nil},
+		{map[string]interface{}{"on_store_error": "retry"}, FailOpen, "", ErrUnknownFailurePolicy},
+	}
+
+	for _, tt := range table {
+		policy, err := ParseFailurePolicy(chihaya.MiddlewareConfig{Name: "test", Config: tt.config}, tt.def)
+		require.Equal(t, tt.err, err, "%v", tt.config)
+		require.Equal(t, tt.expected, policy, "%v", tt.config)
+	}
+}
+
+func storeErrors(t *testing.T, policy FailurePolicy) float64 {
+	var m dto.Metric
+	require.Nil(t, storeErrorsTotal.WithLabelValues("test", string(policy)).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestHandleError(t *testing.T) {
+	opened, closed := storeErrors(t, FailOpen), storeErrors(t, FailClosed)
+	storeErr := errors.New("store failed")
+
+	require.Nil(t, FailOpen.HandleError(context.Background(), "test", storeErr))
+	require.Equal(t, opened+1, storeErrors(t, FailOpen))
+
+	require.Equal(t, ErrStoreUnavailable, FailClosed.HandleError(context.Background(), "test", storeErr))
+	require.Equal(t, closed+1, storeErrors(t, FailClosed))
+}
+
+func TestHandleErrorCanceled(t *testing.T) {
+	opened, closed := storeErrors(t, FailOpen), storeErrors(t, FailClosed)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.Equal(t, context.Canceled, FailOpen.HandleError(ctx, "test", ctx.Err()))
+	require.Equal(t, context.Canceled, FailClosed.HandleError(ctx, "test", ctx.Err()))
+	require.Equal(t, opened, storeErrors(t, FailOpen))
+	require.Equal(t, closed, storeErrors(t, FailClosed))
+
+	// Other errors are handled by the policy even once ctx is done.
+	require.Equal(t, ErrStoreUnavailable, FailClosed.HandleError(ctx, "test", errors.New("store failed")))
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// The files of a MaxMind GeoLite2 Country CSV database that are used by
+// LoadGeoNetworks.
+const (
+	geoLocationsFile  = "GeoLite2-Country-Locations-en.csv"
+	geoBlocksIPv4File = "GeoLite2-Country-Blocks-IPv4.csv"
+	geoBlocksIPv6File = "GeoLite2-Country-Blocks-IPv6.csv"
+)
+
+// geoBatchSize is the number of networks LoadGeoNetworks passes to a single
+// call of AddNetworks.
+const geoBatchSize = 1024
+
+// ErrNoGeoBlocks is returned by LoadGeoNetworks if the database contains
+// neither IPv4 nor IPv6 networks.
+var ErrNoGeoBlocks = errors.New("store: GeoIP database contains no network blocks")
+
+// LoadGeoNetworks adds the networks of the given countries to an IPStore.
+//
+// dbPath is the directory of an extracted MaxMind GeoLite2 Country CSV
+// database. Countries are given as ISO 3166-1 alpha-2 codes and are matched
+// case-insensitively. A network belongs to the country it is located in or,
+// if that is unknown, to the country it is registered in.
+//
+// Malformed rows are skipped and counted in a warning that is logged once
+// loading has finished.
+// The number of networks added to the IPStore is returned, even if an error
+// occurred.
+func LoadGeoNetworks(ips IPStore, dbPath string, countries []string) (added int, err error) {
+	wanted := make(map[string]bool)
+	for _, country := range countries {
+		wanted[strings.ToUpper(strings.TrimSpace(country))] = true
+	}
+
+	var skipped int
+	defer func() {
+		if skipped > 0 {
+			log.Warn("store: skipped malformed rows of GeoIP database", "path", dbPath, "rows", skipped)
+		}
+	}()
+
+	geonames, skippedLocations, err := readGeoLocations(filepath.Join(dbPath, geoLocationsFile), wanted)
+	skipped += skippedLocations
+	if err != nil {
+		return 0, err
+	}
+
+	var found bool
+	for _, name := range []string{geoBlocksIPv4File, geoBlocksIPv6File} {
+		f, err := os.Open(filepath.Join(dbPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return added, err
+		}
+		found = true
+
+		n, skippedBlocks, err := loadGeoBlocks(ips, f, geonames)
+		f.Close()
+		added += n
+		skipped += skippedBlocks
+		if err != nil {
+			return added, err
+		}
+	}
+
+	if !found {
+		return 0, ErrNoGeoBlocks
+	}
+
+	return added, nil
+}
+
+// geoCSV is a CSV file of a GeoLite2 database, which starts with a header
+// naming its columns.
+type geoCSV struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newGeoCSV(r io.Reader, columns ...string) (*geoCSV, error) {
+	c := &geoCSV{
+		r:       csv.NewReader(r),
+		columns: make(map[string]int),
+	}
+	c.r.FieldsPerRecord = -1
+
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("store: reading GeoIP CSV header: %s", err)
+	}
+	for i, column := range header {
+		c.columns[column] = i
+	}
+
+	for _, column := range columns {
+		if _, ok := c.columns[column]; !ok {
+			return nil, fmt.Errorf("store: GeoIP CSV has no column %q", column)
+		}
+	}
+
+	return c, nil
+}
+
+// next reads the next row and returns the values of the given columns.
+//
+// malformed is true if the row could not be parsed or is missing any of the
+// columns. io.EOF is returned after the last row.
+func (c *geoCSV) next(columns ...string) (values []string, malformed bool, err error) {
+	row, err := c.r.Read()
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	values = make([]string, len(columns))
+	for i, column := range columns {
+		index := c.columns[column]
+		if index >= len(row) {
+			return nil, true, nil
+		}
+		values[i] = row[index]
+	}
+
+	return values, false, nil
+}
+
+// readGeoLocations returns the set of geoname IDs of the given countries.
+func readGeoLocations(path string, countries map[string]bool) (geonames map[string]bool, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	c, err := newGeoCSV(f, "geoname_id", "country_iso_code")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	geonames = make(map[string]bool)
+	for {
+		values, malformed, err := c.next("geoname_id", "country_iso_code")
+		if err == io.EOF {
+			return geonames, skipped, nil
+		}
+		if err != nil {
+			return nil, skipped, err
+		}
+		if malformed {
+			skipped++
+			continue
+		}
+
+		if countries[strings.ToUpper(values[1])] {
+			geonames[values[0]] = true
+		}
+	}
+}
+
+// loadGeoBlocks adds the networks of a GeoLite2 blocks file that belong to
+// any of the given geoname IDs to an IPStore.
+func loadGeoBlocks(ips IPStore, r io.Reader, geonames map[string]bool) (added, skipped int, err error) {
+	columns := []string{"network", "geoname_id", "registered_country_geoname_id"}
+	c, err := newGeoCSV(r, columns...)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	batch := make([]string, 0, geoBatchSize)
+	flush := func() error {
+		err := ips.AddNetworks(batch)
+		if err != nil {
+			return err
+		}
+		added += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		values, malformed, err := c.next(columns...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return added, skipped, err
+		}
+		if malformed {
+			skipped++
+			continue
+		}
+
+		geoname := values[1]
+		if geoname == "" {
+			geoname = values[2]
+		}
+		if !geonames[geoname] {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(values[0]); err != nil {
+			skipped++
+			continue
+		}
+
+		batch = append(batch, values[0])
+		if len(batch) == geoBatchSize {
+			if err := flush(); err != nil {
+				return added, skipped, err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		err = flush()
+	}
+	return added, skipped, err
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+func TestLoadGeoNetworks(t *testing.T) {
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	added, err := store.LoadGeoNetworks(ips, "testdata/geolite2", []string{"DE", "fr"})
+	require.Nil(t, err)
+	require.Equal(t, 5, added)
+
+	numNetworks, err := ips.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), numNetworks)
+
+	var table = []struct {
+		ip       string
+		included bool
+	}{
+		{"192.0.2.1", true},         // DE
+		{"192.0.2.129", true},       // FR
+		{"203.0.113.1", true},       // registered in FR
+		{"2001:db8:de::1", true},    // DE
+		{"2001:db8:f7::1", true},    // FR
+		{"198.51.100.1", false},     // US
+		{"203.0.113.65", false},     // no country
+		{"203.0.113.129", false},    // malformed row
+		{"2001:db8:5::1", false},    // US
+		{"2001:db8:ffff::1", false}, // not in the database
+		{"10.154.243.22", false},    // not in the database
+	}
+	for _, tt := range table {
+		match, err := ips.HasIP(net.ParseIP(tt.ip))
+		require.Nil(t, err)
+		require.Equal(t, tt.included, match, tt.ip)
+	}
+
+	require.Nil(t, <-ips.Stop())
+}
+
+func TestLoadGeoNetworksMissingBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-geoip")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	// The locations file is required.
+	_, err = store.LoadGeoNetworks(ips, dir, []string{"DE"})
+	require.NotNil(t, err)
+
+	locations, err := ioutil.ReadFile("testdata/geolite2/GeoLite2-Country-Locations-en.csv")
+	require.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "GeoLite2-Country-Locations-en.csv"), locations, 0644)
+	require.Nil(t, err)
+
+	_, err = store.LoadGeoNetworks(ips, dir, []string{"DE"})
+	require.Equal(t, store.ErrNoGeoBlocks, err)
+
+	require.Nil(t, <-ips.Stop())
+}
@@ -0,0 +1,40 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"net"
+)
+
+// The values the drivers are probed with by Check. The IP is from TEST-NET-1
+// of RFC 5737, which are not stored in practice.
+var (
+	probeIP     = net.IPv4(192, 0, 2, 1)
+	probeString = "chihaya_readiness_probe"
+)
+
+// Check makes a lightweight lookup on each of the drivers of s and returns
+// the errors of the ones that failed by the names of their stores, i.e.
+// "peer_store", "ip_store" and "string_store". An empty map means that all
+// of them are reachable.
+func (s *Store) Check() map[string]error {
+	failed := make(map[string]error)
+	if s.PeerStore != nil {
+		if _, err := s.PeerStore.NumSwarms(); err != nil {
+			failed["peer_store"] = err
+		}
+	}
+	if s.IPStore != nil {
+		if _, err := s.IPStore.HasIP(probeIP); err != nil {
+			failed["ip_store"] = err
+		}
+	}
+	if s.StringStore != nil {
+		if _, err := s.StringStore.HasString(probeString); err != nil {
+			failed["string_store"] = err
+		}
+	}
+	return failed
+}
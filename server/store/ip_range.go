@@ -0,0 +1,187 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+)
+
+var (
+	// ErrInvalidIPRange is returned for IP ranges whose start or end is not
+	// a valid IP address.
+	ErrInvalidIPRange = errors.New("invalid IP range")
+
+	// ErrIPRangeReversed is returned for IP ranges whose start comes after
+	// their end.
+	ErrIPRangeReversed = errors.New("start of IP range is after its end")
+
+	// ErrIPRangeMixedFamilies is returned for IP ranges whose start and end
+	// are of different address families.
+	ErrIPRangeMixedFamilies = errors.New("IP range spans address families")
+)
+
+// IPRangeNetworks returns the smallest set of networks in CIDR notation that
+// together contain exactly the addresses from start to end, inclusive, in
+// ascending order.
+//
+// IPv4 ranges result in IPv4 networks, regardless of the form their
+// addresses are given in.
+func IPRangeNetworks(start, end net.IP) ([]string, error) {
+	width := 8 * net.IPv6len
+	first, last := start.To16(), end.To16()
+	if first == nil || last == nil {
+		return nil, ErrInvalidIPRange
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, ErrIPRangeMixedFamilies
+	}
+	if start.To4() != nil {
+		width = 8 * net.IPv4len
+	}
+
+	lo, hi := fromIP(first), fromIP(last)
+	if hi.less(lo) {
+		return nil, ErrIPRangeReversed
+	}
+
+	var networks []string
+	for {
+		// The largest network starting at lo is limited by the alignment of
+		// lo and must not extend past hi.
+		size := lo.trailingZeros()
+		if size > width {
+			size = width
+		}
+		for size > 0 && hi.less(lo.or(hostMask(size))) {
+			size--
+		}
+
+		ipnet := net.IPNet{
+			IP:   lo.ip(),
+			Mask: net.CIDRMask(width-size, width),
+		}
+		if width == 8*net.IPv4len {
+			ipnet.IP = ipnet.IP.To4()
+		}
+		networks = append(networks, ipnet.String())
+
+		top := lo.or(hostMask(size))
+		if top == hi {
+			return networks, nil
+		}
+		lo = top.inc()
+	}
+}
+
+// ExcludeNetwork returns the smallest set of networks that together contain
+// exactly the addresses of network that are not contained in hole, and
+// whether network and hole overlap at all.
+//
+// If they do not overlap, network is returned as the only remaining network.
+// If hole contains network, no networks remain. Otherwise, network is split
+// into one network per prefix length between the ones of network and hole.
+// IPv4 networks are returned in their 4-byte form and are found to overlap
+// with IPv6 networks that contain them, like ::/0.
+func ExcludeNetwork(network, hole *net.IPNet) (remaining []*net.IPNet, overlap bool) {
+	netIP, netOnes := ipv6Form(network)
+	holeIP, holeOnes := ipv6Form(hole)
+
+	if holeOnes <= netOnes {
+		if !holeIP.Equal(netIP.Mask(net.CIDRMask(holeOnes, 8*net.IPv6len))) {
+			return []*net.IPNet{network}, false
+		}
+		return nil, true
+	}
+
+	if !netIP.Equal(holeIP.Mask(net.CIDRMask(netOnes, 8*net.IPv6len))) {
+		return []*net.IPNet{network}, false
+	}
+
+	// The addresses that remain are the siblings of the networks on the way
+	// from network down to hole.
+	remaining = make([]*net.IPNet, 0, holeOnes-netOnes)
+	for ones := netOnes + 1; ones <= holeOnes; ones++ {
+		mask := net.CIDRMask(ones, 8*net.IPv6len)
+		sibling := fromIP(holeIP.Mask(mask)).flip(ones - 1)
+		remaining = append(remaining, normalizeNetwork(&net.IPNet{IP: sibling.ip(), Mask: mask}))
+	}
+	return remaining, true
+}
+
+// ipv6Form returns the first address of ipnet in its 16-byte form and its
+// prefix length in IPv6 notation.
+func ipv6Form(ipnet *net.IPNet) (net.IP, int) {
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96
+	}
+	return ipnet.IP.To16().Mask(net.CIDRMask(ones, 8*net.IPv6len)), ones
+}
+
+// uint128 is an IPv6 address as a 128-bit unsigned integer.
+type uint128 struct {
+	hi, lo uint64
+}
+
+func fromIP(ip net.IP) uint128 {
+	return uint128{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (u uint128) ip() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
+
+// hostMask returns a uint128 with the lowest n bits set.
+func hostMask(n int) uint128 {
+	switch {
+	case n >= 128:
+		return uint128{^uint64(0), ^uint64(0)}
+	case n >= 64:
+		return uint128{^uint64(0) >> uint(128-n), ^uint64(0)}
+	case n > 0:
+		return uint128{0, ^uint64(0) >> uint(64-n)}
+	}
+	return uint128{}
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || u.hi == v.hi && u.lo < v.lo
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+// flip returns u with the bit at index i, counted from the most significant
+// bit, inverted.
+func (u uint128) flip(i int) uint128 {
+	if i < 64 {
+		u.hi ^= 1 << uint(63-i)
+	} else {
+		u.lo ^= 1 << uint(127-i)
+	}
+	return u
+}
+
+// inc returns u+1. It must not be called for the largest uint128.
+func (u uint128) inc() uint128 {
+	if u.lo == ^uint64(0) {
+		return uint128{u.hi + 1, 0}
+	}
+	return uint128{u.hi, u.lo + 1}
+}
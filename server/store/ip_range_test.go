@@ -0,0 +1,151 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestIPRangeNetworks(t *testing.T) {
+	var table = []struct {
+		start, end string
+		expected   []string
+		err        error
+	}{
+		{"1.2.3.4", "1.2.3.4", []string{"1.2.3.4/32"}, nil},
+		{"1.2.3.0", "1.2.3.255", []string{"1.2.3.0/24"}, nil},
+		{"1.2.3.0", "1.2.7.255", []string{"1.2.3.0/24", "1.2.4.0/22"}, nil},
+		{"1.2.3.5", "1.2.3.17", []string{"1.2.3.5/32", "1.2.3.6/31", "1.2.3.8/29", "1.2.3.16/31"}, nil},
+		{"::ffff:10.0.0.1", "10.0.0.2", []string{"10.0.0.1/32", "10.0.0.2/32"}, nil},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}, nil},
+		{"255.255.255.254", "255.255.255.255", []string{"255.255.255.254/31"}, nil},
+		{"0.0.0.1", "255.255.255.254", []string{
+			"0.0.0.1/32", "0.0.0.2/31", "0.0.0.4/30", "0.0.0.8/29", "0.0.0.16/28",
+			"0.0.0.32/27", "0.0.0.64/26", "0.0.0.128/25", "0.0.1.0/24", "0.0.2.0/23",
+			"0.0.4.0/22", "0.0.8.0/21", "0.0.16.0/20", "0.0.32.0/19", "0.0.64.0/18",
+			"0.0.128.0/17", "0.1.0.0/16", "0.2.0.0/15", "0.4.0.0/14", "0.8.0.0/13",
+			"0.16.0.0/12", "0.32.0.0/11", "0.64.0.0/10", "0.128.0.0/9", "1.0.0.0/8",
+			"2.0.0.0/7", "4.0.0.0/6", "8.0.0.0/5", "16.0.0.0/4", "32.0.0.0/3",
+			"64.0.0.0/2", "128.0.0.0/2", "192.0.0.0/3", "224.0.0.0/4", "240.0.0.0/5",
+			"248.0.0.0/6", "252.0.0.0/7", "254.0.0.0/8", "255.0.0.0/9", "255.128.0.0/10",
+			"255.192.0.0/11", "255.224.0.0/12", "255.240.0.0/13", "255.248.0.0/14", "255.252.0.0/15",
+			"255.254.0.0/16", "255.255.0.0/17", "255.255.128.0/18", "255.255.192.0/19", "255.255.224.0/20",
+			"255.255.240.0/21", "255.255.248.0/22", "255.255.252.0/23", "255.255.254.0/24", "255.255.255.0/25",
+			"255.255.255.128/26", "255.255.255.192/27", "255.255.255.224/28", "255.255.255.240/29", "255.255.255.248/30",
+			"255.255.255.252/31", "255.255.255.254/32",
+		}, nil},
+		{"fd00::", "fd00::1:ffff", []string{"fd00::/111"}, nil},
+		{"fd00::ffff", "fd00::1:0", []string{"fd00::ffff/128", "fd00::1:0/128"}, nil},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}, nil},
+		{"::", "7fff:ffff:ffff:ffff:ffff:ffff:ffff:fffe", nil, nil},
+		{"1.2.3.4", "1.2.3.3", nil, store.ErrIPRangeReversed},
+		{"1.2.3.4", "fd00::1", nil, store.ErrIPRangeMixedFamilies},
+		{"fd00::1", "1.2.3.4", nil, store.ErrIPRangeMixedFamilies},
+	}
+
+	for _, tt := range table {
+		networks, err := store.IPRangeNetworks(net.ParseIP(tt.start), net.ParseIP(tt.end))
+		require.Equal(t, tt.err, err, "%s-%s", tt.start, tt.end)
+		if err != nil || tt.expected == nil {
+			continue
+		}
+		require.Equal(t, tt.expected, networks, "%s-%s", tt.start, tt.end)
+	}
+
+	_, err := store.IPRangeNetworks(nil, net.ParseIP("1.2.3.4"))
+	require.Equal(t, store.ErrInvalidIPRange, err)
+}
+
+// TestIPRangeNetworksCover checks that the networks of ranges cover them
+// exactly, without overlapping each other.
+func TestIPRangeNetworksCover(t *testing.T) {
+	var table = [][2]string{
+		{"::", "7fff:ffff:ffff:ffff:ffff:ffff:ffff:fffe"},
+		{"fd00::3", "fd00:0:0:1::"},
+		{"10.0.3.7", "10.0.9.1"},
+	}
+
+	for _, tt := range table {
+		start, end := net.ParseIP(tt[0]), net.ParseIP(tt[1])
+		networks, err := store.IPRangeNetworks(start, end)
+		require.Nil(t, err)
+
+		next := start.To16()
+		for i, network := range networks {
+			_, ipnet, err := net.ParseCIDR(network)
+			require.Nil(t, err)
+			require.True(t, ipnet.IP.To16().Equal(next), "%s does not start at %s", network, next)
+
+			last := lastIP(ipnet)
+			if i == len(networks)-1 {
+				require.True(t, last.Equal(end), "%s does not end at %s", network, end)
+				break
+			}
+			next = increment(last)
+		}
+	}
+}
+
+func lastIP(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.IP))
+	for i := range ip {
+		ip[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	return ip.To16()
+}
+
+func increment(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func TestExcludeNetwork(t *testing.T) {
+	var table = []struct {
+		network, hole string
+		remaining     []string
+		overlap       bool
+	}{
+		{"10.0.0.0/16", "10.0.5.0/24", []string{
+			"10.0.128.0/17", "10.0.64.0/18", "10.0.32.0/19", "10.0.16.0/20",
+			"10.0.8.0/21", "10.0.0.0/22", "10.0.6.0/23", "10.0.4.0/24",
+		}, true},
+		{"10.0.0.0/16", "10.0.0.0/16", nil, true},
+		{"10.0.0.0/16", "10.0.0.0/8", nil, true},
+		{"10.0.0.0/16", "10.1.0.0/24", []string{"10.0.0.0/16"}, false},
+		{"10.0.0.0/16", "11.0.0.0/8", []string{"10.0.0.0/16"}, false},
+		{"10.0.0.0/31", "10.0.0.1/32", []string{"10.0.0.0/32"}, true},
+		{"10.0.0.0/8", "::/0", nil, true},
+		{"fd00::/16", "10.0.0.0/8", []string{"fd00::/16"}, false},
+		{"fd00::/126", "fd00::2/128", []string{"fd00::/127", "fd00::3/128"}, true},
+	}
+
+	for _, tt := range table {
+		_, network, err := net.ParseCIDR(tt.network)
+		require.Nil(t, err)
+		_, hole, err := net.ParseCIDR(tt.hole)
+		require.Nil(t, err)
+
+		remaining, overlap := store.ExcludeNetwork(network, hole)
+		require.Equal(t, tt.overlap, overlap, "%s without %s", tt.network, tt.hole)
+
+		var networks []string
+		for _, ipnet := range remaining {
+			networks = append(networks, ipnet.String())
+		}
+		require.Equal(t, tt.remaining, networks, "%s without %s", tt.network, tt.hole)
+	}
+}
@@ -5,13 +5,25 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/chihaya/chihaya/pkg/stopper"
 )
 
-var ipStoreDrivers = make(map[string]IPStoreDriver)
+var (
+	ipStoreDriversMu sync.RWMutex
+	ipStoreDrivers   = make(map[string]IPStoreDriver)
+)
+
+// ErrBatchDone is the error returned by the methods of an IPBatch that has
+// already been committed or rolled back.
+var ErrBatchDone = errors.New("batch already committed or rolled back")
 
 // IPStore represents an interface for manipulating IPs and IP ranges.
 type IPStore interface {
@@ -22,18 +34,69 @@ type IPStore interface {
 	// notation, to the IPStore.
 	AddNetwork(network string) error
 
+	// AddIPWithExpiry adds a single IP address to the IPStore, which is
+	// removed once the given time has passed.
+	//
+	// Adding an address that is already contained in the IPStore replaces
+	// its expiry, i.e. AddIP makes a previously expiring address permanent.
+	AddIPWithExpiry(ip net.IP, expires time.Time) error
+
+	// AddNetworkWithExpiry adds a range of IP addresses, denoted by a
+	// network in CIDR notation, to the IPStore, which is removed once the
+	// given time has passed.
+	//
+	// Adding a network that is already contained in the IPStore replaces
+	// its expiry, i.e. AddNetwork makes a previously expiring network
+	// permanent.
+	AddNetworkWithExpiry(network string, expires time.Time) error
+
+	// AddNetworks adds multiple ranges of IP addresses, denoted by networks
+	// in CIDR notation, to the IPStore.
+	//
+	// All networks are parsed before any of them are added. If any of them
+	// is malformed, an InvalidNetworkError naming the first malformed
+	// network is returned and the IPStore is left unchanged.
+	AddNetworks(networks []string) error
+
+	// AddIPRange adds the range of IP addresses from start to end,
+	// inclusive, to the IPStore as the networks IPRangeNetworks returns
+	// for it.
+	//
+	// ErrIPRangeReversed is returned if start comes after end,
+	// ErrIPRangeMixedFamilies if they are of different address families.
+	AddIPRange(start, end net.IP) error
+
 	// HasIP returns whether the given IP address is contained in the IPStore
 	// or belongs to any of the stored networks.
 	HasIP(ip net.IP) (bool, error)
 
 	// HasAnyIP returns whether any of the given IP addresses are contained
 	// in the IPStore or belongs to any of the stored networks.
+	//
+	// The addresses are first looked up as individual IPs, in the given
+	// order, and only then searched for in the stored networks, again in
+	// the given order. HasAnyIP returns true at the first match, without
+	// looking up the remaining addresses.
 	HasAnyIP(ips []net.IP) (bool, error)
 
-	// HassAllIPs returns whether all of the given IP addresses are
+	// HasAllIPs returns whether all of the given IP addresses are
 	// contained in the IPStore or belongs to any of the stored networks.
+	//
+	// The addresses are checked in the given order. Each one is looked up as
+	// an individual IP first and only searched for in the stored networks if
+	// it is not stored individually. HasAllIPs returns false at the first
+	// address that is not contained, without checking the remaining ones.
 	HasAllIPs(ips []net.IP) (bool, error)
 
+	// HasNetwork returns whether every address of the given network in CIDR
+	// notation is contained in the IPStore, either as an individual IP or as
+	// part of a network.
+	//
+	// For a network containing a single address, HasNetwork behaves like
+	// HasIP for that address.
+	// An error is returned if the network could not be parsed.
+	HasNetwork(network string) (bool, error)
+
 	// RemoveIP removes a single IP address from the IPStore.
 	//
 	// This wil not remove the given address from any networks it belongs to
@@ -55,6 +118,74 @@ type IPStore interface {
 	// contained in the store.
 	RemoveNetwork(network string) error
 
+	// RemoveIPRange removes a range of IP addresses that was previously
+	// added through AddIPRange, by removing the networks IPRangeNetworks
+	// returns for it.
+	//
+	// Returns ErrResourceDoesNotExist and leaves the IPStore unchanged if
+	// any of the networks is not contained in the store.
+	RemoveIPRange(start, end net.IP) error
+
+	// CarveNetwork removes the addresses of a network in CIDR notation from
+	// the networks stored in the IPStore.
+	//
+	// Every stored network that contains the given network, including the
+	// network itself, is replaced by the networks ExcludeNetwork returns
+	// for it, which keep its expiry. Stored networks within the given
+	// network are removed. Individual IPs are not affected.
+	//
+	// Returns ErrResourceDoesNotExist if the network does not overlap with
+	// any stored network.
+	// An error is returned if the network could not be parsed.
+	CarveNetwork(network string) error
+
+	// ReplaceAll replaces the contents of the IPStore with the given IP
+	// addresses and networks in CIDR notation, none of which expire.
+	//
+	// The contents are replaced atomically: lookups see either all of the
+	// previous contents or all of the new ones, never a mix of both.
+	// All networks are parsed before anything is replaced. If any of them
+	// is malformed, an InvalidNetworkError naming the first malformed
+	// network is returned and the IPStore is left unchanged.
+	ReplaceAll(ips []net.IP, networks []string) error
+
+	// NumIPs returns the number of individual IP addresses contained in the
+	// IPStore.
+	//
+	// Addresses that have expired but were not yet removed by the IPStore
+	// may still be counted.
+	NumIPs() (uint64, error)
+
+	// NumNetworks returns the number of networks contained in the IPStore.
+	//
+	// Networks that have expired but were not yet removed by the IPStore
+	// may still be counted.
+	NumNetworks() (uint64, error)
+
+	// RangeIPs calls fn for every individual IP address contained in the
+	// IPStore, in no particular order. Iteration stops as soon as fn
+	// returns false.
+	//
+	// IPv4 addresses are always passed to fn in their 4-byte form,
+	// regardless of the form they were added in.
+	//
+	// fn must not call any methods of the IPStore it was passed to.
+	RangeIPs(fn func(ip net.IP) bool) error
+
+	// RangeNetworks calls fn for every network contained in the IPStore, in
+	// no particular order. Iteration stops as soon as fn returns false.
+	//
+	// The networks passed to fn are normalized, i.e. the network
+	// 192.168.22.255/24 is passed as 192.168.22.0/24. IPv4 networks are
+	// always passed in their 4-byte form.
+	//
+	// fn must not call any methods of the IPStore it was passed to.
+	RangeNetworks(fn func(network *net.IPNet) bool) error
+
+	// Batch returns a new IPBatch, which collects modifications of the
+	// IPStore that are applied atomically when it is committed.
+	Batch() IPBatch
+
 	// Stopper provides the Stop method that stops the IPStore.
 	// Stop should shut down the IPStore in a separate goroutine and send
 	// an error to the channel if the shutdown failed. If the shutdown
@@ -62,6 +193,76 @@ type IPStore interface {
 	stopper.Stopper
 }
 
+// IPBatch represents a set of modifications of an IPStore, which become
+// visible all at once when the IPBatch is committed.
+//
+// The error checks of RemoveIP and RemoveNetwork are done when they are
+// called, taking both the IPStore and the modifications collected so far
+// into account. An error returned by any method does not affect the
+// modifications collected before it.
+//
+// An IPBatch is not safe for concurrent use.
+type IPBatch interface {
+	// AddIP adds a single IP address to the IPBatch.
+	AddIP(ip net.IP) error
+
+	// AddNetwork adds a range of IP addresses, denoted by a network in CIDR
+	// notation, to the IPBatch.
+	AddNetwork(network string) error
+
+	// RemoveIP removes a single IP address when the IPBatch is committed.
+	//
+	// Returns ErrResourceDoesNotExist if the given IP address is neither
+	// contained in the store nor added by the IPBatch.
+	RemoveIP(ip net.IP) error
+
+	// RemoveNetwork removes a range of IP addresses that was previously
+	// added as a network when the IPBatch is committed.
+	//
+	// Returns ErrResourceDoesNotExist if the given network is neither
+	// contained in the store nor added by the IPBatch.
+	RemoveNetwork(network string) error
+
+	// Commit applies all modifications collected by the IPBatch at once.
+	Commit() error
+
+	// Rollback discards all modifications collected by the IPBatch.
+	Rollback() error
+}
+
+// IPStoreSnapshotter is implemented by IPStores that can serialize their
+// contents, for example to persist them across restarts.
+type IPStoreSnapshotter interface {
+	// Snapshot writes all IPs and networks contained in the IPStore,
+	// including their expiries, to w.
+	Snapshot(w io.Writer) error
+
+	// Restore replaces the contents of the IPStore with a snapshot read
+	// from r.
+	//
+	// If the snapshot is malformed, an error is returned and the IPStore
+	// is left unchanged.
+	Restore(r io.Reader) error
+}
+
+// InvalidNetworkError is returned by AddNetworks if one of the given networks
+// could not be parsed.
+type InvalidNetworkError struct {
+	// Index is the position of the malformed network in the given slice.
+	Index int
+
+	// Network is the malformed network.
+	Network string
+
+	// Err is the error returned while parsing the network.
+	Err error
+}
+
+// Error implements the error interface for InvalidNetworkError.
+func (e InvalidNetworkError) Error() string {
+	return fmt.Sprintf("store: invalid network %q at index %d: %s", e.Network, e.Index, e.Err)
+}
+
 // IPStoreDriver represents an interface for creating a handle to the
 // storage of IPs.
 type IPStoreDriver interface {
@@ -76,6 +277,9 @@ func RegisterIPStoreDriver(name string, driver IPStoreDriver) {
 	if driver == nil {
 		panic("store: could not register nil IPStoreDriver")
 	}
+
+	ipStoreDriversMu.Lock()
+	defer ipStoreDriversMu.Unlock()
 	if _, dup := ipStoreDrivers[name]; dup {
 		panic("store: could not register duplicate IPStoreDriver: " + name)
 	}
@@ -84,10 +288,21 @@ func RegisterIPStoreDriver(name string, driver IPStoreDriver) {
 
 // OpenIPStore returns an IPStore specified by a configuration.
 func OpenIPStore(cfg *DriverConfig) (IPStore, error) {
+	ipStoreDriversMu.RLock()
 	driver, ok := ipStoreDrivers[cfg.Name]
+	ipStoreDriversMu.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("store: unknown IPStoreDriver %q (forgotten import?)", cfg)
+		return nil, fmt.Errorf("store: unknown IPStoreDriver %q (forgotten import?), registered: %s", cfg.Name, strings.Join(RegisteredIPStoreDrivers(), ", "))
 	}
 
 	return driver.New(cfg)
 }
+
+// RegisteredIPStoreDrivers returns the sorted names of the registered
+// IPStoreDrivers.
+func RegisteredIPStoreDrivers() []string {
+	ipStoreDriversMu.RLock()
+	defer ipStoreDriversMu.RUnlock()
+
+	return sortedNames(ipStoreDrivers)
+}
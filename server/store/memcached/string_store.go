@@ -0,0 +1,269 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package memcached implements a StringStore driver backed by memcached,
+// which allows multiple chihaya instances to share their passkeys and
+// infohashes.
+package memcached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	store.RegisterStringStoreDriver("memcached", &stringStoreDriver{})
+}
+
+// maxRelativeExpiration is the longest expiration memcached interprets
+// relative to the current time. Longer expirations are Unix timestamps.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// maxKeyLength is the maximum length of a memcached key.
+const maxKeyLength = 250
+
+type stringStoreDriver struct{}
+
+func (d *stringStoreDriver) New(storecfg *store.DriverConfig) (store.StringStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newStringStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := memcache.New(cfg.Servers...)
+	client.Timeout = cfg.Timeout
+	client.MaxIdleConns = cfg.MaxIdleConns
+
+	// Make sure the servers are reachable, so that a misconfigured address
+	// is reported right away.
+	err = client.Ping()
+	if err != nil {
+		client.Close()
+		return nil, errors.New("memcached: unable to reach servers: " + err.Error())
+	}
+
+	return &stringStore{
+		client: client,
+		prefix: cfg.Prefix,
+		ttl:    cfg.TTL,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+type stringStoreConfig struct {
+	Servers      []string      `yaml:"servers"`
+	Prefix       string        `yaml:"prefix"`
+	TTL          time.Duration `yaml:"ttl"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxIdleConns int           `yaml:"max_idle_conns"`
+}
+
+func newStringStoreConfig(storecfg *store.DriverConfig) (*stringStoreConfig, error) {
+	b, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg stringStoreConfig
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []string{"localhost:11211"}
+	}
+	for _, server := range cfg.Servers {
+		// Servers containing a slash are Unix sockets.
+		if strings.Contains(server, "/") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("memcached: invalid StringStore config: server %q: %s", server, err)
+		}
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "chihaya:"
+	}
+	if strings.ContainsAny(cfg.Prefix, " \t\r\n") || len(cfg.Prefix) > maxKeyLength/2 {
+		return nil, fmt.Errorf("memcached: invalid StringStore config: prefix %q must not contain whitespace or exceed %d bytes", cfg.Prefix, maxKeyLength/2)
+	}
+	if cfg.TTL < 0 || cfg.TTL > 0 && cfg.TTL < time.Second {
+		return nil, fmt.Errorf("memcached: invalid StringStore config: ttl must be 0 or at least 1s, got %s", cfg.TTL)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.MaxIdleConns < 1 {
+		cfg.MaxIdleConns = 8
+	}
+	return &cfg, nil
+}
+
+// stringStore implements store.StringStore by storing every string as its
+// own memcached key.
+//
+// Memcached may evict keys at any time when it runs out of memory, so it
+// should be sized to hold all strings.
+type stringStore struct {
+	client *memcache.Client
+	prefix string
+	ttl    time.Duration
+	closed chan struct{}
+}
+
+var (
+	_ store.StringStore      = &stringStore{}
+	_ store.MultiStringStore = &stringStore{}
+)
+
+// key returns the memcached key of s.
+//
+// Strings may contain bytes that are not allowed in keys, like raw
+// infohashes, so they are hex-encoded. Strings that would result in keys that
+// are too long are hashed instead; the "h:" marker keeps those keys apart
+// from the hex encodings of other strings.
+func (ss *stringStore) key(s string) string {
+	key := ss.prefix + hex.EncodeToString([]byte(s))
+	if len(key) <= maxKeyLength {
+		return key
+	}
+
+	sum := sha1.Sum([]byte(s))
+	return ss.prefix + "h:" + hex.EncodeToString(sum[:])
+}
+
+// expiration returns the expiration of keys stored now in memcached's
+// notation.
+func (ss *stringStore) expiration() int32 {
+	return expirationAfter(ss.ttl)
+}
+
+// expirationAfter returns the expiration of keys that expire after ttl in
+// memcached's notation. Relative expirations are rounded up to whole seconds,
+// because keys with an expiration of 0 never expire.
+func expirationAfter(ttl time.Duration) int32 {
+	if ttl <= maxRelativeExpiration {
+		return int32((ttl + time.Second - 1) / time.Second)
+	}
+	return int32(time.Now().Add(ttl).Unix())
+}
+
+func (ss *stringStore) checkClosed() {
+	select {
+	case <-ss.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+}
+
+func (ss *stringStore) PutString(s string) error {
+	ss.checkClosed()
+
+	return ss.set(s, ss.expiration())
+}
+
+// PutStringWithExpiry sets the expiration of the key to expires, regardless
+// of the configured ttl.
+func (ss *stringStore) PutStringWithExpiry(s string, expires time.Time) error {
+	ss.checkClosed()
+
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		// The string expired already, so a previous put must not be found
+		// either.
+		err := ss.client.Delete(ss.key(s))
+		if err != nil && err != memcache.ErrCacheMiss {
+			return errors.New("memcached: failed to put string: " + err.Error())
+		}
+		return nil
+	}
+
+	return ss.set(s, expirationAfter(ttl))
+}
+
+// set stores the key of s with the given expiration.
+func (ss *stringStore) set(s string, expiration int32) error {
+	err := ss.client.Set(&memcache.Item{
+		Key:        ss.key(s),
+		Value:      []byte{},
+		Expiration: expiration,
+	})
+	if err != nil {
+		return errors.New("memcached: failed to put string: " + err.Error())
+	}
+	return nil
+}
+
+func (ss *stringStore) HasString(s string) (bool, error) {
+	ss.checkClosed()
+
+	_, err := ss.client.Get(ss.key(s))
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, errors.New("memcached: failed to look up string: " + err.Error())
+	}
+	return true, nil
+}
+
+// HasAnyString looks up all strings in a single request per server.
+func (ss *stringStore) HasAnyString(strs []string) (bool, error) {
+	ss.checkClosed()
+
+	if len(strs) == 0 {
+		return false, nil
+	}
+
+	keys := make([]string, 0, len(strs))
+	for _, s := range strs {
+		keys = append(keys, ss.key(s))
+	}
+
+	items, err := ss.client.GetMulti(keys)
+	if err != nil {
+		return false, errors.New("memcached: failed to look up strings: " + err.Error())
+	}
+	return len(items) > 0, nil
+}
+
+func (ss *stringStore) RemoveString(s string) error {
+	ss.checkClosed()
+
+	err := ss.client.Delete(ss.key(s))
+	if err == memcache.ErrCacheMiss {
+		return store.ErrResourceDoesNotExist
+	} else if err != nil {
+		return errors.New("memcached: failed to remove string: " + err.Error())
+	}
+	return nil
+}
+
+func (ss *stringStore) Stop() <-chan error {
+	toReturn := make(chan error)
+	go func() {
+		close(ss.closed)
+
+		if err := ss.client.Close(); err != nil {
+			toReturn <- err
+		}
+		close(toReturn)
+	}()
+	return toReturn
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build integration
+// +build integration
+
+package memcached
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// The integration tests expect a memcached server at CHIHAYA_MEMCACHED_ADDR,
+// or localhost:11211 if it is unset. They are run with
+//
+//	go test -tags integration
+//
+// Every test uses a key prefix unique to the test and the time it was started
+// at, so that strings of previous runs do not interfere.
+
+var stringStoreTester = store.PrepareStringStoreTester(&stringStoreDriver{})
+
+func memcachedAddr() string {
+	if addr := os.Getenv("CHIHAYA_MEMCACHED_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:11211"
+}
+
+func cleanConfig(test string, options map[string]interface{}) *store.DriverConfig {
+	config := map[string]interface{}{
+		"servers": []string{memcachedAddr()},
+		"prefix":  "chihaya_test:" + test + ":" + strconv.FormatInt(time.Now().UnixNano(), 36) + ":",
+	}
+	for k, v := range options {
+		config[k] = v
+	}
+
+	return &store.DriverConfig{Name: "memcached", Config: config}
+}
+
+func TestStringStore(t *testing.T) {
+	stringStoreTester.TestStringStore(t, cleanConfig("TestStringStore", nil))
+}
+
+func TestSharedStringStore(t *testing.T) {
+	cfg := cleanConfig("TestSharedStringStore", nil)
+
+	a, err := (&stringStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	b, err := (&stringStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, a.PutString("\x00binary\xff"))
+	has, err := b.HasString("\x00binary\xff")
+	require.Nil(t, err)
+	require.True(t, has)
+
+	require.Nil(t, b.RemoveString("\x00binary\xff"))
+	has, err = a.HasString("\x00binary\xff")
+	require.Nil(t, err)
+	require.False(t, has)
+
+	require.Nil(t, <-a.Stop())
+	require.Nil(t, <-b.Stop())
+}
+
+func TestStringStoreTTL(t *testing.T) {
+	ss, err := (&stringStoreDriver{}).New(cleanConfig("TestStringStoreTTL", map[string]interface{}{"ttl": "1s"}))
+	require.Nil(t, err)
+
+	require.Nil(t, ss.PutString("pass"))
+	has, err := ss.HasString("pass")
+	require.Nil(t, err)
+	require.True(t, has)
+
+	// Memcached expires keys with a resolution of one second.
+	time.Sleep(2100 * time.Millisecond)
+	has, err = ss.HasString("pass")
+	require.Nil(t, err)
+	require.False(t, has)
+	require.Equal(t, store.ErrResourceDoesNotExist, ss.RemoveString("pass"))
+
+	require.Nil(t, <-ss.Stop())
+}
+
+func TestStringStoreExpiry(t *testing.T) {
+	ss, err := (&stringStoreDriver{}).New(cleanConfig("TestStringStoreExpiry", nil))
+	require.Nil(t, err)
+
+	require.Nil(t, ss.PutStringWithExpiry("pass", time.Now().Add(time.Second)))
+	has, err := ss.HasString("pass")
+	require.Nil(t, err)
+	require.True(t, has)
+
+	time.Sleep(2100 * time.Millisecond)
+	has, err = ss.HasString("pass")
+	require.Nil(t, err)
+	require.False(t, has)
+
+	require.Nil(t, <-ss.Stop())
+}
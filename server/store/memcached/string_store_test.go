@@ -0,0 +1,109 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memcached
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestStringStoreConfig(t *testing.T) {
+	var table = []struct {
+		config   map[string]interface{}
+		expected []string
+		valid    bool
+	}{
+		{nil, []string{"localhost:11211"}, true},
+		{map[string]interface{}{"servers": []string{"a.example.com:11211", "[::1]:11212"}}, []string{"a.example.com:11211", "[::1]:11212"}, true},
+		{map[string]interface{}{"servers": []string{"/var/run/memcached.sock"}}, []string{"/var/run/memcached.sock"}, true},
+		{map[string]interface{}{"ttl": "1h"}, []string{"localhost:11211"}, true},
+		{map[string]interface{}{"servers": []string{"localhost"}}, nil, false},
+		{map[string]interface{}{"prefix": "chihaya "}, nil, false},
+		{map[string]interface{}{"ttl": "-1s"}, nil, false},
+		{map[string]interface{}{"ttl": "500ms"}, nil, false},
+	}
+
+	for _, tt := range table {
+		cfg, err := newStringStoreConfig(&store.DriverConfig{Name: "memcached", Config: tt.config})
+		if !tt.valid {
+			require.NotNil(t, err, "%v", tt.config)
+			continue
+		}
+		require.Nil(t, err, "%v", tt.config)
+		require.Equal(t, tt.expected, cfg.Servers)
+		require.Equal(t, "chihaya:", cfg.Prefix)
+	}
+
+	// Invalid configs fail before connecting to the servers.
+	_, err := (&stringStoreDriver{}).New(&store.DriverConfig{Name: "memcached", Config: map[string]interface{}{"servers": []string{"localhost"}}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid StringStore config")
+}
+
+func TestKey(t *testing.T) {
+	ss := &stringStore{prefix: "chihaya:"}
+
+	require.Equal(t, "chihaya:"+"70617373", ss.key("pass"))
+	require.Equal(t, "chihaya:"+"00ff20", ss.key("\x00\xff "))
+	require.NotEqual(t, ss.key("a"), ss.key("A"))
+
+	long := strings.Repeat("x", maxKeyLength)
+	require.True(t, strings.HasPrefix(ss.key(long), "chihaya:h:"))
+	require.True(t, len(ss.key(long)) <= maxKeyLength)
+	require.NotEqual(t, ss.key(long), ss.key(long+"x"))
+}
+
+func TestExpiration(t *testing.T) {
+	ss := &stringStore{}
+	require.Equal(t, int32(0), ss.expiration())
+
+	ss.ttl = time.Hour
+	require.Equal(t, int32(3600), ss.expiration())
+
+	// Expirations longer than 30 days must be absolute.
+	ss.ttl = 60 * 24 * time.Hour
+	expected := time.Now().Add(ss.ttl).Unix()
+	require.True(t, int64(ss.expiration())-expected < 2)
+
+	// Keys that expire within a second must not be stored forever.
+	require.Equal(t, int32(1), expirationAfter(300*time.Millisecond))
+	require.Equal(t, int32(2), expirationAfter(1500*time.Millisecond))
+}
+
+// TestUnreachable makes sure that network errors are returned, rather than
+// being reported as missing strings.
+func TestUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	require.Nil(t, l.Close())
+
+	_, err = (&stringStoreDriver{}).New(&store.DriverConfig{Name: "memcached", Config: map[string]interface{}{"servers": []string{addr}}})
+	require.NotNil(t, err)
+
+	ss := &stringStore{
+		client: memcache.New(addr),
+		prefix: "chihaya:",
+		closed: make(chan struct{}),
+	}
+
+	has, err := ss.HasString("pass")
+	require.NotNil(t, err)
+	require.False(t, has)
+	require.NotNil(t, ss.PutString("pass"))
+
+	err = ss.RemoveString("pass")
+	require.NotNil(t, err)
+	require.NotEqual(t, store.ErrResourceDoesNotExist, err)
+
+	require.Nil(t, <-ss.Stop())
+}
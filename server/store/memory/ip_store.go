@@ -5,11 +5,17 @@
 package memory
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mrd0ll4r/netmatch"
+	"gopkg.in/yaml.v2"
 
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/server/store"
 )
 
@@ -19,23 +25,145 @@ func init() {
 
 type ipStoreDriver struct{}
 
-func (d *ipStoreDriver) New(_ *store.DriverConfig) (store.IPStore, error) {
-	return &ipStore{
-		ips:      make(map[[16]byte]struct{}),
+func (d *ipStoreDriver) New(storecfg *store.DriverConfig) (store.IPStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newIPStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newIPStore(cfg.Shards)
+	s.clock = storecfg.ClockOrReal()
+	s.snapshotPath = cfg.SnapshotFile
+
+	if s.snapshotPath != "" {
+		err = s.restoreFile(s.snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go s.reap(cfg.ReapInterval)
+
+	return s, nil
+}
+
+type ipStoreConfig struct {
+	Shards       int           `yaml:"shards"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+	SnapshotFile string        `yaml:"snapshot_file"`
+}
+
+func newIPStoreConfig(storecfg *store.DriverConfig) (*ipStoreConfig, error) {
+	bytes, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ipStoreConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Shards == 0 {
+		cfg.Shards = 32
+	}
+	if cfg.Shards < 0 || cfg.Shards&(cfg.Shards-1) != 0 {
+		return nil, fmt.Errorf("memory: invalid IPStore config: number of shards must be a positive power of two, got %d", cfg.Shards)
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	return &cfg, nil
+}
+
+// newIPStore returns an empty ipStore with the given number of shards, which
+// must be a power of two.
+func newIPStore(shards int) *ipStore {
+	s := &ipStore{
+		shards:   make([]*ipShard, shards),
 		networks: netmatch.New(),
+		nets:     make(map[string]storedNetwork),
 		closed:   make(chan struct{}),
-	}, nil
+		reaped:   make(chan struct{}),
+		clock:    clock.Real,
+	}
+	for i := range s.shards {
+		s.shards[i] = &ipShard{ips: make(map[[16]byte]int64)}
+	}
+
+	return s
 }
 
-// ipStore implements store.IPStore using an in-memory map of byte arrays and
+// storedNetwork is a network contained in an ipStore, along with the time it
+// expires at.
+type storedNetwork struct {
+	*net.IPNet
+	expires int64
+}
+
+// ipShard holds the individual IPs of an ipStore whose keys hash to the
+// shard.
+type ipShard struct {
+	ips map[[16]byte]int64
+	sync.RWMutex
+}
+
+// ipStore implements store.IPStore using in-memory maps of byte arrays and
 // a trie-like structure.
+//
+// Individual IPs are spread across shards, each with its own lock, so that
+// lookups of different IPs don't contend with each other.
+// Networks are kept in the trie, which is protected by the lock of the
+// ipStore itself. The trie cannot be enumerated, so every network it contains
+// is also kept in nets, keyed by its normalized CIDR notation.
+// If both are needed, the lock of the ipStore must be acquired before any
+// shard lock, and shard locks must be acquired in ascending order.
+//
+// Every IP and network is stored along with the time it expires at, in
+// nanoseconds since the epoch, or zero if it never expires.
+// Expired entries are treated as absent until they are evicted by the reaper.
 type ipStore struct {
-	ips      map[[16]byte]struct{}
+	shards   []*ipShard
 	networks *netmatch.Trie
+	nets     map[string]storedNetwork
 	closed   chan struct{}
+	reaped   chan struct{}
+
+	// clock tells the time entries expire at and ticks the reaper.
+	clock clock.Clock
+
+	// nextExpiry is a lower bound for the time the next network in nets
+	// expires at, or zero if no network expires.
+	// As long as nextExpiry has not passed, every match of the trie is
+	// known to be valid.
+	nextExpiry int64
+
+	// replacements counts the calls of ReplaceAll and the commits of
+	// batches. Lookups do not hold the locks of the shards and the networks
+	// at once, so they start over if it changed while they ran, rather than
+	// mix the contents from before and after a replacement.
+	replacements atomic.Uint64
+
+	// snapshotPath is the file the store is restored from when it is
+	// created and written to when it is stopped, if not empty.
+	snapshotPath string
+
 	sync.RWMutex
 }
 
+var _ store.ContextIPStore = &ipStore{}
+
+// testHookLookup is called before every lookup of an address in s, with
+// network set if the stored networks are searched. It is only replaced by
+// tests.
+var testHookLookup = func(s *ipStore, network bool) {}
+
 var (
 	_            store.IPStore = &ipStore{}
 	v4InV6Prefix               = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
@@ -58,8 +186,116 @@ func key(ip net.IP) [16]byte {
 	return array
 }
 
-func (s *ipStore) AddNetwork(network string) error {
+// shardIndex returns the index of the shard the given key belongs to, using
+// the FNV-1a hash of the key.
+func (s *ipStore) shardIndex(key [16]byte) int {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h & uint32(len(s.shards)-1))
+}
+
+func (s *ipStore) shard(key [16]byte) *ipShard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// lockAll acquires the write locks of the store and all of its shards.
+func (s *ipStore) lockAll() {
+	s.Lock()
+	for _, shard := range s.shards {
+		shard.Lock()
+	}
+}
+
+// unlockAll releases the locks acquired by lockAll.
+func (s *ipStore) unlockAll() {
+	for _, shard := range s.shards {
+		shard.Unlock()
+	}
+	s.Unlock()
+}
+
+// parseCIDR parses a network in CIDR notation like net.ParseCIDR does, but
+// always returns IPv4 networks in their 4-byte form, so that every network has
+// exactly one normalized representation.
+func parseCIDR(network string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalize(ipnet), nil
+}
+
+// normalize converts an IPv4 network in IPv6 notation to its 4-byte form.
+// Other networks are returned unmodified.
+func normalize(ipnet *net.IPNet) *net.IPNet {
+	ones, bits := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		ipnet.IP = ip4
+		ipnet.Mask = net.CIDRMask(ones-96, 8*net.IPv4len)
+	}
+
+	return ipnet
+}
+
+// supernet returns the normalized CIDR notation of the network with the given
+// prefix length that contains ip.
+func supernet(ip [16]byte, prefix int) string {
+	mask := net.CIDRMask(prefix, 8*net.IPv6len)
+	return normalize(&net.IPNet{IP: net.IP(ip[:]).Mask(mask), Mask: mask}).String()
+}
+
+// expired returns whether something that expires at expires has expired at
+// now.
+func expired(expires, now int64) bool {
+	return expires != 0 && expires <= now
+}
+
+// expiry converts the time something expires at to its representation in an
+// ipStore.
+func expiry(expires time.Time) int64 {
+	// The zero value means "never", so make sure we never produce it for an
+	// actual point in time.
+	if n := expires.UnixNano(); n != 0 {
+		return n
+	}
+	return 1
+}
+
+// prepareNetwork parses a network in CIDR notation and returns a function that
+// adds it to the store.
+//
+// The returned function must be called with the write lock held.
+func (s *ipStore) prepareNetwork(network string) (func(expires int64) error, error) {
 	key, length, err := netmatch.ParseNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(expires int64) error {
+		err := s.networks.Add(key, length)
+		if err != nil {
+			return err
+		}
+
+		s.nets[ipnet.String()] = storedNetwork{IPNet: ipnet, expires: expires}
+		if expires != 0 && (s.nextExpiry == 0 || expires < s.nextExpiry) {
+			s.nextExpiry = expires
+		}
+		return nil
+	}, nil
+}
+
+func (s *ipStore) addNetwork(network string, expires int64) error {
+	add, err := s.prepareNetwork(network)
 	if err != nil {
 		return err
 	}
@@ -73,10 +309,29 @@ func (s *ipStore) AddNetwork(network string) error {
 	default:
 	}
 
-	return s.networks.Add(key, length)
+	return add(expires)
 }
 
-func (s *ipStore) AddIP(ip net.IP) error {
+func (s *ipStore) AddNetwork(network string) error {
+	return s.addNetwork(network, 0)
+}
+
+func (s *ipStore) AddNetworkWithExpiry(network string, expires time.Time) error {
+	return s.addNetwork(network, expiry(expires))
+}
+
+func (s *ipStore) AddNetworks(networks []string) error {
+	// Parse everything before acquiring the lock, so that a malformed
+	// network neither blocks readers nor leaves the store half-populated.
+	adds := make([]func(int64) error, 0, len(networks))
+	for i, network := range networks {
+		add, err := s.prepareNetwork(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		adds = append(adds, add)
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
@@ -86,15 +341,28 @@ func (s *ipStore) AddIP(ip net.IP) error {
 	default:
 	}
 
-	s.ips[key(ip)] = struct{}{}
+	for _, add := range adds {
+		if err := add(0); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (s *ipStore) HasIP(ip net.IP) (bool, error) {
+func (s *ipStore) AddIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+	return s.AddNetworks(networks)
+}
+
+func (s *ipStore) addIP(ip net.IP, expires int64) error {
 	key := key(ip)
-	s.RLock()
-	defer s.RUnlock()
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
 
 	select {
 	case <-s.closed:
@@ -102,22 +370,103 @@ func (s *ipStore) HasIP(ip net.IP) (bool, error) {
 	default:
 	}
 
-	_, ok := s.ips[key]
-	if ok {
-		return true, nil
+	shard.ips[key] = expires
+
+	return nil
+}
+
+func (s *ipStore) AddIP(ip net.IP) error {
+	return s.addIP(ip, 0)
+}
+
+func (s *ipStore) AddIPWithExpiry(ip net.IP, expires time.Time) error {
+	return s.addIP(ip, expiry(expires))
+}
+
+// hasIP returns whether the given key is contained in the store, either as an
+// individual IP or as part of a network.
+//
+// The caller must not hold any locks.
+func (s *ipStore) hasIP(key [16]byte, now int64) (bool, error) {
+	for {
+		replacements := s.replacements.Load()
+		if s.containsIP(key, now) {
+			return true, nil
+		}
+
+		s.RLock()
+		match, err := s.matchNetwork(key, now)
+		replaced := s.replacements.Load() != replacements
+		s.RUnlock()
+		if !replaced {
+			return match, err
+		}
 	}
+}
+
+// containsIP returns whether the given key is contained in the store as an
+// individual IP.
+//
+// The caller must not hold the lock of the shard key belongs to.
+func (s *ipStore) containsIP(key [16]byte, now int64) bool {
+	testHookLookup(s, false)
+
+	shard := s.shard(key)
+	shard.RLock()
+	expires, ok := shard.ips[key]
+	shard.RUnlock()
+
+	return ok && !expired(expires, now)
+}
+
+// matchNetwork returns whether the given key is part of any network contained
+// in the store.
+//
+// The caller must hold at least a read lock on the store.
+func (s *ipStore) matchNetwork(key [16]byte, now int64) (bool, error) {
+	testHookLookup(s, true)
 
 	match, err := s.networks.Match(key)
-	if err != nil {
+	if err != nil || !match {
 		return false, err
 	}
 
-	return match, nil
+	if s.nextExpiry == 0 || now < s.nextExpiry {
+		return true, nil
+	}
+
+	// Some networks might have expired without being reaped yet, so look
+	// for one that contains key and is still valid.
+	for prefix := 8 * net.IPv6len; prefix >= 0; prefix-- {
+		if n, ok := s.nets[supernet(key, prefix)]; ok && !expired(n.expires, now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *ipStore) HasIP(ip net.IP) (bool, error) {
+	key := key(ip)
+	now := s.clock.Now().UnixNano()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return s.hasIP(key, now)
 }
 
 func (s *ipStore) HasAnyIP(ips []net.IP) (bool, error) {
-	s.RLock()
-	defer s.RUnlock()
+	return s.HasAnyIPContext(context.Background(), ips)
+}
+
+// HasAnyIPContext checks ctx between the lookups of the individual IPs and
+// before waiting for the lock of the networks.
+func (s *ipStore) HasAnyIPContext(ctx context.Context, ips []net.IP) (bool, error) {
+	now := s.clock.Now().UnixNano()
 
 	select {
 	case <-s.closed:
@@ -125,18 +474,43 @@ func (s *ipStore) HasAnyIP(ips []net.IP) (bool, error) {
 	default:
 	}
 
-	for _, ip := range ips {
-		key := key(ip)
-		if _, ok := s.ips[key]; ok {
-			return true, nil
+	if len(ips) == 0 {
+		return false, nil
+	}
+
+	for {
+		replacements := s.replacements.Load()
+		for _, ip := range ips {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			if s.containsIP(key(ip), now) {
+				return true, nil
+			}
 		}
 
-		match, err := s.networks.Match(key)
-		if err != nil {
+		if err := ctx.Err(); err != nil {
 			return false, err
 		}
-		if match {
-			return true, nil
+		match, err := s.matchAnyNetwork(ips, now)
+		if err != nil || match || s.replacements.Load() == replacements {
+			return match, err
+		}
+	}
+}
+
+// matchAnyNetwork returns whether any of the given IPs is part of any network
+// contained in the store.
+//
+// The caller must not hold the lock of the store.
+func (s *ipStore) matchAnyNetwork(ips []net.IP, now int64) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, ip := range ips {
+		match, err := s.matchNetwork(key(ip), now)
+		if err != nil || match {
+			return match, err
 		}
 	}
 
@@ -144,8 +518,12 @@ func (s *ipStore) HasAnyIP(ips []net.IP) (bool, error) {
 }
 
 func (s *ipStore) HasAllIPs(ips []net.IP) (bool, error) {
-	s.RLock()
-	defer s.RUnlock()
+	return s.HasAllIPsContext(context.Background(), ips)
+}
+
+// HasAllIPsContext checks ctx between the lookups of the individual IPs.
+func (s *ipStore) HasAllIPsContext(ctx context.Context, ips []net.IP) (bool, error) {
+	now := s.clock.Now().UnixNano()
 
 	select {
 	case <-s.closed:
@@ -153,10 +531,15 @@ func (s *ipStore) HasAllIPs(ips []net.IP) (bool, error) {
 	default:
 	}
 
-	for _, ip := range ips {
-		key := key(ip)
-		if _, ok := s.ips[key]; !ok {
-			match, err := s.networks.Match(key)
+	// A single missing IP is missing from the contents it was looked up in,
+	// but all IPs must be found in the same contents.
+	for {
+		replacements := s.replacements.Load()
+		for _, ip := range ips {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			match, err := s.hasIP(key(ip), now)
 			if err != nil {
 				return false, err
 			}
@@ -164,15 +547,86 @@ func (s *ipStore) HasAllIPs(ips []net.IP) (bool, error) {
 				return false, nil
 			}
 		}
+
+		if s.replacements.Load() == replacements {
+			return true, nil
+		}
+	}
+}
+
+func (s *ipStore) HasNetwork(network string) (bool, error) {
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return false, err
+	}
+
+	// Work on the IPv6 form, so that IPv4 networks are also found to be
+	// covered by stored IPv6 networks like ::/0.
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96
+	}
+
+	now := s.clock.Now().UnixNano()
+	s.RLock()
+	defer s.RUnlock()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return s.covers(key(ipnet.IP), ones, now)
+}
+
+// covers returns whether every address of the network described by the first
+// address ip and the prefix length ones is contained in the store.
+//
+// A network is covered if it is a subnet of a stored network, if it is a
+// single stored address or if both of its halves are covered.
+//
+// The caller must hold at least a read lock on the store, but no shard locks.
+func (s *ipStore) covers(ip [16]byte, ones int, now int64) (bool, error) {
+	// Every address of the network must be contained in the store, so
+	// checking the first one allows bailing out early for most networks
+	// that are not covered.
+	if s.containsIP(ip, now) {
+		if ones == 8*net.IPv6len {
+			return true, nil
+		}
+	} else {
+		match, err := s.matchNetwork(ip, now)
+		if err != nil || !match {
+			return false, err
+		}
 	}
 
-	return true, nil
+	for prefix := ones; prefix >= 0; prefix-- {
+		if n, ok := s.nets[supernet(ip, prefix)]; ok && !expired(n.expires, now) {
+			return true, nil
+		}
+	}
+
+	if ones == 8*net.IPv6len {
+		return false, nil
+	}
+
+	covered, err := s.covers(ip, ones+1, now)
+	if err != nil || !covered {
+		return false, err
+	}
+
+	ip[ones/8] |= 0x80 >> uint(ones%8)
+	return s.covers(ip, ones+1, now)
 }
 
 func (s *ipStore) RemoveIP(ip net.IP) error {
 	key := key(ip)
-	s.Lock()
-	defer s.Unlock()
+	now := s.clock.Now().UnixNano()
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
 
 	select {
 	case <-s.closed:
@@ -180,12 +634,16 @@ func (s *ipStore) RemoveIP(ip net.IP) error {
 	default:
 	}
 
-	if _, ok := s.ips[key]; !ok {
+	expires, ok := shard.ips[key]
+	if !ok {
 		return store.ErrResourceDoesNotExist
 	}
 
-	delete(s.ips, key)
+	delete(shard.ips, key)
 
+	if expired(expires, now) {
+		return store.ErrResourceDoesNotExist
+	}
 	return nil
 }
 
@@ -195,6 +653,12 @@ func (s *ipStore) RemoveNetwork(network string) error {
 		return err
 	}
 
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now().UnixNano()
 	s.Lock()
 	defer s.Unlock()
 
@@ -208,17 +672,336 @@ func (s *ipStore) RemoveNetwork(network string) error {
 	if err != nil && err == netmatch.ErrNotContained {
 		return store.ErrResourceDoesNotExist
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	n := s.nets[ipnet.String()]
+	delete(s.nets, ipnet.String())
+
+	if expired(n.expires, now) {
+		return store.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (s *ipStore) RemoveIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+
+	b := s.Batch()
+	for _, network := range networks {
+		err = b.RemoveNetwork(network)
+		if err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+func (s *ipStore) CarveNetwork(network string) error {
+	hole, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now().UnixNano()
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	type carving struct {
+		n         storedNetwork
+		remaining []*net.IPNet
+	}
+	var carvings []carving
+	for _, n := range s.nets {
+		if expired(n.expires, now) {
+			continue
+		}
+		if remaining, overlap := store.ExcludeNetwork(n.IPNet, hole); overlap {
+			carvings = append(carvings, carving{n, remaining})
+		}
+	}
+	if len(carvings) == 0 {
+		return store.ErrResourceDoesNotExist
+	}
+
+	// Parse the remaining networks before modifying the store, so that a
+	// failure leaves it unchanged.
+	var adds []func() error
+	for _, c := range carvings {
+		expires := c.n.expires
+		for _, ipnet := range c.remaining {
+			add, err := s.prepareNetwork(ipnet.String())
+			if err != nil {
+				return err
+			}
+			adds = append(adds, func() error { return add(expires) })
+		}
+	}
+
+	for _, c := range carvings {
+		key, length, err := netmatch.ParseNetwork(c.n.String())
+		if err != nil {
+			return err
+		}
+		err = s.networks.Remove(key, length)
+		if err != nil {
+			return err
+		}
+		delete(s.nets, c.n.String())
+	}
+	for _, add := range adds {
+		err = add()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ipStore) ReplaceAll(ips []net.IP, networks []string) error {
+	// Build the new contents in a separate store first, so that the lock is
+	// only held for the swap and a malformed network leaves this store
+	// unchanged.
+	replaced := newIPStore(len(s.shards))
+	for _, ip := range ips {
+		k := key(ip)
+		replaced.shard(k).ips[k] = 0
+	}
+	for i, network := range networks {
+		add, err := replaced.prepareNetwork(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		if err = add(0); err != nil {
+			return err
+		}
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	for i, shard := range s.shards {
+		shard.ips = replaced.shards[i].ips
+	}
+	s.networks = replaced.networks
+	s.nets = replaced.nets
+	s.nextExpiry = replaced.nextExpiry
+	s.replacements.Add(1)
+
+	return nil
+}
+
+func (s *ipStore) NumIPs() (uint64, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	var n uint64
+	for _, shard := range s.shards {
+		shard.RLock()
+		n += uint64(len(shard.ips))
+		shard.RUnlock()
+	}
+
+	return n, nil
+}
+
+func (s *ipStore) NumNetworks() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return uint64(len(s.nets)), nil
+}
+
+func (s *ipStore) RangeIPs(fn func(ip net.IP) bool) error {
+	now := s.clock.Now().UnixNano()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	for _, shard := range s.shards {
+		if !shard.rangeIPs(fn, now) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// rangeIPs calls fn for every IP of the shard that has not expired at now and
+// returns false if fn stopped the iteration.
+func (shard *ipShard) rangeIPs(fn func(ip net.IP) bool, now int64) bool {
+	shard.RLock()
+	defer shard.RUnlock()
+
+	for key, expires := range shard.ips {
+		if expired(expires, now) {
+			continue
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, key[:])
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		if !fn(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *ipStore) RangeNetworks(fn func(network *net.IPNet) bool) error {
+	now := s.clock.Now().UnixNano()
+	s.RLock()
+	defer s.RUnlock()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	for _, n := range s.nets {
+		if expired(n.expires, now) {
+			continue
+		}
+
+		// Hand out a copy, so that fn cannot corrupt the index.
+		network := &net.IPNet{
+			IP:   append(net.IP(nil), n.IP...),
+			Mask: append(net.IPMask(nil), n.Mask...),
+		}
+
+		if !fn(network) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// reap periodically evicts expired entries from the store until the store is
+// stopped.
+func (s *ipStore) reap(interval time.Duration) {
+	defer close(s.reaped)
+
+	t := s.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C():
+			s.evictExpired(s.clock.Now().UnixNano())
+		}
+	}
+}
+
+// evictExpired removes all entries that have expired at now from the store.
+func (s *ipStore) evictExpired(now int64) {
+	for _, shard := range s.shards {
+		shard.Lock()
+		for key, expires := range shard.ips {
+			if expired(expires, now) {
+				delete(shard.ips, key)
+			}
+		}
+		shard.Unlock()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	if s.nextExpiry == 0 || now < s.nextExpiry {
+		return
+	}
+
+	s.nextExpiry = 0
+	for cidr, n := range s.nets {
+		if !expired(n.expires, now) {
+			if n.expires != 0 && (s.nextExpiry == 0 || n.expires < s.nextExpiry) {
+				s.nextExpiry = n.expires
+			}
+			continue
+		}
+
+		key, length, err := netmatch.ParseNetwork(cidr)
+		if err == nil {
+			err = s.networks.Remove(key, length)
+		}
+		if err != nil {
+			// The index and the trie are out of sync. Keep the
+			// network, so we retry on the next run.
+			s.nextExpiry = n.expires
+			continue
+		}
+
+		delete(s.nets, cidr)
+	}
 }
 
 func (s *ipStore) Stop() <-chan error {
 	toReturn := make(chan error)
 	go func() {
-		s.Lock()
-		defer s.Unlock()
-		s.ips = make(map[[16]byte]struct{})
+		s.lockAll()
+
+		var err error
+		if s.snapshotPath != "" {
+			err = s.snapshotFile(s.snapshotPath)
+		}
+
+		for _, shard := range s.shards {
+			shard.ips = make(map[[16]byte]int64)
+		}
 		s.networks = netmatch.New()
+		s.nets = make(map[string]storedNetwork)
 		close(s.closed)
+		s.unlockAll()
+
+		<-s.reaped
+
+		if err != nil {
+			toReturn <- err
+		}
 		close(toReturn)
 	}()
 	return toReturn
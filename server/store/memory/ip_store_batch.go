@@ -0,0 +1,196 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"net"
+
+	"github.com/mrd0ll4r/netmatch"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// ipBatch implements store.IPBatch for an ipStore.
+//
+// Every modification is recorded as an operation that is applied to the store
+// on Commit, while holding the locks of the store and all of its shards.
+type ipBatch struct {
+	s   *ipStore
+	ops []func() error
+
+	// ips and nets record whether the IPs and networks modified by the
+	// batch so far are contained in the store after the batch is
+	// committed.
+	ips  map[[16]byte]bool
+	nets map[string]bool
+
+	done bool
+}
+
+var _ store.IPBatch = &ipBatch{}
+
+func (s *ipStore) Batch() store.IPBatch {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return &ipBatch{
+		s:    s,
+		ips:  make(map[[16]byte]bool),
+		nets: make(map[string]bool),
+	}
+}
+
+// containsNetwork returns whether the network with the given normalized CIDR
+// notation is contained in the store.
+func (s *ipStore) containsNetwork(cidr string, now int64) bool {
+	s.RLock()
+	n, ok := s.nets[cidr]
+	s.RUnlock()
+
+	return ok && !expired(n.expires, now)
+}
+
+func (b *ipBatch) AddIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	key := key(ip)
+	b.ips[key] = true
+	b.ops = append(b.ops, func() error {
+		b.s.shard(key).ips[key] = 0
+		return nil
+	})
+
+	return nil
+}
+
+func (b *ipBatch) AddNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	add, err := b.s.prepareNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	b.nets[ipnet.String()] = true
+	b.ops = append(b.ops, func() error {
+		return add(0)
+	})
+
+	return nil
+}
+
+func (b *ipBatch) RemoveIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	key := key(ip)
+	contained, ok := b.ips[key]
+	if !ok {
+		contained = b.s.containsIP(key, b.s.clock.Now().UnixNano())
+	}
+	if !contained {
+		return store.ErrResourceDoesNotExist
+	}
+
+	b.ips[key] = false
+	b.ops = append(b.ops, func() error {
+		delete(b.s.shard(key).ips, key)
+		return nil
+	})
+
+	return nil
+}
+
+func (b *ipBatch) RemoveNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	key, length, err := netmatch.ParseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	cidr := ipnet.String()
+	contained, ok := b.nets[cidr]
+	if !ok {
+		contained = b.s.containsNetwork(cidr, b.s.clock.Now().UnixNano())
+	}
+	if !contained {
+		return store.ErrResourceDoesNotExist
+	}
+
+	b.nets[cidr] = false
+	b.ops = append(b.ops, func() error {
+		// The network might have expired and been reaped since
+		// RemoveNetwork was called, which is fine.
+		err := b.s.networks.Remove(key, length)
+		if err != nil && err != netmatch.ErrNotContained {
+			return err
+		}
+
+		delete(b.s.nets, cidr)
+		return nil
+	})
+
+	return nil
+}
+
+func (b *ipBatch) Commit() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+
+	b.s.lockAll()
+	defer b.s.unlockAll()
+
+	select {
+	case <-b.s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	// Lookups that ran while the batch was applied start over, as they
+	// would after a replacement, so that they do not see the IPs from
+	// before and the networks from after the batch, or vice versa.
+	b.s.replacements.Add(1)
+
+	for _, op := range b.ops {
+		if err := op(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *ipBatch) Rollback() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+	b.ops = nil
+
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+var _ store.IPStoreSnapshotter = &ipStore{}
+
+// A snapshot consists of
+//
+//	the magic string "CHIP" and the version byte,
+//	the number of IPs as a uint64, followed by one snapshotIP per IP,
+//	the number of networks as a uint64, followed by one snapshotNetwork per
+//	network, and
+//	the CRC-32 (IEEE) of everything before it, as a uint32.
+//
+// All integers are big-endian.
+const (
+	snapshotMagic   = "CHIP"
+	snapshotVersion = 1
+)
+
+type snapshotIP struct {
+	Key     [16]byte
+	Expires int64
+}
+
+// snapshotNetwork is a network in IPv6 notation, i.e. IPv4 networks are
+// prefixed with v4InV6Prefix and their prefix length is increased by 96.
+type snapshotNetwork struct {
+	IP      [16]byte
+	Ones    uint8
+	Expires int64
+}
+
+// invalidSnapshot returns an error describing why a snapshot could not be
+// restored.
+func invalidSnapshot(format string, args ...interface{}) error {
+	return errors.New("memory: invalid IPStore snapshot: " + fmt.Sprintf(format, args...))
+}
+
+func (s *ipStore) Snapshot(w io.Writer) error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, shard := range s.shards {
+		shard.RLock()
+		defer shard.RUnlock()
+	}
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return s.snapshot(w)
+}
+
+// snapshot writes a snapshot of the store to w.
+//
+// The caller must hold at least read locks on the store and all shards.
+func (s *ipStore) snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(bw, crc)
+
+	_, err := io.WriteString(mw, snapshotMagic)
+	if err != nil {
+		return err
+	}
+
+	var numIPs uint64
+	for _, shard := range s.shards {
+		numIPs += uint64(len(shard.ips))
+	}
+
+	err = binary.Write(mw, binary.BigEndian, struct {
+		Version uint8
+		NumIPs  uint64
+	}{snapshotVersion, numIPs})
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range s.shards {
+		for key, expires := range shard.ips {
+			err = binary.Write(mw, binary.BigEndian, snapshotIP{key, expires})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = binary.Write(mw, binary.BigEndian, uint64(len(s.nets)))
+	if err != nil {
+		return err
+	}
+
+	for _, n := range s.nets {
+		ones, bits := n.Mask.Size()
+		if bits == 8*net.IPv4len {
+			ones += 96
+		}
+
+		err = binary.Write(mw, binary.BigEndian, snapshotNetwork{key(n.IP), uint8(ones), n.expires})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = binary.Write(bw, binary.BigEndian, crc.Sum32())
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (s *ipStore) Restore(r io.Reader) error {
+	// Load the snapshot into a separate store first, so that a malformed
+	// snapshot leaves this store unchanged.
+	restored, err := s.readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	for i, shard := range s.shards {
+		shard.ips = restored.shards[i].ips
+	}
+	s.networks = restored.networks
+	s.nets = restored.nets
+	s.nextExpiry = restored.nextExpiry
+	s.replacements.Add(1)
+
+	return nil
+}
+
+// readSnapshot reads a snapshot from r into a new ipStore with the same number
+// of shards as s.
+func (s *ipStore) readSnapshot(r io.Reader) (*ipStore, error) {
+	restored := newIPStore(len(s.shards))
+
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+
+	var header struct {
+		Magic   [4]byte
+		Version uint8
+		NumIPs  uint64
+	}
+	err := binary.Read(tr, binary.BigEndian, &header)
+	if err != nil {
+		return nil, invalidSnapshot("reading header: %s", err)
+	}
+	if string(header.Magic[:]) != snapshotMagic {
+		return nil, invalidSnapshot("not an IPStore snapshot")
+	}
+	if header.Version != snapshotVersion {
+		return nil, invalidSnapshot("unsupported version %d", header.Version)
+	}
+
+	for i := uint64(0); i < header.NumIPs; i++ {
+		var ip snapshotIP
+		err = binary.Read(tr, binary.BigEndian, &ip)
+		if err != nil {
+			return nil, invalidSnapshot("reading IP %d of %d: %s", i+1, header.NumIPs, err)
+		}
+
+		restored.shard(ip.Key).ips[ip.Key] = ip.Expires
+	}
+
+	var numNetworks uint64
+	err = binary.Read(tr, binary.BigEndian, &numNetworks)
+	if err != nil {
+		return nil, invalidSnapshot("reading number of networks: %s", err)
+	}
+
+	for i := uint64(0); i < numNetworks; i++ {
+		var n snapshotNetwork
+		err = binary.Read(tr, binary.BigEndian, &n)
+		if err != nil {
+			return nil, invalidSnapshot("reading network %d of %d: %s", i+1, numNetworks, err)
+		}
+
+		mask := net.CIDRMask(int(n.Ones), 8*net.IPv6len)
+		if mask == nil || !net.IP(n.IP[:]).Mask(mask).Equal(net.IP(n.IP[:])) {
+			return nil, invalidSnapshot("network %d of %d is malformed", i+1, numNetworks)
+		}
+		cidr := normalize(&net.IPNet{IP: net.IP(n.IP[:]), Mask: mask}).String()
+
+		add, err := restored.prepareNetwork(cidr)
+		if err == nil {
+			err = add(n.Expires)
+		}
+		if err != nil {
+			return nil, invalidSnapshot("network %d of %d: %s", i+1, numNetworks, err)
+		}
+	}
+
+	sum := crc.Sum32()
+
+	var expected uint32
+	err = binary.Read(r, binary.BigEndian, &expected)
+	if err != nil {
+		return nil, invalidSnapshot("reading checksum: %s", err)
+	}
+	if sum != expected {
+		return nil, invalidSnapshot("checksum mismatch")
+	}
+
+	return restored, nil
+}
+
+// restoreFile restores the store from the snapshot at path.
+// A missing file is not an error, the store is left empty in that case.
+func (s *ipStore) restoreFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.Restore(bufio.NewReader(f))
+}
+
+// snapshotFile writes a snapshot of the store to path, replacing any previous
+// snapshot only once the new one has been written completely.
+//
+// The caller must hold at least read locks on the store and all shards.
+func (s *ipStore) snapshotFile(path string) error {
+	f, err := os.Create(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp"))
+	if err != nil {
+		return err
+	}
+
+	err = s.snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/server/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotTestStore(t *testing.T, cfg *store.DriverConfig) store.IPStore {
+	is, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+
+	future := time.Now().Add(time.Hour)
+	require.Nil(t, is.AddIP(v4))
+	require.Nil(t, is.AddIPWithExpiry(v6, future))
+	require.Nil(t, is.AddNetwork("192.168.22.0/24"))
+	require.Nil(t, is.AddNetworkWithExpiry("6464:6464:6464::/48", future))
+
+	return is
+}
+
+func requireSnapshotTestContents(t *testing.T, is store.IPStore) {
+	numIPs, err := is.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numIPs)
+
+	numNetworks, err := is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numNetworks)
+
+	match, err := is.HasAllIPs([]net.IP{
+		v4,
+		v6,
+		net.ParseIP("192.168.22.22"),
+		net.ParseIP("6464:6464:6464::64"),
+	})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	networks := make(map[string]bool)
+	err = is.RangeNetworks(func(network *net.IPNet) bool {
+		networks[network.String()] = true
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"192.168.22.0/24": true, "6464:6464:6464::/48": true}, networks)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	is := newSnapshotTestStore(t, ipStoreTestConfig)
+
+	var buf bytes.Buffer
+	err := is.(store.IPStoreSnapshotter).Snapshot(&buf)
+	require.Nil(t, err)
+	require.Nil(t, <-is.Stop())
+
+	restored, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	require.Nil(t, restored.AddIP(net.ParseIP("10.154.243.22")))
+
+	err = restored.(store.IPStoreSnapshotter).Restore(&buf)
+	require.Nil(t, err)
+	requireSnapshotTestContents(t, restored)
+
+	// restoring replaces the previous contents
+	match, err := restored.HasIP(net.ParseIP("10.154.243.22"))
+	require.Nil(t, err)
+	require.False(t, match)
+
+	require.Nil(t, <-restored.Stop())
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	is, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	require.Nil(t, is.AddIPWithExpiry(v4, time.Now().Add(-time.Minute)))
+	require.Nil(t, is.AddNetworkWithExpiry("192.168.22.0/24", time.Now().Add(-time.Minute)))
+
+	var buf bytes.Buffer
+	require.Nil(t, is.(store.IPStoreSnapshotter).Snapshot(&buf))
+	require.Nil(t, <-is.Stop())
+
+	restored, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	require.Nil(t, restored.(store.IPStoreSnapshotter).Restore(&buf))
+
+	match, err := restored.HasAnyIP([]net.IP{v4, net.ParseIP("192.168.22.22")})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	require.Nil(t, <-restored.Stop())
+}
+
+func TestRestoreMalformed(t *testing.T) {
+	is := newSnapshotTestStore(t, ipStoreTestConfig)
+
+	var buf bytes.Buffer
+	require.Nil(t, is.(store.IPStoreSnapshotter).Snapshot(&buf))
+	snapshot := buf.Bytes()
+
+	target, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	require.Nil(t, target.AddIP(net.ParseIP("10.154.243.22")))
+
+	// every truncation must fail
+	for i := 0; i < len(snapshot); i++ {
+		err = target.(store.IPStoreSnapshotter).Restore(bytes.NewReader(snapshot[:i]))
+		require.NotNil(t, err, "truncated to %d bytes", i)
+	}
+
+	// every flipped byte must fail
+	for i := 0; i < len(snapshot); i++ {
+		corrupt := append([]byte(nil), snapshot...)
+		corrupt[i] ^= 0x5a
+		err = target.(store.IPStoreSnapshotter).Restore(bytes.NewReader(corrupt))
+		require.NotNil(t, err, "corrupted byte %d", i)
+	}
+
+	// the target must be unchanged
+	numIPs, err := target.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), numIPs)
+
+	numNetworks, err := target.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numNetworks)
+
+	require.Nil(t, <-target.Stop())
+	require.Nil(t, <-is.Stop())
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-ipstore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &store.DriverConfig{
+		Config: map[string]interface{}{
+			"snapshot_file": filepath.Join(dir, "ipstore.snapshot"),
+		},
+	}
+
+	// a missing snapshot file is not an error
+	is := newSnapshotTestStore(t, cfg)
+	require.Nil(t, <-is.Stop())
+
+	restored, err := (&ipStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	requireSnapshotTestContents(t, restored)
+	require.Nil(t, <-restored.Stop())
+
+	// a malformed snapshot file fails New
+	err = ioutil.WriteFile(filepath.Join(dir, "ipstore.snapshot"), []byte("CHIP"), 0644)
+	require.Nil(t, err)
+
+	_, err = (&ipStoreDriver{}).New(cfg)
+	require.NotNil(t, err)
+}
@@ -5,9 +5,12 @@
 package memory
 
 import (
+	"context"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/server/store"
 
 	"github.com/stretchr/testify/require"
@@ -21,6 +24,12 @@ var (
 	ipStoreTester      = store.PrepareIPStoreTester(&ipStoreDriver{})
 	ipStoreBenchmarker = store.PrepareIPStoreBenchmarker(&ipStoreDriver{})
 	ipStoreTestConfig  = &store.DriverConfig{}
+
+	// unshardedIPStoreTestConfig is used to compare the parallel
+	// benchmarks against a store with a single lock for all IPs.
+	unshardedIPStoreTestConfig = &store.DriverConfig{
+		Config: map[string]interface{}{"shards": 1},
+	}
 )
 
 func TestKey(t *testing.T) {
@@ -39,6 +48,47 @@ func TestKey(t *testing.T) {
 	}
 }
 
+func TestIPStoreConfig(t *testing.T) {
+	var table = []struct {
+		shards   int
+		expected int
+		valid    bool
+	}{
+		{0, 32, true},
+		{1, 1, true},
+		{64, 64, true},
+		{3, 0, false},
+		{-2, 0, false},
+	}
+
+	for _, tt := range table {
+		cfg, err := newIPStoreConfig(&store.DriverConfig{
+			Config: map[string]interface{}{"shards": tt.shards},
+		})
+		if !tt.valid {
+			require.NotNil(t, err, "shards: %d", tt.shards)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, cfg.Shards)
+		require.Equal(t, time.Minute, cfg.ReapInterval)
+	}
+}
+
+func TestNewIPStoreInvalidConfig(t *testing.T) {
+	var table = []interface{}{
+		"shards: 32",
+		map[string]interface{}{"shards": 3},
+		map[string]interface{}{"shards": -32},
+		map[string]interface{}{"shards": "many"},
+	}
+
+	for _, config := range table {
+		_, err := (&ipStoreDriver{}).New(&store.DriverConfig{Name: "memory", Config: config})
+		require.NotNil(t, err, "%#v", config)
+	}
+}
+
 func TestIPStore(t *testing.T) {
 	ipStoreTester.TestIPStore(t, ipStoreTestConfig)
 }
@@ -55,6 +105,164 @@ func TestHasAllHasAnyNetworks(t *testing.T) {
 	ipStoreTester.TestHasAllHasAnyNetworks(t, ipStoreTestConfig)
 }
 
+func TestAddNetworks(t *testing.T) {
+	ipStoreTester.TestAddNetworks(t, ipStoreTestConfig)
+}
+
+func TestIPRange(t *testing.T) {
+	ipStoreTester.TestIPRange(t, ipStoreTestConfig)
+}
+
+func TestCarveNetwork(t *testing.T) {
+	ipStoreTester.TestCarveNetwork(t, ipStoreTestConfig)
+}
+
+func TestRange(t *testing.T) {
+	ipStoreTester.TestRange(t, ipStoreTestConfig)
+}
+
+func TestHasNetwork(t *testing.T) {
+	ipStoreTester.TestHasNetwork(t, ipStoreTestConfig)
+}
+
+func TestCount(t *testing.T) {
+	ipStoreTester.TestCount(t, ipStoreTestConfig)
+}
+
+func TestExpiry(t *testing.T) {
+	ipStoreTester.TestExpiry(t, ipStoreTestConfig)
+}
+
+func TestBatch(t *testing.T) {
+	ipStoreTester.TestBatch(t, ipStoreTestConfig)
+}
+
+func TestBatchConcurrentReads(t *testing.T) {
+	ipStoreTester.TestBatchConcurrentReads(t, ipStoreTestConfig)
+}
+
+func TestBatchMoveConcurrentReads(t *testing.T) {
+	ipStoreTester.TestBatchMoveConcurrentReads(t, ipStoreTestConfig)
+}
+
+func TestReplaceAll(t *testing.T) {
+	ipStoreTester.TestReplaceAll(t, ipStoreTestConfig)
+}
+
+func TestReplaceAllConcurrentReads(t *testing.T) {
+	ipStoreTester.TestReplaceAllConcurrentReads(t, ipStoreTestConfig)
+}
+
+// onLookup makes fn be called before every lookup of an address in s, until
+// the returned function is called.
+func onLookup(s *ipStore, fn func(network bool)) func() {
+	hook := testHookLookup
+	testHookLookup = func(looked *ipStore, network bool) {
+		if looked == s {
+			fn(network)
+		}
+	}
+	return func() { testHookLookup = hook }
+}
+
+func TestLookupOrder(t *testing.T) {
+	is, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	s := is.(*ipStore)
+
+	var lookups []string
+	defer onLookup(s, func(network bool) {
+		if network {
+			lookups = append(lookups, "net")
+		} else {
+			lookups = append(lookups, "ip")
+		}
+	})()
+
+	// v4 is only contained in a network, v6 only individually.
+	require.Nil(t, s.AddIP(v6))
+	require.Nil(t, s.AddNetwork("12.13.14.0/24"))
+	miss1 := net.ParseIP("10.0.0.1")
+	miss2 := net.ParseIP("fd00::1")
+
+	var table = []struct {
+		all      bool
+		ips      []net.IP
+		expected bool
+		lookups  []string
+	}{
+		{false, []net.IP{v6, miss1}, true, []string{"ip"}},
+		{false, []net.IP{v4, v6}, true, []string{"ip", "ip"}},
+		{false, []net.IP{miss1, v4, miss2}, true, []string{"ip", "ip", "ip", "net", "net"}},
+		{false, []net.IP{miss1, miss2}, false, []string{"ip", "ip", "net", "net"}},
+		{false, nil, false, nil},
+		{true, []net.IP{miss1, v6}, false, []string{"ip", "net"}},
+		{true, []net.IP{v6, v4, miss1, miss2}, false, []string{"ip", "ip", "net", "ip", "net"}},
+		{true, []net.IP{v6, v4}, true, []string{"ip", "ip", "net"}},
+	}
+
+	for _, tt := range table {
+		lookups = nil
+		var match bool
+		if tt.all {
+			match, err = s.HasAllIPs(tt.ips)
+		} else {
+			match, err = s.HasAnyIP(tt.ips)
+		}
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, match, "all: %t, ips: %v", tt.all, tt.ips)
+		require.Equal(t, tt.lookups, lookups, "all: %t, ips: %v", tt.all, tt.ips)
+	}
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err)
+}
+
+func TestReap(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000000, 0))
+	is, err := (&ipStoreDriver{}).New(&store.DriverConfig{
+		Clock:  fake,
+		Config: map[string]interface{}{"reap_interval": "1m"},
+	})
+	require.Nil(t, err)
+
+	soon := fake.Now().Add(30 * time.Second)
+	require.Nil(t, is.AddIPWithExpiry(v4, soon))
+	require.Nil(t, is.AddIP(v6))
+	require.Nil(t, is.AddNetworkWithExpiry("192.168.22.0/24", soon))
+	require.Nil(t, is.AddNetwork("192.168.23.0/24"))
+
+	numIPs, err := is.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numIPs)
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		numIPs, err := is.NumIPs()
+		require.Nil(t, err)
+		numNetworks, err := is.NumNetworks()
+		require.Nil(t, err)
+
+		if numIPs == 1 && numNetworks == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "expired entries were not reaped")
+		time.Sleep(time.Millisecond)
+	}
+
+	match, err := is.HasAllIPs([]net.IP{v6, net.ParseIP("192.168.23.23")})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err)
+}
+
 func BenchmarkIPStore_AddV4(b *testing.B) {
 	ipStoreBenchmarker.AddV4(b, ipStoreTestConfig)
 }
@@ -198,3 +406,87 @@ func BenchmarkIPStore_RemoveNonExist1KV4Network(b *testing.B) {
 func BenchmarkIPStore_RemoveNonExist1KV6Network(b *testing.B) {
 	ipStoreBenchmarker.RemoveNonExist1KV6Network(b, ipStoreTestConfig)
 }
+
+func BenchmarkIPStore_Add100KV4NetworksSequential(b *testing.B) {
+	ipStoreBenchmarker.Add100KV4NetworksSequential(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_Add100KV4NetworksBatch(b *testing.B) {
+	ipStoreBenchmarker.Add100KV4NetworksBatch(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_Lookup1KV4Parallel(b *testing.B) {
+	ipStoreBenchmarker.Lookup1KV4Parallel(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_Lookup1KV6Parallel(b *testing.B) {
+	ipStoreBenchmarker.Lookup1KV6Parallel(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_Lookup1KV4ParallelUnsharded(b *testing.B) {
+	ipStoreBenchmarker.Lookup1KV4Parallel(b, unshardedIPStoreTestConfig)
+}
+
+func BenchmarkIPStore_Lookup1KV6ParallelUnsharded(b *testing.B) {
+	ipStoreBenchmarker.Lookup1KV6Parallel(b, unshardedIPStoreTestConfig)
+}
+
+func BenchmarkIPStore_LookupAnyV4V6(b *testing.B) {
+	ipStoreBenchmarker.LookupAnyV4V6(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_LookupAnyV4V6NonExist(b *testing.B) {
+	ipStoreBenchmarker.LookupAnyV4V6NonExist(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_LookupAllV4V6(b *testing.B) {
+	ipStoreBenchmarker.LookupAllV4V6(b, ipStoreTestConfig)
+}
+
+func BenchmarkIPStore_LookupAllV4V6FirstMiss(b *testing.B) {
+	ipStoreBenchmarker.LookupAllV4V6FirstMiss(b, ipStoreTestConfig)
+}
+
+func TestLookupCanceled(t *testing.T) {
+	is, err := (&ipStoreDriver{}).New(ipStoreTestConfig)
+	require.Nil(t, err)
+	s := is.(*ipStore)
+	require.Nil(t, s.AddIP(v6))
+	miss := net.ParseIP("10.0.0.1")
+
+	// lookup cancels the request while its first IP is looked up and
+	// returns the number of lookups.
+	lookup := func(all bool, ips []net.IP) (int, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		lookups := 0
+		defer onLookup(s, func(bool) {
+			lookups++
+			cancel()
+		})()
+
+		if all {
+			_, err := s.HasAllIPsContext(ctx, ips)
+			return lookups, err
+		}
+		_, err := s.HasAnyIPContext(ctx, ips)
+		return lookups, err
+	}
+
+	lookups, err := lookup(false, []net.IP{miss, v4})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, lookups)
+
+	lookups, err = lookup(true, []net.IP{v6, v6})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, lookups)
+
+	// Lookups without a context are unaffected.
+	match, err := s.HasAnyIP([]net.IP{miss, v6})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	errChan := s.Stop()
+	require.Nil(t, <-errChan)
+}
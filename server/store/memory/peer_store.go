@@ -5,8 +5,12 @@
 package memory
 
 import (
+	"container/list"
+	"context"
 	"encoding/binary"
-	"log"
+	"encoding/hex"
+	"fmt"
+	"math"
 	"net"
 	"runtime"
 	"sync"
@@ -15,6 +19,8 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server/store"
 )
 
@@ -25,26 +31,111 @@ func init() {
 type peerStoreDriver struct{}
 
 func (d *peerStoreDriver) New(storecfg *store.DriverConfig) (store.PeerStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	cfg, err := newPeerStoreConfig(storecfg)
 	if err != nil {
 		return nil, err
 	}
 
-	shards := make([]*peerShard, cfg.Shards)
-	for i := 0; i < cfg.Shards; i++ {
-		shards[i] = &peerShard{}
-		shards[i].swarms = make(map[chihaya.InfoHash]swarm)
+	s := newPeerStore(cfg.Shards, cfg.EventBuffer)
+	s.clock = storecfg.ClockOrReal()
+	s.downloadedPath = cfg.DownloadedFile
+	s.maxPeersPerSwarm = cfg.MaxPeersPerSwarm
+	s.swarmPeerLimits = cfg.swarmPeerLimits
+	s.swarmSizeHints = cfg.swarmSizeHints
+	s.stableSelection = cfg.PeerSelection == stablePeerSelection
+	s.seederRatio = cfg.SeederRatio
+	s.strictCrypto = cfg.RequireCrypto == strictCrypto
+
+	if s.downloadedPath != "" {
+		err = s.restoreDownloadedFile(s.downloadedPath)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &peerStore{
-		shards: shards,
-		closed: make(chan struct{}),
-	}, nil
+
+	go s.reap(cfg.ReapInterval, cfg.PeerLifetime)
+
+	return s, nil
 }
 
 type peerStoreConfig struct {
-	Shards int `yaml:"shards"`
+	// Shards is the number of partitions the swarms are spread across by
+	// their infohash. Each shard has its own lock, so announces to swarms of
+	// different shards do not block each other.
+	Shards       int           `yaml:"shards"`
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+
+	// DownloadedFile is the file the numbers of completed downloads are
+	// restored from when the store is created and saved to when it is
+	// stopped.
+	DownloadedFile string `yaml:"downloaded_file"`
+
+	// EventBuffer is the number of PeerEvents buffered per subscriber.
+	EventBuffer int `yaml:"event_buffer"`
+
+	// MaxPeersPerSwarm is the maximum number of peers of a swarm, counting
+	// both seeders and leechers of both address families. Swarms are not
+	// limited if it is zero.
+	MaxPeersPerSwarm int `yaml:"max_peers_per_swarm"`
+
+	// SwarmPeerLimits overrides MaxPeersPerSwarm for the swarms of the
+	// hex-encoded infohashes it contains.
+	SwarmPeerLimits map[string]int `yaml:"swarm_peer_limits"`
+
+	// swarmPeerLimits are the parsed SwarmPeerLimits.
+	swarmPeerLimits map[chihaya.InfoHash]int
+
+	// SwarmSizeHints holds the expected numbers of peers of the swarms of
+	// hex-encoded infohashes, e.g. of new popular releases. The leechers of
+	// both address families of these swarms are allocated for that many
+	// peers when the swarm is created, so that they do not have to grow
+	// while the first peers announce. Other swarms start small.
+	SwarmSizeHints map[string]int `yaml:"swarm_size_hints"`
+
+	// swarmSizeHints are the parsed SwarmSizeHints.
+	swarmSizeHints map[chihaya.InfoHash]int
+
+	// PeerSelection is the way peers are selected for announce responses,
+	// either randomPeerSelection or stablePeerSelection.
+	PeerSelection string `yaml:"peer_selection"`
+
+	// SeederRatio is the largest share of the peers returned to leechers
+	// that are seeders, if there are enough leechers to fill the rest, so
+	// that leechers still get to know each other. Leechers get seeders
+	// first if it is zero.
+	SeederRatio float64 `yaml:"seeder_ratio"`
+
+	// RequireCrypto is the way peers are selected for announcers that
+	// require encrypted connections, either preferCrypto or strictCrypto.
+	RequireCrypto string `yaml:"require_crypto"`
 }
 
+const (
+	// randomPeerSelection returns a random subset of a swarm to every
+	// announce.
+	randomPeerSelection = "random"
+
+	// stablePeerSelection returns the same subset of a swarm to every
+	// announce of a peer, for as long as the swarm does not change.
+	stablePeerSelection = "stable"
+)
+
+const (
+	// preferCrypto returns the peers that support encrypted connections
+	// first to announcers that require them, and fills up with the others.
+	preferCrypto = "prefer"
+
+	// strictCrypto only returns the peers that support encrypted
+	// connections to announcers that require them.
+	strictCrypto = "strict"
+)
+
 func newPeerStoreConfig(storecfg *store.DriverConfig) (*peerStoreConfig, error) {
 	bytes, err := yaml.Marshal(storecfg.Config)
 	if err != nil {
@@ -57,41 +148,401 @@ func newPeerStoreConfig(storecfg *store.DriverConfig) (*peerStoreConfig, error)
 		return nil, err
 	}
 
-	if cfg.Shards < 1 {
+	if cfg.Shards < 0 {
+		return nil, fmt.Errorf("memory: invalid PeerStore config: number of shards must be positive, got %d", cfg.Shards)
+	}
+	if cfg.Shards == 0 {
 		cfg.Shards = 1
 	}
+	if cfg.PeerLifetime <= 0 {
+		cfg.PeerLifetime = 30 * time.Minute
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	if cfg.EventBuffer < 0 {
+		return nil, fmt.Errorf("memory: invalid PeerStore config: event buffer must be positive, got %d", cfg.EventBuffer)
+	}
+	if cfg.EventBuffer == 0 {
+		cfg.EventBuffer = defaultEventBuffer
+	}
+	switch cfg.PeerSelection {
+	case "":
+		cfg.PeerSelection = randomPeerSelection
+	case randomPeerSelection, stablePeerSelection:
+	default:
+		return nil, fmt.Errorf("memory: invalid PeerStore config: unknown peer selection %q", cfg.PeerSelection)
+	}
+	switch cfg.RequireCrypto {
+	case "":
+		cfg.RequireCrypto = preferCrypto
+	case preferCrypto, strictCrypto:
+	default:
+		return nil, fmt.Errorf("memory: invalid PeerStore config: unknown require crypto mode %q", cfg.RequireCrypto)
+	}
+	if cfg.SeederRatio < 0 || cfg.SeederRatio >= 1 {
+		return nil, fmt.Errorf("memory: invalid PeerStore config: seeder ratio must be at least 0 and less than 1, got %v", cfg.SeederRatio)
+	}
+	if cfg.MaxPeersPerSwarm < 0 {
+		return nil, fmt.Errorf("memory: invalid PeerStore config: max peers per swarm must be positive, got %d", cfg.MaxPeersPerSwarm)
+	}
+
+	cfg.swarmPeerLimits = make(map[chihaya.InfoHash]int, len(cfg.SwarmPeerLimits))
+	for hexInfoHash, limit := range cfg.SwarmPeerLimits {
+		b, err := hex.DecodeString(hexInfoHash)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("memory: invalid PeerStore config: malformed infohash in swarm peer limits: %q", hexInfoHash)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("memory: invalid PeerStore config: peer limit of %s must be positive, got %d", hexInfoHash, limit)
+		}
+		cfg.swarmPeerLimits[chihaya.InfoHashFromString(string(b))] = limit
+	}
+
+	cfg.swarmSizeHints = make(map[chihaya.InfoHash]int, len(cfg.SwarmSizeHints))
+	for hexInfoHash, hint := range cfg.SwarmSizeHints {
+		b, err := hex.DecodeString(hexInfoHash)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("memory: invalid PeerStore config: malformed infohash in swarm size hints: %q", hexInfoHash)
+		}
+		if hint < 0 {
+			return nil, fmt.Errorf("memory: invalid PeerStore config: size hint of %s must be positive, got %d", hexInfoHash, hint)
+		}
+		cfg.swarmSizeHints[chihaya.InfoHashFromString(string(b))] = hint
+	}
+
 	return &cfg, nil
 }
 
+// defaultEventBuffer is the number of PeerEvents buffered per subscriber if
+// none is configured.
+const defaultEventBuffer = 1024
+
+// newPeerStore returns an empty peerStore with the given number of shards,
+// which buffers eventBuffer PeerEvents per subscriber and tells the time with
+// clock.Real.
+func newPeerStore(shards, eventBuffer int) *peerStore {
+	s := &peerStore{
+		PeerEventFeed: store.NewPeerEventFeed(eventBuffer),
+		shards:        make([]*peerShard, shards),
+		closed:        make(chan struct{}),
+		reaped:        make(chan struct{}),
+		clock:         clock.Real,
+	}
+	for i := range s.shards {
+		s.shards[i] = &peerShard{
+			swarms:     make(map[chihaya.InfoHash]swarm),
+			downloaded: make(map[chihaya.InfoHash]uint64),
+		}
+	}
+
+	return s
+}
+
 type serializedPeer string
 
 type peerShard struct {
 	swarms map[chihaya.InfoHash]swarm
+
+	// downloaded holds the number of completed downloads per infohash. It
+	// is kept apart from the swarms, which are deleted once they are empty.
+	downloaded map[chihaya.InfoHash]uint64
 	sync.RWMutex
 }
 
+// swarm holds the peers of an infohash. IPv4 and IPv6 peers are kept in
+// separate pools, so that announcers are only handed peers they can reach.
 type swarm struct {
+	v4 peerPool
+	v6 peerPool
+
+	// completed holds the IDs of the seeders that have been counted as a
+	// completed download, so that a dual-stacked peer graduating in both
+	// pools is only counted once.
+	completed map[chihaya.PeerID]struct{}
+}
+
+type peerPool struct {
 	// map serialized peer to mtime
 	seeders  map[serializedPeer]int64
 	leechers map[serializedPeer]int64
+
+	// keys maps the keys peers announced with to the peers, and keyOf maps
+	// them back, see chihaya.Peer.Key.
+	keys  map[string]serializedPeer
+	keyOf map[serializedPeer]string
+
+	// states holds the states of the peers, see store.PeerStateStore.
+	states map[serializedPeer]store.PeerState
+
+	// ids maps peer IDs to the peers that announced with them, most recently
+	// added last, so that the address of a peer in the other family is found
+	// without scanning the pool. Stale addresses of a peer share its ID.
+	ids map[chihaya.PeerID][]serializedPeer
+
+	// crypto holds the peers that support encrypted connections, see
+	// chihaya.Peer.Crypto.
+	crypto map[serializedPeer]struct{}
+
+	// recency is shared by both pools of a swarm with a limit, and nil
+	// otherwise.
+	recency *recency
+}
+
+// recency orders the peers of a swarm by their last announces, so that the
+// peer that announced least recently is evicted without scanning the swarm.
+// Peers always announce at the current time, so an announce moves a peer to
+// the end of the order.
+type recency struct {
+	order    *list.List // of serializedPeer, least recently announced first
+	elements map[serializedPeer]*list.Element
+}
+
+func newRecency() *recency {
+	return &recency{
+		order:    list.New(),
+		elements: make(map[serializedPeer]*list.Element),
+	}
+}
+
+// touch moves pk to the end of the order, adding it if necessary.
+func (r *recency) touch(pk serializedPeer) {
+	if r == nil {
+		return
+	}
+	if e, ok := r.elements[pk]; ok {
+		r.order.MoveToBack(e)
+		return
+	}
+	r.elements[pk] = r.order.PushBack(pk)
+}
+
+// remove deletes pk from the order.
+func (r *recency) remove(pk serializedPeer) {
+	if r == nil {
+		return
+	}
+	if e, ok := r.elements[pk]; ok {
+		r.order.Remove(e)
+		delete(r.elements, pk)
+	}
+}
+
+// stalest returns the peer that announced least recently. The order must not
+// be empty.
+func (r *recency) stalest() serializedPeer {
+	return r.order.Front().Value.(serializedPeer)
+}
+
+// newPeerPool returns an empty peerPool with room for hint leechers, which
+// orders its peers by r.
+func newPeerPool(hint int, r *recency) peerPool {
+	return peerPool{
+		seeders:  make(map[serializedPeer]int64),
+		leechers: make(map[serializedPeer]int64, hint),
+		keys:     make(map[string]serializedPeer),
+		keyOf:    make(map[serializedPeer]string),
+		states:   make(map[serializedPeer]store.PeerState),
+		ids:      make(map[chihaya.PeerID][]serializedPeer),
+		crypto:   make(map[serializedPeer]struct{}),
+		recency:  r,
+	}
+}
+
+// newSwarm returns an empty swarm whose pools have room for hint leechers
+// each. The peers of a limited swarm are ordered by their last announces.
+func newSwarm(hint int, limited bool) swarm {
+	var r *recency
+	if limited {
+		r = newRecency()
+	}
+	return swarm{
+		v4:        newPeerPool(hint, r),
+		v6:        newPeerPool(hint, r),
+		completed: make(map[chihaya.PeerID]struct{}),
+	}
+}
+
+// setKey records that pk announced with key, which replaces the key it
+// announced with before. An empty key only forgets the previous one.
+func (pp peerPool) setKey(pk serializedPeer, key string) {
+	if old, ok := pp.keyOf[pk]; ok && old != key {
+		pp.forgetKey(pk)
+	}
+	if key != "" {
+		pp.keys[key] = pk
+		pp.keyOf[pk] = key
+	}
+}
+
+// forgetKey deletes the key of pk, if it announced with one.
+func (pp peerPool) forgetKey(pk serializedPeer) {
+	if key, ok := pp.keyOf[pk]; ok {
+		delete(pp.keys, key)
+		delete(pp.keyOf, pk)
+	}
+}
+
+// addID indexes pk by its peer ID, unless it already is.
+func (pp peerPool) addID(pk serializedPeer) {
+	id := chihaya.PeerIDFromString(string(pk[:20]))
+	for _, indexed := range pp.ids[id] {
+		if indexed == pk {
+			return
+		}
+	}
+	pp.ids[id] = append(pp.ids[id], pk)
+}
+
+// forgetID deletes pk from the index of peer IDs.
+func (pp peerPool) forgetID(pk serializedPeer) {
+	id := chihaya.PeerIDFromString(string(pk[:20]))
+	indexed := pp.ids[id]
+	for i, other := range indexed {
+		if other != pk {
+			continue
+		}
+		if len(indexed) == 1 {
+			delete(pp.ids, id)
+		} else {
+			pp.ids[id] = append(indexed[:i:i], indexed[i+1:]...)
+		}
+		return
+	}
+}
+
+// setCrypto records whether pk announced support for encrypted connections.
+func (pp peerPool) setCrypto(pk serializedPeer, c chihaya.Crypto) {
+	if c.Supported() {
+		pp.crypto[pk] = struct{}{}
+	} else {
+		delete(pp.crypto, pk)
+	}
+}
+
+// forget deletes the key, the state, the peer ID, the crypto support and the
+// recency of pk. It must be called whenever pk is deleted from the pool.
+func (pp peerPool) forget(pk serializedPeer) {
+	pp.forgetKey(pk)
+	pp.forgetID(pk)
+	delete(pp.states, pk)
+	delete(pp.crypto, pk)
+	pp.recency.remove(pk)
+}
+
+// lookup returns the serialized form p is stored under: the peer that
+// announced with the key of p, if any, and p itself otherwise.
+func (pp peerPool) lookup(p chihaya.Peer) serializedPeer {
+	if pk, ok := pp.keys[p.Key]; ok && p.Key != "" {
+		return pk
+	}
+	return peerKey(p)
+}
+
+// list returns the seeders and leechers of the pool.
+func (pp peerPool) list() []store.SwarmPeer {
+	peers := make([]store.SwarmPeer, 0, len(pp.seeders)+len(pp.leechers))
+	for pk, mtime := range pp.seeders {
+		peers = append(peers, store.SwarmPeer{Peer: decodePeerKey(pk), Seeder: true, LastAnnounce: time.Unix(0, mtime)})
+	}
+	for pk, mtime := range pp.leechers {
+		peers = append(peers, store.SwarmPeer{Peer: decodePeerKey(pk), LastAnnounce: time.Unix(0, mtime)})
+	}
+	return peers
+}
+
+// pool returns the pool of the address family of ip.
+func (sw swarm) pool(ip net.IP) peerPool {
+	if ip.To4() != nil {
+		return sw.v4
+	}
+	return sw.v6
+}
+
+func (sw swarm) numSeeders() int {
+	return len(sw.v4.seeders) + len(sw.v6.seeders)
+}
+
+func (sw swarm) numLeechers() int {
+	return len(sw.v4.leechers) + len(sw.v6.leechers)
+}
+
+func (sw swarm) empty() bool {
+	return sw.numSeeders()|sw.numLeechers() == 0
 }
 
 type peerStore struct {
+	// PeerEventFeed provides Subscribe. Events are published while the
+	// shard of the swarm is locked, so that they are ordered per swarm.
+	*store.PeerEventFeed
+
 	shards []*peerShard
 	closed chan struct{}
+	reaped chan struct{}
+
+	// downloadedPath is the file the numbers of completed downloads are
+	// saved to when the store is stopped. They are not saved if it is empty.
+	downloadedPath string
+
+	// maxPeersPerSwarm and swarmPeerLimits limit the number of peers of a
+	// swarm, see peerStoreConfig.
+	maxPeersPerSwarm int
+	swarmPeerLimits  map[chihaya.InfoHash]int
+
+	// swarmSizeHints are the numbers of peers swarms are allocated for,
+	// see peerStoreConfig.
+	swarmSizeHints map[chihaya.InfoHash]int
+
+	// stableSelection is true if peers are selected with a stablePicker
+	// instead of pickRandom.
+	stableSelection bool
+
+	// seederRatio biases the peers returned to leechers, see
+	// peerStoreConfig.
+	seederRatio float64
+
+	// strictCrypto is true if announcers that require encrypted
+	// connections only get the peers that support them.
+	strictCrypto bool
+
+	// clock tells the time peers announce at and ticks the reaper.
+	clock clock.Clock
 }
 
-var _ store.PeerStore = &peerStore{}
+var (
+	_ store.PeerStore          = &peerStore{}
+	_ store.ContextPeerStore   = &peerStore{}
+	_ store.SwarmSizeWalker    = &peerStore{}
+	_ store.SwarmPeerLister    = &peerStore{}
+	_ store.SwarmMemberChecker = &peerStore{}
+)
 
+// shardIndex returns the index of the shard the swarm of infoHash belongs to,
+// using the FNV-1a hash of the infohash.
+//
+// All of its bytes are hashed, because infohashes of private trackers or
+// clients under test need not be uniformly distributed.
 func (s *peerStore) shardIndex(infoHash chihaya.InfoHash) uint32 {
-	return binary.BigEndian.Uint32(infoHash[:4]) % uint32(len(s.shards))
+	h := uint32(2166136261)
+	for _, b := range infoHash {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h % uint32(len(s.shards))
 }
 
+// peerKey serializes p. IPv4 addresses are always serialized in their 4-byte
+// form, so that a peer is found regardless of the representation of its IP.
 func peerKey(p chihaya.Peer) serializedPeer {
-	b := make([]byte, 20+2+len(p.IP))
+	ip := p.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b := make([]byte, 20+2+len(ip))
 	copy(b[:20], p.ID[:])
 	binary.BigEndian.PutUint16(b[20:22], p.Port)
-	copy(b[22:], p.IP)
+	copy(b[22:], ip)
 
 	return serializedPeer(b)
 }
@@ -105,25 +556,7 @@ func decodePeerKey(pk serializedPeer) chihaya.Peer {
 }
 
 func (s *peerStore) PutSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error {
-	select {
-	case <-s.closed:
-		panic("attempted to interact with stopped store")
-	default:
-	}
-
-	shard := s.shards[s.shardIndex(infoHash)]
-	shard.Lock()
-
-	if _, ok := shard.swarms[infoHash]; !ok {
-		shard.swarms[infoHash] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
-	}
-
-	shard.swarms[infoHash].seeders[peerKey(p)] = time.Now().UnixNano()
-
-	shard.Unlock()
+	s.putPeer(infoHash, p, true)
 	return nil
 }
 
@@ -135,7 +568,6 @@ func (s *peerStore) DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) erro
 	}
 
 	shard := s.shards[s.shardIndex(infoHash)]
-	pk := peerKey(p)
 	shard.Lock()
 
 	if _, ok := shard.swarms[infoHash]; !ok {
@@ -143,14 +575,20 @@ func (s *peerStore) DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) erro
 		return store.ErrResourceDoesNotExist
 	}
 
-	if _, ok := shard.swarms[infoHash].seeders[pk]; !ok {
+	pool := shard.swarms[infoHash].pool(p.IP)
+	pk := pool.lookup(p)
+	if _, ok := pool.seeders[pk]; !ok {
 		shard.Unlock()
 		return store.ErrResourceDoesNotExist
 	}
 
-	delete(shard.swarms[infoHash].seeders, pk)
+	p = decodePeerKey(pk)
+	delete(pool.seeders, pk)
+	pool.forget(pk)
+	delete(shard.swarms[infoHash].completed, p.ID)
+	s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p, Seeder: true})
 
-	if len(shard.swarms[infoHash].seeders)|len(shard.swarms[infoHash].leechers) == 0 {
+	if shard.swarms[infoHash].empty() {
 		delete(shard.swarms, infoHash)
 	}
 
@@ -159,6 +597,19 @@ func (s *peerStore) DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) erro
 }
 
 func (s *peerStore) PutLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	s.putPeer(infoHash, p, false)
+	return nil
+}
+
+// putPeer adds p to the seeders or leechers of the swarm of infoHash, or
+// updates its announce time if it is already one of them.
+//
+// A peer that is in the other list of its pool is moved, without making room
+// for it, because the size of the swarm does not change. Leechers that are
+// moved to the seeders are not counted as a completed download, which only
+// GraduateLeecher does. A peer that announced with the key of p under another
+// address or port is replaced by p.
+func (s *peerStore) putPeer(infoHash chihaya.InfoHash, p chihaya.Peer, seeder bool) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with stopped store")
@@ -169,16 +620,66 @@ func (s *peerStore) PutLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error
 	shard.Lock()
 
 	if _, ok := shard.swarms[infoHash]; !ok {
-		shard.swarms[infoHash] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
+		shard.swarms[infoHash] = newSwarm(s.swarmSizeHints[infoHash], s.swarmPeerLimit(infoHash) > 0)
 	}
 
-	shard.swarms[infoHash].leechers[peerKey(p)] = time.Now().UnixNano()
+	sw := shard.swarms[infoHash]
+	pool := sw.pool(p.IP)
+	peers, others := pool.leechers, pool.seeders
+	if seeder {
+		peers, others = others, peers
+	}
+
+	pk, key, crypto := peerKey(p), p.Key, p.Crypto
+	p.Key, p.Crypto = "", chihaya.CryptoNone
+	s.replaceKeyed(infoHash, sw, pool, key, pk, p.ID)
+
+	if _, ok := others[pk]; ok {
+		delete(others, pk)
+		if !seeder {
+			delete(sw.completed, p.ID)
+		}
+		s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p, Seeder: !seeder})
+		s.Publish(store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: seeder})
+	} else if _, ok := peers[pk]; !ok {
+		s.makeRoom(infoHash, sw)
+		s.Publish(store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: seeder})
+	}
+	peers[pk] = s.clock.Now().UnixNano()
+	pool.recency.touch(pk)
+	pool.addID(pk)
+	pool.setKey(pk, key)
+	pool.setCrypto(pk, crypto)
 
 	shard.Unlock()
-	return nil
+}
+
+// replaceKeyed deletes the peer of pool that announced with key, unless it is
+// pk, so that the client that announced again from another address or port
+// is not in the swarm twice. Its state is moved to pk, and its completed
+// download is kept if its peer ID did not change. replaceKeyed reports whether
+// the deleted peer was a leecher.
+//
+// The shard of the swarm must be locked.
+func (s *peerStore) replaceKeyed(infoHash chihaya.InfoHash, sw swarm, pool peerPool, key string, pk serializedPeer, id chihaya.PeerID) (leecher bool) {
+	old, ok := pool.keys[key]
+	if key == "" || !ok || old == pk {
+		return false
+	}
+
+	p := decodePeerKey(old)
+	_, seeder := pool.seeders[old]
+	delete(pool.seeders, old)
+	delete(pool.leechers, old)
+	if state, ok := pool.states[old]; ok {
+		pool.states[pk] = state
+	}
+	pool.forget(old)
+	if seeder && p.ID != id {
+		delete(sw.completed, p.ID)
+	}
+	s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p, Seeder: seeder})
+	return !seeder
 }
 
 func (s *peerStore) DeleteLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
@@ -189,7 +690,6 @@ func (s *peerStore) DeleteLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) err
 	}
 
 	shard := s.shards[s.shardIndex(infoHash)]
-	pk := peerKey(p)
 	shard.Lock()
 
 	if _, ok := shard.swarms[infoHash]; !ok {
@@ -197,14 +697,19 @@ func (s *peerStore) DeleteLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) err
 		return store.ErrResourceDoesNotExist
 	}
 
-	if _, ok := shard.swarms[infoHash].leechers[pk]; !ok {
+	pool := shard.swarms[infoHash].pool(p.IP)
+	pk := pool.lookup(p)
+	if _, ok := pool.leechers[pk]; !ok {
 		shard.Unlock()
 		return store.ErrResourceDoesNotExist
 	}
 
-	delete(shard.swarms[infoHash].leechers, pk)
+	p = decodePeerKey(pk)
+	delete(pool.leechers, pk)
+	pool.forget(pk)
+	s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p})
 
-	if len(shard.swarms[infoHash].seeders)|len(shard.swarms[infoHash].leechers) == 0 {
+	if shard.swarms[infoHash].empty() {
 		delete(shard.swarms, infoHash)
 	}
 
@@ -219,25 +724,101 @@ func (s *peerStore) GraduateLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) e
 	default:
 	}
 
-	key := peerKey(p)
+	pk, key, crypto := peerKey(p), p.Key, p.Crypto
+	p.Key, p.Crypto = "", chihaya.CryptoNone
 	shard := s.shards[s.shardIndex(infoHash)]
 	shard.Lock()
 
 	if _, ok := shard.swarms[infoHash]; !ok {
-		shard.swarms[infoHash] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
+		shard.swarms[infoHash] = newSwarm(s.swarmSizeHints[infoHash], s.swarmPeerLimit(infoHash) > 0)
 	}
 
-	delete(shard.swarms[infoHash].leechers, key)
+	sw := shard.swarms[infoHash]
+	pool := sw.pool(p.IP)
+
+	replacedLeecher := s.replaceKeyed(infoHash, sw, pool, key, pk, p.ID)
+	_, leecher := pool.leechers[pk]
+	_, seeder := pool.seeders[pk]
+	switch {
+	case leecher:
+		delete(pool.leechers, pk)
+		s.countDownload(infoHash, sw, p)
+	case seeder:
+	case replacedLeecher:
+		// A leecher that announced with the key of p from another address
+		// or port moved to p, and completed its download there.
+		s.Publish(store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p})
+		s.countDownload(infoHash, sw, p)
+	default:
+		s.makeRoom(infoHash, sw)
+		s.Publish(store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: true})
+	}
 
-	shard.swarms[infoHash].seeders[key] = time.Now().UnixNano()
+	pool.seeders[pk] = s.clock.Now().UnixNano()
+	pool.recency.touch(pk)
+	pool.addID(pk)
+	pool.setKey(pk, key)
+	pool.setCrypto(pk, crypto)
 
 	shard.Unlock()
 	return nil
 }
 
+// countDownload counts the completed download of the leecher p, unless a
+// peer with its ID has already been counted.
+//
+// The shard of the swarm must be locked.
+func (s *peerStore) countDownload(infoHash chihaya.InfoHash, sw swarm, p chihaya.Peer) {
+	shard := s.shards[s.shardIndex(infoHash)]
+	if _, ok := sw.completed[p.ID]; !ok {
+		sw.completed[p.ID] = struct{}{}
+		shard.downloaded[infoHash]++
+	}
+	s.Publish(store.PeerEvent{Type: store.PeerCompleted, InfoHash: infoHash, Peer: p, Seeder: true})
+}
+
+// swarmPeerLimit returns the maximum number of peers of the swarm of
+// infoHash, or zero if it is not limited.
+func (s *peerStore) swarmPeerLimit(infoHash chihaya.InfoHash) int {
+	if limit, ok := s.swarmPeerLimits[infoHash]; ok {
+		return limit
+	}
+	return s.maxPeersPerSwarm
+}
+
+// makeRoom evicts the peers of the swarm of infoHash that announced least
+// recently until another peer can be added without exceeding its limit.
+//
+// The shard of the swarm must be locked.
+func (s *peerStore) makeRoom(infoHash chihaya.InfoHash, sw swarm) {
+	limit := s.swarmPeerLimit(infoHash)
+	if limit == 0 {
+		return
+	}
+
+	for sw.numSeeders()+sw.numLeechers() >= limit {
+		s.evictStalest(infoHash, sw)
+	}
+}
+
+// evictStalest deletes the peer of the limited swarm sw that announced least
+// recently.
+func (s *peerStore) evictStalest(infoHash chihaya.InfoHash, sw swarm) {
+	stalest := sw.v4.recency.stalest()
+	p := decodePeerKey(stalest)
+	pool := sw.pool(p.IP)
+
+	_, seeder := pool.seeders[stalest]
+	if seeder {
+		delete(pool.seeders, stalest)
+		delete(sw.completed, p.ID)
+	} else {
+		delete(pool.leechers, stalest)
+	}
+	pool.forget(stalest)
+	s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p, Seeder: seeder})
+}
+
 func (s *peerStore) CollectGarbage(cutoff time.Time) error {
 	select {
 	case <-s.closed:
@@ -245,7 +826,18 @@ func (s *peerStore) CollectGarbage(cutoff time.Time) error {
 	default:
 	}
 
-	log.Printf("memory: collecting garbage. Cutoff time: %s", cutoff.String())
+	log.Debug("memory: collecting garbage", "cutoff", cutoff)
+	s.collectGarbage(cutoff)
+
+	return nil
+}
+
+// collectGarbage deletes all peers that have not announced since cutoff,
+// along with the swarms that become empty.
+//
+// Each shard is only locked for one swarm at a time, so announces are not
+// blocked for long.
+func (s *peerStore) collectGarbage(cutoff time.Time) {
 	cutoffUnix := cutoff.UnixNano()
 	for _, shard := range s.shards {
 		shard.RLock()
@@ -259,19 +851,33 @@ func (s *peerStore) CollectGarbage(cutoff time.Time) error {
 		for _, infohash := range infohashes {
 			shard.Lock()
 
-			for peerKey, mtime := range shard.swarms[infohash].leechers {
-				if mtime <= cutoffUnix {
-					delete(shard.swarms[infohash].leechers, peerKey)
-				}
+			sw, ok := shard.swarms[infohash]
+			if !ok {
+				shard.Unlock()
+				continue
 			}
 
-			for peerKey, mtime := range shard.swarms[infohash].seeders {
-				if mtime <= cutoffUnix {
-					delete(shard.swarms[infohash].seeders, peerKey)
+			for _, pool := range []peerPool{sw.v4, sw.v6} {
+				for peerKey, mtime := range pool.leechers {
+					if mtime <= cutoffUnix {
+						delete(pool.leechers, peerKey)
+						pool.forget(peerKey)
+						s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infohash, Peer: decodePeerKey(peerKey)})
+					}
+				}
+
+				for peerKey, mtime := range pool.seeders {
+					if mtime <= cutoffUnix {
+						p := decodePeerKey(peerKey)
+						delete(pool.seeders, peerKey)
+						pool.forget(peerKey)
+						delete(sw.completed, p.ID)
+						s.Publish(store.PeerEvent{Type: store.PeerLeft, InfoHash: infohash, Peer: p, Seeder: true})
+					}
 				}
 			}
 
-			if len(shard.swarms[infohash].seeders)|len(shard.swarms[infohash].leechers) == 0 {
+			if sw.empty() {
 				delete(shard.swarms, infohash)
 			}
 
@@ -281,87 +887,251 @@ func (s *peerStore) CollectGarbage(cutoff time.Time) error {
 
 		runtime.Gosched()
 	}
+}
 
-	return nil
+// reap periodically deletes peers that have not announced for lifetime, until
+// the store is stopped.
+func (s *peerStore) reap(interval, lifetime time.Duration) {
+	defer close(s.reaped)
+
+	t := s.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C():
+			s.collectGarbage(s.clock.Now().Add(-lifetime))
+		}
+	}
 }
 
-func (s *peerStore) AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer) (peers, peers6 []chihaya.Peer, err error) {
+func (s *peerStore) AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	return s.AnnouncePeersContext(context.Background(), infoHash, seeder, numWant, peer4, peer6, policy)
+}
+
+// AnnouncePeersContext checks ctx before and after waiting for the lock of
+// the shard, which may be held by writers for a while.
+func (s *peerStore) AnnouncePeersContext(ctx context.Context, infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with stopped store")
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 	shard := s.shards[s.shardIndex(infoHash)]
 	shard.RLock()
+	if err := ctx.Err(); err != nil {
+		shard.RUnlock()
+		return nil, nil, err
+	}
 
-	if _, ok := shard.swarms[infoHash]; !ok {
+	sw, ok := shard.swarms[infoHash]
+	if !ok {
 		shard.RUnlock()
 		return nil, nil, store.ErrResourceDoesNotExist
 	}
 
+	sel := selection{pick: pickRandom, seederRatio: s.seederRatio, strictCrypto: s.strictCrypto}
+	if s.stableSelection {
+		announcerID := peer4.ID
+		if peer4.IP == nil {
+			announcerID = peer6.ID
+		}
+		sel.pick = stablePicker(infoHash, announcerID)
+	}
+
+	if policy == store.BridgeFamilies {
+		// Complete the address families of a dual-stacked announcer that
+		// only announced one of them.
+		if peer4.IP == nil && peer6.IP != nil {
+			peer4, _ = sw.v4.find(peer6.ID)
+			peer4.Crypto = peer6.Crypto
+		} else if peer6.IP == nil && peer4.IP != nil {
+			peer6, _ = sw.v6.find(peer4.ID)
+			peer6.Crypto = peer4.Crypto
+		}
+
+		if peer4.IP != nil && peer6.IP != nil {
+			peers, peers6 = sw.announceBridged(seeder, numWant, peer4, peer6, sel)
+			sw.v4.markCrypto(peers)
+			sw.v6.markCrypto(peers6)
+			shard.RUnlock()
+			return
+		}
+	}
+
+	if peer4.IP != nil {
+		peers = sw.v4.announcePeers(seeder, numWant, peer4, sel)
+		sw.v4.markCrypto(peers)
+	}
+	if peer6.IP != nil {
+		peers6 = sw.v6.announcePeers(seeder, numWant, peer6, sel)
+		sw.v6.markCrypto(peers6)
+	}
+
+	shard.RUnlock()
+	return
+}
+
+// markCrypto sets the Crypto of the peers of the pool that support encrypted
+// connections to CryptoSupported.
+func (pp peerPool) markCrypto(peers []chihaya.Peer) {
+	if len(pp.crypto) == 0 {
+		return
+	}
+	for i := range peers {
+		if _, ok := pp.crypto[peerKey(peers[i])]; ok {
+			peers[i].Crypto = chihaya.CryptoSupported
+		}
+	}
+}
+
+// announcePeers returns up to numWant peers from the pool for an announce by
+// announcer, which are selected by sel.
+//
+// If the seederRatio of sel is not zero, leechers get seeders for at most
+// seederRatio of numWant while there are enough leechers to fill the rest,
+// and seeders that announce without being marked as seeders get leechers
+// first. Announcers that require encrypted connections get the peers that
+// support them first.
+func (pp peerPool) announcePeers(seeder bool, numWant int, announcer chihaya.Peer, sel selection) []chihaya.Peer {
+	if announcer.Crypto != chihaya.CryptoRequired {
+		return pp.selectPeers(seeder, numWant, announcer, sel.pick, sel.seederRatio)
+	}
+
+	// The peers that support encryption are selected as if the others were
+	// not there, and the others fill up as far as sel allows.
+	supporting, others := pp.splitCrypto()
+	peers := supporting.selectPeers(seeder, numWant, announcer, sel.pick, sel.seederRatio)
+	if sel.strictCrypto {
+		return peers
+	}
+	return append(peers, others.selectPeers(seeder, numWant-len(peers), announcer, sel.pick, sel.seederRatio)...)
+}
+
+// splitCrypto returns the seeders and leechers of the pool that support
+// encrypted connections and the others, as pools of their own.
+func (pp peerPool) splitCrypto() (supporting, others peerPool) {
+	supporting.seeders, others.seeders = pp.split(pp.seeders)
+	supporting.leechers, others.leechers = pp.split(pp.leechers)
+	return
+}
+
+func (pp peerPool) split(peers map[serializedPeer]int64) (supporting, others map[serializedPeer]int64) {
+	supporting, others = make(map[serializedPeer]int64), make(map[serializedPeer]int64)
+	for pk, mtime := range peers {
+		if _, ok := pp.crypto[pk]; ok {
+			supporting[pk] = mtime
+		} else {
+			others[pk] = mtime
+		}
+	}
+	return
+}
+
+// selectPeers returns up to numWant peers from the pool for an announce by
+// announcer, which are selected by pick and biased by seederRatio, see
+// announcePeers.
+func (pp peerPool) selectPeers(seeder bool, numWant int, announcer chihaya.Peer, pick peerPicker, seederRatio float64) []chihaya.Peer {
 	if seeder {
 		// Append leechers as possible.
-		leechers := shard.swarms[infoHash].leechers
-		for p := range leechers {
-			decodedPeer := decodePeerKey(p)
-			if numWant == 0 {
-				break
-			}
+		return pick(nil, pp.leechers, numWant, announcer)
+	}
+
+	if seederRatio == 0 {
+		// Append as many seeders as possible, then leechers until we
+		// reach numWant.
+		peers := pick(nil, pp.seeders, numWant, announcer)
+		return pick(peers, pp.leechers, numWant-len(peers), announcer)
+	}
 
-			if decodedPeer.IP.To4() == nil {
-				peers6 = append(peers6, decodedPeer)
-			} else {
-				peers = append(peers, decodedPeer)
+	if _, ok := pp.seeders[peerKey(announcer)]; ok {
+		// Seeders have nothing to download from other seeders.
+		peers := pick(nil, pp.leechers, numWant, announcer)
+		return pick(peers, pp.seeders, numWant-len(peers), announcer)
+	}
+
+	// The seeders are picked once, so that the ones filling in for missing
+	// leechers are not picked twice.
+	seeders := pick(nil, pp.seeders, numWant, announcer)
+	quota := int(math.Ceil(seederRatio * float64(numWant)))
+	if quota > len(seeders) {
+		quota = len(seeders)
+	}
+	peers := pick(seeders[:quota:quota], pp.leechers, numWant-quota, announcer)
+
+	extra := numWant - len(peers)
+	if extra > len(seeders)-quota {
+		extra = len(seeders) - quota
+	}
+	return append(peers, seeders[quota:quota+extra]...)
+}
+
+// announceBridged returns up to numWant IPv4 and IPv6 peers for an announce
+// by a dual-stacked announcer. The IPv6 addresses of the returned IPv4 peers
+// come first, so that the announcer learns both addresses of the peers that
+// are dual-stacked, too.
+func (sw swarm) announceBridged(seeder bool, numWant int, peer4, peer6 chihaya.Peer, sel selection) (peers, peers6 []chihaya.Peer) {
+	peers = sw.v4.announcePeers(seeder, numWant, peer4, sel)
+	strict := sel.strictCrypto && peer6.Crypto == chihaya.CryptoRequired
+
+	picked := make(map[chihaya.PeerID]struct{}, len(peers))
+	for _, p := range peers {
+		picked[p.ID] = struct{}{}
+	}
+
+	matched := make(map[serializedPeer]struct{})
+	match := func(candidates map[serializedPeer]int64) {
+		for pk := range candidates {
+			if len(peers6) == numWant {
+				return
 			}
-			numWant--
-		}
-	} else {
-		// Append as many seeders as possible.
-		seeders := shard.swarms[infoHash].seeders
-		for p := range seeders {
-			decodedPeer := decodePeerKey(p)
-			if numWant == 0 {
-				break
+
+			if _, ok := sw.v6.crypto[pk]; strict && !ok {
+				continue
 			}
 
-			if decodedPeer.IP.To4() == nil {
-				peers6 = append(peers6, decodedPeer)
-			} else {
-				peers = append(peers, decodedPeer)
+			p := decodePeerKey(pk)
+			if _, ok := picked[p.ID]; ok && !p.Equal(peer6) {
+				peers6 = append(peers6, p)
+				matched[pk] = struct{}{}
 			}
-			numWant--
 		}
+	}
+	if !seeder {
+		match(sw.v6.seeders)
+	}
+	match(sw.v6.leechers)
 
-		// Append leechers until we reach numWant.
-		leechers := shard.swarms[infoHash].leechers
-		if numWant > 0 {
-			for p := range leechers {
-				decodedPeer := decodePeerKey(p)
-				if numWant == 0 {
-					break
-				}
-
-				if decodedPeer.IP.To4() == nil {
-					if decodedPeer.Equal(peer6) {
-						continue
-					}
-					peers6 = append(peers6, decodedPeer)
-				} else {
-					if decodedPeer.Equal(peer4) {
-						continue
-					}
-					peers = append(peers, decodedPeer)
-				}
-				numWant--
-			}
+	// Fill up with other IPv6 peers, which are picked as if the matched
+	// ones were not there.
+	for _, p := range sw.v6.announcePeers(seeder, numWant+len(matched), peer6, sel) {
+		if len(peers6) == numWant {
+			break
+		}
+		if _, ok := matched[peerKey(p)]; !ok {
+			peers6 = append(peers6, p)
 		}
 	}
 
-	shard.RUnlock()
 	return
 }
 
+// find returns the peer of the pool with the peer ID id that was added most
+// recently.
+func (pp peerPool) find(id chihaya.PeerID) (chihaya.Peer, bool) {
+	indexed := pp.ids[id]
+	if len(indexed) == 0 {
+		return chihaya.Peer{}, false
+	}
+	return decodePeerKey(indexed[len(indexed)-1]), true
+}
+
 func (s *peerStore) GetSeeders(infoHash chihaya.InfoHash) (peers, peers6 []chihaya.Peer, err error) {
 	select {
 	case <-s.closed:
@@ -377,14 +1147,11 @@ func (s *peerStore) GetSeeders(infoHash chihaya.InfoHash) (peers, peers6 []chiha
 		return nil, nil, store.ErrResourceDoesNotExist
 	}
 
-	seeders := shard.swarms[infoHash].seeders
-	for p := range seeders {
-		decodedPeer := decodePeerKey(p)
-		if decodedPeer.IP.To4() == nil {
-			peers6 = append(peers6, decodedPeer)
-		} else {
-			peers = append(peers, decodedPeer)
-		}
+	for p := range shard.swarms[infoHash].v4.seeders {
+		peers = append(peers, decodePeerKey(p))
+	}
+	for p := range shard.swarms[infoHash].v6.seeders {
+		peers6 = append(peers6, decodePeerKey(p))
 	}
 
 	shard.RUnlock()
@@ -406,20 +1173,63 @@ func (s *peerStore) GetLeechers(infoHash chihaya.InfoHash) (peers, peers6 []chih
 		return nil, nil, store.ErrResourceDoesNotExist
 	}
 
-	leechers := shard.swarms[infoHash].leechers
-	for p := range leechers {
-		decodedPeer := decodePeerKey(p)
-		if decodedPeer.IP.To4() == nil {
-			peers6 = append(peers6, decodedPeer)
-		} else {
-			peers = append(peers, decodedPeer)
-		}
+	for p := range shard.swarms[infoHash].v4.leechers {
+		peers = append(peers, decodePeerKey(p))
+	}
+	for p := range shard.swarms[infoHash].v6.leechers {
+		peers6 = append(peers6, decodePeerKey(p))
 	}
 
 	shard.RUnlock()
 	return
 }
 
+func (s *peerStore) ListSwarmPeers(infoHash chihaya.InfoHash) (peers, peers6 []store.SwarmPeer, err error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.RLock()
+
+	sw, ok := shard.swarms[infoHash]
+	if !ok {
+		shard.RUnlock()
+		return nil, nil, store.ErrResourceDoesNotExist
+	}
+
+	peers, peers6 = sw.v4.list(), sw.v6.list()
+	shard.RUnlock()
+	return
+}
+
+func (s *peerStore) HasPeer(infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.RLock()
+
+	sw, ok := shard.swarms[infoHash]
+	if !ok {
+		shard.RUnlock()
+		return false, false, nil
+	}
+
+	pool := sw.pool(p.IP)
+	pk := pool.lookup(p)
+	_, seeder = pool.seeders[pk]
+	_, leecher = pool.leechers[pk]
+
+	shard.RUnlock()
+	return seeder, leecher, nil
+}
+
 func (s *peerStore) NumSeeders(infoHash chihaya.InfoHash) int {
 	select {
 	case <-s.closed:
@@ -435,7 +1245,7 @@ func (s *peerStore) NumSeeders(infoHash chihaya.InfoHash) int {
 		return 0
 	}
 
-	numSeeders := len(shard.swarms[infoHash].seeders)
+	numSeeders := shard.swarms[infoHash].numSeeders()
 
 	shard.RUnlock()
 	return numSeeders
@@ -456,22 +1266,132 @@ func (s *peerStore) NumLeechers(infoHash chihaya.InfoHash) int {
 		return 0
 	}
 
-	numLeechers := len(shard.swarms[infoHash].leechers)
+	numLeechers := shard.swarms[infoHash].numLeechers()
 
 	shard.RUnlock()
 	return numLeechers
 }
 
+func (s *peerStore) IncrementDownloaded(infoHash chihaya.InfoHash) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.Lock()
+	shard.downloaded[infoHash]++
+	shard.Unlock()
+
+	return nil
+}
+
+func (s *peerStore) GetStats(infoHash chihaya.InfoHash) (seeders, leechers, downloaded uint64, err error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.RLock()
+
+	if sw, ok := shard.swarms[infoHash]; ok {
+		seeders = uint64(sw.numSeeders())
+		leechers = uint64(sw.numLeechers())
+	}
+	downloaded = shard.downloaded[infoHash]
+
+	shard.RUnlock()
+	return
+}
+
+func (s *peerStore) NumSwarms() (uint64, error) {
+	return s.count(func(sw swarm) int { return 1 }), nil
+}
+
+func (s *peerStore) NumTotalSeeders() (uint64, error) {
+	return s.count(swarm.numSeeders), nil
+}
+
+func (s *peerStore) NumTotalLeechers() (uint64, error) {
+	return s.count(swarm.numLeechers), nil
+}
+
+// WalkSwarmSizes implements store.SwarmSizeWalker. The sizes of the swarms of
+// a shard are copied while it is locked, and passed to fn once it is
+// unlocked.
+func (s *peerStore) WalkSwarmSizes(fn func(infoHash chihaya.InfoHash, peers int)) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	type swarmSize struct {
+		infoHash chihaya.InfoHash
+		peers    int
+	}
+	var sizes []swarmSize
+	for _, shard := range s.shards {
+		shard.RLock()
+		for infoHash, sw := range shard.swarms {
+			sizes = append(sizes, swarmSize{infoHash, sw.numSeeders() + sw.numLeechers()})
+		}
+		shard.RUnlock()
+
+		for _, size := range sizes {
+			fn(size.infoHash, size.peers)
+		}
+		sizes = sizes[:0]
+	}
+}
+
+// count returns the sum of fn over all swarms.
+func (s *peerStore) count(fn func(swarm) int) uint64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	var n uint64
+	for _, shard := range s.shards {
+		shard.RLock()
+		for _, sw := range shard.swarms {
+			n += uint64(fn(sw))
+		}
+		shard.RUnlock()
+	}
+	return n
+}
+
 func (s *peerStore) Stop() <-chan error {
 	toReturn := make(chan error)
 	go func() {
-		shards := make([]*peerShard, len(s.shards))
-		for i := 0; i < len(s.shards); i++ {
-			shards[i] = &peerShard{}
-			shards[i].swarms = make(map[chihaya.InfoHash]swarm)
-		}
-		s.shards = shards
 		close(s.closed)
+		<-s.reaped
+
+		for _, shard := range s.shards {
+			shard.Lock()
+		}
+
+		var err error
+		if s.downloadedPath != "" {
+			err = s.saveDownloadedFile(s.downloadedPath)
+		}
+
+		for _, shard := range s.shards {
+			shard.swarms = make(map[chihaya.InfoHash]swarm)
+			shard.downloaded = make(map[chihaya.InfoHash]uint64)
+			shard.Unlock()
+		}
+		s.Close()
+
+		if err != nil {
+			toReturn <- err
+		}
 		close(toReturn)
 	}()
 	return toReturn
@@ -0,0 +1,186 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/chihaya/chihaya"
+)
+
+// A downloaded file holds the numbers of completed downloads of a PeerStore.
+// It consists of
+//
+//	the magic string "CHPD" and the version byte,
+//	the number of infohashes as a uint64, followed by one downloadedCount per
+//	infohash, and
+//	the CRC-32 (IEEE) of everything before it, as a uint32.
+//
+// All integers are big-endian.
+const (
+	downloadedMagic   = "CHPD"
+	downloadedVersion = 1
+)
+
+type downloadedCount struct {
+	InfoHash   chihaya.InfoHash
+	Downloaded uint64
+}
+
+// invalidDownloaded returns an error describing why a downloaded file could
+// not be read.
+func invalidDownloaded(format string, args ...interface{}) error {
+	return errors.New("memory: invalid PeerStore downloaded file: " + fmt.Sprintf(format, args...))
+}
+
+// writeDownloaded writes the numbers of completed downloads to w.
+//
+// The caller must hold at least read locks on all shards.
+func (s *peerStore) writeDownloaded(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(bw, crc)
+
+	_, err := io.WriteString(mw, downloadedMagic)
+	if err != nil {
+		return err
+	}
+
+	var numInfoHashes uint64
+	for _, shard := range s.shards {
+		numInfoHashes += uint64(len(shard.downloaded))
+	}
+
+	err = binary.Write(mw, binary.BigEndian, struct {
+		Version       uint8
+		NumInfoHashes uint64
+	}{downloadedVersion, numInfoHashes})
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range s.shards {
+		for infoHash, downloaded := range shard.downloaded {
+			err = binary.Write(mw, binary.BigEndian, downloadedCount{infoHash, downloaded})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = binary.Write(bw, binary.BigEndian, crc.Sum32())
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// readDownloaded reads the numbers of completed downloads from r and replaces
+// the ones of the store with them. A malformed file leaves the store
+// unchanged.
+func (s *peerStore) readDownloaded(r io.Reader) error {
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+
+	var header struct {
+		Magic         [4]byte
+		Version       uint8
+		NumInfoHashes uint64
+	}
+	err := binary.Read(tr, binary.BigEndian, &header)
+	if err != nil {
+		return invalidDownloaded("reading header: %s", err)
+	}
+	if string(header.Magic[:]) != downloadedMagic {
+		return invalidDownloaded("not a downloaded file")
+	}
+	if header.Version != downloadedVersion {
+		return invalidDownloaded("unsupported version %d", header.Version)
+	}
+
+	downloaded := make([]map[chihaya.InfoHash]uint64, len(s.shards))
+	for i := range downloaded {
+		downloaded[i] = make(map[chihaya.InfoHash]uint64)
+	}
+
+	for i := uint64(0); i < header.NumInfoHashes; i++ {
+		var count downloadedCount
+		err = binary.Read(tr, binary.BigEndian, &count)
+		if err != nil {
+			return invalidDownloaded("reading infohash %d of %d: %s", i+1, header.NumInfoHashes, err)
+		}
+
+		downloaded[s.shardIndex(count.InfoHash)][count.InfoHash] = count.Downloaded
+	}
+
+	sum := crc.Sum32()
+
+	var expected uint32
+	err = binary.Read(r, binary.BigEndian, &expected)
+	if err != nil {
+		return invalidDownloaded("reading checksum: %s", err)
+	}
+	if sum != expected {
+		return invalidDownloaded("checksum mismatch")
+	}
+
+	for i, shard := range s.shards {
+		shard.Lock()
+		shard.downloaded = downloaded[i]
+		shard.Unlock()
+	}
+
+	return nil
+}
+
+// restoreDownloadedFile restores the numbers of completed downloads from the
+// file at path. A missing file is not an error, the numbers are left at zero
+// in that case.
+func (s *peerStore) restoreDownloadedFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.readDownloaded(bufio.NewReader(f))
+}
+
+// saveDownloadedFile writes the numbers of completed downloads to path,
+// replacing the previous file only once the new one has been written
+// completely.
+//
+// The caller must hold at least read locks on all shards.
+func (s *peerStore) saveDownloadedFile(path string) error {
+	f, err := os.Create(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp"))
+	if err != nil {
+		return err
+	}
+
+	err = s.writeDownloaded(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+
+	"github.com/chihaya/chihaya"
+)
+
+// selection is the way the peers of an announce are selected.
+type selection struct {
+	pick peerPicker
+
+	// seederRatio and strictCrypto are the SeederRatio and RequireCrypto
+	// of the peerStoreConfig, see peerPool.announcePeers.
+	seederRatio  float64
+	strictCrypto bool
+}
+
+// peerPicker appends up to numWant peers of candidates other than announcer
+// to peers.
+type peerPicker func(peers []chihaya.Peer, candidates map[serializedPeer]int64, numWant int, announcer chihaya.Peer) []chihaya.Peer
+
+// pickRandom is a peerPicker that picks a uniformly random sample of the
+// candidates by reservoir sampling. It passes over the candidates once and
+// only keeps numWant of them, so announces to large swarms neither copy nor
+// shuffle the swarm.
+func pickRandom(peers []chihaya.Peer, candidates map[serializedPeer]int64, numWant int, announcer chihaya.Peer) []chihaya.Peer {
+	if numWant <= 0 {
+		return peers
+	}
+
+	announcerKey := peerKey(announcer)
+	size := numWant
+	if size > len(candidates) {
+		size = len(candidates)
+	}
+	reservoir := make([]serializedPeer, 0, size)
+	seen := 0
+	for pk := range candidates {
+		if pk == announcerKey {
+			continue
+		}
+
+		// The i-th candidate replaces one of the sampled ones with a
+		// probability of numWant/i.
+		seen++
+		if len(reservoir) < numWant {
+			reservoir = append(reservoir, pk)
+		} else if i := rand.Intn(seen); i < numWant {
+			reservoir[i] = pk
+		}
+	}
+
+	// The first candidates keep the order of map iteration, which callers
+	// that split the picked peers must not see.
+	rand.Shuffle(len(reservoir), func(i, j int) {
+		reservoir[i], reservoir[j] = reservoir[j], reservoir[i]
+	})
+	for _, pk := range reservoir {
+		peers = append(peers, decodePeerKey(pk))
+	}
+	return peers
+}
+
+// stablePicker returns a peerPicker that picks the same peers for every
+// announce of the peer announcerID to the swarm of infoHash.
+//
+// Every candidate is scored by a hash of the infohash, the announcer and the
+// candidate, and the candidates with the lowest scores are picked. A peer
+// that joins or leaves the swarm therefore only changes the picked peers if
+// it has one of the lowest scores, so the picked peers rotate slowly as
+// the swarm changes, while different announcers still get different peers.
+//
+// Like pickRandom, it passes over every candidate, but it hashes each of
+// them, so it is slower.
+func stablePicker(infoHash chihaya.InfoHash, announcerID chihaya.PeerID) peerPicker {
+	seed := fnv1a(fnv1a(fnvOffset, string(infoHash[:])), string(announcerID[:]))
+
+	return func(peers []chihaya.Peer, candidates map[serializedPeer]int64, numWant int, announcer chihaya.Peer) []chihaya.Peer {
+		if numWant <= 0 {
+			return peers
+		}
+
+		picked := make(scoredPeers, 0, numWant)
+		for pk := range candidates {
+			score := mix(fnv1a(seed, string(pk)))
+			if len(picked) == numWant && score >= picked[0].score {
+				continue
+			}
+
+			p := decodePeerKey(pk)
+			if p.Equal(announcer) {
+				continue
+			}
+
+			if len(picked) == numWant {
+				heap.Pop(&picked)
+			}
+			heap.Push(&picked, scoredPeer{score, p})
+		}
+
+		sort.Sort(sort.Reverse(picked))
+		for _, sp := range picked {
+			peers = append(peers, sp.peer)
+		}
+		return peers
+	}
+}
+
+type scoredPeer struct {
+	score uint64
+	peer  chihaya.Peer
+}
+
+// scoredPeers is a max-heap of scoredPeer ordered by score.
+type scoredPeers []scoredPeer
+
+func (sp scoredPeers) Len() int            { return len(sp) }
+func (sp scoredPeers) Less(i, j int) bool  { return sp[i].score > sp[j].score }
+func (sp scoredPeers) Swap(i, j int)       { sp[i], sp[j] = sp[j], sp[i] }
+func (sp *scoredPeers) Push(x interface{}) { *sp = append(*sp, x.(scoredPeer)) }
+
+func (sp *scoredPeers) Pop() interface{} {
+	old := *sp
+	x := old[len(old)-1]
+	*sp = old[:len(old)-1]
+	return x
+}
+
+const (
+	fnvOffset uint64 = 14695981039346656037
+	fnvPrime  uint64 = 1099511628211
+)
+
+// fnv1a continues the 64-bit FNV-1a hash h with s.
+func fnv1a(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime
+	}
+	return h
+}
+
+// mix is the finalizer of SplitMix64. It spreads the last bytes hashed by
+// fnv1a over all bits, so that scores of similar candidates are unrelated.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
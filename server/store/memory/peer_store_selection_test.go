@@ -0,0 +1,227 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestPeerStoreStableSelection(t *testing.T) {
+	peerStoreTester.TestPeerStore(t, &store.DriverConfig{Config: map[string]interface{}{
+		"peer_selection": "stable",
+	}})
+}
+
+func TestStableSelection(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+		"peer_selection": "stable",
+	}})
+	require.Nil(t, err)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := func(i int) chihaya.Peer {
+		return chihaya.Peer{
+			ID:   chihaya.PeerID{byte(i), byte(i >> 8)},
+			IP:   net.IPv4(10, 0, byte(i>>8), byte(i)).To4(),
+			Port: 1234,
+		}
+	}
+	for i := 0; i < 200; i++ {
+		require.Nil(t, ps.PutSeeder(hash, peer(i)))
+	}
+	announcer := peer(1000)
+	require.Nil(t, ps.PutLeecher(hash, announcer))
+
+	announce := func(p chihaya.Peer) map[string]bool {
+		peers, _, err := ps.AnnouncePeers(hash, false, 20, p, chihaya.Peer{}, store.SameFamily)
+		require.Nil(t, err)
+		require.Len(t, peers, 20)
+
+		set := make(map[string]bool)
+		for _, p := range peers {
+			require.False(t, p.Equal(announcer))
+			set[string(peerKey(p))] = true
+		}
+		return set
+	}
+	overlap := func(a, b map[string]bool) (n int) {
+		for pk := range a {
+			if b[pk] {
+				n++
+			}
+		}
+		return
+	}
+
+	// repeated announces return the same peers
+	first := announce(announcer)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, first, announce(announcer))
+	}
+
+	// a changing swarm only rotates a few of them
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.DeleteSeeder(hash, peer(i)))
+		require.Nil(t, ps.PutSeeder(hash, peer(200+i)))
+	}
+	require.True(t, overlap(first, announce(announcer)) >= 14, "too many peers rotated")
+
+	// other announcers get other peers
+	require.True(t, overlap(first, announce(peer(1001))) < 14, "announcers get the same peers")
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestSeederRatio(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+		"seeder_ratio": 0.6,
+	}})
+	require.Nil(t, err)
+
+	peer := func(i int) chihaya.Peer {
+		return chihaya.Peer{
+			ID:   chihaya.PeerID{byte(i), byte(i >> 8)},
+			IP:   net.IPv4(10, 0, byte(i>>8), byte(i)).To4(),
+			Port: 1234,
+		}
+	}
+	fill := func(hash chihaya.InfoHash, seeders, leechers int) {
+		for i := 0; i < seeders; i++ {
+			require.Nil(t, ps.PutSeeder(hash, peer(i)))
+		}
+		for i := 0; i < leechers; i++ {
+			require.Nil(t, ps.PutLeecher(hash, peer(1000+i)))
+		}
+	}
+	announce := func(hash chihaya.InfoHash, numWant int, p chihaya.Peer) (seeders, leechers int) {
+		peers, _, err := ps.AnnouncePeers(hash, false, numWant, p, chihaya.Peer{}, store.SameFamily)
+		require.Nil(t, err)
+
+		seen := make(map[string]bool)
+		for _, p := range peers {
+			require.False(t, seen[string(peerKey(p))], "peer returned twice")
+			seen[string(peerKey(p))] = true
+			if int(p.ID[0])|int(p.ID[1])<<8 < 1000 {
+				seeders++
+			} else {
+				leechers++
+			}
+		}
+		return
+	}
+
+	// Leechers get seeders for no more than the ratio of their numwant.
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	fill(hash, 100, 100)
+	seeders, leechers := announce(hash, 50, peer(1000))
+	require.Equal(t, 30, seeders)
+	require.Equal(t, 20, leechers)
+
+	// Seeders fill in for missing leechers.
+	hash = chihaya.InfoHashFromString("00000000000000000002")
+	fill(hash, 100, 5)
+	seeders, leechers = announce(hash, 50, peer(1000))
+	require.Equal(t, 46, seeders)
+	require.Equal(t, 4, leechers)
+
+	// Seeders that announce as leechers get leechers first.
+	seeders, leechers = announce(hash, 10, peer(0))
+	require.Equal(t, 5, seeders)
+	require.Equal(t, 5, leechers)
+
+	// Swarms that are too small are returned entirely.
+	hash = chihaya.InfoHashFromString("00000000000000000003")
+	fill(hash, 3, 3)
+	seeders, leechers = announce(hash, 50, peer(1000))
+	require.Equal(t, 3, seeders)
+	require.Equal(t, 2, leechers)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestRandomSelection(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{})
+	require.Nil(t, err)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := func(i int) chihaya.Peer {
+		return chihaya.Peer{ID: chihaya.PeerID{byte(i)}, IP: net.IPv4(10, 0, 0, byte(i)).To4(), Port: 1234}
+	}
+	for i := 0; i < 100; i++ {
+		require.Nil(t, ps.PutSeeder(hash, peer(i)))
+	}
+	announcer := peer(0)
+
+	// Every peer but the announcer is picked with the same probability of
+	// 1/10, i.e. 200 times, give or take 7 standard deviations.
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		peers, _, err := ps.AnnouncePeers(hash, false, 10, announcer, chihaya.Peer{}, store.SameFamily)
+		require.Nil(t, err)
+		require.Len(t, peers, 10)
+
+		seen := make(map[string]bool)
+		for _, p := range peers {
+			require.False(t, p.Equal(announcer), "announcer returned to itself")
+			require.False(t, seen[string(peerKey(p))], "peer returned twice")
+			seen[string(peerKey(p))] = true
+			counts[string(peerKey(p))]++
+		}
+	}
+	require.Len(t, counts, 99)
+	for pk, n := range counts {
+		require.True(t, n > 100 && n < 300, "%v picked %d times", decodePeerKey(serializedPeer(pk)), n)
+	}
+
+	require.Nil(t, <-ps.Stop())
+}
+
+// pickShuffled is a peerPicker that copies and shuffles all candidates, to
+// compare pickRandom with.
+func pickShuffled(peers []chihaya.Peer, candidates map[serializedPeer]int64, numWant int, announcer chihaya.Peer) []chihaya.Peer {
+	all := make([]chihaya.Peer, 0, len(candidates))
+	for pk := range candidates {
+		if p := decodePeerKey(pk); !p.Equal(announcer) {
+			all = append(all, p)
+		}
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if numWant > len(all) {
+		numWant = len(all)
+	}
+	return append(peers, all[:numWant]...)
+}
+
+// BenchmarkPickPeers picks 50 peers of a swarm of 100k peers.
+func BenchmarkPickPeers(b *testing.B) {
+	candidates := make(map[serializedPeer]int64, 100000)
+	for i := 0; i < 100000; i++ {
+		p := chihaya.Peer{ID: chihaya.PeerID{byte(i), byte(i >> 8), byte(i >> 16)}, IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(), Port: 1234}
+		candidates[peerKey(p)] = 0
+	}
+	announcer := chihaya.Peer{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 1234}
+
+	for _, bb := range []struct {
+		name string
+		pick peerPicker
+	}{
+		{"Reservoir", pickRandom},
+		{"Shuffle", pickShuffled},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bb.pick(nil, candidates, 50, announcer)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+var _ store.PeerStateStore = &peerStore{}
+
+// UpdatePeerState implements store.PeerStateStore. The state is kept in the
+// pool of the peer, which deletes it along with the peer.
+func (s *peerStore) UpdatePeerState(infoHash chihaya.InfoHash, p chihaya.Peer, uploaded, downloaded, left uint64) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.Lock()
+	defer shard.Unlock()
+
+	sw, ok := shard.swarms[infoHash]
+	if !ok {
+		return store.ErrResourceDoesNotExist
+	}
+
+	pool := sw.pool(p.IP)
+	pk := pool.lookup(p)
+	if !pool.has(pk) {
+		return store.ErrResourceDoesNotExist
+	}
+
+	pool.states[pk] = pool.states[pk].Update(uploaded, downloaded, left, s.clock.Now())
+	return nil
+}
+
+// GetPeerState implements store.PeerStateStore.
+func (s *peerStore) GetPeerState(infoHash chihaya.InfoHash, p chihaya.Peer) (store.PeerState, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	shard := s.shards[s.shardIndex(infoHash)]
+	shard.RLock()
+	defer shard.RUnlock()
+
+	sw, ok := shard.swarms[infoHash]
+	if !ok {
+		return store.PeerState{}, store.ErrResourceDoesNotExist
+	}
+
+	pool := sw.pool(p.IP)
+	state, ok := pool.states[pool.lookup(p)]
+	if !ok {
+		return store.PeerState{}, store.ErrResourceDoesNotExist
+	}
+	return state, nil
+}
+
+// has returns whether pk is a seeder or a leecher of the pool.
+func (pp peerPool) has(pk serializedPeer) bool {
+	if _, ok := pp.seeders[pk]; ok {
+		return true
+	}
+	_, ok := pp.leechers[pk]
+	return ok
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestPeerState(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000000, 0))
+	st, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake})
+	require.Nil(t, err)
+	s := st.(*peerStore)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := chihaya.Peer{
+		ID:   chihaya.PeerIDFromString("-TEST01-000000000001"),
+		IP:   net.IPv4(10, 0, 0, 1).To4(),
+		Port: 6881,
+		Key:  "3F2A1B9C",
+	}
+
+	// Peers must be in the swarm to have a state.
+	require.Equal(t, store.ErrResourceDoesNotExist, s.UpdatePeerState(hash, peer, 0, 0, 1000))
+	require.Nil(t, s.PutLeecher(hash, peer))
+	_, err = s.GetPeerState(hash, peer)
+	require.Equal(t, store.ErrResourceDoesNotExist, err)
+
+	first := fake.Now()
+	require.Nil(t, s.UpdatePeerState(hash, peer, 0, 0, 1000))
+	fake.Advance(time.Minute)
+	require.Nil(t, s.UpdatePeerState(hash, peer, 100, 400, 600))
+
+	state, err := s.GetPeerState(hash, peer)
+	require.Nil(t, err)
+	require.Equal(t, first, state.FirstSeen)
+	require.Equal(t, uint64(100), state.Uploaded)
+	require.Equal(t, uint64(400), state.Downloaded)
+	require.Equal(t, uint64(600), state.Left)
+
+	// The state is kept when the leecher becomes a seeder, and when it
+	// moves to another address with its key.
+	require.Nil(t, s.GraduateLeecher(hash, peer))
+	moved := peer
+	moved.IP = net.IPv4(10, 0, 0, 2).To4()
+	require.Nil(t, s.PutSeeder(hash, moved))
+	require.Nil(t, s.UpdatePeerState(hash, moved, 300, 1000, 0))
+
+	state, err = s.GetPeerState(hash, moved)
+	require.Nil(t, err)
+	require.Equal(t, first, state.FirstSeen)
+	require.Equal(t, uint64(300), state.Uploaded)
+	require.Equal(t, uint64(1000), state.Downloaded)
+
+	// The state is deleted along with the peer.
+	require.Nil(t, s.DeleteSeeder(hash, moved))
+	require.Nil(t, s.PutSeeder(hash, moved))
+	_, err = s.GetPeerState(hash, moved)
+	require.Equal(t, store.ErrResourceDoesNotExist, err)
+
+	require.Nil(t, s.UpdatePeerState(hash, moved, 0, 0, 0))
+	require.Nil(t, s.CollectGarbage(fake.Now().Add(time.Second)))
+	require.Nil(t, s.PutSeeder(hash, moved))
+	_, err = s.GetPeerState(hash, moved)
+	require.Equal(t, store.ErrResourceDoesNotExist, err)
+
+	require.Nil(t, <-s.Stop())
+}
@@ -5,9 +5,22 @@
 package memory
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/server/store"
+
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -29,6 +42,568 @@ func TestPeerStore(t *testing.T) {
 	peerStoreTester.TestPeerStore(t, peerStoreTestConfig)
 }
 
+func TestPeerStoreConfig(t *testing.T) {
+	var table = []struct {
+		config   interface{}
+		expected int
+		valid    bool
+	}{
+		{nil, 1, true},
+		{map[string]interface{}{"shards": 0}, 1, true},
+		{map[string]interface{}{"shards": 16}, 16, true},
+		{map[string]interface{}{"shards": -1}, 0, false},
+		{map[string]interface{}{"shards": "many"}, 0, false},
+		{"shards: 16", 0, false},
+		{map[string]interface{}{"peer_selection": "stable"}, 1, true},
+		{map[string]interface{}{"peer_selection": "sorted"}, 0, false},
+		{map[string]interface{}{"seeder_ratio": 0.5}, 1, true},
+		{map[string]interface{}{"seeder_ratio": -0.1}, 0, false},
+		{map[string]interface{}{"seeder_ratio": 1}, 0, false},
+		{map[string]interface{}{"require_crypto": "strict"}, 1, true},
+		{map[string]interface{}{"require_crypto": "always"}, 0, false},
+		{map[string]interface{}{"max_peers_per_swarm": 1000}, 1, true},
+		{map[string]interface{}{"max_peers_per_swarm": -1}, 0, false},
+		{map[string]interface{}{"swarm_peer_limits": map[string]int{"3030303030303030303030303030303030303031": 0}}, 1, true},
+		{map[string]interface{}{"swarm_peer_limits": map[string]int{"00000000000000000001": 10}}, 0, false},
+		{map[string]interface{}{"swarm_peer_limits": map[string]int{"3030303030303030303030303030303030303031": -1}}, 0, false},
+		{map[string]interface{}{"swarm_size_hints": map[string]int{"3030303030303030303030303030303030303031": 100000}}, 1, true},
+		{map[string]interface{}{"swarm_size_hints": map[string]int{"00000000000000000001": 10}}, 0, false},
+		{map[string]interface{}{"swarm_size_hints": map[string]int{"3030303030303030303030303030303030303031": -1}}, 0, false},
+	}
+
+	for _, tt := range table {
+		storecfg := &store.DriverConfig{Name: "memory", Config: tt.config}
+		ps, err := (&peerStoreDriver{}).New(storecfg)
+		if !tt.valid {
+			require.NotNil(t, err, "%#v", tt.config)
+			continue
+		}
+		require.Nil(t, err, "%#v", tt.config)
+		require.Equal(t, tt.expected, len(ps.(*peerStore).shards))
+		require.Nil(t, <-ps.Stop())
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	s := newPeerStore(16, defaultEventBuffer)
+
+	// Infohashes that only differ in a few bytes are spread across all
+	// shards, not only the ones their first bytes select.
+	counts := make([]int, len(s.shards))
+	for i := 0; i < 1600; i++ {
+		counts[s.shardIndex(chihaya.InfoHash([20]byte{19: byte(i), 18: byte(i >> 8)}))]++
+	}
+	for i, count := range counts {
+		require.True(t, count > 50 && count < 150, "shard %d holds %d of 1600 swarms", i, count)
+	}
+}
+
+func TestAnnouncePeersFamilies(t *testing.T) {
+	peerStoreTester.TestAnnouncePeersFamilies(t, peerStoreTestConfig)
+}
+
+func TestDownloaded(t *testing.T) {
+	peerStoreTester.TestDownloaded(t, peerStoreTestConfig)
+}
+
+func TestAnnounceFamilyPolicies(t *testing.T) {
+	peerStoreTester.TestAnnounceFamilyPolicies(t, peerStoreTestConfig)
+}
+
+func TestReannounce(t *testing.T) {
+	peerStoreTester.TestReannounce(t, peerStoreTestConfig)
+}
+
+func TestKeys(t *testing.T) {
+	peerStoreTester.TestKeys(t, peerStoreTestConfig)
+}
+
+func TestHasPeer(t *testing.T) {
+	peerStoreTester.TestHasPeer(t, peerStoreTestConfig)
+}
+
+func TestRequireCrypto(t *testing.T) {
+	peerStoreTester.TestRequireCrypto(t, peerStoreTestConfig)
+}
+
+func TestStrictCrypto(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake, Config: map[string]interface{}{"require_crypto": "strict"}})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := func(i byte, crypto chihaya.Crypto) chihaya.Peer {
+		return chihaya.Peer{ID: chihaya.PeerID{i}, IP: net.IPv4(10, 0, 0, i).To4(), Port: 1234, Crypto: crypto}
+	}
+	var (
+		plain     = peer(1, chihaya.CryptoNone)
+		supported = peer(2, chihaya.CryptoSupported)
+		announcer = peer(3, chihaya.CryptoRequired)
+	)
+	announce := func() []chihaya.Peer {
+		peers, _, err := s.AnnouncePeers(hash, false, 5, announcer, chihaya.Peer{}, store.SameFamily)
+		require.Nil(t, err)
+		return peers
+	}
+
+	// announcers that require encryption only get the peers that support it
+	require.Nil(t, s.PutSeeder(hash, plain))
+	require.Nil(t, s.PutLeecher(hash, supported))
+	require.Equal(t, []chihaya.Peer{supported}, announce())
+	peers, _, err := s.AnnouncePeers(hash, false, 5, peer(4, chihaya.CryptoSupported), chihaya.Peer{}, store.SameFamily)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+
+	// the support is forgotten once the peer announces without it
+	supported.Crypto = chihaya.CryptoNone
+	require.Nil(t, s.GraduateLeecher(hash, supported))
+	require.Empty(t, announce())
+	require.Empty(t, s.shards[0].swarms[hash].v4.crypto)
+
+	// and reaped with the peer
+	require.Nil(t, s.PutSeeder(hash, peer(5, chihaya.CryptoSupported)))
+	fake.Advance(time.Minute)
+	require.Nil(t, s.PutSeeder(hash, plain))
+	require.Nil(t, s.CollectGarbage(fake.Now().Add(-time.Second)))
+	require.Equal(t, 1, s.NumSeeders(hash))
+	require.Empty(t, s.shards[0].swarms[hash].v4.crypto)
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestPeerEvents(t *testing.T) {
+	peerStoreTester.TestPeerEvents(t, peerStoreTestConfig)
+}
+
+func TestPeerEventsDropped(t *testing.T) {
+	s := newPeerStore(1, 2)
+	go s.reap(time.Minute, 30*time.Minute)
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := func(i byte) chihaya.Peer {
+		return chihaya.Peer{ID: chihaya.PeerID{i}, IP: net.ParseIP("10.0.0.1").To4(), Port: 1234}
+	}
+
+	slow, cancelSlow := s.Subscribe()
+	fast, cancelFast := s.Subscribe()
+	defer cancelFast()
+
+	// Announces are not blocked by a full buffer, events that do not fit
+	// are dropped for the slow subscriber only.
+	for i := byte(0); i < 5; i++ {
+		require.Nil(t, s.PutLeecher(hash, peer(i)))
+		e := <-fast
+		require.Equal(t, peer(i).ID, e.Peer.ID)
+	}
+	require.Equal(t, uint64(3), s.DroppedPeerEvents())
+
+	require.Equal(t, peer(0).ID, (<-slow).Peer.ID)
+	require.Equal(t, peer(1).ID, (<-slow).Peer.ID)
+	cancelSlow()
+	_, ok := <-slow
+	require.False(t, ok)
+
+	require.Nil(t, s.DeleteLeecher(hash, peer(0)))
+	require.Equal(t, store.PeerLeft, (<-fast).Type)
+	require.Equal(t, uint64(3), s.DroppedPeerEvents())
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestSwarmPeerLimit(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake, Config: map[string]interface{}{
+		"max_peers_per_swarm": 3,
+		"swarm_peer_limits": map[string]int{
+			// 00000000000000000002
+			"3030303030303030303030303030303030303032": 0,
+		},
+	}})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	limited := chihaya.InfoHashFromString("00000000000000000001")
+	unlimited := chihaya.InfoHashFromString("00000000000000000002")
+	peer := func(i byte, ip string) chihaya.Peer {
+		return chihaya.Peer{ID: chihaya.PeerID{i}, IP: net.ParseIP(ip), Port: 1234}
+	}
+	var (
+		seeder   = peer(1, "10.0.0.1")
+		leecher  = peer(2, "fc00::2")
+		leecher2 = peer(3, "10.0.0.3")
+		leecher3 = peer(4, "fc00::4")
+	)
+	announce := func(infoHash chihaya.InfoHash, p chihaya.Peer, seeder bool) {
+		fake.Advance(time.Second)
+		if seeder {
+			require.Nil(t, s.GraduateLeecher(infoHash, p))
+			return
+		}
+		require.Nil(t, s.PutLeecher(infoHash, p))
+	}
+	requireStats := func(numSeeders, numLeechers uint64) {
+		seeders, leechers, _, err := s.GetStats(limited)
+		require.Nil(t, err)
+		require.Equal(t, numSeeders, seeders, "seeders")
+		require.Equal(t, numLeechers, leechers, "leechers")
+	}
+
+	announce(limited, seeder, true)
+	announce(limited, leecher, false)
+	announce(limited, leecher2, false)
+	requireStats(1, 2)
+
+	// re-announcing peers do not count against the limit
+	announce(limited, seeder, true)
+	announce(limited, leecher, false)
+	requireStats(1, 2)
+
+	// the peer that announced least recently is evicted, regardless of its
+	// address family and whether it is a seeder
+	events, cancel := s.Subscribe()
+	defer cancel()
+	announce(limited, leecher3, false)
+	requireStats(1, 2)
+	requireEvicted := func(p chihaya.Peer, seeder bool) {
+		e := <-events
+		require.Equal(t, store.PeerLeft, e.Type)
+		require.True(t, e.Peer.Equal(p), "expected %v to be evicted, got %v", p, e.Peer)
+		require.Equal(t, seeder, e.Seeder)
+		require.Equal(t, store.PeerJoined, (<-events).Type)
+	}
+	requireEvicted(leecher2, false)
+
+	announce(limited, leecher2, false)
+	requireStats(0, 3)
+	requireEvicted(seeder, true)
+
+	// the graduation of a leecher does not grow the swarm
+	announce(limited, leecher, true)
+	requireStats(1, 2)
+
+	// peers that left make room, and are not evicted again
+	require.Equal(t, store.PeerCompleted, (<-events).Type)
+	require.Nil(t, s.DeleteSeeder(limited, leecher))
+	require.Equal(t, store.PeerLeft, (<-events).Type)
+	announce(limited, seeder, false)
+	require.Equal(t, store.PeerJoined, (<-events).Type)
+	requireStats(0, 3)
+	announce(limited, peer(5, "10.0.0.5"), false)
+	requireEvicted(leecher3, false)
+	shard := s.shards[s.shardIndex(limited)]
+	require.Equal(t, 3, shard.swarms[limited].v4.recency.order.Len())
+
+	// the limit can be overridden per swarm
+	for i := byte(0); i < 10; i++ {
+		announce(unlimited, peer(i, "10.0.0.1"), false)
+	}
+	require.Equal(t, 10, s.NumLeechers(unlimited))
+	require.Nil(t, s.shards[s.shardIndex(unlimited)].swarms[unlimited].v4.recency)
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestWalkSwarmSizes(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{"shards": 4}})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+	defer func() { require.Nil(t, <-s.Stop()) }()
+
+	expected := make(map[chihaya.InfoHash]int)
+	for i := 1; i <= 20; i++ {
+		infoHash := chihaya.InfoHash{byte(i)}
+		for j := 0; j < i; j++ {
+			p := chihaya.Peer{ID: chihaya.PeerID{byte(j)}, IP: net.IPv4(10, 0, 0, byte(j)).To4(), Port: 6881}
+			if j%2 == 0 {
+				require.Nil(t, s.PutSeeder(infoHash, p))
+			} else {
+				require.Nil(t, s.PutLeecher(infoHash, p))
+			}
+		}
+		expected[infoHash] = i
+	}
+
+	walked := make(map[chihaya.InfoHash]int)
+	s.WalkSwarmSizes(func(infoHash chihaya.InfoHash, peers int) {
+		_, ok := walked[infoHash]
+		require.False(t, ok, "swarm walked twice")
+		walked[infoHash] = peers
+
+		// No shard is locked while fn runs.
+		require.Nil(t, s.PutLeecher(chihaya.InfoHash{99}, chihaya.Peer{IP: net.IPv4(10, 0, 1, 1).To4(), Port: 6881}))
+	})
+	delete(walked, chihaya.InfoHash{99})
+	require.Equal(t, expected, walked)
+}
+
+func TestListSwarmPeers(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+	defer func() { require.Nil(t, <-s.Stop()) }()
+
+	infoHash := chihaya.InfoHash{1}
+	_, _, err = s.ListSwarmPeers(infoHash)
+	require.Equal(t, store.ErrResourceDoesNotExist, err)
+
+	seeder := chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}
+	leecher := chihaya.Peer{ID: chihaya.PeerID{2}, IP: net.ParseIP("2001:db8::2"), Port: 6882}
+	require.Nil(t, s.PutSeeder(infoHash, seeder))
+	fake.Advance(time.Minute)
+	require.Nil(t, s.PutLeecher(infoHash, leecher))
+
+	peers, peers6, err := s.ListSwarmPeers(infoHash)
+	require.Nil(t, err)
+	require.Equal(t, []store.SwarmPeer{{Peer: seeder, Seeder: true, LastAnnounce: time.Unix(1466000000, 0)}}, peers)
+	require.Equal(t, []store.SwarmPeer{{Peer: leecher, LastAnnounce: time.Unix(1466000060, 0)}}, peers6)
+}
+
+func TestPutMovesPeer(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := chihaya.Peer{ID: chihaya.PeerIDFromString("00000000000000000001"), IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	events, cancel := s.Subscribe()
+	defer cancel()
+	requireEvent := func(typ store.PeerEventType, seeder bool) {
+		e := <-events
+		require.Equal(t, typ, e.Type)
+		require.Equal(t, seeder, e.Seeder)
+	}
+
+	require.Nil(t, s.PutLeecher(hash, peer))
+	requireEvent(store.PeerJoined, false)
+
+	// the moved peer is as fresh as its last announce
+	fake.Advance(20 * time.Minute)
+	require.Nil(t, s.PutSeeder(hash, peer))
+	requireEvent(store.PeerLeft, false)
+	requireEvent(store.PeerJoined, true)
+	require.Nil(t, s.CollectGarbage(fake.Now().Add(-10*time.Minute)))
+	require.Equal(t, 1, s.NumSeeders(hash))
+	require.Equal(t, 0, s.NumLeechers(hash))
+
+	fake.Advance(20 * time.Minute)
+	require.Nil(t, s.PutLeecher(hash, peer))
+	requireEvent(store.PeerLeft, true)
+	requireEvent(store.PeerJoined, false)
+	require.Nil(t, s.CollectGarbage(fake.Now().Add(-10*time.Minute)))
+	require.Equal(t, 0, s.NumSeeders(hash))
+	require.Equal(t, 1, s.NumLeechers(hash))
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestPeerIDIndex(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	id := chihaya.PeerIDFromString("00000000000000000001")
+	var (
+		peer  = chihaya.Peer{ID: id, IP: net.ParseIP("10.0.0.1").To4(), Port: 1234}
+		moved = chihaya.Peer{ID: id, IP: net.ParseIP("10.0.0.1").To4(), Port: 1235}
+		keyed = chihaya.Peer{ID: id, IP: net.ParseIP("10.0.0.2").To4(), Port: 1236, Key: "A1B2C3D4"}
+	)
+	requireFound := func(expected chihaya.Peer, ok bool) {
+		shard := s.shards[s.shardIndex(hash)]
+		p, found := shard.swarms[hash].v4.find(id)
+		require.Equal(t, ok, found)
+		require.True(t, p.Equal(expected), "expected %v, got %v", expected, p)
+	}
+
+	// the most recently added address of a peer is found, across moves
+	// between the seeders and the leechers
+	require.Nil(t, s.PutLeecher(hash, peer))
+	require.Nil(t, s.PutLeecher(hash, moved))
+	requireFound(moved, true)
+	require.Nil(t, s.GraduateLeecher(hash, moved))
+	require.Nil(t, s.PutLeecher(hash, peer))
+	requireFound(moved, true)
+
+	// deleted and replaced addresses are not found again
+	require.Nil(t, s.DeleteSeeder(hash, moved))
+	requireFound(peer, true)
+	require.Nil(t, s.PutLeecher(hash, chihaya.Peer{ID: id, IP: keyed.IP, Port: 1237, Key: keyed.Key}))
+	require.Nil(t, s.PutLeecher(hash, keyed))
+	require.Nil(t, s.DeleteLeecher(hash, peer))
+	requireFound(keyed, true)
+	require.Nil(t, s.DeleteLeecher(hash, keyed))
+	require.Nil(t, s.PutLeecher(hash, chihaya.Peer{ID: chihaya.PeerID{2}, IP: peer.IP, Port: 1}))
+	requireFound(chihaya.Peer{}, false)
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestAnnouncePeersCanceled(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	seeder := chihaya.Peer{ID: chihaya.PeerIDFromString("00000000000000000001"), IP: net.ParseIP("10.0.0.1").To4(), Port: 1234}
+	leecher := chihaya.Peer{ID: chihaya.PeerIDFromString("00000000000000000002"), IP: net.ParseIP("10.0.0.2").To4(), Port: 1234}
+	require.Nil(t, s.PutSeeder(hash, seeder))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = s.AnnouncePeersContext(ctx, hash, false, 50, leecher, chihaya.Peer{}, store.SameFamily)
+	require.Equal(t, context.Canceled, err)
+
+	// A request waiting for the lock of its shard is canceled.
+	shard := s.shards[s.shardIndex(hash)]
+	shard.Lock()
+	ctx, cancel = context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, _, err := s.AnnouncePeersContext(ctx, hash, false, 50, leecher, chihaya.Peer{}, store.SameFamily)
+		errs <- err
+	}()
+	cancel()
+	shard.Unlock()
+	require.Equal(t, context.Canceled, <-errs)
+
+	peers, _, err := s.AnnouncePeersContext(context.Background(), hash, false, 50, leecher, chihaya.Peer{}, store.SameFamily)
+	require.Nil(t, err)
+	require.Equal(t, []chihaya.Peer{seeder}, peers)
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestDownloadedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-peerstore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &store.DriverConfig{
+		Config: map[string]interface{}{
+			"shards":          4,
+			"downloaded_file": filepath.Join(dir, "downloaded"),
+		},
+	}
+	hash := chihaya.InfoHashFromString("00000000000000000001")
+	peer := chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1234}
+
+	// a missing file is not an error
+	ps, err := (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutLeecher(hash, peer))
+	require.Nil(t, ps.GraduateLeecher(hash, peer))
+	require.Nil(t, ps.IncrementDownloaded(hash))
+	require.Nil(t, <-ps.Stop())
+
+	ps, err = (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	seeders, leechers, downloaded, err := ps.GetStats(hash)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(0), leechers)
+	require.Equal(t, uint64(2), downloaded)
+	require.Nil(t, <-ps.Stop())
+
+	// every truncated or corrupted file must fail
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "downloaded"))
+	require.Nil(t, err)
+
+	s := newPeerStore(4, defaultEventBuffer)
+	for i := 0; i < len(contents); i++ {
+		require.NotNil(t, s.readDownloaded(bytes.NewReader(contents[:i])), "truncated to %d bytes", i)
+
+		corrupt := append([]byte(nil), contents...)
+		corrupt[i] ^= 0x5a
+		require.NotNil(t, s.readDownloaded(bytes.NewReader(corrupt)), "corrupted byte %d", i)
+	}
+
+	// a malformed file fails New
+	err = ioutil.WriteFile(filepath.Join(dir, "downloaded"), []byte("CHPD"), 0644)
+	require.Nil(t, err)
+
+	_, err = (&peerStoreDriver{}).New(cfg)
+	require.NotNil(t, err)
+}
+
+func TestPeerStoreReap(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Clock: fake, Config: map[string]interface{}{
+		"reap_interval": "20m",
+		"peer_lifetime": "30m",
+	}})
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	stale := chihaya.InfoHashFromString("00000000000000000001")
+	fresh := chihaya.InfoHashFromString("00000000000000000002")
+	peer := func(id string) chihaya.Peer {
+		return chihaya.Peer{
+			ID:   chihaya.PeerIDFromString(id),
+			IP:   net.ParseIP("10.0.0.1").To4(),
+			Port: 1234,
+		}
+	}
+
+	require.Nil(t, s.PutSeeder(stale, peer("00000000000000000001")))
+	require.Nil(t, s.PutLeecher(stale, peer("00000000000000000002")))
+	require.Nil(t, s.PutSeeder(fresh, peer("00000000000000000001")))
+	require.Nil(t, s.PutLeecher(fresh, peer("00000000000000000002")))
+
+	// The first cycle reaps nothing, the second the peers that did not
+	// announce again.
+	fake.BlockUntil(1)
+	fake.Advance(20 * time.Minute)
+	require.Nil(t, s.PutSeeder(fresh, peer("00000000000000000001")))
+	fake.Advance(20 * time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.shards[0].RLock()
+		numSwarms := len(s.shards[0].swarms)
+		s.shards[0].RUnlock()
+
+		if numSwarms == 1 && s.NumLeechers(fresh) == 0 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "stale peers were not reaped")
+		time.Sleep(time.Millisecond)
+	}
+
+	require.Equal(t, 1, s.NumSeeders(fresh))
+	require.Equal(t, 0, s.NumSeeders(stale))
+
+	require.Nil(t, <-s.Stop())
+}
+
+// BenchmarkSwarmPeerLimit joins new leechers to a swarm at its limit, each of
+// them evicting the peer that announced least recently.
+func BenchmarkSwarmPeerLimit(b *testing.B) {
+	const limit = 100000
+	ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+		"max_peers_per_swarm": limit,
+	}})
+	require.Nil(b, err)
+	defer func() { require.Nil(b, <-ps.Stop()) }()
+
+	hash := chihaya.InfoHash{1}
+	peer := func(i int) chihaya.Peer {
+		var id chihaya.PeerID
+		binary.BigEndian.PutUint64(id[:], uint64(i))
+		return chihaya.Peer{ID: id, IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(), Port: 6881}
+	}
+	for i := 0; i < limit; i++ {
+		require.Nil(b, ps.PutLeecher(hash, peer(i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps.PutLeecher(hash, peer(limit+i))
+	}
+}
+
 func BenchmarkPeerStore_PutSeeder(b *testing.B) {
 	peerStoreBenchmarker.PutSeeder(b, peerStoreTestConfig)
 }
@@ -140,3 +715,61 @@ func BenchmarkPeerStore_NumSeeders(b *testing.B) {
 func BenchmarkPeerStore_NumSeeders1KInfohash(b *testing.B) {
 	peerStoreBenchmarker.NumSeeders1KInfohash(b, peerStoreTestConfig)
 }
+
+func BenchmarkPeerStore_AnnounceParallel1KInfohash(b *testing.B) {
+	peerStoreBenchmarker.AnnounceParallel1KInfohash(b, peerStoreTestConfig)
+}
+
+// BenchmarkPeerStore_AnnounceParallelShards shows how announces to distinct
+// swarms scale with the number of shards.
+func BenchmarkPeerStore_AnnounceParallelShards(b *testing.B) {
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			peerStoreBenchmarker.AnnounceParallel1KInfohash(b, &store.DriverConfig{
+				Config: map[string]interface{}{"shards": shards},
+			})
+		})
+	}
+}
+
+// BenchmarkPeerStore_SwarmSizeHint fills a new swarm with 10000 leechers, as
+// the launch of a popular torrent does, with and without a matching size
+// hint.
+func BenchmarkPeerStore_SwarmSizeHint(b *testing.B) {
+	const numPeers = 10000
+	infoHash := chihaya.InfoHashFromString("00000000000000000001")
+	peers := make([]chihaya.Peer, numPeers)
+	for i := range peers {
+		peers[i] = chihaya.Peer{ID: chihaya.PeerID{byte(i), byte(i >> 8)}, IP: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Port: 6881}
+	}
+
+	for _, bb := range []struct {
+		name string
+		hint int
+	}{
+		{"Unhinted", 0},
+		{"Hinted", numPeers},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			ps, err := (&peerStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+				"swarm_size_hints": map[string]int{fmt.Sprintf("%x", infoHash[:]): bb.hint},
+			}})
+			require.Nil(b, err)
+			s := ps.(*peerStore)
+			defer func() { require.Nil(b, <-s.Stop()) }()
+			shard := s.shards[s.shardIndex(infoHash)]
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, p := range peers {
+					s.PutLeecher(infoHash, p)
+				}
+
+				shard.Lock()
+				delete(shard.swarms, infoHash)
+				shard.Unlock()
+			}
+		})
+	}
+}
@@ -5,8 +5,14 @@
 package memory
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/server/store"
 )
 
@@ -16,22 +22,142 @@ func init() {
 
 type stringStoreDriver struct{}
 
-func (d *stringStoreDriver) New(_ *store.DriverConfig) (store.StringStore, error) {
-	return &stringStore{
-		strings: make(map[string]struct{}),
+func (d *stringStoreDriver) New(storecfg *store.DriverConfig) (store.StringStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newStringStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &stringStore{
+		strings: make(map[string]time.Time),
 		closed:  make(chan struct{}),
-	}, nil
+		reaped:  make(chan struct{}),
+		fold:    foldPrefixed(caseFoldings[cfg.CaseFolding], cfg.CaseFoldingPrefixes),
+		clock:   storecfg.ClockOrReal(),
+	}
+	go ss.reap(cfg.ReapInterval)
+
+	return ss, nil
+}
+
+type stringStoreConfig struct {
+	// CaseFolding is the folding strings are normalized with, one of none,
+	// lowercase or uppercase. It defaults to none.
+	CaseFolding string `yaml:"case_folding"`
+
+	// CaseFoldingPrefixes restricts the folding to the strings that start
+	// with one of them, e.g. to the pk- namespace of the passkey
+	// middleware. Strings of other namespaces, like raw infohashes or peer
+	// ID prefixes, are then matched exactly. If it is empty, every string is
+	// folded.
+	CaseFoldingPrefixes []string `yaml:"case_folding_prefixes"`
+
+	// ReapInterval is the interval at which expired strings are deleted.
+	ReapInterval time.Duration `yaml:"reap_interval"`
+}
+
+func newStringStoreConfig(storecfg *store.DriverConfig) (*stringStoreConfig, error) {
+	bytes, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg stringStoreConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CaseFolding == "" {
+		cfg.CaseFolding = "none"
+	}
+	if _, ok := caseFoldings[cfg.CaseFolding]; !ok {
+		return nil, fmt.Errorf("memory: invalid StringStore config: unknown case folding %q (must be none, lowercase or uppercase)", cfg.CaseFolding)
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	return &cfg, nil
+}
+
+// caseFoldings maps the names of the available case foldings to functions
+// that normalize strings accordingly.
+//
+// Only ASCII letters are folded, so that binary strings are never mangled
+// into invalid UTF-8. They can still collide though: two raw infohashes that
+// only differ in bytes that are ASCII letters of different cases fold to the
+// same string, which is why folding is off by default.
+var caseFoldings = map[string]func(string) string{
+	"none":      func(s string) string { return s },
+	"lowercase": func(s string) string { return foldASCII(s, 'A', 'Z') },
+	"uppercase": func(s string) string { return foldASCII(s, 'a', 'z') },
+}
+
+// foldPrefixed returns a function that folds the strings that start with one
+// of prefixes with fold, and keeps the others as they are. If there are no
+// prefixes, it returns fold.
+func foldPrefixed(fold func(string) string, prefixes []string) func(string) string {
+	if len(prefixes) == 0 {
+		return fold
+	}
+	return func(s string) string {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(s, prefix) {
+				return fold(s)
+			}
+		}
+		return s
+	}
+}
+
+// foldASCII swaps the case of every ASCII letter of s in the range [lo, hi].
+func foldASCII(s string, lo, hi byte) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= lo && s[i] <= hi {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= lo && b[j] <= hi {
+					b[j] ^= 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
 }
 
 type stringStore struct {
-	strings map[string]struct{}
+	// strings maps the stored strings to their expiry, which is zero for
+	// strings that never expire.
+	strings map[string]time.Time
 	closed  chan struct{}
 	sync.RWMutex
+
+	// reaped is closed once the reaper stopped.
+	reaped chan struct{}
+
+	// fold normalizes strings before they are stored or looked up.
+	fold func(string) string
+
+	// clock tells the time strings expire at and ticks the reaper.
+	clock clock.Clock
 }
 
-var _ store.StringStore = &stringStore{}
+var (
+	_ store.StringStore      = &stringStore{}
+	_ store.MultiStringStore = &stringStore{}
+)
 
 func (ss *stringStore) PutString(s string) error {
+	return ss.PutStringWithExpiry(s, time.Time{})
+}
+
+func (ss *stringStore) PutStringWithExpiry(s string, expires time.Time) error {
 	ss.Lock()
 	defer ss.Unlock()
 
@@ -41,11 +167,17 @@ func (ss *stringStore) PutString(s string) error {
 	default:
 	}
 
-	ss.strings[s] = struct{}{}
+	ss.strings[ss.fold(s)] = expires
 
 	return nil
 }
 
+// has returns whether s is stored and has not expired. The lock must be held.
+func (ss *stringStore) has(s string) bool {
+	expires, ok := ss.strings[s]
+	return ok && (expires.IsZero() || ss.clock.Now().Before(expires))
+}
+
 func (ss *stringStore) HasString(s string) (bool, error) {
 	ss.RLock()
 	defer ss.RUnlock()
@@ -56,9 +188,26 @@ func (ss *stringStore) HasString(s string) (bool, error) {
 	default:
 	}
 
-	_, ok := ss.strings[s]
+	return ss.has(ss.fold(s)), nil
+}
+
+// HasAnyString looks up all strings under a single read lock.
+func (ss *stringStore) HasAnyString(strs []string) (bool, error) {
+	ss.RLock()
+	defer ss.RUnlock()
+
+	select {
+	case <-ss.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
 
-	return ok, nil
+	for _, s := range strs {
+		if ss.has(ss.fold(s)) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (ss *stringStore) RemoveString(s string) error {
@@ -71,7 +220,8 @@ func (ss *stringStore) RemoveString(s string) error {
 	default:
 	}
 
-	if _, ok := ss.strings[s]; !ok {
+	s = ss.fold(s)
+	if !ss.has(s) {
 		return store.ErrResourceDoesNotExist
 	}
 
@@ -80,13 +230,45 @@ func (ss *stringStore) RemoveString(s string) error {
 	return nil
 }
 
+// reap periodically deletes expired strings, until the store is stopped.
+func (ss *stringStore) reap(interval time.Duration) {
+	defer close(ss.reaped)
+
+	t := ss.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ss.closed:
+			return
+		case <-t.C():
+			ss.deleteExpired()
+		}
+	}
+}
+
+// deleteExpired deletes the strings that have expired.
+func (ss *stringStore) deleteExpired() {
+	ss.Lock()
+	defer ss.Unlock()
+
+	now := ss.clock.Now()
+	for s, expires := range ss.strings {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(ss.strings, s)
+		}
+	}
+}
+
 func (ss *stringStore) Stop() <-chan error {
 	toReturn := make(chan error)
 	go func() {
 		ss.Lock()
-		defer ss.Unlock()
-		ss.strings = make(map[string]struct{})
+		ss.strings = make(map[string]time.Time)
 		close(ss.closed)
+		ss.Unlock()
+
+		<-ss.reaped
 		close(toReturn)
 	}()
 	return toReturn
@@ -6,8 +6,12 @@ package memory
 
 import (
 	"testing"
+	"time"
 
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/server/store"
+
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -20,6 +24,170 @@ func TestStringStore(t *testing.T) {
 	stringStoreTester.TestStringStore(t, stringStoreTestConfig)
 }
 
+func TestStringStoreCaseFolding(t *testing.T) {
+	var (
+		lower = "infohash:3dbf6fa32a4bcc1a1a8e0c8b2e8b5bd6e5d7e8a9"
+		upper = "INFOHASH:3DBF6FA32A4BCC1A1A8E0C8B2E8B5BD6E5D7E8A9"
+		mixed = "infohash:3DbF6fA32a4BcC1a1a8E0c8B2e8B5bD6e5D7e8A9"
+	)
+
+	for _, folding := range []string{"lowercase", "uppercase"} {
+		ss, err := (&stringStoreDriver{}).New(&store.DriverConfig{
+			Config: map[string]interface{}{"case_folding": folding},
+		})
+		require.Nil(t, err)
+
+		require.Nil(t, ss.PutString(mixed))
+		for _, s := range []string{lower, upper, mixed} {
+			has, err := ss.HasString(s)
+			require.Nil(t, err)
+			require.True(t, has, "%q with case folding %q", s, folding)
+		}
+
+		require.Nil(t, ss.RemoveString(upper))
+		has, err := ss.HasString(lower)
+		require.Nil(t, err)
+		require.False(t, has)
+
+		require.Nil(t, <-ss.Stop())
+	}
+
+	// strings are matched exactly by default
+	ss, err := (&stringStoreDriver{}).New(&store.DriverConfig{})
+	require.Nil(t, err)
+
+	require.Nil(t, ss.PutString(mixed))
+	has, err := ss.HasString(mixed)
+	require.Nil(t, err)
+	require.True(t, has)
+	for _, s := range []string{lower, upper} {
+		has, err = ss.HasString(s)
+		require.Nil(t, err)
+		require.False(t, has)
+	}
+	require.Equal(t, store.ErrResourceDoesNotExist, ss.RemoveString(lower))
+	require.Nil(t, <-ss.Stop())
+
+	_, err = (&stringStoreDriver{}).New(&store.DriverConfig{
+		Config: map[string]interface{}{"case_folding": "titlecase"},
+	})
+	require.NotNil(t, err)
+}
+
+func TestStringStoreCaseFoldingPrefixes(t *testing.T) {
+	// two raw infohashes that only differ in the case of ASCII letters
+	var (
+		infoHash1 = "ih-" + string([]byte{0x41, 0x00, 0xff, 0x5a})
+		infoHash2 = "ih-" + string([]byte{0x61, 0x00, 0xff, 0x7a})
+	)
+
+	for _, config := range []map[string]interface{}{
+		nil,
+		{"case_folding": "lowercase", "case_folding_prefixes": []string{"pk-"}},
+	} {
+		ss, err := (&stringStoreDriver{}).New(&store.DriverConfig{Config: config})
+		require.Nil(t, err)
+
+		require.Nil(t, ss.PutString(infoHash1))
+		has, err := ss.HasString(infoHash2)
+		require.Nil(t, err)
+		require.False(t, has, "%v", config)
+		require.Equal(t, store.ErrResourceDoesNotExist, ss.RemoveString(infoHash2))
+
+		has, err = ss.HasString(infoHash1)
+		require.Nil(t, err)
+		require.True(t, has, "%v", config)
+		require.Nil(t, <-ss.Stop())
+	}
+
+	// the strings with the prefixes are still folded
+	ss, err := (&stringStoreDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+		"case_folding":          "lowercase",
+		"case_folding_prefixes": []string{"pk-"},
+	}})
+	require.Nil(t, err)
+	require.Nil(t, ss.PutString("pk-ABCD"))
+	has, err := ss.HasString("pk-abcd")
+	require.Nil(t, err)
+	require.True(t, has)
+	require.Nil(t, <-ss.Stop())
+}
+
+func TestStringStoreExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000000, 0))
+	st, err := (&stringStoreDriver{}).New(&store.DriverConfig{Clock: fake})
+	require.Nil(t, err)
+	ss := st.(*stringStore)
+	now := fake.Now()
+
+	require.Nil(t, ss.PutStringWithExpiry("temporary", now.Add(time.Hour)))
+	require.Nil(t, ss.PutStringWithExpiry("removed", now.Add(time.Hour)))
+	require.Nil(t, ss.PutString("permanent"))
+	require.Nil(t, ss.RemoveString("removed"))
+
+	has := func(s string) bool {
+		ok, err := ss.HasString(s)
+		require.Nil(t, err)
+		return ok
+	}
+
+	fake.Advance(time.Hour - time.Second)
+	require.True(t, has("temporary"))
+	require.False(t, has("removed"))
+
+	// Expired strings are absent before they are reaped.
+	fake.Advance(time.Second)
+	require.False(t, has("temporary"))
+	require.True(t, has("permanent"))
+	require.Equal(t, store.ErrResourceDoesNotExist, ss.RemoveString("temporary"))
+	require.Len(t, ss.strings, 2)
+
+	ss.deleteExpired()
+	require.Len(t, ss.strings, 1)
+	require.True(t, has("permanent"))
+
+	require.Nil(t, <-ss.Stop())
+}
+
+// TestStringStoreReaper makes sure that the reaper deletes expired strings
+// and exits when the store is stopped.
+func TestStringStoreReaper(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1000000, 0))
+	st, err := (&stringStoreDriver{}).New(&store.DriverConfig{Clock: fake, Config: map[string]interface{}{
+		"reap_interval": "1m",
+	}})
+	require.Nil(t, err)
+	ss := st.(*stringStore)
+
+	require.Nil(t, ss.PutStringWithExpiry("temporary", fake.Now().Add(30*time.Second)))
+	reaped := func() bool {
+		ss.RLock()
+		defer ss.RUnlock()
+		return len(ss.strings) == 0
+	}
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	for deadline := time.Now().Add(time.Second); !reaped(); {
+		require.True(t, time.Now().Before(deadline), "expired string not reaped")
+		time.Sleep(time.Millisecond)
+	}
+
+	require.Nil(t, <-ss.Stop())
+	select {
+	case <-ss.reaped:
+	default:
+		t.Fatal("reaper still running after Stop")
+	}
+}
+
+func TestFoldASCII(t *testing.T) {
+	binary := "\x00\xffAz\xc3"
+	require.Equal(t, "\x00\xffaz\xc3", caseFoldings["lowercase"](binary))
+	require.Equal(t, "\x00\xffAZ\xc3", caseFoldings["uppercase"](binary))
+	require.Equal(t, binary, caseFoldings["none"](binary))
+}
+
 func BenchmarkStringStore_AddShort(b *testing.B) {
 	stringStoreBenchmarker.AddShort(b, stringStoreTestConfig)
 }
@@ -12,23 +12,35 @@ import (
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("client_blacklist", blacklistAnnounceClient)
+	tracker.RegisterAnnounceMiddlewareConstructor("client_blacklist", blacklistAnnounceClient)
 }
 
 // ErrBlacklistedClient is returned by an announce middleware if the announcing
 // Client is blacklisted.
 var ErrBlacklistedClient = tracker.ClientError("client blacklisted")
 
-// blacklistAnnounceClient provides a middleware that only allows Clients to
-// announce that are not stored in the StringStore.
-func blacklistAnnounceClient(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
-		blacklisted, err := store.MustGetStore().HasString(PrefixClient + clientid.New(string(req.PeerID[:])))
-		if err != nil {
-			return err
-		} else if blacklisted {
-			return ErrBlacklistedClient
-		}
-		return next(cfg, req, resp)
+// blacklistAnnounceClient provides a middleware constructor for a middleware
+// that only allows Clients to announce that are not stored in the StringStore.
+//
+// The middleware fails open by default.
+func blacklistAnnounceClient(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policy, err := store.ParseFailurePolicy(c, store.FailOpen)
+	if err != nil {
+		return nil, err
 	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			blacklisted, err := store.MustGetStore().HasString(PrefixClient + clientid.New(string(req.PeerID[:])))
+			if err != nil {
+				err = policy.HandleError(req.Context(), "client_blacklist", err)
+				if err != nil {
+					return err
+				}
+			} else if blacklisted {
+				return ErrBlacklistedClient
+			}
+			return next(cfg, req, resp)
+		}
+	}, nil
 }
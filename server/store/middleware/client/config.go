@@ -0,0 +1,77 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// ErrUnknownMode is returned by a MiddlewareConstructor if the Mode specified
+// in the configuration is unknown.
+var ErrUnknownMode = errors.New("unknown mode")
+
+// defaultMaxPrefixLength is the length of the longest peer ID prefix that is
+// looked up if none is configured. It covers the Azureus-style "-UT3500-".
+const defaultMaxPrefixLength = 8
+
+// Mode represents the mode of operation of the client_prefix middleware.
+type Mode string
+
+const (
+	// ModeDeny makes the middleware reject announces whose peer ID starts
+	// with a stored prefix.
+	ModeDeny = Mode("deny")
+
+	// ModeAllow makes the middleware reject announces whose peer ID starts
+	// with none of the stored prefixes.
+	ModeAllow = Mode("allow")
+)
+
+// PrefixConfig represents the configuration of the client_prefix
+// middleware.
+type PrefixConfig struct {
+	Mode Mode `yaml:"mode"`
+
+	// MaxPrefixLength is the length of the longest prefix that is looked
+	// up. Every shorter prefix of a peer ID is looked up, too, so it bounds
+	// the number of StringStore lookups per announce.
+	MaxPrefixLength int `yaml:"max_prefix_length"`
+}
+
+// newPrefixConfig parses the given MiddlewareConfig as a PrefixConfig.
+// The mode defaults to ModeDeny, ErrUnknownMode is returned if it is unknown.
+func newPrefixConfig(mwcfg chihaya.MiddlewareConfig) (*PrefixConfig, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg PrefixConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Mode == "" {
+		cfg.Mode = ModeDeny
+	}
+	if cfg.Mode != ModeDeny && cfg.Mode != ModeAllow {
+		return nil, ErrUnknownMode
+	}
+
+	if cfg.MaxPrefixLength == 0 {
+		cfg.MaxPrefixLength = defaultMaxPrefixLength
+	}
+	if cfg.MaxPrefixLength < 1 || cfg.MaxPrefixLength > len(chihaya.PeerID{}) {
+		return nil, fmt.Errorf("max_prefix_length must be between 1 and %d, got %d", len(chihaya.PeerID{}), cfg.MaxPrefixLength)
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package client
+
+import (
+	"encoding/hex"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("client_prefix", prefixAnnounceClient)
+	mustGetStore = func() store.StringStore {
+		return store.MustGetStore().StringStore
+	}
+}
+
+// PrefixClientPrefix is the prefix to be used for peer ID prefixes.
+const PrefixClientPrefix = "cp-"
+
+var (
+	// ErrDeniedClientPrefix is returned by the client_prefix middleware in
+	// ModeDeny if the peer ID of an announce starts with a stored prefix.
+	ErrDeniedClientPrefix = tracker.ClientError("client denied by client_prefix deny list")
+
+	// ErrClientPrefixNotAllowed is returned by the client_prefix middleware
+	// in ModeAllow if the peer ID of an announce starts with none of the
+	// stored prefixes.
+	ErrClientPrefixNotAllowed = tracker.ClientError("client not in client_prefix allow list")
+)
+
+var mustGetStore func() store.StringStore
+
+// PrefixKey returns the key a peer ID prefix is stored under in the
+// StringStore.
+//
+// The prefix is hex-encoded, so that prefixes which only differ in case, like
+// -lt and -LT, are kept apart by StringStores that fold the case of strings.
+func PrefixKey(prefix string) string {
+	return PrefixClientPrefix + hex.EncodeToString([]byte(prefix))
+}
+
+// hasStoredPrefix reports whether any prefix of peerID of up to maxLength
+// bytes is stored in the StringStore. The prefixes are looked up at once if
+// the StringStore supports it.
+func hasStoredPrefix(peerID chihaya.PeerID, maxLength int) (bool, error) {
+	keys := make([]string, maxLength)
+	for n := 1; n <= maxLength; n++ {
+		keys[n-1] = PrefixKey(string(peerID[:n]))
+	}
+	return store.HasAnyString(mustGetStore(), keys)
+}
+
+// prefixAnnounceClient provides a middleware constructor for a middleware
+// that rejects announces based on the prefix of their peer ID, which
+// identifies the client.
+//
+// In ModeDeny, the middleware fails open by default, in ModeAllow it fails
+// closed.
+func prefixAnnounceClient(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newPrefixConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	def := store.FailOpen
+	if cfg.Mode == ModeAllow {
+		def = store.FailClosed
+	}
+	policy, err := store.ParseFailurePolicy(c, def)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			stored, err := hasStoredPrefix(req.PeerID, cfg.MaxPrefixLength)
+			if err != nil {
+				err = policy.HandleError(req.Context(), "client_prefix", err)
+				if err != nil {
+					return err
+				}
+				return next(tcfg, req, resp)
+			}
+
+			if cfg.Mode == ModeDeny && stored {
+				log.DebugContext(req.Context(), "client: denied peer ID prefix", "mode", cfg.Mode)
+				return ErrDeniedClientPrefix
+			}
+			if cfg.Mode == ModeAllow && !stored {
+				log.DebugContext(req.Context(), "client: peer ID prefix not allowed", "mode", cfg.Mode)
+				return ErrClientPrefixNotAllowed
+			}
+			return next(tcfg, req, resp)
+		}
+	}, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+// failingStore is a StringStore whose lookups fail.
+type failingStore struct {
+	store.StringStore
+}
+
+func (failingStore) HasString(string) (bool, error) {
+	return false, errors.New("store failed")
+}
+
+// withStore makes the middleware use ss until the test ends.
+func withStore(t *testing.T, ss store.StringStore) {
+	previous := mustGetStore
+	mustGetStore = func() store.StringStore { return ss }
+	t.Cleanup(func() { mustGetStore = previous })
+}
+
+func announcePrefix(t *testing.T, config map[string]interface{}, peerID string) error {
+	mw, err := prefixAnnounceClient(chihaya.MiddlewareConfig{Name: "client_prefix", Config: config})
+	require.Nil(t, err)
+
+	req := &chihaya.AnnounceRequest{PeerID: chihaya.PeerIDFromString(peerID)}
+	return mw(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		return nil
+	})(&chihaya.TrackerConfig{}, req, &chihaya.AnnounceResponse{})
+}
+
+func TestPrefix(t *testing.T) {
+	ss, err := store.OpenStringStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ss.Stop()) }()
+	withStore(t, ss)
+
+	require.Nil(t, ss.PutString(PrefixKey("-UT")))
+	require.Nil(t, ss.PutString(PrefixKey("-qB4250-")))
+
+	const (
+		banned    = "-UT3500-MNu93JKnm930"
+		exact     = "-qB4250-kgjjfkd97620"
+		permitted = "-TR2940-6ep6svaa61r4"
+	)
+
+	var table = []struct {
+		mode     string
+		peerID   string
+		expected error
+	}{
+		{"", banned, ErrDeniedClientPrefix},
+		{"deny", banned, ErrDeniedClientPrefix},
+		{"deny", exact, ErrDeniedClientPrefix},
+		{"deny", permitted, nil},
+		{"allow", banned, nil},
+		{"allow", exact, nil},
+		{"allow", permitted, ErrClientPrefixNotAllowed},
+	}
+
+	for _, tt := range table {
+		config := map[string]interface{}{}
+		if tt.mode != "" {
+			config["mode"] = tt.mode
+		}
+		require.Equal(t, tt.expected, announcePrefix(t, config, tt.peerID), "%s in mode %q", tt.peerID, tt.mode)
+	}
+
+	// prefixes longer than the maximum length are not looked up
+	require.Nil(t, announcePrefix(t, map[string]interface{}{"max_prefix_length": 7}, exact))
+
+	// prefixes can be removed at runtime
+	require.Nil(t, ss.RemoveString(PrefixKey("-UT")))
+	require.Nil(t, announcePrefix(t, nil, banned))
+}
+
+func TestPrefixCaseFolding(t *testing.T) {
+	ss, err := store.OpenStringStore(&store.DriverConfig{
+		Name:   "memory",
+		Config: map[string]interface{}{"case_folding": "lowercase"},
+	})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ss.Stop()) }()
+	withStore(t, ss)
+
+	// -lt and -LT identify different clients, even in a store that folds
+	// the case of strings
+	require.Nil(t, ss.PutString(PrefixKey("-lt")))
+	require.Equal(t, ErrDeniedClientPrefix, announcePrefix(t, nil, "-lt0D80-MNu93JKnm930"))
+	require.Nil(t, announcePrefix(t, nil, "-LT0D80-MNu93JKnm930"))
+}
+
+// countingStore is a StringStore that counts its lookups.
+type countingStore struct {
+	store.StringStore
+	lookups int
+}
+
+func (s *countingStore) HasString(str string) (bool, error) {
+	s.lookups++
+	return s.StringStore.HasString(str)
+}
+
+func (s *countingStore) HasAnyString(strs []string) (bool, error) {
+	s.lookups++
+	return store.HasAnyString(s.StringStore, strs)
+}
+
+func TestPrefixSingleLookup(t *testing.T) {
+	ss, err := store.OpenStringStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ss.Stop()) }()
+	cs := &countingStore{StringStore: ss}
+	withStore(t, cs)
+
+	require.Nil(t, ss.PutString(PrefixKey("-UT3500-")))
+	require.Equal(t, ErrDeniedClientPrefix, announcePrefix(t, nil, "-UT3500-MNu93JKnm930"))
+	require.Nil(t, announcePrefix(t, nil, "-TR2940-6ep6svaa61r4"))
+	require.Equal(t, 2, cs.lookups)
+}
+
+func TestPrefixStoreErrors(t *testing.T) {
+	withStore(t, failingStore{})
+
+	var table = []struct {
+		config   map[string]interface{}
+		expected error
+	}{
+		{nil, nil},
+		{map[string]interface{}{"on_store_error": "closed"}, store.ErrStoreUnavailable},
+		{map[string]interface{}{"mode": "allow"}, store.ErrStoreUnavailable},
+		{map[string]interface{}{"mode": "allow", "on_store_error": "open"}, nil},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, announcePrefix(t, tt.config, "-UT3500-MNu93JKnm930"), "%v", tt.config)
+	}
+}
+
+func TestPrefixConfig(t *testing.T) {
+	var table = []map[string]interface{}{
+		{"mode": "block"},
+		{"max_prefix_length": -1},
+		{"max_prefix_length": 21},
+		{"on_store_error": "maybe"},
+	}
+
+	for _, config := range table {
+		_, err := prefixAnnounceClient(chihaya.MiddlewareConfig{Name: "client_prefix", Config: config})
+		require.NotNil(t, err, "%v", config)
+	}
+}
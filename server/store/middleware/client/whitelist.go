@@ -12,7 +12,7 @@ import (
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("client_whitelist", whitelistAnnounceClient)
+	tracker.RegisterAnnounceMiddlewareConstructor("client_whitelist", whitelistAnnounceClient)
 }
 
 // PrefixClient is the prefix to be used for client peer IDs.
@@ -22,16 +22,28 @@ const PrefixClient = "c-"
 // announcing Client is not whitelisted.
 var ErrNotWhitelistedClient = tracker.ClientError("client not whitelisted")
 
-// whitelistAnnounceClient provides a middleware that only allows Clients to
-// announce that are stored in the StringStore.
-func whitelistAnnounceClient(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
-		whitelisted, err := store.MustGetStore().HasString(PrefixClient + clientid.New(string(req.PeerID[:])))
-		if err != nil {
-			return err
-		} else if !whitelisted {
-			return ErrNotWhitelistedClient
-		}
-		return next(cfg, req, resp)
+// whitelistAnnounceClient provides a middleware constructor for a middleware
+// that only allows Clients to announce that are stored in the StringStore.
+//
+// The middleware fails closed by default.
+func whitelistAnnounceClient(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policy, err := store.ParseFailurePolicy(c, store.FailClosed)
+	if err != nil {
+		return nil, err
 	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			whitelisted, err := store.MustGetStore().HasString(PrefixClient + clientid.New(string(req.PeerID[:])))
+			if err != nil {
+				err = policy.HandleError(req.Context(), "client_whitelist", err)
+				if err != nil {
+					return err
+				}
+			} else if !whitelisted {
+				return ErrNotWhitelistedClient
+			}
+			return next(cfg, req, resp)
+		}
+	}, nil
 }
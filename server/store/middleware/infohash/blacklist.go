@@ -11,7 +11,7 @@ import (
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("infohash_blacklist", blacklistAnnounceInfohash)
+	tracker.RegisterAnnounceMiddlewareConstructor("infohash_blacklist", blacklistAnnounceInfohash)
 	tracker.RegisterScrapeMiddlewareConstructor("infohash_blacklist", blacklistScrapeInfohash)
 	mustGetStore = func() store.StringStore {
 		return store.MustGetStore().StringStore
@@ -24,19 +24,31 @@ var ErrBlockedInfohash = tracker.ClientError("disallowed infohash")
 
 var mustGetStore func() store.StringStore
 
-// blacklistAnnounceInfohash provides a middleware that only allows announces
-// for infohashes that are not stored in a StringStore.
-func blacklistAnnounceInfohash(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
-		blacklisted, err := mustGetStore().HasString(PrefixInfohash + string(req.InfoHash[:]))
-		if err != nil {
-			return err
-		} else if blacklisted {
-			return ErrBlockedInfohash
-		}
-
-		return next(cfg, req, resp)
+// blacklistAnnounceInfohash provides a middleware constructor for a
+// middleware that only allows announces for infohashes that are not stored in
+// a StringStore.
+//
+// The middleware fails open by default.
+func blacklistAnnounceInfohash(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policy, err := store.ParseFailurePolicy(c, store.FailOpen)
+	if err != nil {
+		return nil, err
 	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
+			blacklisted, err := mustGetStore().HasString(PrefixInfohash + string(req.InfoHash[:]))
+			if err != nil {
+				err = policy.HandleError(req.Context(), "infohash_blacklist", err)
+				if err != nil {
+					return err
+				}
+			} else if blacklisted {
+				return ErrBlockedInfohash
+			}
+			return next(cfg, req, resp)
+		}
+	}, nil
 }
 
 // blacklistScrapeInfohash provides a middleware constructor for a middleware
@@ -47,6 +59,7 @@ func blacklistAnnounceInfohash(next tracker.AnnounceHandler) tracker.AnnounceHan
 // disallowed.
 // The filter mode filters any disallowed infohashes from the scrape,
 // potentially leaving an empty scrape.
+// In both modes, the middleware fails open by default.
 //
 // ErrUnknownMode is returned if the Mode specified in the config is unknown.
 func blacklistScrapeInfohash(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
@@ -55,52 +68,67 @@ func blacklistScrapeInfohash(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddlewa
 		return nil, err
 	}
 
+	policy, err := store.ParseFailurePolicy(c, store.FailOpen)
+	if err != nil {
+		return nil, err
+	}
+
 	switch cfg.Mode {
 	case ModeFilter:
-		return blacklistFilterScrape, nil
+		return blacklistFilterScrape(policy), nil
 	case ModeBlock:
-		return blacklistBlockScrape, nil
+		return blacklistBlockScrape(policy), nil
 	default:
 		panic("unknown mode")
 	}
 }
 
-func blacklistFilterScrape(next tracker.ScrapeHandler) tracker.ScrapeHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
-		blacklisted := false
-		storage := mustGetStore()
-		infohashes := req.InfoHashes
-
-		for i, ih := range infohashes {
-			blacklisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
-
-			if err != nil {
-				return err
-			} else if blacklisted {
-				req.InfoHashes[i] = req.InfoHashes[len(req.InfoHashes)-1]
-				req.InfoHashes = req.InfoHashes[:len(req.InfoHashes)-1]
+func blacklistFilterScrape(policy store.FailurePolicy) tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
+			blacklisted := false
+			storage := mustGetStore()
+			infohashes := req.InfoHashes
+
+			for i, ih := range infohashes {
+				blacklisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
+
+				if err != nil {
+					err = policy.HandleError(req.Context(), "infohash_blacklist", err)
+					if err != nil {
+						return err
+					}
+				} else if blacklisted {
+					req.InfoHashes[i] = req.InfoHashes[len(req.InfoHashes)-1]
+					req.InfoHashes = req.InfoHashes[:len(req.InfoHashes)-1]
+				}
 			}
-		}
 
-		return next(cfg, req, resp)
+			return next(cfg, req, resp)
+		}
 	}
 }
 
-func blacklistBlockScrape(next tracker.ScrapeHandler) tracker.ScrapeHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
-		blacklisted := false
-		storage := mustGetStore()
-
-		for _, ih := range req.InfoHashes {
-			blacklisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
-
-			if err != nil {
-				return err
-			} else if blacklisted {
-				return ErrBlockedInfohash
+func blacklistBlockScrape(policy store.FailurePolicy) tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
+			blacklisted := false
+			storage := mustGetStore()
+
+			for _, ih := range req.InfoHashes {
+				blacklisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
+
+				if err != nil {
+					err = policy.HandleError(req.Context(), "infohash_blacklist", err)
+					if err != nil {
+						return err
+					}
+				} else if blacklisted {
+					return ErrBlockedInfohash
+				}
 			}
-		}
 
-		return next(cfg, req, resp)
+			return next(cfg, req, resp)
+		}
 	}
 }
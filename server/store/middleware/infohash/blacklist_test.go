@@ -6,6 +6,7 @@ package infohash
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -25,6 +26,10 @@ func (ss *storeMock) PutString(s string) error {
 	return nil
 }
 
+func (ss *storeMock) PutStringWithExpiry(s string, expires time.Time) error {
+	return ss.PutString(s)
+}
+
 func (ss *storeMock) HasString(s string) (bool, error) {
 	_, ok := ss.strings[s]
 
@@ -65,10 +70,12 @@ func TestBlacklistAnnounceMiddleware(t *testing.T) {
 		resp   chihaya.AnnounceResponse
 	)
 
-	achain.Append(blacklistAnnounceInfohash)
+	mw, err := blacklistAnnounceInfohash(chihaya.MiddlewareConfig{Name: "infohash_blacklist"})
+	assert.Nil(t, err)
+	achain.Append(mw)
 	handler := achain.Handler()
 
-	err := handler(nil, &req, &resp)
+	err = handler(nil, &req, &resp)
 	assert.Nil(t, err)
 
 	req.InfoHash = chihaya.InfoHash(ih1)
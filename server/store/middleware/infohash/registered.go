@@ -0,0 +1,58 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package infohash
+
+import (
+	"encoding/hex"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("infohash_registered", registeredAnnounceInfohash)
+}
+
+// PrefixRegisteredInfohash is the prefix to be used for registered
+// infohashes, which are stored hex-encoded.
+const PrefixRegisteredInfohash = "ihreg-"
+
+// ErrUnregisteredInfohash is returned by the infohash_registered middleware
+// if the infohash of an announce is not registered.
+var ErrUnregisteredInfohash = tracker.ClientError("torrent not registered")
+
+// RegisteredKey returns the string under which a registered infohash is
+// stored in the StringStore.
+func RegisteredKey(infoHash chihaya.InfoHash) string {
+	return PrefixRegisteredInfohash + hex.EncodeToString(infoHash[:])
+}
+
+// registeredAnnounceInfohash provides a middleware constructor for a
+// middleware that only allows announces for infohashes that are registered in
+// a StringStore.
+//
+// The middleware fails closed by default.
+func registeredAnnounceInfohash(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policy, err := store.ParseFailurePolicy(c, store.FailClosed)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
+			registered, err := mustGetStore().HasString(RegisteredKey(req.InfoHash))
+			if err != nil {
+				err = policy.HandleError(req.Context(), "infohash_registered", err)
+				if err != nil {
+					return err
+				}
+			} else if !registered {
+				return ErrUnregisteredInfohash
+			}
+			return next(cfg, req, resp)
+		}
+	}, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package infohash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestRegisteredKey(t *testing.T) {
+	assert.Equal(t, "ihreg-0100000000000000000000000000000000000000", RegisteredKey(ih1))
+}
+
+func TestRegisteredAnnounceMiddleware(t *testing.T) {
+	var (
+		achain tracker.AnnounceChain
+		req    chihaya.AnnounceRequest
+		resp   chihaya.AnnounceResponse
+	)
+
+	mw, err := registeredAnnounceInfohash(chihaya.MiddlewareConfig{Name: "infohash_registered"})
+	assert.Nil(t, err)
+	achain.Append(mw)
+	handler := achain.Handler()
+
+	req.InfoHash = ih2
+	err = handler(nil, &req, &resp)
+	assert.Equal(t, ErrUnregisteredInfohash, err)
+
+	assert.Nil(t, mustGetStore().PutString(RegisteredKey(ih2)))
+	err = handler(nil, &req, &resp)
+	assert.Nil(t, err)
+
+	// the black- and whitelist entries are not registrations
+	req.InfoHash = ih1
+	err = handler(nil, &req, &resp)
+	assert.Equal(t, ErrUnregisteredInfohash, err)
+
+	assert.Nil(t, mustGetStore().RemoveString(RegisteredKey(ih2)))
+	req.InfoHash = ih2
+	err = handler(nil, &req, &resp)
+	assert.Equal(t, ErrUnregisteredInfohash, err)
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package infohash
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// failingStore is a StringStore whose lookups fail.
+type failingStore struct {
+	store.StringStore
+}
+
+func (failingStore) HasString(string) (bool, error) {
+	return false, errors.New("store failed")
+}
+
+// withFailingStore makes the middlewares use a failingStore until the test
+// ends.
+func withFailingStore(t *testing.T) {
+	previous := mustGetStore
+	mustGetStore = func() store.StringStore {
+		return failingStore{}
+	}
+	t.Cleanup(func() { mustGetStore = previous })
+}
+
+func policyConfig(name, mode, policy string) chihaya.MiddlewareConfig {
+	config := map[string]interface{}{}
+	if mode != "" {
+		config["mode"] = mode
+	}
+	if policy != "" {
+		config["on_store_error"] = policy
+	}
+	return chihaya.MiddlewareConfig{Name: name, Config: config}
+}
+
+func TestAnnounceStoreErrors(t *testing.T) {
+	withFailingStore(t)
+
+	var table = []struct {
+		name        string
+		constructor tracker.AnnounceMiddlewareConstructor
+		policy      string
+		expected    error
+	}{
+		{"infohash_blacklist", blacklistAnnounceInfohash, "", nil},
+		{"infohash_blacklist", blacklistAnnounceInfohash, "closed", store.ErrStoreUnavailable},
+		{"infohash_whitelist", whitelistAnnounceInfohash, "", store.ErrStoreUnavailable},
+		{"infohash_whitelist", whitelistAnnounceInfohash, "open", nil},
+		{"infohash_registered", registeredAnnounceInfohash, "", store.ErrStoreUnavailable},
+		{"infohash_registered", registeredAnnounceInfohash, "open", nil},
+	}
+
+	for _, tt := range table {
+		mw, err := tt.constructor(policyConfig(tt.name, "", tt.policy))
+		require.Nil(t, err)
+
+		var called bool
+		handler := mw(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+			called = true
+			return nil
+		})
+
+		err = handler(nil, &chihaya.AnnounceRequest{InfoHash: ih1}, &chihaya.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, "%s with policy %q", tt.name, tt.policy)
+		require.Equal(t, tt.expected == nil, called, "%s with policy %q", tt.name, tt.policy)
+	}
+
+	_, err := whitelistAnnounceInfohash(policyConfig("infohash_whitelist", "", "maybe"))
+	require.Equal(t, store.ErrUnknownFailurePolicy, err)
+}
+
+func TestScrapeStoreErrors(t *testing.T) {
+	withFailingStore(t)
+
+	var table = []struct {
+		name        string
+		constructor tracker.ScrapeMiddlewareConstructor
+		mode        Mode
+		policy      string
+		expected    error
+	}{
+		{"infohash_blacklist", blacklistScrapeInfohash, ModeBlock, "", nil},
+		{"infohash_blacklist", blacklistScrapeInfohash, ModeFilter, "", nil},
+		{"infohash_blacklist", blacklistScrapeInfohash, ModeFilter, "closed", store.ErrStoreUnavailable},
+		{"infohash_whitelist", whitelistScrapeInfohash, ModeBlock, "", store.ErrStoreUnavailable},
+		{"infohash_whitelist", whitelistScrapeInfohash, ModeFilter, "", store.ErrStoreUnavailable},
+		{"infohash_whitelist", whitelistScrapeInfohash, ModeBlock, "open", nil},
+	}
+
+	for _, tt := range table {
+		mw, err := tt.constructor(policyConfig(tt.name, string(tt.mode), tt.policy))
+		require.Nil(t, err)
+
+		var scraped []chihaya.InfoHash
+		handler := mw(func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			scraped = req.InfoHashes
+			return nil
+		})
+
+		req := &chihaya.ScrapeRequest{InfoHashes: []chihaya.InfoHash{ih1, ih2}}
+		err = handler(nil, req, &chihaya.ScrapeResponse{})
+		require.Equal(t, tt.expected, err, "%s in mode %s with policy %q", tt.name, tt.mode, tt.policy)
+		if tt.expected == nil {
+			// Failing open keeps all infohashes.
+			require.Equal(t, []chihaya.InfoHash{ih1, ih2}, scraped)
+		}
+	}
+}
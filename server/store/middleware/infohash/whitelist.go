@@ -6,30 +6,43 @@ package infohash
 
 import (
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
 	"github.com/chihaya/chihaya/tracker"
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("infohash_whitelist", whitelistAnnounceInfohash)
+	tracker.RegisterAnnounceMiddlewareConstructor("infohash_whitelist", whitelistAnnounceInfohash)
 	tracker.RegisterScrapeMiddlewareConstructor("infohash_whitelist", whitelistScrapeInfohash)
 }
 
 // PrefixInfohash is the prefix to be used for infohashes.
 const PrefixInfohash = "ih-"
 
-// whitelistAnnounceInfohash provides a middleware that only allows announces
-// for infohashes that are not stored in a StringStore
-func whitelistAnnounceInfohash(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
-		whitelisted, err := mustGetStore().HasString(PrefixInfohash + string(req.InfoHash[:]))
+// whitelistAnnounceInfohash provides a middleware constructor for a
+// middleware that only allows announces for infohashes that are stored in a
+// StringStore.
+//
+// The middleware fails closed by default.
+func whitelistAnnounceInfohash(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	policy, err := store.ParseFailurePolicy(c, store.FailClosed)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return err
-		} else if !whitelisted {
-			return ErrBlockedInfohash
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
+			whitelisted, err := mustGetStore().HasString(PrefixInfohash + string(req.InfoHash[:]))
+			if err != nil {
+				err = policy.HandleError(req.Context(), "infohash_whitelist", err)
+				if err != nil {
+					return err
+				}
+			} else if !whitelisted {
+				return ErrBlockedInfohash
+			}
+			return next(cfg, req, resp)
 		}
-		return next(cfg, req, resp)
-	}
+	}, nil
 }
 
 // whitelistScrapeInfohash provides a middleware constructor for a middleware
@@ -40,6 +53,7 @@ func whitelistAnnounceInfohash(next tracker.AnnounceHandler) tracker.AnnounceHan
 // disallowed.
 // The filter mode filters any disallowed infohashes from the scrape,
 // potentially leaving an empty scrape.
+// In both modes, the middleware fails closed by default.
 //
 // ErrUnknownMode is returned if the Mode specified in the config is unknown.
 func whitelistScrapeInfohash(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
@@ -48,52 +62,67 @@ func whitelistScrapeInfohash(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddlewa
 		return nil, err
 	}
 
+	policy, err := store.ParseFailurePolicy(c, store.FailClosed)
+	if err != nil {
+		return nil, err
+	}
+
 	switch cfg.Mode {
 	case ModeFilter:
-		return whitelistFilterScrape, nil
+		return whitelistFilterScrape(policy), nil
 	case ModeBlock:
-		return whitelistBlockScrape, nil
+		return whitelistBlockScrape(policy), nil
 	default:
 		panic("unknown mode")
 	}
 }
 
-func whitelistFilterScrape(next tracker.ScrapeHandler) tracker.ScrapeHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
-		whitelisted := false
-		storage := mustGetStore()
-		infohashes := req.InfoHashes
-
-		for i, ih := range infohashes {
-			whitelisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
-
-			if err != nil {
-				return err
-			} else if !whitelisted {
-				req.InfoHashes[i] = req.InfoHashes[len(req.InfoHashes)-1]
-				req.InfoHashes = req.InfoHashes[:len(req.InfoHashes)-1]
+func whitelistFilterScrape(policy store.FailurePolicy) tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
+			whitelisted := false
+			storage := mustGetStore()
+			infohashes := req.InfoHashes
+
+			for i, ih := range infohashes {
+				whitelisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
+
+				if err != nil {
+					err = policy.HandleError(req.Context(), "infohash_whitelist", err)
+					if err != nil {
+						return err
+					}
+				} else if !whitelisted {
+					req.InfoHashes[i] = req.InfoHashes[len(req.InfoHashes)-1]
+					req.InfoHashes = req.InfoHashes[:len(req.InfoHashes)-1]
+				}
 			}
-		}
 
-		return next(cfg, req, resp)
+			return next(cfg, req, resp)
+		}
 	}
 }
 
-func whitelistBlockScrape(next tracker.ScrapeHandler) tracker.ScrapeHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
-		whitelisted := false
-		storage := mustGetStore()
-
-		for _, ih := range req.InfoHashes {
-			whitelisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
-
-			if err != nil {
-				return err
-			} else if !whitelisted {
-				return ErrBlockedInfohash
+func whitelistBlockScrape(policy store.FailurePolicy) tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
+			whitelisted := false
+			storage := mustGetStore()
+
+			for _, ih := range req.InfoHashes {
+				whitelisted, err = storage.HasString(PrefixInfohash + string(ih[:]))
+
+				if err != nil {
+					err = policy.HandleError(req.Context(), "infohash_whitelist", err)
+					if err != nil {
+						return err
+					}
+				} else if !whitelisted {
+					return ErrBlockedInfohash
+				}
 			}
-		}
 
-		return next(cfg, req, resp)
+			return next(cfg, req, resp)
+		}
 	}
 }
@@ -20,10 +20,12 @@ func TestWhitelistAnnounceMiddleware(t *testing.T) {
 		resp   chihaya.AnnounceResponse
 	)
 
-	achain.Append(whitelistAnnounceInfohash)
+	mw, err := whitelistAnnounceInfohash(chihaya.MiddlewareConfig{Name: "infohash_whitelist"})
+	assert.Nil(t, err)
+	achain.Append(mw)
 	handler := achain.Handler()
 
-	err := handler(nil, &req, &resp)
+	err = handler(nil, &req, &resp)
 	assert.Equal(t, ErrBlockedInfohash, err)
 
 	req.InfoHash = chihaya.InfoHash(ih2)
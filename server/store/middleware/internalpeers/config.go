@@ -0,0 +1,77 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package internalpeers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// ErrUnknownMode is returned by the MiddlewareConstructor if the Mode
+// specified in the configuration is unknown.
+var ErrUnknownMode = errors.New("unknown mode")
+
+// Mode represents the policy for handing out internal peers.
+type Mode string
+
+const (
+	// ModeExclude makes the middleware remove internal peers from the peer
+	// lists of external announces. Internal announces get every peer.
+	ModeExclude = Mode("exclude")
+
+	// ModeIsolate makes the middleware hand out internal peers to internal
+	// announces only, and external peers to external announces only.
+	ModeIsolate = Mode("isolate")
+)
+
+// Config represents the configuration for the internal_peers middleware.
+type Config struct {
+	// Networks are the internal networks in CIDR notation, e.g. the subnet
+	// of the seedboxes that run alongside the tracker.
+	Networks []string `yaml:"networks"`
+
+	Mode Mode `yaml:"mode"`
+}
+
+// newConfig parses the given MiddlewareConfig as an internalpeers.Config.
+// The mode defaults to ModeExclude, ErrUnknownMode is returned if it is
+// unknown. At least one network must be configured, and all of them must be
+// valid.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeExclude
+	case ModeExclude, ModeIsolate:
+	default:
+		return nil, ErrUnknownMode
+	}
+
+	if len(cfg.Networks) == 0 {
+		return nil, errors.New("no internal networks configured")
+	}
+	for _, network := range cfg.Networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return nil, fmt.Errorf("invalid internal network %q: %s", network, err)
+		}
+	}
+
+	return &cfg, nil
+}
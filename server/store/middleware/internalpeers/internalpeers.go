@@ -0,0 +1,140 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package internalpeers implements a middleware that keeps the peers of
+// internal networks, like seedboxes run by the operator, from being handed
+// out to external clients.
+package internalpeers
+
+import (
+	"context"
+	"net"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+
+	// The internal networks are kept in a memory IPStore.
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("internal_peers", constructor)
+}
+
+// constructor provides a middleware constructor that returns a middleware to
+// filter the peers of responses by the configured internal networks.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	networks, err := openNetworks(cfg.Networks)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterPeers(cfg.Mode, networks), nil
+}
+
+// openNetworks returns an IPStore that contains the given networks. It is
+// private to the middleware and lives as long as the process.
+func openNetworks(networks []string) (store.IPStore, error) {
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, network := range networks {
+		err = ips.AddNetwork(network)
+		if err != nil {
+			<-ips.Stop()
+			return nil, err
+		}
+	}
+	return ips, nil
+}
+
+// filterPeers provides a middleware that removes peers from the response
+// according to mode, depending on whether they and the announcing client are
+// in the networks stored in internal.
+//
+// Internal peers are still tracked and counted by the seeders and leechers
+// of the response, they are only left out of the peer lists. The middleware
+// must therefore run after store_response, and responses may contain fewer
+// peers than requested.
+func filterPeers(mode Mode, internal store.IPStore) tracker.AnnounceMiddleware {
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			ctx := req.Context()
+			fromInternal, err := isInternal(ctx, internal, req.IPv4, req.IPv6)
+			if err != nil {
+				return err
+			}
+
+			if !fromInternal || mode == ModeIsolate {
+				resp.IPv4Peers, err = keep(ctx, internal, resp.IPv4Peers, fromInternal)
+				if err != nil {
+					return err
+				}
+				resp.IPv6Peers, err = keep(ctx, internal, resp.IPv6Peers, fromInternal)
+				if err != nil {
+					return err
+				}
+			}
+
+			return next(cfg, req, resp)
+		}
+	}
+}
+
+// isInternal reports whether any of the IPs that are not nil is stored in
+// internal.
+func isInternal(ctx context.Context, internal store.IPStore, v4, v6 net.IP) (bool, error) {
+	var ips []net.IP
+	if v4 != nil {
+		ips = append(ips, v4)
+	}
+	if v6 != nil {
+		ips = append(ips, v6)
+	}
+	if len(ips) == 0 {
+		return false, nil
+	}
+
+	contained, err := store.HasAnyIP(ctx, internal, ips)
+	if err != nil {
+		log.DebugContext(ctx, "internal_peers: lookup failed", "error", err)
+		return false, err
+	}
+	return contained, nil
+}
+
+// keep returns the peers whose IP is stored in internal if wantInternal is
+// set, and those whose IP is not stored otherwise.
+//
+// The kept peers are copied, because the PeerStore may share peers among
+// responses.
+func keep(ctx context.Context, internal store.IPStore, peers []chihaya.Peer, wantInternal bool) ([]chihaya.Peer, error) {
+	if len(peers) == 0 {
+		return peers, nil
+	}
+
+	kept := make([]chihaya.Peer, 0, len(peers))
+	for _, p := range peers {
+		contained, err := isInternal(ctx, internal, p.IP, nil)
+		if err != nil {
+			return nil, err
+		}
+		if contained == wantInternal {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package internalpeers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+var (
+	internalV4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TEST01-000000000001"), IP: net.ParseIP("10.0.0.1").To4(), Port: 6881}
+	internalV6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TEST01-000000000002"), IP: net.ParseIP("fd00::1"), Port: 6881}
+	externalV4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TEST01-000000000003"), IP: net.ParseIP("192.0.2.1").To4(), Port: 6881}
+	externalV6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TEST01-000000000004"), IP: net.ParseIP("2001:db8::1"), Port: 6881}
+)
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		config   interface{}
+		valid    bool
+		expected Mode
+	}{
+		{map[string]interface{}{"networks": []string{"10.0.0.0/8"}}, true, ModeExclude},
+		{map[string]interface{}{"networks": []string{"10.0.0.0/8", "fd00::/8"}, "mode": "isolate"}, true, ModeIsolate},
+		{map[string]interface{}{"networks": []string{"10.0.0.0/8"}, "mode": "mark"}, false, ""},
+		{map[string]interface{}{"networks": []string{"10.0.0.1"}}, false, ""},
+		{map[string]interface{}{"mode": "exclude"}, false, ""},
+		{nil, false, ""},
+	}
+
+	for _, tt := range table {
+		cfg, err := newConfig(chihaya.MiddlewareConfig{Name: "internal_peers", Config: tt.config})
+		if !tt.valid {
+			require.NotNil(t, err, "config %v", tt.config)
+			continue
+		}
+		require.Nil(t, err, "config %v", tt.config)
+		require.Equal(t, tt.expected, cfg.Mode)
+	}
+}
+
+// announce runs an announce from the given IPs through an internal_peers
+// middleware in mode, with a response that contains all test peers, and
+// returns the peers it leaves in the response.
+func announce(t *testing.T, mode Mode, v4, v6 net.IP) (peers, peers6 []chihaya.Peer) {
+	mw, err := constructor(chihaya.MiddlewareConfig{
+		Name: "internal_peers",
+		Config: map[string]interface{}{
+			"networks": []string{"10.0.0.0/8", "fd00::/8"},
+			"mode":     string(mode),
+		},
+	})
+	require.Nil(t, err)
+
+	var called bool
+	handler := mw(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		called = true
+		return nil
+	})
+
+	resp := &chihaya.AnnounceResponse{
+		Complete:   2,
+		Incomplete: 2,
+		IPv4Peers:  []chihaya.Peer{internalV4, externalV4},
+		IPv6Peers:  []chihaya.Peer{internalV6, externalV6},
+	}
+	err = handler(&chihaya.TrackerConfig{}, &chihaya.AnnounceRequest{IPv4: v4, IPv6: v6}, resp)
+	require.Nil(t, err)
+	require.True(t, called)
+
+	// the internal peers are still counted
+	require.Equal(t, int32(2), resp.Complete)
+	require.Equal(t, int32(2), resp.Incomplete)
+
+	return resp.IPv4Peers, resp.IPv6Peers
+}
+
+func TestExclude(t *testing.T) {
+	var table = []struct {
+		v4, v6        net.IP
+		peers, peers6 []chihaya.Peer
+		announcer     string
+	}{
+		{externalV4.IP, nil, []chihaya.Peer{externalV4}, []chihaya.Peer{externalV6}, "external IPv4"},
+		{nil, externalV6.IP, []chihaya.Peer{externalV4}, []chihaya.Peer{externalV6}, "external IPv6"},
+		{nil, nil, []chihaya.Peer{externalV4}, []chihaya.Peer{externalV6}, "no IPs"},
+		{internalV4.IP, nil, []chihaya.Peer{internalV4, externalV4}, []chihaya.Peer{internalV6, externalV6}, "internal IPv4"},
+		{externalV4.IP, internalV6.IP, []chihaya.Peer{internalV4, externalV4}, []chihaya.Peer{internalV6, externalV6}, "partly internal"},
+	}
+
+	for _, tt := range table {
+		peers, peers6 := announce(t, ModeExclude, tt.v4, tt.v6)
+		require.Equal(t, tt.peers, peers, tt.announcer)
+		require.Equal(t, tt.peers6, peers6, tt.announcer)
+	}
+}
+
+func TestIsolate(t *testing.T) {
+	peers, peers6 := announce(t, ModeIsolate, externalV4.IP, externalV6.IP)
+	require.Equal(t, []chihaya.Peer{externalV4}, peers)
+	require.Equal(t, []chihaya.Peer{externalV6}, peers6)
+
+	peers, peers6 = announce(t, ModeIsolate, internalV4.IP, nil)
+	require.Equal(t, []chihaya.Peer{internalV4}, peers)
+	require.Equal(t, []chihaya.Peer{internalV6}, peers6)
+}
@@ -5,43 +5,45 @@
 package ip
 
 import (
-	"net"
-
 	"github.com/chihaya/chihaya"
 	"github.com/chihaya/chihaya/server/store"
 	"github.com/chihaya/chihaya/tracker"
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("ip_blacklist", blacklistAnnounceIP)
+	tracker.RegisterAnnounceMiddlewareConstructor("ip_blacklist", blacklistAnnounceIP)
+	tracker.RegisterScrapeMiddlewareConstructor("ip_blacklist", blacklistScrapeIP)
+	mustGetStore = func() store.IPStore {
+		return store.MustGetStore().IPStore
+	}
+}
+
+// ErrBlockedIP is returned by the whitelist middlewares if any of the IPs of a
+// request is not whitelisted.
+var ErrBlockedIP = tracker.ClientError("your IP is not allowed")
+
+// ErrBannedIP is returned by the blacklist middlewares if any of the IPs of a
+// request is blacklisted.
+var ErrBannedIP = tracker.ClientError("your IP is banned")
+
+var mustGetStore func() store.IPStore
+
+// blacklistAnnounceIP provides a middleware constructor for a middleware
+// that only allows IPs to announce that are not stored in an IPStore.
+func blacklistAnnounceIP(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	f, err := newFilter("ip_blacklist", ModeDeny, c)
+	if err != nil {
+		return nil, err
+	}
+	return f.announceMiddleware(), nil
 }
 
-// ErrBlockedIP is returned by an announce middleware if any of the announcing
-// IPs is disallowed.
-var ErrBlockedIP = tracker.ClientError("disallowed IP address")
-
-// blacklistAnnounceIP provides a middleware that only allows IPs to announce
-// that are not stored in an IPStore.
-func blacklistAnnounceIP(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
-		blacklisted := false
-		storage := store.MustGetStore()
-
-		// We have to check explicitly if they are present, because someone
-		// could have added a <nil> net.IP to the store.
-		if req.IPv6 != nil && req.IPv4 != nil {
-			blacklisted, err = storage.HasAnyIP([]net.IP{req.IPv4, req.IPv6})
-		} else if req.IPv4 != nil {
-			blacklisted, err = storage.HasIP(req.IPv4)
-		} else {
-			blacklisted, err = storage.HasIP(req.IPv6)
-		}
-
-		if err != nil {
-			return err
-		} else if blacklisted {
-			return ErrBlockedIP
-		}
-		return next(cfg, req, resp)
+// blacklistScrapeIP provides a middleware constructor for a middleware that
+// only allows IPs to scrape that are not stored in an IPStore.
+func blacklistScrapeIP(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
+	f, err := newFilter("ip_blacklist", ModeDeny, c)
+	if err != nil {
+		return nil, err
 	}
+	return f.scrapeMiddleware(), nil
 }
@@ -0,0 +1,94 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+var (
+	listedV4   = net.ParseIP("192.168.22.22").To4()
+	listedV6   = net.ParseIP("fd45:7856:3dae::48")
+	unlistedV4 = net.ParseIP("10.154.243.22").To4()
+	unlistedV6 = net.ParseIP("fd0a:29a8:8445::38")
+)
+
+// newTestIPStore returns an IPStore that contains listedV4 and listedV6 and
+// makes the middlewares use it.
+func newTestIPStore(t *testing.T) store.IPStore {
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+
+	require.Nil(t, ips.AddNetwork("192.168.22.0/24"))
+	require.Nil(t, ips.AddIP(listedV6))
+
+	mustGetStore = func() store.IPStore {
+		return ips
+	}
+	return ips
+}
+
+func TestBlacklist(t *testing.T) {
+	ips := newTestIPStore(t)
+
+	announceMW, err := blacklistAnnounceIP(chihaya.MiddlewareConfig{Name: "ip_blacklist"})
+	require.Nil(t, err)
+	scrapeMW, err := blacklistScrapeIP(chihaya.MiddlewareConfig{Name: "ip_blacklist"})
+	require.Nil(t, err)
+
+	var called bool
+	announce := announceMW(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		called = true
+		return nil
+	})
+	scrape := scrapeMW(func(*chihaya.TrackerConfig, *chihaya.ScrapeRequest, *chihaya.ScrapeResponse) error {
+		called = true
+		return nil
+	})
+
+	var table = []struct {
+		v4, v6 net.IP
+		banned bool
+	}{
+		{unlistedV4, nil, false},
+		{nil, unlistedV6, false},
+		{unlistedV4, unlistedV6, false},
+		{nil, nil, false},
+		{listedV4, nil, true},
+		{nil, listedV6, true},
+		{listedV4, unlistedV6, true},
+		{unlistedV4, listedV6, true},
+		{listedV4, listedV6, true},
+	}
+
+	for _, tt := range table {
+		called = false
+		err := announce(nil, &chihaya.AnnounceRequest{IPv4: tt.v4, IPv6: tt.v6}, &chihaya.AnnounceResponse{})
+		if tt.banned {
+			require.Equal(t, ErrBannedIP, err, "announce of %s, %s", tt.v4, tt.v6)
+		} else {
+			require.Nil(t, err, "announce of %s, %s", tt.v4, tt.v6)
+		}
+		require.Equal(t, !tt.banned, called, "announce of %s, %s", tt.v4, tt.v6)
+
+		called = false
+		err = scrape(nil, &chihaya.ScrapeRequest{IPv4: tt.v4, IPv6: tt.v6}, &chihaya.ScrapeResponse{})
+		if tt.banned {
+			require.Equal(t, ErrBannedIP, err, "scrape from %s, %s", tt.v4, tt.v6)
+		} else {
+			require.Nil(t, err, "scrape from %s, %s", tt.v4, tt.v6)
+		}
+		require.Equal(t, !tt.banned, called, "scrape from %s, %s", tt.v4, tt.v6)
+	}
+
+	require.Nil(t, <-ips.Stop())
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ip
+
+import (
+	"errors"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+)
+
+// ErrUnknownMode is returned by a MiddlewareConstructor if the Mode specified
+// in the configuration is unknown.
+var ErrUnknownMode = errors.New("unknown mode")
+
+// Mode represents the mode of operation for an IP middleware.
+type Mode string
+
+const (
+	// ModeDeny makes the middleware treat the IPStore as a denylist, i.e.
+	// reject requests if any of their IPs is stored.
+	ModeDeny = Mode("deny")
+
+	// ModeAllow makes the middleware treat the IPStore as an allowlist, i.e.
+	// reject requests unless all of their IPs are stored.
+	ModeAllow = Mode("allow")
+)
+
+// Config represents the configuration for an IP middleware.
+type Config struct {
+	Mode Mode `yaml:"mode"`
+}
+
+// newConfig parses the given MiddlewareConfig as an ip.Config.
+// The mode defaults to ModeDeny, ErrUnknownMode is returned if it is
+// unknown.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Mode == "" {
+		cfg.Mode = ModeDeny
+	}
+	if cfg.Mode != ModeDeny && cfg.Mode != ModeAllow {
+		return nil, ErrUnknownMode
+	}
+
+	return &cfg, nil
+}
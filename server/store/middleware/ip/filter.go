@@ -0,0 +1,161 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ip
+
+import (
+	"context"
+	"net"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("ip_filter", filterAnnounceIP)
+	tracker.RegisterScrapeMiddlewareConstructor("ip_filter", filterScrapeIP)
+}
+
+// presentIPs returns those of v4 and v6 that are not nil.
+//
+// We have to check explicitly if they are present, because someone could have
+// added a <nil> net.IP to the store.
+func presentIPs(v4, v6 net.IP) []net.IP {
+	var ips []net.IP
+	if v4 != nil {
+		ips = append(ips, v4)
+	}
+	if v6 != nil {
+		ips = append(ips, v6)
+	}
+	return ips
+}
+
+// filter checks the IPs of requests against the IPStore for the middleware
+// of the given name.
+type filter struct {
+	name   string
+	mode   Mode
+	policy store.FailurePolicy
+}
+
+// newFilter returns a filter in the given mode with the failure policy
+// configured by mwcfg. Filters in ModeDeny fail open by default, filters in
+// ModeAllow fail closed.
+func newFilter(name string, mode Mode, mwcfg chihaya.MiddlewareConfig) (*filter, error) {
+	def := store.FailOpen
+	if mode == ModeAllow {
+		def = store.FailClosed
+	}
+
+	policy, err := store.ParseFailurePolicy(mwcfg, def)
+	if err != nil {
+		return nil, err
+	}
+	return &filter{name: name, mode: mode, policy: policy}, nil
+}
+
+// check returns an error if a request with the given IPs must be rejected.
+// Rejections are logged with ctx, store errors are handled by the failure
+// policy of f.
+//
+// In ModeDeny, ErrBannedIP is returned if any of the IPs is stored in the
+// IPStore. In ModeAllow, ErrBlockedIP is returned unless there is at least one
+// IP and all of them are stored in the IPStore.
+func (f *filter) check(ctx context.Context, v4, v6 net.IP) error {
+	ips := presentIPs(v4, v6)
+	if f.mode == ModeAllow {
+		if len(ips) == 0 {
+			log.DebugContext(ctx, "ip: blocked request without IPs", "mode", f.mode)
+			return ErrBlockedIP
+		}
+		allowed, err := store.HasAllIPs(ctx, mustGetStore(), ips)
+		if err != nil {
+			return f.policy.HandleError(ctx, f.name, err)
+		} else if !allowed {
+			log.DebugContext(ctx, "ip: blocked IP not stored in IPStore", "mode", f.mode, "ips", ips)
+			return ErrBlockedIP
+		}
+		return nil
+	}
+
+	if len(ips) == 0 {
+		return nil
+	}
+	banned, err := store.HasAnyIP(ctx, mustGetStore(), ips)
+	if err != nil {
+		return f.policy.HandleError(ctx, f.name, err)
+	} else if banned {
+		log.DebugContext(ctx, "ip: blocked IP stored in IPStore", "mode", f.mode, "ips", ips)
+		return ErrBannedIP
+	}
+	return nil
+}
+
+// announceMiddleware returns an announce middleware that rejects announces
+// that do not pass f.
+func (f *filter) announceMiddleware() tracker.AnnounceMiddleware {
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			err := f.check(req.Context(), req.IPv4, req.IPv6)
+			if err != nil {
+				return err
+			}
+			return next(cfg, req, resp)
+		}
+	}
+}
+
+// scrapeMiddleware returns a scrape middleware that rejects scrapes that do
+// not pass f.
+func (f *filter) scrapeMiddleware() tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			err := f.check(req.Context(), req.IPv4, req.IPv6)
+			if err != nil {
+				return err
+			}
+			return next(cfg, req, resp)
+		}
+	}
+}
+
+// filterAnnounceIP provides a middleware constructor for a middleware that
+// rejects announces based on the IPs they contain.
+//
+// The middleware works in two modes: deny and allow.
+// The deny mode behaves like ip_blacklist, the allow mode like ip_whitelist.
+//
+// ErrUnknownMode is returned if the Mode specified in the config is unknown.
+func filterAnnounceIP(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := newFilter("ip_filter", cfg.Mode, c)
+	if err != nil {
+		return nil, err
+	}
+	return f.announceMiddleware(), nil
+}
+
+// filterScrapeIP provides a middleware constructor for a middleware that
+// rejects scrapes based on the IPs of the client.
+//
+// The modes are the same as for filterAnnounceIP.
+func filterScrapeIP(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := newFilter("ip_filter", cfg.Mode, c)
+	if err != nil {
+		return nil, err
+	}
+	return f.scrapeMiddleware(), nil
+}
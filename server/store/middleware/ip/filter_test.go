@@ -0,0 +1,267 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/ipmask"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		config   interface{}
+		err      error
+		expected Mode
+	}{
+		{nil, nil, ModeDeny},
+		{map[string]interface{}{"mode": "deny"}, nil, ModeDeny},
+		{map[string]interface{}{"mode": "allow"}, nil, ModeAllow},
+		{map[string]interface{}{"mode": "block"}, ErrUnknownMode, ""},
+	}
+
+	for _, tt := range table {
+		cfg, err := newConfig(chihaya.MiddlewareConfig{Name: "ip_filter", Config: tt.config})
+		require.Equal(t, tt.err, err)
+		if err == nil {
+			require.Equal(t, tt.expected, cfg.Mode)
+		}
+	}
+}
+
+func newFilters(t *testing.T, mode Mode, called *bool) (tracker.AnnounceHandler, tracker.ScrapeHandler) {
+	mwcfg := chihaya.MiddlewareConfig{
+		Name:   "ip_filter",
+		Config: map[string]interface{}{"mode": string(mode)},
+	}
+
+	announceMW, err := filterAnnounceIP(mwcfg)
+	require.Nil(t, err)
+	scrapeMW, err := filterScrapeIP(mwcfg)
+	require.Nil(t, err)
+
+	announce := announceMW(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		*called = true
+		return nil
+	})
+	scrape := scrapeMW(func(*chihaya.TrackerConfig, *chihaya.ScrapeRequest, *chihaya.ScrapeResponse) error {
+		*called = true
+		return nil
+	})
+	return announce, scrape
+}
+
+func TestFilter(t *testing.T) {
+	ips := newTestIPStore(t)
+
+	var table = []struct {
+		v4, v6            net.IP
+		denyErr, allowErr error
+	}{
+		{nil, nil, nil, ErrBlockedIP},
+		{unlistedV4, nil, nil, ErrBlockedIP},
+		{nil, unlistedV6, nil, ErrBlockedIP},
+		{unlistedV4, unlistedV6, nil, ErrBlockedIP},
+		{listedV4, nil, ErrBannedIP, nil},
+		{nil, listedV6, ErrBannedIP, nil},
+		{listedV4, unlistedV6, ErrBannedIP, ErrBlockedIP},
+		{unlistedV4, listedV6, ErrBannedIP, ErrBlockedIP},
+		{listedV4, listedV6, ErrBannedIP, nil},
+	}
+
+	var called bool
+	denyAnnounce, denyScrape := newFilters(t, ModeDeny, &called)
+	allowAnnounce, allowScrape := newFilters(t, ModeAllow, &called)
+
+	check := func(expected, err error, msg string, v4, v6 net.IP) {
+		require.Equal(t, expected, err, "%s of %s, %s", msg, v4, v6)
+		require.Equal(t, expected == nil, called, "%s of %s, %s", msg, v4, v6)
+		called = false
+	}
+
+	for _, tt := range table {
+		areq := &chihaya.AnnounceRequest{IPv4: tt.v4, IPv6: tt.v6}
+		sreq := &chihaya.ScrapeRequest{IPv4: tt.v4, IPv6: tt.v6}
+
+		check(tt.denyErr, denyAnnounce(nil, areq, &chihaya.AnnounceResponse{}), "deny announce", tt.v4, tt.v6)
+		check(tt.denyErr, denyScrape(nil, sreq, &chihaya.ScrapeResponse{}), "deny scrape", tt.v4, tt.v6)
+		check(tt.allowErr, allowAnnounce(nil, areq, &chihaya.AnnounceResponse{}), "allow announce", tt.v4, tt.v6)
+		check(tt.allowErr, allowScrape(nil, sreq, &chihaya.ScrapeResponse{}), "allow scrape", tt.v4, tt.v6)
+	}
+
+	// An empty store rejects everyone in allow mode.
+	require.Nil(t, ips.RemoveNetwork("192.168.22.0/24"))
+	require.Nil(t, ips.RemoveIP(listedV6))
+
+	for _, tt := range table {
+		check(ErrBlockedIP, allowAnnounce(nil, &chihaya.AnnounceRequest{IPv4: tt.v4, IPv6: tt.v6}, &chihaya.AnnounceResponse{}), "allow announce", tt.v4, tt.v6)
+		check(nil, denyAnnounce(nil, &chihaya.AnnounceRequest{IPv4: tt.v4, IPv6: tt.v6}, &chihaya.AnnounceResponse{}), "deny announce", tt.v4, tt.v6)
+	}
+
+	require.Nil(t, <-ips.Stop())
+}
+
+// failingIPStore is an IPStore whose lookups fail.
+type failingIPStore struct {
+	store.IPStore
+}
+
+var errStoreFailed = errors.New("store failed")
+
+func (failingIPStore) HasAnyIP([]net.IP) (bool, error)  { return false, errStoreFailed }
+func (failingIPStore) HasAllIPs([]net.IP) (bool, error) { return false, errStoreFailed }
+
+func TestFilterStoreErrors(t *testing.T) {
+	mustGetStore = func() store.IPStore {
+		return failingIPStore{}
+	}
+
+	filterAnnounce := func(mode Mode) tracker.AnnounceMiddlewareConstructor {
+		return func(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+			c.Config.(map[string]interface{})["mode"] = string(mode)
+			return filterAnnounceIP(c)
+		}
+	}
+
+	var table = []struct {
+		name        string
+		constructor tracker.AnnounceMiddlewareConstructor
+		policy      string
+		expected    error
+	}{
+		{"ip_blacklist", blacklistAnnounceIP, "", nil},
+		{"ip_blacklist", blacklistAnnounceIP, "open", nil},
+		{"ip_blacklist", blacklistAnnounceIP, "closed", store.ErrStoreUnavailable},
+		{"ip_whitelist", whitelistAnnounceIP, "", store.ErrStoreUnavailable},
+		{"ip_whitelist", whitelistAnnounceIP, "open", nil},
+		{"ip_whitelist", whitelistAnnounceIP, "closed", store.ErrStoreUnavailable},
+		{"ip_filter", filterAnnounce(ModeDeny), "", nil},
+		{"ip_filter", filterAnnounce(ModeDeny), "closed", store.ErrStoreUnavailable},
+		{"ip_filter", filterAnnounce(ModeAllow), "", store.ErrStoreUnavailable},
+		{"ip_filter", filterAnnounce(ModeAllow), "open", nil},
+	}
+
+	for _, tt := range table {
+		config := map[string]interface{}{}
+		if tt.policy != "" {
+			config["on_store_error"] = tt.policy
+		}
+		mw, err := tt.constructor(chihaya.MiddlewareConfig{Name: tt.name, Config: config})
+		require.Nil(t, err)
+
+		var called bool
+		announce := mw(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+			called = true
+			return nil
+		})
+
+		err = announce(nil, &chihaya.AnnounceRequest{IPv4: listedV4}, &chihaya.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, "%s with policy %q", tt.name, tt.policy)
+		require.Equal(t, tt.expected == nil, called, "%s with policy %q", tt.name, tt.policy)
+	}
+
+	_, err := blacklistScrapeIP(chihaya.MiddlewareConfig{
+		Name:   "ip_blacklist",
+		Config: map[string]interface{}{"on_store_error": "ignore"},
+	})
+	require.Equal(t, store.ErrUnknownFailurePolicy, err)
+}
+
+// blockingIPStore is a ContextIPStore whose lookups block until their context
+// is done.
+type blockingIPStore struct {
+	store.IPStore
+	started chan struct{}
+}
+
+func (s blockingIPStore) HasAnyIPContext(ctx context.Context, ips []net.IP) (bool, error) {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func (s blockingIPStore) HasAllIPsContext(ctx context.Context, ips []net.IP) (bool, error) {
+	return s.HasAnyIPContext(ctx, ips)
+}
+
+func TestFilterCanceled(t *testing.T) {
+	blocking := blockingIPStore{started: make(chan struct{})}
+	mustGetStore = func() store.IPStore {
+		return blocking
+	}
+
+	for _, mode := range []Mode{ModeDeny, ModeAllow} {
+		// Canceled requests are neither allowed by an open policy nor
+		// reported as unavailable by a closed one.
+		for _, policy := range []string{"open", "closed"} {
+			mw, err := filterAnnounceIP(chihaya.MiddlewareConfig{
+				Name:   "ip_filter",
+				Config: map[string]interface{}{"mode": string(mode), "on_store_error": policy},
+			})
+			require.Nil(t, err)
+
+			var called bool
+			announce := mw(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+				called = true
+				return nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-blocking.started
+				cancel()
+			}()
+			req := (&chihaya.AnnounceRequest{IPv4: listedV4}).WithContext(ctx)
+			err = announce(nil, req, &chihaya.AnnounceResponse{})
+			require.Equal(t, context.Canceled, err, "%s with policy %q", mode, policy)
+			require.False(t, called, "%s with policy %q", mode, policy)
+		}
+	}
+}
+
+func TestFilterLogsAnonymizedIPs(t *testing.T) {
+	ips := newTestIPStore(t)
+	banned := net.ParseIP("192.0.2.55").To4()
+	neighbour := net.ParseIP("192.0.2.56").To4()
+	require.Nil(t, ips.AddIP(banned))
+
+	mask, err := ipmask.New(ipmask.Config{Enabled: true})
+	require.Nil(t, err)
+	ipmask.SetDefault(mask)
+	defer ipmask.SetDefault(nil)
+
+	var buf bytes.Buffer
+	logger, err := log.New(&buf, log.Config{Level: "debug"})
+	require.Nil(t, err)
+	defer log.SetDefault(log.Default())
+	log.SetDefault(logger)
+
+	var called bool
+	announce, _ := newFilters(t, ModeDeny, &called)
+
+	err = announce(nil, &chihaya.AnnounceRequest{IPv4: banned}, &chihaya.AnnounceResponse{})
+	require.Equal(t, ErrBannedIP, err)
+	require.Contains(t, buf.String(), "192.0.2.0")
+	require.NotContains(t, buf.String(), "192.0.2.55")
+
+	// the IPStore is still asked about the full address
+	buf.Reset()
+	err = announce(nil, &chihaya.AnnounceRequest{IPv4: neighbour}, &chihaya.AnnounceResponse{})
+	require.Nil(t, err)
+	require.True(t, called)
+	require.Equal(t, "", buf.String())
+
+	require.Nil(t, <-ips.Stop())
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package passkey
+
+import (
+	"errors"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// defaultLength is the length of a passkey if none is configured.
+const defaultLength = 32
+
+// Config represents the configuration for a passkey middleware.
+type Config struct {
+	Length int `yaml:"length"`
+
+	// OnStoreError is the policy for requests whose passkeys can not be
+	// looked up. It defaults to store.FailClosed.
+	OnStoreError store.FailurePolicy `yaml:"on_store_error"`
+}
+
+// newConfig parses the given MiddlewareConfig as a passkey.Config.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Length == 0 {
+		cfg.Length = defaultLength
+	}
+	if cfg.Length < 0 {
+		return nil, errors.New("length must be > 0")
+	}
+
+	cfg.OnStoreError, err = store.ParseFailurePolicy(mwcfg, store.FailClosed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
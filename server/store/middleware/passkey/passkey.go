@@ -0,0 +1,119 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package passkey implements middleware that authenticates announces and
+// scrapes by the passkeys of registered users.
+package passkey
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("passkey", announceConstructor)
+	tracker.RegisterScrapeMiddlewareConstructor("passkey", scrapeConstructor)
+	mustGetStore = func() store.StringStore {
+		return store.MustGetStore().StringStore
+	}
+}
+
+// PrefixPasskey is the prefix to be used for passkeys.
+const PrefixPasskey = "pk-"
+
+var (
+	// ErrMissingPasskey is returned by a passkey middleware if a request
+	// contains no passkey.
+	ErrMissingPasskey = tracker.ClientError("passkey missing")
+
+	// ErrMalformedPasskey is returned by a passkey middleware if a passkey
+	// has the wrong length or contains characters other than ASCII letters
+	// and digits.
+	ErrMalformedPasskey = tracker.ClientError("malformed passkey")
+
+	// ErrUnknownPasskey is returned by a passkey middleware if a passkey is
+	// not stored in the StringStore.
+	ErrUnknownPasskey = tracker.ClientError("unknown passkey")
+)
+
+var mustGetStore func() store.StringStore
+
+func announceConstructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			userID, err := authenticate(req.Context(), cfg, req.Passkey)
+			if err != nil {
+				return err
+			}
+			req.UserID = userID
+
+			return next(tcfg, req, resp)
+		}
+	}, nil
+}
+
+func scrapeConstructor(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			userID, err := authenticate(req.Context(), cfg, req.Passkey)
+			if err != nil {
+				return err
+			}
+			req.UserID = userID
+
+			return next(tcfg, req, resp)
+		}
+	}, nil
+}
+
+// authenticate returns the user ID of a passkey, which is the passkey itself.
+// Well-formed passkeys that can not be looked up are handled according to the
+// failure policy of cfg.
+func authenticate(ctx context.Context, cfg *Config, passkey string) (userID string, err error) {
+	if passkey == "" {
+		return "", ErrMissingPasskey
+	}
+	if !wellFormed(cfg, passkey) {
+		return "", ErrMalformedPasskey
+	}
+
+	known, err := mustGetStore().HasString(PrefixPasskey + passkey)
+	if err != nil {
+		err = cfg.OnStoreError.HandleError(ctx, "passkey", err)
+		if err != nil {
+			return "", err
+		}
+	} else if !known {
+		return "", ErrUnknownPasskey
+	}
+
+	return passkey, nil
+}
+
+func wellFormed(cfg *Config, passkey string) bool {
+	if len(passkey) != cfg.Length {
+		return false
+	}
+
+	for i := 0; i < len(passkey); i++ {
+		c := passkey[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package passkey
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/stopper"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+type storeMock struct {
+	strings map[string]struct{}
+}
+
+func (ss *storeMock) PutString(s string) error {
+	ss.strings[s] = struct{}{}
+
+	return nil
+}
+
+func (ss *storeMock) PutStringWithExpiry(s string, expires time.Time) error {
+	return ss.PutString(s)
+}
+
+func (ss *storeMock) HasString(s string) (bool, error) {
+	_, ok := ss.strings[s]
+
+	return ok, nil
+}
+
+func (ss *storeMock) RemoveString(s string) error {
+	delete(ss.strings, s)
+
+	return nil
+}
+
+func (ss *storeMock) Stop() <-chan error {
+	return stopper.AlreadyStopped
+}
+
+const (
+	knownPasskey   = "0123456789abcdefABCDEF0123456789"
+	unknownPasskey = "00000000000000000000000000000000"
+)
+
+func init() {
+	mock := &storeMock{strings: make(map[string]struct{})}
+	mock.PutString(PrefixPasskey + knownPasskey)
+	mustGetStore = func() store.StringStore {
+		return mock
+	}
+}
+
+var authTests = []struct {
+	passkey  string
+	expected error
+}{
+	{knownPasskey, nil},
+	{unknownPasskey, ErrUnknownPasskey},
+	{"", ErrMissingPasskey},
+	{knownPasskey[1:], ErrMalformedPasskey},
+	{knownPasskey + "0", ErrMalformedPasskey},
+	{"0123456789abcdef-BCDEF0123456789", ErrMalformedPasskey},
+}
+
+func TestAnnounceMiddleware(t *testing.T) {
+	var achain tracker.AnnounceChain
+	mw, err := announceConstructor(chihaya.MiddlewareConfig{Name: "passkey"})
+	require.Nil(t, err)
+	achain.Append(mw)
+
+	var userID string
+	achain.Append(func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			userID = req.UserID
+			return next(cfg, req, resp)
+		}
+	})
+	handler := achain.Handler()
+
+	for _, tt := range authTests {
+		userID = ""
+		err := handler(nil, &chihaya.AnnounceRequest{Passkey: tt.passkey}, &chihaya.AnnounceResponse{})
+		assert.Equal(t, tt.expected, err, tt.passkey)
+
+		if tt.expected == nil {
+			assert.Equal(t, tt.passkey, userID)
+		} else {
+			// rejected requests never reach later middleware
+			assert.Equal(t, "", userID)
+		}
+	}
+}
+
+func TestScrapeMiddleware(t *testing.T) {
+	var schain tracker.ScrapeChain
+	mw, err := scrapeConstructor(chihaya.MiddlewareConfig{Name: "passkey"})
+	require.Nil(t, err)
+	schain.Append(mw)
+	handler := schain.Handler()
+
+	for _, tt := range authTests {
+		req := &chihaya.ScrapeRequest{Passkey: tt.passkey}
+		err := handler(nil, req, &chihaya.ScrapeResponse{})
+		assert.Equal(t, tt.expected, err, tt.passkey)
+		if tt.expected == nil {
+			assert.Equal(t, tt.passkey, req.UserID)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	mw, err := announceConstructor(chihaya.MiddlewareConfig{
+		Name:   "passkey",
+		Config: Config{Length: 8},
+	})
+	require.Nil(t, err)
+
+	var achain tracker.AnnounceChain
+	achain.Append(mw)
+	handler := achain.Handler()
+
+	err = handler(nil, &chihaya.AnnounceRequest{Passkey: "a1b2c3d4"}, &chihaya.AnnounceResponse{})
+	assert.Equal(t, ErrUnknownPasskey, err)
+	err = handler(nil, &chihaya.AnnounceRequest{Passkey: knownPasskey}, &chihaya.AnnounceResponse{})
+	assert.Equal(t, ErrMalformedPasskey, err)
+
+	_, err = announceConstructor(chihaya.MiddlewareConfig{
+		Name:   "passkey",
+		Config: Config{Length: -1},
+	})
+	assert.NotNil(t, err)
+}
+
+// failingStore is a StringStore whose lookups fail.
+type failingStore struct {
+	store.StringStore
+}
+
+func (failingStore) HasString(string) (bool, error) {
+	return false, errors.New("store failed")
+}
+
+func TestStoreErrors(t *testing.T) {
+	previous := mustGetStore
+	mustGetStore = func() store.StringStore {
+		return failingStore{}
+	}
+	defer func() { mustGetStore = previous }()
+
+	var table = []struct {
+		policy   store.FailurePolicy
+		expected error
+	}{
+		{"", store.ErrStoreUnavailable},
+		{store.FailClosed, store.ErrStoreUnavailable},
+		{store.FailOpen, nil},
+	}
+
+	for _, tt := range table {
+		mw, err := announceConstructor(chihaya.MiddlewareConfig{
+			Name:   "passkey",
+			Config: Config{OnStoreError: tt.policy},
+		})
+		require.Nil(t, err)
+
+		var achain tracker.AnnounceChain
+		achain.Append(mw)
+		handler := achain.Handler()
+
+		req := &chihaya.AnnounceRequest{Passkey: unknownPasskey}
+		err = handler(nil, req, &chihaya.AnnounceResponse{})
+		assert.Equal(t, tt.expected, err, "policy %q", tt.policy)
+		if tt.expected == nil {
+			assert.Equal(t, unknownPasskey, req.UserID)
+		}
+
+		// Malformed passkeys are rejected without looking them up.
+		err = handler(nil, &chihaya.AnnounceRequest{Passkey: "malformed"}, &chihaya.AnnounceResponse{})
+		assert.Equal(t, ErrMalformedPasskey, err)
+	}
+
+	_, err := scrapeConstructor(chihaya.MiddlewareConfig{
+		Name:   "passkey",
+		Config: Config{OnStoreError: "sometimes"},
+	})
+	assert.Equal(t, store.ErrUnknownFailurePolicy, err)
+}
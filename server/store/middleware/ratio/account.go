@@ -0,0 +1,59 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+var accountLookupDrivers = make(map[string]AccountLookupDriver)
+
+// Account holds the totals a user transferred across all torrents, as
+// accounted by the site the tracker belongs to.
+type Account struct {
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// AccountLookup looks up the accounts of users, e.g. in the database or by the
+// API of the site.
+type AccountLookup interface {
+	// LookupAccount returns the account of the user identified by userID,
+	// see chihaya.AnnounceRequest.UserID. It should return once ctx is
+	// canceled.
+	LookupAccount(ctx context.Context, userID string) (Account, error)
+}
+
+// AccountLookupDriver represents an interface for creating AccountLookups.
+type AccountLookupDriver interface {
+	New(*store.DriverConfig) (AccountLookup, error)
+}
+
+// RegisterAccountLookupDriver makes a driver available by the provided name.
+//
+// If this function is called twice with the same name or if the driver is nil,
+// it panics.
+func RegisterAccountLookupDriver(name string, driver AccountLookupDriver) {
+	if driver == nil {
+		panic("ratio: could not register nil AccountLookupDriver")
+	}
+	if _, dup := accountLookupDrivers[name]; dup {
+		panic("ratio: could not register duplicate AccountLookupDriver: " + name)
+	}
+	accountLookupDrivers[name] = driver
+}
+
+// openAccountLookup returns the AccountLookup specified by a configuration.
+func openAccountLookup(cfg *store.DriverConfig) (AccountLookup, error) {
+	driver, ok := accountLookupDrivers[cfg.Name]
+	if !ok {
+		return nil, fmt.Errorf("ratio: unknown AccountLookupDriver %q (forgotten import?)", cfg.Name)
+	}
+
+	return driver.New(cfg)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratio
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// The actions taken for users whose ratio is too low.
+const (
+	throttleAction = "throttle"
+	blockAction    = "block"
+)
+
+// Config represents the configuration for the ratio middleware.
+type Config struct {
+	// MinRatio is the lowest ratio of uploaded to downloaded bytes users
+	// may leech with.
+	MinRatio float64 `yaml:"min_ratio"`
+
+	// MinDownloaded is the number of bytes users may download before their
+	// ratio is enforced, so that new users can start.
+	MinDownloaded uint64 `yaml:"min_downloaded"`
+
+	// Action is what happens to the announces of leechers whose ratio is
+	// too low, either throttleAction or blockAction.
+	Action string `yaml:"action"`
+
+	// ThrottleInterval is the announce interval of throttled leechers.
+	ThrottleInterval time.Duration `yaml:"throttle_interval"`
+
+	// AccountLookup configures the AccountLookup the accounts of the users
+	// are looked up with.
+	AccountLookup store.DriverConfig `yaml:"account_lookup"`
+
+	// OnStoreError is the policy for announces whose ratio can not be
+	// computed because the account lookup or the PeerStore failed. It
+	// defaults to store.FailOpen.
+	OnStoreError store.FailurePolicy `yaml:"on_store_error"`
+}
+
+// newConfig parses the given MiddlewareConfig as a ratio.Config.
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MinRatio <= 0 {
+		return nil, errors.New("min_ratio must be > 0")
+	}
+	switch cfg.Action {
+	case "":
+		cfg.Action = throttleAction
+	case throttleAction, blockAction:
+	default:
+		return nil, fmt.Errorf("unknown action %q (must be throttle or block)", cfg.Action)
+	}
+	if cfg.ThrottleInterval == 0 {
+		cfg.ThrottleInterval = time.Hour
+	}
+	if cfg.ThrottleInterval < 0 {
+		return nil, errors.New("throttle_interval must be > 0")
+	}
+	if cfg.AccountLookup.Name == "" {
+		return nil, errors.New("no account_lookup configured")
+	}
+
+	cfg.OnStoreError, err = store.ParseFailurePolicy(mwcfg, store.FailOpen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	RegisterAccountLookupDriver("http", &httpLookupDriver{})
+}
+
+// maxAccountSize is the largest response of an account API that is read.
+const maxAccountSize = 4096
+
+type httpLookupDriver struct{}
+
+func (d *httpLookupDriver) New(lookupcfg *store.DriverConfig) (AccountLookup, error) {
+	err := lookupcfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := yaml.Marshal(lookupcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg httpLookupConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("ratio: invalid http AccountLookup config: url %q must be an http or https URL", cfg.URL)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+
+	return &httpLookup{
+		url:    cfg.URL,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+type httpLookupConfig struct {
+	// URL is the URL of the API accounts are looked up at.
+	URL string `yaml:"url"`
+
+	// Timeout is the time a lookup may take.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// httpLookup looks up accounts by an HTTP API of the site.
+//
+// The user ID is passed as the user_id query parameter of a GET request, and
+// the API answers with a JSON object holding the uploaded and downloaded
+// totals of the account.
+type httpLookup struct {
+	url    string
+	client *http.Client
+}
+
+var _ AccountLookup = &httpLookup{}
+
+func (l *httpLookup) LookupAccount(ctx context.Context, userID string) (Account, error) {
+	sep := "?"
+	if strings.Contains(l.url, "?") {
+		sep = "&"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", l.url+sep+"user_id="+url.QueryEscape(userID), nil)
+	if err != nil {
+		return Account{}, err
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return Account{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Account{}, fmt.Errorf("ratio: account lookup failed: %s", resp.Status)
+	}
+
+	var account struct {
+		Uploaded   uint64 `json:"uploaded"`
+		Downloaded uint64 `json:"downloaded"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxAccountSize)).Decode(&account)
+	if err != nil {
+		return Account{}, fmt.Errorf("ratio: malformed account: %s", err)
+	}
+	return Account{Uploaded: account.Uploaded, Downloaded: account.Downloaded}, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestHTTPLookup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secret", r.URL.Query().Get("token"))
+		switch r.URL.Query().Get("user_id") {
+		case "a b":
+			w.Write([]byte(`{"uploaded": 2000, "downloaded": 1000}`))
+		case "garbage":
+			w.Write([]byte(`{"uploaded": -1}`))
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	lookup, err := (&httpLookupDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{
+		"url":     srv.URL + "/accounts?token=secret",
+		"timeout": "100ms",
+	}})
+	require.Nil(t, err)
+
+	account, err := lookup.LookupAccount(context.Background(), "a b")
+	require.Nil(t, err)
+	require.Equal(t, Account{Uploaded: 2000, Downloaded: 1000}, account)
+
+	for _, user := range []string{"garbage", "slow", "unknown"} {
+		_, err = lookup.LookupAccount(context.Background(), user)
+		require.NotNil(t, err, user)
+	}
+
+	for _, u := range []string{"", "ftp://example.com", "%zz"} {
+		_, err = (&httpLookupDriver{}).New(&store.DriverConfig{Config: map[string]interface{}{"url": u}})
+		require.NotNil(t, err, u)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package ratio implements a middleware that enforces the share ratios of the
+// users of a private tracker.
+package ratio
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddlewareConstructor("ratio", constructor)
+	mustGetStore = func() store.PeerStore {
+		return store.MustGetStore().PeerStore
+	}
+}
+
+// ErrRatioTooLow is returned for the announces of leechers whose ratio is
+// below the minimum if they are blocked.
+var ErrRatioTooLow = tracker.ClientError("share ratio too low")
+
+var mustGetStore func() store.PeerStore
+
+// constructor provides a middleware constructor that returns a middleware to
+// enforce the configured ratio.
+//
+// It returns an error if the config provided is either syntactically or
+// semantically incorrect, or if the account lookup can not be created.
+func constructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup, err := openAccountLookup(&cfg.AccountLookup)
+	if err != nil {
+		return nil, err
+	}
+
+	return enforceRatio(cfg, lookup), nil
+}
+
+// enforceRatio provides a middleware that throttles or blocks leechers whose
+// ratio is below cfg.MinRatio. Seeders, announces without a user and stopped
+// announces are passed on unchanged.
+func enforceRatio(cfg *Config, lookup AccountLookup) tracker.AnnounceMiddleware {
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(tcfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			if req.UserID == "" || req.Left == 0 || req.Event == event.Stopped {
+				return next(tcfg, req, resp)
+			}
+
+			ok, err := meetsRatio(cfg, lookup, req)
+			if err != nil {
+				err = cfg.OnStoreError.HandleError(req.Context(), "ratio", err)
+				if err != nil {
+					return err
+				}
+				return next(tcfg, req, resp)
+			}
+			if ok {
+				return next(tcfg, req, resp)
+			}
+
+			log.DebugContext(req.Context(), "ratio: ratio too low", "user_id", req.UserID, "action", cfg.Action)
+			if cfg.Action == blockAction {
+				return ErrRatioTooLow
+			}
+
+			throttled := *tcfg
+			throttled.AnnounceInterval = cfg.ThrottleInterval
+			throttled.MinAnnounceInterval = cfg.ThrottleInterval
+			return next(&throttled, req, resp)
+		}
+	}
+}
+
+// meetsRatio reports whether the user of req has at least the minimum ratio,
+// counting the bytes of its account and of the session of the peer that
+// announced, including those reported by req.
+func meetsRatio(cfg *Config, lookup AccountLookup, req *chihaya.AnnounceRequest) (bool, error) {
+	account, err := lookup.LookupAccount(req.Context(), req.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	session, err := sessionState(req)
+	if err != nil {
+		return false, err
+	}
+
+	uploaded := account.Uploaded + session.Uploaded
+	downloaded := account.Downloaded + session.Downloaded
+	if downloaded < cfg.MinDownloaded {
+		return true, nil
+	}
+	return float64(uploaded) >= cfg.MinRatio*float64(downloaded), nil
+}
+
+// sessionState returns the state the peer of req will have once req is
+// handled. The state is empty if the PeerStore does not keep the states of
+// its peers.
+func sessionState(req *chihaya.AnnounceRequest) (store.PeerState, error) {
+	states, ok := mustGetStore().(store.PeerStateStore)
+	if !ok {
+		return store.PeerState{}, nil
+	}
+
+	peer := req.Peer4()
+	if req.IPv4 == nil {
+		peer = req.Peer6()
+	}
+
+	state, err := states.GetPeerState(req.InfoHash, peer)
+	if err != nil && err != store.ErrResourceDoesNotExist {
+		return store.PeerState{}, err
+	}
+	return state.Update(req.Uploaded, req.Downloaded, req.Left, time.Now()), nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package ratio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+// staticLookup looks up the accounts of a map. Users without an account fail
+// to be looked up.
+type staticLookup map[string]Account
+
+func (l staticLookup) LookupAccount(_ context.Context, userID string) (Account, error) {
+	account, ok := l[userID]
+	if !ok {
+		return Account{}, errors.New("database unavailable")
+	}
+	return account, nil
+}
+
+type staticLookupDriver struct{}
+
+func (staticLookupDriver) New(*store.DriverConfig) (AccountLookup, error) {
+	return accounts, nil
+}
+
+var accounts = staticLookup{
+	"good":  {Uploaded: 2000, Downloaded: 1000},
+	"bad":   {Uploaded: 100, Downloaded: 1000},
+	"new":   {Uploaded: 0, Downloaded: 50},
+	"close": {Uploaded: 450, Downloaded: 1000},
+}
+
+func init() {
+	RegisterAccountLookupDriver("static", staticLookupDriver{})
+}
+
+// withStore makes the middleware use a new memory PeerStore until the test
+// ends.
+func withStore(t *testing.T) store.PeerStore {
+	ps, err := store.OpenPeerStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	previous := mustGetStore
+	mustGetStore = func() store.PeerStore { return ps }
+	t.Cleanup(func() {
+		mustGetStore = previous
+		require.Nil(t, <-ps.Stop())
+	})
+	return ps
+}
+
+func config(options map[string]interface{}) chihaya.MiddlewareConfig {
+	config := map[string]interface{}{
+		"min_ratio":      0.5,
+		"min_downloaded": 100,
+		"account_lookup": map[string]interface{}{"name": "static"},
+	}
+	for k, v := range options {
+		config[k] = v
+	}
+	return chihaya.MiddlewareConfig{Name: "ratio", Config: config}
+}
+
+func TestNewConfig(t *testing.T) {
+	var table = []struct {
+		options map[string]interface{}
+		valid   bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"action": "block"}, true},
+		{map[string]interface{}{"action": "throttle", "throttle_interval": "2h"}, true},
+		{map[string]interface{}{"on_store_error": "closed"}, true},
+		{map[string]interface{}{"min_ratio": 0}, false},
+		{map[string]interface{}{"min_ratio": -1}, false},
+		{map[string]interface{}{"action": "ban"}, false},
+		{map[string]interface{}{"throttle_interval": "-1h"}, false},
+		{map[string]interface{}{"account_lookup": nil}, false},
+		{map[string]interface{}{"on_store_error": "ajar"}, false},
+	}
+
+	for _, tt := range table {
+		_, err := newConfig(config(tt.options))
+		require.Equal(t, tt.valid, err == nil, "%v", tt.options)
+	}
+
+	_, err := constructor(config(map[string]interface{}{"account_lookup": map[string]interface{}{"name": "ldap"}}))
+	require.NotNil(t, err)
+}
+
+// announce hands an announce of user through the ratio middleware and
+// returns the error and the interval of the response.
+func announce(t *testing.T, options map[string]interface{}, user string, req *chihaya.AnnounceRequest) (time.Duration, error) {
+	mw, err := constructor(config(options))
+	require.Nil(t, err)
+
+	req.UserID = user
+	req.InfoHash = chihaya.InfoHash{1}
+	req.PeerID = chihaya.PeerID{1}
+	req.IPv4 = net.IPv4(10, 0, 0, 1).To4()
+	req.Port = 6881
+
+	var interval time.Duration
+	err = mw(func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		interval = cfg.AnnounceInterval
+		return nil
+	})(&chihaya.TrackerConfig{AnnounceInterval: 30 * time.Minute}, req, &chihaya.AnnounceResponse{})
+	return interval, err
+}
+
+func TestEnforceRatio(t *testing.T) {
+	withStore(t)
+
+	var table = []struct {
+		user     string
+		left     uint64
+		e        event.Event
+		action   string
+		interval time.Duration
+		err      error
+	}{
+		// Users with a good ratio, new users and seeders pass.
+		{"good", 10, event.Started, "throttle", 30 * time.Minute, nil},
+		{"good", 10, event.Started, "block", 30 * time.Minute, nil},
+		{"new", 10, event.Started, "block", 30 * time.Minute, nil},
+		{"bad", 0, event.None, "block", 30 * time.Minute, nil},
+		{"bad", 10, event.Stopped, "block", 30 * time.Minute, nil},
+		{"", 10, event.Started, "block", 30 * time.Minute, nil},
+
+		// Leechers with a bad ratio are throttled or blocked.
+		{"bad", 10, event.Started, "throttle", time.Hour, nil},
+		{"close", 10, event.Started, "throttle", time.Hour, nil},
+		{"bad", 10, event.Started, "block", 0, ErrRatioTooLow},
+	}
+
+	for _, tt := range table {
+		interval, err := announce(t, map[string]interface{}{"action": tt.action}, tt.user, &chihaya.AnnounceRequest{
+			Event: tt.e,
+			Left:  tt.left,
+		})
+		require.Equal(t, tt.err, err, "%+v", tt)
+		require.Equal(t, tt.interval, interval, "%+v", tt)
+	}
+}
+
+// TestSession makes sure that the bytes the peer reported during its session
+// count, too.
+func TestSession(t *testing.T) {
+	ps := withStore(t)
+	options := map[string]interface{}{"action": "block"}
+
+	// The user "close" needs another 50 bytes of upload.
+	_, err := announce(t, options, "close", &chihaya.AnnounceRequest{Event: event.Started, Left: 10})
+	require.Equal(t, ErrRatioTooLow, err)
+
+	peer := chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}
+	require.Nil(t, ps.PutLeecher(chihaya.InfoHash{1}, peer))
+	require.Nil(t, ps.(store.PeerStateStore).UpdatePeerState(chihaya.InfoHash{1}, peer, 1000, 0, 10))
+
+	_, err = announce(t, options, "close", &chihaya.AnnounceRequest{Uploaded: 1040, Left: 10})
+	require.Equal(t, ErrRatioTooLow, err)
+	_, err = announce(t, options, "close", &chihaya.AnnounceRequest{Uploaded: 1050, Left: 10})
+	require.Nil(t, err)
+}
+
+func TestLookupError(t *testing.T) {
+	withStore(t)
+
+	interval, err := announce(t, map[string]interface{}{"action": "block"}, "unknown", &chihaya.AnnounceRequest{Left: 10})
+	require.Nil(t, err)
+	require.Equal(t, 30*time.Minute, interval)
+
+	_, err = announce(t, map[string]interface{}{"action": "block", "on_store_error": "closed"}, "unknown", &chihaya.AnnounceRequest{Left: 10})
+	require.Equal(t, store.ErrStoreUnavailable, err)
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package response
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// Config represents the configuration for the store_response announce
+// middleware.
+type Config struct {
+	// FamilyPolicy is the address family policy of announces, either
+	// strict or bridge. It defaults to strict.
+	FamilyPolicy string `yaml:"family_policy"`
+
+	// SeedersToSeeders makes seeders get seeders, too, like leechers do. By
+	// default, seeders only get leechers, because seeders have nothing to
+	// exchange.
+	SeedersToSeeders bool `yaml:"seeders_to_seeders"`
+}
+
+// familyPolicies are the store.FamilyPolicy values of the FamilyPolicy
+// config values.
+var familyPolicies = map[string]store.FamilyPolicy{
+	"":       store.SameFamily,
+	"strict": store.SameFamily,
+	"bridge": store.BridgeFamilies,
+}
+
+func newConfig(mwcfg chihaya.MiddlewareConfig) (*Config, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := familyPolicies[cfg.FamilyPolicy]; !ok {
+		return nil, fmt.Errorf("unknown family policy %q", cfg.FamilyPolicy)
+	}
+
+	return &cfg, nil
+}
+
+// defaultCacheTTL is the time the stats of swarms are cached for if the cache
+// is enabled, but no TTL is configured.
+const defaultCacheTTL = 10 * time.Second
+
+// ScrapeConfig represents the configuration for the store_response scrape
+// middleware.
+type ScrapeConfig struct {
+	// CacheSize is the number of swarms whose stats are cached. The stats
+	// are looked up for every scrape if it is 0.
+	CacheSize int `yaml:"cache_size"`
+
+	// CacheTTL is the time stats are cached for. It defaults to 10s.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+func newScrapeConfig(mwcfg chihaya.MiddlewareConfig) (*ScrapeConfig, error) {
+	bytes, err := yaml.Marshal(mwcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ScrapeConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CacheSize < 0 || cfg.CacheTTL < 0 {
+		return nil, errors.New("cache_size and cache_ttl must not be negative")
+	}
+	if cfg.CacheSize > 0 && cfg.CacheTTL == 0 {
+		cfg.CacheTTL = defaultCacheTTL
+	}
+
+	return &cfg, nil
+}
@@ -6,15 +6,27 @@ package response
 
 import (
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server/store"
 	"github.com/chihaya/chihaya/tracker"
 )
 
 func init() {
-	tracker.RegisterAnnounceMiddleware("store_response", responseAnnounceClient)
-	tracker.RegisterScrapeMiddleware("store_response", responseScrapeClient)
+	tracker.RegisterAnnounceMiddlewareConstructor("store_response", announceConstructor)
+	tracker.RegisterScrapeMiddlewareConstructor("store_response", scrapeConstructor)
+	mustGetStore = func() store.PeerStore {
+		return store.MustGetStore().PeerStore
+	}
 }
 
+var mustGetStore func() store.PeerStore
+
+// ErrFullScrapeUnsupported is returned for full scrapes if the PeerStore can
+// not list its swarms.
+var ErrFullScrapeUnsupported = tracker.ClientError("full scrape not supported")
+
 // FailedToRetrievePeers represents an error that has been return when
 // attempting to fetch peers from the store.
 type FailedToRetrievePeers string
@@ -22,38 +34,169 @@ type FailedToRetrievePeers string
 // Error interface for FailedToRetrievePeers.
 func (f FailedToRetrievePeers) Error() string { return string(f) }
 
+func announceConstructor(c chihaya.MiddlewareConfig) (tracker.AnnounceMiddleware, error) {
+	cfg, err := newConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseAnnounceClient(cfg), nil
+}
+
 // responseAnnounceClient provides a middleware to make a response to an
-// announce based on the current request.
-func responseAnnounceClient(next tracker.AnnounceHandler) tracker.AnnounceHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
-		storage := store.MustGetStore()
-
-		resp.Interval = cfg.AnnounceInterval
-		resp.MinInterval = cfg.MinAnnounceInterval
-		resp.Compact = req.Compact
-		resp.Complete = int32(storage.NumSeeders(req.InfoHash))
-		resp.Incomplete = int32(storage.NumLeechers(req.InfoHash))
-		resp.IPv4Peers, resp.IPv6Peers, err = storage.AnnouncePeers(req.InfoHash, req.Left == 0, int(req.NumWant), req.Peer4(), req.Peer6())
+// announce based on the current request, which returns peers according to
+// the family policy of mwcfg.
+//
+// The peers are not looked up for announces that want none, for stopped
+// announces, and for seeders of swarms without leechers that are not handed
+// seeders. The counts of seeders and leechers are part of every response.
+// Neither the peers nor the counts include the announcer.
+func responseAnnounceClient(mwcfg *Config) tracker.AnnounceMiddleware {
+	policy := familyPolicies[mwcfg.FamilyPolicy]
+	return func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) (err error) {
+			storage := mustGetStore()
+
+			resp.Interval = cfg.AnnounceInterval
+			resp.MinInterval = cfg.MinAnnounceInterval
+			resp.Compact = req.Compact
+			resp.Complete = int32(storage.NumSeeders(req.InfoHash))
+			resp.Incomplete = int32(storage.NumLeechers(req.InfoHash))
+			excludeAnnouncer(storage, req, resp)
+
+			seeder := req.Left == 0 && !mwcfg.SeedersToSeeders
+			if req.NumWant <= 0 || req.Event == event.Stopped || seeder && resp.Incomplete == 0 {
+				return next(cfg, req, resp)
+			}
+
+			ctx := req.Context()
+			resp.IPv4Peers, resp.IPv6Peers, err = store.AnnouncePeers(ctx, storage, req.InfoHash, seeder, int(req.NumWant), req.Peer4(), req.Peer6(), policy)
+			if err != nil && err == ctx.Err() {
+				log.DebugContext(ctx, "store_response: request canceled", "error", err)
+				return err
+			} else if err != nil {
+				log.ErrorContext(req.Context(), "store_response: failed to retrieve peers", "error", err)
+				return FailedToRetrievePeers(err.Error())
+			}
+
+			return next(cfg, req, resp)
+		}
+	}
+}
+
+// excludeAnnouncer leaves the announcer of req out of the counts of resp, for
+// each address family it is stored under in the swarm, as the seeder or
+// leecher it is stored as. Whether it is stored depends on the middleware that
+// ran before, on the limits of the PeerStore and on the peers it replaced, so
+// the PeerStore is asked.
+//
+// The counts are left as they are if the PeerStore can not tell, or fails to.
+func excludeAnnouncer(storage store.PeerStore, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) {
+	checker, ok := storage.(store.SwarmMemberChecker)
+	if !ok {
+		return
+	}
+
+	var seeders, leechers int32
+	for _, p := range []chihaya.Peer{req.Peer4(), req.Peer6()} {
+		if p.IP == nil {
+			continue
+		}
+
+		seeder, leecher, err := checker.HasPeer(req.InfoHash, p)
 		if err != nil {
-			return FailedToRetrievePeers(err.Error())
+			log.WarnContext(req.Context(), "store_response: failed to look up announcer", "error", err)
+			return
+		}
+		if seeder {
+			seeders++
+		}
+		if leecher {
+			leechers++
 		}
+	}
+
+	// The counts and the lookups are not atomic, so peers may have left in
+	// between.
+	resp.Complete -= seeders
+	if resp.Complete < 0 {
+		resp.Complete = 0
+	}
+	resp.Incomplete -= leechers
+	if resp.Incomplete < 0 {
+		resp.Incomplete = 0
+	}
+}
+
+func scrapeConstructor(c chihaya.MiddlewareConfig) (tracker.ScrapeMiddleware, error) {
+	cfg, err := newScrapeConfig(c)
+	if err != nil {
+		return nil, err
+	}
 
-		return next(cfg, req, resp)
+	var cache *statsCache
+	if cfg.CacheSize > 0 {
+		cache = newStatsCache(cfg.CacheSize, cfg.CacheTTL, clock.Real)
 	}
+	return responseScrapeClient(cache), nil
 }
 
 // responseScrapeClient provides a middleware to make a response to an
 // scrape based on the current request.
-func responseScrapeClient(next tracker.ScrapeHandler) tracker.ScrapeHandler {
-	return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
-		storage := store.MustGetStore()
-		for _, infoHash := range req.InfoHashes {
-			resp.Files[infoHash] = chihaya.Scrape{
-				Complete:   int32(storage.NumSeeders(infoHash)),
-				Incomplete: int32(storage.NumLeechers(infoHash)),
+//
+// Every requested infohash is part of the response, unknown ones with all
+// counts being zero. Full scrapes get every swarm with peers, if the
+// PeerStore is a store.SwarmSizeWalker.
+//
+// If cache is not nil, the stats of the scraped infohashes are taken from it
+// while they are cached, except for full scrapes.
+func responseScrapeClient(cache *statsCache) tracker.ScrapeMiddleware {
+	return func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) (err error) {
+			storage := mustGetStore()
+			infoHashes := req.InfoHashes
+			if req.Full {
+				walker, ok := storage.(store.SwarmSizeWalker)
+				if !ok {
+					return ErrFullScrapeUnsupported
+				}
+				infoHashes = nil
+				walker.WalkSwarmSizes(func(infoHash chihaya.InfoHash, peers int) {
+					infoHashes = append(infoHashes, infoHash)
+				})
 			}
-		}
+			cached := cache != nil && !req.Full
+
+			for _, infoHash := range infoHashes {
+				if cached {
+					if stats, ok := cache.get(infoHash); ok {
+						resp.Files[infoHash] = stats
+						continue
+					}
+				}
 
-		return next(cfg, req, resp)
+				seeders, leechers, downloaded, err := storage.GetStats(infoHash)
+				if err != nil {
+					log.ErrorContext(req.Context(), "store_response: failed to retrieve stats", "error", err)
+					return FailedToRetrievePeers(err.Error())
+				}
+				if req.Full && seeders+leechers == 0 {
+					// The swarm emptied after it was listed.
+					continue
+				}
+
+				stats := chihaya.Scrape{
+					Complete:   int32(seeders),
+					Incomplete: int32(leechers),
+					Downloaded: int32(downloaded),
+				}
+				resp.Files[infoHash] = stats
+				if cached {
+					cache.put(infoHash, stats)
+				}
+			}
+
+			return next(cfg, req, resp)
+		}
 	}
 }
@@ -0,0 +1,372 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package response
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+// countingStore is a PeerStore that counts the lookups of peers and stats.
+type countingStore struct {
+	store.PeerStore
+	lookups      int
+	statsLookups int
+}
+
+func (s *countingStore) GetStats(infoHash chihaya.InfoHash) (seeders, leechers, downloaded uint64, err error) {
+	s.statsLookups++
+	return s.PeerStore.GetStats(infoHash)
+}
+
+func (s *countingStore) AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	s.lookups++
+	return s.PeerStore.AnnouncePeers(infoHash, seeder, numWant, peer4, peer6, policy)
+}
+
+func (s *countingStore) HasPeer(infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error) {
+	return s.PeerStore.(store.SwarmMemberChecker).HasPeer(infoHash, p)
+}
+
+// failingStore is a PeerStore that fails to tell whether a peer is stored.
+type failingStore struct {
+	store.PeerStore
+}
+
+func (s failingStore) HasPeer(chihaya.InfoHash, chihaya.Peer) (seeder, leecher bool, err error) {
+	return false, false, errors.New("unreachable")
+}
+
+// withStore makes the middleware use a new memory PeerStore until the test
+// ends.
+func withStore(t *testing.T) *countingStore {
+	return withStoreConfig(t, nil)
+}
+
+// withStoreConfig is like withStore, with a memory PeerStore of cfg.
+func withStoreConfig(t *testing.T, cfg map[string]interface{}) *countingStore {
+	ps, err := store.OpenPeerStore(&store.DriverConfig{Name: "memory", Config: cfg})
+	require.Nil(t, err)
+	s := &countingStore{PeerStore: ps}
+
+	previous := mustGetStore
+	mustGetStore = func() store.PeerStore { return s }
+	t.Cleanup(func() {
+		mustGetStore = previous
+		require.Nil(t, <-ps.Stop())
+	})
+	return s
+}
+
+func peer(id byte) chihaya.Peer {
+	return chihaya.Peer{ID: chihaya.PeerID{id}, IP: net.IPv4(10, 0, 0, id).To4(), Port: 6881}
+}
+
+func announce(t *testing.T, mwcfg *Config, p chihaya.Peer, left uint64, numWant int32) *chihaya.AnnounceResponse {
+	return announceRequest(t, mwcfg, &chihaya.AnnounceRequest{
+		InfoHash: chihaya.InfoHash{1},
+		PeerID:   p.ID,
+		IPv4:     p.IP,
+		Port:     p.Port,
+		Left:     left,
+		NumWant:  numWant,
+	})
+}
+
+func announceRequest(t *testing.T, mwcfg *Config, req *chihaya.AnnounceRequest) *chihaya.AnnounceResponse {
+	resp := &chihaya.AnnounceResponse{}
+	err := responseAnnounceClient(mwcfg)(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		return nil
+	})(&chihaya.TrackerConfig{}, req, resp)
+	require.Nil(t, err)
+	return resp
+}
+
+func TestNumWantZero(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutLeecher(hash, peer(2)))
+	require.Nil(t, s.PutLeecher(hash, peer(3)))
+
+	// the counts leave out the announcer, but no peers are looked up
+	resp := announce(t, &Config{}, peer(2), 10, 0)
+	require.Equal(t, int32(1), resp.Complete)
+	require.Equal(t, int32(1), resp.Incomplete)
+	require.Equal(t, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers))
+	require.Equal(t, 0, s.lookups)
+
+	resp = announce(t, &Config{}, peer(2), 10, 50)
+	require.Equal(t, 2, len(resp.IPv4Peers))
+	require.Equal(t, 1, s.lookups)
+}
+
+func TestStopped(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutLeecher(hash, peer(3)))
+
+	// stopping peers get the counts, but no peers they would not use
+	req := &chihaya.AnnounceRequest{
+		Event:    event.Stopped,
+		InfoHash: hash,
+		PeerID:   peer(2).ID,
+		IPv4:     peer(2).IP,
+		Port:     peer(2).Port,
+		Left:     10,
+		NumWant:  50,
+	}
+	resp := &chihaya.AnnounceResponse{}
+	err := responseAnnounceClient(&Config{})(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		return nil
+	})(&chihaya.TrackerConfig{}, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, int32(1), resp.Complete)
+	require.Equal(t, int32(1), resp.Incomplete)
+	require.Equal(t, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers))
+	require.Equal(t, 0, s.lookups)
+}
+
+func TestSeedersToSeeders(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutSeeder(hash, peer(2)))
+
+	// seeders of swarms without leechers get nobody to connect to, without
+	// a lookup
+	resp := announce(t, &Config{}, peer(1), 0, 50)
+	require.Equal(t, int32(1), resp.Complete)
+	require.Equal(t, int32(0), resp.Incomplete)
+	require.Equal(t, 0, len(resp.IPv4Peers))
+	require.Equal(t, 0, s.lookups)
+
+	// unless seeders are handed seeders
+	resp = announce(t, &Config{SeedersToSeeders: true}, peer(1), 0, 50)
+	require.Equal(t, []chihaya.Peer{peer(2)}, resp.IPv4Peers)
+
+	// once there is a leecher, seeders only get it
+	require.Nil(t, s.PutLeecher(hash, peer(3)))
+	resp = announce(t, &Config{}, peer(1), 0, 50)
+	require.Equal(t, int32(1), resp.Incomplete)
+	require.Equal(t, []chihaya.Peer{peer(3)}, resp.IPv4Peers)
+
+	// while leechers get everyone else
+	resp = announce(t, &Config{}, peer(3), 10, 50)
+	require.Equal(t, 2, len(resp.IPv4Peers))
+}
+
+func TestAnnouncerExcluded(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	self6 := chihaya.Peer{ID: peer(1).ID, IP: net.ParseIP("fd00::1"), Port: 6881}
+	stale := peer(1)
+	stale.Port = 6882
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutSeeder(hash, self6))
+	require.Nil(t, s.PutSeeder(hash, stale))
+	require.Nil(t, s.PutSeeder(hash, peer(2)))
+	require.Nil(t, s.PutLeecher(hash, peer(3)))
+
+	// a dual-stacked seeder is left out of the counts of both families,
+	// and neither it nor its stale address is handed to it
+	req := &chihaya.AnnounceRequest{
+		InfoHash: hash,
+		PeerID:   peer(1).ID,
+		IPv4:     peer(1).IP,
+		IPv6:     self6.IP,
+		Port:     peer(1).Port,
+		NumWant:  50,
+	}
+	resp := &chihaya.AnnounceResponse{}
+	err := responseAnnounceClient(&Config{SeedersToSeeders: true})(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		return nil
+	})(&chihaya.TrackerConfig{}, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, int32(2), resp.Complete)
+	require.Equal(t, int32(1), resp.Incomplete)
+	require.ElementsMatch(t, []chihaya.Peer{peer(2), peer(3)}, resp.IPv4Peers)
+	require.Empty(t, resp.IPv6Peers)
+
+	// the stored counts remain whole
+	require.Equal(t, 4, s.NumSeeders(hash))
+
+	// leechers are left out of the leechers they see
+	for i := 0; i < 10; i++ {
+		resp = announce(t, &Config{}, peer(3), 10, 50)
+		require.Equal(t, int32(4), resp.Complete)
+		require.Equal(t, int32(0), resp.Incomplete)
+		require.NotContains(t, resp.IPv4Peers, peer(3))
+	}
+
+	// announcers that were not stored leave out nobody
+	resp = announce(t, &Config{}, peer(9), 10, 0)
+	require.Equal(t, int32(4), resp.Complete)
+	require.Equal(t, int32(1), resp.Incomplete)
+}
+
+func TestAnnouncerNotStored(t *testing.T) {
+	s := withStoreConfig(t, map[string]interface{}{"max_peers_per_swarm": 1})
+	hash := chihaya.InfoHash{1}
+	self6 := chihaya.Peer{ID: peer(1).ID, IP: net.ParseIP("fd00::1"), Port: 6881}
+	req := &chihaya.AnnounceRequest{
+		InfoHash: hash,
+		PeerID:   peer(1).ID,
+		IPv4:     peer(1).IP,
+		IPv6:     self6.IP,
+		Port:     peer(1).Port,
+	}
+
+	// a dual-stacked seeder of a full swarm is only left out of the family
+	// it is still stored under
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutSeeder(hash, self6))
+	require.Equal(t, 1, s.NumSeeders(hash))
+	resp := announceRequest(t, &Config{}, req)
+	require.Equal(t, int32(0), resp.Complete)
+
+	// once the swarm holds another seeder instead, that one is counted
+	require.Nil(t, s.PutSeeder(hash, peer(2)))
+	resp = announceRequest(t, &Config{}, req)
+	require.Equal(t, int32(1), resp.Complete)
+	require.Equal(t, int32(0), resp.Incomplete)
+}
+
+func TestAnnouncerReplaced(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	keyed := peer(1)
+	keyed.Key = "A1B2C3D4"
+	remapped := keyed
+	remapped.Port = 6882
+	require.Nil(t, s.PutLeecher(hash, keyed))
+	require.Nil(t, s.PutLeecher(hash, peer(2)))
+
+	// a peer whose NAT mapping changed replaced its old address, and is left
+	// out once
+	require.Nil(t, s.PutLeecher(hash, remapped))
+	resp := announceRequest(t, &Config{}, &chihaya.AnnounceRequest{
+		InfoHash: hash,
+		PeerID:   remapped.ID,
+		IPv4:     remapped.IP,
+		Port:     remapped.Port,
+		Key:      remapped.Key,
+		Left:     10,
+		NumWant:  50,
+	})
+	require.Equal(t, int32(1), resp.Incomplete)
+	require.Equal(t, []chihaya.Peer{peer(2)}, resp.IPv4Peers)
+}
+
+func TestAnnouncerChainOrder(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutLeecher(hash, peer(1)))
+	require.Nil(t, s.PutLeecher(hash, peer(2)))
+
+	// running before store_swarm_interaction, the first announce of a peer
+	// counts everyone else
+	resp := announce(t, &Config{}, peer(3), 10, 0)
+	require.Equal(t, int32(2), resp.Incomplete)
+
+	// and a stopping peer, which is still stored, is left out
+	resp = announceRequest(t, &Config{}, &chihaya.AnnounceRequest{
+		Event:    event.Stopped,
+		InfoHash: hash,
+		PeerID:   peer(1).ID,
+		IPv4:     peer(1).IP,
+		Port:     peer(1).Port,
+		Left:     10,
+	})
+	require.Equal(t, int32(1), resp.Incomplete)
+}
+
+func TestAnnouncerLookupFails(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+	require.Nil(t, s.PutSeeder(hash, peer(2)))
+
+	// the counts are left whole if the PeerStore can not tell whether the
+	// announcer is stored, or fails to
+	for _, ps := range []store.PeerStore{struct{ store.PeerStore }{s.PeerStore}, failingStore{s.PeerStore}} {
+		mustGetStore = func() store.PeerStore { return ps }
+		resp := announce(t, &Config{}, peer(1), 0, 0)
+		require.Equal(t, int32(2), resp.Complete)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+
+	// The memory store itself notices the cancellation.
+	mustGetStore = func() store.PeerStore { return s.PeerStore }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := (&chihaya.AnnounceRequest{
+		InfoHash: hash,
+		PeerID:   peer(2).ID,
+		IPv4:     peer(2).IP,
+		Port:     peer(2).Port,
+		Left:     10,
+		NumWant:  50,
+	}).WithContext(ctx)
+	resp := &chihaya.AnnounceResponse{}
+	err := responseAnnounceClient(&Config{})(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+		t.Fatal("canceled request reached the next handler")
+		return nil
+	})(&chihaya.TrackerConfig{}, req, resp)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestFullScrape(t *testing.T) {
+	s := withStore(t)
+	for i := byte(1); i <= 3; i++ {
+		require.Nil(t, s.PutSeeder(chihaya.InfoHash{i}, peer(i)))
+	}
+	require.Nil(t, s.PutLeecher(chihaya.InfoHash{1}, peer(4)))
+
+	scrape := func(req *chihaya.ScrapeRequest) (*chihaya.ScrapeResponse, error) {
+		resp := &chihaya.ScrapeResponse{Files: make(map[chihaya.InfoHash]chihaya.Scrape)}
+		err := responseScrapeClient(nil)(func(*chihaya.TrackerConfig, *chihaya.ScrapeRequest, *chihaya.ScrapeResponse) error {
+			return nil
+		})(&chihaya.TrackerConfig{}, req, resp)
+		return resp, err
+	}
+
+	// Stores that can not list their swarms do not support full scrapes.
+	_, err := scrape(&chihaya.ScrapeRequest{Full: true})
+	require.Equal(t, ErrFullScrapeUnsupported, err)
+
+	mustGetStore = func() store.PeerStore { return s.PeerStore }
+	resp, err := scrape(&chihaya.ScrapeRequest{Full: true})
+	require.Nil(t, err)
+	require.Equal(t, map[chihaya.InfoHash]chihaya.Scrape{
+		{1}: {Complete: 1, Incomplete: 1},
+		{2}: {Complete: 1},
+		{3}: {Complete: 1},
+	}, resp.Files)
+
+	// Scrapes of infohashes only get those.
+	resp, err = scrape(&chihaya.ScrapeRequest{InfoHashes: []chihaya.InfoHash{{2}, {9}}})
+	require.Nil(t, err)
+	require.Equal(t, map[chihaya.InfoHash]chihaya.Scrape{
+		{2}: {Complete: 1},
+		{9}: {},
+	}, resp.Files)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package response
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+// statsCache is an LRU cache of the stats of swarms, as scrapes get them from
+// the PeerStore.
+//
+// It only saves the lookups of the stats: the scrape middleware in front of
+// store_response, e.g. the checks of IPs and passkeys, runs for every scrape.
+type statsCache struct {
+	size  int
+	ttl   time.Duration
+	clock clock.Clock
+
+	mu      sync.Mutex
+	entries map[chihaya.InfoHash]*list.Element
+	lru     *list.List // of *statsCacheEntry, most recently used first
+}
+
+type statsCacheEntry struct {
+	infoHash chihaya.InfoHash
+	stats    chihaya.Scrape
+	expires  time.Time
+}
+
+// newStatsCache returns a statsCache that holds the stats of up to size swarms
+// for ttl each.
+func newStatsCache(size int, ttl time.Duration, c clock.Clock) *statsCache {
+	return &statsCache{
+		size:    size,
+		ttl:     ttl,
+		clock:   c,
+		entries: make(map[chihaya.InfoHash]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the stats cached for infoHash, if they have not expired.
+func (c *statsCache) get(infoHash chihaya.InfoHash) (chihaya.Scrape, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[infoHash]
+	if !ok {
+		return chihaya.Scrape{}, false
+	}
+
+	entry := e.Value.(*statsCacheEntry)
+	if !c.clock.Now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, infoHash)
+		return chihaya.Scrape{}, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.stats, true
+}
+
+// put caches stats as the stats of infoHash, evicting the least recently used
+// stats if the cache is full.
+func (c *statsCache) put(infoHash chihaya.InfoHash, stats chihaya.Scrape) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.clock.Now().Add(c.ttl)
+	if e, ok := c.entries[infoHash]; ok {
+		entry := e.Value.(*statsCacheEntry)
+		entry.stats, entry.expires = stats, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*statsCacheEntry).infoHash)
+	}
+	c.entries[infoHash] = c.lru.PushFront(&statsCacheEntry{infoHash: infoHash, stats: stats, expires: expires})
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package response
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func TestScrapeConfig(t *testing.T) {
+	cfg, err := newScrapeConfig(chihaya.MiddlewareConfig{Config: map[string]interface{}{"cache_size": 1024}})
+	require.Nil(t, err)
+	require.Equal(t, defaultCacheTTL, cfg.CacheTTL)
+
+	_, err = newScrapeConfig(chihaya.MiddlewareConfig{Config: map[string]interface{}{"cache_size": -1}})
+	require.NotNil(t, err)
+	_, err = newScrapeConfig(chihaya.MiddlewareConfig{Config: map[string]interface{}{"cache_ttl": "-1s"}})
+	require.NotNil(t, err)
+}
+
+func TestStatsCache(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	c := newStatsCache(2, 10*time.Second, fake)
+	a, b, d := chihaya.InfoHash{1}, chihaya.InfoHash{2}, chihaya.InfoHash{3}
+
+	c.put(a, chihaya.Scrape{Complete: 1})
+	c.put(b, chihaya.Scrape{Complete: 2})
+	stats, ok := c.get(a)
+	require.True(t, ok)
+	require.Equal(t, chihaya.Scrape{Complete: 1}, stats)
+
+	// the least recently used stats are evicted
+	c.put(d, chihaya.Scrape{Complete: 3})
+	_, ok = c.get(b)
+	require.False(t, ok)
+	_, ok = c.get(a)
+	require.True(t, ok)
+	_, ok = c.get(d)
+	require.True(t, ok)
+
+	// stats expire after the TTL
+	fake.Advance(5 * time.Second)
+	c.put(a, chihaya.Scrape{Complete: 4})
+	fake.Advance(5 * time.Second)
+	_, ok = c.get(d)
+	require.False(t, ok)
+	stats, ok = c.get(a)
+	require.True(t, ok)
+	require.Equal(t, chihaya.Scrape{Complete: 4}, stats)
+	require.Equal(t, 1, c.lru.Len())
+}
+
+// bannedIP is rejected by response_test_ban.
+var bannedIP = net.IPv4(10, 0, 0, 66).To4()
+
+func init() {
+	tracker.RegisterScrapeMiddleware("response_test_ban", func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			if req.IPv4.Equal(bannedIP) {
+				return tracker.ClientError("banned")
+			}
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+func TestCachedScrape(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		ScrapeMiddleware: []chihaya.MiddlewareConfig{
+			{Name: "response_test_ban"},
+			{Name: "store_response", Config: map[string]interface{}{"cache_size": 16}},
+		},
+	})
+	require.Nil(t, err)
+
+	scrape := func(ip net.IP) (*chihaya.ScrapeResponse, error) {
+		return tkr.HandleScrape(&chihaya.ScrapeRequest{IPv4: ip, InfoHashes: []chihaya.InfoHash{hash}})
+	}
+
+	resp, err := scrape(peer(2).IP)
+	require.Nil(t, err)
+	require.Equal(t, chihaya.Scrape{Complete: 1}, resp.Files[hash])
+	require.Equal(t, 1, s.statsLookups)
+
+	// the stats are cached
+	require.Nil(t, s.PutLeecher(hash, peer(3)))
+	resp, err = scrape(peer(3).IP)
+	require.Nil(t, err)
+	require.Equal(t, chihaya.Scrape{Complete: 1}, resp.Files[hash])
+	require.Equal(t, 1, s.statsLookups)
+
+	// but the middleware in front of store_response still runs
+	_, err = scrape(bannedIP)
+	require.Equal(t, tracker.ClientError("banned"), err)
+}
+
+func TestCachedScrapeExpiry(t *testing.T) {
+	s := withStore(t)
+	hash := chihaya.InfoHash{1}
+	require.Nil(t, s.PutSeeder(hash, peer(1)))
+
+	fake := clock.NewFake(time.Unix(1466000000, 0))
+	mw := responseScrapeClient(newStatsCache(16, 10*time.Second, fake))
+	scrape := func(req *chihaya.ScrapeRequest) *chihaya.ScrapeResponse {
+		resp := &chihaya.ScrapeResponse{Files: make(map[chihaya.InfoHash]chihaya.Scrape)}
+		err := mw(func(*chihaya.TrackerConfig, *chihaya.ScrapeRequest, *chihaya.ScrapeResponse) error {
+			return nil
+		})(&chihaya.TrackerConfig{}, req, resp)
+		require.Nil(t, err)
+		return resp
+	}
+
+	scrape(&chihaya.ScrapeRequest{InfoHashes: []chihaya.InfoHash{hash}})
+	require.Nil(t, s.PutLeecher(hash, peer(2)))
+
+	// full scrapes bypass the cache
+	mustGetStore = func() store.PeerStore { return s.PeerStore }
+	resp := scrape(&chihaya.ScrapeRequest{Full: true})
+	require.Equal(t, chihaya.Scrape{Complete: 1, Incomplete: 1}, resp.Files[hash])
+	mustGetStore = func() store.PeerStore { return s }
+
+	// the stats refresh once they expired
+	fake.Advance(9 * time.Second)
+	resp = scrape(&chihaya.ScrapeRequest{InfoHashes: []chihaya.InfoHash{hash}})
+	require.Equal(t, chihaya.Scrape{Complete: 1}, resp.Files[hash])
+	fake.Advance(time.Second)
+	resp = scrape(&chihaya.ScrapeRequest{InfoHashes: []chihaya.InfoHash{hash}})
+	require.Equal(t, chihaya.Scrape{Complete: 1, Incomplete: 1}, resp.Files[hash])
+	require.Equal(t, 2, s.statsLookups)
+}
@@ -7,14 +7,20 @@ package response
 import (
 	"github.com/chihaya/chihaya"
 	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server/store"
 	"github.com/chihaya/chihaya/tracker"
 )
 
 func init() {
 	tracker.RegisterAnnounceMiddleware("store_swarm_interaction", announceSwarmInteraction)
+	mustGetStore = func() store.PeerStore {
+		return store.MustGetStore().PeerStore
+	}
 }
 
+var mustGetStore func() store.PeerStore
+
 // FailedSwarmInteraction represents an error that indicates that the
 // interaction of a peer with a swarm failed.
 type FailedSwarmInteraction string
@@ -29,6 +35,7 @@ func announceSwarmInteraction(next tracker.AnnounceHandler) tracker.AnnounceHand
 		if req.IPv4 != nil {
 			err = updatePeerStore(req, req.Peer4())
 			if err != nil {
+				log.ErrorContext(req.Context(), "store_swarm_interaction: failed to update swarm", "error", err)
 				return FailedSwarmInteraction(err.Error())
 			}
 		}
@@ -36,6 +43,7 @@ func announceSwarmInteraction(next tracker.AnnounceHandler) tracker.AnnounceHand
 		if req.IPv6 != nil {
 			err = updatePeerStore(req, req.Peer6())
 			if err != nil {
+				log.ErrorContext(req.Context(), "store_swarm_interaction: failed to update swarm", "error", err)
 				return FailedSwarmInteraction(err.Error())
 			}
 		}
@@ -45,7 +53,7 @@ func announceSwarmInteraction(next tracker.AnnounceHandler) tracker.AnnounceHand
 }
 
 func updatePeerStore(req *chihaya.AnnounceRequest, peer chihaya.Peer) (err error) {
-	storage := store.MustGetStore()
+	storage := mustGetStore()
 
 	switch {
 	case req.Event == event.Stopped:
@@ -71,5 +79,12 @@ func updatePeerStore(req *chihaya.AnnounceRequest, peer chihaya.Peer) (err error
 		}
 	}
 
+	if states, ok := storage.(store.PeerStateStore); ok && req.Event != event.Stopped {
+		err = states.UpdatePeerState(req.InfoHash, peer, req.Uploaded, req.Downloaded, req.Left)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,170 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package response
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	_ "github.com/chihaya/chihaya/middleware/ipoverride"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+type params map[string]string
+
+func (p params) String(key string) (string, error) {
+	if v, ok := p[key]; ok {
+		return v, nil
+	}
+	return "", errors.New("not found")
+}
+
+// withStore makes the middleware use a new memory PeerStore until the test
+// ends.
+func withStore(t *testing.T) store.PeerStore {
+	ps, err := store.OpenPeerStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	previous := mustGetStore
+	mustGetStore = func() store.PeerStore { return ps }
+	t.Cleanup(func() {
+		mustGetStore = previous
+		require.Nil(t, <-ps.Stop())
+	})
+	return ps
+}
+
+func TestDualStackAnnounce(t *testing.T) {
+	ps := withStore(t)
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{
+			{Name: "ip_override", Config: map[string]interface{}{"dual_stack": true}},
+			{Name: "store_swarm_interaction"},
+		},
+	})
+	require.Nil(t, err)
+
+	hash := chihaya.InfoHash{1}
+	announce := func(id byte, ipv6 string) {
+		_, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{
+			InfoHash: hash,
+			PeerID:   chihaya.PeerID{id},
+			IPv4:     net.IPv4(203, 0, 113, id).To4(),
+			Port:     6881,
+			Left:     10,
+			Params:   params{"ipv6": ipv6},
+		})
+		require.Nil(t, err)
+	}
+	first4 := chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.IPv4(203, 0, 113, 1).To4(), Port: 6881}
+	first6 := chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.ParseIP("2001:db8::1"), Port: 6882}
+	second4 := chihaya.Peer{ID: chihaya.PeerID{2}, IP: net.IPv4(203, 0, 113, 2).To4(), Port: 6881}
+	second6 := chihaya.Peer{ID: chihaya.PeerID{2}, IP: net.ParseIP("2001:db8::2"), Port: 6881}
+
+	// Both clients announce over IPv4, with their IPv6 endpoint as of
+	// BEP 7, and end up in both pools.
+	announce(1, "[2001:db8::1]:6882")
+	announce(2, "2001:db8::2")
+	require.Equal(t, 4, ps.NumLeechers(hash), "leechers of both families")
+
+	peers, peers6, err := ps.AnnouncePeers(hash, false, 50, second4, second6, store.SameFamily)
+	require.Nil(t, err)
+	require.Equal(t, []chihaya.Peer{first4}, peers)
+	require.Equal(t, []chihaya.Peer{first6}, peers6)
+
+	peers, peers6, err = ps.AnnouncePeers(hash, false, 50, first4, first6, store.SameFamily)
+	require.Nil(t, err)
+	require.Equal(t, []chihaya.Peer{second4}, peers)
+	require.Equal(t, []chihaya.Peer{second6}, peers6)
+
+	// Link-local addresses are rejected before they reach the store.
+	_, err = tkr.HandleAnnounce(&chihaya.AnnounceRequest{
+		InfoHash: hash,
+		PeerID:   chihaya.PeerID{3},
+		IPv4:     net.IPv4(203, 0, 113, 3).To4(),
+		Port:     6881,
+		Params:   params{"ipv6": "fe80::3"},
+	})
+	require.Equal(t, tracker.ClientError("failed to provide valid ipv6"), err)
+	require.Equal(t, 4, ps.NumLeechers(hash))
+}
+
+func TestStopped(t *testing.T) {
+	ps := withStore(t)
+	hash := chihaya.InfoHash{1}
+	announce := func(id byte, left uint64, e event.Event) {
+		err := announceSwarmInteraction(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+			return nil
+		})(&chihaya.TrackerConfig{}, &chihaya.AnnounceRequest{
+			Event:    e,
+			InfoHash: hash,
+			PeerID:   chihaya.PeerID{id},
+			IPv4:     net.IPv4(203, 0, 113, id).To4(),
+			Port:     6881,
+			Left:     left,
+		}, &chihaya.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	announce(1, 0, event.Started)
+	announce(2, 10, event.Started)
+	require.Equal(t, 1, ps.NumSeeders(hash))
+	require.Equal(t, 1, ps.NumLeechers(hash))
+
+	// Stopped peers leave the swarm right away, whatever they are.
+	announce(1, 0, event.Stopped)
+	require.Equal(t, 0, ps.NumSeeders(hash))
+	require.Equal(t, 1, ps.NumLeechers(hash))
+	announce(2, 10, event.Stopped)
+	require.Equal(t, 0, ps.NumLeechers(hash))
+
+	// Peers that are not in the swarm can stop, too.
+	announce(2, 10, event.Stopped)
+	announce(3, 10, event.Stopped)
+	require.Equal(t, 0, ps.NumSeeders(hash)+ps.NumLeechers(hash))
+}
+
+func TestPeerState(t *testing.T) {
+	ps := withStore(t)
+	hash := chihaya.InfoHash{1}
+	peer := chihaya.Peer{ID: chihaya.PeerID{1}, IP: net.IPv4(203, 0, 113, 1).To4(), Port: 6881}
+	announce := func(uploaded, downloaded, left uint64, e event.Event) {
+		err := announceSwarmInteraction(func(*chihaya.TrackerConfig, *chihaya.AnnounceRequest, *chihaya.AnnounceResponse) error {
+			return nil
+		})(&chihaya.TrackerConfig{}, &chihaya.AnnounceRequest{
+			Event:      e,
+			InfoHash:   hash,
+			PeerID:     peer.ID,
+			IPv4:       peer.IP,
+			Port:       peer.Port,
+			Uploaded:   uploaded,
+			Downloaded: downloaded,
+			Left:       left,
+		}, &chihaya.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+	states := ps.(store.PeerStateStore)
+
+	announce(0, 0, 1000, event.Started)
+	announce(100, 600, 400, event.None)
+	announce(250, 1000, 0, event.Completed)
+
+	state, err := states.GetPeerState(hash, peer)
+	require.Nil(t, err)
+	require.Equal(t, uint64(250), state.Uploaded)
+	require.Equal(t, uint64(1000), state.Downloaded)
+	require.Equal(t, uint64(0), state.Left)
+
+	announce(300, 1000, 0, event.Stopped)
+	_, err = states.GetPeerState(hash, peer)
+	require.Equal(t, store.ErrResourceDoesNotExist, err)
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// p2bMagic starts every P2B file, followed by its version.
+var p2bMagic = []byte{0xff, 0xff, 0xff, 0xff, 'P', '2', 'B'}
+
+// gzipMagic starts gzipped files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// LoadP2B adds the IPv4 ranges of a PeerGuardian P2B blocklist of version 1,
+// 2 or 3 to an IPStore through AddIPRange, and returns the number of ranges
+// it added. The labels of the ranges are skipped. Gzipped files are
+// decompressed.
+//
+// Corrupt and truncated files fail with an error naming the offset in the
+// uncompressed file at which they are broken. The ranges added before are
+// not removed.
+func LoadP2B(ips IPStore, r io.Reader) (ranges int, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, fmt.Errorf("store: invalid gzipped P2B file: %s", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	p := &p2bReader{r: br}
+	header := p.read(len(p2bMagic) + 1)
+	if p.err != nil {
+		return 0, p.err
+	}
+	if !bytes.Equal(header[:len(p2bMagic)], p2bMagic) {
+		return 0, p.fail(0, "not a P2B file")
+	}
+
+	add := func(offset int64, start, end net.IP) error {
+		if binary.BigEndian.Uint32(start) > binary.BigEndian.Uint32(end) {
+			return p.fail(offset, "start of range is after its end")
+		}
+		err := ips.AddIPRange(start, end)
+		if err != nil {
+			return err
+		}
+		ranges++
+		return nil
+	}
+
+	switch version := header[len(p2bMagic)]; version {
+	case 1, 2:
+		// Every range is a NUL-terminated label followed by its start and
+		// end.
+		for {
+			offset := p.offset
+			if _, err := p.r.Peek(1); err == io.EOF {
+				return ranges, nil
+			}
+			p.label()
+			start, end := p.ip(), p.ip()
+			if p.err != nil {
+				return ranges, p.err
+			}
+			if err := add(offset, start, end); err != nil {
+				return ranges, err
+			}
+		}
+
+	case 3:
+		// The labels come first, then the ranges refer to them by index.
+		labels := p.uint32()
+		for i := uint32(0); i < labels && p.err == nil; i++ {
+			p.label()
+		}
+		count := p.uint32()
+		for i := uint32(0); i < count && p.err == nil; i++ {
+			offset := p.offset
+			label, start, end := p.uint32(), p.ip(), p.ip()
+			if p.err != nil {
+				break
+			}
+			if label >= labels {
+				return ranges, p.fail(offset, fmt.Sprintf("label %d of range does not exist", label))
+			}
+			if err := add(offset, start, end); err != nil {
+				return ranges, err
+			}
+		}
+		if p.err != nil {
+			return ranges, p.err
+		}
+		if _, err := p.r.Peek(1); err != io.EOF {
+			return ranges, p.fail(p.offset, "trailing data after the last range")
+		}
+		return ranges, nil
+
+	default:
+		return 0, p.fail(int64(len(p2bMagic)), fmt.Sprintf("unsupported version %d", version))
+	}
+}
+
+// p2bReader reads the fields of a P2B file and keeps track of its offset.
+// Once reading fails, err is set and all further reads are no-ops.
+type p2bReader struct {
+	r      *bufio.Reader
+	offset int64
+	err    error
+}
+
+// fail returns an error about the P2B file at offset.
+func (p *p2bReader) fail(offset int64, msg string) error {
+	return fmt.Errorf("store: invalid P2B file at byte %d: %s", offset, msg)
+}
+
+func (p *p2bReader) read(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+
+	b := make([]byte, n)
+	read, err := io.ReadFull(p.r, b)
+	p.offset += int64(read)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		p.err = p.fail(p.offset, "unexpected end of file")
+	} else if err != nil {
+		p.err = p.fail(p.offset, err.Error())
+	}
+	return b
+}
+
+func (p *p2bReader) uint32() uint32 {
+	b := p.read(4)
+	if p.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (p *p2bReader) ip() net.IP {
+	b := p.read(net.IPv4len)
+	if p.err != nil {
+		return nil
+	}
+	return net.IP(b)
+}
+
+// label skips a NUL-terminated label.
+func (p *p2bReader) label() {
+	if p.err != nil {
+		return
+	}
+
+	b, err := p.r.ReadBytes(0)
+	p.offset += int64(len(b))
+	if err == io.EOF {
+		p.err = p.fail(p.offset, "unexpected end of file in label")
+	} else if err != nil {
+		p.err = p.fail(p.offset, err.Error())
+	}
+}
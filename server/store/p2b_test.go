@@ -0,0 +1,154 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+	_ "github.com/chihaya/chihaya/server/store/memory"
+)
+
+// p2bRange is a range of the hand-crafted P2B files of the tests.
+type p2bRange struct {
+	label      string
+	start, end string
+}
+
+var p2bRanges = []p2bRange{
+	{"Some Org - Hosting", "1.2.3.0", "1.2.7.255"},
+	{"Bogon", "10.0.0.0", "10.0.0.255"},
+	{"Some Org - Hosting", "192.168.22.22", "192.168.22.22"},
+}
+
+func p2bIP(s string) []byte {
+	return net.ParseIP(s).To4()
+}
+
+// p2bFile returns a P2B file of version with ranges.
+func p2bFile(version byte, ranges []p2bRange) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xff, 0xff, 0xff, 'P', '2', 'B', version})
+
+	if version < 3 {
+		for _, r := range ranges {
+			b.WriteString(r.label)
+			b.WriteByte(0)
+			b.Write(p2bIP(r.start))
+			b.Write(p2bIP(r.end))
+		}
+		return b.Bytes()
+	}
+
+	var labels []string
+	index := make(map[string]uint32)
+	for _, r := range ranges {
+		if _, ok := index[r.label]; !ok {
+			index[r.label] = uint32(len(labels))
+			labels = append(labels, r.label)
+		}
+	}
+	binary.Write(&b, binary.BigEndian, uint32(len(labels)))
+	for _, label := range labels {
+		b.WriteString(label)
+		b.WriteByte(0)
+	}
+	binary.Write(&b, binary.BigEndian, uint32(len(ranges)))
+	for _, r := range ranges {
+		binary.Write(&b, binary.BigEndian, index[r.label])
+		b.Write(p2bIP(r.start))
+		b.Write(p2bIP(r.end))
+	}
+	return b.Bytes()
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func loadP2B(t *testing.T, file []byte) (store.IPStore, int, error) {
+	ips, err := store.OpenIPStore(&store.DriverConfig{Name: "memory"})
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Nil(t, <-ips.Stop()) })
+
+	ranges, err := store.LoadP2B(ips, bytes.NewReader(file))
+	return ips, ranges, err
+}
+
+func TestLoadP2B(t *testing.T) {
+	expected := []string{"1.2.3.0/24", "1.2.4.0/22", "10.0.0.0/24", "192.168.22.22/32"}
+
+	for _, version := range []byte{1, 2, 3} {
+		for _, file := range [][]byte{p2bFile(version, p2bRanges), gzipped(p2bFile(version, p2bRanges))} {
+			ips, ranges, err := loadP2B(t, file)
+			require.Nil(t, err, "version %d", version)
+			require.Equal(t, len(p2bRanges), ranges)
+			require.Equal(t, expected, storeContents(t, ips))
+		}
+
+		// Empty lists are valid.
+		ips, ranges, err := loadP2B(t, p2bFile(version, nil))
+		require.Nil(t, err)
+		require.Equal(t, 0, ranges)
+		require.Equal(t, 0, len(storeContents(t, ips)))
+	}
+}
+
+func TestLoadP2BInvalid(t *testing.T) {
+	v2 := p2bFile(2, p2bRanges)
+	v3 := p2bFile(3, p2bRanges)
+
+	// The last range of version 3 refers to a label that does not exist.
+	badLabel := append([]byte(nil), v3...)
+	binary.BigEndian.PutUint32(badLabel[len(badLabel)-12:], 7)
+
+	// The last range ends before it starts.
+	reversed := p2bFile(2, []p2bRange{{"Reversed", "10.0.0.255", "10.0.0.0"}})
+
+	var table = []struct {
+		file     []byte
+		expected string
+	}{
+		{nil, "store: invalid P2B file at byte 0: unexpected end of file"},
+		{[]byte("1.2.3.4-1.2.3.5\n"), "store: invalid P2B file at byte 0: not a P2B file"},
+		{p2bFile(4, nil), "store: invalid P2B file at byte 7: unsupported version 4"},
+		{v2[:len(v2)-3], "store: invalid P2B file at byte 73: unexpected end of file"},
+		{v2[:len(v2)-12], "store: invalid P2B file at byte 64: unexpected end of file in label"},
+		{v3[:len(v3)-1], "store: invalid P2B file at byte 76: unexpected end of file"},
+		{v3[:14], "store: invalid P2B file at byte 14: unexpected end of file in label"},
+		{append(append([]byte(nil), v3...), 0), "store: invalid P2B file at byte 77: trailing data after the last range"},
+		{badLabel, "store: invalid P2B file at byte 65: label 7 of range does not exist"},
+		{reversed, "store: invalid P2B file at byte 8: start of range is after its end"},
+	}
+
+	for _, tt := range table {
+		_, _, err := loadP2B(t, tt.file)
+		require.NotNil(t, err, tt.expected)
+		require.Equal(t, tt.expected, err.Error())
+	}
+
+	// How much of a truncated gzipped file can be decompressed depends on
+	// the compressor.
+	_, _, err := loadP2B(t, gzipped(v2)[:20])
+	require.NotNil(t, err)
+	require.True(t, strings.HasSuffix(err.Error(), ": unexpected end of file"), err.Error())
+
+	// The ranges before the corruption are kept.
+	ips, ranges, err := loadP2B(t, v2[:len(v2)-3])
+	require.NotNil(t, err)
+	require.Equal(t, 2, ranges)
+	require.Equal(t, []string{"1.2.3.0/24", "1.2.4.0/22", "10.0.0.0/24"}, storeContents(t, ips))
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya"
+)
+
+// PeerEventType is the kind of change of a swarm a PeerEvent describes.
+type PeerEventType uint8
+
+const (
+	// PeerJoined is the type of events of peers that were added to a swarm.
+	PeerJoined PeerEventType = iota + 1
+
+	// PeerCompleted is the type of events of leechers that became seeders.
+	PeerCompleted
+
+	// PeerLeft is the type of events of peers that were removed from a
+	// swarm, because they stopped or because they were garbage collected.
+	PeerLeft
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "join"
+	case PeerCompleted:
+		return "complete"
+	case PeerLeft:
+		return "leave"
+	}
+	return "unknown"
+}
+
+// PeerEvent describes a change of a swarm.
+type PeerEvent struct {
+	Type     PeerEventType
+	InfoHash chihaya.InfoHash
+	Peer     chihaya.Peer
+
+	// Seeder is true if the peer is a seeder after a PeerJoined or
+	// PeerCompleted event, or was a seeder before a PeerLeft event.
+	Seeder bool
+}
+
+// PeerEventFeed delivers PeerEvents to any number of subscribers. It can be
+// embedded by PeerStore drivers to implement Subscribe.
+//
+// Publishing never blocks: every subscriber has a buffer of events, and
+// events that do not fit into the buffer of a subscriber are dropped for that
+// subscriber and counted.
+type PeerEventFeed struct {
+	bufferSize int
+	dropped    uint64 // accessed atomically
+
+	mu     sync.RWMutex
+	subs   map[chan PeerEvent]struct{}
+	closed bool
+}
+
+// NewPeerEventFeed returns a PeerEventFeed that buffers up to bufferSize
+// events per subscriber.
+func NewPeerEventFeed(bufferSize int) *PeerEventFeed {
+	return &PeerEventFeed{
+		bufferSize: bufferSize,
+		subs:       make(map[chan PeerEvent]struct{}),
+	}
+}
+
+// Subscribe returns a channel that receives all events published from now
+// on, and a function that cancels the subscription and closes the channel.
+//
+// The channel is also closed when the feed is closed.
+func (f *PeerEventFeed) Subscribe() (<-chan PeerEvent, func()) {
+	ch := make(chan PeerEvent, f.bufferSize)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	f.subs[ch] = struct{}{}
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish delivers an event to all subscribers that have room for it in
+// their buffers.
+func (f *PeerEventFeed) Publish(e PeerEvent) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&f.dropped, 1)
+		}
+	}
+}
+
+// DroppedPeerEvents returns the number of events that were dropped because a
+// subscriber was not receiving them fast enough.
+func (f *PeerEventFeed) DroppedPeerEvents() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// Close closes the channels of all subscribers. Subscriptions made after
+// Close receive a closed channel.
+func (f *PeerEventFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+
+	for ch := range f.subs {
+		close(ch)
+	}
+	f.subs = nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya"
+)
+
+// PeerStateStore is implemented by PeerStores that keep the state of their
+// peers across announces, e.g. for ratio enforcement.
+//
+// The state of a peer is deleted along with the peer, and it is kept when a
+// peer that announced a Key moves to another address or port.
+type PeerStateStore interface {
+	// UpdatePeerState updates the state of p in the swarm of infoHash with
+	// the counts p reported by an announce. The state is created by the
+	// first update of a peer.
+	//
+	// Returns ErrResourceDoesNotExist if p is not in the swarm.
+	UpdatePeerState(infoHash chihaya.InfoHash, p chihaya.Peer, uploaded, downloaded, left uint64) error
+
+	// GetPeerState returns the state of p in the swarm of infoHash.
+	//
+	// Returns ErrResourceDoesNotExist if p is not in the swarm or its state
+	// was never updated.
+	GetPeerState(infoHash chihaya.InfoHash, p chihaya.Peer) (PeerState, error)
+}
+
+// PeerState is the state of a peer across its announces to a swarm.
+//
+// The counts are the ones clients report, which are not verified: clients can
+// report any counts they like. In particular, Uploaded and Downloaded are the
+// raw sums of the increases of the counts between announces.
+type PeerState struct {
+	// FirstSeen is the time of the first announce of the peer.
+	FirstSeen time.Time
+
+	// Uploaded and Downloaded are the numbers of bytes the peer reported
+	// to have transferred since its first announce.
+	Uploaded   uint64
+	Downloaded uint64
+
+	// Left is the number of bytes the peer reported to have left by its
+	// last announce.
+	Left uint64
+
+	// MaxUploaded and MaxDownloaded are the highest counts the peer
+	// reported, which the next increases are taken from.
+	MaxUploaded   uint64
+	MaxDownloaded uint64
+}
+
+// Update returns the state of a peer that announced the given counts at now,
+// whose previous state is s. A zero s is the state of a peer that did not
+// announce before, whose counts are only taken as the baseline of the next
+// ones, because they may have been reported to another tracker before.
+//
+// Counts below the highest count reported before add nothing. Clients that
+// restart a download without announcing stopped start counting from zero
+// again, but honoring that would let clients inflate their counts by
+// alternately reporting a low and a high count.
+func (s PeerState) Update(uploaded, downloaded, left uint64, now time.Time) PeerState {
+	if s.FirstSeen.IsZero() {
+		return PeerState{
+			FirstSeen:     now,
+			Left:          left,
+			MaxUploaded:   uploaded,
+			MaxDownloaded: downloaded,
+		}
+	}
+
+	s.Uploaded += increase(&s.MaxUploaded, uploaded)
+	s.Downloaded += increase(&s.MaxDownloaded, downloaded)
+	s.Left = left
+	return s
+}
+
+// increase returns by how much reported exceeds max, and raises max to it.
+func increase(max *uint64, reported uint64) uint64 {
+	if reported <= *max {
+		return 0
+	}
+	delta := reported - *max
+	*max = reported
+	return delta
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerStateUpdate(t *testing.T) {
+	first := time.Unix(1000000, 0)
+
+	// The counts of the first announce are the baseline.
+	s := PeerState{}.Update(100, 50, 1000, first)
+	require.Equal(t, PeerState{FirstSeen: first, Left: 1000, MaxUploaded: 100, MaxDownloaded: 50}, s)
+
+	s = s.Update(300, 450, 600, first.Add(time.Minute))
+	require.Equal(t, first, s.FirstSeen)
+	require.Equal(t, uint64(200), s.Uploaded)
+	require.Equal(t, uint64(400), s.Downloaded)
+	require.Equal(t, uint64(600), s.Left)
+
+	// Counts that went down add nothing, until they exceed the highest
+	// count again.
+	s = s.Update(20, 450, 500, first.Add(2*time.Minute))
+	require.Equal(t, uint64(200), s.Uploaded)
+	require.Equal(t, uint64(500), s.Left)
+	s = s.Update(320, 450, 500, first.Add(3*time.Minute))
+	require.Equal(t, uint64(220), s.Uploaded)
+
+	// Alternating counts do not inflate the sums.
+	for i := 0; i < 10; i++ {
+		s = s.Update(0, 0, 500, first.Add(4*time.Minute))
+		s = s.Update(320, 450, 500, first.Add(4*time.Minute))
+	}
+	require.Equal(t, uint64(220), s.Uploaded)
+	require.Equal(t, uint64(400), s.Downloaded)
+}
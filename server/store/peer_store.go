@@ -6,17 +6,52 @@ package store
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chihaya/chihaya"
 	"github.com/chihaya/chihaya/pkg/stopper"
 )
 
-var peerStoreDrivers = make(map[string]PeerStoreDriver)
+var (
+	peerStoreDriversMu sync.RWMutex
+	peerStoreDrivers   = make(map[string]PeerStoreDriver)
+)
+
+// FamilyPolicy determines how the address families of announcers and the
+// peers returned to them are matched.
+type FamilyPolicy uint8
+
+const (
+	// SameFamily returns IPv4 peers to the IPv4 address of an announcer and
+	// IPv6 peers to its IPv6 address, independently of each other.
+	SameFamily FamilyPolicy = iota
+
+	// BridgeFamilies treats an announcer as dual-stacked if it announced
+	// both of its addresses, or if its peer ID is in the swarm under the
+	// address family it did not announce. Dual-stacked announcers get both
+	// addresses of the dual-stacked peers returned to them, so that they
+	// can reach each other over either family.
+	//
+	// Peers are never returned under an address family the announcer is not
+	// known to have.
+	BridgeFamilies
+)
 
 // PeerStore represents an interface for manipulating peers.
+//
+// Peers are identified by their address, unless they announced a Key. Within
+// an address family, a peer that announces the Key of a stored peer replaces
+// it, even if its address, port or peer ID changed, so that peers behind NAT
+// do not leave ghosts behind when their mapping changes. Deletes find the
+// peer of the Key, too. Keys are never returned with peers.
 type PeerStore interface {
 	// PutSeeder adds a seeder for the infoHash to the PeerStore.
+	//
+	// If the peer is already a seeder, only the time of its last announce is
+	// updated. If it is a leecher, it is moved to the seeders in one atomic
+	// operation, without counting a completed download.
 	PutSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error
 	// DeleteSeeder removes a seeder for the infoHash from the PeerStore.
 	//
@@ -25,6 +60,10 @@ type PeerStore interface {
 	DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error
 
 	// PutLeecher adds a leecher for the infoHash to the PeerStore.
+	//
+	// If the peer is already a leecher, only the time of its last announce
+	// is updated. If it is a seeder, it is moved to the leechers in one
+	// atomic operation.
 	PutLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error
 	// DeleteLeecher removes a leecher for the infoHash from the PeerStore.
 	//
@@ -36,19 +75,28 @@ type PeerStore interface {
 	// infoHash within the PeerStore.
 	//
 	// If the given Peer is not a leecher, it will still be added to the
-	// list of seeders and no error will be returned.
+	// list of seeders, or have the time of its last announce updated if it
+	// already is a seeder, and no error will be returned.
+	// If it is a leecher, the download is counted as completed, but only
+	// once per peer ID while the peer stays in the swarm, so that repeated
+	// completions and dual-stacked peers are not counted again.
 	GraduateLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error
 
 	// AnnouncePeers returns a list of both IPv4, and IPv6 peers for an
 	// announce.
 	//
 	// If seeder is true then the peers returned will only be leechers, the
-	// ammount of leechers returned will be the smaller value of numWant or
+	// amount of leechers returned will be the smaller value of numWant or
 	// the available leechers.
 	// If it is false then seeders will be returned up until numWant or the
 	// available seeders, whichever is smaller. If the available seeders is
 	// less than numWant then peers are returned until numWant or they run out.
-	AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer) (peers, peers6 []chihaya.Peer, err error)
+	//
+	// IPv4 peers are only returned if peer4 has an IP, and IPv6 peers only
+	// if peer6 has one, unless policy bridges address families. numWant
+	// applies to each address family separately. peer4 and peer6 are never
+	// returned themselves.
+	AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy FamilyPolicy) (peers, peers6 []chihaya.Peer, err error)
 	// CollectGarbage deletes peers from the peerStore which are older than the
 	// cutoff time.
 	CollectGarbage(cutoff time.Time) error
@@ -63,6 +111,33 @@ type PeerStore interface {
 	// NumLeechers gets the amount of leechers for a particular infoHash.
 	NumLeechers(infoHash chihaya.InfoHash) int
 
+	// IncrementDownloaded increments the number of completed downloads of
+	// the infoHash.
+	IncrementDownloaded(infoHash chihaya.InfoHash) error
+	// GetStats gets the amounts of seeders and leechers of a particular
+	// infoHash and the number of its completed downloads.
+	//
+	// The number of completed downloads is not reset when the swarm of the
+	// infoHash empties. Drivers that persist their data should persist it,
+	// too.
+	GetStats(infoHash chihaya.InfoHash) (seeders, leechers, downloaded uint64, err error)
+
+	// NumSwarms returns the number of infoHashes that have at least one
+	// peer.
+	NumSwarms() (uint64, error)
+	// NumTotalSeeders returns the amount of seeders across all infoHashes.
+	NumTotalSeeders() (uint64, error)
+	// NumTotalLeechers returns the amount of leechers across all
+	// infoHashes.
+	NumTotalLeechers() (uint64, error)
+
+	// Subscribe returns a channel of the PeerEvents of all swarms and a
+	// function that cancels the subscription and closes the channel.
+	//
+	// Events are never waited for: if the channel's buffer is full, events
+	// are dropped. The channel is closed when the PeerStore is stopped.
+	Subscribe() (<-chan PeerEvent, func())
+
 	// Stopper provides the Stop method that stops the PeerStore.
 	// Stop should shut down the PeerStore in a separate goroutine and send
 	// an error to the channel if the shutdown failed. If the shutdown
@@ -82,11 +157,14 @@ type PeerStoreDriver interface {
 // it panics.
 func RegisterPeerStoreDriver(name string, driver PeerStoreDriver) {
 	if driver == nil {
-		panic("storage: could not register nil PeerStoreDriver")
+		panic("store: could not register nil PeerStoreDriver")
 	}
 
+	peerStoreDriversMu.Lock()
+	defer peerStoreDriversMu.Unlock()
+
 	if _, dup := peerStoreDrivers[name]; dup {
-		panic("storage: could not register duplicate PeerStoreDriver: " + name)
+		panic("store: could not register duplicate PeerStoreDriver: " + name)
 	}
 
 	peerStoreDrivers[name] = driver
@@ -94,10 +172,21 @@ func RegisterPeerStoreDriver(name string, driver PeerStoreDriver) {
 
 // OpenPeerStore returns a PeerStore specified by a configuration.
 func OpenPeerStore(cfg *DriverConfig) (PeerStore, error) {
+	peerStoreDriversMu.RLock()
 	driver, ok := peerStoreDrivers[cfg.Name]
+	peerStoreDriversMu.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("storage: unknown PeerStoreDriver %q (forgotten import?)", cfg)
+		return nil, fmt.Errorf("store: unknown PeerStoreDriver %q (forgotten import?), registered: %s", cfg.Name, strings.Join(RegisteredPeerStoreDrivers(), ", "))
 	}
 
 	return driver.New(cfg)
 }
+
+// RegisteredPeerStoreDrivers returns the sorted names of the registered
+// PeerStoreDrivers.
+func RegisteredPeerStoreDrivers() []string {
+	peerStoreDriversMu.RLock()
+	defer peerStoreDriversMu.RUnlock()
+
+	return sortedNames(peerStoreDrivers)
+}
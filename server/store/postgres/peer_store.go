@@ -0,0 +1,935 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package postgres implements a PeerStore driver backed by PostgreSQL, which
+// keeps the swarms across restarts and allows multiple chihaya instances to
+// share them.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// Register the "postgres" database/sql driver.
+	_ "github.com/lib/pq"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	store.RegisterPeerStoreDriver("postgres", &peerStoreDriver{})
+}
+
+// gcBatchSize is the largest number of peers deleted by a single statement
+// of the garbage collection, so that it does not hold the locks of many rows
+// at once.
+const gcBatchSize = 1000
+
+// defaultEventBuffer is the number of PeerEvents buffered per subscriber if
+// none is configured.
+const defaultEventBuffer = 1024
+
+// Peers are stored under the family of their address.
+const (
+	familyIPv4 = 4
+	familyIPv6 = 6
+)
+
+type peerStoreDriver struct{}
+
+func (d *peerStoreDriver) New(storecfg *store.DriverConfig) (store.PeerStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newPeerStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	// Make sure the database is reachable, so that a misconfigured DSN is
+	// reported right away, and that the schema is up to date.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	err = db.PingContext(ctx)
+	if err == nil {
+		err = migrate(ctx, db, cfg.Prefix)
+	}
+	if err != nil {
+		db.Close()
+		return nil, errors.New("postgres: unable to open PeerStore: " + err.Error())
+	}
+
+	s := &peerStore{
+		PeerEventFeed: store.NewPeerEventFeed(cfg.EventBuffer),
+		db:            db,
+		prefix:        cfg.Prefix,
+		timeout:       cfg.Timeout,
+		peerLifetime:  cfg.PeerLifetime,
+		strictCrypto:  cfg.RequireCrypto == strictCrypto,
+		closed:        make(chan struct{}),
+		reaped:        make(chan struct{}),
+		clock:         storecfg.ClockOrReal(),
+	}
+	go s.reap(cfg.ReapInterval)
+
+	return s, nil
+}
+
+type peerStoreConfig struct {
+	// DSN is the connection string of the database, either as a URL or as
+	// key=value pairs.
+	DSN string `yaml:"dsn"`
+
+	// Prefix is prepended to the names of the tables, so that multiple
+	// stores can share a database.
+	Prefix string `yaml:"prefix"`
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the pool of
+	// connections to the database.
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	// Timeout is the time a single operation may take.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// PeerLifetime is the time after their last announce that peers are no
+	// longer returned to announces and are reaped.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+
+	// EventBuffer is the number of PeerEvents buffered per subscriber.
+	EventBuffer int `yaml:"event_buffer"`
+
+	// RequireCrypto is the way peers are selected for announcers that
+	// require encrypted connections, either preferCrypto or strictCrypto.
+	RequireCrypto string `yaml:"require_crypto"`
+}
+
+const (
+	// preferCrypto returns the peers that support encrypted connections
+	// first to announcers that require them, and fills up with the others.
+	preferCrypto = "prefer"
+
+	// strictCrypto only returns the peers that support encrypted
+	// connections to announcers that require them.
+	strictCrypto = "strict"
+)
+
+// validPrefix matches the prefixes that can be used in table names without
+// quoting and leave room for the names of the tables and indexes.
+var validPrefix = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,31}$`)
+
+func newPeerStoreConfig(storecfg *store.DriverConfig) (*peerStoreConfig, error) {
+	bytes, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg peerStoreConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DSN == "" {
+		cfg.DSN = "postgres://localhost/chihaya?sslmode=disable"
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "chihaya_"
+	}
+	if !validPrefix.MatchString(cfg.Prefix) {
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: prefix %q must be at most 32 lowercase letters, digits and underscores, not starting with a digit", cfg.Prefix)
+	}
+	if cfg.MaxOpenConns < 0 {
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: max open conns must be positive, got %d", cfg.MaxOpenConns)
+	}
+	if cfg.MaxOpenConns == 0 {
+		cfg.MaxOpenConns = 16
+	}
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConns > cfg.MaxOpenConns {
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: max idle conns must be between 0 and %d, got %d", cfg.MaxOpenConns, cfg.MaxIdleConns)
+	}
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = cfg.MaxOpenConns
+	}
+	if cfg.ConnMaxLifetime < 0 {
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: conn max lifetime must be positive, got %s", cfg.ConnMaxLifetime)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.PeerLifetime <= 0 {
+		cfg.PeerLifetime = 30 * time.Minute
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	if cfg.EventBuffer < 0 {
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: event buffer must be positive, got %d", cfg.EventBuffer)
+	}
+	if cfg.EventBuffer == 0 {
+		cfg.EventBuffer = defaultEventBuffer
+	}
+	switch cfg.RequireCrypto {
+	case "":
+		cfg.RequireCrypto = preferCrypto
+	case preferCrypto, strictCrypto:
+	default:
+		return nil, fmt.Errorf("postgres: invalid PeerStore config: unknown require crypto mode %q", cfg.RequireCrypto)
+	}
+
+	return &cfg, nil
+}
+
+// peerStore implements store.PeerStore with a table of peers and a table of
+// the numbers of completed downloads.
+//
+// Peers are stored per infohash, peer ID and address family. A peer that
+// announces under a known peer ID replaces the address stored for it.
+//
+// Writes to a swarm are serialized by an advisory lock of its infohash, so
+// that the trackers sharing the tables agree on the events of its peers.
+// PeerEvents are only published to the subscribers of the store that made
+// the change, once it is committed.
+type peerStore struct {
+	*store.PeerEventFeed
+
+	db           *sql.DB
+	prefix       string
+	timeout      time.Duration
+	peerLifetime time.Duration
+
+	// strictCrypto is true if announcers that require encrypted
+	// connections only get the peers that support them.
+	strictCrypto bool
+
+	closed chan struct{}
+	reaped chan struct{}
+
+	// clock tells the time peers announce at and ticks the reaper.
+	clock clock.Clock
+}
+
+var (
+	_ store.PeerStore          = &peerStore{}
+	_ store.ContextPeerStore   = &peerStore{}
+	_ store.SwarmSizeWalker    = &peerStore{}
+	_ store.SwarmMemberChecker = &peerStore{}
+)
+
+// q returns query with the table names of the store.
+func (s *peerStore) q(query string) string {
+	return expand(query, s.prefix)
+}
+
+func (s *peerStore) checkClosed() {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+}
+
+// encodeIP returns the address family and the canonical form of ip, which
+// peers are stored with.
+func encodeIP(ip net.IP) (family int16, b []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return familyIPv4, ip4
+	}
+	return familyIPv6, ip.To16()
+}
+
+// swarmLock returns the key of the advisory lock of the swarm of infoHash.
+func swarmLock(infoHash chihaya.InfoHash) int64 {
+	return int64(binary.BigEndian.Uint64(infoHash[:8]))
+}
+
+// row is a stored peer.
+type row struct {
+	peer      chihaya.Peer
+	key       string
+	seeder    bool
+	completed bool
+}
+
+// update runs fn in a transaction that holds the lock of the swarm of
+// infoHash and publishes the events fn returns once the transaction is
+// committed.
+func (s *peerStore) update(infoHash chihaya.InfoHash, fn func(ctx context.Context, tx *sql.Tx) ([]store.PeerEvent, error)) error {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, swarmLock(infoHash))
+	if err != nil {
+		return err
+	}
+
+	events, err := fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		s.Publish(e)
+	}
+	return nil
+}
+
+// lookup returns the stored peers of the family of p that have either its
+// peer ID or its Key, locking them until tx ends.
+func (s *peerStore) lookup(ctx context.Context, tx *sql.Tx, infoHash chihaya.InfoHash, p chihaya.Peer) ([]row, error) {
+	family, _ := encodeIP(p.IP)
+	rows, err := tx.QueryContext(ctx, s.q(`
+		SELECT peer_id, ip, port, key, seeder, completed FROM {p}peers
+		WHERE info_hash = $1 AND family = $2 AND (peer_id = $3 OR key <> '' AND key = $4)
+		FOR UPDATE`), infoHash[:], family, p.ID[:], p.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []row
+	for rows.Next() {
+		var (
+			r      row
+			id, ip []byte
+			port   int
+		)
+		err = rows.Scan(&id, &ip, &port, &r.key, &r.seeder, &r.completed)
+		if err != nil {
+			return nil, err
+		}
+		r.peer = chihaya.Peer{ID: chihaya.PeerIDFromBytes(id), IP: net.IP(ip), Port: uint16(port)}
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
+
+// previous is the state of the stored peer an announce of a peer applies
+// to.
+type previous struct {
+	// found reports whether the peer is stored with its address.
+	found     bool
+	seeder    bool
+	completed bool
+
+	// replaced reports whether a stored peer with the Key or peer ID of
+	// the announcer but another address or peer ID was replaced, and
+	// replacedLeecher whether it was a leecher.
+	replaced        bool
+	replacedLeecher bool
+}
+
+// replace deletes the stored peers that the announce of p replaces, and
+// returns the previous state of p and the events of the replaced peers.
+//
+// Peers with the Key of p but another peer ID are deleted. The stored peer
+// with the peer ID of p is only kept if its address did not change, but its
+// completed download is kept in any case.
+func (s *peerStore) replace(ctx context.Context, tx *sql.Tx, infoHash chihaya.InfoHash, p chihaya.Peer) (prev previous, events []store.PeerEvent, err error) {
+	found, err := s.lookup(ctx, tx, infoHash, p)
+	if err != nil {
+		return previous{}, nil, err
+	}
+
+	family, _ := encodeIP(p.IP)
+	for _, r := range found {
+		if r.peer.ID == p.ID {
+			prev.completed = r.completed
+			if r.peer.EqualEndpoint(p) {
+				prev.found, prev.seeder = true, r.seeder
+				continue
+			}
+		} else {
+			_, err = tx.ExecContext(ctx, s.q(`DELETE FROM {p}peers WHERE info_hash = $1 AND peer_id = $2 AND family = $3`), infoHash[:], r.peer.ID[:], family)
+			if err != nil {
+				return previous{}, nil, err
+			}
+		}
+
+		prev.replaced = true
+		prev.replacedLeecher = prev.replacedLeecher || !r.seeder
+		events = append(events, store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: r.peer, Seeder: r.seeder})
+	}
+	return prev, events, nil
+}
+
+// upsert stores p as of now.
+func (s *peerStore) upsert(ctx context.Context, tx *sql.Tx, infoHash chihaya.InfoHash, p chihaya.Peer, seeder, completed bool) error {
+	family, ip := encodeIP(p.IP)
+	_, err := tx.ExecContext(ctx, s.q(`
+		INSERT INTO {p}peers (info_hash, peer_id, family, ip, port, key, seeder, completed, last_announce, crypto)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (info_hash, peer_id, family) DO UPDATE SET
+			ip = EXCLUDED.ip, port = EXCLUDED.port, key = EXCLUDED.key, seeder = EXCLUDED.seeder,
+			completed = EXCLUDED.completed, last_announce = EXCLUDED.last_announce, crypto = EXCLUDED.crypto`),
+		infoHash[:], p.ID[:], family, ip, int(p.Port), p.Key, seeder, completed, s.clock.Now(), p.Crypto.Supported())
+	return err
+}
+
+func (s *peerStore) PutSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	return s.putPeer(infoHash, p, true)
+}
+
+func (s *peerStore) PutLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	return s.putPeer(infoHash, p, false)
+}
+
+// putPeer adds p as a seeder or a leecher, or moves it if it is stored as
+// the other.
+func (s *peerStore) putPeer(infoHash chihaya.InfoHash, p chihaya.Peer, seeder bool) error {
+	return s.update(infoHash, func(ctx context.Context, tx *sql.Tx) ([]store.PeerEvent, error) {
+		prev, events, err := s.replace(ctx, tx, infoHash, p)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !prev.found:
+			events = append(events, store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: seeder})
+		case prev.seeder != seeder:
+			events = append(events,
+				store.PeerEvent{Type: store.PeerLeft, InfoHash: infoHash, Peer: p, Seeder: prev.seeder},
+				store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: seeder},
+			)
+		}
+
+		if !seeder && prev.found && prev.seeder {
+			// A seeder that leeches again may complete again, under
+			// either address family.
+			_, err = tx.ExecContext(ctx, s.q(`UPDATE {p}peers SET completed = false WHERE info_hash = $1 AND peer_id = $2`), infoHash[:], p.ID[:])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return events, s.upsert(ctx, tx, infoHash, p, seeder, seeder && prev.completed)
+	})
+}
+
+func (s *peerStore) GraduateLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	return s.update(infoHash, func(ctx context.Context, tx *sql.Tx) ([]store.PeerEvent, error) {
+		prev, events, err := s.replace(ctx, tx, infoHash, p)
+		if err != nil {
+			return nil, err
+		}
+
+		completed := prev.completed
+		switch {
+		case prev.found && prev.seeder:
+			return events, s.upsert(ctx, tx, infoHash, p, true, completed)
+		case prev.found:
+		case prev.replacedLeecher:
+			events = append(events, store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p})
+		default:
+			events = append(events, store.PeerEvent{Type: store.PeerJoined, InfoHash: infoHash, Peer: p, Seeder: true})
+			return events, s.upsert(ctx, tx, infoHash, p, true, completed)
+		}
+
+		// The leecher completed. Count it unless it did so under its
+		// other address family already.
+		err = tx.QueryRowContext(ctx, s.q(`SELECT EXISTS (SELECT 1 FROM {p}peers WHERE info_hash = $1 AND peer_id = $2 AND completed)`), infoHash[:], p.ID[:]).Scan(&completed)
+		if err != nil {
+			return nil, err
+		}
+		if !completed {
+			err = s.incrementDownloaded(ctx, tx, infoHash)
+			if err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, store.PeerEvent{Type: store.PeerCompleted, InfoHash: infoHash, Peer: p, Seeder: true})
+
+		return events, s.upsert(ctx, tx, infoHash, p, true, true)
+	})
+}
+
+func (s *peerStore) DeleteSeeder(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	return s.deletePeer(infoHash, p, true)
+}
+
+func (s *peerStore) DeleteLeecher(infoHash chihaya.InfoHash, p chihaya.Peer) error {
+	return s.deletePeer(infoHash, p, false)
+}
+
+// deletePeer deletes the seeder or leecher with the Key of p, or with its
+// peer ID and address if no peer has its Key.
+func (s *peerStore) deletePeer(infoHash chihaya.InfoHash, p chihaya.Peer, seeder bool) error {
+	return s.update(infoHash, func(ctx context.Context, tx *sql.Tx) ([]store.PeerEvent, error) {
+		found, err := s.lookup(ctx, tx, infoHash, p)
+		if err != nil {
+			return nil, err
+		}
+
+		var match *row
+		for i, r := range found {
+			if p.Key != "" && r.key == p.Key {
+				match = &found[i]
+				break
+			}
+			if r.peer.Equal(p) {
+				match = &found[i]
+			}
+		}
+		if match == nil || match.seeder != seeder {
+			return nil, store.ErrResourceDoesNotExist
+		}
+
+		family, _ := encodeIP(p.IP)
+		_, err = tx.ExecContext(ctx, s.q(`DELETE FROM {p}peers WHERE info_hash = $1 AND peer_id = $2 AND family = $3`), infoHash[:], match.peer.ID[:], family)
+		if err != nil {
+			return nil, err
+		}
+		return []store.PeerEvent{{Type: store.PeerLeft, InfoHash: infoHash, Peer: match.peer, Seeder: seeder}}, nil
+	})
+}
+
+func (s *peerStore) incrementDownloaded(ctx context.Context, tx *sql.Tx, infoHash chihaya.InfoHash) error {
+	_, err := tx.ExecContext(ctx, s.q(`
+		INSERT INTO {p}downloads (info_hash, downloaded) VALUES ($1, 1)
+		ON CONFLICT (info_hash) DO UPDATE SET downloaded = {p}downloads.downloaded + 1`), infoHash[:])
+	return err
+}
+
+func (s *peerStore) IncrementDownloaded(infoHash chihaya.InfoHash) error {
+	return s.update(infoHash, func(ctx context.Context, tx *sql.Tx) ([]store.PeerEvent, error) {
+		return nil, s.incrementDownloaded(ctx, tx, infoHash)
+	})
+}
+
+func (s *peerStore) CollectGarbage(cutoff time.Time) error {
+	s.checkClosed()
+
+	log.Debug("postgres: collecting garbage", "cutoff", cutoff)
+	return s.collectGarbage(cutoff)
+}
+
+// collectGarbage deletes the peers that last announced at or before cutoff,
+// in batches of gcBatchSize.
+func (s *peerStore) collectGarbage(cutoff time.Time) error {
+	for {
+		n, err := s.collectBatch(cutoff)
+		if err != nil {
+			return err
+		}
+		if n < gcBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *peerStore) collectBatch(cutoff time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.q(`
+		DELETE FROM {p}peers WHERE (info_hash, peer_id, family) IN (
+			SELECT info_hash, peer_id, family FROM {p}peers WHERE last_announce <= $1 LIMIT $2
+		) RETURNING info_hash, peer_id, ip, port, seeder`), cutoff, gcBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var events []store.PeerEvent
+	for rows.Next() {
+		var (
+			infoHash, id, ip []byte
+			port             int
+			seeder           bool
+		)
+		err = rows.Scan(&infoHash, &id, &ip, &port, &seeder)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, store.PeerEvent{
+			Type:     store.PeerLeft,
+			InfoHash: chihaya.InfoHashFromBytes(infoHash),
+			Peer:     chihaya.Peer{ID: chihaya.PeerIDFromBytes(id), IP: net.IP(ip), Port: uint16(port)},
+			Seeder:   seeder,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range events {
+		s.Publish(e)
+	}
+	return len(events), nil
+}
+
+func (s *peerStore) reap(interval time.Duration) {
+	defer close(s.reaped)
+
+	t := s.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C():
+			err := s.collectGarbage(s.clock.Now().Add(-s.peerLifetime))
+			if err != nil {
+				log.Warn("postgres: failed to collect garbage", "err", err)
+			}
+		}
+	}
+}
+
+func (s *peerStore) AnnouncePeers(infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	return s.AnnouncePeersContext(context.Background(), infoHash, seeder, numWant, peer4, peer6, policy)
+}
+
+// AnnouncePeersContext cancels the queries of the peers once ctx is done.
+//
+// Only peers that announced within the peer lifetime are returned, even if
+// they were not reaped yet.
+func (s *peerStore) AnnouncePeersContext(ctx context.Context, infoHash chihaya.InfoHash, seeder bool, numWant int, peer4, peer6 chihaya.Peer, policy store.FamilyPolicy) (peers, peers6 []chihaya.Peer, err error) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if policy == store.BridgeFamilies {
+		// Complete the address families of a dual-stacked announcer that
+		// only announced one of them.
+		if peer4.IP == nil && peer6.IP != nil {
+			peer4, err = s.find(ctx, infoHash, peer6.ID, familyIPv4)
+			peer4.Crypto = peer6.Crypto
+		} else if peer6.IP == nil && peer4.IP != nil {
+			peer6, err = s.find(ctx, infoHash, peer4.ID, familyIPv6)
+			peer6.Crypto = peer4.Crypto
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if peer4.IP != nil {
+		peers, err = s.selectPeers(ctx, infoHash, seeder, numWant, peer4, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if peer6.IP != nil {
+		// The IPv6 addresses of the returned IPv4 peers come first for
+		// bridged announcers, so that they learn both addresses of the
+		// peers that are dual-stacked, too.
+		var prefer []chihaya.Peer
+		if policy == store.BridgeFamilies && peer4.IP != nil {
+			prefer = peers
+		}
+		peers6, err = s.selectPeers(ctx, infoHash, seeder, numWant, peer6, prefer)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(peers) == 0 && len(peers6) == 0 {
+		var exists bool
+		err = s.db.QueryRowContext(ctx, s.q(`SELECT EXISTS (SELECT 1 FROM {p}peers WHERE info_hash = $1)`), infoHash[:]).Scan(&exists)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, store.ErrResourceDoesNotExist
+		}
+	}
+	return peers, peers6, nil
+}
+
+// find returns the peer with the peer ID id of the family of the swarm of
+// infoHash, or an empty Peer if there is none.
+func (s *peerStore) find(ctx context.Context, infoHash chihaya.InfoHash, id chihaya.PeerID, family int16) (chihaya.Peer, error) {
+	var (
+		ip   []byte
+		port int
+	)
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT ip, port FROM {p}peers WHERE info_hash = $1 AND peer_id = $2 AND family = $3`), infoHash[:], id[:], family).Scan(&ip, &port)
+	if err == sql.ErrNoRows {
+		return chihaya.Peer{}, nil
+	}
+	if err != nil {
+		return chihaya.Peer{}, err
+	}
+	return chihaya.Peer{ID: id, IP: net.IP(ip), Port: uint16(port)}, nil
+}
+
+// selectPeers returns up to numWant random peers of the family of announcer
+// for its announce: leechers if it is a seeder, seeders first otherwise.
+// Peers with the peer IDs of the peers in prefer are returned first, then the
+// peers that support encrypted connections if announcer requires them.
+func (s *peerStore) selectPeers(ctx context.Context, infoHash chihaya.InfoHash, seeder bool, numWant int, announcer chihaya.Peer, prefer []chihaya.Peer) ([]chihaya.Peer, error) {
+	family, ip := encodeIP(announcer.IP)
+	args := []interface{}{infoHash[:], family, s.clock.Now().Add(-s.peerLifetime), announcer.ID[:], ip, int(announcer.Port), seeder, numWant}
+
+	order, filter := "seeder DESC, random()", ""
+	if announcer.Crypto == chihaya.CryptoRequired {
+		if s.strictCrypto {
+			filter = " AND crypto"
+		} else {
+			order = "crypto DESC, " + order
+		}
+	}
+	if len(prefer) > 0 {
+		placeholders := make([]string, len(prefer))
+		for i, p := range prefer {
+			args = append(args, p.ID[:])
+			placeholders[i] = "$" + strconv.Itoa(len(args))
+		}
+		order = "peer_id IN (" + strings.Join(placeholders, ", ") + ") DESC, " + order
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.q(`
+		SELECT peer_id, ip, port, crypto FROM {p}peers
+		WHERE info_hash = $1 AND family = $2 AND last_announce > $3
+			AND NOT (peer_id = $4 AND ip = $5 AND port = $6) AND NOT ($7 AND seeder)`+filter+`
+		ORDER BY `+order+`
+		LIMIT $8`), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanPeers(rows)
+}
+
+// scanPeers returns the peers of rows, which must consist of their peer IDs,
+// IPs, ports and crypto support, and closes rows.
+func scanPeers(rows *sql.Rows) ([]chihaya.Peer, error) {
+	defer rows.Close()
+
+	var peers []chihaya.Peer
+	for rows.Next() {
+		var (
+			id, ip []byte
+			port   int
+			crypto bool
+		)
+		err := rows.Scan(&id, &ip, &port, &crypto)
+		if err != nil {
+			return nil, err
+		}
+		p := chihaya.Peer{ID: chihaya.PeerIDFromBytes(id), IP: net.IP(ip), Port: uint16(port)}
+		if crypto {
+			p.Crypto = chihaya.CryptoSupported
+		}
+		peers = append(peers, p)
+	}
+	return peers, rows.Err()
+}
+
+func (s *peerStore) GetSeeders(infoHash chihaya.InfoHash) (peers, peers6 []chihaya.Peer, err error) {
+	return s.getPeers(infoHash, true)
+}
+
+func (s *peerStore) GetLeechers(infoHash chihaya.InfoHash) (peers, peers6 []chihaya.Peer, err error) {
+	return s.getPeers(infoHash, false)
+}
+
+func (s *peerStore) getPeers(infoHash chihaya.InfoHash, seeder bool) (peers, peers6 []chihaya.Peer, err error) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	for _, family := range []int16{familyIPv4, familyIPv6} {
+		rows, err := s.db.QueryContext(ctx, s.q(`SELECT peer_id, ip, port, crypto FROM {p}peers WHERE info_hash = $1 AND family = $2 AND seeder = $3`), infoHash[:], family, seeder)
+		if err != nil {
+			return nil, nil, err
+		}
+		found, err := scanPeers(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if family == familyIPv4 {
+			peers = found
+		} else {
+			peers6 = found
+		}
+	}
+	return peers, peers6, nil
+}
+
+// count runs query, which must count something, with args.
+func (s *peerStore) count(query string, args ...interface{}) (uint64, error) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var n int64
+	err := s.db.QueryRowContext(ctx, s.q(query), args...).Scan(&n)
+	return uint64(n), err
+}
+
+// HasPeer matches p like deletePeer does: by its Key, or by its peer ID and
+// address if no peer has its Key.
+func (s *peerStore) HasPeer(infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	family, ip := encodeIP(p.IP)
+	var isSeeder bool
+	err = s.db.QueryRowContext(ctx, s.q(`
+		SELECT seeder FROM {p}peers
+		WHERE info_hash = $1 AND family = $2
+			AND (key <> '' AND key = $3 OR peer_id = $4 AND ip = $5 AND port = $6)
+		ORDER BY key <> '' AND key = $3 DESC
+		LIMIT 1`), infoHash[:], family, p.Key, p.ID[:], ip, int(p.Port)).Scan(&isSeeder)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return isSeeder, !isSeeder, nil
+}
+
+func (s *peerStore) NumSeeders(infoHash chihaya.InfoHash) int {
+	n, err := s.count(`SELECT COUNT(*) FROM {p}peers WHERE info_hash = $1 AND seeder`, infoHash[:])
+	if err != nil {
+		log.Warn("postgres: failed to count seeders", "infohash", infoHash, "err", err)
+		return 0
+	}
+	return int(n)
+}
+
+func (s *peerStore) NumLeechers(infoHash chihaya.InfoHash) int {
+	n, err := s.count(`SELECT COUNT(*) FROM {p}peers WHERE info_hash = $1 AND NOT seeder`, infoHash[:])
+	if err != nil {
+		log.Warn("postgres: failed to count leechers", "infohash", infoHash, "err", err)
+		return 0
+	}
+	return int(n)
+}
+
+func (s *peerStore) GetStats(infoHash chihaya.InfoHash) (seeders, leechers, downloaded uint64, err error) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var numSeeders, numLeechers, numDownloaded int64
+	err = s.db.QueryRowContext(ctx, s.q(`
+		SELECT
+			COUNT(*) FILTER (WHERE seeder),
+			COUNT(*) FILTER (WHERE NOT seeder),
+			COALESCE((SELECT downloaded FROM {p}downloads WHERE info_hash = $1), 0)
+		FROM {p}peers WHERE info_hash = $1`), infoHash[:]).Scan(&numSeeders, &numLeechers, &numDownloaded)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return uint64(numSeeders), uint64(numLeechers), uint64(numDownloaded), nil
+}
+
+func (s *peerStore) NumSwarms() (uint64, error) {
+	return s.count(`SELECT COUNT(DISTINCT info_hash) FROM {p}peers`)
+}
+
+func (s *peerStore) NumTotalSeeders() (uint64, error) {
+	return s.count(`SELECT COUNT(*) FROM {p}peers WHERE seeder`)
+}
+
+func (s *peerStore) NumTotalLeechers() (uint64, error) {
+	return s.count(`SELECT COUNT(*) FROM {p}peers WHERE NOT seeder`)
+}
+
+// WalkSwarmSizes reads the sizes of all swarms before it calls fn, so that
+// no query is open while fn runs.
+func (s *peerStore) WalkSwarmSizes(fn func(infoHash chihaya.InfoHash, peers int)) {
+	s.checkClosed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	type size struct {
+		infoHash chihaya.InfoHash
+		peers    int
+	}
+	var sizes []size
+
+	rows, err := s.db.QueryContext(ctx, s.q(`SELECT info_hash, COUNT(*) FROM {p}peers GROUP BY info_hash`))
+	if err != nil {
+		log.Warn("postgres: failed to list swarm sizes", "err", err)
+		return
+	}
+	for rows.Next() {
+		var (
+			infoHash []byte
+			peers    int
+		)
+		if err = rows.Scan(&infoHash, &peers); err != nil {
+			break
+		}
+		sizes = append(sizes, size{chihaya.InfoHashFromBytes(infoHash), peers})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		log.Warn("postgres: failed to list swarm sizes", "err", err)
+		return
+	}
+
+	for _, sz := range sizes {
+		fn(sz.infoHash, sz.peers)
+	}
+}
+
+func (s *peerStore) Stop() <-chan error {
+	toReturn := make(chan error)
+	go func() {
+		close(s.closed)
+		<-s.reaped
+
+		err := s.db.Close()
+		s.Close()
+
+		if err != nil {
+			toReturn <- err
+		}
+		close(toReturn)
+	}()
+	return toReturn
+}
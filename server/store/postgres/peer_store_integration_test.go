@@ -0,0 +1,173 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build integration
+// +build integration
+
+package postgres
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// The integration tests expect a PostgreSQL database at CHIHAYA_POSTGRES_DSN,
+// or postgres://localhost/chihaya_test?sslmode=disable if it is unset. They
+// are run with
+//
+//	go test -tags integration
+//
+// Every test uses a table prefix unique to the time it was started at, so
+// that peers of previous runs do not interfere.
+
+var peerStoreTester = store.PreparePeerStoreTester(&peerStoreDriver{})
+
+func postgresDSN() string {
+	if dsn := os.Getenv("CHIHAYA_POSTGRES_DSN"); dsn != "" {
+		return dsn
+	}
+	return "postgres://localhost/chihaya_test?sslmode=disable"
+}
+
+func cleanConfig(options map[string]interface{}) *store.DriverConfig {
+	config := map[string]interface{}{
+		"dsn":    postgresDSN(),
+		"prefix": "test_" + strconv.FormatInt(time.Now().UnixNano(), 36) + "_",
+	}
+	for k, v := range options {
+		config[k] = v
+	}
+
+	return &store.DriverConfig{Name: "postgres", Config: config}
+}
+
+func TestPeerStore(t *testing.T) {
+	peerStoreTester.TestPeerStore(t, cleanConfig(nil))
+}
+
+func TestAnnouncePeersFamilies(t *testing.T) {
+	peerStoreTester.TestAnnouncePeersFamilies(t, cleanConfig(nil))
+}
+
+func TestDownloaded(t *testing.T) {
+	peerStoreTester.TestDownloaded(t, cleanConfig(nil))
+}
+
+func TestPeerEvents(t *testing.T) {
+	peerStoreTester.TestPeerEvents(t, cleanConfig(nil))
+}
+
+func TestAnnounceFamilyPolicies(t *testing.T) {
+	peerStoreTester.TestAnnounceFamilyPolicies(t, cleanConfig(nil))
+}
+
+func TestReannounce(t *testing.T) {
+	peerStoreTester.TestReannounce(t, cleanConfig(nil))
+}
+
+func TestKeys(t *testing.T) {
+	peerStoreTester.TestKeys(t, cleanConfig(nil))
+}
+
+func TestHasPeer(t *testing.T) {
+	peerStoreTester.TestHasPeer(t, cleanConfig(nil))
+}
+
+func TestRequireCrypto(t *testing.T) {
+	peerStoreTester.TestRequireCrypto(t, cleanConfig(nil))
+}
+
+func TestMigrate(t *testing.T) {
+	cfg := cleanConfig(nil)
+	prefix := cfg.Config.(map[string]interface{})["prefix"].(string)
+
+	// Migrating an up to date schema does nothing.
+	a, err := (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	b, err := (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, <-b.Stop())
+
+	db := a.(*peerStore).db
+	var version int
+	require.Nil(t, db.QueryRow(expand(`SELECT version FROM {p}schema_version`, prefix)).Scan(&version))
+	require.Equal(t, schemaVersion, version)
+
+	// Schemas of newer versions are refused.
+	_, err = db.Exec(expand(`UPDATE {p}schema_version SET version = $1`, prefix), schemaVersion+1)
+	require.Nil(t, err)
+	_, err = (&peerStoreDriver{}).New(cfg)
+	require.NotNil(t, err)
+	require.Nil(t, <-a.Stop())
+}
+
+// TestSharedPeerStore makes sure that trackers sharing the tables see the
+// peers of each other, and count their completions once.
+func TestSharedPeerStore(t *testing.T) {
+	cfg := cleanConfig(nil)
+	hash := chihaya.InfoHash{1}
+	peer := chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720}
+
+	a, err := (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+	b, err := (&peerStoreDriver{}).New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, a.PutLeecher(hash, peer))
+	require.Equal(t, 1, b.NumLeechers(hash))
+	require.Nil(t, b.GraduateLeecher(hash, peer))
+	require.Nil(t, a.GraduateLeecher(hash, peer))
+
+	seeders, leechers, downloaded, err := a.GetStats(hash)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(0), leechers)
+	require.Equal(t, uint64(1), downloaded)
+
+	require.Nil(t, <-a.Stop())
+	require.Nil(t, <-b.Stop())
+}
+
+// TestPeerLifetime makes sure that peers that did not announce within the
+// peer lifetime are not returned, and are reaped.
+func TestPeerLifetime(t *testing.T) {
+	ps, err := (&peerStoreDriver{}).New(cleanConfig(map[string]interface{}{
+		"peer_lifetime": "10m",
+		"reap_interval": "10ms",
+	}))
+	require.Nil(t, err)
+	s := ps.(*peerStore)
+
+	hash := chihaya.InfoHash{1}
+	stale := chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720}
+	fresh := chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3042-6ozMq5q6Q3NX"), IP: net.IPv4(38, 241, 13, 19).To4(), Port: 4833}
+	announcer := chihaya.Peer{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1}
+
+	// The stale peer last announced an hour ago.
+	require.Nil(t, s.PutSeeder(hash, stale))
+	_, err = s.db.Exec(s.q(`UPDATE {p}peers SET last_announce = $1`), time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Nil(t, s.PutSeeder(hash, fresh))
+
+	peers, _, err := s.AnnouncePeersContext(context.Background(), hash, false, 50, announcer, chihaya.Peer{}, store.SameFamily)
+	require.Nil(t, err)
+	require.Equal(t, []chihaya.Peer{fresh}, peers)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumSeeders(hash) != 1 {
+		require.True(t, time.Now().Before(deadline), "stale peer was not reaped")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Nil(t, <-ps.Stop())
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestPeerStoreConfig(t *testing.T) {
+	var table = []struct {
+		config map[string]interface{}
+		valid  bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"dsn": "host=db.example.com dbname=tracker", "prefix": "tracker_"}, true},
+		{map[string]interface{}{"max_open_conns": 4, "max_idle_conns": 2, "conn_max_lifetime": "10m"}, true},
+		{map[string]interface{}{"prefix": "Chihaya"}, false},
+		{map[string]interface{}{"prefix": "1chihaya_"}, false},
+		{map[string]interface{}{"prefix": "chihaya; DROP TABLE users; --"}, false},
+		{map[string]interface{}{"prefix": strings.Repeat("a", 33)}, false},
+		{map[string]interface{}{"max_open_conns": -1}, false},
+		{map[string]interface{}{"max_open_conns": 4, "max_idle_conns": 5}, false},
+		{map[string]interface{}{"conn_max_lifetime": "-1m"}, false},
+		{map[string]interface{}{"event_buffer": -1}, false},
+		{map[string]interface{}{"require_crypto": "strict"}, true},
+		{map[string]interface{}{"require_crypto": "always"}, false},
+	}
+
+	for _, tt := range table {
+		_, err := newPeerStoreConfig(&store.DriverConfig{Name: "postgres", Config: tt.config})
+		require.Equal(t, tt.valid, err == nil, "%v: %v", tt.config, err)
+	}
+
+	cfg, err := newPeerStoreConfig(&store.DriverConfig{Name: "postgres"})
+	require.Nil(t, err)
+	require.Equal(t, "chihaya_", cfg.Prefix)
+	require.Equal(t, 16, cfg.MaxOpenConns)
+	require.Equal(t, 16, cfg.MaxIdleConns)
+	require.Equal(t, 5*time.Second, cfg.Timeout)
+	require.Equal(t, 30*time.Minute, cfg.PeerLifetime)
+	require.Equal(t, time.Minute, cfg.ReapInterval)
+	require.Equal(t, defaultEventBuffer, cfg.EventBuffer)
+}
+
+func TestUnreachable(t *testing.T) {
+	_, err := (&peerStoreDriver{}).New(&store.DriverConfig{
+		Name: "postgres",
+		Config: map[string]interface{}{
+			"dsn":     "postgres://127.0.0.1:1/chihaya?sslmode=disable&connect_timeout=1",
+			"timeout": "1s",
+		},
+	})
+	require.NotNil(t, err)
+}
+
+func TestExpand(t *testing.T) {
+	require.Equal(t, "SELECT 1 FROM tracker_peers JOIN tracker_downloads", expand("SELECT 1 FROM {p}peers JOIN {p}downloads", "tracker_"))
+	require.NotEqual(t, migrationLock("a_"), migrationLock("b_"))
+}
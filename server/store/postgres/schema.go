@@ -0,0 +1,109 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// migrations are the statements that bring the schema from one version to
+// the next: migrations[i] migrates version i to version i+1. Applied
+// migrations must never change; changes of the schema are appended.
+//
+// The tables of a store are named with its prefix in place of {p}.
+var migrations = []string{
+	`CREATE TABLE {p}peers (
+		info_hash     bytea       NOT NULL,
+		peer_id       bytea       NOT NULL,
+		family        smallint    NOT NULL,
+		ip            bytea       NOT NULL,
+		port          integer     NOT NULL,
+		key           text        NOT NULL DEFAULT '',
+		seeder        boolean     NOT NULL,
+		completed     boolean     NOT NULL DEFAULT false,
+		last_announce timestamptz NOT NULL,
+		PRIMARY KEY (info_hash, peer_id, family)
+	);
+	CREATE UNIQUE INDEX {p}peers_key ON {p}peers (info_hash, family, key) WHERE key <> '';
+	CREATE INDEX {p}peers_last_announce ON {p}peers (last_announce);
+	CREATE TABLE {p}downloads (
+		info_hash  bytea  PRIMARY KEY,
+		downloaded bigint NOT NULL
+	);`,
+	`ALTER TABLE {p}peers ADD COLUMN crypto boolean NOT NULL DEFAULT false;`,
+}
+
+// schemaVersion is the version of the schema of this package.
+var schemaVersion = len(migrations)
+
+// migrate creates the tables of prefix or brings them to schemaVersion.
+//
+// Trackers that share the tables may start at the same time, so migrations
+// are serialized by an advisory lock. It fails if the schema is newer than
+// schemaVersion, as this package does not know how to use it.
+func migrate(ctx context.Context, db *sql.DB, prefix string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock(prefix))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, expand(`CREATE TABLE IF NOT EXISTS {p}schema_version (version integer NOT NULL)`, prefix))
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, expand(`SELECT COALESCE(MAX(version), 0) FROM {p}schema_version`, prefix)).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("postgres: schema version %d of %q is newer than the supported version %d", version, prefix, schemaVersion)
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	for _, m := range migrations[version:] {
+		_, err = tx.ExecContext(ctx, expand(m, prefix))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, expand(`DELETE FROM {p}schema_version`, prefix))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, expand(`INSERT INTO {p}schema_version (version) VALUES ($1)`, prefix), schemaVersion)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// expand replaces the placeholders of the table names of query with prefix.
+func expand(query, prefix string) string {
+	return strings.Replace(query, "{p}", prefix, -1)
+}
+
+// migrationLock returns the key of the advisory lock that serializes the
+// migrations of the tables of prefix.
+func migrationLock(prefix string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("chihaya:migrate:" + prefix))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,970 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package redis implements store drivers backed by Redis, which allows
+// multiple chihaya instances to share their state.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func init() {
+	store.RegisterIPStoreDriver("redis", &ipStoreDriver{})
+}
+
+type ipStoreDriver struct{}
+
+func (d *ipStoreDriver) New(storecfg *store.DriverConfig) (store.IPStore, error) {
+	err := storecfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newIPStoreConfig(storecfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		IdleTimeout: cfg.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Addr,
+				redis.DialDatabase(cfg.DB),
+				redis.DialConnectTimeout(cfg.DialTimeout))
+		},
+	}
+
+	// Make sure the server is reachable, so that a misconfigured address
+	// is reported right away.
+	conn := pool.Get()
+	_, err = conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		pool.Close()
+		return nil, errors.New("redis: unable to reach server: " + err.Error())
+	}
+
+	s := &ipStore{
+		pool:     pool,
+		ips:      cfg.Prefix + "ips",
+		networks: cfg.Prefix + "networks",
+		expiry:   cfg.Prefix + "expiry",
+		closed:   make(chan struct{}),
+		reaped:   make(chan struct{}),
+		clock:    storecfg.ClockOrReal(),
+	}
+	go s.reap(cfg.ReapInterval)
+
+	return s, nil
+}
+
+type ipStoreConfig struct {
+	Addr         string        `yaml:"addr"`
+	DB           int           `yaml:"db"`
+	Prefix       string        `yaml:"prefix"`
+	MaxIdle      int           `yaml:"max_idle"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	DialTimeout  time.Duration `yaml:"dial_timeout"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+}
+
+func newIPStoreConfig(storecfg *store.DriverConfig) (*ipStoreConfig, error) {
+	b, err := yaml.Marshal(storecfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ipStoreConfig
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Addr == "" {
+		cfg.Addr = "localhost:6379"
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return nil, fmt.Errorf("redis: invalid IPStore config: addr %q: %s", cfg.Addr, err)
+	}
+	if cfg.DB < 0 {
+		return nil, fmt.Errorf("redis: invalid IPStore config: db must not be negative, got %d", cfg.DB)
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "chihaya:"
+	}
+	if cfg.MaxIdle < 1 {
+		cfg.MaxIdle = 8
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 4 * time.Minute
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = time.Minute
+	}
+	return &cfg, nil
+}
+
+// ipStore implements store.IPStore using three Redis keys:
+//
+// The set <prefix>ips contains individual IP addresses.
+// The sorted set <prefix>networks contains networks in normalized CIDR
+// notation, scored by their prefix length in IPv6 notation.
+// The sorted set <prefix>expiry contains the "ip:" or "net:" prefixed members
+// of the other two keys that expire, scored by the time they expire at, in
+// milliseconds since the epoch.
+//
+// Expired members are treated as absent until they are evicted by the reaper.
+// Because every instance sharing the same keys runs a reaper, evicting is
+// idempotent.
+type ipStore struct {
+	pool     *redis.Pool
+	ips      string
+	networks string
+	expiry   string
+	closed   chan struct{}
+	reaped   chan struct{}
+
+	// clock tells the time members expire at and ticks the reaper.
+	clock clock.Clock
+}
+
+var (
+	_ store.IPStore        = &ipStore{}
+	_ store.ContextIPStore = &ipStore{}
+)
+
+// lookupScript checks groups of IPs for containment in a single round-trip.
+//
+// KEYS are the ips, networks and expiry keys.
+// ARGV[1] is the current time in milliseconds, ARGV[2] is either "any" or
+// "all". They are followed by one group per IP, consisting of the IP (or an
+// empty string), the number of candidate networks and the candidate networks
+// themselves, which are all networks that would contain the IP.
+//
+// In "any" mode, the IPs of all groups are checked before any of the
+// candidate networks. In "all" mode, the candidate networks of a group are
+// only checked if its IP is not stored. Both modes return as soon as the
+// result is known.
+//
+// Returns 1 if any (or all) of the groups matched, 0 otherwise.
+var lookupScript = redis.NewScript(3, `
+local now = tonumber(ARGV[1])
+local all = ARGV[2] == "all"
+
+local function valid(member)
+	local expires = redis.call("ZSCORE", KEYS[3], member)
+	return not expires or tonumber(expires) > now
+end
+
+local function matchIP(i)
+	local ip = ARGV[i]
+	return ip ~= "" and redis.call("SISMEMBER", KEYS[1], ip) == 1 and valid("ip:" .. ip)
+end
+
+local function matchNetwork(i)
+	for j = i + 2, i + 1 + tonumber(ARGV[i+1]) do
+		if redis.call("ZSCORE", KEYS[2], ARGV[j]) and valid("net:" .. ARGV[j]) then
+			return true
+		end
+	end
+	return false
+end
+
+local function nextGroup(i)
+	return i + 2 + tonumber(ARGV[i+1])
+end
+
+if all then
+	local i = 3
+	while i <= #ARGV do
+		if not matchIP(i) and not matchNetwork(i) then
+			return 0
+		end
+		i = nextGroup(i)
+	end
+	return 1
+end
+
+local i = 3
+while i <= #ARGV do
+	if matchIP(i) then
+		return 1
+	end
+	i = nextGroup(i)
+end
+
+i = 3
+while i <= #ARGV do
+	if matchNetwork(i) then
+		return 1
+	end
+	i = nextGroup(i)
+end
+return 0
+`)
+
+// reapScript evicts all expired members.
+//
+// KEYS are the ips, networks and expiry keys, ARGV[1] is the current time in
+// milliseconds.
+//
+// Returns the number of members evicted.
+var reapScript = redis.NewScript(3, `
+local expired = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])
+for _, member in ipairs(expired) do
+	local kind, value = string.match(member, "^(%a+):(.*)$")
+	if kind == "ip" then
+		redis.call("SREM", KEYS[1], value)
+	elseif kind == "net" then
+		redis.call("ZREM", KEYS[2], value)
+	end
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])
+return #expired
+`)
+
+// conn returns a connection from the pool.
+// It panics if the store has been stopped.
+func (s *ipStore) conn() redis.Conn {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return s.pool.Get()
+}
+
+// now returns the current time in milliseconds since the epoch.
+func (s *ipStore) now() int64 {
+	return s.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// expiry converts the time something expires at to its score in the expiry
+// key.
+func expiry(expires time.Time) int64 {
+	return expires.UnixNano() / int64(time.Millisecond)
+}
+
+// parseCIDR parses a network in CIDR notation like net.ParseCIDR does, but
+// always returns IPv4 networks in their 4-byte form, so that every network has
+// exactly one normalized representation.
+func parseCIDR(network string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalize(ipnet), nil
+}
+
+// normalize converts an IPv4 network in IPv6 notation to its 4-byte form.
+// Other networks are returned unmodified.
+func normalize(ipnet *net.IPNet) *net.IPNet {
+	ones, bits := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		ipnet.IP = ip4
+		ipnet.Mask = net.CIDRMask(ones-96, 8*net.IPv4len)
+	}
+
+	return ipnet
+}
+
+// prefixLength returns the prefix length of a normalized network in IPv6
+// notation.
+func prefixLength(ipnet *net.IPNet) int {
+	ones, bits := ipnet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 96
+	}
+	return ones
+}
+
+// supernets returns the normalized CIDR notation of all networks that contain
+// the network described by ip and the prefix length ones in IPv6 notation,
+// including the network itself.
+func supernets(ip net.IP, ones int) []string {
+	ip = ip.To16()
+	networks := make([]string, 0, ones+1)
+	for prefix := ones; prefix >= 0; prefix-- {
+		mask := net.CIDRMask(prefix, 8*net.IPv6len)
+		networks = append(networks, normalize(&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+	}
+	return networks
+}
+
+// lookupArgs appends the lookupScript group for ip to args.
+func lookupArgs(args redis.Args, ip net.IP) redis.Args {
+	candidates := supernets(ip, 8*net.IPv6len)
+	args = args.Add(ip.String(), len(candidates))
+	for _, candidate := range candidates {
+		args = args.Add(candidate)
+	}
+	return args
+}
+
+// lookup runs the lookup script for ips in the given mode.
+//
+// Redigo can not cancel a command once it is sent, so if ctx is done first,
+// the command is abandoned: its error is returned right away, while the
+// command completes in the background and returns its connection to the pool.
+func (s *ipStore) lookup(ctx context.Context, mode string, ips []net.IP) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	conn := s.conn()
+
+	args := redis.Args{s.ips, s.networks, s.expiry, s.now(), mode}
+	for _, ip := range ips {
+		args = lookupArgs(args, ip)
+	}
+
+	if ctx.Done() == nil {
+		defer conn.Close()
+		return redis.Bool(lookupScript.Do(conn, args...))
+	}
+
+	type result struct {
+		match bool
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer conn.Close()
+		match, err := redis.Bool(lookupScript.Do(conn, args...))
+		done <- result{match, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.match, r.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (s *ipStore) addIP(ip net.IP, expires time.Time) error {
+	conn := s.conn()
+	defer conn.Close()
+
+	member := ip.String()
+	conn.Send("MULTI")
+	conn.Send("SADD", s.ips, member)
+	if expires.IsZero() {
+		conn.Send("ZREM", s.expiry, "ip:"+member)
+	} else {
+		conn.Send("ZADD", s.expiry, expiry(expires), "ip:"+member)
+	}
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+func (s *ipStore) AddIP(ip net.IP) error {
+	return s.addIP(ip, time.Time{})
+}
+
+func (s *ipStore) AddIPWithExpiry(ip net.IP, expires time.Time) error {
+	return s.addIP(ip, expires)
+}
+
+func (s *ipStore) addNetworks(networks []string, expires time.Time) error {
+	// Parse everything before talking to the server, so that a malformed
+	// network leaves the store untouched.
+	ipnets := make([]*net.IPNet, 0, len(networks))
+	for i, network := range networks {
+		ipnet, err := parseCIDR(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+
+	if len(ipnets) == 0 {
+		return nil
+	}
+
+	conn := s.conn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, ipnet := range ipnets {
+		member := ipnet.String()
+		conn.Send("ZADD", s.networks, prefixLength(ipnet), member)
+		if expires.IsZero() {
+			conn.Send("ZREM", s.expiry, "net:"+member)
+		} else {
+			conn.Send("ZADD", s.expiry, expiry(expires), "net:"+member)
+		}
+	}
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+func (s *ipStore) AddNetwork(network string) error {
+	err := s.addNetworks([]string{network}, time.Time{})
+	if invalid, ok := err.(store.InvalidNetworkError); ok {
+		return invalid.Err
+	}
+	return err
+}
+
+func (s *ipStore) AddNetworkWithExpiry(network string, expires time.Time) error {
+	err := s.addNetworks([]string{network}, expires)
+	if invalid, ok := err.(store.InvalidNetworkError); ok {
+		return invalid.Err
+	}
+	return err
+}
+
+func (s *ipStore) AddNetworks(networks []string) error {
+	return s.addNetworks(networks, time.Time{})
+}
+
+func (s *ipStore) AddIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+	return s.AddNetworks(networks)
+}
+
+func (s *ipStore) HasIP(ip net.IP) (bool, error) {
+	return s.lookup(context.Background(), "any", []net.IP{ip})
+}
+
+func (s *ipStore) HasAnyIP(ips []net.IP) (bool, error) {
+	return s.HasAnyIPContext(context.Background(), ips)
+}
+
+func (s *ipStore) HasAnyIPContext(ctx context.Context, ips []net.IP) (bool, error) {
+	if len(ips) == 0 {
+		return false, nil
+	}
+	return s.lookup(ctx, "any", ips)
+}
+
+func (s *ipStore) HasAllIPs(ips []net.IP) (bool, error) {
+	return s.HasAllIPsContext(context.Background(), ips)
+}
+
+func (s *ipStore) HasAllIPsContext(ctx context.Context, ips []net.IP) (bool, error) {
+	if len(ips) == 0 {
+		return true, nil
+	}
+	return s.lookup(ctx, "all", ips)
+}
+
+// HasNetwork first checks whether the network is contained in any stored
+// network, which only takes a single round-trip.
+// Otherwise, all stored subnets of the network and all stored IPs are
+// scanned, which is expensive for large stores.
+func (s *ipStore) HasNetwork(network string) (bool, error) {
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return false, err
+	}
+	ones := prefixLength(ipnet)
+
+	if ones == 8*net.IPv6len {
+		return s.HasIP(ipnet.IP)
+	}
+
+	conn := s.conn()
+	defer conn.Close()
+
+	candidates := supernets(ipnet.IP, ones)
+	args := redis.Args{s.ips, s.networks, s.expiry, s.now(), "any", "", len(candidates)}
+	for _, candidate := range candidates {
+		args = args.Add(candidate)
+	}
+
+	covered, err := redis.Bool(lookupScript.Do(conn, args...))
+	if err != nil || covered {
+		return covered, err
+	}
+
+	expired, err := s.expired(conn)
+	if err != nil {
+		return false, err
+	}
+
+	var ranges []addrRange
+
+	subnets, err := redis.Strings(conn.Do("ZRANGEBYSCORE", s.networks, "("+strconv.Itoa(ones), "+inf"))
+	if err != nil {
+		return false, err
+	}
+	for _, subnet := range subnets {
+		if expired["net:"+subnet] {
+			continue
+		}
+
+		n, err := parseCIDR(subnet)
+		if err != nil || !ipnet.Contains(n.IP) {
+			continue
+		}
+		ranges = append(ranges, newAddrRange(n))
+	}
+
+	err = s.scan(conn, "SSCAN", s.ips, func(member string) bool {
+		ip := net.ParseIP(member)
+		if ip != nil && !expired["ip:"+member] && ipnet.Contains(ip) {
+			var r addrRange
+			copy(r.first[:], ip.To16())
+			r.last = r.first
+			ranges = append(ranges, r)
+		}
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return newAddrRange(ipnet).coveredBy(ranges), nil
+}
+
+// addrRange is an inclusive range of IPv6 addresses.
+type addrRange struct {
+	first, last [16]byte
+}
+
+func newAddrRange(ipnet *net.IPNet) addrRange {
+	var r addrRange
+	ones := prefixLength(ipnet)
+	copy(r.first[:], ipnet.IP.To16())
+	r.last = r.first
+	for i := ones; i < 8*net.IPv6len; i++ {
+		r.last[i/8] |= 0x80 >> uint(i%8)
+	}
+	return r
+}
+
+type byFirst []addrRange
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].first[:], r[j].first[:]) < 0 }
+
+// coveredBy returns whether the union of ranges contains every address of r.
+func (r addrRange) coveredBy(ranges []addrRange) bool {
+	sort.Sort(byFirst(ranges))
+
+	// next is the first address of r that is not known to be covered yet.
+	next := r.first
+	for _, c := range ranges {
+		if bytes.Compare(c.first[:], next[:]) > 0 {
+			return false
+		}
+		if bytes.Compare(c.last[:], next[:]) < 0 {
+			continue
+		}
+		if bytes.Compare(c.last[:], r.last[:]) >= 0 {
+			return true
+		}
+
+		// Advance next to the address following c.
+		next = c.last
+		for i := len(next) - 1; i >= 0; i-- {
+			next[i]++
+			if next[i] != 0 {
+				break
+			}
+		}
+	}
+
+	return false
+}
+
+// expired returns the set of all members of the expiry key that have expired,
+// but were not evicted yet.
+func (s *ipStore) expired(conn redis.Conn) (map[string]bool, error) {
+	members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", s.expiry, "-inf", s.now()))
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]bool, len(members))
+	for _, member := range members {
+		expired[member] = true
+	}
+	return expired, nil
+}
+
+// scan iterates over the members of a set or sorted set using cmd, which is
+// either SSCAN or ZSCAN, until fn returns false.
+//
+// Members may be passed to fn more than once if the key is modified during
+// the iteration.
+func (s *ipStore) scan(conn redis.Conn, cmd, key string, fn func(member string) bool) error {
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do(cmd, key, cursor, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return errors.New("redis: unexpected " + cmd + " reply")
+		}
+
+		cursor, err = redis.String(values[0], nil)
+		if err != nil {
+			return err
+		}
+
+		members, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+
+		// ZSCAN returns members and scores alternately.
+		step := 1
+		if cmd == "ZSCAN" {
+			step = 2
+		}
+		for i := 0; i < len(members); i += step {
+			if !fn(members[i]) {
+				return nil
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (s *ipStore) RemoveIP(ip net.IP) error {
+	conn := s.conn()
+	defer conn.Close()
+
+	member := ip.String()
+	conn.Send("MULTI")
+	conn.Send("SREM", s.ips, member)
+	conn.Send("ZSCORE", s.expiry, "ip:"+member)
+	conn.Send("ZREM", s.expiry, "ip:"+member)
+
+	return s.removeReply(conn.Do("EXEC"))
+}
+
+func (s *ipStore) RemoveNetwork(network string) error {
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	conn := s.conn()
+	defer conn.Close()
+
+	member := ipnet.String()
+	conn.Send("MULTI")
+	conn.Send("ZREM", s.networks, member)
+	conn.Send("ZSCORE", s.expiry, "net:"+member)
+	conn.Send("ZREM", s.expiry, "net:"+member)
+
+	return s.removeReply(conn.Do("EXEC"))
+}
+
+func (s *ipStore) RemoveIPRange(start, end net.IP) error {
+	networks, err := store.IPRangeNetworks(start, end)
+	if err != nil {
+		return err
+	}
+
+	b := s.Batch()
+	for _, network := range networks {
+		err = b.RemoveNetwork(network)
+		if err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// CarveNetwork looks up the supernets of the network directly and scans all
+// networks with longer prefixes for its subnets. The networks and expiry keys
+// are watched, so that concurrent modifications make it start over.
+func (s *ipStore) CarveNetwork(network string) error {
+	hole, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+	ones := prefixLength(hole)
+
+	conn := s.conn()
+	defer conn.Close()
+
+	for {
+		done, err := s.carveNetwork(conn, hole, ones)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// carveNetwork makes one attempt of CarveNetwork. It returns false if the
+// transaction was aborted because a watched key was modified.
+func (s *ipStore) carveNetwork(conn redis.Conn, hole *net.IPNet, ones int) (bool, error) {
+	_, err := conn.Do("WATCH", s.networks, s.expiry)
+	if err != nil {
+		return false, err
+	}
+
+	expired, err := s.expired(conn)
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+
+	var overlapping []string
+	for _, candidate := range supernets(hole.IP, ones) {
+		score, err := conn.Do("ZSCORE", s.networks, candidate)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+		if score != nil && !expired["net:"+candidate] {
+			overlapping = append(overlapping, candidate)
+		}
+	}
+
+	subnets, err := redis.Strings(conn.Do("ZRANGEBYSCORE", s.networks, "("+strconv.Itoa(ones), "+inf"))
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+	for _, subnet := range subnets {
+		n, err := parseCIDR(subnet)
+		if err == nil && !expired["net:"+subnet] && hole.Contains(n.IP) {
+			overlapping = append(overlapping, subnet)
+		}
+	}
+
+	if len(overlapping) == 0 {
+		conn.Do("UNWATCH")
+		return false, store.ErrResourceDoesNotExist
+	}
+
+	expiries := make([]interface{}, len(overlapping))
+	for i, member := range overlapping {
+		expiries[i], err = conn.Do("ZSCORE", s.expiry, "net:"+member)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+	}
+
+	conn.Send("MULTI")
+	for i, member := range overlapping {
+		n, _ := parseCIDR(member)
+		remaining, _ := store.ExcludeNetwork(n, hole)
+
+		conn.Send("ZREM", s.networks, member)
+		conn.Send("ZREM", s.expiry, "net:"+member)
+		for _, ipnet := range remaining {
+			conn.Send("ZADD", s.networks, prefixLength(ipnet), ipnet.String())
+			if expiries[i] != nil {
+				conn.Send("ZADD", s.expiry, expiries[i], "net:"+ipnet.String())
+			}
+		}
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+
+	// EXEC replies nil if a watched key was modified.
+	return reply != nil, nil
+}
+
+// removeReply interprets the reply to a transaction consisting of a removal,
+// fetching the expiry of the removed member and removing its expiry.
+//
+// Removing a member that has expired, but was not evicted yet, is treated
+// like removing a member that does not exist.
+func (s *ipStore) removeReply(reply interface{}, err error) error {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return err
+	}
+	if len(values) != 3 {
+		return errors.New("redis: unexpected reply to removal")
+	}
+
+	removed, err := redis.Int(values[0], nil)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return store.ErrResourceDoesNotExist
+	}
+
+	if values[1] != nil {
+		expires, err := redis.Float64(values[1], nil)
+		if err != nil {
+			return err
+		}
+		if expires <= float64(s.now()) {
+			return store.ErrResourceDoesNotExist
+		}
+	}
+
+	return nil
+}
+
+func (s *ipStore) ReplaceAll(ips []net.IP, networks []string) error {
+	ipnets := make([]*net.IPNet, 0, len(networks))
+	for i, network := range networks {
+		ipnet, err := parseCIDR(network)
+		if err != nil {
+			return store.InvalidNetworkError{Index: i, Network: network, Err: err}
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+
+	conn := s.conn()
+	defer conn.Close()
+
+	// Lookups are scripts, which never run in the middle of a transaction.
+	conn.Send("MULTI")
+	conn.Send("DEL", s.ips, s.networks, s.expiry)
+	if len(ips) > 0 {
+		args := redis.Args{s.ips}
+		for _, ip := range ips {
+			args = append(args, ip.String())
+		}
+		conn.Send("SADD", args...)
+	}
+	if len(ipnets) > 0 {
+		args := redis.Args{s.networks}
+		for _, ipnet := range ipnets {
+			args = append(args, prefixLength(ipnet), ipnet.String())
+		}
+		conn.Send("ZADD", args...)
+	}
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+func (s *ipStore) NumIPs() (uint64, error) {
+	conn := s.conn()
+	defer conn.Close()
+
+	return redis.Uint64(conn.Do("SCARD", s.ips))
+}
+
+func (s *ipStore) NumNetworks() (uint64, error) {
+	conn := s.conn()
+	defer conn.Close()
+
+	return redis.Uint64(conn.Do("ZCARD", s.networks))
+}
+
+// RangeIPs iterates over the stored IPs using SSCAN, which may pass an IP to
+// fn more than once if IPs are added or removed during the iteration.
+func (s *ipStore) RangeIPs(fn func(ip net.IP) bool) error {
+	conn := s.conn()
+	defer conn.Close()
+
+	expired, err := s.expired(conn)
+	if err != nil {
+		return err
+	}
+
+	return s.scan(conn, "SSCAN", s.ips, func(member string) bool {
+		if expired["ip:"+member] {
+			return true
+		}
+
+		ip := net.ParseIP(member)
+		if ip == nil {
+			return true
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return fn(ip)
+	})
+}
+
+// RangeNetworks iterates over the stored networks using ZSCAN, which may pass
+// a network to fn more than once if networks are added or removed during the
+// iteration.
+func (s *ipStore) RangeNetworks(fn func(network *net.IPNet) bool) error {
+	conn := s.conn()
+	defer conn.Close()
+
+	expired, err := s.expired(conn)
+	if err != nil {
+		return err
+	}
+
+	return s.scan(conn, "ZSCAN", s.networks, func(member string) bool {
+		if expired["net:"+member] {
+			return true
+		}
+
+		ipnet, err := parseCIDR(member)
+		if err != nil {
+			return true
+		}
+		return fn(ipnet)
+	})
+}
+
+// reap periodically evicts expired members until the store is stopped.
+func (s *ipStore) reap(interval time.Duration) {
+	defer close(s.reaped)
+
+	t := s.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C():
+			conn := s.pool.Get()
+			// Failing to evict is harmless, because expired members
+			// are ignored anyway; the next run will try again.
+			reapScript.Do(conn, s.ips, s.networks, s.expiry, s.now())
+			conn.Close()
+		}
+	}
+}
+
+func (s *ipStore) Stop() <-chan error {
+	toReturn := make(chan error)
+	go func() {
+		close(s.closed)
+		<-s.reaped
+
+		if err := s.pool.Close(); err != nil {
+			toReturn <- err
+		}
+		close(toReturn)
+	}()
+	return toReturn
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"errors"
+	"net"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// ipBatch implements store.IPBatch for an ipStore.
+//
+// Every modification is recorded as Redis commands, which are sent in a
+// single MULTI/EXEC transaction on Commit.
+type ipBatch struct {
+	s    *ipStore
+	cmds []command
+
+	// ips and nets record whether the IPs and networks modified by the
+	// batch so far are contained in the store after the batch is
+	// committed.
+	ips  map[string]bool
+	nets map[string]bool
+
+	done bool
+}
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+var _ store.IPBatch = &ipBatch{}
+
+func (s *ipStore) Batch() store.IPBatch {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with stopped store")
+	default:
+	}
+
+	return &ipBatch{
+		s:    s,
+		ips:  make(map[string]bool),
+		nets: make(map[string]bool),
+	}
+}
+
+// contains returns whether member is contained in key, using cmd, which is
+// either SISMEMBER or ZSCORE, and has not expired.
+func (s *ipStore) contains(cmd, key, member, expiryMember string) (bool, error) {
+	conn := s.conn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send(cmd, key, member)
+	conn.Send("ZSCORE", s.expiry, expiryMember)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	if len(values) != 2 {
+		return false, errors.New("redis: unexpected reply to lookup")
+	}
+
+	if values[0] == nil || values[0] == int64(0) {
+		return false, nil
+	}
+
+	if values[1] != nil {
+		expires, err := redis.Float64(values[1], nil)
+		if err != nil {
+			return false, err
+		}
+		if expires <= float64(s.now()) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (b *ipBatch) add(name string, args ...interface{}) {
+	b.cmds = append(b.cmds, command{name, args})
+}
+
+func (b *ipBatch) AddIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	member := ip.String()
+	b.ips[member] = true
+	b.add("SADD", b.s.ips, member)
+	b.add("ZREM", b.s.expiry, "ip:"+member)
+
+	return nil
+}
+
+func (b *ipBatch) AddNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	member := ipnet.String()
+	b.nets[member] = true
+	b.add("ZADD", b.s.networks, prefixLength(ipnet), member)
+	b.add("ZREM", b.s.expiry, "net:"+member)
+
+	return nil
+}
+
+func (b *ipBatch) RemoveIP(ip net.IP) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	member := ip.String()
+	contained, ok := b.ips[member]
+	if !ok {
+		var err error
+		contained, err = b.s.contains("SISMEMBER", b.s.ips, member, "ip:"+member)
+		if err != nil {
+			return err
+		}
+	}
+	if !contained {
+		return store.ErrResourceDoesNotExist
+	}
+
+	b.ips[member] = false
+	b.add("SREM", b.s.ips, member)
+	b.add("ZREM", b.s.expiry, "ip:"+member)
+
+	return nil
+}
+
+func (b *ipBatch) RemoveNetwork(network string) error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+
+	ipnet, err := parseCIDR(network)
+	if err != nil {
+		return err
+	}
+
+	member := ipnet.String()
+	contained, ok := b.nets[member]
+	if !ok {
+		contained, err = b.s.contains("ZSCORE", b.s.networks, member, "net:"+member)
+		if err != nil {
+			return err
+		}
+	}
+	if !contained {
+		return store.ErrResourceDoesNotExist
+	}
+
+	b.nets[member] = false
+	b.add("ZREM", b.s.networks, member)
+	b.add("ZREM", b.s.expiry, "net:"+member)
+
+	return nil
+}
+
+func (b *ipBatch) Commit() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+
+	if len(b.cmds) == 0 {
+		return nil
+	}
+
+	conn := b.s.conn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, cmd := range b.cmds {
+		conn.Send(cmd.name, cmd.args...)
+	}
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+func (b *ipBatch) Rollback() error {
+	if b.done {
+		return store.ErrBatchDone
+	}
+	b.done = true
+	b.cmds = nil
+
+	return nil
+}
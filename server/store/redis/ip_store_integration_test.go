@@ -0,0 +1,119 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+//go:build integration
+// +build integration
+
+package redis
+
+import (
+	"os"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/server/store"
+)
+
+// The integration tests expect a Redis server at CHIHAYA_REDIS_ADDR, or
+// localhost:6379 if it is unset. They are run with
+//
+//	go test -tags integration
+//
+// Every test works on its own set of keys, which are deleted before the test.
+
+var ipStoreTester = store.PrepareIPStoreTester(&ipStoreDriver{})
+
+func redisAddr() string {
+	if addr := os.Getenv("CHIHAYA_REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:6379"
+}
+
+// cleanConfig returns a DriverConfig for a store that uses a key prefix unique
+// to the given test and makes sure the keys of that prefix are empty.
+func cleanConfig(t *testing.T, test string) *store.DriverConfig {
+	prefix := "chihaya_test:" + test + ":"
+
+	conn, err := redis.Dial("tcp", redisAddr())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", prefix+"ips", prefix+"networks", prefix+"expiry")
+	require.Nil(t, err)
+
+	return &store.DriverConfig{
+		Name: "redis",
+		Config: map[string]interface{}{
+			"addr":   redisAddr(),
+			"prefix": prefix,
+		},
+	}
+}
+
+func TestIPStore(t *testing.T) {
+	ipStoreTester.TestIPStore(t, cleanConfig(t, "TestIPStore"))
+}
+
+func TestHasAllHasAny(t *testing.T) {
+	ipStoreTester.TestHasAllHasAny(t, cleanConfig(t, "TestHasAllHasAny"))
+}
+
+func TestNetworks(t *testing.T) {
+	ipStoreTester.TestNetworks(t, cleanConfig(t, "TestNetworks"))
+}
+
+func TestHasAllHasAnyNetworks(t *testing.T) {
+	ipStoreTester.TestHasAllHasAnyNetworks(t, cleanConfig(t, "TestHasAllHasAnyNetworks"))
+}
+
+func TestAddNetworks(t *testing.T) {
+	ipStoreTester.TestAddNetworks(t, cleanConfig(t, "TestAddNetworks"))
+}
+
+func TestIPRange(t *testing.T) {
+	ipStoreTester.TestIPRange(t, cleanConfig(t, "TestIPRange"))
+}
+
+func TestCarveNetwork(t *testing.T) {
+	ipStoreTester.TestCarveNetwork(t, cleanConfig(t, "TestCarveNetwork"))
+}
+
+func TestRange(t *testing.T) {
+	ipStoreTester.TestRange(t, cleanConfig(t, "TestRange"))
+}
+
+func TestHasNetwork(t *testing.T) {
+	ipStoreTester.TestHasNetwork(t, cleanConfig(t, "TestHasNetwork"))
+}
+
+func TestCount(t *testing.T) {
+	ipStoreTester.TestCount(t, cleanConfig(t, "TestCount"))
+}
+
+func TestExpiry(t *testing.T) {
+	ipStoreTester.TestExpiry(t, cleanConfig(t, "TestExpiry"))
+}
+
+func TestBatch(t *testing.T) {
+	ipStoreTester.TestBatch(t, cleanConfig(t, "TestBatch"))
+}
+
+func TestBatchConcurrentReads(t *testing.T) {
+	ipStoreTester.TestBatchConcurrentReads(t, cleanConfig(t, "TestBatchConcurrentReads"))
+}
+
+func TestBatchMoveConcurrentReads(t *testing.T) {
+	ipStoreTester.TestBatchMoveConcurrentReads(t, cleanConfig(t, "TestBatchMoveConcurrentReads"))
+}
+
+func TestReplaceAll(t *testing.T) {
+	ipStoreTester.TestReplaceAll(t, cleanConfig(t, "TestReplaceAll"))
+}
+
+func TestReplaceAllConcurrentReads(t *testing.T) {
+	ipStoreTester.TestReplaceAllConcurrentReads(t, cleanConfig(t, "TestReplaceAllConcurrentReads"))
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package redis
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/server/store"
+)
+
+func TestSupernets(t *testing.T) {
+	_, ipnet, err := net.ParseCIDR("192.168.22.0/24")
+	require.Nil(t, err)
+
+	got := supernets(ipnet.IP, prefixLength(ipnet))
+	require.Equal(t, 96+24+1, len(got))
+	require.Equal(t, "192.168.22.0/24", got[0])
+	require.Equal(t, "192.168.22.0/23", got[1])
+	require.Equal(t, "0.0.0.0/0", got[24])
+	require.Equal(t, "::/0", got[len(got)-1])
+}
+
+func TestCoveredBy(t *testing.T) {
+	mustRange := func(network string) addrRange {
+		ipnet, err := parseCIDR(network)
+		require.Nil(t, err)
+		return newAddrRange(ipnet)
+	}
+
+	var table = []struct {
+		network  string
+		ranges   []string
+		expected bool
+	}{
+		{"192.168.22.0/23", nil, false},
+		{"192.168.22.0/23", []string{"192.168.22.0/24"}, false},
+		{"192.168.22.0/23", []string{"192.168.23.0/24", "192.168.22.0/24"}, true},
+		{"192.168.22.0/23", []string{"192.168.22.0/25", "192.168.23.0/24"}, false},
+		{"192.168.22.0/31", []string{"192.168.22.1/32", "192.168.22.0/32"}, true},
+		{"192.168.22.0/24", []string{"192.168.22.0/25", "192.168.22.0/26", "192.168.22.128/25"}, true},
+		{"::/127", []string{"::/128", "::1/128"}, true},
+	}
+
+	for _, tt := range table {
+		var ranges []addrRange
+		for _, r := range tt.ranges {
+			ranges = append(ranges, mustRange(r))
+		}
+		require.Equal(t, tt.expected, mustRange(tt.network).coveredBy(ranges), tt.network)
+	}
+}
+
+func TestIPStoreConfig(t *testing.T) {
+	var table = []struct {
+		config   map[string]interface{}
+		expected string
+		valid    bool
+	}{
+		{nil, "localhost:6379", true},
+		{map[string]interface{}{"addr": "redis.example.com:6380"}, "redis.example.com:6380", true},
+		{map[string]interface{}{"addr": "[::1]:6379", "db": 2}, "[::1]:6379", true},
+		{map[string]interface{}{"addr": "localhost"}, "", false},
+		{map[string]interface{}{"addr": "::1:6379"}, "", false},
+		{map[string]interface{}{"addr": "localhost:6379", "db": -1}, "", false},
+	}
+
+	for _, tt := range table {
+		cfg, err := newIPStoreConfig(&store.DriverConfig{Name: "redis", Config: tt.config})
+		if !tt.valid {
+			require.NotNil(t, err, "%v", tt.config)
+			continue
+		}
+		require.Nil(t, err, "%v", tt.config)
+		require.Equal(t, tt.expected, cfg.Addr)
+	}
+
+	// Invalid configs fail before connecting to the server.
+	_, err := (&ipStoreDriver{}).New(&store.DriverConfig{Name: "redis", Config: "addr: localhost:6379"})
+	require.NotNil(t, err)
+	_, err = (&ipStoreDriver{}).New(&store.DriverConfig{Name: "redis", Config: map[string]interface{}{"addr": "localhost"}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid IPStore config")
+}
+
+// blockingConn is a redis.Conn whose commands block until release is closed
+// and then reply with 1.
+type blockingConn struct {
+	started chan struct{}
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (c *blockingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	close(c.started)
+	<-c.release
+	return int64(1), nil
+}
+
+func (c *blockingConn) Close() error                            { close(c.closed); return nil }
+func (c *blockingConn) Err() error                              { return nil }
+func (c *blockingConn) Send(string, ...interface{}) error       { return nil }
+func (c *blockingConn) Flush() error                            { return nil }
+func (c *blockingConn) Receive() (reply interface{}, err error) { return nil, nil }
+
+func TestLookupCanceled(t *testing.T) {
+	conn := &blockingConn{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	s := &ipStore{
+		pool:   &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		closed: make(chan struct{}),
+		clock:  clock.Real,
+	}
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := s.HasAnyIPContext(ctx, ips)
+		errs <- err
+	}()
+
+	// The lookup returns as soon as it is canceled, before the server
+	// replies.
+	<-conn.started
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+
+	// The abandoned command still returns its connection.
+	close(conn.release)
+	<-conn.closed
+
+	// Canceled contexts are not sent to the server at all.
+	_, err := s.HasAllIPsContext(ctx, ips)
+	require.Equal(t, context.Canceled, err)
+}
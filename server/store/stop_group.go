@@ -0,0 +1,116 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/stopper"
+)
+
+// ErrStopTimeout is reported by a StopGroup for stores that did not finish
+// stopping in time.
+var ErrStopTimeout = errors.New("timed out")
+
+// StopError is returned by StopGroup.Stop if any of its stores failed to
+// stop.
+type StopError struct {
+	// Failed maps the names of the stores that failed to stop to their
+	// errors. Stores that timed out are mapped to ErrStopTimeout.
+	Failed map[string]error
+}
+
+func (e *StopError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := make([]string, len(names))
+	for i, name := range names {
+		failures[i] = name + ": " + e.Failed[name].Error()
+	}
+	return "store: failed to stop " + strings.Join(failures, "; ")
+}
+
+// StopGroup stops a set of named stores together.
+type StopGroup struct {
+	timeout time.Duration
+	names   []string
+	stores  []stopper.Stopper
+	sync.Mutex
+}
+
+// NewStopGroup creates a new StopGroup that waits up to timeout for its
+// stores to stop.
+func NewStopGroup(timeout time.Duration) *StopGroup {
+	return &StopGroup{timeout: timeout}
+}
+
+// Add adds a store to the StopGroup under the given name.
+func (g *StopGroup) Add(name string, s stopper.Stopper) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.names = append(g.names, name)
+	g.stores = append(g.stores, s)
+}
+
+// Stop stops all stores of the StopGroup in parallel and waits for them to
+// finish, but no longer than the timeout of the StopGroup.
+//
+// If any of the stores failed to stop or did not finish in time, a
+// *StopError naming them is returned.
+func (g *StopGroup) Stop() error {
+	g.Lock()
+	defer g.Unlock()
+
+	type result struct {
+		index int
+		err   error
+	}
+	// results is buffered, so that stores that finish after the timeout
+	// do not block forever.
+	results := make(chan result, len(g.stores))
+	for i, s := range g.stores {
+		go func(i int, s stopper.Stopper) {
+			results <- result{i, <-s.Stop()}
+		}(i, s)
+	}
+
+	failed := make(map[string]error)
+	pending := make(map[int]bool)
+	for i := range g.stores {
+		pending[i] = true
+	}
+
+	timeout := time.NewTimer(g.timeout)
+	defer timeout.Stop()
+
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.index)
+			if r.err != nil {
+				failed[g.names[r.index]] = r.err
+			}
+		case <-timeout.C:
+			for i := range pending {
+				failed[g.names[i]] = ErrStopTimeout
+			}
+			pending = nil
+		}
+	}
+
+	if len(failed) > 0 {
+		return &StopError{Failed: failed}
+	}
+	return nil
+}
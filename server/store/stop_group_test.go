@@ -0,0 +1,62 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/stopper"
+)
+
+// stopperFunc adapts a function to the stopper.Stopper interface.
+type stopperFunc func() <-chan error
+
+func (f stopperFunc) Stop() <-chan error { return f() }
+
+var (
+	cleanStore = stopperFunc(stopper.AlreadyStoppedFunc)
+
+	errFailingStore = errors.New("failing store")
+	failingStore    = stopperFunc(func() <-chan error {
+		c := make(chan error, 1)
+		c <- errFailingStore
+		close(c)
+		return c
+	})
+
+	// hangingStore never finishes stopping.
+	hangingStore = stopperFunc(func() <-chan error {
+		return make(chan error)
+	})
+)
+
+func TestStopGroup(t *testing.T) {
+	sg := NewStopGroup(time.Second)
+	sg.Add("peer_store", cleanStore)
+	sg.Add("ip_store", cleanStore)
+	require.Nil(t, sg.Stop())
+
+	sg = NewStopGroup(50 * time.Millisecond)
+	sg.Add("peer_store", cleanStore)
+	sg.Add("ip_store", failingStore)
+	sg.Add("string_store", hangingStore)
+
+	start := time.Now()
+	err := sg.Stop()
+	require.True(t, time.Since(start) < time.Second, "Stop must not wait for hanging stores")
+
+	require.NotNil(t, err)
+	stopErr, ok := err.(*StopError)
+	require.True(t, ok)
+	require.Equal(t, map[string]error{
+		"ip_store":     errFailingStore,
+		"string_store": ErrStopTimeout,
+	}, stopErr.Failed)
+	require.Equal(t, "store: failed to stop ip_store: failing store; string_store: timed out", err.Error())
+}
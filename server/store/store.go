@@ -6,13 +6,17 @@ package store
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"math"
+	"sort"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya"
-	"github.com/chihaya/chihaya/pkg/stopper"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/server"
 	"github.com/chihaya/chihaya/tracker"
 )
@@ -38,34 +42,132 @@ func constructor(srvcfg *chihaya.ServerConfig, tkr *tracker.Tracker) (server.Ser
 			cfg:      cfg,
 			tkr:      tkr,
 			shutdown: make(chan struct{}),
-			sg:       stopper.NewStopGroup(),
+			sg:       NewStopGroup(cfg.ShutdownTimeout),
 		}
 
+		log.Info("store: registered drivers",
+			"peer_store", RegisteredPeerStoreDrivers(),
+			"ip_store", RegisteredIPStoreDrivers(),
+			"string_store", RegisteredStringStoreDrivers())
+
 		ps, err := OpenPeerStore(&cfg.PeerStore)
 		if err != nil {
 			return nil, err
 		}
-		theStore.sg.Add(ps)
+		theStore.sg.Add("peer_store", ps)
+		registerPeerStoreMetrics(ps)
 
 		ips, err := OpenIPStore(&cfg.IPStore)
 		if err != nil {
 			return nil, err
 		}
-		theStore.sg.Add(ips)
+		theStore.sg.Add("ip_store", ips)
+		registerIPStoreMetrics(ips)
 
 		ss, err := OpenStringStore(&cfg.StringStore)
 		if err != nil {
 			return nil, err
 		}
-		theStore.sg.Add(ss)
+		theStore.sg.Add("string_store", ss)
 
 		theStore.PeerStore = ps
 		theStore.IPStore = ips
 		theStore.StringStore = ss
+
+		if w, ok := ps.(SwarmSizeWalker); ok {
+			theStore.statsStop = make(chan struct{})
+			theStore.statsDone = make(chan struct{})
+			go func() {
+				defer close(theStore.statsDone)
+				exportSwarmSizes(w, cfg.SwarmStatsInterval, theStore.statsStop)
+			}()
+		}
 	}
 	return theStore, nil
 }
 
+// sortedNames returns the sorted keys of a registry of drivers.
+func sortedNames[T any](drivers map[string]T) []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registerIPStoreMetrics exports the size of an IPStore to prometheus.
+func registerIPStoreMetrics(ips IPStore) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "chihaya",
+			Subsystem: "ip_store",
+			Name:      "ips",
+			Help:      "The number of individual IP addresses in the IPStore.",
+		}, countFunc(ips.NumIPs)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "chihaya",
+			Subsystem: "ip_store",
+			Name:      "networks",
+			Help:      "The number of networks in the IPStore.",
+		}, countFunc(ips.NumNetworks)),
+	)
+}
+
+// registerPeerStoreMetrics exports the number of swarms and peers of a
+// PeerStore to prometheus.
+func registerPeerStoreMetrics(ps PeerStore) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "chihaya",
+			Subsystem: "peer_store",
+			Name:      "swarms",
+			Help:      "The number of swarms in the PeerStore.",
+		}, countFunc(ps.NumSwarms)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "chihaya",
+			Subsystem: "peer_store",
+			Name:      "seeders",
+			Help:      "The number of seeders across all swarms in the PeerStore.",
+		}, countFunc(ps.NumTotalSeeders)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "chihaya",
+			Subsystem: "peer_store",
+			Name:      "leechers",
+			Help:      "The number of leechers across all swarms in the PeerStore.",
+		}, countFunc(ps.NumTotalLeechers)),
+	)
+
+	if d, ok := ps.(droppedPeerEventCounter); ok {
+		prometheus.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "chihaya",
+				Subsystem: "peer_store",
+				Name:      "dropped_events",
+				Help:      "The number of PeerEvents dropped because a subscriber fell behind.",
+			}, func() float64 { return float64(d.DroppedPeerEvents()) }),
+		)
+	}
+}
+
+// droppedPeerEventCounter is implemented by PeerStores that embed a
+// PeerEventFeed.
+type droppedPeerEventCounter interface {
+	DroppedPeerEvents() uint64
+}
+
+// countFunc adapts a count method of a store to a prometheus GaugeFunc.
+// Failing to count is reported as NaN.
+func countFunc(count func() (uint64, error)) func() float64 {
+	return func() float64 {
+		n, err := count()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	}
+}
+
 // Config represents the configuration for the store.
 type Config struct {
 	Addr           string        `yaml:"addr"`
@@ -73,15 +175,59 @@ type Config struct {
 	ReadTimeout    time.Duration `yaml:"read_timeout"`
 	WriteTimeout   time.Duration `yaml:"write_timeout"`
 	GCAfter        time.Duration `yaml:"gc_after"`
-	PeerStore      DriverConfig  `yaml:"peer_store"`
-	IPStore        DriverConfig  `yaml:"ip_store"`
-	StringStore    DriverConfig  `yaml:"string_store"`
+	// ShutdownTimeout is the time to wait for the store drivers to stop.
+	// It defaults to 10 seconds.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// SwarmStatsInterval is the interval the distribution of the sizes of
+	// the swarms is exported to prometheus in. It defaults to one minute.
+	SwarmStatsInterval time.Duration `yaml:"swarm_stats_interval"`
+	PeerStore          DriverConfig  `yaml:"peer_store"`
+	IPStore            DriverConfig  `yaml:"ip_store"`
+	StringStore        DriverConfig  `yaml:"string_store"`
 }
 
 // DriverConfig represents the configuration for a store driver.
 type DriverConfig struct {
 	Name   string      `yaml:"name"`
 	Config interface{} `yaml:"config"`
+
+	// Clock is the clock the store tells the time with, e.g. to expire
+	// entries and to reap them. It is not configurable, but tests set it to
+	// a clock.Fake. See ClockOrReal.
+	Clock clock.Clock `yaml:"-"`
+}
+
+// ClockOrReal returns the Clock of cfg, or clock.Real if it has none.
+func (cfg *DriverConfig) ClockOrReal() clock.Clock {
+	if cfg.Clock == nil {
+		return clock.Real
+	}
+	return cfg.Clock
+}
+
+// Validate checks the parts of a DriverConfig that are common to all
+// drivers, i.e. that its options, if any, are a mapping of option names to
+// values.
+//
+// Drivers call Validate at the start of New, before checking their own
+// options and allocating any resources.
+func (cfg *DriverConfig) Validate() error {
+	if cfg.Config == nil {
+		return nil
+	}
+
+	bytes, err := yaml.Marshal(cfg.Config)
+	if err != nil {
+		return fmt.Errorf("store: invalid config for driver %q: %s", cfg.Name, err)
+	}
+
+	var options map[string]interface{}
+	err = yaml.Unmarshal(bytes, &options)
+	if err != nil {
+		return fmt.Errorf("store: invalid config for driver %q: options must be a mapping of names to values", cfg.Name)
+	}
+
+	return nil
 }
 
 func newConfig(srvcfg *chihaya.ServerConfig) (*Config, error) {
@@ -96,6 +242,12 @@ func newConfig(srvcfg *chihaya.ServerConfig) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+	if cfg.SwarmStatsInterval <= 0 {
+		cfg.SwarmStatsInterval = time.Minute
+	}
 	return &cfg, nil
 }
 
@@ -115,7 +267,13 @@ type Store struct {
 	cfg      *Config
 	tkr      *tracker.Tracker
 	shutdown chan struct{}
-	sg       *stopper.StopGroup
+	sg       *StopGroup
+
+	// statsStop stops exporting the sizes of the swarms, which is done
+	// once statsDone is closed. Both are nil if the PeerStore is not a
+	// SwarmSizeWalker.
+	statsStop chan struct{}
+	statsDone chan struct{}
 
 	PeerStore
 	IPStore
@@ -127,16 +285,19 @@ func (s *Store) Start() {
 	<-s.shutdown
 }
 
-// Stop stops the store drivers and waits for them to exit.
+// Stop stops the store drivers and waits for them to exit, but no longer than
+// the configured shutdown timeout.
 func (s *Store) Stop() {
-	errors := s.sg.Stop()
-	if len(errors) == 0 {
-		log.Println("Store server shut down cleanly")
+	if s.statsStop != nil {
+		close(s.statsStop)
+		<-s.statsDone
+	}
+
+	err := s.sg.Stop()
+	if err == nil {
+		log.Info("store server shut down cleanly")
 	} else {
-		log.Println("Store server: failed to shutdown drivers")
-		for _, err := range errors {
-			log.Println(err.Error())
-		}
+		log.Error("failed to shut down store server", "error", err)
 	}
 	close(s.shutdown)
 }
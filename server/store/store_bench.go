@@ -7,14 +7,23 @@ package store
 import (
 	"fmt"
 	"net"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/chihaya/chihaya"
 	"github.com/stretchr/testify/require"
 )
 
-const num1KElements = 1000
+const (
+	num1KElements   = 1000
+	num100KElements = 100000
+
+	// numParallelGoroutines is the number of goroutines used by parallel
+	// benchmarks.
+	numParallelGoroutines = 64
+)
 
 // StringStoreBenchmarker is a collection of benchmarks for StringStore drivers.
 // Every benchmark expects a new, clean storage. Every benchmark should be
@@ -342,6 +351,17 @@ type IPStoreBenchmarker interface {
 	AddRemove1KV6Network(*testing.B, *DriverConfig)
 	RemoveNonExist1KV4Network(*testing.B, *DriverConfig)
 	RemoveNonExist1KV6Network(*testing.B, *DriverConfig)
+
+	Add100KV4NetworksSequential(*testing.B, *DriverConfig)
+	Add100KV4NetworksBatch(*testing.B, *DriverConfig)
+
+	Lookup1KV4Parallel(*testing.B, *DriverConfig)
+	Lookup1KV6Parallel(*testing.B, *DriverConfig)
+
+	LookupAnyV4V6(*testing.B, *DriverConfig)
+	LookupAnyV4V6NonExist(*testing.B, *DriverConfig)
+	LookupAllV4V6(*testing.B, *DriverConfig)
+	LookupAllV4V6FirstMiss(*testing.B, *DriverConfig)
 }
 
 func generateV4Networks() (a [num1KElements]string) {
@@ -355,6 +375,15 @@ func generateV4Networks() (a [num1KElements]string) {
 	return
 }
 
+func generate100KV4Networks() []string {
+	a := make([]string, num100KElements)
+	for i := range a {
+		a[i] = fmt.Sprintf("%d.%d.%d.0/24", 1+byte(i>>16), byte(i>>8), byte(i))
+	}
+
+	return a
+}
+
 func generateV6Networks() (a [num1KElements]string) {
 	b := make([]byte, 2)
 	for i := range a {
@@ -395,6 +424,8 @@ type ipStoreBench struct {
 	v4Networks [num1KElements]string
 	v6Networks [num1KElements]string
 
+	v4Networks100K []string
+
 	driver IPStoreDriver
 }
 
@@ -406,7 +437,10 @@ func PrepareIPStoreBenchmarker(driver IPStoreDriver) IPStoreBenchmarker {
 		v6IPs:      generateV6IPs(),
 		v4Networks: generateV4Networks(),
 		v6Networks: generateV6Networks(),
-		driver:     driver,
+
+		v4Networks100K: generate100KV4Networks(),
+
+		driver: driver,
 	}
 }
 
@@ -435,6 +469,38 @@ func (ib ipStoreBench) runBenchmark(b *testing.B, cfg *DriverConfig, setup ipSto
 	require.Nil(b, err, "IPStore shutdown must not fail")
 }
 
+// runParallelBenchmark is like runBenchmark, but calls execute from
+// numParallelGoroutines goroutines concurrently. Every goroutine passes its
+// own, increasing sequence of integers to execute.
+func (ib ipStoreBench) runParallelBenchmark(b *testing.B, cfg *DriverConfig, setup ipStoreSetupFunc, execute ipStoreBenchFunc) {
+	is, err := ib.driver.New(cfg)
+	require.Nil(b, err, "Constructor error must be nil")
+	require.NotNil(b, is, "IP store must not be nil")
+
+	err = setup(is)
+	require.Nil(b, err, "Benchmark setup must not fail")
+
+	procs := runtime.GOMAXPROCS(0)
+	b.SetParallelism((numParallelGoroutines + procs - 1) / procs)
+
+	var offset uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Start every goroutine at a different element, so that they
+		// don't all work on the same one.
+		i := int(atomic.AddUint32(&offset, 1)) * 7
+		for pb.Next() {
+			execute(is, i)
+			i++
+		}
+	})
+	b.StopTimer()
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(b, err, "IPStore shutdown must not fail")
+}
+
 func (ib ipStoreBench) AddV4(b *testing.B, cfg *DriverConfig) {
 	ib.runBenchmark(b, cfg, ipStoreSetupNOP,
 		func(is IPStore, i int) error {
@@ -779,6 +845,40 @@ func (ib ipStoreBench) RemoveNonExist1KV6Network(b *testing.B, cfg *DriverConfig
 		})
 }
 
+func (ib ipStoreBench) Lookup1KV4Parallel(b *testing.B, cfg *DriverConfig) {
+	ib.runParallelBenchmark(b, cfg,
+		func(is IPStore) error {
+			for i := 0; i < num1KElements; i++ {
+				err := is.AddIP(ib.v4IPs[i%num1KElements])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(is IPStore, i int) error {
+			is.HasIP(ib.v4IPs[i%num1KElements])
+			return nil
+		})
+}
+
+func (ib ipStoreBench) Lookup1KV6Parallel(b *testing.B, cfg *DriverConfig) {
+	ib.runParallelBenchmark(b, cfg,
+		func(is IPStore) error {
+			for i := 0; i < num1KElements; i++ {
+				err := is.AddIP(ib.v6IPs[i%num1KElements])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(is IPStore, i int) error {
+			is.HasIP(ib.v6IPs[i%num1KElements])
+			return nil
+		})
+}
+
 // PeerStoreBenchmarker is a collection of benchmarks for PeerStore drivers.
 // Every benchmark expects a new, clean storage. Every benchmark should be
 // called with a DriverConfig that ensures this.
@@ -818,6 +918,8 @@ type PeerStoreBenchmarker interface {
 
 	NumSeeders(*testing.B, *DriverConfig)
 	NumSeeders1KInfohash(*testing.B, *DriverConfig)
+
+	AnnounceParallel1KInfohash(*testing.B, *DriverConfig)
 }
 
 type peerStoreBench struct {
@@ -887,6 +989,38 @@ func (pb peerStoreBench) runBenchmark(b *testing.B, cfg *DriverConfig, setup pee
 	require.Nil(b, err, "PeerStore shutdown must not fail")
 }
 
+// runParallelBenchmark is like runBenchmark, but calls execute from
+// numParallelGoroutines goroutines concurrently. Every goroutine passes its
+// own, increasing sequence of integers to execute.
+func (pb peerStoreBench) runParallelBenchmark(b *testing.B, cfg *DriverConfig, setup peerStoreSetupFunc, execute peerStoreBenchFunc) {
+	ps, err := pb.driver.New(cfg)
+	require.Nil(b, err, "Constructor error must be nil")
+	require.NotNil(b, ps, "Peer store must not be nil")
+
+	err = setup(ps)
+	require.Nil(b, err, "Benchmark setup must not fail")
+
+	procs := runtime.GOMAXPROCS(0)
+	b.SetParallelism((numParallelGoroutines + procs - 1) / procs)
+
+	var offset uint32
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		// Start every goroutine at a different infohash, so that they
+		// don't all announce to the same swarm.
+		i := int(atomic.AddUint32(&offset, 1)) * 7
+		for p.Next() {
+			execute(ps, i)
+			i++
+		}
+	})
+	b.StopTimer()
+
+	errChan := ps.Stop()
+	err = <-errChan
+	require.Nil(b, err, "PeerStore shutdown must not fail")
+}
+
 func (pb peerStoreBench) PutSeeder(b *testing.B, cfg *DriverConfig) {
 	pb.runBenchmark(b, cfg, peerStoreSetupNOP,
 		func(ps PeerStore, i int) error {
@@ -1088,7 +1222,7 @@ func (pb peerStoreBench) AnnouncePeers(b *testing.B, cfg *DriverConfig) {
 			return nil
 		},
 		func(ps PeerStore, i int) error {
-			ps.AnnouncePeers(pb.infohashes[0], false, 50, pb.peers[0], chihaya.Peer{})
+			ps.AnnouncePeers(pb.infohashes[0], false, 50, pb.peers[0], chihaya.Peer{}, SameFamily)
 			return nil
 		})
 }
@@ -1112,7 +1246,7 @@ func (pb peerStoreBench) AnnouncePeers1KInfohash(b *testing.B, cfg *DriverConfig
 			return nil
 		},
 		func(ps PeerStore, i int) error {
-			ps.AnnouncePeers(pb.infohashes[i%num1KElements], false, 50, pb.peers[0], chihaya.Peer{})
+			ps.AnnouncePeers(pb.infohashes[i%num1KElements], false, 50, pb.peers[0], chihaya.Peer{}, SameFamily)
 			return nil
 		})
 }
@@ -1136,7 +1270,7 @@ func (pb peerStoreBench) AnnouncePeersSeeder(b *testing.B, cfg *DriverConfig) {
 			return nil
 		},
 		func(ps PeerStore, i int) error {
-			ps.AnnouncePeers(pb.infohashes[0], true, 50, pb.peers[0], chihaya.Peer{})
+			ps.AnnouncePeers(pb.infohashes[0], true, 50, pb.peers[0], chihaya.Peer{}, SameFamily)
 			return nil
 		})
 }
@@ -1160,7 +1294,7 @@ func (pb peerStoreBench) AnnouncePeersSeeder1KInfohash(b *testing.B, cfg *Driver
 			return nil
 		},
 		func(ps PeerStore, i int) error {
-			ps.AnnouncePeers(pb.infohashes[i%num1KElements], true, 50, pb.peers[0], chihaya.Peer{})
+			ps.AnnouncePeers(pb.infohashes[i%num1KElements], true, 50, pb.peers[0], chihaya.Peer{}, SameFamily)
 			return nil
 		})
 }
@@ -1260,3 +1394,98 @@ func (pb peerStoreBench) NumSeeders1KInfohash(b *testing.B, cfg *DriverConfig) {
 			return nil
 		})
 }
+
+func (ib ipStoreBench) Add100KV4NetworksSequential(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ipStoreSetupNOP,
+		func(is IPStore, i int) error {
+			for _, network := range ib.v4Networks100K {
+				is.AddNetwork(network)
+			}
+			return nil
+		})
+}
+
+func (ib ipStoreBench) Add100KV4NetworksBatch(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ipStoreSetupNOP,
+		func(is IPStore, i int) error {
+			is.AddNetworks(ib.v4Networks100K)
+			return nil
+		})
+}
+
+// setupV4V6 stores the first half of the IPv4 networks and the individual
+// IPv6 IPs, so that the IPv4 IPs of the first half are only contained in a
+// network and the IPv6 IPs of the first half individually.
+func (ib ipStoreBench) setupV4V6(is IPStore) error {
+	err := is.AddNetworks(ib.v4Networks[:num1KElements/2])
+	if err != nil {
+		return err
+	}
+	for _, ip := range ib.v6IPs[:num1KElements/2] {
+		err = is.AddIP(ip)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ib ipStoreBench) LookupAnyV4V6(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ib.setupV4V6,
+		func(is IPStore, i int) error {
+			i %= num1KElements / 2
+			is.HasAnyIP([]net.IP{ib.v4IPs[i], ib.v6IPs[i]})
+			return nil
+		})
+}
+
+func (ib ipStoreBench) LookupAnyV4V6NonExist(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ib.setupV4V6,
+		func(is IPStore, i int) error {
+			i = num1KElements/2 + i%(num1KElements/2)
+			is.HasAnyIP([]net.IP{ib.v4IPs[i], ib.v6IPs[i]})
+			return nil
+		})
+}
+
+func (ib ipStoreBench) LookupAllV4V6(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ib.setupV4V6,
+		func(is IPStore, i int) error {
+			i %= num1KElements / 2
+			is.HasAllIPs([]net.IP{ib.v4IPs[i], ib.v6IPs[i]})
+			return nil
+		})
+}
+
+func (ib ipStoreBench) LookupAllV4V6FirstMiss(b *testing.B, cfg *DriverConfig) {
+	ib.runBenchmark(b, cfg, ib.setupV4V6,
+		func(is IPStore, i int) error {
+			i %= num1KElements / 2
+			is.HasAllIPs([]net.IP{ib.v4IPs[num1KElements/2+i], ib.v6IPs[i]})
+			return nil
+		})
+}
+
+// AnnounceParallel1KInfohash announces to 1K distinct swarms of 50 peers each
+// from numParallelGoroutines goroutines, the way a tracker handles announces
+// to unrelated torrents.
+func (pb peerStoreBench) AnnounceParallel1KInfohash(b *testing.B, cfg *DriverConfig) {
+	pb.runParallelBenchmark(b, cfg,
+		func(ps PeerStore) error {
+			for i := 0; i < num1KElements; i++ {
+				for j := 0; j < 50; j++ {
+					err := ps.PutSeeder(pb.infohashes[i], pb.peers[j])
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		func(ps PeerStore, i int) error {
+			infohash, peer := pb.infohashes[i%num1KElements], pb.peers[(i/num1KElements)%num1KElements]
+			ps.PutLeecher(infohash, peer)
+			ps.AnnouncePeers(infohash, false, 50, peer, chihaya.Peer{}, SameFamily)
+			return nil
+		})
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriverConfigValidate(t *testing.T) {
+	var table = []struct {
+		config interface{}
+		valid  bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"shards": 32}, true},
+		{map[interface{}]interface{}{"shards": 32}, true},
+		{struct{ Shards int }{32}, true},
+		{"shards: 32", false},
+		{[]string{"shards", "32"}, false},
+		{42, false},
+	}
+
+	for _, tt := range table {
+		err := (&DriverConfig{Name: "memory", Config: tt.config}).Validate()
+		if tt.valid {
+			require.Nil(t, err, "%#v", tt.config)
+		} else {
+			require.NotNil(t, err, "%#v", tt.config)
+		}
+	}
+}
+
+type fakeIPStoreDriver struct{}
+
+func (fakeIPStoreDriver) New(*DriverConfig) (IPStore, error) { return nil, nil }
+
+type fakePeerStoreDriver struct{}
+
+func (fakePeerStoreDriver) New(*DriverConfig) (PeerStore, error) { return nil, nil }
+
+type fakeStringStoreDriver struct{}
+
+func (fakeStringStoreDriver) New(*DriverConfig) (StringStore, error) { return nil, nil }
+
+func TestRegisteredDrivers(t *testing.T) {
+	RegisterIPStoreDriver("registered_test_b", fakeIPStoreDriver{})
+	RegisterIPStoreDriver("registered_test_a", fakeIPStoreDriver{})
+	RegisterPeerStoreDriver("registered_test_a", fakePeerStoreDriver{})
+	RegisterStringStoreDriver("registered_test_a", fakeStringStoreDriver{})
+
+	// Other tests of the package register the real drivers.
+	registered := func(names []string) []string {
+		var test []string
+		for _, name := range names {
+			if strings.HasPrefix(name, "registered_test_") {
+				test = append(test, name)
+			}
+		}
+		return test
+	}
+	require.Equal(t, []string{"registered_test_a", "registered_test_b"}, registered(RegisteredIPStoreDrivers()))
+	require.Equal(t, []string{"registered_test_a"}, registered(RegisteredPeerStoreDrivers()))
+	require.Equal(t, []string{"registered_test_a"}, registered(RegisteredStringStoreDrivers()))
+
+	// unknown drivers are reported along with the registered ones
+	_, err := OpenIPStore(&DriverConfig{Name: "missing"})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), `"missing"`), err.Error())
+	require.True(t, strings.Contains(err.Error(), "registered_test_a, registered_test_b"), err.Error())
+}
+
+func TestRegisteredDriversConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterPeerStoreDriver(fmt.Sprintf("concurrent_test_%d", i), fakePeerStoreDriver{})
+		}(i)
+		go func() {
+			defer wg.Done()
+			RegisteredPeerStoreDrivers()
+		}()
+	}
+	wg.Wait()
+
+	var registered int
+	for _, name := range RegisteredPeerStoreDrivers() {
+		if strings.HasPrefix(name, "concurrent_test_") {
+			registered++
+		}
+	}
+	require.Equal(t, 8, registered)
+}
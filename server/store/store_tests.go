@@ -5,6 +5,9 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"net"
@@ -94,6 +97,48 @@ func (s *stringStoreTester) TestStringStore(t *testing.T, cfg *DriverConfig) {
 	require.Nil(t, err)
 	require.False(t, has)
 
+	// Strings are present until they expire, and can be removed before.
+	err = ss.PutStringWithExpiry(s.s1, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+
+	has, err = ss.HasString(s.s1)
+	require.Nil(t, err)
+	require.True(t, has)
+
+	err = ss.RemoveString(s.s1)
+	require.Nil(t, err)
+
+	has, err = ss.HasString(s.s1)
+	require.Nil(t, err)
+	require.False(t, has)
+
+	// Strings that expired already are absent, even if they were present.
+	err = ss.PutString(s.s2)
+	require.Nil(t, err)
+
+	err = ss.PutStringWithExpiry(s.s2, time.Now().Add(-time.Second))
+	require.Nil(t, err)
+
+	has, err = ss.HasString(s.s2)
+	require.Nil(t, err)
+	require.False(t, has)
+
+	// Any of several strings is looked up at once.
+	has, err = HasAnyString(ss, []string{s.s1, s.s2})
+	require.Nil(t, err)
+	require.False(t, has)
+
+	err = ss.PutString(s.s2)
+	require.Nil(t, err)
+
+	has, err = HasAnyString(ss, []string{s.s1, s.s2})
+	require.Nil(t, err)
+	require.True(t, has)
+
+	has, err = HasAnyString(ss, nil)
+	require.Nil(t, err)
+	require.False(t, has)
+
 	errChan := ss.Stop()
 	err = <-errChan
 	require.Nil(t, err, "StringStore shutdown must not fail")
@@ -107,6 +152,18 @@ type IPStoreTester interface {
 	TestHasAllHasAny(*testing.T, *DriverConfig)
 	TestNetworks(*testing.T, *DriverConfig)
 	TestHasAllHasAnyNetworks(*testing.T, *DriverConfig)
+	TestAddNetworks(*testing.T, *DriverConfig)
+	TestIPRange(*testing.T, *DriverConfig)
+	TestCarveNetwork(*testing.T, *DriverConfig)
+	TestRange(*testing.T, *DriverConfig)
+	TestHasNetwork(*testing.T, *DriverConfig)
+	TestCount(*testing.T, *DriverConfig)
+	TestExpiry(*testing.T, *DriverConfig)
+	TestBatch(*testing.T, *DriverConfig)
+	TestBatchConcurrentReads(*testing.T, *DriverConfig)
+	TestBatchMoveConcurrentReads(*testing.T, *DriverConfig)
+	TestReplaceAll(*testing.T, *DriverConfig)
+	TestReplaceAllConcurrentReads(*testing.T, *DriverConfig)
 }
 
 var _ IPStoreTester = &ipStoreTester{}
@@ -355,172 +412,1692 @@ func (s *ipStoreTester) TestHasAllHasAnyNetworks(t *testing.T, cfg *DriverConfig
 	require.Nil(t, err, "IPStore shutdown must not fail")
 }
 
-// PeerStoreTester is a collection of tests for a PeerStore driver.
-// Every benchmark expects a new, clean storage. Every benchmark should be
-// called with a DriverConfig that ensures this.
-type PeerStoreTester interface {
-	// CompareEndpoints sets the function used to compare peers to a
-	// comparison that only compares endpoints and omits PeerIDs.
-	CompareEndpoints()
+func (s *ipStoreTester) TestAddNetworks(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
 
-	TestPeerStore(*testing.T, *DriverConfig)
-}
+	err = is.AddNetworks(nil)
+	require.Nil(t, err)
 
-var _ PeerStoreTester = &peerStoreTester{}
+	// a malformed network must not commit any of the valid ones
+	err = is.AddNetworks([]string{s.net1, "", s.net2})
+	require.NotNil(t, err)
+	invalid, ok := err.(InvalidNetworkError)
+	require.True(t, ok)
+	require.Equal(t, 1, invalid.Index)
+	require.Equal(t, "", invalid.Network)
 
-type peerStoreTester struct {
-	driver       PeerStoreDriver
-	equalityFunc func(a, b chihaya.Peer) bool
-}
+	match, err := is.HasAnyIP([]net.IP{s.inNet1, s.inNet2})
+	require.Nil(t, err)
+	require.False(t, match)
 
-// PreparePeerStoreTester prepares a reusable suite for PeerStore driver
-// tests.
-// The tester will use PeerIDs and endpoints to compare peers.
-func PreparePeerStoreTester(driver PeerStoreDriver) PeerStoreTester {
-	return &peerStoreTester{
-		driver:       driver,
-		equalityFunc: func(a, b chihaya.Peer) bool { return a.Equal(b) },
-	}
-}
+	err = is.AddNetworks([]string{s.net1, s.net2})
+	require.Nil(t, err)
 
-func (pt *peerStoreTester) CompareEndpoints() {
-	pt.equalityFunc = func(a, b chihaya.Peer) bool { return a.EqualEndpoint(b) }
-}
+	match, err = is.HasAllIPs([]net.IP{s.inNet1, s.inNet2})
+	require.Nil(t, err)
+	require.True(t, match)
 
-func (pt *peerStoreTester) peerInSlice(peer chihaya.Peer, peers []chihaya.Peer) bool {
-	for _, v := range peers {
-		if pt.equalityFunc(peer, v) {
-			return true
-		}
-	}
-	return false
+	match, err = is.HasIP(s.excluded)
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.RemoveNetwork(s.net1)
+	require.Nil(t, err)
+
+	err = is.RemoveNetwork(s.net2)
+	require.Nil(t, err)
+
+	match, err = is.HasAnyIP([]net.IP{s.inNet1, s.inNet2})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
 }
 
-func (pt *peerStoreTester) TestPeerStore(t *testing.T, cfg *DriverConfig) {
-	var (
-		hash = chihaya.InfoHash([20]byte{})
+func (s *ipStoreTester) TestIPRange(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
 
-		peers = []struct {
-			seeder bool
-			peerID string
-			ip     string
-			port   uint16
-		}{
-			{false, "-AZ3034-6wfG2wk6wWLc", "250.183.81.177", 5720},
-			{false, "-AZ3042-6ozMq5q6Q3NX", "38.241.13.19", 4833},
-			{false, "-BS5820-oy4La2MWGEFj", "fd45:7856:3dae::48", 2878},
-			{false, "-AR6360-6oZyyMWoOOBe", "fd0a:29a8:8445::38", 3167},
-			{true, "-AG2083-s1hiF8vGAAg0", "231.231.49.173", 1453},
-			{true, "-AG3003-lEl2Mm4NEO4n", "254.99.84.77", 7032},
-			{true, "-MR1100-00HS~T7*65rm", "211.229.100.129", 2614},
-			{true, "-LK0140-ATIV~nbEQAMr", "fdad:c435:bf79::12", 4114},
-			{true, "-KT2210-347143496631", "fdda:1b35:7d6e::9", 6179},
-			{true, "-TR0960-6ep6svaa61r4", "fd7f:78f0:4c77::55", 4727},
-		}
-	)
-	s, err := pt.driver.New(cfg)
+	start, end := net.ParseIP("1.2.3.0"), net.ParseIP("1.2.7.255")
+	err = is.AddIPRange(end, start)
+	require.Equal(t, ErrIPRangeReversed, err)
+	err = is.AddIPRange(start, s.v6)
+	require.Equal(t, ErrIPRangeMixedFamilies, err)
+
+	err = is.AddIPRange(start, end)
 	require.Nil(t, err)
-	require.NotNil(t, s)
 
-	for _, p := range peers {
-		// Construct chihaya.Peer from test data.
-		peer := chihaya.Peer{
-			ID:   chihaya.PeerIDFromString(p.peerID),
-			IP:   net.ParseIP(p.ip),
-			Port: p.port,
-		}
+	numNetworks, err := is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numNetworks)
 
-		if p.seeder {
-			err = s.PutSeeder(hash, peer)
-		} else {
-			err = s.PutLeecher(hash, peer)
-		}
-		require.Nil(t, err)
-	}
+	match, err := is.HasAllIPs([]net.IP{start, end, net.ParseIP("1.2.5.5")})
+	require.Nil(t, err)
+	require.True(t, match)
 
-	leechers1, leechers61, err := s.GetLeechers(hash)
+	match, err = is.HasAnyIP([]net.IP{net.ParseIP("1.2.2.255"), net.ParseIP("1.2.8.0")})
 	require.Nil(t, err)
-	require.NotEmpty(t, leechers1)
-	require.NotEmpty(t, leechers61)
-	num := s.NumLeechers(hash)
-	require.Equal(t, len(leechers1)+len(leechers61), num)
+	require.False(t, match)
 
-	seeders1, seeders61, err := s.GetSeeders(hash)
+	match, err = is.HasNetwork("1.2.4.0/22")
 	require.Nil(t, err)
-	require.NotEmpty(t, seeders1)
-	require.NotEmpty(t, seeders61)
-	num = s.NumSeeders(hash)
-	require.Equal(t, len(seeders1)+len(seeders61), num)
+	require.True(t, match)
 
-	leechers := append(leechers1, leechers61...)
-	seeders := append(seeders1, seeders61...)
+	// a range that is only partly stored is not removed at all
+	err = is.AddIPRange(net.ParseIP("fd00::ffff"), net.ParseIP("fd00::1:0"))
+	require.Nil(t, err)
+	err = is.RemoveNetwork("fd00::1:0/128")
+	require.Nil(t, err)
+	err = is.RemoveIPRange(net.ParseIP("fd00::ffff"), net.ParseIP("fd00::1:0"))
+	require.Equal(t, ErrResourceDoesNotExist, err)
+	match, err = is.HasIP(net.ParseIP("fd00::ffff"))
+	require.Nil(t, err)
+	require.True(t, match)
 
-	for _, p := range peers {
-		// Construct chihaya.Peer from test data.
-		peer := chihaya.Peer{
-			ID:   chihaya.PeerIDFromString(p.peerID),
-			IP:   net.ParseIP(p.ip),
-			Port: p.port,
-		}
+	err = is.RemoveIPRange(start, end)
+	require.Nil(t, err)
+	err = is.RemoveIPRange(start, end)
+	require.Equal(t, ErrResourceDoesNotExist, err)
 
-		if p.seeder {
-			require.True(t, pt.peerInSlice(peer, seeders))
-		} else {
-			require.True(t, pt.peerInSlice(peer, leechers))
-		}
+	match, err = is.HasAnyIP([]net.IP{start, end})
+	require.Nil(t, err)
+	require.False(t, match)
 
-		if p.seeder {
-			err = s.DeleteSeeder(hash, peer)
-		} else {
-			err = s.DeleteLeecher(hash, peer)
-		}
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestCarveNetwork(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	hasIP := func(ip string) bool {
+		match, err := is.HasIP(net.ParseIP(ip))
 		require.Nil(t, err)
+		return match
 	}
 
-	require.Zero(t, s.NumLeechers(hash))
-	require.Zero(t, s.NumSeeders(hash))
+	err = is.CarveNetwork("10.0.5.0/33")
+	require.NotNil(t, err)
 
-	// Re-add all the peers to the peerStore.
-	for _, p := range peers {
-		// Construct chihaya.Peer from test data.
-		peer := chihaya.Peer{
-			ID:   chihaya.PeerIDFromString(p.peerID),
-			IP:   net.ParseIP(p.ip),
-			Port: p.port,
-		}
-		if p.seeder {
-			s.PutSeeder(hash, peer)
-		} else {
-			s.PutLeecher(hash, peer)
-		}
-	}
+	// not covered at all
+	err = is.CarveNetwork("10.0.5.0/24")
+	require.Equal(t, ErrResourceDoesNotExist, err)
 
-	// Check that there are 6 seeders, and 4 leechers.
-	require.Equal(t, 6, s.NumSeeders(hash))
-	require.Equal(t, 4, s.NumLeechers(hash))
-	peer := chihaya.Peer{
-		ID:   chihaya.PeerIDFromString(peers[0].peerID),
-		IP:   net.ParseIP(peers[0].ip),
-		Port: peers[0].port,
-	}
-	err = s.GraduateLeecher(hash, peer)
+	err = is.AddNetwork("10.0.0.0/16")
 	require.Nil(t, err)
-	// Check that there are 7 seeders, and 3 leechers after graduating a
-	// leecher to a seeder.
-	require.Equal(t, 7, s.NumSeeders(hash))
-	require.Equal(t, 3, s.NumLeechers(hash))
+	err = is.CarveNetwork("10.1.0.0/24")
+	require.Equal(t, ErrResourceDoesNotExist, err)
 
-	_, _, err = s.AnnouncePeers(hash, true, 5, peer, chihaya.Peer{})
-	// Only test if it works, do not test the slices returned. They change
-	// depending on the driver.
+	// subset
+	err = is.CarveNetwork("10.0.5.0/24")
 	require.Nil(t, err)
+	require.False(t, hasIP("10.0.5.0"))
+	require.False(t, hasIP("10.0.5.255"))
+	require.True(t, hasIP("10.0.4.255"))
+	require.True(t, hasIP("10.0.6.0"))
+	require.True(t, hasIP("10.0.0.0"))
+	require.True(t, hasIP("10.0.255.255"))
 
-	err = s.CollectGarbage(time.Now())
+	numNetworks, err := is.NumNetworks()
 	require.Nil(t, err)
-	require.Equal(t, 0, s.NumLeechers(hash))
-	require.Equal(t, 0, s.NumSeeders(hash))
+	require.Equal(t, uint64(8), numNetworks)
 
-	errChan := s.Stop()
+	covered, err := is.HasNetwork("10.0.128.0/17")
+	require.Nil(t, err)
+	require.True(t, covered)
+
+	// The carved network is no longer stored.
+	err = is.RemoveNetwork("10.0.0.0/16")
+	require.Equal(t, ErrResourceDoesNotExist, err)
+	err = is.CarveNetwork("10.0.5.0/24")
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	// exact match
+	err = is.CarveNetwork("10.0.128.0/17")
+	require.Nil(t, err)
+	require.False(t, hasIP("10.0.200.1"))
+	numNetworks, err = is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(7), numNetworks)
+
+	// supernets and subnets of the carved network are all carved
+	err = is.AddNetworks([]string{"fd00::/16", "fd00::/32", "fd00:0:1::/48"})
+	require.Nil(t, err)
+	err = is.AddIP(net.ParseIP("fd00::1"))
+	require.Nil(t, err)
+	err = is.CarveNetwork("fd00::/31")
+	require.Nil(t, err)
+	require.False(t, hasIP("fd00:0:1::1"))
+	require.False(t, hasIP("fd00:1::1"))
+	require.True(t, hasIP("fd00:2::1"))
+	require.True(t, hasIP("fd00::1"), "individual IPs must not be carved")
+	numNetworks, err = is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(7+15), numNetworks)
+
+	// expired networks are not carved
+	err = is.AddNetworkWithExpiry("192.168.0.0/16", time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	err = is.CarveNetwork("192.168.1.0/24")
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	errChan := is.Stop()
 	err = <-errChan
-	require.Nil(t, err, "PeerStore shutdown must not fail")
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestRange(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	// empty store
+	err = is.RangeIPs(func(net.IP) bool {
+		t.Fatal("RangeIPs called fn on an empty store")
+		return true
+	})
+	require.Nil(t, err)
+
+	err = is.RangeNetworks(func(*net.IPNet) bool {
+		t.Fatal("RangeNetworks called fn on an empty store")
+		return true
+	})
+	require.Nil(t, err)
+
+	// v4 and v4s are the same address and must only be reported once
+	err = is.AddIP(s.v4)
+	require.Nil(t, err)
+	err = is.AddIP(s.v4s)
+	require.Nil(t, err)
+	err = is.AddIP(s.v6)
+	require.Nil(t, err)
+
+	ips := make(map[string]net.IP)
+	err = is.RangeIPs(func(ip net.IP) bool {
+		ips[ip.String()] = ip
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ips))
+	require.Equal(t, net.IPv4len, len(ips[s.v4.String()]))
+	require.True(t, ips[s.v6.String()].Equal(s.v6))
+
+	err = is.AddNetwork(s.net1)
+	require.Nil(t, err)
+	err = is.AddNetwork(s.net2)
+	require.Nil(t, err)
+
+	networks := make(map[string]*net.IPNet)
+	err = is.RangeNetworks(func(network *net.IPNet) bool {
+		networks[network.String()] = network
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(networks))
+	require.Contains(t, networks, "192.168.22.0/24")
+	require.Contains(t, networks, "192.168.23.0/24")
+	require.True(t, networks["192.168.22.0/24"].Contains(s.inNet1))
+
+	// returning false stops the iteration
+	calls := 0
+	err = is.RangeIPs(func(net.IP) bool {
+		calls++
+		return false
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = is.RangeNetworks(func(*net.IPNet) bool {
+		calls++
+		return false
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, calls)
+
+	// removed entries are no longer reported
+	err = is.RemoveIP(s.v6)
+	require.Nil(t, err)
+	err = is.RemoveNetwork(s.net1)
+	require.Nil(t, err)
+
+	ips = make(map[string]net.IP)
+	err = is.RangeIPs(func(ip net.IP) bool {
+		ips[ip.String()] = ip
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ips))
+	require.Contains(t, ips, s.v4.String())
+
+	networks = make(map[string]*net.IPNet)
+	err = is.RangeNetworks(func(network *net.IPNet) bool {
+		networks[network.String()] = network
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(networks))
+	require.Contains(t, networks, "192.168.23.0/24")
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestHasNetwork(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	_, err = is.HasNetwork("")
+	require.NotNil(t, err)
+
+	_, err = is.HasNetwork("192.168.22.0/33")
+	require.NotNil(t, err)
+
+	match, err := is.HasNetwork(s.net1)
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.AddNetwork(s.net1)
+	require.Nil(t, err)
+
+	var table = []struct {
+		network  string
+		expected bool
+	}{
+		{s.net1, true},
+		{"192.168.22.0/24", true},
+		{"192.168.22.128/25", true},
+		{"192.168.22.22/32", true},
+		{"192.168.22.0/23", false},
+		{"192.168.23.0/24", false},
+		{"10.154.243.0/24", false},
+	}
+	for _, tt := range table {
+		match, err = is.HasNetwork(tt.network)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, match, tt.network)
+	}
+
+	// a network covered by several smaller ones
+	err = is.AddNetwork(s.net2)
+	require.Nil(t, err)
+
+	match, err = is.HasNetwork("192.168.22.0/23")
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasNetwork("192.168.20.0/22")
+	require.Nil(t, err)
+	require.False(t, match)
+
+	// a /32 behaves like HasIP
+	match, err = is.HasNetwork("12.13.14.15/32")
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.AddIP(s.v4)
+	require.Nil(t, err)
+
+	match, err = is.HasNetwork("12.13.14.15/32")
+	require.Nil(t, err)
+	require.True(t, match)
+
+	// a network covered by individual IPs
+	match, err = is.HasNetwork("12.13.14.14/31")
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.AddIP(net.ParseIP("12.13.14.14"))
+	require.Nil(t, err)
+
+	match, err = is.HasNetwork("12.13.14.14/31")
+	require.Nil(t, err)
+	require.True(t, match)
+
+	err = is.AddIP(s.v6)
+	require.Nil(t, err)
+
+	match, err = is.HasNetwork(s.v6.String() + "/128")
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasNetwork(s.v6.String() + "/127")
+	require.Nil(t, err)
+	require.False(t, match)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestCount(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	requireCounts := func(ips, networks uint64) {
+		n, err := is.NumIPs()
+		require.Nil(t, err)
+		require.Equal(t, ips, n)
+
+		n, err = is.NumNetworks()
+		require.Nil(t, err)
+		require.Equal(t, networks, n)
+	}
+
+	requireCounts(0, 0)
+
+	// v4 and v4s are the same address
+	err = is.AddIP(s.v4)
+	require.Nil(t, err)
+	err = is.AddIP(s.v4s)
+	require.Nil(t, err)
+	err = is.AddIP(s.v6)
+	require.Nil(t, err)
+	requireCounts(2, 0)
+
+	// net1 and its normalized form are the same network
+	err = is.AddNetwork(s.net1)
+	require.Nil(t, err)
+	err = is.AddNetwork("192.168.22.0/24")
+	require.Nil(t, err)
+	err = is.AddNetworks([]string{s.net2})
+	require.Nil(t, err)
+	requireCounts(2, 2)
+
+	// failed removals must not change the counts
+	err = is.RemoveIP(s.excluded)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+	err = is.RemoveNetwork("10.154.243.0/24")
+	require.Equal(t, ErrResourceDoesNotExist, err)
+	requireCounts(2, 2)
+
+	err = is.RemoveIP(s.v4s)
+	require.Nil(t, err)
+	err = is.RemoveNetwork(s.net2)
+	require.Nil(t, err)
+	requireCounts(1, 1)
+
+	err = is.RemoveIP(s.v4)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+	requireCounts(1, 1)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestExpiry(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	// expired entries must be treated as absent, even if they were not
+	// removed yet
+	err = is.AddIPWithExpiry(s.v4, past)
+	require.Nil(t, err)
+	err = is.AddIPWithExpiry(s.v6, future)
+	require.Nil(t, err)
+
+	match, err := is.HasIP(s.v4)
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasIP(s.v6)
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasAnyIP([]net.IP{s.v4, s.excluded})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasAllIPs([]net.IP{s.v4, s.v6})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasNetwork(s.v4.String() + "/32")
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.RangeIPs(func(ip net.IP) bool {
+		require.True(t, ip.Equal(s.v6))
+		return true
+	})
+	require.Nil(t, err)
+
+	err = is.RemoveIP(s.v4)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	err = is.AddNetworkWithExpiry(s.net1, past)
+	require.Nil(t, err)
+	err = is.AddNetworkWithExpiry(s.net2, future)
+	require.Nil(t, err)
+
+	match, err = is.HasIP(s.inNet1)
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasIP(s.inNet2)
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasNetwork(s.net1)
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasNetwork(s.net2)
+	require.Nil(t, err)
+	require.True(t, match)
+
+	err = is.RangeNetworks(func(network *net.IPNet) bool {
+		require.Equal(t, "192.168.23.0/24", network.String())
+		return true
+	})
+	require.Nil(t, err)
+
+	// adding an entry again replaces its expiry
+	err = is.AddIP(s.v4)
+	require.Nil(t, err)
+	err = is.AddNetwork(s.net1)
+	require.Nil(t, err)
+
+	match, err = is.HasAllIPs([]net.IP{s.v4, s.inNet1})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	err = is.AddIPWithExpiry(s.v6, past)
+	require.Nil(t, err)
+	err = is.AddNetworkWithExpiry(s.net2, past)
+	require.Nil(t, err)
+
+	match, err = is.HasAnyIP([]net.IP{s.v6, s.inNet2})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.RemoveNetwork(s.net2)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	err = is.RemoveNetwork(s.net1)
+	require.Nil(t, err)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestBatch(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	err = is.AddIP(s.v6)
+	require.Nil(t, err)
+	err = is.AddNetwork(s.net1)
+	require.Nil(t, err)
+
+	// nothing is visible before the batch is committed
+	b := is.Batch()
+	require.Nil(t, b.AddIP(s.v4))
+	require.Nil(t, b.AddNetwork(s.net2))
+	require.Nil(t, b.RemoveIP(s.v6))
+	require.Nil(t, b.RemoveNetwork(s.net1))
+
+	match, err := is.HasAnyIP([]net.IP{s.v4, s.inNet2})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	match, err = is.HasAllIPs([]net.IP{s.v6, s.inNet1})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	require.Nil(t, b.Commit())
+
+	match, err = is.HasAllIPs([]net.IP{s.v4, s.inNet2})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasAnyIP([]net.IP{s.v6, s.inNet1})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	// a finished batch can't be used anymore
+	require.Equal(t, ErrBatchDone, b.AddIP(s.v6))
+	require.Equal(t, ErrBatchDone, b.Commit())
+	require.Equal(t, ErrBatchDone, b.Rollback())
+
+	// removing something that doesn't exist fails at the call site, but
+	// the batch remains usable
+	b = is.Batch()
+	require.Nil(t, b.AddIP(s.v6))
+	require.Equal(t, ErrResourceDoesNotExist, b.RemoveNetwork(s.net1))
+	require.Equal(t, ErrResourceDoesNotExist, b.RemoveIP(s.excluded))
+
+	// modifications of the batch are taken into account
+	require.Nil(t, b.RemoveIP(s.v6))
+	require.Equal(t, ErrResourceDoesNotExist, b.RemoveIP(s.v6))
+	require.Nil(t, b.AddNetwork(s.net1))
+	require.Nil(t, b.RemoveNetwork(s.net1))
+	require.Nil(t, b.RemoveNetwork(s.net2))
+	require.Equal(t, ErrResourceDoesNotExist, b.RemoveNetwork(s.net2))
+
+	require.NotNil(t, b.AddNetwork(""))
+
+	// rolling back discards everything
+	require.Nil(t, b.Rollback())
+	require.Equal(t, ErrBatchDone, b.Commit())
+
+	match, err = is.HasAllIPs([]net.IP{s.v4, s.inNet2})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	match, err = is.HasAnyIP([]net.IP{s.v6, s.inNet1})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestBatchConcurrentReads(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	// the batch replaces the old IPs with the new ones
+	var oldIPs, newIPs []net.IP
+	for i := 0; i < 1000; i++ {
+		oldIPs = append(oldIPs, net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+		newIPs = append(newIPs, net.ParseIP(fmt.Sprintf("10.1.%d.%d", i/256, i%256)))
+	}
+
+	b := is.Batch()
+	for _, ip := range oldIPs {
+		require.Nil(t, b.AddIP(ip))
+	}
+	require.Nil(t, b.Commit())
+
+	b = is.Batch()
+	for i := range oldIPs {
+		require.Nil(t, b.RemoveIP(oldIPs[i]))
+		require.Nil(t, b.AddIP(newIPs[i]))
+	}
+
+	stop := make(chan struct{})
+	failures := make(chan string, 8)
+	var started, wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			for {
+				if first {
+					started.Done()
+					first = false
+				}
+
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// Once any of the old IPs is gone, the batch must
+				// have been applied completely.
+				hasOld, err := is.HasAllIPs(oldIPs)
+				if err != nil {
+					failures <- err.Error()
+					return
+				}
+				if hasOld {
+					continue
+				}
+
+				hasNew, err := is.HasAllIPs(newIPs)
+				if err != nil {
+					failures <- err.Error()
+					return
+				}
+				if !hasNew {
+					failures <- "observed a partially committed batch"
+					return
+				}
+			}
+		}()
+	}
+
+	// make sure the readers are running while the batch is committed
+	started.Wait()
+	require.Nil(t, b.Commit())
+	close(stop)
+	wg.Wait()
+	close(failures)
+
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	match, err := is.HasAllIPs(newIPs)
+	require.Nil(t, err)
+	require.True(t, match)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestBatchMoveConcurrentReads(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	// The batches move the probed IPs back and forth between a network
+	// that covers them and individual IPs, so that a lookup that sees the
+	// IPs before and the networks after a batch, or vice versa, would miss
+	// them.
+	network := "10.0.0.0/24"
+	var probed []net.IP
+	for i := 0; i < 100; i++ {
+		probed = append(probed, net.ParseIP(fmt.Sprintf("10.0.0.%d", i)))
+	}
+	absent := net.ParseIP("172.16.0.1")
+	require.Nil(t, is.AddNetwork(network))
+
+	stop := make(chan struct{})
+	failures := make(chan string, 8)
+	var started, wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				ip := probed[i%len(probed)]
+				i++
+
+				match, err := is.HasIP(ip)
+				if err == nil && !match {
+					err = fmt.Errorf("HasIP missed %s", ip)
+				}
+				if err == nil {
+					match, err = is.HasAnyIP([]net.IP{absent, ip})
+					if err == nil && !match {
+						err = fmt.Errorf("HasAnyIP missed %s", ip)
+					}
+				}
+				if err == nil {
+					match, err = is.HasAllIPs(probed)
+					if err == nil && !match {
+						err = errors.New("HasAllIPs missed a probed IP")
+					}
+				}
+				if err != nil {
+					failures <- err.Error()
+					return
+				}
+			}
+		}(i)
+	}
+
+	// make sure the readers are running while the batches are committed
+	started.Wait()
+	for i := 0; i < 50; i++ {
+		b := is.Batch()
+		if i%2 == 0 {
+			for _, ip := range probed {
+				require.Nil(t, b.AddIP(ip))
+			}
+			require.Nil(t, b.RemoveNetwork(network))
+		} else {
+			require.Nil(t, b.AddNetwork(network))
+			for _, ip := range probed {
+				require.Nil(t, b.RemoveIP(ip))
+			}
+		}
+		require.Nil(t, b.Commit())
+	}
+	close(stop)
+	wg.Wait()
+	close(failures)
+
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+// PeerStoreTester is a collection of tests for a PeerStore driver.
+// Every benchmark expects a new, clean storage. Every benchmark should be
+// called with a DriverConfig that ensures this.
+type PeerStoreTester interface {
+	// CompareEndpoints sets the function used to compare peers to a
+	// comparison that only compares endpoints and omits PeerIDs.
+	CompareEndpoints()
+
+	TestPeerStore(*testing.T, *DriverConfig)
+	TestAnnouncePeersFamilies(*testing.T, *DriverConfig)
+	TestDownloaded(*testing.T, *DriverConfig)
+	TestPeerEvents(*testing.T, *DriverConfig)
+	TestAnnounceFamilyPolicies(*testing.T, *DriverConfig)
+	TestReannounce(*testing.T, *DriverConfig)
+	TestKeys(*testing.T, *DriverConfig)
+	TestRequireCrypto(*testing.T, *DriverConfig)
+	TestHasPeer(*testing.T, *DriverConfig)
+}
+
+var _ PeerStoreTester = &peerStoreTester{}
+
+type peerStoreTester struct {
+	driver       PeerStoreDriver
+	equalityFunc func(a, b chihaya.Peer) bool
+}
+
+// PreparePeerStoreTester prepares a reusable suite for PeerStore driver
+// tests.
+// The tester will use PeerIDs and endpoints to compare peers.
+func PreparePeerStoreTester(driver PeerStoreDriver) PeerStoreTester {
+	return &peerStoreTester{
+		driver:       driver,
+		equalityFunc: func(a, b chihaya.Peer) bool { return a.Equal(b) },
+	}
+}
+
+func (pt *peerStoreTester) CompareEndpoints() {
+	pt.equalityFunc = func(a, b chihaya.Peer) bool { return a.EqualEndpoint(b) }
+}
+
+func (pt *peerStoreTester) peerInSlice(peer chihaya.Peer, peers []chihaya.Peer) bool {
+	for _, v := range peers {
+		if pt.equalityFunc(peer, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pt *peerStoreTester) TestPeerStore(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash = chihaya.InfoHash([20]byte{})
+
+		peers = []struct {
+			seeder bool
+			peerID string
+			ip     string
+			port   uint16
+		}{
+			{false, "-AZ3034-6wfG2wk6wWLc", "250.183.81.177", 5720},
+			{false, "-AZ3042-6ozMq5q6Q3NX", "38.241.13.19", 4833},
+			{false, "-BS5820-oy4La2MWGEFj", "fd45:7856:3dae::48", 2878},
+			{false, "-AR6360-6oZyyMWoOOBe", "fd0a:29a8:8445::38", 3167},
+			{true, "-AG2083-s1hiF8vGAAg0", "231.231.49.173", 1453},
+			{true, "-AG3003-lEl2Mm4NEO4n", "254.99.84.77", 7032},
+			{true, "-MR1100-00HS~T7*65rm", "211.229.100.129", 2614},
+			{true, "-LK0140-ATIV~nbEQAMr", "fdad:c435:bf79::12", 4114},
+			{true, "-KT2210-347143496631", "fdda:1b35:7d6e::9", 6179},
+			{true, "-TR0960-6ep6svaa61r4", "fd7f:78f0:4c77::55", 4727},
+		}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	for _, p := range peers {
+		// Construct chihaya.Peer from test data.
+		peer := chihaya.Peer{
+			ID:   chihaya.PeerIDFromString(p.peerID),
+			IP:   net.ParseIP(p.ip),
+			Port: p.port,
+		}
+
+		if p.seeder {
+			err = s.PutSeeder(hash, peer)
+		} else {
+			err = s.PutLeecher(hash, peer)
+		}
+		require.Nil(t, err)
+	}
+
+	leechers1, leechers61, err := s.GetLeechers(hash)
+	require.Nil(t, err)
+	require.NotEmpty(t, leechers1)
+	require.NotEmpty(t, leechers61)
+	num := s.NumLeechers(hash)
+	require.Equal(t, len(leechers1)+len(leechers61), num)
+
+	seeders1, seeders61, err := s.GetSeeders(hash)
+	require.Nil(t, err)
+	require.NotEmpty(t, seeders1)
+	require.NotEmpty(t, seeders61)
+	num = s.NumSeeders(hash)
+	require.Equal(t, len(seeders1)+len(seeders61), num)
+
+	leechers := append(leechers1, leechers61...)
+	seeders := append(seeders1, seeders61...)
+
+	for _, p := range peers {
+		// Construct chihaya.Peer from test data.
+		peer := chihaya.Peer{
+			ID:   chihaya.PeerIDFromString(p.peerID),
+			IP:   net.ParseIP(p.ip),
+			Port: p.port,
+		}
+
+		if p.seeder {
+			require.True(t, pt.peerInSlice(peer, seeders))
+		} else {
+			require.True(t, pt.peerInSlice(peer, leechers))
+		}
+
+		if p.seeder {
+			err = s.DeleteSeeder(hash, peer)
+		} else {
+			err = s.DeleteLeecher(hash, peer)
+		}
+		require.Nil(t, err)
+	}
+
+	require.Zero(t, s.NumLeechers(hash))
+	require.Zero(t, s.NumSeeders(hash))
+
+	// Re-add all the peers to the peerStore.
+	for _, p := range peers {
+		// Construct chihaya.Peer from test data.
+		peer := chihaya.Peer{
+			ID:   chihaya.PeerIDFromString(p.peerID),
+			IP:   net.ParseIP(p.ip),
+			Port: p.port,
+		}
+		if p.seeder {
+			s.PutSeeder(hash, peer)
+		} else {
+			s.PutLeecher(hash, peer)
+		}
+	}
+
+	// Check that there are 6 seeders, and 4 leechers.
+	require.Equal(t, 6, s.NumSeeders(hash))
+	require.Equal(t, 4, s.NumLeechers(hash))
+
+	numSwarms, err := s.NumSwarms()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), numSwarms)
+	numSeeders, err := s.NumTotalSeeders()
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), numSeeders)
+	numLeechers, err := s.NumTotalLeechers()
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), numLeechers)
+
+	peer := chihaya.Peer{
+		ID:   chihaya.PeerIDFromString(peers[0].peerID),
+		IP:   net.ParseIP(peers[0].ip),
+		Port: peers[0].port,
+	}
+	err = s.GraduateLeecher(hash, peer)
+	require.Nil(t, err)
+	// Check that there are 7 seeders, and 3 leechers after graduating a
+	// leecher to a seeder.
+	require.Equal(t, 7, s.NumSeeders(hash))
+	require.Equal(t, 3, s.NumLeechers(hash))
+
+	_, _, err = s.AnnouncePeers(hash, true, 5, peer, chihaya.Peer{}, SameFamily)
+	// Only test if it works, do not test the slices returned. They change
+	// depending on the driver.
+	require.Nil(t, err)
+
+	err = s.CollectGarbage(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 0, s.NumLeechers(hash))
+	require.Equal(t, 0, s.NumSeeders(hash))
+
+	numSwarms, err = s.NumSwarms()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numSwarms)
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (pt *peerStoreTester) TestAnnouncePeersFamilies(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash = chihaya.InfoHash([20]byte{1})
+
+		// IPv4 peers are given both as 4-byte and 16-byte net.IPs.
+		seeders = []chihaya.Peer{
+			{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720},
+			{ID: chihaya.PeerIDFromString("-AZ3042-6ozMq5q6Q3NX"), IP: net.IPv4(38, 241, 13, 19), Port: 4833},
+			{ID: chihaya.PeerIDFromString("-BS5820-oy4La2MWGEFj"), IP: net.ParseIP("fd45:7856:3dae::48"), Port: 2878},
+			{ID: chihaya.PeerIDFromString("-AR6360-6oZyyMWoOOBe"), IP: net.ParseIP("fd0a:29a8:8445::38"), Port: 3167},
+		}
+
+		// A dual-stack leecher that announced both of its addresses.
+		leecher4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.IPv4(231, 231, 49, 173), Port: 1453}
+		leecher6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.ParseIP("fdad:c435:bf79::12"), Port: 1453}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	for _, p := range seeders {
+		require.Nil(t, s.PutSeeder(hash, p))
+	}
+	require.Nil(t, s.PutLeecher(hash, leecher4))
+	require.Nil(t, s.PutLeecher(hash, leecher6))
+
+	requireFamily := func(peers []chihaya.Peer, v4 bool) {
+		for _, p := range peers {
+			require.Equal(t, v4, p.IP.To4() != nil, "peer %s returned to the wrong address family", p.IP)
+		}
+	}
+
+	// An IPv4 announcer only gets IPv4 peers.
+	peers, peers6, err := s.AnnouncePeers(hash, false, 50, chihaya.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 1}, chihaya.Peer{}, SameFamily)
+	require.Nil(t, err)
+	require.Empty(t, peers6)
+	require.Len(t, peers, 3)
+	requireFamily(peers, true)
+	require.True(t, pt.peerInSlice(leecher4, peers))
+
+	// An IPv6 announcer only gets IPv6 peers.
+	peers, peers6, err = s.AnnouncePeers(hash, false, 50, chihaya.Peer{}, chihaya.Peer{IP: net.ParseIP("fd00::1"), Port: 1}, SameFamily)
+	require.Nil(t, err)
+	require.Empty(t, peers)
+	require.Len(t, peers6, 3)
+	requireFamily(peers6, false)
+	require.True(t, pt.peerInSlice(leecher6, peers6))
+
+	// numWant applies to each family.
+	peers, peers6, err = s.AnnouncePeers(hash, false, 2, chihaya.Peer{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1}, chihaya.Peer{IP: net.ParseIP("fd00::1"), Port: 1}, SameFamily)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.Len(t, peers6, 2)
+	requireFamily(peers, true)
+	requireFamily(peers6, false)
+
+	// The 16-byte form of an IPv4 address finds the same peer.
+	require.Nil(t, s.DeleteSeeder(hash, chihaya.Peer{ID: seeders[0].ID, IP: net.IPv4(250, 183, 81, 177), Port: seeders[0].Port}))
+	require.Equal(t, 3, s.NumSeeders(hash))
+
+	require.Equal(t, 2, s.NumLeechers(hash))
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (pt *peerStoreTester) TestDownloaded(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash  = chihaya.InfoHash([20]byte{1})
+		other = chihaya.InfoHash([20]byte{2})
+		peer  = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720}
+		seed  = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3042-6ozMq5q6Q3NX"), IP: net.IPv4(38, 241, 13, 19).To4(), Port: 4833}
+
+		// A dual-stacked leecher that announced both of its addresses.
+		leecher4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.IPv4(231, 231, 49, 173).To4(), Port: 1453}
+		leecher6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.ParseIP("fdad:c435:bf79::12"), Port: 1453}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	requireStats := func(infoHash chihaya.InfoHash, seeders, leechers, downloaded uint64) {
+		numSeeders, numLeechers, numDownloaded, err := s.GetStats(infoHash)
+		require.Nil(t, err)
+		require.Equal(t, seeders, numSeeders, "seeders")
+		require.Equal(t, leechers, numLeechers, "leechers")
+		require.Equal(t, downloaded, numDownloaded, "downloaded")
+	}
+
+	requireStats(hash, 0, 0, 0)
+
+	// Duplicate completions of a peer are counted once.
+	require.Nil(t, s.PutLeecher(hash, peer))
+	requireStats(hash, 0, 1, 0)
+	require.Nil(t, s.GraduateLeecher(hash, peer))
+	require.Nil(t, s.GraduateLeecher(hash, peer))
+	requireStats(hash, 1, 0, 1)
+
+	// Peers that never leeched did not complete a download.
+	require.Nil(t, s.GraduateLeecher(hash, seed))
+	requireStats(hash, 2, 0, 1)
+
+	// A dual-stacked peer completes once.
+	require.Nil(t, s.PutLeecher(hash, leecher4))
+	require.Nil(t, s.PutLeecher(hash, leecher6))
+	require.Nil(t, s.GraduateLeecher(hash, leecher4))
+	require.Nil(t, s.GraduateLeecher(hash, leecher6))
+	requireStats(hash, 4, 0, 2)
+
+	require.Nil(t, s.IncrementDownloaded(hash))
+	requireStats(hash, 4, 0, 3)
+	requireStats(other, 0, 0, 0)
+
+	// The count outlives the peers of the swarm.
+	for _, p := range []chihaya.Peer{peer, seed, leecher4, leecher6} {
+		require.Nil(t, s.DeleteSeeder(hash, p))
+	}
+	requireStats(hash, 0, 0, 3)
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (pt *peerStoreTester) TestPeerEvents(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash    = chihaya.InfoHash([20]byte{1})
+		leecher = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720}
+		seeder  = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3042-6ozMq5q6Q3NX"), IP: net.IPv4(38, 241, 13, 19).To4(), Port: 4833}
+		stale   = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.ParseIP("fdad:c435:bf79::12"), Port: 1453}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	events, cancel := s.Subscribe()
+
+	requireEvent := func(typ PeerEventType, p chihaya.Peer, seeder bool) {
+		select {
+		case e := <-events:
+			require.Equal(t, typ, e.Type)
+			require.Equal(t, hash, e.InfoHash)
+			require.True(t, pt.equalityFunc(p, e.Peer), "expected %s of %v, got %v", typ, p, e.Peer)
+			require.Equal(t, seeder, e.Seeder, "seeder")
+		case <-time.After(time.Second):
+			t.Fatalf("missing event: %s of %v", typ, p)
+		}
+	}
+	requireNoEvent := func() {
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected event: %+v", e)
+		default:
+		}
+	}
+
+	// Peers join once, regardless of how often they announce.
+	require.Nil(t, s.PutLeecher(hash, leecher))
+	requireEvent(PeerJoined, leecher, false)
+	require.Nil(t, s.PutLeecher(hash, leecher))
+	require.Nil(t, s.PutSeeder(hash, seeder))
+	requireEvent(PeerJoined, seeder, true)
+	requireNoEvent()
+
+	// Leechers complete, seeders that never leeched join.
+	require.Nil(t, s.GraduateLeecher(hash, leecher))
+	requireEvent(PeerCompleted, leecher, true)
+	require.Nil(t, s.GraduateLeecher(hash, stale))
+	requireEvent(PeerJoined, stale, true)
+	requireNoEvent()
+
+	// Peers leave when they stop and when they are garbage collected.
+	require.Nil(t, s.DeleteSeeder(hash, leecher))
+	requireEvent(PeerLeft, leecher, true)
+	require.Equal(t, ErrResourceDoesNotExist, s.DeleteSeeder(hash, leecher))
+	requireNoEvent()
+
+	require.Nil(t, s.PutLeecher(hash, leecher))
+	requireEvent(PeerJoined, leecher, false)
+	require.Nil(t, s.DeleteLeecher(hash, leecher))
+	requireEvent(PeerLeft, leecher, false)
+
+	require.Nil(t, s.DeleteSeeder(hash, seeder))
+	requireEvent(PeerLeft, seeder, true)
+	require.Nil(t, s.CollectGarbage(time.Now().Add(time.Hour)))
+	requireEvent(PeerLeft, stale, true)
+	requireNoEvent()
+
+	// Cancelled subscriptions are closed and receive no more events.
+	cancel()
+	cancel()
+	_, ok := <-events
+	require.False(t, ok, "channel of cancelled subscription must be closed")
+	require.Nil(t, s.PutLeecher(hash, leecher))
+
+	// Subscriptions end when the store is stopped.
+	events, _ = s.Subscribe()
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+	for range events {
+	}
+}
+
+func (pt *peerStoreTester) TestAnnounceFamilyPolicies(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash = chihaya.InfoHash([20]byte{1})
+
+		// The seeders: a dual-stacked one and one of each family.
+		dual4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(10, 0, 0, 2).To4(), Port: 2}
+		dual6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.ParseIP("fd00::2"), Port: 2}
+		only4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3042-6ozMq5q6Q3NX"), IP: net.IPv4(10, 0, 0, 3).To4(), Port: 3}
+		only6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.ParseIP("fd00::3"), Port: 3}
+
+		// A dual-stacked leecher that only announced its IPv6 address so far.
+		leecher4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-BS5820-oy4La2MWGEFj"), IP: net.IPv4(10, 0, 0, 4).To4(), Port: 4}
+		leecher6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-BS5820-oy4La2MWGEFj"), IP: net.ParseIP("fd00::4"), Port: 4}
+
+		// A leecher that is not in the swarm.
+		stranger4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TR2820-wz4La2MWGEFj"), IP: net.IPv4(10, 0, 0, 5).To4(), Port: 5}
+		stranger6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-TR2820-wz4La2MWGEFj"), IP: net.ParseIP("fd00::5"), Port: 5}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	for _, p := range []chihaya.Peer{dual4, dual6, only4, only6} {
+		require.Nil(t, s.PutSeeder(hash, p))
+	}
+	require.Nil(t, s.PutLeecher(hash, leecher6))
+
+	requirePeers := func(expected, peers []chihaya.Peer) {
+		require.Len(t, peers, len(expected), "%v", peers)
+		for _, p := range expected {
+			require.True(t, pt.peerInSlice(p, peers), "%v not in %v", p, peers)
+		}
+	}
+
+	for _, policy := range []FamilyPolicy{SameFamily, BridgeFamilies} {
+		// Single-stacked announcers only get peers of their family.
+		peers, peers6, err := s.AnnouncePeers(hash, false, 50, stranger4, chihaya.Peer{}, policy)
+		require.Nil(t, err)
+		requirePeers([]chihaya.Peer{dual4, only4}, peers)
+		require.Len(t, peers6, 0)
+
+		peers, peers6, err = s.AnnouncePeers(hash, false, 50, chihaya.Peer{}, stranger6, policy)
+		require.Nil(t, err)
+		require.Len(t, peers, 0)
+		requirePeers([]chihaya.Peer{dual6, only6, leecher6}, peers6)
+
+		// Dual-stacked announcers get both families.
+		peers, peers6, err = s.AnnouncePeers(hash, false, 50, stranger4, stranger6, policy)
+		require.Nil(t, err)
+		requirePeers([]chihaya.Peer{dual4, only4}, peers)
+		requirePeers([]chihaya.Peer{dual6, only6, leecher6}, peers6)
+	}
+
+	// A dual-stacked peer announcing one family is only bridged to the
+	// other if the policy allows it.
+	peers, peers6, err := s.AnnouncePeers(hash, false, 50, leecher4, chihaya.Peer{}, SameFamily)
+	require.Nil(t, err)
+	requirePeers([]chihaya.Peer{dual4, only4}, peers)
+	require.Len(t, peers6, 0)
+
+	peers, peers6, err = s.AnnouncePeers(hash, false, 50, leecher4, chihaya.Peer{}, BridgeFamilies)
+	require.Nil(t, err)
+	requirePeers([]chihaya.Peer{dual4, only4}, peers)
+	requirePeers([]chihaya.Peer{dual6, only6}, peers6)
+
+	// Bridged dual-stacked announcers get both addresses of dual-stacked
+	// peers.
+	var bridged bool
+	for i := 0; i < 50; i++ {
+		peers, peers6, err = s.AnnouncePeers(hash, false, 1, stranger4, stranger6, BridgeFamilies)
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		require.Len(t, peers6, 1)
+		if pt.equalityFunc(dual4, peers[0]) {
+			require.True(t, pt.equalityFunc(dual6, peers6[0]), "expected %v, got %v", dual6, peers6[0])
+			bridged = true
+		}
+	}
+	require.True(t, bridged, "the dual-stacked peer was never returned")
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (pt *peerStoreTester) TestReannounce(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash = chihaya.InfoHash([20]byte{1})
+		peer = chihaya.Peer{ID: chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc"), IP: net.IPv4(250, 183, 81, 177).To4(), Port: 5720}
+
+		// A dual-stacked peer that announced both of its addresses.
+		dual4 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.IPv4(231, 231, 49, 173).To4(), Port: 1453}
+		dual6 = chihaya.Peer{ID: chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0"), IP: net.ParseIP("fdad:c435:bf79::12"), Port: 1453}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	requireCounts := func(seeders, leechers, downloaded uint64) {
+		numSeeders, numLeechers, numDownloaded, err := s.GetStats(hash)
+		require.Nil(t, err)
+		require.Equal(t, seeders, numSeeders, "seeders")
+		require.Equal(t, leechers, numLeechers, "leechers")
+		require.Equal(t, downloaded, numDownloaded, "downloaded")
+
+		require.Equal(t, int(seeders), s.NumSeeders(hash), "seeders")
+		require.Equal(t, int(leechers), s.NumLeechers(hash), "leechers")
+
+		totalSeeders, err := s.NumTotalSeeders()
+		require.Nil(t, err)
+		require.Equal(t, seeders, totalSeeders, "total seeders")
+		totalLeechers, err := s.NumTotalLeechers()
+		require.Nil(t, err)
+		require.Equal(t, leechers, totalLeechers, "total leechers")
+
+		peers, peers6, err := s.GetSeeders(hash)
+		require.Nil(t, err)
+		require.Equal(t, int(seeders), len(peers)+len(peers6), "listed seeders")
+		peers, peers6, err = s.GetLeechers(hash)
+		require.Nil(t, err)
+		require.Equal(t, int(leechers), len(peers)+len(peers6), "listed leechers")
+	}
+
+	// Re-announcing peers are not duplicated.
+	for i := 0; i < 5; i++ {
+		require.Nil(t, s.PutLeecher(hash, peer))
+		requireCounts(0, 1, 0)
+	}
+
+	// Leechers that announce as seeders are moved without completing.
+	for i := 0; i < 5; i++ {
+		require.Nil(t, s.PutSeeder(hash, peer))
+		requireCounts(1, 0, 0)
+	}
+	require.Nil(t, s.GraduateLeecher(hash, peer))
+	requireCounts(1, 0, 0)
+
+	// Seeders that announce as leechers are moved back and can complete.
+	require.Nil(t, s.PutLeecher(hash, peer))
+	requireCounts(0, 1, 0)
+	require.Nil(t, s.GraduateLeecher(hash, peer))
+	require.Nil(t, s.PutSeeder(hash, peer))
+	requireCounts(1, 0, 1)
+
+	// The addresses of dual-stacked peers are moved separately.
+	require.Nil(t, s.PutLeecher(hash, dual4))
+	require.Nil(t, s.PutLeecher(hash, dual6))
+	requireCounts(1, 2, 1)
+	require.Nil(t, s.PutSeeder(hash, dual4))
+	requireCounts(2, 1, 1)
+	require.Nil(t, s.PutSeeder(hash, dual6))
+	requireCounts(3, 0, 1)
+
+	// Counts do not drift when peers change their minds concurrently.
+	peers := []chihaya.Peer{peer, dual4, dual6}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p := peers[(i+j)%len(peers)]
+				if (i+j)%2 == 0 {
+					require.Nil(t, s.PutSeeder(hash, p))
+				} else {
+					require.Nil(t, s.PutLeecher(hash, p))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seeders, leechers, _, err := s.GetStats(hash)
+	require.Nil(t, err)
+	require.Equal(t, uint64(len(peers)), seeders+leechers, "peers")
+
+	for _, p := range peers {
+		require.Nil(t, s.PutSeeder(hash, p))
+	}
+	requireCounts(3, 0, 1)
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (pt *peerStoreTester) TestKeys(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash  = chihaya.InfoHash([20]byte{1})
+		id    = chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc")
+		other = chihaya.PeerIDFromString("-AG2083-s1hiF8vGAAg0")
+		ip    = net.IPv4(250, 183, 81, 177).To4()
+
+		keyed    = chihaya.Peer{ID: id, IP: ip, Port: 5720, Key: "A1B2C3D4"}
+		remapped = chihaya.Peer{ID: id, IP: ip, Port: 5721, Key: "A1B2C3D4"}
+		neighbor = chihaya.Peer{ID: other, IP: ip, Port: 5722, Key: "E5F6A7B8"}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	requirePeers := func(seeders, leechers []chihaya.Peer) {
+		peers, _, err := s.GetSeeders(hash)
+		require.Nil(t, err)
+		require.Equal(t, len(seeders), len(peers), "seeders")
+		for _, p := range seeders {
+			require.True(t, pt.peerInSlice(p, peers), "expected seeder %v", p)
+		}
+		for _, p := range peers {
+			require.Equal(t, "", p.Key, "key of %v", p)
+		}
+		require.Equal(t, len(seeders), s.NumSeeders(hash), "seeders")
+
+		peers, _, err = s.GetLeechers(hash)
+		require.Nil(t, err)
+		require.Equal(t, len(leechers), len(peers), "leechers")
+		for _, p := range leechers {
+			require.True(t, pt.peerInSlice(p, peers), "expected leecher %v", p)
+		}
+		for _, p := range peers {
+			require.Equal(t, "", p.Key, "key of %v", p)
+		}
+		require.Equal(t, len(leechers), s.NumLeechers(hash), "leechers")
+	}
+
+	// A peer whose NAT mapping changed replaces its old address.
+	require.Nil(t, s.PutLeecher(hash, keyed))
+	requirePeers(nil, []chihaya.Peer{keyed})
+	require.Nil(t, s.PutLeecher(hash, remapped))
+	requirePeers(nil, []chihaya.Peer{remapped})
+
+	// Peers behind the same address are told apart by their keys.
+	require.Nil(t, s.PutLeecher(hash, neighbor))
+	requirePeers(nil, []chihaya.Peer{remapped, neighbor})
+
+	// A completion is found across a change of the mapping.
+	require.Nil(t, s.GraduateLeecher(hash, keyed))
+	requirePeers([]chihaya.Peer{keyed}, []chihaya.Peer{neighbor})
+	_, _, downloaded, err := s.GetStats(hash)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), downloaded)
+
+	// Stopping peers are found by their keys, too.
+	require.Nil(t, s.DeleteSeeder(hash, remapped))
+	requirePeers(nil, []chihaya.Peer{neighbor})
+	require.Nil(t, s.DeleteLeecher(hash, neighbor))
+	require.Equal(t, 0, s.NumSeeders(hash)+s.NumLeechers(hash), "peers")
+
+	// Once a keyed peer is gone, its key does not match anymore.
+	require.Equal(t, ErrResourceDoesNotExist, s.DeleteLeecher(hash, neighbor))
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+// TestRequireCrypto expects a driver that prefers the peers which support
+// encrypted connections for announcers that require them, rather than only
+// returning those.
+func (pt *peerStoreTester) TestRequireCrypto(t *testing.T, cfg *DriverConfig) {
+	hash := chihaya.InfoHash([20]byte{1})
+	peer := func(i byte, crypto chihaya.Crypto) chihaya.Peer {
+		return chihaya.Peer{ID: chihaya.PeerID{i}, IP: net.IPv4(10, 0, 0, i).To4(), Port: 5720, Crypto: crypto}
+	}
+	var (
+		plain     = []chihaya.Peer{peer(1, chihaya.CryptoNone), peer(2, chihaya.CryptoNone), peer(3, chihaya.CryptoNone)}
+		supported = peer(4, chihaya.CryptoSupported)
+		required  = peer(5, chihaya.CryptoRequired)
+		announcer = peer(6, chihaya.CryptoRequired)
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+
+	for _, p := range append(plain, supported, required) {
+		require.Nil(t, s.PutSeeder(hash, p))
+	}
+
+	// requireFirst announces for announcer and requires the first of the
+	// returned peers to be expected, and the others to be plain. The peers
+	// are returned with their support for encryption.
+	requireFirst := func(announcer chihaya.Peer, expected ...chihaya.Peer) {
+		for i := 0; i < 10; i++ {
+			peers, _, err := s.AnnouncePeers(hash, false, 4, announcer, chihaya.Peer{}, SameFamily)
+			require.Nil(t, err)
+			require.Equal(t, 4, len(peers))
+			for j, p := range peers {
+				if j < len(expected) {
+					require.True(t, pt.peerInSlice(p, expected), "expected a peer that supports crypto, got %v", p)
+					require.Equal(t, chihaya.CryptoSupported, p.Crypto, "crypto of %v", p)
+				} else {
+					require.True(t, pt.peerInSlice(p, plain), "expected a plain peer, got %v", p)
+					require.Equal(t, chihaya.CryptoNone, p.Crypto, "crypto of %v", p)
+				}
+			}
+		}
+	}
+	requireFirst(announcer, supported, required)
+
+	// A peer that no longer supports encryption loses its priority, and
+	// announcers that only support encryption get any peers.
+	withoutCrypto := required
+	withoutCrypto.Crypto = chihaya.CryptoNone
+	require.Nil(t, s.PutSeeder(hash, withoutCrypto))
+	plain = append(plain, withoutCrypto)
+	requireFirst(announcer, supported)
+	peers, _, err := s.AnnouncePeers(hash, false, 5, peer(7, chihaya.CryptoSupported), chihaya.Peer{}, SameFamily)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(peers))
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+// TestHasPeer expects a driver that implements SwarmMemberChecker, matching
+// peers by their keys like PutSeeder and PutLeecher do.
+func (pt *peerStoreTester) TestHasPeer(t *testing.T, cfg *DriverConfig) {
+	var (
+		hash = chihaya.InfoHash([20]byte{1})
+		id   = chihaya.PeerIDFromString("-AZ3034-6wfG2wk6wWLc")
+		ip   = net.IPv4(250, 183, 81, 177).To4()
+		ip6  = net.ParseIP("2001:db8::1")
+
+		plain    = chihaya.Peer{ID: id, IP: ip, Port: 5720}
+		moved    = chihaya.Peer{ID: id, IP: ip, Port: 5721}
+		plain6   = chihaya.Peer{ID: id, IP: ip6, Port: 5720}
+		keyed    = chihaya.Peer{ID: chihaya.PeerID{2}, IP: ip, Port: 5722, Key: "A1B2C3D4"}
+		remapped = chihaya.Peer{ID: chihaya.PeerID{2}, IP: ip, Port: 5723, Key: "A1B2C3D4"}
+	)
+	s, err := pt.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, s)
+	c, ok := s.(SwarmMemberChecker)
+	require.True(t, ok, "PeerStore must implement SwarmMemberChecker")
+
+	requireMember := func(p chihaya.Peer, seeder, leecher bool) {
+		isSeeder, isLeecher, err := c.HasPeer(hash, p)
+		require.Nil(t, err)
+		require.Equal(t, seeder, isSeeder, "seeder %v", p)
+		require.Equal(t, leecher, isLeecher, "leecher %v", p)
+	}
+
+	// Nothing is stored in a swarm without peers.
+	requireMember(plain, false, false)
+
+	// Peers without keys are matched by their addresses, in their family.
+	require.Nil(t, s.PutLeecher(hash, plain))
+	requireMember(plain, false, true)
+	requireMember(plain6, false, false)
+	require.Nil(t, s.GraduateLeecher(hash, plain))
+	requireMember(plain, true, false)
+	require.Nil(t, s.DeleteSeeder(hash, plain))
+	requireMember(plain, false, false)
+	require.Nil(t, s.PutSeeder(hash, moved))
+	requireMember(plain, false, false)
+	requireMember(moved, true, false)
+
+	// Keyed peers are matched by their keys across a change of the mapping.
+	require.Nil(t, s.PutLeecher(hash, keyed))
+	requireMember(keyed, false, true)
+	requireMember(remapped, false, true)
+	require.Nil(t, s.DeleteLeecher(hash, remapped))
+	requireMember(keyed, false, false)
+
+	errChan := s.Stop()
+	err = <-errChan
+	require.Nil(t, err, "PeerStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestReplaceAll(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	require.Nil(t, is.AddIP(s.v4))
+	require.Nil(t, is.AddNetwork(s.net1))
+
+	// a malformed network must not replace anything
+	err = is.ReplaceAll([]net.IP{s.excluded}, []string{s.net2, ""})
+	require.NotNil(t, err)
+	invalid, ok := err.(InvalidNetworkError)
+	require.True(t, ok)
+	require.Equal(t, 1, invalid.Index)
+	match, err := is.HasAllIPs([]net.IP{s.v4, s.inNet1})
+	require.Nil(t, err)
+	require.True(t, match)
+	match, err = is.HasAnyIP([]net.IP{s.excluded, s.inNet2})
+	require.Nil(t, err)
+	require.False(t, match)
+
+	err = is.ReplaceAll([]net.IP{s.excluded, s.v6}, []string{s.net2})
+	require.Nil(t, err)
+	match, err = is.HasAnyIP([]net.IP{s.v4, s.inNet1})
+	require.Nil(t, err)
+	require.False(t, match)
+	match, err = is.HasAllIPs([]net.IP{s.excluded, s.v6, s.inNet2})
+	require.Nil(t, err)
+	require.True(t, match)
+
+	numIPs, err := is.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), numIPs)
+	numNetworks, err := is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), numNetworks)
+
+	// replacing with nothing empties the IPStore
+	err = is.ReplaceAll(nil, nil)
+	require.Nil(t, err)
+	numIPs, err = is.NumIPs()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numIPs)
+	numNetworks, err = is.NumNetworks()
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), numNetworks)
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
+}
+
+func (s *ipStoreTester) TestReplaceAllConcurrentReads(t *testing.T, cfg *DriverConfig) {
+	is, err := s.driver.New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, is)
+
+	// Both contents contain the probed IPs, once as individual IPs and once
+	// as networks, so that a lookup that mixes them would miss some.
+	var probed []net.IP
+	for i := 0; i < 100; i++ {
+		probed = append(probed, net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+	}
+	contents := []struct {
+		ips      []net.IP
+		networks []string
+	}{
+		{[]net.IP{net.ParseIP("192.0.2.1")}, []string{"10.0.0.0/8"}},
+		{probed, []string{"192.0.2.0/24"}},
+	}
+	probed = append(probed, net.ParseIP("192.0.2.1"))
+	absent := net.ParseIP("172.16.0.1")
+
+	require.Nil(t, is.ReplaceAll(contents[0].ips, contents[0].networks))
+
+	stop := make(chan struct{})
+	failures := make(chan string, 8)
+	var started, wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				ip := probed[i%len(probed)]
+				i++
+
+				match, err := is.HasIP(ip)
+				if err == nil && !match {
+					err = fmt.Errorf("HasIP missed %s", ip)
+				}
+				if err == nil {
+					match, err = is.HasAllIPs(probed)
+					if err == nil && !match {
+						err = errors.New("HasAllIPs missed a probed IP")
+					}
+				}
+				if err == nil {
+					match, err = is.HasAnyIP([]net.IP{absent, ip})
+					if err == nil && !match {
+						err = fmt.Errorf("HasAnyIP missed %s", ip)
+					}
+				}
+				if err == nil {
+					match, err = is.HasIP(absent)
+					if err == nil && match {
+						err = fmt.Errorf("HasIP found %s", absent)
+					}
+				}
+				if err != nil {
+					failures <- err.Error()
+					return
+				}
+			}
+		}(i)
+	}
+
+	// make sure the readers are running while the contents are replaced
+	started.Wait()
+	for i := 1; i <= 50; i++ {
+		c := contents[i%2]
+		require.Nil(t, is.ReplaceAll(c.ips, c.networks))
+	}
+	close(stop)
+	wg.Wait()
+	close(failures)
+
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	errChan := is.Stop()
+	err = <-errChan
+	require.Nil(t, err, "IPStore shutdown must not fail")
 }
@@ -6,17 +6,29 @@ package store
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/chihaya/chihaya/pkg/stopper"
 )
 
-var stringStoreDrivers = make(map[string]StringStoreDriver)
+var (
+	stringStoreDriversMu sync.RWMutex
+	stringStoreDrivers   = make(map[string]StringStoreDriver)
+)
 
 // StringStore represents an interface for manipulating strings.
 type StringStore interface {
 	// PutString adds the given string to the StringStore.
 	PutString(s string) error
 
+	// PutStringWithExpiry adds the given string to the StringStore until
+	// expires, e.g. for temporary passkeys. The string is absent once it
+	// expired, even if the StringStore did not delete it yet.
+	// Putting the string again replaces its expiry.
+	PutStringWithExpiry(s string, expires time.Time) error
+
 	// HasString returns whether or not the StringStore contains the given
 	// string.
 	HasString(s string) (bool, error)
@@ -33,6 +45,30 @@ type StringStore interface {
 	stopper.Stopper
 }
 
+// MultiStringStore is implemented by StringStores that can look up several
+// strings at once, e.g. in a single round trip.
+type MultiStringStore interface {
+	// HasAnyString returns whether the StringStore contains any of the
+	// given strings.
+	HasAnyString(strs []string) (bool, error)
+}
+
+// HasAnyString calls HasAnyString if s is a MultiStringStore. Otherwise,
+// HasString is called for each of strs until one of them is found.
+func HasAnyString(s StringStore, strs []string) (bool, error) {
+	if ms, ok := s.(MultiStringStore); ok {
+		return ms.HasAnyString(strs)
+	}
+
+	for _, str := range strs {
+		stored, err := s.HasString(str)
+		if err != nil || stored {
+			return stored, err
+		}
+	}
+	return false, nil
+}
+
 // StringStoreDriver represents an interface for creating a handle to the
 // storage of strings.
 type StringStoreDriver interface {
@@ -47,6 +83,9 @@ func RegisterStringStoreDriver(name string, driver StringStoreDriver) {
 	if driver == nil {
 		panic("store: could not register nil StringStoreDriver")
 	}
+
+	stringStoreDriversMu.Lock()
+	defer stringStoreDriversMu.Unlock()
 	if _, dup := stringStoreDrivers[name]; dup {
 		panic("store: could not register duplicate StringStoreDriver: " + name)
 	}
@@ -55,10 +94,21 @@ func RegisterStringStoreDriver(name string, driver StringStoreDriver) {
 
 // OpenStringStore returns a StringStore specified by a configuration.
 func OpenStringStore(cfg *DriverConfig) (StringStore, error) {
+	stringStoreDriversMu.RLock()
 	driver, ok := stringStoreDrivers[cfg.Name]
+	stringStoreDriversMu.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("store: unknown StringStoreDriver %q (forgotten import?)", cfg)
+		return nil, fmt.Errorf("store: unknown StringStoreDriver %q (forgotten import?), registered: %s", cfg.Name, strings.Join(RegisteredStringStoreDrivers(), ", "))
 	}
 
 	return driver.New(cfg)
 }
+
+// RegisteredStringStoreDrivers returns the sorted names of the registered
+// StringStoreDrivers.
+func RegisteredStringStoreDrivers() []string {
+	stringStoreDriversMu.RLock()
+	defer stringStoreDriversMu.RUnlock()
+
+	return sortedNames(stringStoreDrivers)
+}
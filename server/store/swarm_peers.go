@@ -0,0 +1,42 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya"
+)
+
+// SwarmPeerLister is implemented by PeerStores that can list the peers of a
+// swarm along with the times of their last announces, e.g. for debugging.
+type SwarmPeerLister interface {
+	// ListSwarmPeers returns the seeders and leechers of the swarm of
+	// infoHash, by address family.
+	//
+	// Returns ErrResourceDoesNotExist if the swarm has no peers.
+	ListSwarmPeers(infoHash chihaya.InfoHash) (peers, peers6 []SwarmPeer, err error)
+}
+
+// SwarmPeer is a peer of a swarm, as listed by a SwarmPeerLister.
+type SwarmPeer struct {
+	chihaya.Peer
+
+	// Seeder is true if the peer is a seeder, and false if it is a leecher.
+	Seeder bool
+
+	// LastAnnounce is the time of the last announce of the peer.
+	LastAnnounce time.Time
+}
+
+// SwarmMemberChecker is implemented by PeerStores that can tell whether a peer
+// is stored in a swarm, e.g. to leave an announcer out of the counts of its
+// swarm.
+type SwarmMemberChecker interface {
+	// HasPeer reports whether p is stored as a seeder or as a leecher of the
+	// swarm of infoHash. Peers are matched like PutSeeder and PutLeecher
+	// store them, i.e. by their key, if they have one.
+	HasPeer(infoHash chihaya.InfoHash, p chihaya.Peer) (seeder, leecher bool, err error)
+}
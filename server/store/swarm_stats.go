@@ -0,0 +1,118 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya"
+)
+
+func init() {
+	prometheus.MustRegister(swarmsBySize, largestSwarmPeers)
+}
+
+// SwarmSizeWalker is implemented by PeerStores that can list the sizes of
+// their swarms.
+type SwarmSizeWalker interface {
+	// WalkSwarmSizes calls fn with the infohash and the number of peers of
+	// every swarm. Drivers must only lock a part of their swarms at a time,
+	// and must not hold any lock while calling fn.
+	WalkSwarmSizes(fn func(infoHash chihaya.InfoHash, peers int))
+}
+
+// swarmSizeBuckets are the upper bounds of the sizes of the swarms counted
+// by swarmsBySize, with their labels.
+var swarmSizeBuckets = []struct {
+	label string
+	max   int
+}{
+	{"0-10", 10},
+	{"11-100", 100},
+	{"101-1000", 1000},
+	{"1001+", math.MaxInt32},
+}
+
+var (
+	swarmsBySize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "peer_store",
+		Name:      "swarms_by_size",
+		Help:      "The number of swarms in the PeerStore, by their number of peers.",
+	}, []string{"size"})
+
+	largestSwarmPeers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chihaya",
+		Subsystem: "peer_store",
+		Name:      "largest_swarm_peers",
+		Help:      "The number of peers of the largest swarm in the PeerStore, labeled with the hash of its infohash.",
+	}, []string{"infohash"})
+)
+
+// swarmSizes is the distribution of the sizes of the swarms of a PeerStore.
+type swarmSizes struct {
+	// buckets holds the number of swarms per bucket of swarmSizeBuckets.
+	buckets []int
+
+	largest      chihaya.InfoHash
+	largestPeers int
+}
+
+// walkSwarmSizes computes the distribution of the sizes of the swarms of w.
+func walkSwarmSizes(w SwarmSizeWalker) swarmSizes {
+	sizes := swarmSizes{buckets: make([]int, len(swarmSizeBuckets))}
+	w.WalkSwarmSizes(func(infoHash chihaya.InfoHash, peers int) {
+		for i, b := range swarmSizeBuckets {
+			if peers <= b.max {
+				sizes.buckets[i]++
+				break
+			}
+		}
+		if peers > sizes.largestPeers {
+			sizes.largest, sizes.largestPeers = infoHash, peers
+		}
+	})
+	return sizes
+}
+
+// export sets the swarm size metrics to sizes.
+func (sizes swarmSizes) export() {
+	for i, b := range swarmSizeBuckets {
+		swarmsBySize.WithLabelValues(b.label).Set(float64(sizes.buckets[i]))
+	}
+
+	largestSwarmPeers.Reset()
+	if sizes.largestPeers > 0 {
+		largestSwarmPeers.WithLabelValues(anonymizeInfoHash(sizes.largest)).Set(float64(sizes.largestPeers))
+	}
+}
+
+// anonymizeInfoHash returns a label for infoHash that does not reveal it, but
+// can be matched by operators that hash the infohashes they know.
+func anonymizeInfoHash(infoHash chihaya.InfoHash) string {
+	sum := sha256.Sum256(infoHash[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+// exportSwarmSizes exports the distribution of the sizes of the swarms of w
+// every interval until stop is closed.
+func exportSwarmSizes(w SwarmSizeWalker, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		walkSwarmSizes(w).export()
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
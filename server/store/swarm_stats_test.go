@@ -0,0 +1,86 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+// swarmSizeMap is a SwarmSizeWalker of fixed swarm sizes.
+type swarmSizeMap map[chihaya.InfoHash]int
+
+func (m swarmSizeMap) WalkSwarmSizes(fn func(infoHash chihaya.InfoHash, peers int)) {
+	for infoHash, peers := range m {
+		fn(infoHash, peers)
+	}
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	require.Nil(t, g.Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func TestSwarmSizes(t *testing.T) {
+	largest := chihaya.InfoHash{7}
+	w := swarmSizeMap{
+		{1}:     1,
+		{2}:     10,
+		{3}:     11,
+		{4}:     100,
+		{5}:     101,
+		{6}:     1000,
+		largest: 1001,
+		{8}:     250,
+	}
+
+	sizes := walkSwarmSizes(w)
+	require.Equal(t, []int{2, 2, 3, 1}, sizes.buckets)
+	require.Equal(t, largest, sizes.largest)
+	require.Equal(t, 1001, sizes.largestPeers)
+
+	sizes.export()
+	for i, expected := range []float64{2, 2, 3, 1} {
+		require.Equal(t, expected, gaugeValue(t, swarmsBySize.WithLabelValues(swarmSizeBuckets[i].label)), swarmSizeBuckets[i].label)
+	}
+	require.Equal(t, float64(1001), gaugeValue(t, largestSwarmPeers.WithLabelValues(anonymizeInfoHash(largest))))
+
+	// The label of the largest swarm does not reveal its infohash, and
+	// follows the largest swarm.
+	require.Equal(t, 16, len(anonymizeInfoHash(largest)))
+	require.NotEqual(t, anonymizeInfoHash(largest), anonymizeInfoHash(chihaya.InfoHash{8}))
+	w[chihaya.InfoHash{8}] = 2000
+	walkSwarmSizes(w).export()
+	require.Equal(t, float64(2000), gaugeValue(t, largestSwarmPeers.WithLabelValues(anonymizeInfoHash(chihaya.InfoHash{8}))))
+	require.Equal(t, float64(0), gaugeValue(t, largestSwarmPeers.WithLabelValues(anonymizeInfoHash(largest))))
+
+	// Without swarms, there is no largest one.
+	sizes = walkSwarmSizes(swarmSizeMap{})
+	require.Equal(t, []int{0, 0, 0, 0}, sizes.buckets)
+	require.Equal(t, 0, sizes.largestPeers)
+}
+
+func TestExportSwarmSizes(t *testing.T) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		exportSwarmSizes(swarmSizeMap{{1}: 5000}, time.Millisecond, stop)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for gaugeValue(t, swarmsBySize.WithLabelValues("1001+")) != 1 {
+		require.True(t, time.Now().Before(deadline), "swarm sizes not exported")
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/listen"
+)
+
+// defaultNumWant is the number of peers returned to clients that do not ask
+// for a specific number.
+const defaultNumWant = 50
+
+// defaultMaxNumWant is the largest number of peers returned to a client if
+// none is configured.
+const defaultMaxNumWant = 50
+
+// defaultQueueSize is the number of packets that wait for a worker if no
+// queue size is configured.
+const defaultQueueSize = 1024
+
+type udpConfig struct {
+	Addr            string `yaml:"addr"`
+	AllowIPv6       bool   `yaml:"allow_ipv6"`
+	AllowIPSpoofing bool   `yaml:"allow_ip_spoofing"`
+	DefaultNumWant  int32  `yaml:"default_num_want"`
+	MaxNumWant      int32  `yaml:"max_num_want"`
+
+	// ConnectionIDRotation is the interval at which the key connection IDs
+	// are authenticated with is replaced.
+	ConnectionIDRotation time.Duration `yaml:"connection_id_rotation"`
+
+	// Workers is the number of packets handled at the same time, QueueSize
+	// the number of packets that wait for a worker. Packets that arrive
+	// while the queue is full are dropped.
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+
+	// Config holds the options Addr is listened on with.
+	listen.Config `yaml:",inline"`
+}
+
+func newUDPConfig(srvcfg *chihaya.ServerConfig) (*udpConfig, error) {
+	bytes, err := yaml.Marshal(srvcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg udpConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxNumWant <= 0 {
+		cfg.MaxNumWant = defaultMaxNumWant
+	}
+	if cfg.DefaultNumWant <= 0 {
+		cfg.DefaultNumWant = defaultNumWant
+		if cfg.DefaultNumWant > cfg.MaxNumWant {
+			cfg.DefaultNumWant = cfg.MaxNumWant
+		}
+	}
+	if cfg.DefaultNumWant > cfg.MaxNumWant {
+		return nil, errors.New("default_num_want must not exceed max_num_want")
+	}
+
+	if cfg.ConnectionIDRotation == 0 {
+		cfg.ConnectionIDRotation = defaultConnectionIDRotation
+	}
+	if cfg.ConnectionIDRotation < time.Second {
+		return nil, errors.New("connection_id_rotation must be at least 1s")
+	}
+
+	// Workers mostly wait for the stores, so there are more of them
+	// than CPUs.
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4 * runtime.GOMAXPROCS(0)
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+
+	err = cfg.Config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
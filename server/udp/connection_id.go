@@ -0,0 +1,152 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+// defaultConnectionIDRotation is the interval at which the connection ID key
+// is rotated if none is configured. Connection IDs are accepted for at least
+// one interval, which satisfies the two minutes required by BEP 15.
+const defaultConnectionIDRotation = 2 * time.Minute
+
+// connectionIDGenerator issues and validates connection IDs without keeping
+// any state per client.
+//
+// A connection ID consists of the time it was issued at as a big-endian
+// uint32 of Unix seconds, followed by the first four bytes of an HMAC-SHA256
+// of that time and the IP of the client it was issued to.
+//
+// The HMAC key is replaced by a new random key every rotation interval, and
+// only the keys of the current and the previous interval are kept. A
+// connection ID is validated with the key of the interval it was issued in,
+// so that it is rejected once it is older than two intervals, and a leaked
+// key is of no use after that either.
+type connectionIDGenerator struct {
+	// interval is the rotation interval in seconds.
+	interval int64
+	clock    clock.Clock
+
+	mu       sync.Mutex
+	window   int64 // the interval the current key belongs to
+	current  []byte
+	previous []byte // nil if no key was used in the previous interval
+}
+
+// newConnectionIDGenerator creates a connectionIDGenerator with a random key,
+// so that connection IDs are only valid for a single server instance, which
+// rotates its key every interval of c.
+func newConnectionIDGenerator(interval time.Duration, c clock.Clock) (*connectionIDGenerator, error) {
+	key, err := newConnectionIDKey()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &connectionIDGenerator{
+		interval: int64(interval / time.Second),
+		clock:    c,
+		current:  key,
+	}
+	g.window = g.windowOf(g.clock.Now().Unix())
+
+	return g, nil
+}
+
+func newConnectionIDKey() ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// windowOf returns the rotation interval that the Unix time t belongs to.
+func (g *connectionIDGenerator) windowOf(t int64) int64 {
+	return t / g.interval
+}
+
+// key returns the key for connection IDs issued in the interval window,
+// or nil if there is none, after rotating the keys to the interval of now.
+//
+// If the clock went backwards, both keys are replaced.
+func (g *connectionIDGenerator) key(window, now int64) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if nowWindow := g.windowOf(now); nowWindow != g.window {
+		key, err := newConnectionIDKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if nowWindow == g.window+1 {
+			g.previous = g.current
+		} else {
+			g.previous = nil
+		}
+		g.current = key
+		g.window = nowWindow
+	}
+
+	switch window {
+	case g.window:
+		return g.current, nil
+	case g.window - 1:
+		return g.previous, nil
+	}
+	return nil, nil
+}
+
+// generate returns a new connection ID for ip.
+func (g *connectionIDGenerator) generate(ip net.IP) ([]byte, error) {
+	now := g.clock.Now().Unix()
+	key, err := g.key(g.windowOf(now), now)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint32(id, uint32(now))
+	copy(id[4:], mac(key, id[:4], ip))
+	return id, nil
+}
+
+// validate reports whether id was issued to ip by g in the current or the
+// previous rotation interval.
+func (g *connectionIDGenerator) validate(id []byte, ip net.IP) bool {
+	if len(id) != 8 {
+		return false
+	}
+
+	issued := int64(binary.BigEndian.Uint32(id))
+	now := g.clock.Now().Unix()
+	if issued > now {
+		return false
+	}
+
+	key, err := g.key(g.windowOf(issued), now)
+	if err != nil || key == nil {
+		return false
+	}
+
+	return hmac.Equal(id[4:], mac(key, id[:4], ip))
+}
+
+func mac(key, issued []byte, ip net.IP) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(issued)
+	h.Write(ip.To16())
+	return h.Sum(nil)[:4]
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+func newTestConnectionIDGenerator(t *testing.T, c clock.Clock) *connectionIDGenerator {
+	g, err := newConnectionIDGenerator(time.Minute, c)
+	require.Nil(t, err)
+	return g
+}
+
+func TestConnectionID(t *testing.T) {
+	// the start of a rotation interval
+	fake := clock.NewFake(time.Unix(1460000040, 0))
+	g := newTestConnectionIDGenerator(t, fake)
+
+	ip := net.ParseIP("10.11.12.13").To4()
+	id, err := g.generate(ip)
+	require.Nil(t, err)
+	require.Len(t, id, 8)
+	require.True(t, g.validate(id, ip))
+	require.True(t, g.validate(id, net.ParseIP("10.11.12.13")))
+
+	// other clients cannot use it
+	require.False(t, g.validate(id, net.ParseIP("10.11.12.14")))
+
+	// it cannot be tampered with
+	for i := range id {
+		tampered := append([]byte(nil), id...)
+		tampered[i] ^= 0x01
+		require.False(t, g.validate(tampered, ip), "tampered byte %d", i)
+	}
+	require.False(t, g.validate(id[:7], ip))
+
+	// other servers did not issue it
+	other := newTestConnectionIDGenerator(t, fake)
+	require.False(t, other.validate(id, ip))
+
+	// it is valid for the next interval, too
+	fake.Advance(2*time.Minute - time.Second)
+	require.True(t, g.validate(id, ip))
+
+	// and expires after that
+	fake.Advance(time.Second)
+	require.False(t, g.validate(id, ip))
+}
+
+func TestConnectionIDRotation(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1460000099, 0))
+	g := newTestConnectionIDGenerator(t, fake)
+	ip := net.ParseIP("10.11.12.13").To4()
+
+	// an ID of the previous interval is validated with the previous key
+	previous, err := g.generate(ip)
+	require.Nil(t, err)
+	fake.Advance(time.Second)
+	current, err := g.generate(ip)
+	require.Nil(t, err)
+	require.True(t, g.validate(previous, ip))
+	require.True(t, g.validate(current, ip))
+
+	// an ID older than two intervals is rejected, regardless of its MAC
+	fake.Advance(time.Minute)
+	require.False(t, g.validate(previous, ip))
+	require.True(t, g.validate(current, ip))
+
+	// an ID forged for the current interval is rejected
+	forged := append([]byte(nil), current...)
+	forged[3]++
+	require.False(t, g.validate(forged, ip))
+
+	// IDs from the future are rejected
+	future := append([]byte(nil), current...)
+	future[0]++
+	require.False(t, g.validate(future, ip))
+
+	// after a pause, IDs of earlier intervals are rejected
+	fake.Advance(time.Minute)
+	fresh, err := g.generate(ip)
+	require.Nil(t, err)
+	require.False(t, g.validate(current, ip))
+	require.True(t, g.validate(fresh, ip))
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// protocolID is the magic constant a connect request starts with.
+const protocolID = 0x41727101980
+
+// The actions of the UDP tracker protocol.
+const (
+	connectActionID uint32 = iota
+	announceActionID
+	scrapeActionID
+	errorActionID
+)
+
+// The lengths of requests and their parts, in bytes.
+//
+// Every request starts with a header consisting of a connection ID, an action
+// and a transaction ID. A scrape request is followed by up to
+// maxScrapeInfoHashes infohashes.
+const (
+	headerLen           = 16
+	announceRequestLen  = 98
+	maxScrapeInfoHashes = 74
+)
+
+// errMalformedPacket is returned for packets that are dropped without a
+// response.
+var errMalformedPacket = errors.New("udp: malformed packet")
+
+// errBadConnectionID is returned for announces and scrapes with a connection
+// ID that was not issued to the client or has expired.
+var errBadConnectionID = tracker.ClientError("bad connection ID")
+
+// udpEvents maps the event IDs of the UDP tracker protocol to events.
+var udpEvents = []event.Event{
+	event.None,
+	event.Completed,
+	event.Started,
+	event.Stopped,
+}
+
+// header is the header every request starts with.
+type header struct {
+	connectionID  []byte
+	action        uint32
+	transactionID []byte
+}
+
+func parseHeader(packet []byte) (header, error) {
+	if len(packet) < headerLen {
+		return header{}, errMalformedPacket
+	}
+
+	return header{
+		connectionID:  packet[0:8],
+		action:        binary.BigEndian.Uint32(packet[8:12]),
+		transactionID: packet[12:16],
+	}, nil
+}
+
+// noParams is the chihaya.Params of UDP requests, which have no parameters
+// beyond the fixed fields of the protocol.
+type noParams struct{}
+
+var errNoParams = errors.New("udp: requests have no parameters")
+
+func (noParams) String(key string) (string, error) { return "", errNoParams }
+
+// announceRequest parses an announce request sent from ip.
+func announceRequest(packet []byte, ip net.IP, cfg *udpConfig) (*chihaya.AnnounceRequest, error) {
+	if len(packet) < announceRequestLen {
+		return nil, errMalformedPacket
+	}
+
+	eventID := binary.BigEndian.Uint32(packet[80:84])
+	if eventID >= uint32(len(udpEvents)) {
+		return nil, tracker.ClientError("failed to provide valid client event")
+	}
+
+	request := &chihaya.AnnounceRequest{
+		Event:      udpEvents[eventID],
+		InfoHash:   chihaya.InfoHashFromBytes(packet[16:36]),
+		PeerID:     chihaya.PeerIDFromBytes(packet[36:56]),
+		Downloaded: binary.BigEndian.Uint64(packet[56:64]),
+		Left:       binary.BigEndian.Uint64(packet[64:72]),
+		Uploaded:   binary.BigEndian.Uint64(packet[72:80]),
+		NumWant:    int32(binary.BigEndian.Uint32(packet[92:96])),
+		Port:       binary.BigEndian.Uint16(packet[96:98]),
+		Compact:    true,
+		Params:     noParams{},
+	}
+
+	// Clients that send no key leave it zero. Keys are formatted the way
+	// most clients send them to HTTP trackers.
+	if key := binary.BigEndian.Uint32(packet[88:92]); key != 0 {
+		request.Key = fmt.Sprintf("%08X", key)
+	}
+
+	if request.NumWant < 0 {
+		request.NumWant = cfg.DefaultNumWant
+	} else if request.NumWant > cfg.MaxNumWant {
+		request.NumWant = cfg.MaxNumWant
+	}
+
+	if ip.To4() != nil {
+		request.IPv4 = ip.To4()
+
+		// An announce can only carry an IPv4 address.
+		spoofed := net.IP(packet[84:88])
+		if cfg.AllowIPSpoofing && !spoofed.Equal(net.IPv4zero) {
+			request.IPv4 = append(net.IP(nil), spoofed...)
+		}
+	} else {
+		request.IPv6 = ip
+	}
+
+	return request, nil
+}
+
+// scrapeRequest parses a scrape request sent from ip.
+func scrapeRequest(packet []byte, ip net.IP) (*chihaya.ScrapeRequest, error) {
+	data := packet[headerLen:]
+	if len(data) == 0 || len(data)%20 != 0 {
+		return nil, errMalformedPacket
+	}
+	if len(data)/20 > maxScrapeInfoHashes {
+		return nil, tracker.ClientError("too many infohashes")
+	}
+
+	request := &chihaya.ScrapeRequest{Params: noParams{}}
+	for i := 0; i < len(data); i += 20 {
+		request.InfoHashes = append(request.InfoHashes, chihaya.InfoHashFromBytes(data[i:i+20]))
+	}
+
+	if ip.To4() != nil {
+		request.IPv4 = ip.To4()
+	} else {
+		request.IPv6 = ip
+	}
+
+	return request, nil
+}
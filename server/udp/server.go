@@ -0,0 +1,196 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package udp implements a BitTorrent tracker over the UDP tracker protocol
+// as specified in BEP 15.
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// maxPacketLen is the size of the buffer packets are read into. It exceeds
+// the largest valid request, a scrape of maxScrapeInfoHashes infohashes.
+const maxPacketLen = 2048
+
+func init() {
+	server.Register("udp", constructor)
+}
+
+func constructor(srvcfg *chihaya.ServerConfig, tkr *tracker.Tracker) (server.Server, error) {
+	cfg, err := newUDPConfig(srvcfg)
+	if err != nil {
+		return nil, errors.New("udp: invalid config: " + err.Error())
+	}
+
+	connIDs, err := newConnectionIDGenerator(cfg.ConnectionIDRotation, clock.Real)
+	if err != nil {
+		return nil, errors.New("udp: failed to generate connection ID key: " + err.Error())
+	}
+
+	return &udpServer{
+		cfg:     cfg,
+		tkr:     tkr,
+		connIDs: connIDs,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+type udpServer struct {
+	cfg     *udpConfig
+	tkr     *tracker.Tracker
+	connIDs *connectionIDGenerator
+	conn    *net.UDPConn
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Start runs the server and blocks until it has exited.
+//
+// It panics if the server exits unexpectedly.
+func (s *udpServer) Start() {
+	if err := s.listen(); err != nil {
+		log.Error("failed to run UDP server", "error", err)
+		panic(err)
+	}
+
+	s.serve()
+	log.Info("UDP server shut down cleanly")
+}
+
+// Stop stops the server and blocks until the server has exited.
+//
+// The server stops reading packets, but answers the ones it queued before it
+// closes its socket.
+func (s *udpServer) Stop() {
+	close(s.closing)
+	s.conn.SetReadDeadline(time.Now())
+	<-s.done
+}
+
+func (s *udpServer) listen() (err error) {
+	s.conn, err = s.cfg.ListenUDP("udp", s.cfg.Addr)
+	return err
+}
+
+// serve handles packets until the server is stopped and all queued packets
+// have been handled and answered. It closes the socket of the server once the
+// last response was written.
+func (s *udpServer) serve() {
+	defer close(s.done)
+	defer s.conn.Close()
+
+	pool := newWorkerPool(s.cfg.Workers, s.cfg.QueueSize, func(p datagram) {
+		response := s.handlePacket(p.data, p.addr)
+		if response != nil {
+			s.conn.WriteToUDP(response, p.addr)
+		}
+	})
+	defer pool.stop()
+
+	var buf []byte
+	for {
+		if buf == nil {
+			buf = make([]byte, maxPacketLen)
+		}
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			log.Error("failed to read UDP packet", "error", err)
+			panic(err)
+		}
+
+		// The buffers of dropped packets are reused for the next one.
+		if pool.submit(datagram{data: buf[:n], addr: addr}) {
+			buf = nil
+		}
+	}
+}
+
+// handlePacket returns the response to a packet received from addr, or nil if
+// the packet is malformed or not acceptable and must be dropped.
+func (s *udpServer) handlePacket(packet []byte, addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		if !s.cfg.AllowIPv6 {
+			return nil
+		}
+		ip = addr.IP
+	}
+
+	h, err := parseHeader(packet)
+	if err != nil {
+		return nil
+	}
+
+	switch h.action {
+	case connectActionID:
+		if binary.BigEndian.Uint64(h.connectionID) != protocolID {
+			return nil
+		}
+		id, err := s.connIDs.generate(ip)
+		if err != nil {
+			log.Error("udp: failed to generate connection ID", "error", err)
+			return nil
+		}
+		return writeConnectResponse(h.transactionID, id)
+
+	case announceActionID:
+		req, err := announceRequest(packet, ip, s.cfg)
+		if err == errMalformedPacket {
+			return nil
+		}
+		if !s.connIDs.validate(h.connectionID, ip) {
+			return writeError(h.transactionID, errBadConnectionID)
+		}
+		if err != nil {
+			return writeError(h.transactionID, err)
+		}
+
+		resp, err := s.tkr.HandleAnnounce(req)
+		if err != nil {
+			return writeError(h.transactionID, err)
+		}
+		return writeAnnounceResponse(h.transactionID, resp, ip.To4() == nil)
+
+	case scrapeActionID:
+		req, err := scrapeRequest(packet, ip)
+		if err == errMalformedPacket {
+			return nil
+		}
+		if !s.connIDs.validate(h.connectionID, ip) {
+			return writeError(h.transactionID, errBadConnectionID)
+		}
+		if err != nil {
+			return writeError(h.transactionID, err)
+		}
+
+		resp, err := s.tkr.HandleScrape(req)
+		if err != nil {
+			return writeError(h.transactionID, err)
+		}
+		return writeScrapeResponse(h.transactionID, req, resp)
+	}
+
+	return nil
+}
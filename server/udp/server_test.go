@@ -0,0 +1,350 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+var (
+	testInfoHash  = chihaya.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	testInfoHash2 = chihaya.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	testPeerID    = chihaya.PeerIDFromString("-TEST01-000000000000")
+	testTxID      = []byte{0xde, 0xad, 0xbe, 0xef}
+
+	v4Addr = &net.UDPAddr{IP: net.ParseIP("10.11.12.13"), Port: 6881}
+	v6Addr = &net.UDPAddr{IP: net.ParseIP("fc00::1"), Port: 6881}
+
+	// lastAnnounce is the last AnnounceRequest seen by the test middleware.
+	lastAnnounce *chihaya.AnnounceRequest
+
+	// blockAnnounce is called by the test middleware for every announce, if
+	// it is set.
+	blockAnnounce func()
+)
+
+func init() {
+	tracker.RegisterAnnounceMiddleware("udp_test", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			lastAnnounce = req
+			if blockAnnounce != nil {
+				blockAnnounce()
+			}
+			if req.Event == event.Completed {
+				return tracker.ClientError("no completions")
+			}
+
+			resp.Interval = 30 * time.Minute
+			resp.Complete = 2
+			resp.Incomplete = 1
+			resp.IPv4Peers = []chihaya.Peer{
+				{IP: net.ParseIP("1.2.3.4").To4(), Port: 0x1ae1},
+				{IP: net.ParseIP("5.6.7.8"), Port: 0x1ae2},
+			}
+			resp.IPv6Peers = []chihaya.Peer{
+				{IP: net.ParseIP("fc00::2"), Port: 0x1ae3},
+			}
+			return next(cfg, req, resp)
+		}
+	})
+
+	tracker.RegisterScrapeMiddleware("udp_test", func(next tracker.ScrapeHandler) tracker.ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			resp.Files[testInfoHash] = chihaya.Scrape{Complete: 3, Incomplete: 4, Downloaded: 5}
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+func newTestServer(t *testing.T, config map[string]interface{}) *udpServer {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "udp_test"}},
+		ScrapeMiddleware:   []chihaya.MiddlewareConfig{{Name: "udp_test"}},
+	})
+	require.Nil(t, err)
+
+	srv, err := constructor(&chihaya.ServerConfig{Name: "udp", Config: config}, tkr)
+	require.Nil(t, err)
+	return srv.(*udpServer)
+}
+
+func packet(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		err := binary.Write(&buf, binary.BigEndian, field)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func connectPacket() []byte {
+	return packet(uint64(protocolID), connectActionID, testTxID)
+}
+
+func announcePacket(connID []byte, eventID uint32, ip net.IP, numWant int32) []byte {
+	return packet(
+		connID, announceActionID, testTxID,
+		testInfoHash, testPeerID,
+		uint64(100), uint64(200), uint64(300),
+		eventID, []byte(ip.To4()), uint32(0x12345678), numWant, uint16(0x1ae0),
+	)
+}
+
+func scrapePacket(connID []byte, infoHashes ...chihaya.InfoHash) []byte {
+	fields := []interface{}{connID, scrapeActionID, testTxID}
+	for _, infoHash := range infoHashes {
+		fields = append(fields, infoHash)
+	}
+	return packet(fields...)
+}
+
+func connect(t *testing.T, s *udpServer, addr *net.UDPAddr) []byte {
+	resp := s.handlePacket(connectPacket(), addr)
+	require.Len(t, resp, 16)
+	return resp[8:]
+}
+
+func TestConnect(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	resp := s.handlePacket(connectPacket(), v4Addr)
+	require.Equal(t, packet(connectActionID, testTxID), resp[:8])
+	require.True(t, s.connIDs.validate(resp[8:], v4Addr.IP))
+
+	// the protocol ID is required
+	require.Nil(t, s.handlePacket(packet(uint64(0x1234), connectActionID, testTxID), v4Addr))
+}
+
+func TestAnnounce(t *testing.T) {
+	s := newTestServer(t, nil)
+	connID := connect(t, s, v4Addr)
+
+	resp := s.handlePacket(announcePacket(connID, 2, net.IPv4zero, -1), v4Addr)
+	require.Equal(t, packet(
+		announceActionID, testTxID,
+		uint32(1800), uint32(1), uint32(2),
+		[]byte{1, 2, 3, 4}, uint16(0x1ae1),
+		[]byte{5, 6, 7, 8}, uint16(0x1ae2),
+	), resp)
+
+	require.Equal(t, (&chihaya.AnnounceRequest{
+		Event:      event.Started,
+		InfoHash:   testInfoHash,
+		PeerID:     testPeerID,
+		IPv4:       net.ParseIP("10.11.12.13").To4(),
+		Port:       0x1ae0,
+		Key:        "12345678",
+		Compact:    true,
+		NumWant:    defaultNumWant,
+		Downloaded: 100,
+		Left:       200,
+		Uploaded:   300,
+		Params:     noParams{},
+	}).WithContext(lastAnnounce.Context()), lastAnnounce)
+	require.NotEqual(t, "", log.RequestID(lastAnnounce.Context()))
+
+	// client errors are reported
+	resp = s.handlePacket(announcePacket(connID, 1, net.IPv4zero, 10), v4Addr)
+	require.Equal(t, append(packet(errorActionID, testTxID), "no completions"...), resp)
+
+	// unknown events are reported
+	resp = s.handlePacket(announcePacket(connID, 4, net.IPv4zero, 10), v4Addr)
+	require.Equal(t, append(packet(errorActionID, testTxID), "failed to provide valid client event"...), resp)
+
+	// the connection ID must be valid
+	resp = s.handlePacket(announcePacket(make([]byte, 8), 0, net.IPv4zero, 10), v4Addr)
+	require.Equal(t, append(packet(errorActionID, testTxID), "bad connection ID"...), resp)
+
+	other := &net.UDPAddr{IP: net.ParseIP("10.11.12.14"), Port: 6881}
+	resp = s.handlePacket(announcePacket(connID, 0, net.IPv4zero, 10), other)
+	require.Equal(t, append(packet(errorActionID, testTxID), "bad connection ID"...), resp)
+}
+
+func TestAnnounceIPSpoofing(t *testing.T) {
+	spoofed := net.ParseIP("10.0.0.1").To4()
+
+	s := newTestServer(t, nil)
+	connID := connect(t, s, v4Addr)
+	s.handlePacket(announcePacket(connID, 0, spoofed, 10), v4Addr)
+	require.Equal(t, net.ParseIP("10.11.12.13").To4(), lastAnnounce.IPv4)
+	require.Equal(t, int32(10), lastAnnounce.NumWant)
+
+	s = newTestServer(t, map[string]interface{}{"allow_ip_spoofing": true})
+	connID = connect(t, s, v4Addr)
+	s.handlePacket(announcePacket(connID, 0, spoofed, 10), v4Addr)
+	require.Equal(t, spoofed, lastAnnounce.IPv4)
+}
+
+func TestAnnounceNumWant(t *testing.T) {
+	s := newTestServer(t, nil)
+	connID := connect(t, s, v4Addr)
+	s.handlePacket(announcePacket(connID, 0, net.IPv4zero, 10000), v4Addr)
+	require.Equal(t, int32(defaultMaxNumWant), lastAnnounce.NumWant)
+
+	s = newTestServer(t, map[string]interface{}{"max_num_want": 200})
+	connID = connect(t, s, v4Addr)
+	s.handlePacket(announcePacket(connID, 0, net.IPv4zero, 10000), v4Addr)
+	require.Equal(t, int32(200), lastAnnounce.NumWant)
+	s.handlePacket(announcePacket(connID, 0, net.IPv4zero, -1), v4Addr)
+	require.Equal(t, int32(defaultNumWant), lastAnnounce.NumWant)
+
+	_, err := newUDPConfig(&chihaya.ServerConfig{Config: map[string]interface{}{"default_num_want": 100, "max_num_want": 20}})
+	require.NotNil(t, err)
+}
+
+func TestAnnounceIPv6(t *testing.T) {
+	// IPv6 is disabled by default
+	s := newTestServer(t, nil)
+	require.Nil(t, s.handlePacket(connectPacket(), v6Addr))
+
+	s = newTestServer(t, map[string]interface{}{"allow_ipv6": true})
+	connID := connect(t, s, v6Addr)
+
+	resp := s.handlePacket(announcePacket(connID, 0, net.IPv4zero, 10), v6Addr)
+	require.Equal(t, packet(
+		announceActionID, testTxID,
+		uint32(1800), uint32(1), uint32(2),
+		[]byte(net.ParseIP("fc00::2")), uint16(0x1ae3),
+	), resp)
+	require.Nil(t, lastAnnounce.IPv4)
+	require.Equal(t, v6Addr.IP, lastAnnounce.IPv6)
+}
+
+func TestScrape(t *testing.T) {
+	s := newTestServer(t, nil)
+	connID := connect(t, s, v4Addr)
+
+	resp := s.handlePacket(scrapePacket(connID, testInfoHash2, testInfoHash), v4Addr)
+	require.Equal(t, packet(
+		scrapeActionID, testTxID,
+		uint32(0), uint32(0), uint32(0),
+		uint32(3), uint32(5), uint32(4),
+	), resp)
+
+	infoHashes := make([]chihaya.InfoHash, maxScrapeInfoHashes+1)
+	resp = s.handlePacket(scrapePacket(connID, infoHashes...), v4Addr)
+	require.Equal(t, append(packet(errorActionID, testTxID), "too many infohashes"...), resp)
+
+	resp = s.handlePacket(scrapePacket(make([]byte, 8), testInfoHash), v4Addr)
+	require.Equal(t, append(packet(errorActionID, testTxID), "bad connection ID"...), resp)
+}
+
+func TestMalformedPackets(t *testing.T) {
+	s := newTestServer(t, nil)
+	connID := connect(t, s, v4Addr)
+
+	// truncated packets are dropped
+	for _, p := range [][]byte{connectPacket(), announcePacket(connID, 0, net.IPv4zero, 10)} {
+		for i := 0; i < len(p); i++ {
+			require.Nil(t, s.handlePacket(p[:i], v4Addr), "action %d truncated to %d bytes", p[11], i)
+		}
+	}
+
+	// scrapes must contain whole infohashes
+	p := scrapePacket(connID, testInfoHash, testInfoHash2)
+	for _, i := range []int{headerLen, headerLen + 19, headerLen + 21, len(p) - 1} {
+		require.Nil(t, s.handlePacket(p[:i], v4Addr), "scrape truncated to %d bytes", i)
+	}
+
+	// unknown actions are dropped
+	require.Nil(t, s.handlePacket(packet(connID, uint32(4), testTxID), v4Addr))
+	require.Nil(t, s.handlePacket(packet(connID, errorActionID, testTxID), v4Addr))
+}
+
+func TestServe(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"addr": "127.0.0.1:0"})
+	require.Nil(t, s.listen())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.serve()
+		close(stopped)
+	}()
+
+	conn, err := net.DialUDP("udp", nil, s.conn.LocalAddr().(*net.UDPAddr))
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// malformed packets get no response, so the connect response is the
+	// first packet received
+	_, err = conn.Write([]byte{1, 2, 3})
+	require.Nil(t, err)
+	_, err = conn.Write(connectPacket())
+	require.Nil(t, err)
+
+	buf := make([]byte, maxPacketLen)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, 16, n)
+	require.Equal(t, packet(connectActionID, testTxID), buf[:8])
+	connID := append([]byte(nil), buf[8:16]...)
+
+	_, err = conn.Write(scrapePacket(connID, testInfoHash))
+	require.Nil(t, err)
+	n, err = conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, packet(scrapeActionID, testTxID, uint32(3), uint32(5), uint32(4)), buf[:n])
+
+	s.Stop()
+	<-stopped
+}
+
+func TestStopAnswersQueuedPackets(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"addr": "127.0.0.1:0", "workers": 1})
+	require.Nil(t, s.listen())
+
+	handling, release := make(chan struct{}), make(chan struct{})
+	blockAnnounce = func() {
+		close(handling)
+		<-release
+	}
+	defer func() { blockAnnounce = nil }()
+
+	go s.serve()
+
+	conn, err := net.DialUDP("udp", nil, s.conn.LocalAddr().(*net.UDPAddr))
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write(connectPacket())
+	require.Nil(t, err)
+	buf := make([]byte, maxPacketLen)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, 16, n)
+	connID := append([]byte(nil), buf[8:16]...)
+
+	// an announce that is handled while the server stops is still answered
+	_, err = conn.Write(announcePacket(connID, 0, net.IPv4zero, 1))
+	require.Nil(t, err)
+	<-handling
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	<-s.closing
+	close(release)
+
+	n, err = conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, packet(announceActionID, testTxID), buf[:8])
+	<-stopped
+}
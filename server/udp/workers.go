@@ -0,0 +1,82 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(droppedPackets)
+}
+
+var droppedPackets = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "chihaya",
+	Subsystem: "udp",
+	Name:      "dropped_packets_total",
+	Help:      "The number of packets dropped because the queue of the UDP server was full.",
+})
+
+// datagram is a packet received from addr.
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// workerPool handles packets with a fixed number of workers.
+//
+// Packets wait for a worker in a queue of a fixed size. Packets that arrive
+// while the queue is full are dropped, so that a flood of packets neither
+// blocks the read loop nor makes the server run out of memory. Clients retry
+// requests that are not answered, as BEP 15 asks them to.
+type workerPool struct {
+	queue  chan datagram
+	handle func(datagram)
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts workers that call handle for the packets submitted to
+// the pool.
+func newWorkerPool(workers, queueSize int, handle func(datagram)) *workerPool {
+	p := &workerPool{
+		queue:  make(chan datagram, queueSize),
+		handle: handle,
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for pkt := range p.queue {
+		p.handle(pkt)
+	}
+}
+
+// submit queues pkt without blocking. It returns false and counts the packet
+// as dropped if the queue is full.
+func (p *workerPool) submit(pkt datagram) bool {
+	select {
+	case p.queue <- pkt:
+		return true
+	default:
+		droppedPackets.Inc()
+		return false
+	}
+}
+
+// stop waits for the workers to handle the queued packets and stops them.
+// Packets must not be submitted after stop was called.
+func (p *workerPool) stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
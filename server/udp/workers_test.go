@@ -0,0 +1,58 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	require.Nil(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestWorkerPoolOverload(t *testing.T) {
+	const (
+		workers   = 2
+		queueSize = 4
+		flood     = 100
+	)
+
+	unblock := make(chan struct{})
+	var handled int32
+	p := newWorkerPool(workers, queueSize, func(datagram) {
+		<-unblock
+		atomic.AddInt32(&handled, 1)
+	})
+
+	// Submitting never blocks: once the workers are busy and the queue is
+	// full, packets are dropped.
+	dropsBefore := counterValue(t, droppedPackets)
+	accepted := 0
+	for i := 0; i < flood; i++ {
+		if p.submit(datagram{data: []byte{byte(i)}, addr: v4Addr}) {
+			accepted++
+		}
+	}
+	require.True(t, accepted >= queueSize && accepted <= queueSize+workers, "accepted %d packets", accepted)
+	require.Equal(t, float64(flood-accepted), counterValue(t, droppedPackets)-dropsBefore)
+
+	// The workers drain the queue once they are unblocked.
+	close(unblock)
+	p.stop()
+	require.Equal(t, int32(accepted), atomic.LoadInt32(&handled))
+}
+
+func TestWorkerConfig(t *testing.T) {
+	s := newTestServer(t, nil)
+	require.True(t, s.cfg.Workers > 0)
+	require.Equal(t, defaultQueueSize, s.cfg.QueueSize)
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+// writeHeader writes the action and transaction ID every response starts
+// with.
+func writeHeader(w *bytes.Buffer, action uint32, transactionID []byte) {
+	binary.Write(w, binary.BigEndian, action)
+	w.Write(transactionID)
+}
+
+func writeError(transactionID []byte, err error) []byte {
+	message := "internal server error"
+	switch err.(type) {
+	case tracker.ClientError, tracker.RetryError:
+		message = err.Error()
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, errorActionID, transactionID)
+	buf.WriteString(message)
+	return buf.Bytes()
+}
+
+func writeConnectResponse(transactionID, connectionID []byte) []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, connectActionID, transactionID)
+	buf.Write(connectionID)
+	return buf.Bytes()
+}
+
+// writeAnnounceResponse writes an announce response containing the IPv6 peers
+// of resp if v6 is true and the IPv4 peers otherwise, as the address family
+// of the peers is implied by the one the request was sent over.
+func writeAnnounceResponse(transactionID []byte, resp *chihaya.AnnounceResponse, v6 bool) []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, announceActionID, transactionID)
+	binary.Write(&buf, binary.BigEndian, uint32(resp.Interval/time.Second))
+	binary.Write(&buf, binary.BigEndian, uint32(resp.Incomplete))
+	binary.Write(&buf, binary.BigEndian, uint32(resp.Complete))
+
+	peers := resp.IPv4Peers
+	if v6 {
+		peers = resp.IPv6Peers
+	}
+
+	for _, peer := range peers {
+		ip := peer.IP.To4()
+		if v6 {
+			ip = peer.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, peer.Port)
+	}
+
+	return buf.Bytes()
+}
+
+// writeScrapeResponse writes a scrape response containing the swarms of the
+// requested infohashes in the order they were requested.
+// Infohashes that are missing from resp are reported as empty swarms.
+func writeScrapeResponse(transactionID []byte, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, scrapeActionID, transactionID)
+
+	for _, infoHash := range req.InfoHashes {
+		scrape := resp.Files[infoHash]
+		binary.Write(&buf, binary.BigEndian, uint32(scrape.Complete))
+		binary.Write(&buf, binary.BigEndian, uint32(scrape.Downloaded))
+		binary.Write(&buf, binary.BigEndian, uint32(scrape.Incomplete))
+	}
+
+	return buf.Bytes()
+}
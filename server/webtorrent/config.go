@@ -0,0 +1,80 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package webtorrent
+
+import (
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/listen"
+)
+
+const (
+	// defaultAnnounceInterval is the interval WebTorrent clients use if the
+	// tracker does not specify one.
+	defaultAnnounceInterval = 2 * time.Minute
+
+	// defaultReadTimeout allows a client to miss one announce before it is
+	// dropped.
+	defaultReadTimeout = 5 * time.Minute
+
+	defaultWriteTimeout = 10 * time.Second
+
+	// defaultMaxNumWant is the default maximum number of peers a single
+	// announce relays offers to.
+	defaultMaxNumWant = 10
+)
+
+type webtorrentConfig struct {
+	Addr             string        `yaml:"addr"`
+	AnnounceInterval time.Duration `yaml:"announce_interval"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	MaxNumWant       int           `yaml:"max_numwant"`
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+
+	// AnnounceMiddleware is the middleware announces run through. If it is
+	// unset, it is the announce middleware of the tracker without the
+	// middleware that stores peers in and returns them from the PeerStore.
+	AnnounceMiddleware []chihaya.MiddlewareConfig `yaml:"announce_middleware"`
+
+	// Config holds the options Addr is listened on with.
+	listen.Config `yaml:",inline"`
+}
+
+func newWebTorrentConfig(srvcfg *chihaya.ServerConfig) (*webtorrentConfig, error) {
+	bytes, err := yaml.Marshal(srvcfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg webtorrentConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AnnounceInterval <= 0 {
+		cfg.AnnounceInterval = defaultAnnounceInterval
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.MaxNumWant <= 0 {
+		cfg.MaxNumWant = defaultMaxNumWant
+	}
+
+	err = cfg.Config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package webtorrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/chihaya/chihaya/tracker"
+)
+
+const announceAction = "announce"
+
+var (
+	errUnsupportedAction = tracker.ClientError("unsupported action")
+	errMalformedInfoHash = tracker.ClientError("malformed info_hash")
+	errMalformedPeerID   = tracker.ClientError("malformed peer_id")
+	errMalformedMessage  = tracker.ClientError("malformed message")
+)
+
+// request is a message sent by a client.
+//
+// An announce with an answer and a to_peer_id is the answer to an offer the
+// client received and is forwarded to the peer that made the offer.
+type request struct {
+	Action   string          `json:"action"`
+	InfoHash string          `json:"info_hash"`
+	PeerID   string          `json:"peer_id"`
+	NumWant  *int            `json:"numwant"`
+	Left     *float64        `json:"left"`
+	Event    string          `json:"event"`
+	Offers   []offer         `json:"offers"`
+	Answer   json.RawMessage `json:"answer"`
+	OfferID  string          `json:"offer_id"`
+	ToPeerID string          `json:"to_peer_id"`
+}
+
+type offer struct {
+	Offer   json.RawMessage `json:"offer"`
+	OfferID string          `json:"offer_id"`
+}
+
+type announceResponse struct {
+	Action     string `json:"action"`
+	Interval   int    `json:"interval"`
+	InfoHash   string `json:"info_hash"`
+	Complete   int    `json:"complete"`
+	Incomplete int    `json:"incomplete"`
+}
+
+// offerMessage relays an offer to a peer.
+type offerMessage struct {
+	Action   string          `json:"action"`
+	Offer    json.RawMessage `json:"offer"`
+	OfferID  string          `json:"offer_id"`
+	PeerID   string          `json:"peer_id"`
+	InfoHash string          `json:"info_hash"`
+}
+
+// answerMessage forwards an answer to the peer that made the offer.
+type answerMessage struct {
+	Action   string          `json:"action"`
+	Answer   json.RawMessage `json:"answer"`
+	OfferID  string          `json:"offer_id"`
+	PeerID   string          `json:"peer_id"`
+	InfoHash string          `json:"info_hash"`
+}
+
+type errorResponse struct {
+	Action        string `json:"action,omitempty"`
+	InfoHash      string `json:"info_hash,omitempty"`
+	FailureReason string `json:"failure reason"`
+}
+
+// decodeID decodes a 20 byte info_hash or peer_id.
+//
+// WebTorrent clients send them as binary strings, i.e. one code point per
+// byte, but 40 character hex strings are accepted, too. isHex reports which
+// of both was used, so that responses can be encoded the same way.
+func decodeID(s string) (id [20]byte, isHex bool, ok bool) {
+	if len(s) == 2*len(id) {
+		if _, err := hex.Decode(id[:], []byte(s)); err == nil {
+			return id, true, true
+		}
+	}
+
+	var i int
+	for _, r := range s {
+		if i == len(id) || r > 0xff {
+			return id, false, false
+		}
+		id[i] = byte(r)
+		i++
+	}
+
+	return id, false, i == len(id)
+}
+
+// encodeID encodes a 20 byte info_hash or peer_id as a hex or binary string.
+func encodeID(id [20]byte, isHex bool) string {
+	if isHex {
+		return hex.EncodeToString(id[:])
+	}
+
+	runes := make([]rune, len(id))
+	for i, b := range id {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
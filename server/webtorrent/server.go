@@ -0,0 +1,466 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package webtorrent implements a tracker for WebTorrent clients, which
+// announce over WebSockets and exchange WebRTC offers and answers through the
+// tracker.
+package webtorrent
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/event"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/server"
+	"github.com/chihaya/chihaya/server/http/query"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+func init() {
+	server.Register("webtorrent", constructor)
+}
+
+func constructor(srvcfg *chihaya.ServerConfig, tkr *tracker.Tracker) (server.Server, error) {
+	cfg, err := newWebTorrentConfig(srvcfg)
+	if err != nil {
+		return nil, errors.New("webtorrent: invalid config: " + err.Error())
+	}
+
+	s := &webtorrentServer{
+		cfg:     cfg,
+		tkr:     tkr,
+		peers:   newRegistry(),
+		clients: make(map[*client]struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.upgrader.CheckOrigin = s.checkOrigin
+
+	if _, err := s.announceTracker(); err != nil {
+		return nil, errors.New("webtorrent: invalid announce middleware: " + err.Error())
+	}
+
+	return s, nil
+}
+
+// webtorrentServer keeps its peers in memory rather than in the PeerStore:
+// WebTorrent peers have no endpoint other peers could connect to, they are
+// only reachable through the connection they announced on. Stored in the
+// PeerStore, they would be handed to HTTP and UDP clients that can not reach
+// them, and counted in their swarms.
+//
+// Announces still run through the announce middleware of the tracker, so
+// that its policies, e.g. passkeys, black- and whitelists and rate limits,
+// apply to WebTorrent peers, too. The middleware that stores peers in and
+// returns them from the PeerStore is left out, see announceTracker.
+type webtorrentServer struct {
+	cfg      *webtorrentConfig
+	tkr      *tracker.Tracker
+	peers    *registry
+	upgrader websocket.Upgrader
+	listener net.Listener
+
+	// chain is the Tracker announces run through.
+	chain atomic.Pointer[announceChain]
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+
+	closing chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// announceChain is a Tracker that runs the announce middleware of WebTorrent
+// peers, along with the configuration of the tracker it was derived from.
+type announceChain struct {
+	from *chihaya.TrackerConfig
+	tkr  *tracker.Tracker
+}
+
+// peerStoreMiddleware are the announce middleware that store peers in and
+// return them from the PeerStore, which WebTorrent peers are kept out of.
+var peerStoreMiddleware = map[string]bool{
+	"store_swarm_interaction": true,
+	"store_response":          true,
+}
+
+// announceTracker returns the Tracker announces run through. It has the
+// configured announce_middleware, or the announce middleware of the tracker
+// without the peerStoreMiddleware if none is configured.
+//
+// It is derived again whenever the tracker was reloaded. If that fails, the
+// previous one is kept.
+func (s *webtorrentServer) announceTracker() (*tracker.Tracker, error) {
+	from := s.tkr.Config()
+	previous := s.chain.Load()
+	if previous != nil && previous.from == from {
+		return previous.tkr, nil
+	}
+
+	cfg := *from
+	cfg.ScrapeMiddleware = nil
+	cfg.AnnounceMiddleware = s.cfg.AnnounceMiddleware
+	if cfg.AnnounceMiddleware == nil {
+		for _, mw := range from.AnnounceMiddleware {
+			if !peerStoreMiddleware[mw.Name] {
+				cfg.AnnounceMiddleware = append(cfg.AnnounceMiddleware, mw)
+			}
+		}
+	}
+
+	tkr, err := tracker.NewTracker(&cfg)
+	if err != nil && previous != nil {
+		log.Error("webtorrent: failed to reload announce middleware, keeping the previous one", "error", err)
+		return previous.tkr, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.chain.Store(&announceChain{from: from, tkr: tkr})
+	return tkr, nil
+}
+
+// client is a WebSocket connection.
+type client struct {
+	conn         *websocket.Conn
+	writeTimeout time.Duration
+
+	// ip, passkey and params are the address of the client and the
+	// passkey and query parameters of the URL it connected to, which its
+	// announces are made with.
+	ip      net.IP
+	passkey string
+	params  chihaya.Params
+
+	// wmu serializes writes, which can happen concurrently when other
+	// clients' offers and answers are relayed.
+	wmu sync.Mutex
+}
+
+// send writes a message to the client.
+//
+// A failed write closes the connection, which removes the client's peers.
+func (c *client) send(msg interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.conn.Close()
+	}
+}
+
+// Start runs the server and blocks until it has exited.
+//
+// It panics if the server exits unexpectedly.
+func (s *webtorrentServer) Start() {
+	if err := s.listen(); err != nil {
+		log.Error("failed to run WebTorrent server", "error", err)
+		panic(err)
+	}
+
+	s.serve()
+	log.Info("WebTorrent server shut down cleanly")
+}
+
+// Stop stops the server and blocks until the server has exited.
+func (s *webtorrentServer) Stop() {
+	s.mu.Lock()
+	close(s.closing)
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.listener.Close()
+	<-s.done
+}
+
+func (s *webtorrentServer) listen() (err error) {
+	s.listener, err = s.cfg.Listen("tcp", s.cfg.Addr)
+	return err
+}
+
+// serve accepts connections until the server is stopped and all connections
+// have been closed.
+func (s *webtorrentServer) serve() {
+	defer close(s.done)
+	defer s.wg.Wait()
+
+	err := http.Serve(s.listener, s)
+
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+
+	log.Error("failed to run WebTorrent server", "error", err)
+	panic(err)
+}
+
+func (s *webtorrentServer) checkOrigin(r *http.Request) bool {
+	if len(s.cfg.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP upgrades a request to a WebSocket connection and handles its
+// messages until it is closed.
+func (s *webtorrentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &client{conn: conn, writeTimeout: s.cfg.WriteTimeout}
+	c.ip, c.passkey, c.params = clientAnnounceParams(r)
+	if !s.register(c) {
+		conn.Close()
+		return
+	}
+	defer s.unregister(c)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.ReadTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.send(errorResponse{FailureReason: string(errMalformedMessage)})
+			continue
+		}
+
+		s.handleRequest(c, &req)
+	}
+}
+
+// clientAnnounceParams returns the IP of the client of r, and the passkey and
+// parameters of the URL it connected to. The passkey is either the passkey
+// parameter, or the last element of the path unless that is "announce".
+func clientAnnounceParams(r *http.Request) (ip net.IP, passkey string, params chihaya.Params) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	q, err := query.New(r.URL.RawQuery)
+	if err != nil {
+		q, _ = query.New("")
+	}
+
+	passkey, _ = q.String("passkey")
+	if last := path.Base(r.URL.Path); passkey == "" && last != "announce" && last != "/" && last != "." {
+		passkey = last
+	}
+	return ip, passkey, q
+}
+
+// register adds c to the open connections unless the server is stopping.
+func (s *webtorrentServer) register(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		return false
+	default:
+	}
+
+	s.clients[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// unregister closes c and removes its peers from all swarms.
+func (s *webtorrentServer) unregister(c *client) {
+	s.peers.deleteClient(c)
+	c.conn.Close()
+
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *webtorrentServer) handleRequest(c *client, req *request) {
+	if req.Action != announceAction {
+		c.send(errorResponse{Action: req.Action, FailureReason: string(errUnsupportedAction)})
+		return
+	}
+
+	ih, ihHex, ok := decodeID(req.InfoHash)
+	if !ok {
+		c.send(errorResponse{Action: req.Action, FailureReason: string(errMalformedInfoHash)})
+		return
+	}
+	infoHash := chihaya.InfoHash(ih)
+
+	id, idHex, ok := decodeID(req.PeerID)
+	if !ok {
+		c.send(errorResponse{Action: req.Action, InfoHash: req.InfoHash, FailureReason: string(errMalformedPeerID)})
+		return
+	}
+	peerID := chihaya.PeerID(id)
+
+	if req.Answer != nil {
+		s.forwardAnswer(c, infoHash, peerID, req)
+		return
+	}
+
+	resp, err := s.announce(c, infoHash, peerID, req)
+	if err != nil {
+		c.send(errorResponse{Action: req.Action, InfoHash: req.InfoHash, FailureReason: failureReason(err)})
+		return
+	}
+
+	p := &peer{
+		client: c,
+		seeder: req.Event == "completed" || (req.Left != nil && *req.Left == 0),
+		hex:    ihHex || idHex,
+	}
+	if req.Event == "stopped" {
+		s.peers.delete(infoHash, peerID, c)
+	} else {
+		s.peers.put(infoHash, peerID, p)
+	}
+
+	interval := s.cfg.AnnounceInterval
+	if resp.Interval > 0 {
+		interval = resp.Interval
+	}
+	complete, incomplete := s.peers.counts(infoHash)
+	c.send(announceResponse{
+		Action:     announceAction,
+		Interval:   int(interval / time.Second),
+		InfoHash:   req.InfoHash,
+		Complete:   complete,
+		Incomplete: incomplete,
+	})
+
+	if req.Event != "stopped" {
+		s.relayOffers(infoHash, peerID, p.seeder, req)
+	}
+}
+
+// announce runs an announce of c through the announce middleware, before the
+// peer joins or leaves the swarm.
+func (s *webtorrentServer) announce(c *client, infoHash chihaya.InfoHash, peerID chihaya.PeerID, req *request) (*chihaya.AnnounceResponse, error) {
+	ev, err := event.New(req.Event)
+	if err != nil {
+		return nil, tracker.ClientError("invalid event")
+	}
+
+	areq := &chihaya.AnnounceRequest{
+		Event:    ev,
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		Passkey:  c.passkey,
+		Params:   c.params,
+	}
+	if ip := c.ip.To4(); ip != nil {
+		areq.IPv4 = ip
+	} else {
+		areq.IPv6 = c.ip
+	}
+	if req.Left != nil && *req.Left > 0 {
+		areq.Left = uint64(*req.Left)
+	}
+	if req.NumWant != nil {
+		areq.NumWant = int32(*req.NumWant)
+	}
+
+	tkr, err := s.announceTracker()
+	if err != nil {
+		return nil, err
+	}
+	return tkr.HandleAnnounce(areq)
+}
+
+// failureReason returns the failure reason an error of the announce
+// middleware is reported to the client with.
+func failureReason(err error) string {
+	switch err.(type) {
+	case tracker.ClientError, tracker.RetryError:
+		return err.Error()
+	}
+	return "internal server error"
+}
+
+// relayOffers sends each of the offers of an announce to a different peer of
+// the swarm.
+func (s *webtorrentServer) relayOffers(infoHash chihaya.InfoHash, from chihaya.PeerID, seeder bool, req *request) {
+	n := len(req.Offers)
+	if req.NumWant != nil && *req.NumWant < n {
+		n = *req.NumWant
+	}
+	if n > s.cfg.MaxNumWant {
+		n = s.cfg.MaxNumWant
+	}
+	if n <= 0 {
+		return
+	}
+
+	var i int
+	for _, p := range s.peers.sample(infoHash, from, seeder, n) {
+		p.client.send(offerMessage{
+			Action:   announceAction,
+			Offer:    req.Offers[i].Offer,
+			OfferID:  req.Offers[i].OfferID,
+			PeerID:   encodeID(from, p.hex),
+			InfoHash: encodeID(infoHash, p.hex),
+		})
+		i++
+	}
+}
+
+// forwardAnswer sends an answer to the peer that made the offer.
+//
+// Answers are only accepted from peers announced on the same connection and
+// are dropped if the offering peer has left.
+func (s *webtorrentServer) forwardAnswer(c *client, infoHash chihaya.InfoHash, from chihaya.PeerID, req *request) {
+	if s.peers.get(infoHash, from, c) == nil {
+		return
+	}
+
+	to, _, ok := decodeID(req.ToPeerID)
+	if !ok {
+		c.send(errorResponse{Action: req.Action, InfoHash: req.InfoHash, FailureReason: string(errMalformedPeerID)})
+		return
+	}
+
+	p := s.peers.get(infoHash, chihaya.PeerID(to), nil)
+	if p == nil {
+		return
+	}
+
+	p.client.send(answerMessage{
+		Action:   announceAction,
+		Answer:   req.Answer,
+		OfferID:  req.OfferID,
+		PeerID:   encodeID(from, p.hex),
+		InfoHash: encodeID(infoHash, p.hex),
+	})
+}
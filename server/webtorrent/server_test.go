@@ -0,0 +1,337 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package webtorrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/tracker"
+)
+
+const (
+	testInfoHash = "aaaaaaaaaaaaaaaaaaaa"
+	seederID     = "-WW0001-seederseeder"
+	leecherID    = "-WW0001-leecherleech"
+)
+
+func newTestServer(t *testing.T) *webtorrentServer {
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+	return newTestServerWithTracker(t, tkr)
+}
+
+func newTestServerWithTracker(t *testing.T, tkr *tracker.Tracker) *webtorrentServer {
+	srv, err := constructor(&chihaya.ServerConfig{
+		Name:   "webtorrent",
+		Config: map[string]interface{}{"addr": "127.0.0.1:0"},
+	}, tkr)
+	require.Nil(t, err)
+
+	s := srv.(*webtorrentServer)
+	require.Nil(t, s.listen())
+	go s.serve()
+	return s
+}
+
+func dial(t *testing.T, s *webtorrentServer) *websocket.Conn {
+	return dialPath(t, s, "/announce")
+}
+
+func dialPath(t *testing.T, s *webtorrentServer, path string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+s.listener.Addr().String()+path, nil)
+	require.Nil(t, err)
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, msg map[string]interface{}) {
+	require.Nil(t, conn.WriteJSON(msg))
+}
+
+func receive(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg map[string]interface{}
+	require.Nil(t, conn.ReadJSON(&msg))
+	return msg
+}
+
+func TestOfferAnswerRelay(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	seeder := dial(t, s)
+	defer seeder.Close()
+	send(t, seeder, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   seederID,
+		"left":      0,
+		"numwant":   5,
+		"offers":    []interface{}{},
+	})
+	resp := receive(t, seeder)
+	require.Equal(t, "announce", resp["action"])
+	require.Equal(t, float64(120), resp["interval"])
+	require.Equal(t, float64(1), resp["complete"])
+	require.Equal(t, float64(0), resp["incomplete"])
+
+	leecher := dial(t, s)
+	defer leecher.Close()
+	send(t, leecher, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   leecherID,
+		"left":      100,
+		"numwant":   5,
+		"offers": []interface{}{
+			map[string]interface{}{
+				"offer_id": "offer1offer1offer1of",
+				"offer":    map[string]interface{}{"type": "offer", "sdp": "v=0"},
+			},
+			map[string]interface{}{
+				"offer_id": "offer2offer2offer2of",
+				"offer":    map[string]interface{}{"type": "offer", "sdp": "v=0"},
+			},
+		},
+	})
+	resp = receive(t, leecher)
+	require.Equal(t, float64(1), resp["complete"])
+	require.Equal(t, float64(1), resp["incomplete"])
+
+	// only one peer receives an offer
+	offer := receive(t, seeder)
+	require.Equal(t, "announce", offer["action"])
+	require.Equal(t, testInfoHash, offer["info_hash"])
+	require.Equal(t, leecherID, offer["peer_id"])
+	require.Equal(t, "offer1offer1offer1of", offer["offer_id"])
+	require.Equal(t, map[string]interface{}{"type": "offer", "sdp": "v=0"}, offer["offer"])
+
+	send(t, seeder, map[string]interface{}{
+		"action":     "announce",
+		"info_hash":  testInfoHash,
+		"peer_id":    seederID,
+		"to_peer_id": leecherID,
+		"offer_id":   offer["offer_id"],
+		"answer":     map[string]interface{}{"type": "answer", "sdp": "v=0"},
+	})
+	answer := receive(t, leecher)
+	require.Equal(t, "announce", answer["action"])
+	require.Equal(t, testInfoHash, answer["info_hash"])
+	require.Equal(t, seederID, answer["peer_id"])
+	require.Equal(t, "offer1offer1offer1of", answer["offer_id"])
+	require.Equal(t, map[string]interface{}{"type": "answer", "sdp": "v=0"}, answer["answer"])
+
+	// a dropped connection removes its peer
+	seeder.Close()
+	ih, _, _ := decodeID(testInfoHash)
+	for i := 0; ; i++ {
+		complete, _ := s.peers.counts(chihaya.InfoHash(ih))
+		if complete == 0 {
+			break
+		}
+		require.True(t, i < 100, "seeder was not removed")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	send(t, leecher, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   leecherID,
+		"left":      100,
+	})
+	resp = receive(t, leecher)
+	require.Equal(t, float64(0), resp["complete"])
+	require.Equal(t, float64(1), resp["incomplete"])
+}
+
+func TestHexIDs(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	binary := dial(t, s)
+	defer binary.Close()
+	send(t, binary, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   seederID,
+		"left":      0,
+	})
+	receive(t, binary)
+
+	hexInfoHash := "6161616161616161616161616161616161616161"
+	conn := dial(t, s)
+	defer conn.Close()
+	send(t, conn, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": hexInfoHash,
+		"peer_id":   "2d5757303030312d6c6565636865726865786964",
+		"left":      1,
+		"offers": []interface{}{
+			map[string]interface{}{"offer_id": "offer1offer1offer1of", "offer": map[string]interface{}{}},
+		},
+	})
+	resp := receive(t, conn)
+	require.Equal(t, hexInfoHash, resp["info_hash"])
+	require.Equal(t, float64(1), resp["complete"])
+
+	// the offer is encoded the way its recipient announced
+	offer := receive(t, binary)
+	require.Equal(t, testInfoHash, offer["info_hash"])
+	require.Equal(t, "-WW0001-leecherhexid", offer["peer_id"])
+}
+
+func TestFailures(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	conn := dial(t, s)
+	defer conn.Close()
+
+	require.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	require.Equal(t, "malformed message", receive(t, conn)["failure reason"])
+
+	send(t, conn, map[string]interface{}{"action": "scrape", "info_hash": testInfoHash})
+	require.Equal(t, "unsupported action", receive(t, conn)["failure reason"])
+
+	send(t, conn, map[string]interface{}{"action": "announce", "info_hash": "short", "peer_id": seederID})
+	require.Equal(t, "malformed info_hash", receive(t, conn)["failure reason"])
+
+	send(t, conn, map[string]interface{}{"action": "announce", "info_hash": testInfoHash, "peer_id": "Ā"})
+	require.Equal(t, "malformed peer_id", receive(t, conn)["failure reason"])
+}
+
+func TestAnnounceMiddleware(t *testing.T) {
+	var passkeys, stored []string
+	tracker.RegisterAnnounceMiddleware("webtorrent_test_banned", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			passkeys = append(passkeys, req.Passkey)
+			if req.Passkey != "good" {
+				return tracker.ClientError("unauthorized")
+			}
+			return next(cfg, req, resp)
+		}
+	})
+	tracker.RegisterAnnounceMiddleware("store_swarm_interaction", func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			stored = append(stored, req.Passkey)
+			return next(cfg, req, resp)
+		}
+	})
+
+	tkr, err := tracker.NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{
+			{Name: "webtorrent_test_banned"},
+			{Name: "store_swarm_interaction"},
+		},
+	})
+	require.Nil(t, err)
+	s := newTestServerWithTracker(t, tkr)
+	defer s.Stop()
+
+	seeder := dialPath(t, s, "/announce?passkey=good")
+	defer seeder.Close()
+	send(t, seeder, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   seederID,
+		"left":      0,
+	})
+	require.Equal(t, float64(1), receive(t, seeder)["complete"])
+
+	// a rejected announce fails, and neither joins the swarm nor relays
+	// its offers
+	banned := dialPath(t, s, "/bad/announce/evil")
+	defer banned.Close()
+	send(t, banned, map[string]interface{}{
+		"action":    "announce",
+		"info_hash": testInfoHash,
+		"peer_id":   leecherID,
+		"left":      100,
+		"offers": []interface{}{
+			map[string]interface{}{"offer_id": "offer1offer1offer1of", "offer": map[string]interface{}{}},
+		},
+	})
+	resp := receive(t, banned)
+	require.Equal(t, "unauthorized", resp["failure reason"])
+	require.Equal(t, testInfoHash, resp["info_hash"])
+
+	ih, _, _ := decodeID(testInfoHash)
+	complete, incomplete := s.peers.counts(chihaya.InfoHash(ih))
+	require.Equal(t, 1, complete)
+	require.Equal(t, 0, incomplete)
+	require.Equal(t, []string{"good", "evil"}, passkeys)
+
+	// WebTorrent peers are kept out of the PeerStore
+	require.Empty(t, stored)
+
+	seeder.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = seeder.ReadMessage()
+	require.NotNil(t, err, "the offer of a rejected announce was relayed")
+}
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	ih := chihaya.InfoHash{1}
+	c1, c2 := &client{}, &client{}
+
+	r.put(ih, chihaya.PeerID{1}, &peer{client: c1})
+	r.put(ih, chihaya.PeerID{2}, &peer{client: c2, seeder: true})
+	complete, incomplete := r.counts(ih)
+	require.Equal(t, 1, complete)
+	require.Equal(t, 1, incomplete)
+
+	// a leecher that completes is counted as a seeder once
+	r.put(ih, chihaya.PeerID{1}, &peer{client: c1, seeder: true})
+	r.put(ih, chihaya.PeerID{1}, &peer{client: c1, seeder: true})
+	complete, incomplete = r.counts(ih)
+	require.Equal(t, 2, complete)
+	require.Equal(t, 0, incomplete)
+
+	r.deleteClient(c2)
+	complete, incomplete = r.counts(ih)
+	require.Equal(t, 1, complete)
+	require.Equal(t, 0, incomplete)
+
+	// samples of large swarms only consider some of their peers
+	for i := 0; i < 2*maxSampleScan; i++ {
+		r.put(chihaya.InfoHash{2}, chihaya.PeerID{byte(i), byte(i >> 8), 1}, &peer{client: &client{}})
+	}
+	require.Equal(t, 10, len(r.sample(chihaya.InfoHash{2}, chihaya.PeerID{0xff, 0xff}, false, 10)))
+	require.Equal(t, maxSampleScan, len(r.sample(chihaya.InfoHash{2}, chihaya.PeerID{0xff, 0xff}, false, 2*maxSampleScan)))
+	require.Empty(t, r.sample(ih, chihaya.PeerID{}, true, 10))
+}
+
+func TestDecodeID(t *testing.T) {
+	var table = []struct {
+		in    string
+		id    string
+		isHex bool
+		ok    bool
+	}{
+		{"aaaaaaaaaaaaaaaaaaaa", "aaaaaaaaaaaaaaaaaaaa", false, true},
+		{"6161616161616161616161616161616161616161", "aaaaaaaaaaaaaaaaaaaa", true, true},
+		{"ÿþýaaaaaaaaaaaaaaaaa", "\xff\xfe\xfdaaaaaaaaaaaaaaaaa", false, true},
+		{"aaaaaaaaaaaaaaaaaaa", "", false, false},
+		{"aaaaaaaaaaaaaaaaaaaaa", "", false, false},
+		{"Āaaaaaaaaaaaaaaaaaaa", "", false, false},
+	}
+
+	for _, tt := range table {
+		id, isHex, ok := decodeID(tt.in)
+		require.Equal(t, tt.ok, ok, tt.in)
+		if !ok {
+			continue
+		}
+		require.Equal(t, tt.id, string(id[:]), tt.in)
+		require.Equal(t, tt.isHex, isHex, tt.in)
+		require.Equal(t, tt.in, encodeID(id, isHex), tt.in)
+	}
+
+}
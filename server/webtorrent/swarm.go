@@ -0,0 +1,198 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package webtorrent
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/chihaya/chihaya"
+)
+
+// peer is a WebTorrent peer announced by a client.
+type peer struct {
+	client *client
+	seeder bool
+
+	// hex is true if the client sends IDs as hex strings.
+	hex bool
+}
+
+// maxSampleScan is the number of peers of a swarm sample considers at most,
+// so that announces to large swarms do not pass over every peer while the
+// registry is locked. Map iteration starts at a random peer, so the
+// considered peers still vary between announces.
+const maxSampleScan = 1024
+
+// swarm holds the peers of a swarm and the number of seeders among them.
+type swarm struct {
+	peers   map[chihaya.PeerID]*peer
+	seeders int
+}
+
+// registry holds the peers of all swarms together with the connection they
+// were announced on.
+type registry struct {
+	sync.Mutex
+	swarms map[chihaya.InfoHash]*swarm
+
+	// joined holds the swarms every client announced a peer in.
+	joined map[*client]map[chihaya.InfoHash]chihaya.PeerID
+}
+
+func newRegistry() *registry {
+	return &registry{
+		swarms: make(map[chihaya.InfoHash]*swarm),
+		joined: make(map[*client]map[chihaya.InfoHash]chihaya.PeerID),
+	}
+}
+
+// put adds a peer to a swarm or updates it.
+//
+// A peer that announces on a new connection replaces the peer with the same
+// ID, a client that announces a new ID replaces its previous peer.
+func (r *registry) put(infoHash chihaya.InfoHash, peerID chihaya.PeerID, p *peer) {
+	r.Lock()
+	defer r.Unlock()
+
+	joined, ok := r.joined[p.client]
+	if !ok {
+		joined = make(map[chihaya.InfoHash]chihaya.PeerID)
+		r.joined[p.client] = joined
+	}
+	if previous, ok := joined[infoHash]; ok && previous != peerID {
+		r.remove(infoHash, previous, p.client)
+	}
+
+	sw, ok := r.swarms[infoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[chihaya.PeerID]*peer)}
+		r.swarms[infoHash] = sw
+	}
+	if existing, ok := sw.peers[peerID]; ok {
+		if existing.client != p.client {
+			delete(r.joined[existing.client], infoHash)
+		}
+		if existing.seeder {
+			sw.seeders--
+		}
+	}
+
+	sw.peers[peerID] = p
+	if p.seeder {
+		sw.seeders++
+	}
+	joined[infoHash] = peerID
+}
+
+// delete removes a peer from a swarm if it was announced by c.
+func (r *registry) delete(infoHash chihaya.InfoHash, peerID chihaya.PeerID, c *client) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.remove(infoHash, peerID, c)
+}
+
+// deleteClient removes all peers announced by c.
+func (r *registry) deleteClient(c *client) {
+	r.Lock()
+	defer r.Unlock()
+
+	for infoHash, peerID := range r.joined[c] {
+		r.remove(infoHash, peerID, c)
+	}
+	delete(r.joined, c)
+}
+
+// remove removes a peer from a swarm if it was announced by c.
+//
+// The caller must hold the lock.
+func (r *registry) remove(infoHash chihaya.InfoHash, peerID chihaya.PeerID, c *client) {
+	sw := r.swarms[infoHash]
+	if sw == nil {
+		return
+	}
+	if p, ok := sw.peers[peerID]; ok && p.client == c {
+		delete(sw.peers, peerID)
+		if p.seeder {
+			sw.seeders--
+		}
+		if len(sw.peers) == 0 {
+			delete(r.swarms, infoHash)
+		}
+	}
+
+	if r.joined[c][infoHash] == peerID {
+		delete(r.joined[c], infoHash)
+	}
+}
+
+// get returns a peer if it was announced by c, or nil if c is nil.
+func (r *registry) get(infoHash chihaya.InfoHash, peerID chihaya.PeerID, c *client) *peer {
+	r.Lock()
+	defer r.Unlock()
+
+	sw := r.swarms[infoHash]
+	if sw == nil {
+		return nil
+	}
+	p := sw.peers[peerID]
+	if p == nil || (c != nil && p.client != c) {
+		return nil
+	}
+	return p
+}
+
+// counts returns the numbers of seeders and leechers in a swarm.
+func (r *registry) counts(infoHash chihaya.InfoHash) (complete, incomplete int) {
+	r.Lock()
+	defer r.Unlock()
+
+	sw := r.swarms[infoHash]
+	if sw == nil {
+		return 0, 0
+	}
+	return sw.seeders, len(sw.peers) - sw.seeders
+}
+
+// sample returns up to n random peers of a swarm, excluding the given peer.
+// Seeders receive no seeders. The peers are sampled from at most
+// maxSampleScan peers of the swarm.
+func (r *registry) sample(infoHash chihaya.InfoHash, exclude chihaya.PeerID, seeder bool, n int) map[chihaya.PeerID]*peer {
+	r.Lock()
+	defer r.Unlock()
+
+	sw := r.swarms[infoHash]
+	if sw == nil || n <= 0 {
+		return nil
+	}
+
+	// Reservoir sampling: the i-th candidate replaces one of the sampled
+	// ones with a probability of n/i.
+	ids := make([]chihaya.PeerID, 0, n)
+	var seen, scanned int
+	for id, p := range sw.peers {
+		if scanned == maxSampleScan {
+			break
+		}
+		scanned++
+		if id == exclude || seeder && p.seeder {
+			continue
+		}
+
+		seen++
+		if len(ids) < n {
+			ids = append(ids, id)
+		} else if i := rand.Intn(seen); i < n {
+			ids[i] = id
+		}
+	}
+
+	peers := make(map[chihaya.PeerID]*peer, len(ids))
+	for _, id := range ids {
+		peers[id] = sw.peers[id]
+	}
+	return peers
+}
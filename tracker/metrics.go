@@ -0,0 +1,51 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(announcesTotal, scrapesTotal, requestDuration)
+}
+
+var (
+	announcesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "announces_total",
+		Help:      "The number of announces handled, by result.",
+	}, []string{"result"})
+
+	scrapesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "scrapes_total",
+		Help:      "The number of scrapes handled, by result.",
+	}, []string{"result"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chihaya",
+		Subsystem: "tracker",
+		Name:      "request_duration_seconds",
+		Help:      "The time it took to run a request through the middleware, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"endpoint"})
+)
+
+// recordRequest records the outcome of a request to endpoint that was
+// started at start.
+func recordRequest(counter *prometheus.CounterVec, endpoint string, start time.Time, err error) {
+	requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	counter.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+func counterValue(t *testing.T, counter *prometheus.CounterVec, result string) float64 {
+	var m dto.Metric
+	require.Nil(t, counter.WithLabelValues(result).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, endpoint string) uint64 {
+	var m dto.Metric
+	require.Nil(t, requestDuration.WithLabelValues(endpoint).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func failingAnnounceMW(next AnnounceHandler) AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		return errors.New("failing announce")
+	}
+}
+
+func TestAnnounceMetrics(t *testing.T) {
+	successes := counterValue(t, announcesTotal, "success")
+	failures := counterValue(t, announcesTotal, "failure")
+	observed := histogramCount(t, "announce")
+
+	tkr, err := NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+
+	_, err = tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, successes+1, counterValue(t, announcesTotal, "success"))
+	require.Equal(t, failures, counterValue(t, announcesTotal, "failure"))
+	require.Equal(t, observed+1, histogramCount(t, "announce"))
+
+	var achain AnnounceChain
+	achain.Append(failingAnnounceMW)
+	tkr.chains.Store(&chains{cfg: &chihaya.TrackerConfig{}, handleAnnounce: achain.Handler()})
+
+	_, err = tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.NotNil(t, err)
+	require.Equal(t, successes+1, counterValue(t, announcesTotal, "success"))
+	require.Equal(t, failures+1, counterValue(t, announcesTotal, "failure"))
+	require.Equal(t, observed+2, histogramCount(t, "announce"))
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	successes := counterValue(t, scrapesTotal, "success")
+	observed := histogramCount(t, "scrape")
+
+	tkr, err := NewTracker(&chihaya.TrackerConfig{})
+	require.Nil(t, err)
+
+	_, err = tkr.HandleScrape(&chihaya.ScrapeRequest{})
+	require.Nil(t, err)
+	require.Equal(t, successes+1, counterValue(t, scrapesTotal, "success"))
+	require.Equal(t, observed+1, histogramCount(t, "scrape"))
+}
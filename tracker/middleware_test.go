@@ -5,9 +5,11 @@
 package tracker
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya"
 )
@@ -50,3 +52,67 @@ func TestAnnounceChain(t *testing.T) {
 	assert.Nil(t, err, "the handler should not return an error")
 	assert.Equal(t, resp.IPv4Peers, []chihaya.Peer{{Port: 1}, {Port: 2}, {Port: 3}}, "the list of peers added from the middleware should be in the same order.")
 }
+
+func init() {
+	RegisterAnnounceMiddlewareConstructor("test_port", func(c chihaya.MiddlewareConfig) (AnnounceMiddleware, error) {
+		params, _ := c.Config.(map[string]interface{})
+		port, ok := params["port"].(int)
+		if !ok {
+			return nil, errors.New("port is required")
+		}
+		return func(next AnnounceHandler) AnnounceHandler {
+			return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+				resp.IPv4Peers = append(resp.IPv4Peers, chihaya.Peer{Port: uint16(port)})
+				return next(cfg, req, resp)
+			}
+		}, nil
+	})
+}
+
+func TestChainFromConfig(t *testing.T) {
+	port := func(p int) chihaya.MiddlewareConfig {
+		return chihaya.MiddlewareConfig{Name: "test_port", Config: map[string]interface{}{"port": p}}
+	}
+
+	// the chain runs the middleware in the order of the configuration, each
+	// with its own parameters
+	tkr, err := NewTracker(&chihaya.TrackerConfig{
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{port(3), port(1), port(2)},
+	})
+	require.Nil(t, err)
+	resp, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, []chihaya.Peer{{Port: 3}, {Port: 1}, {Port: 2}}, resp.IPv4Peers)
+
+	var table = []struct {
+		cfg *chihaya.TrackerConfig
+		err string
+	}{
+		{
+			&chihaya.TrackerConfig{AnnounceMiddleware: []chihaya.MiddlewareConfig{port(1), {Name: "test_nonexistent"}}},
+			`unknown announce middleware "test_nonexistent", registered ones are: `,
+		},
+		{
+			&chihaya.TrackerConfig{ScrapeMiddleware: []chihaya.MiddlewareConfig{{Name: "test_nonexistent"}}},
+			`unknown scrape middleware "test_nonexistent"`,
+		},
+		{
+			&chihaya.TrackerConfig{ScrapeMiddleware: []chihaya.MiddlewareConfig{port(1)}},
+			`middleware "test_port" can not handle scrapes`,
+		},
+		{
+			&chihaya.TrackerConfig{AnnounceMiddleware: []chihaya.MiddlewareConfig{{Name: "test_port"}}},
+			`failed to load announce middleware "test_port": port is required`,
+		},
+	}
+
+	for _, tt := range table {
+		_, err := NewTracker(tt.cfg)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), tt.err)
+	}
+
+	// the registered middleware are listed for unknown ones
+	_, err = NewTracker(table[0].cfg)
+	require.Contains(t, err.Error(), "test_port")
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya"
+)
+
+// TraceStep is the record of one middleware in a Trace.
+type TraceStep struct {
+	// Middleware is the name the middleware is configured with.
+	Middleware string
+
+	// Duration is the time spent in the middleware itself, without the
+	// middleware after it.
+	Duration time.Duration
+
+	// Aborted is true if the middleware returned without passing the
+	// request on to the rest of the chain.
+	Aborted bool
+}
+
+// Outcome returns "abort" if the middleware of s aborted the request, and
+// "pass" otherwise.
+func (s TraceStep) Outcome() string {
+	if s.Aborted {
+		return "abort"
+	}
+	return "pass"
+}
+
+// Trace records the middleware a request has run through, if trace_middleware
+// is enabled in the configuration of the tracker. A nil Trace records nothing.
+type Trace struct {
+	mu    sync.Mutex
+	steps []TraceStep
+
+	// running are the indexes of the steps whose middleware has not
+	// returned yet, innermost last, and since is the time the innermost
+	// one last started or resumed running. It is zero while the innermost
+	// one waits for the rest of the chain.
+	running []int
+	since   time.Time
+}
+
+type traceContextKey struct{}
+
+// WithTrace returns a copy of ctx that carries a new Trace, along with the
+// Trace. Requests with such a context are traced by the Tracker, so that
+// servers can export the Trace once the request is handled.
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{}
+	return context.WithValue(ctx, traceContextKey{}, t), t
+}
+
+// TraceFromContext returns the Trace carried by ctx, or nil if it carries
+// none.
+func TraceFromContext(ctx context.Context) *Trace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(traceContextKey{}).(*Trace)
+	return t
+}
+
+// Steps returns the steps of the Trace in the order their middleware was run
+// in.
+func (t *Trace) Steps() []TraceStep {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	steps := append([]TraceStep(nil), t.steps...)
+	t.mu.Unlock()
+	return steps
+}
+
+// String formats the Trace for logging, e.g. "jwt:pass(120µs),
+// ratelimit:abort(8µs)".
+func (t *Trace) String() string {
+	steps := t.Steps()
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		parts[i] = fmt.Sprintf("%s:%s(%s)", s.Middleware, s.Outcome(), s.Duration)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ServerTiming formats the Trace as the value of a Server-Timing header, with
+// the durations in milliseconds and the outcomes as descriptions.
+func (t *Trace) ServerTiming() string {
+	steps := t.Steps()
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		parts[i] = fmt.Sprintf("%s;dur=%.3f;desc=%q", s.Middleware, float64(s.Duration)/float64(time.Millisecond), s.Outcome())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// begin records that the middleware called name starts running. It is
+// aborted until it passes the request on.
+func (t *Trace) begin(name string) {
+	t.mu.Lock()
+	now := time.Now()
+	t.pauseLocked(now)
+	t.steps = append(t.steps, TraceStep{Middleware: name, Aborted: true})
+	t.running = append(t.running, len(t.steps)-1)
+	t.since = now
+	t.mu.Unlock()
+}
+
+// end records that the innermost running middleware returned. The one it
+// was called by resumes once the rest of its chain has returned.
+func (t *Trace) end() {
+	t.mu.Lock()
+	t.pauseLocked(time.Now())
+	t.running = t.running[:len(t.running)-1]
+	t.mu.Unlock()
+}
+
+// pass records that the innermost running middleware passes the request on,
+// so that the time until resume is not accounted to it.
+func (t *Trace) pass() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if len(t.running) > 0 {
+		t.pauseLocked(time.Now())
+		t.steps[t.running[len(t.running)-1]].Aborted = false
+	}
+	t.mu.Unlock()
+}
+
+// resume records that the rest of the chain returned to the innermost running
+// middleware.
+func (t *Trace) resume() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.since = time.Now()
+	t.mu.Unlock()
+}
+
+// pauseLocked accounts the time since t.since to the innermost running
+// middleware.
+func (t *Trace) pauseLocked(now time.Time) {
+	if len(t.running) > 0 && !t.since.IsZero() {
+		t.steps[t.running[len(t.running)-1]].Duration += now.Sub(t.since)
+	}
+	t.since = time.Time{}
+}
+
+// traceAnnounce wraps the AnnounceMiddleware called name so that it is
+// recorded in the Traces of the requests it handles.
+func traceAnnounce(name string, mw AnnounceMiddleware) AnnounceMiddleware {
+	return func(next AnnounceHandler) AnnounceHandler {
+		handle := mw(func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			t := TraceFromContext(req.Context())
+			t.pass()
+			err := next(cfg, req, resp)
+			t.resume()
+			return err
+		})
+
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			t := TraceFromContext(req.Context())
+			if t == nil {
+				return handle(cfg, req, resp)
+			}
+			t.begin(name)
+			err := handle(cfg, req, resp)
+			t.end()
+			return err
+		}
+	}
+}
+
+// traceScrape wraps the ScrapeMiddleware called name so that it is recorded
+// in the Traces of the requests it handles.
+func traceScrape(name string, mw ScrapeMiddleware) ScrapeMiddleware {
+	return func(next ScrapeHandler) ScrapeHandler {
+		handle := mw(func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			t := TraceFromContext(req.Context())
+			t.pass()
+			err := next(cfg, req, resp)
+			t.resume()
+			return err
+		})
+
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			t := TraceFromContext(req.Context())
+			if t == nil {
+				return handle(cfg, req, resp)
+			}
+			t.begin(name)
+			err := handle(cfg, req, resp)
+			t.end()
+			return err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+)
+
+func init() {
+	RegisterAnnounceMiddleware("trace_test_slow", func(next AnnounceHandler) AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			time.Sleep(20 * time.Millisecond)
+			return next(cfg, req, resp)
+		}
+	})
+	RegisterAnnounceMiddleware("trace_test_pass", func(next AnnounceHandler) AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			return next(cfg, req, resp)
+		}
+	})
+	RegisterAnnounceMiddleware("trace_test_reject", rejectingAnnounceMW)
+	RegisterScrapeMiddleware("trace_test_pass", func(next ScrapeHandler) ScrapeHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.ScrapeRequest, resp *chihaya.ScrapeResponse) error {
+			return next(cfg, req, resp)
+		}
+	})
+}
+
+func traceTestTracker(t *testing.T, trace bool) *Tracker {
+	tkr, err := NewTracker(&chihaya.TrackerConfig{
+		TraceMiddleware: trace,
+		AnnounceMiddleware: []chihaya.MiddlewareConfig{
+			{Name: "trace_test_pass"},
+			{Name: "trace_test_slow"},
+			{Name: "trace_test_reject"},
+			{Name: "trace_test_pass"},
+		},
+		ScrapeMiddleware: []chihaya.MiddlewareConfig{{Name: "trace_test_pass"}},
+	})
+	require.Nil(t, err)
+	return tkr
+}
+
+func TestTraceAbortingMiddleware(t *testing.T) {
+	tkr := traceTestTracker(t, true)
+
+	ctx, trace := WithTrace(context.Background())
+	_, err := tkr.HandleAnnounce((&chihaya.AnnounceRequest{}).WithContext(ctx))
+	require.Equal(t, ClientError("rejected"), err)
+
+	// the middleware after the aborting one is not run
+	steps := trace.Steps()
+	require.Equal(t, 3, len(steps))
+	for i, expected := range []struct {
+		name    string
+		aborted bool
+	}{
+		{"trace_test_pass", false},
+		{"trace_test_slow", false},
+		{"trace_test_reject", true},
+	} {
+		require.Equal(t, expected.name, steps[i].Middleware)
+		require.Equal(t, expected.aborted, steps[i].Aborted, expected.name)
+	}
+
+	// the time spent in the rest of the chain is not accounted to the
+	// middleware that passed the request on
+	require.True(t, steps[1].Duration >= 20*time.Millisecond, "%s", steps[1].Duration)
+	require.True(t, steps[0].Duration < 20*time.Millisecond, "%s", steps[0].Duration)
+
+	require.Contains(t, trace.String(), "trace_test_reject:abort(")
+	require.Contains(t, trace.ServerTiming(), `trace_test_reject;dur=`)
+	require.Contains(t, trace.ServerTiming(), `;desc="abort"`)
+}
+
+func TestTraceLog(t *testing.T) {
+	buf := captureLogs(t)
+	tkr := traceTestTracker(t, true)
+
+	_, err := tkr.HandleScrape(&chihaya.ScrapeRequest{})
+	require.Nil(t, err)
+
+	var traced bool
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+		if line["msg"] == "scrape middleware trace" {
+			traced = true
+			require.Contains(t, line["middleware"], "trace_test_pass:pass(")
+		}
+	}
+	require.True(t, traced)
+}
+
+func TestTraceDisabled(t *testing.T) {
+	tkr := traceTestTracker(t, false)
+
+	// without trace_middleware, traces stay empty
+	ctx, trace := WithTrace(context.Background())
+	_, err := tkr.HandleAnnounce((&chihaya.AnnounceRequest{}).WithContext(ctx))
+	require.Equal(t, ClientError("rejected"), err)
+	require.Empty(t, trace.Steps())
+	require.Nil(t, TraceFromContext(context.Background()).Steps())
+}
@@ -7,10 +7,15 @@
 package tracker
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
 )
 
 // ClientError represents an error that should be exposed to the client over
@@ -20,9 +25,31 @@ type ClientError string
 // Error implements the error interface for ClientError.
 func (c ClientError) Error() string { return string(c) }
 
+// RetryError represents a ClientError after which the client should not retry
+// its request before RetryIn has passed.
+type RetryError struct {
+	Reason  ClientError
+	RetryIn time.Duration
+}
+
+// Error implements the error interface for RetryError.
+func (e RetryError) Error() string { return e.Reason.Error() }
+
 // Tracker represents a protocol-independent, middleware-composed BitTorrent
 // tracker.
 type Tracker struct {
+	chains   atomic.Pointer[chains]
+	draining atomic.Bool
+}
+
+// defaultDrainInterval is the interval handed out while draining if the
+// configuration does not set one.
+const defaultDrainInterval = time.Minute
+
+// chains are the middleware chains of a Tracker, along with the configuration
+// they were built from. They are replaced as a whole when the Tracker is
+// reloaded.
+type chains struct {
 	cfg            *chihaya.TrackerConfig
 	handleAnnounce AnnounceHandler
 	handleScrape   ScrapeHandler
@@ -31,16 +58,55 @@ type Tracker struct {
 // NewTracker constructs a newly allocated Tracker composed of the middleware
 // in the provided configuration.
 func NewTracker(cfg *chihaya.TrackerConfig) (*Tracker, error) {
+	c, err := newChains(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tracker{}
+	t.chains.Store(c)
+	return t, nil
+}
+
+// Reload replaces the middleware and configuration of the Tracker with the
+// ones of cfg.
+//
+// The new middleware is constructed completely before it replaces the old
+// one. Requests that are being handled finish on the old middleware, all
+// requests handled afterwards run through the new one. Middleware that keeps
+// state, like ratelimit, starts over.
+// If any middleware of cfg fails to load, an error is returned and the
+// Tracker is left unchanged.
+func (t *Tracker) Reload(cfg *chihaya.TrackerConfig) error {
+	c, err := newChains(cfg)
+	if err != nil {
+		return err
+	}
+
+	t.chains.Store(c)
+	return nil
+}
+
+// Config returns the configuration the Tracker was last built or reloaded
+// with.
+func (t *Tracker) Config() *chihaya.TrackerConfig {
+	return t.chains.Load().cfg
+}
+
+func newChains(cfg *chihaya.TrackerConfig) (*chains, error) {
 	var achain AnnounceChain
 	for _, mwConfig := range cfg.AnnounceMiddleware {
 		mw, ok := announceMiddlewareConstructors[mwConfig.Name]
 		if !ok {
-			return nil, errors.New("failed to find announce middleware: " + mwConfig.Name)
+			return nil, unknownMiddleware("announce", mwConfig.Name, announceMiddlewareConstructors, scrapeMiddlewareConstructors)
 		}
 		middleware, err := mw(mwConfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load announce middleware %q: %s", mwConfig.Name, err.Error())
 		}
+		if cfg.TraceMiddleware {
+			middleware = traceAnnounce(mwConfig.Name, middleware)
+		}
 		achain.Append(middleware)
 	}
 
@@ -48,36 +114,154 @@ func NewTracker(cfg *chihaya.TrackerConfig) (*Tracker, error) {
 	for _, mwConfig := range cfg.ScrapeMiddleware {
 		mw, ok := scrapeMiddlewareConstructors[mwConfig.Name]
 		if !ok {
-			return nil, errors.New("failed to find scrape middleware: " + mwConfig.Name)
+			return nil, unknownMiddleware("scrape", mwConfig.Name, scrapeMiddlewareConstructors, announceMiddlewareConstructors)
 		}
 		middleware, err := mw(mwConfig)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load scrape middleware %q: %s", mwConfig.Name, err.Error())
 		}
+		if cfg.TraceMiddleware {
+			middleware = traceScrape(mwConfig.Name, middleware)
+		}
 		schain.Append(middleware)
 	}
 
-	return &Tracker{
+	return &chains{
 		cfg:            cfg,
 		handleAnnounce: achain.Handler(),
 		handleScrape:   schain.Handler(),
 	}, nil
 }
 
+// unknownMiddleware returns the error for a middleware called name that is
+// not registered as a middleware of kind. It tells if it is registered as
+// the other kind of middleware, and lists the ones of kind otherwise.
+func unknownMiddleware[C, O any](kind, name string, registered map[string]C, other map[string]O) error {
+	if _, ok := other[name]; ok {
+		return fmt.Errorf("middleware %q can not handle %ss, remove it from the %s middleware", name, kind, kind)
+	}
+
+	names := make([]string, 0, len(registered))
+	for n := range registered {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown %s middleware %q, registered ones are: %s", kind, name, strings.Join(names, ", "))
+}
+
 // HandleAnnounce runs an AnnounceRequest through the Tracker's middleware and
 // returns the result.
+//
+// If the context of the request carries no request ID, a new one is assigned
+// to it.
 func (t *Tracker) HandleAnnounce(req *chihaya.AnnounceRequest) (*chihaya.AnnounceResponse, error) {
+	start := time.Now()
+	if log.RequestID(req.Context()) == "" {
+		req = req.WithContext(log.WithRequestID(req.Context(), log.NewRequestID()))
+	}
+	log.DebugContext(req.Context(), "handling announce",
+		"infohash", fmt.Sprintf("%x", req.InfoHash[:]),
+		"event", req.Event.String())
+
+	c := t.chains.Load()
+	if c.cfg.TraceMiddleware && TraceFromContext(req.Context()) == nil {
+		ctx, _ := WithTrace(req.Context())
+		req = req.WithContext(ctx)
+	}
+
 	resp := &chihaya.AnnounceResponse{}
-	err := t.handleAnnounce(t.cfg, req, resp)
+	err := c.handleAnnounce(c.cfg, req, resp)
+	if err == nil && t.draining.Load() {
+		drain(c.cfg, resp)
+	}
+	recordRequest(announcesTotal, "announce", start, err)
+	logResult(req.Context(), "announce", start, err)
+	logTrace(req.Context(), "announce")
 	return resp, err
 }
 
+// Drain makes the Tracker hand out short intervals, so that clients announce
+// to another instance soon, e.g. before this one is shut down. Announces are
+// still handled as usual otherwise.
+func (t *Tracker) Drain() {
+	if !t.draining.Swap(true) {
+		log.Info("draining tracker")
+	}
+}
+
+// StopDraining makes the Tracker hand out the usual intervals again.
+func (t *Tracker) StopDraining() {
+	if t.draining.Swap(false) {
+		log.Info("stopped draining tracker")
+	}
+}
+
+// Draining reports whether the Tracker is draining.
+func (t *Tracker) Draining() bool {
+	return t.draining.Load()
+}
+
+// drain caps the intervals of resp at the drain interval of cfg.
+func drain(cfg *chihaya.TrackerConfig, resp *chihaya.AnnounceResponse) {
+	interval := cfg.DrainInterval
+	if interval <= 0 {
+		interval = defaultDrainInterval
+	}
+	if resp.Interval > interval {
+		resp.Interval = interval
+	}
+	if resp.MinInterval > interval {
+		resp.MinInterval = interval
+	}
+}
+
 // HandleScrape runs a ScrapeRequest through the Tracker's middleware and
 // returns the result.
+//
+// If the context of the request carries no request ID, a new one is assigned
+// to it.
 func (t *Tracker) HandleScrape(req *chihaya.ScrapeRequest) (*chihaya.ScrapeResponse, error) {
+	start := time.Now()
+	if log.RequestID(req.Context()) == "" {
+		req = req.WithContext(log.WithRequestID(req.Context(), log.NewRequestID()))
+	}
+	log.DebugContext(req.Context(), "handling scrape", "infohashes", len(req.InfoHashes))
+
+	c := t.chains.Load()
+	if c.cfg.TraceMiddleware && TraceFromContext(req.Context()) == nil {
+		ctx, _ := WithTrace(req.Context())
+		req = req.WithContext(ctx)
+	}
+
 	resp := &chihaya.ScrapeResponse{
 		Files: make(map[chihaya.InfoHash]chihaya.Scrape),
 	}
-	err := t.handleScrape(t.cfg, req, resp)
+	err := c.handleScrape(c.cfg, req, resp)
+	recordRequest(scrapesTotal, "scrape", start, err)
+	logResult(req.Context(), "scrape", start, err)
+	logTrace(req.Context(), "scrape")
 	return resp, err
 }
+
+// logResult logs the outcome of a request. Requests rejected by middleware
+// are logged at the debug level, failed requests at the error level.
+func logResult(ctx context.Context, kind string, start time.Time, err error) {
+	duration := time.Since(start)
+	switch err.(type) {
+	case nil:
+		log.DebugContext(ctx, kind+" handled", "duration", duration)
+	case ClientError, RetryError:
+		log.DebugContext(ctx, kind+" rejected", "reason", err.Error(), "duration", duration)
+	default:
+		log.ErrorContext(ctx, kind+" failed", "error", err, "duration", duration)
+	}
+}
+
+// logTrace logs the Trace of a request at the debug level, if it has one.
+func logTrace(ctx context.Context, kind string) {
+	t := TraceFromContext(ctx)
+	if len(t.Steps()) == 0 {
+		return
+	}
+	log.DebugContext(ctx, kind+" middleware trace", "middleware", t.String())
+}
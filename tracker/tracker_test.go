@@ -0,0 +1,254 @@
+// Copyright 2016 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+func loggingAnnounceMW(next AnnounceHandler) AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		log.InfoContext(req.Context(), "test middleware")
+		return next(cfg, req, resp)
+	}
+}
+
+func rejectingAnnounceMW(next AnnounceHandler) AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		return ClientError("rejected")
+	}
+}
+
+// captureLogs makes the default logger write JSON at the debug level to the
+// returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := log.New(&buf, log.Config{Level: "debug", Format: "json"})
+	require.Nil(t, err)
+
+	previous := log.Default()
+	log.SetDefault(logger)
+	t.Cleanup(func() { log.SetDefault(previous) })
+	return &buf
+}
+
+// requestIDs returns the request IDs of the JSON lines in buf in order.
+func requestIDs(t *testing.T, buf *bytes.Buffer) []string {
+	var ids []string
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+		id, _ := line[log.RequestIDKey].(string)
+		ids = append(ids, id)
+	}
+	require.Nil(t, scanner.Err())
+	return ids
+}
+
+func TestRequestIDs(t *testing.T) {
+	buf := captureLogs(t)
+
+	var achain AnnounceChain
+	achain.Append(loggingAnnounceMW, rejectingAnnounceMW)
+	tkr := &Tracker{}
+	tkr.chains.Store(&chains{cfg: &chihaya.TrackerConfig{}, handleAnnounce: achain.Handler()})
+
+	_, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.Equal(t, ClientError("rejected"), err)
+
+	// received, middleware and rejected
+	ids := requestIDs(t, buf)
+	require.Equal(t, 3, len(ids))
+	require.NotEqual(t, "", ids[0])
+	for _, id := range ids {
+		require.Equal(t, ids[0], id)
+	}
+
+	_, err = tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.Equal(t, ClientError("rejected"), err)
+	other := requestIDs(t, buf)
+	require.Equal(t, 3, len(other))
+	require.NotEqual(t, ids[0], other[0])
+
+	// IDs assigned by frontends are kept.
+	req := (&chihaya.AnnounceRequest{}).WithContext(log.WithRequestID(context.Background(), "frontend"))
+	_, err = tkr.HandleAnnounce(req)
+	require.Equal(t, ClientError("rejected"), err)
+	require.Equal(t, []string{"frontend", "frontend", "frontend"}, requestIDs(t, buf))
+}
+
+// markerAnnounceMW returns a middleware that appends a peer with the port
+// marker to the response.
+func markerAnnounceMW(marker uint16) AnnounceMiddleware {
+	return func(next AnnounceHandler) AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			resp.IPv4Peers = append(resp.IPv4Peers, chihaya.Peer{Port: marker})
+			return next(cfg, req, resp)
+		}
+	}
+}
+
+// intervalAnnounceMW copies the announce interval of the configuration the
+// chain was built with into the response.
+func intervalAnnounceMW(next AnnounceHandler) AnnounceHandler {
+	return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+		resp.Interval = cfg.AnnounceInterval
+		return next(cfg, req, resp)
+	}
+}
+
+func init() {
+	for _, marker := range []uint16{1, 2, 3} {
+		RegisterAnnounceMiddleware(fmt.Sprintf("test_marker_%d", marker), markerAnnounceMW(marker))
+	}
+	RegisterAnnounceMiddleware("test_interval", intervalAnnounceMW)
+	RegisterAnnounceMiddleware("test_min_interval", func(next AnnounceHandler) AnnounceHandler {
+		return func(cfg *chihaya.TrackerConfig, req *chihaya.AnnounceRequest, resp *chihaya.AnnounceResponse) error {
+			resp.MinInterval = 20 * time.Minute
+			return next(cfg, req, resp)
+		}
+	})
+	RegisterAnnounceMiddlewareConstructor("test_failing", func(chihaya.MiddlewareConfig) (AnnounceMiddleware, error) {
+		return nil, errors.New("failing constructor")
+	})
+}
+
+func reloadConfig(interval time.Duration, names ...string) *chihaya.TrackerConfig {
+	cfg := &chihaya.TrackerConfig{AnnounceInterval: interval}
+	for _, name := range append([]string{"test_interval"}, names...) {
+		cfg.AnnounceMiddleware = append(cfg.AnnounceMiddleware, chihaya.MiddlewareConfig{Name: name})
+	}
+	return cfg
+}
+
+func TestReload(t *testing.T) {
+	var (
+		forward      = reloadConfig(time.Minute, "test_marker_1", "test_marker_2", "test_marker_3")
+		forwardPeers = []chihaya.Peer{{Port: 1}, {Port: 2}, {Port: 3}}
+
+		backward      = reloadConfig(time.Hour, "test_marker_3", "test_marker_2")
+		backwardPeers = []chihaya.Peer{{Port: 3}, {Port: 2}}
+	)
+
+	tkr, err := NewTracker(forward)
+	require.Nil(t, err)
+
+	// Every response must have been made by one of the chains in full, with
+	// the configuration that chain was built with.
+	valid := func(resp *chihaya.AnnounceResponse) bool {
+		switch resp.Interval {
+		case time.Minute:
+			return reflect.DeepEqual(resp.IPv4Peers, forwardPeers)
+		case time.Hour:
+			return reflect.DeepEqual(resp.IPv4Peers, backwardPeers)
+		}
+		return false
+	}
+
+	stop := make(chan struct{})
+	invalid := make(chan *chihaya.AnnounceResponse, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resp, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+				if err != nil || !valid(resp) {
+					select {
+					case invalid <- resp:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		cfg := backward
+		if i%2 == 1 {
+			cfg = forward
+		}
+		require.Nil(t, tkr.Reload(cfg))
+
+		// Invalid configurations leave the chains intact.
+		require.NotNil(t, tkr.Reload(reloadConfig(time.Second, "test_marker_1", "test_failing")))
+		require.NotNil(t, tkr.Reload(reloadConfig(time.Second, "test_marker_1", "test_unknown")))
+	}
+	close(stop)
+	wg.Wait()
+
+	select {
+	case resp := <-invalid:
+		t.Fatalf("invalid response during reloads: %+v", resp)
+	default:
+	}
+
+	resp, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+	require.Equal(t, forwardPeers, resp.IPv4Peers)
+}
+
+func TestDrain(t *testing.T) {
+	cfg := reloadConfig(30*time.Minute, "test_min_interval")
+	tkr, err := NewTracker(cfg)
+	require.Nil(t, err)
+
+	announce := func() *chihaya.AnnounceResponse {
+		resp, err := tkr.HandleAnnounce(&chihaya.AnnounceRequest{})
+		require.Nil(t, err)
+		return resp
+	}
+
+	resp := announce()
+	require.Equal(t, 30*time.Minute, resp.Interval)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+
+	// Draining trackers cap the intervals of the responses.
+	tkr.Drain()
+	require.True(t, tkr.Draining())
+	resp = announce()
+	require.Equal(t, defaultDrainInterval, resp.Interval)
+	require.Equal(t, defaultDrainInterval, resp.MinInterval)
+
+	cfg.DrainInterval = 10 * time.Second
+	resp = announce()
+	require.Equal(t, 10*time.Second, resp.Interval)
+	require.Equal(t, 10*time.Second, resp.MinInterval)
+
+	// Shorter intervals are kept.
+	cfg.DrainInterval = 25 * time.Minute
+	resp = announce()
+	require.Equal(t, 25*time.Minute, resp.Interval)
+	require.Equal(t, 20*time.Minute, resp.MinInterval)
+
+	tkr.StopDraining()
+	require.False(t, tkr.Draining())
+	resp = announce()
+	require.Equal(t, 30*time.Minute, resp.Interval)
+}